@@ -28,6 +28,10 @@ import (
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
 
+// ErrProfileNotExists is returned by RetrieveUserProfile when neither the
+// local database nor any application service knows about the user.
+var ErrProfileNotExists = errors.New("no known profile for given user ID")
+
 // AppServiceInternalAPI is used to query user and room alias data from application
 // services
 type AppServiceInternalAPI interface {
@@ -188,7 +192,7 @@ func RetrieveUserProfile(
 
 	// If no user exists, return
 	if !userResp.UserIDExists {
-		return nil, errors.New("no known profile for given user ID")
+		return nil, ErrProfileNotExists
 	}
 
 	// Try to query the user from the local database again
@@ -8,18 +8,23 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/dendrite/appservice"
 	"github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/appservice/inthttp"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/roomserver"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
 
 	"github.com/matrix-org/dendrite/test/testrig"
 )
@@ -152,6 +157,99 @@ func TestAppserviceInternalAPI(t *testing.T) {
 	})
 }
 
+func TestAppserviceCreatesOnDemand(t *testing.T) {
+	const hsToken = "hs_token"
+	var usrAPI uapi.UserInternalAPI
+
+	// The dummy AS only implements the v1 user query, creating the user when
+	// asked about it, and the legacy room alias query.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+hsToken {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/_matrix/app/v1/users/"):
+			userID := strings.TrimPrefix(r.URL.Path, "/_matrix/app/v1/users/")
+			localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+			if err != nil || localpart != "as-ondemand" {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errcode":"M_NOT_FOUND"}`))
+				return
+			}
+			if err = usrAPI.PerformAccountCreation(r.Context(), &uapi.PerformAccountCreationRequest{
+				AccountType:  uapi.AccountTypeAppService,
+				Localpart:    localpart,
+				AppServiceID: "someID",
+			}, &uapi.PerformAccountCreationResponse{}); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write([]byte(`{}`))
+		case r.URL.Path == "/rooms/#asroom-legacy:test":
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errcode":"M_UNRECOGNIZED"}`))
+		}
+	}))
+	defer srv.Close()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, closeBase := testrig.CreateBaseDendrite(t, dbType)
+		defer closeBase()
+
+		base.Cfg.AppServiceAPI.Derived.ApplicationServices = []config.ApplicationService{
+			{
+				ID:              "someID",
+				URL:             srv.URL,
+				HSToken:         hsToken,
+				SenderLocalpart: "senderLocalPart",
+				NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+					"users":   {{RegexpObject: regexp.MustCompile("as-.*")}},
+					"aliases": {{RegexpObject: regexp.MustCompile("asroom-.*")}},
+				},
+			},
+		}
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		usrAPI = userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, nil, rsAPI, nil)
+		asAPI := appservice.NewInternalAPI(base, usrAPI, rsAPI)
+		ctx := context.Background()
+
+		// The user doesn't exist yet, so looking up its profile must ask the AS
+		// to create it.
+		profile, err := api.RetrieveUserProfile(ctx, "@as-ondemand:test", asAPI, usrAPI)
+		if err != nil {
+			t.Fatalf("expected user to be created on demand: %s", err)
+		}
+		if profile.Localpart != "as-ondemand" {
+			t.Fatalf("unexpected localpart %q", profile.Localpart)
+		}
+		// Now the user is resolvable without the AS.
+		res := &uapi.QueryAccountByLocalpartResponse{}
+		if err = usrAPI.QueryAccountByLocalpart(ctx, &uapi.QueryAccountByLocalpartRequest{
+			Localpart: "as-ondemand", ServerName: "test",
+		}, res); err != nil || res.Account == nil {
+			t.Fatalf("expected account to exist after AS query: %v", err)
+		}
+
+		// Users the AS doesn't know about remain unknown.
+		if _, err = api.RetrieveUserProfile(ctx, "@as-unknown:test", asAPI, usrAPI); err != api.ErrProfileNotExists {
+			t.Fatalf("expected ErrProfileNotExists, got %v", err)
+		}
+		// Users outside the AS namespace aren't queried at all.
+		if _, err = api.RetrieveUserProfile(ctx, "@someone:test", asAPI, usrAPI); err != api.ErrProfileNotExists {
+			t.Fatalf("expected ErrProfileNotExists, got %v", err)
+		}
+
+		// Application services which don't implement the v1 path are queried
+		// on the legacy path instead.
+		testAliasExists(t, asAPI, "#asroom-legacy:test", true)
+		testAliasExists(t, asAPI, "#asroom-missing:test", false)
+	})
+}
+
 func testUserIDExists(t *testing.T, asAPI api.AppServiceInternalAPI, userID string, wantExists bool) {
 	ctx := context.Background()
 	userResp := &api.UserIDExistsResponse{}
@@ -221,3 +319,84 @@ func testProtocol(t *testing.T, asAPI api.AppServiceInternalAPI, proto string, w
 		t.Errorf("unexpected result for Protocols(%s): %+v, expected %+v", proto, protoResp.Protocols[proto], wantResult)
 	}
 }
+
+func TestAppserviceEventFilter(t *testing.T) {
+	alice := test.NewUser(t)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		var mu sync.Mutex
+		var received []gomatrixserverlib.ClientEvent
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, "/transactions/") {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var txn gomatrixserverlib.ApplicationServiceTransaction
+			if err := json.NewDecoder(r.Body).Decode(&txn); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			received = append(received, txn.Events...)
+			mu.Unlock()
+			_, _ = w.Write([]byte(`{}`))
+		}))
+		defer srv.Close()
+
+		base, closeBase := testrig.CreateBaseDendrite(t, dbType)
+		defer closeBase()
+
+		base.Cfg.AppServiceAPI.Derived.ApplicationServices = []config.ApplicationService{
+			{
+				ID:              "someID",
+				URL:             srv.URL,
+				HSToken:         "hs_token",
+				SenderLocalpart: "senderLocalPart",
+				NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+					"users": {{RegexpObject: regexp.MustCompile(regexp.QuoteMeta(alice.ID))}},
+				},
+				EventFilter: config.ApplicationServiceEventFilter{
+					NotTypes: []string{"m.room.message"},
+				},
+			},
+		}
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(nil, nil)
+		usrAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, nil, rsAPI, nil)
+		_ = appservice.NewInternalAPI(base, usrAPI, rsAPI)
+
+		room := test.NewRoom(t, alice)
+		room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "filtered out"})
+		topic := room.CreateAndInsert(t, alice, "m.room.topic", map[string]interface{}{"topic": "not filtered out"}, test.WithStateKey(""))
+		if err := rsapi.SendEvents(context.Background(), rsAPI, rsapi.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		// The topic is sent after the message, so once it has been delivered
+		// the message would have been too if it wasn't filtered out.
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			mu.Lock()
+			var gotTopic bool
+			for _, ev := range received {
+				if ev.Type == "m.room.message" {
+					mu.Unlock()
+					t.Fatalf("expected m.room.message to be filtered out, got %+v", ev)
+				}
+				if ev.EventID == topic.EventID() {
+					gotTopic = true
+				}
+			}
+			mu.Unlock()
+			if gotTopic {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the topic to be sent to the appservice")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+}
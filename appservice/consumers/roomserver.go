@@ -118,7 +118,9 @@ func (s *OutputRoomEventConsumer) onMessage(
 			if output.NewRoomEvent == nil || !s.appserviceIsInterestedInEvent(ctx, output.NewRoomEvent.Event, state.ApplicationService) {
 				continue
 			}
-			events = append(events, output.NewRoomEvent.Event)
+			if state.EventFilter.Allows(output.NewRoomEvent.Event.RoomID(), output.NewRoomEvent.Event.Type()) {
+				events = append(events, output.NewRoomEvent.Event)
+			}
 			if len(output.NewRoomEvent.AddsStateEventIDs) > 0 {
 				newEventID := output.NewRoomEvent.Event.EventID()
 				eventsReq := &api.QueryEventsByIDRequest{
@@ -135,7 +137,11 @@ func (s *OutputRoomEventConsumer) onMessage(
 						log.WithError(err).Errorf("s.rsAPI.QueryEventsByID failed")
 						return false
 					}
-					events = append(events, eventsRes.Events...)
+					for _, ev := range eventsRes.Events {
+						if state.EventFilter.Allows(ev.RoomID(), ev.Type()) {
+							events = append(events, ev)
+						}
+					}
 				}
 			}
 
@@ -143,6 +149,9 @@ func (s *OutputRoomEventConsumer) onMessage(
 			if output.NewInviteEvent == nil || !s.appserviceIsInterestedInEvent(ctx, output.NewInviteEvent.Event, state.ApplicationService) {
 				continue
 			}
+			if !state.EventFilter.Allows(output.NewInviteEvent.Event.RoomID(), output.NewInviteEvent.Event.Type()) {
+				continue
+			}
 			events = append(events, output.NewInviteEvent.Event)
 
 		default:
@@ -32,8 +32,12 @@ import (
 	"github.com/matrix-org/dendrite/setup/config"
 )
 
-const roomAliasExistsPath = "/rooms/"
-const userIDExistsPath = "/users/"
+const (
+	roomAliasExistsPath       = "/_matrix/app/v1/rooms/"
+	userIDExistsPath          = "/_matrix/app/v1/users/"
+	legacyRoomAliasExistsPath = "/rooms/"
+	legacyUserIDExistsPath    = "/users/"
+)
 
 // AppServiceQueryAPI is an implementation of api.AppServiceQueryAPI
 type AppServiceQueryAPI struct {
@@ -43,7 +47,7 @@ type AppServiceQueryAPI struct {
 	CacheMu       sync.Mutex
 }
 
-// RoomAliasExists performs a request to '/room/{roomAlias}' on all known
+// RoomAliasExists performs a request to '/rooms/{roomAlias}' on all known
 // handling application services until one admits to owning the room
 func (a *AppServiceQueryAPI) RoomAliasExists(
 	ctx context.Context,
@@ -54,54 +58,19 @@ func (a *AppServiceQueryAPI) RoomAliasExists(
 	defer span.Finish()
 
 	// Determine which application service should handle this request
-	for _, appservice := range a.Cfg.Derived.ApplicationServices {
+	for i := range a.Cfg.Derived.ApplicationServices {
+		appservice := &a.Cfg.Derived.ApplicationServices[i]
 		if appservice.URL != "" && appservice.IsInterestedInRoomAlias(request.Alias) {
-			// The full path to the rooms API, includes hs token
-			URL, err := url.Parse(appservice.URL + roomAliasExistsPath)
-			if err != nil {
-				return err
-			}
-
-			URL.Path += request.Alias
-			apiURL := URL.String() + "?access_token=" + appservice.HSToken
-
 			// Send a request to each application service. If one responds that it has
 			// created the room, immediately return.
-			req, err := http.NewRequest(http.MethodGet, apiURL, nil)
-			if err != nil {
-				return err
-			}
-			req = req.WithContext(ctx)
-
-			resp, err := a.HTTPClient.Do(req)
-			if resp != nil {
-				defer func() {
-					err = resp.Body.Close()
-					if err != nil {
-						log.WithFields(log.Fields{
-							"appservice_id": appservice.ID,
-							"status_code":   resp.StatusCode,
-						}).WithError(err).Error("Unable to close application service response body")
-					}
-				}()
-			}
+			exists, err := a.queryExists(ctx, appservice, roomAliasExistsPath, legacyRoomAliasExistsPath, request.Alias)
 			if err != nil {
 				log.WithError(err).Errorf("Issue querying room alias on application service %s", appservice.ID)
 				return err
 			}
-			switch resp.StatusCode {
-			case http.StatusOK:
-				// OK received from appservice. Room exists
+			if exists {
 				response.AliasExists = true
 				return nil
-			case http.StatusNotFound:
-				// Room does not exist
-			default:
-				// Application service reported an error. Warn
-				log.WithFields(log.Fields{
-					"appservice_id": appservice.ID,
-					"status_code":   resp.StatusCode,
-				}).Warn("Application service responded with non-OK status code")
 			}
 		}
 	}
@@ -121,56 +90,92 @@ func (a *AppServiceQueryAPI) UserIDExists(
 	defer span.Finish()
 
 	// Determine which application service should handle this request
-	for _, appservice := range a.Cfg.Derived.ApplicationServices {
+	for i := range a.Cfg.Derived.ApplicationServices {
+		appservice := &a.Cfg.Derived.ApplicationServices[i]
 		if appservice.URL != "" && appservice.IsInterestedInUserID(request.UserID) {
-			// The full path to the rooms API, includes hs token
-			URL, err := url.Parse(appservice.URL + userIDExistsPath)
-			if err != nil {
-				return err
-			}
-			URL.Path += request.UserID
-			apiURL := URL.String() + "?access_token=" + appservice.HSToken
-
 			// Send a request to each application service. If one responds that it has
 			// created the user, immediately return.
-			req, err := http.NewRequest(http.MethodGet, apiURL, nil)
-			if err != nil {
-				return err
-			}
-			resp, err := a.HTTPClient.Do(req.WithContext(ctx))
-			if resp != nil {
-				defer func() {
-					err = resp.Body.Close()
-					if err != nil {
-						log.WithFields(log.Fields{
-							"appservice_id": appservice.ID,
-							"status_code":   resp.StatusCode,
-						}).Error("Unable to close application service response body")
-					}
-				}()
-			}
+			exists, err := a.queryExists(ctx, appservice, userIDExistsPath, legacyUserIDExistsPath, request.UserID)
 			if err != nil {
 				log.WithFields(log.Fields{
 					"appservice_id": appservice.ID,
 				}).WithError(err).Error("issue querying user ID on application service")
 				return err
 			}
-			if resp.StatusCode == http.StatusOK {
-				// StatusOK received from appservice. User ID exists
+			if exists {
 				response.UserIDExists = true
 				return nil
 			}
+		}
+	}
+
+	response.UserIDExists = false
+	return nil
+}
 
-			// Log non OK
+// queryExists asks an application service whether a user ID or room alias in
+// its namespace exists, which gives it the chance to create it on demand. The
+// /_matrix/app/v1 path is tried first, falling back to the legacy unprefixed
+// path if the application service doesn't recognise it.
+func (a *AppServiceQueryAPI) queryExists(
+	ctx context.Context, appservice *config.ApplicationService,
+	path, legacyPath, id string,
+) (bool, error) {
+	status, errcode, err := a.doQueryExists(ctx, appservice, path, id)
+	if err != nil {
+		return false, err
+	}
+	if status == http.StatusNotFound && errcode == "M_UNRECOGNIZED" {
+		status, _, err = a.doQueryExists(ctx, appservice, legacyPath, id)
+		if err != nil {
+			return false, err
+		}
+	}
+	switch status {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		// Application service reported an error. Warn
+		log.WithFields(log.Fields{
+			"appservice_id": appservice.ID,
+			"status_code":   status,
+		}).Warn("Application service responded with non-OK status code")
+		return false, nil
+	}
+}
+
+func (a *AppServiceQueryAPI) doQueryExists(
+	ctx context.Context, appservice *config.ApplicationService, path, id string,
+) (status int, errcode string, err error) {
+	apiURL := appservice.URL + path + url.PathEscape(id) + "?access_token=" + url.QueryEscape(appservice.HSToken)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+appservice.HSToken)
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer func() {
+		if err = resp.Body.Close(); err != nil {
 			log.WithFields(log.Fields{
 				"appservice_id": appservice.ID,
 				"status_code":   resp.StatusCode,
-			}).Warn("application service responded with non-OK status code")
+			}).WithError(err).Error("Unable to close application service response body")
+		}
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		var body struct {
+			ErrCode string `json:"errcode"`
 		}
+		// The body is optional, so ignore any errors decoding it.
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body)
+		errcode = body.ErrCode
 	}
-
-	response.UserIDExists = false
-	return nil
+	return resp.StatusCode, errcode, nil
 }
 
 type thirdpartyResponses interface {
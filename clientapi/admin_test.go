@@ -2,6 +2,7 @@ package clientapi
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -9,12 +10,15 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/federationapi"
 	"github.com/matrix-org/dendrite/keyserver"
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/syncapi"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/dendrite/test"
@@ -159,7 +163,7 @@ func TestPurgeRoom(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
 
 		// this starts the JetStream consumers
-		syncapi.AddPublicRoutes(base, userAPI, rsAPI, keyAPI)
+		syncapi.AddPublicRoutes(base, userAPI, rsAPI, keyAPI, nil)
 		federationapi.NewInternalAPI(base, fedClient, rsAPI, base.Caches, nil, true)
 		rsAPI.SetFederationAPI(nil, nil)
 		keyAPI.SetUserAPI(userAPI)
@@ -233,3 +237,275 @@ func TestPurgeRoom(t *testing.T) {
 
 	})
 }
+
+func TestAdminUserDevices(t *testing.T) {
+	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t, test.WithAccountType(uapi.AccountTypeUser))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		keyAPI.SetUserAPI(userAPI)
+		AddPublicRoutes(base, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil)
+
+		// Create the users in the userapi and login
+		accessTokens := map[*test.User]string{
+			aliceAdmin: "",
+			bob:        "",
+		}
+		deviceIDs := map[*test.User]string{}
+		for u := range accessTokens {
+			localpart, serverName, _ := gomatrixserverlib.SplitID('@', u.ID)
+			password := util.RandomString(8)
+			if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+				AccountType: u.AccountType,
+				Localpart:   localpart,
+				ServerName:  serverName,
+				Password:    password,
+			}, &uapi.PerformAccountCreationResponse{}); err != nil {
+				t.Errorf("failed to create account: %s", err)
+			}
+
+			req := test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/login", test.WithJSONBody(t, map[string]interface{}{
+				"type": authtypes.LoginTypePassword,
+				"identifier": map[string]interface{}{
+					"type": "m.id.user",
+					"user": u.ID,
+				},
+				"password": password,
+			}))
+			rec := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("failed to login: %s", rec.Body.String())
+			}
+			accessTokens[u] = gjson.GetBytes(rec.Body.Bytes(), "access_token").String()
+			deviceIDs[u] = gjson.GetBytes(rec.Body.Bytes(), "device_id").String()
+		}
+
+		// Give Bob's device a one-time key, which should be deleted with it.
+		uploadRes := &keyapi.PerformUploadKeysResponse{}
+		if err := keyAPI.PerformUploadKeys(ctx, &keyapi.PerformUploadKeysRequest{
+			UserID:   bob.ID,
+			DeviceID: deviceIDs[bob],
+			OneTimeKeys: []keyapi.OneTimeKeys{{
+				UserID:   bob.ID,
+				DeviceID: deviceIDs[bob],
+				KeyJSON: map[string]json.RawMessage{
+					"signed_curve25519:AAAAAQ": json.RawMessage(`{"key":"a"}`),
+				},
+			}},
+		}, uploadRes); err != nil || uploadRes.Error != nil {
+			t.Fatalf("failed to upload keys: %v %v", err, uploadRes.Error)
+		}
+
+		testCases := []struct {
+			name           string
+			requestingUser *test.User
+			method         string
+			path           string
+			wantCode       int
+		}{
+			{name: "Bob is denied access", requestingUser: bob, method: http.MethodGet, path: "/users/" + bob.ID + "/devices", wantCode: http.StatusForbidden},
+			{name: "Alice can list Bob's devices", requestingUser: aliceAdmin, method: http.MethodGet, path: "/users/" + bob.ID + "/devices", wantCode: http.StatusOK},
+			{name: "unknown user is not found", requestingUser: aliceAdmin, method: http.MethodGet, path: "/users/@doesnotexist:test/devices", wantCode: http.StatusNotFound},
+			{name: "remote user is rejected", requestingUser: aliceAdmin, method: http.MethodGet, path: "/users/@bob:remote/devices", wantCode: http.StatusBadRequest},
+			{name: "unknown device is not found", requestingUser: aliceAdmin, method: http.MethodDelete, path: "/users/" + bob.ID + "/devices/UNKNOWN", wantCode: http.StatusNotFound},
+			{name: "Alice's device is not Bob's", requestingUser: aliceAdmin, method: http.MethodDelete, path: "/users/" + bob.ID + "/devices/" + deviceIDs[aliceAdmin], wantCode: http.StatusNotFound},
+			{name: "Alice can delete Bob's device", requestingUser: aliceAdmin, method: http.MethodDelete, path: "/users/" + bob.ID + "/devices/" + deviceIDs[bob], wantCode: http.StatusOK},
+		}
+
+		for _, tc := range testCases {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				req := test.NewRequest(t, tc.method, "/_dendrite/admin"+tc.path)
+				req.Header.Set("Authorization", "Bearer "+accessTokens[tc.requestingUser])
+				rec := httptest.NewRecorder()
+				base.DendriteAdminMux.ServeHTTP(rec, req)
+				if rec.Code != tc.wantCode {
+					t.Fatalf("expected http status %d, got %d: %s", tc.wantCode, rec.Code, rec.Body.String())
+				}
+				if tc.method == http.MethodGet && tc.wantCode == http.StatusOK {
+					if got := gjson.GetBytes(rec.Body.Bytes(), "devices.0.device_id").Str; got != deviceIDs[bob] {
+						t.Fatalf("expected device %q, got %s", deviceIDs[bob], rec.Body.String())
+					}
+				}
+			})
+		}
+
+		// Bob's device and its keys are gone, and his access token no longer works.
+		devicesRes := &uapi.QueryDevicesResponse{}
+		if err := userAPI.QueryDevices(ctx, &uapi.QueryDevicesRequest{UserID: bob.ID}, devicesRes); err != nil {
+			t.Fatal(err)
+		}
+		if len(devicesRes.Devices) != 0 {
+			t.Fatalf("expected Bob to have no devices, got %+v", devicesRes.Devices)
+		}
+		otkRes := &keyapi.QueryOneTimeKeysResponse{}
+		if err := keyAPI.QueryOneTimeKeys(ctx, &keyapi.QueryOneTimeKeysRequest{UserID: bob.ID, DeviceID: deviceIDs[bob]}, otkRes); err != nil {
+			t.Fatal(err)
+		}
+		if count := otkRes.Count.KeyCount["signed_curve25519"]; count != 0 {
+			t.Fatalf("expected Bob's one-time keys to be deleted, got %d", count)
+		}
+		req := test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/devices")
+		req.Header.Set("Authorization", "Bearer "+accessTokens[bob])
+		rec := httptest.NewRecorder()
+		base.PublicClientAPIMux.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("expected Bob's access token to be revoked, got HTTP %d", rec.Code)
+		}
+	})
+}
+
+func TestAdminSetRoomState(t *testing.T) {
+	aliceAdmin := test.NewUser(t, test.WithAccountType(uapi.AccountTypeAdmin))
+	bob := test.NewUser(t, test.WithAccountType(uapi.AccountTypeUser))
+	charlie := test.NewUser(t)
+
+	// Bob created the room, so he is the most powerful local member.
+	room := test.NewRoom(t, bob, test.RoomPreset(test.PresetPublicChat))
+	room.CreateAndInsert(t, charlie, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(charlie.ID))
+	room.CreateAndInsert(t, bob, gomatrixserverlib.MRoomName, map[string]interface{}{
+		"name": "something malicious",
+	}, test.WithStateKey(""))
+
+	// Charlie created this room and left it, so nobody local can change its name.
+	powerlessRoom := test.NewRoom(t, charlie, test.RoomPreset(test.PresetPublicChat))
+	powerlessRoom.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+	powerlessRoom.CreateAndInsert(t, charlie, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": "leave",
+	}, test.WithStateKey(charlie.ID))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		keyAPI.SetUserAPI(userAPI)
+		rsAPI.SetFederationAPI(nil, nil)
+		AddPublicRoutes(base, nil, rsAPI, nil, nil, nil, userAPI, nil, nil, nil)
+
+		for _, r := range []*test.Room{room, powerlessRoom} {
+			if err := api.SendEvents(ctx, rsAPI, api.KindNew, r.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+
+		accessTokens := map[*test.User]string{
+			aliceAdmin: "",
+			bob:        "",
+		}
+		for u := range accessTokens {
+			localpart, serverName, _ := gomatrixserverlib.SplitID('@', u.ID)
+			password := util.RandomString(8)
+			if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+				AccountType: u.AccountType,
+				Localpart:   localpart,
+				ServerName:  serverName,
+				Password:    password,
+			}, &uapi.PerformAccountCreationResponse{}); err != nil {
+				t.Errorf("failed to create account: %s", err)
+			}
+
+			req := test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/login", test.WithJSONBody(t, map[string]interface{}{
+				"type": authtypes.LoginTypePassword,
+				"identifier": map[string]interface{}{
+					"type": "m.id.user",
+					"user": u.ID,
+				},
+				"password": password,
+			}))
+			rec := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("failed to login: %s", rec.Body.String())
+			}
+			accessTokens[u] = gjson.GetBytes(rec.Body.Bytes(), "access_token").String()
+		}
+
+		auditLog := logrustest.NewGlobal()
+		defer auditLog.Reset()
+
+		testCases := []struct {
+			name           string
+			requestingUser *test.User
+			path           string
+			body           interface{}
+			wantCode       int
+		}{
+			{name: "Bob is denied access", requestingUser: bob, path: "/rooms/" + room.ID + "/state/m.room.name", body: map[string]interface{}{}, wantCode: http.StatusForbidden},
+			{name: "rejects invalid room ID", requestingUser: aliceAdmin, path: "/rooms/@notaroom:test/state/m.room.name", body: map[string]interface{}{}, wantCode: http.StatusBadRequest},
+			{name: "rejects content which isn't an object", requestingUser: aliceAdmin, path: "/rooms/" + room.ID + "/state/m.room.name", body: "name", wantCode: http.StatusBadRequest},
+			{name: "unknown room is not found", requestingUser: aliceAdmin, path: "/rooms/!doesnotexist:test/state/m.room.name", body: map[string]interface{}{}, wantCode: http.StatusNotFound},
+			{name: "no local user has enough power", requestingUser: aliceAdmin, path: "/rooms/" + powerlessRoom.ID + "/state/m.room.name", body: map[string]interface{}{}, wantCode: http.StatusForbidden},
+			{name: "Alice can clear the room name", requestingUser: aliceAdmin, path: "/rooms/" + room.ID + "/state/m.room.name/", body: map[string]interface{}{}, wantCode: http.StatusOK},
+		}
+
+		for _, tc := range testCases {
+			tc := tc
+			t.Run(tc.name, func(t *testing.T) {
+				req := test.NewRequest(t, http.MethodPut, "/_dendrite/admin"+tc.path, test.WithJSONBody(t, tc.body))
+				req.Header.Set("Authorization", "Bearer "+accessTokens[tc.requestingUser])
+				rec := httptest.NewRecorder()
+				base.DendriteAdminMux.ServeHTTP(rec, req)
+				if rec.Code != tc.wantCode {
+					t.Fatalf("expected http status %d, got %d: %s", tc.wantCode, rec.Code, rec.Body.String())
+				}
+				if tc.wantCode == http.StatusOK {
+					if got := gjson.GetBytes(rec.Body.Bytes(), "sender").Str; got != bob.ID {
+						t.Fatalf("expected the event to be sent as %s, got %s", bob.ID, rec.Body.String())
+					}
+				}
+			})
+		}
+
+		// The room name has been cleared.
+		nameTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomName, StateKey: ""}
+		stateRes := &api.QueryCurrentStateResponse{}
+		if err := rsAPI.QueryCurrentState(ctx, &api.QueryCurrentStateRequest{
+			RoomID:      room.ID,
+			StateTuples: []gomatrixserverlib.StateKeyTuple{nameTuple},
+		}, stateRes); err != nil {
+			t.Fatal(err)
+		}
+		nameEvent := stateRes.StateEvents[nameTuple]
+		if nameEvent == nil || string(nameEvent.Content()) != "{}" {
+			t.Fatalf("expected the room name to be cleared, got %+v", nameEvent)
+		}
+
+		// Only the successful change is audited, including who asked for it.
+		var audited []*logrus.Entry
+		for _, entry := range auditLog.AllEntries() {
+			if entry.Message == "Admin force-set room state" {
+				audited = append(audited, entry)
+			}
+		}
+		if len(audited) != 1 {
+			t.Fatalf("expected 1 audit log entry, got %d", len(audited))
+		}
+		for key, want := range map[string]string{
+			"admin":      aliceAdmin.ID,
+			"room_id":    room.ID,
+			"event_type": gomatrixserverlib.MRoomName,
+			"sender":     bob.ID,
+			"event_id":   nameEvent.EventID(),
+		} {
+			if got := audited[0].Data[key]; got != want {
+				t.Errorf("expected audit log field %s to be %q, got %q", key, want, got)
+			}
+		}
+	})
+}
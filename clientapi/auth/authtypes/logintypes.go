@@ -12,4 +12,6 @@ const (
 	LoginTypeApplicationService = "m.login.application_service"
 	LoginTypeSSO                = "m.login.sso"
 	LoginTypeToken              = "m.login.token"
+	LoginTypeTerms              = "m.login.terms"
+	LoginTypeEmail              = "m.login.email.identity"
 )
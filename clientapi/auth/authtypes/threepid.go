@@ -18,4 +18,8 @@ package authtypes
 type ThreePID struct {
 	Address string `json:"address"`
 	Medium  string `json:"medium"`
+	// When the 3PID was added to the account, in milliseconds since the epoch
+	AddedAt int64 `json:"added_at"`
+	// When the 3PID was validated, in milliseconds since the epoch
+	ValidatedAt int64 `json:"validated_at"`
 }
@@ -60,6 +60,8 @@ func (t *LoginTypeToken) LoginFromJSON(ctx context.Context, reqBytes []byte) (*L
 
 	r.Login.Identifier.Type = "m.id.user"
 	r.Login.Identifier.User = res.Data.UserID
+	r.Login.SSOProvider = res.Data.SSOProvider
+	r.Login.SSOIDToken = res.Data.SSOIDToken
 
 	cleanup := func(ctx context.Context, authRes *util.JSONResponse) {
 		if authRes == nil {
@@ -92,12 +92,12 @@ func (p *oauth2IdentityProvider) ProcessCallback(ctx context.Context, callbackUR
 		return nil, jsonerror.MissingArgument("code parameter missing")
 	}
 
-	at, err := p.getAccessToken(ctx, callbackURL, code)
+	at, idToken, err := p.getAccessToken(ctx, callbackURL, code)
 	if err != nil {
 		return nil, err
 	}
 
-	subject, displayName, suggestedLocalpart, err := p.getUserInfo(ctx, at)
+	subject, displayName, suggestedLocalpart, groups, err := p.getUserInfo(ctx, at)
 	if err != nil {
 		return nil, err
 	}
@@ -114,10 +114,18 @@ func (p *oauth2IdentityProvider) ProcessCallback(ctx context.Context, callbackUR
 		},
 		DisplayName:     displayName,
 		SuggestedUserID: suggestedLocalpart,
+		Groups:          groups,
+		IDToken:         idToken,
 	}, nil
 }
 
-func (p *oauth2IdentityProvider) getAccessToken(ctx context.Context, callbackURL, code string) (string, error) {
+// Logout does nothing, as OAuth2 has no standard way of ending a
+// session at the provider.
+func (p *oauth2IdentityProvider) Logout(ctx context.Context, idToken string) error {
+	return nil
+}
+
+func (p *oauth2IdentityProvider) getAccessToken(ctx context.Context, callbackURL, code string) (accessToken, idToken string, _ error) {
 	body := url.Values{
 		"grant_type":    []string{"authorization_code"},
 		"code":          []string{code},
@@ -127,60 +135,61 @@ func (p *oauth2IdentityProvider) getAccessToken(ctx context.Context, callbackURL
 	}
 	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.accessTokenURL, strings.NewReader(body.Encode()))
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	hreq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	hreq.Header.Set("Accept", p.responseMimeType)
 
 	hresp, err := httpDo(ctx, p.hc, hreq)
 	if err != nil {
-		return "", fmt.Errorf("access token: %w", err)
+		return "", "", fmt.Errorf("access token: %w", err)
 	}
 	defer hresp.Body.Close() // nolint:errcheck
 
 	var resp oauth2TokenResponse
 	if err := json.NewDecoder(hresp.Body).Decode(&resp); err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	if strings.ToLower(resp.TokenType) != "bearer" {
-		return "", fmt.Errorf("expected bearer token, got type %q", resp.TokenType)
+		return "", "", fmt.Errorf("expected bearer token, got type %q", resp.TokenType)
 	}
 
-	return resp.AccessToken, nil
+	return resp.AccessToken, resp.IDToken, nil
 }
 
 type oauth2TokenResponse struct {
 	TokenType   string `json:"token_type"`
 	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
 }
 
-func (p *oauth2IdentityProvider) getUserInfo(ctx context.Context, accessToken string) (subject, displayName, suggestedLocalpart string, _ error) {
+func (p *oauth2IdentityProvider) getUserInfo(ctx context.Context, accessToken string) (subject, displayName, suggestedLocalpart string, groups []string, _ error) {
 	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, p.userInfoURL, nil)
 	if err != nil {
-		return "", "", "", err
+		return "", "", "", nil, err
 	}
 	hreq.Header.Set("Authorization", "Bearer "+accessToken)
 	hreq.Header.Set("Accept", p.responseMimeType)
 
 	hresp, err := httpDo(ctx, p.hc, hreq)
 	if err != nil {
-		return "", "", "", fmt.Errorf("user info: %w", err)
+		return "", "", "", nil, fmt.Errorf("user info: %w", err)
 	}
 	defer hresp.Body.Close() // nolint:errcheck
 
 	body, err := io.ReadAll(hresp.Body)
 	if err != nil {
-		return "", "", "", err
+		return "", "", "", nil, err
 	}
 
 	if res := gjson.GetBytes(body, p.subPath); !res.Exists() {
-		return "", "", "", fmt.Errorf("no %q in user info response body", p.subPath)
+		return "", "", "", nil, fmt.Errorf("no %q in user info response body", p.subPath)
 	} else {
 		subject = res.String()
 	}
 	if subject == "" {
-		return "", "", "", fmt.Errorf("empty subject in user info")
+		return "", "", "", nil, fmt.Errorf("empty subject in user info")
 	}
 
 	if p.suggestedUserIDPath != "" {
@@ -191,6 +200,18 @@ func (p *oauth2IdentityProvider) getUserInfo(ctx context.Context, accessToken st
 		displayName = gjson.GetBytes(body, p.displayNamePath).String()
 	}
 
+	if p.cfg.GroupsClaim != "" {
+		// The claim may be a list of groups, or a single one.
+		res := gjson.GetBytes(body, p.cfg.GroupsClaim)
+		if res.IsArray() {
+			for _, group := range res.Array() {
+				groups = append(groups, group.String())
+			}
+		} else if res.Exists() {
+			groups = []string{res.String()}
+		}
+	}
+
 	return
 }
 
@@ -129,7 +129,7 @@ func TestOAuth2IdentityProviderGetAccessToken(t *testing.T) {
 		gotReq = r.Form
 
 		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"access_token":"atoken", "token_type":"Bearer"}`))
+		w.Write([]byte(`{"access_token":"atoken", "token_type":"Bearer", "id_token":"anidtoken"}`))
 	})
 
 	s := httptest.NewServer(mux)
@@ -149,7 +149,7 @@ func TestOAuth2IdentityProviderGetAccessToken(t *testing.T) {
 	}
 	idp.oauth2Cfg = &idp.cfg.OAuth2
 
-	got, err := idp.getAccessToken(ctx, callbackURL, "acode")
+	got, gotIDToken, err := idp.getAccessToken(ctx, callbackURL, "acode")
 	if err != nil {
 		t.Fatalf("getAccessToken failed: %v", err)
 	}
@@ -157,6 +157,9 @@ func TestOAuth2IdentityProviderGetAccessToken(t *testing.T) {
 	if want := "atoken"; got != want {
 		t.Errorf("getAccessToken: got %q, want %q", got, want)
 	}
+	if want := "anidtoken"; gotIDToken != want {
+		t.Errorf("getAccessToken ID token: got %q, want %q", gotIDToken, want)
+	}
 
 	wantReq := url.Values{
 		"client_id":     []string{"aclientid"},
@@ -178,7 +181,7 @@ func TestOAuth2IdentityProviderGetUserInfo(t *testing.T) {
 	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
 		gotHeader = r.Header
 		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"sub":"asub", "name":"aname", "preferred_user":"auser"}`))
+		w.Write([]byte(`{"sub":"asub", "name":"aname", "preferred_user":"auser", "roles":["agroup", "anothergroup"]}`))
 	})
 
 	s := httptest.NewServer(mux)
@@ -186,7 +189,8 @@ func TestOAuth2IdentityProviderGetUserInfo(t *testing.T) {
 
 	idp := &oauth2IdentityProvider{
 		cfg: &config.IdentityProvider{
-			ID: "anid",
+			ID:          "anid",
+			GroupsClaim: "roles",
 			OAuth2: config.OAuth2{
 				ClientID:     "aclientid",
 				ClientSecret: "aclientsecret",
@@ -203,7 +207,7 @@ func TestOAuth2IdentityProviderGetUserInfo(t *testing.T) {
 	}
 	idp.oauth2Cfg = &idp.cfg.OAuth2
 
-	gotSub, gotName, gotSuggestedUser, err := idp.getUserInfo(ctx, "atoken")
+	gotSub, gotName, gotSuggestedUser, gotGroups, err := idp.getUserInfo(ctx, "atoken")
 	if err != nil {
 		t.Fatalf("getUserInfo failed: %v", err)
 	}
@@ -217,6 +221,9 @@ func TestOAuth2IdentityProviderGetUserInfo(t *testing.T) {
 	if want := "auser"; gotSuggestedUser != want {
 		t.Errorf("getUserInfo suggestedUser: got %q, want %q", gotSuggestedUser, want)
 	}
+	if want := []string{"agroup", "anothergroup"}; !reflect.DeepEqual(gotGroups, want) {
+		t.Errorf("getUserInfo groups: got %q, want %q", gotGroups, want)
+	}
 
 	gotHeader.Del("Accept-Encoding")
 	gotHeader.Del("User-Agent")
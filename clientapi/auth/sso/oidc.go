@@ -90,6 +90,44 @@ func (p *oidcIdentityProvider) ProcessCallback(ctx context.Context, callbackURL,
 	return res, nil
 }
 
+// Logout calls the end session endpoint of the provider, if configured to.
+// The ID token is passed as a hint, so the provider knows which session to
+// end without asking the user to confirm.
+//
+// See https://openid.net/specs/openid-connect-rpinitiated-1_0.html.
+func (p *oidcIdentityProvider) Logout(ctx context.Context, idToken string) error {
+	if !p.cfg.PropagateLogout {
+		return nil
+	}
+	oauth2p, disc, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+	if disc.EndSessionEndpoint == "" {
+		return fmt.Errorf("no end session endpoint from OIDC provider")
+	}
+
+	vs := url.Values{
+		"client_id": []string{oauth2p.oauth2Cfg.ClientID},
+	}
+	if idToken != "" {
+		vs.Set("id_token_hint", idToken)
+	}
+	u, err := resolveURL(disc.EndSessionEndpoint, vs)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	hresp, err := httpDo(ctx, oauth2p.hc, hreq)
+	if err != nil {
+		return fmt.Errorf("end session: %w", err)
+	}
+	return hresp.Body.Close()
+}
+
 func (p *oidcIdentityProvider) get(ctx context.Context) (*oauth2IdentityProvider, *oidcDiscovery, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -123,6 +161,7 @@ type oidcDiscovery struct {
 	AuthorizationEndpoint string   `json:"authorization_endpoint"`
 	TokenEndpoint         string   `json:"token_endpoint"`
 	UserinfoEndpoint      string   `json:"userinfo_endpoint"`
+	EndSessionEndpoint    string   `json:"end_session_endpoint"`
 	ScopesSupported       []string `json:"scopes_supported"`
 }
 
@@ -161,6 +200,10 @@ func oidcDiscover(ctx context.Context, url string) (*oidcDiscovery, error) {
 		return nil, fmt.Errorf("userinfo endpoint is invalid in %q", url)
 	}
 
+	if disc.EndSessionEndpoint != "" && !validWebURL(disc.EndSessionEndpoint) {
+		return nil, fmt.Errorf("end session endpoint is invalid in %q", url)
+	}
+
 	if disc.ScopesSupported != nil {
 		if !stringSliceContains(disc.ScopesSupported, "openid") {
 			return nil, fmt.Errorf("scope 'openid' is missing in %q", url)
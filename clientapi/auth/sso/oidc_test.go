@@ -116,3 +116,62 @@ func TestOIDCIdentityProviderProcessCallback(t *testing.T) {
 		})
 	}
 }
+
+func TestOIDCIdentityProviderLogout(t *testing.T) {
+	ctx := context.Background()
+
+	tsts := []struct {
+		Name             string
+		PropagateLogout  bool
+		IDToken          string
+		EndSessionStatus int
+
+		WantEndSession url.Values
+		WantErr        bool
+	}{
+		{Name: "propagate", PropagateLogout: true, IDToken: "anidtoken", WantEndSession: url.Values{"client_id": []string{"aclientid"}, "id_token_hint": []string{"anidtoken"}}},
+		{Name: "propagateNoIDToken", PropagateLogout: true, WantEndSession: url.Values{"client_id": []string{"aclientid"}}},
+		{Name: "propagateFailed", PropagateLogout: true, IDToken: "anidtoken", EndSessionStatus: http.StatusBadRequest, WantEndSession: url.Values{"client_id": []string{"aclientid"}, "id_token_hint": []string{"anidtoken"}}, WantErr: true},
+		{Name: "dontPropagate", IDToken: "anidtoken"},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			var sURL string
+			mux.HandleFunc("/discovery", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(fmt.Sprintf(`{"authorization_endpoint":"%s/authorize","token_endpoint":"%s/token","userinfo_endpoint":"%s/userinfo","end_session_endpoint":"%s/end_session","issuer":"http://oidc.example.com/"}`,
+					sURL, sURL, sURL, sURL)))
+			})
+			var gotEndSession url.Values
+			mux.HandleFunc("/end_session", func(w http.ResponseWriter, r *http.Request) {
+				gotEndSession = r.URL.Query()
+				if tst.EndSessionStatus != 0 {
+					w.WriteHeader(tst.EndSessionStatus)
+				}
+			})
+
+			s := httptest.NewServer(mux)
+			defer s.Close()
+
+			sURL = s.URL
+			idp := newOIDCIdentityProvider(&config.IdentityProvider{
+				OIDC: config.OIDC{
+					OAuth2: config.OAuth2{
+						ClientID: "aclientid",
+					},
+					DiscoveryURL: sURL + "/discovery",
+				},
+				PropagateLogout: tst.PropagateLogout,
+			}, s.Client())
+
+			if err := idp.Logout(ctx, tst.IDToken); (err != nil) != tst.WantErr {
+				t.Fatalf("Logout: got error %v, want error %v", err, tst.WantErr)
+			}
+
+			if !reflect.DeepEqual(gotEndSession, tst.WantEndSession) {
+				t.Errorf("Logout end session query: got %+v, want %+v", gotEndSession, tst.WantEndSession)
+			}
+		})
+	}
+}
@@ -82,9 +82,21 @@ func (auth *Authenticator) ProcessCallback(ctx context.Context, providerID, call
 	return p.ProcessCallback(ctx, callbackURL, nonce, query)
 }
 
+// Logout ends the user's session at the identity provider, if it is
+// configured to propagate logouts. idToken is the ID token the provider
+// issued when the session was created, if any.
+func (auth *Authenticator) Logout(ctx context.Context, providerID, idToken string) error {
+	p := auth.providers[providerID]
+	if p == nil {
+		return fmt.Errorf("unknown identity provider: %s", providerID)
+	}
+	return p.Logout(ctx, idToken)
+}
+
 type identityProvider interface {
 	AuthorizationURL(ctx context.Context, callbackURL, nonce string) (string, error)
 	ProcessCallback(ctx context.Context, callbackURL, nonce string, query url.Values) (*CallbackResult, error)
+	Logout(ctx context.Context, idToken string) error
 }
 
 type CallbackResult struct {
@@ -92,6 +104,9 @@ type CallbackResult struct {
 	Identifier      *UserIdentifier
 	DisplayName     string
 	SuggestedUserID string
+	Groups          []string
+	// IDToken is the OpenID Connect ID token issued by the provider, if any.
+	IDToken string
 }
 
 type UserIdentifier struct {
@@ -63,9 +63,20 @@ func TestAuthenticator(t *testing.T) {
 			t.Errorf("ProcessCallback: got %+v, want %+v", got, want)
 		}
 	})
+
+	t.Run("logout", func(t *testing.T) {
+		if err := a.Logout(ctx, "fake", "anidtoken"); err != nil {
+			t.Fatalf("Logout failed: %v", err)
+		}
+		if want := "anidtoken"; idp.loggedOut != want {
+			t.Errorf("Logout: got ID token %q, want %q", idp.loggedOut, want)
+		}
+	})
 }
 
-type fakeIdentityProvider struct{}
+type fakeIdentityProvider struct {
+	loggedOut string
+}
 
 func (idp *fakeIdentityProvider) AuthorizationURL(ctx context.Context, callbackURL, nonce string) (string, error) {
 	return "aurl", nil
@@ -74,3 +85,8 @@ func (idp *fakeIdentityProvider) AuthorizationURL(ctx context.Context, callbackU
 func (idp *fakeIdentityProvider) ProcessCallback(ctx context.Context, callbackURL, nonce string, query url.Values) (*CallbackResult, error) {
 	return &CallbackResult{DisplayName: "aname"}, nil
 }
+
+func (idp *fakeIdentityProvider) Logout(ctx context.Context, idToken string) error {
+	idp.loggedOut = idToken
+	return nil
+}
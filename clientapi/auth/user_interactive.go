@@ -71,6 +71,13 @@ type Login struct {
 	// Thus a pointer is needed to differentiate between the two
 	InitialDisplayName *string `json:"initial_device_display_name"`
 	DeviceID           *string `json:"device_id"`
+
+	// SSOProvider is the ID of the SSO identity provider the user logged in
+	// with. It is set from the login token, never from the request.
+	SSOProvider string `json:"-"`
+	// SSOIDToken is the ID token the SSO identity provider issued. It is
+	// set from the login token, never from the request.
+	SSOIDToken string `json:"-"`
 }
 
 // Username returns the user localpart/user_id in this request, if it exists.
@@ -17,12 +17,15 @@ import (
 	"net/http"
 	"strconv"
 	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
 )
 
 // ParseTSParam takes a req (typically from an application service) and parses a Time object
 // from the req if it exists in the query parameters. If it doesn't exist, the
-// current time is returned.
-func ParseTSParam(req *http.Request) (time.Time, error) {
+// current time is returned. Timestamps which are too far in the future are clamped
+// or rejected, depending on the configured policy.
+func ParseTSParam(req *http.Request, cfg *config.ClientAPI) (time.Time, error) {
 	// Use the ts parameter's value for event time if present
 	tsStr := req.URL.Query().Get("ts")
 	if tsStr == "" {
@@ -35,5 +38,19 @@ func ParseTSParam(req *http.Request) (time.Time, error) {
 		return time.Time{}, fmt.Errorf("param 'ts' is no valid int (%s)", err.Error())
 	}
 
-	return time.Unix(ts/1000, 0), nil
+	return checkFutureTimestamp(time.Unix(ts/1000, 0), time.Now(), cfg.FutureTimestamps)
+}
+
+func checkFutureTimestamp(ts, now time.Time, policy config.FutureTimestamps) (time.Time, error) {
+	if policy.MaxSkew <= 0 {
+		return ts, nil
+	}
+	latest := now.Add(policy.MaxSkew)
+	if !ts.After(latest) {
+		return ts, nil
+	}
+	if policy.Policy == config.FutureTimestampsReject {
+		return time.Time{}, fmt.Errorf("param 'ts' is more than %s in the future", policy.MaxSkew)
+	}
+	return latest, nil
 }
@@ -0,0 +1,83 @@
+package httputil
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestParseTSParamFutureTimestamps(t *testing.T) {
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		name      string
+		ts        time.Time
+		policy    config.FutureTimestamps
+		wantErr   bool
+		wantTS    time.Time
+		wantClamp bool
+	}{
+		{
+			name:   "no limit",
+			ts:     future,
+			policy: config.FutureTimestamps{Policy: config.FutureTimestampsReject},
+			wantTS: future,
+		},
+		{
+			name:   "past timestamp is allowed",
+			ts:     past,
+			policy: config.FutureTimestamps{MaxSkew: time.Minute, Policy: config.FutureTimestampsReject},
+			wantTS: past,
+		},
+		{
+			name:   "future timestamp within skew is allowed",
+			ts:     future,
+			policy: config.FutureTimestamps{MaxSkew: 2 * time.Hour, Policy: config.FutureTimestampsReject},
+			wantTS: future,
+		},
+		{
+			name:      "future timestamp is clamped",
+			ts:        future,
+			policy:    config.FutureTimestamps{MaxSkew: time.Minute, Policy: config.FutureTimestampsClamp},
+			wantClamp: true,
+		},
+		{
+			name:    "future timestamp is rejected",
+			ts:      future,
+			policy:  config.FutureTimestamps{MaxSkew: time.Minute, Policy: config.FutureTimestampsReject},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.ClientAPI{FutureTimestamps: tt.policy}
+			req := httptest.NewRequest(http.MethodPut, fmt.Sprintf("/?ts=%d", tt.ts.UnixMilli()), nil)
+			before := time.Now()
+			got, err := ParseTSParam(req, cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got timestamp %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if tt.wantClamp {
+				earliest, latest := before.Add(tt.policy.MaxSkew), time.Now().Add(tt.policy.MaxSkew)
+				if got.Before(earliest) || got.After(latest) {
+					t.Fatalf("expected timestamp to be clamped to %s, got %s", earliest, got)
+				}
+				return
+			}
+			if !got.Equal(tt.wantTS) {
+				t.Fatalf("expected timestamp %s, got %s", tt.wantTS, got)
+			}
+		})
+	}
+}
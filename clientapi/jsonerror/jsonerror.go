@@ -55,6 +55,12 @@ func Forbidden(msg string) *MatrixError {
 	return &MatrixError{"M_FORBIDDEN", msg}
 }
 
+// ConsentNotGiven is an error when the user has not accepted the current
+// version of the server's policies.
+func ConsentNotGiven(msg string) *MatrixError {
+	return &MatrixError{"M_CONSENT_NOT_GIVEN", msg}
+}
+
 // BadJSON is an error when the client supplies malformed JSON.
 func BadJSON(msg string) *MatrixError {
 	return &MatrixError{"M_BAD_JSON", msg}
@@ -76,6 +82,11 @@ func NotFound(msg string) *MatrixError {
 	return &MatrixError{"M_NOT_FOUND", msg}
 }
 
+// TooLarge is an error when the requested content is larger than allowed
+func TooLarge(msg string) *MatrixError {
+	return &MatrixError{"M_TOO_LARGE", msg}
+}
+
 // MissingArgument is an error when the client tries to access a resource
 // without providing an argument that is required.
 func MissingArgument(msg string) *MatrixError {
@@ -207,6 +218,22 @@ func LimitExceeded(msg string, retryAfterMS int64) *LimitExceededError {
 	}
 }
 
+// RoomTombstonedError is returned when the client tries to join a room which
+// has been replaced by another room.
+type RoomTombstonedError struct {
+	MatrixError
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// RoomTombstoned is an error when the client tries to join a room which has
+// been replaced, naming the room which replaced it.
+func RoomTombstoned(msg, replacementRoom string) *RoomTombstonedError {
+	return &RoomTombstonedError{
+		MatrixError:     MatrixError{"M_FORBIDDEN", msg},
+		ReplacementRoom: replacementRoom,
+	}
+}
+
 // NotTrusted is an error which is returned when the client asks the server to
 // proxy a request (e.g. 3PID association) to a server that isn't trusted
 func NotTrusted(serverName string) *MatrixError {
@@ -16,6 +16,7 @@ package routing
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -25,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
 
 	"github.com/matrix-org/util"
@@ -73,9 +75,16 @@ func GetAccountData(
 	}
 }
 
+// reservedAccountDataTypes are the types of account data which clients can't
+// set using the account data API, as they are managed through other APIs.
+var reservedAccountDataTypes = map[string]bool{
+	"m.fully_read": true,
+	"m.push_rules": true,
+}
+
 // SaveAccountData implements PUT /user/{userId}/[rooms/{roomId}/]account_data/{type}
 func SaveAccountData(
-	req *http.Request, userAPI api.ClientUserAPI, device *api.Device,
+	req *http.Request, cfg *config.ClientAPI, userAPI api.ClientUserAPI, device *api.Device,
 	userID string, roomID string, dataType string, syncProducer *producers.SyncAPIProducer,
 ) util.JSONResponse {
 	if userID != device.UserID {
@@ -94,20 +103,37 @@ func SaveAccountData(
 		}
 	}
 
-	if dataType == "m.fully_read" || dataType == "m.push_rules" {
+	if reservedAccountDataTypes[dataType] {
 		return util.JSONResponse{
 			Code: http.StatusForbidden,
 			JSON: jsonerror.Forbidden(fmt.Sprintf("Unable to modify %q using this API", dataType)),
 		}
 	}
 
-	body, err := io.ReadAll(req.Body)
+	// Read at most one byte more than we allow, so that we can tell if the
+	// content is too large without reading all of it.
+	var body []byte
+	var err error
+	maxSize := cfg.AccountData.MaxSizePerType
+	if maxSize > 0 {
+		body, err = io.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	} else {
+		body, err = io.ReadAll(req.Body)
+	}
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("io.ReadAll failed")
 		return jsonerror.InternalServerError()
 	}
+	if maxSize > 0 && int64(len(body)) > maxSize {
+		return util.JSONResponse{
+			Code: http.StatusRequestEntityTooLarge,
+			JSON: jsonerror.TooLarge(fmt.Sprintf("Account data must not be larger than %d bytes", maxSize)),
+		}
+	}
 
-	if !json.Valid(body) {
+	// Account data content must be a JSON object.
+	var content map[string]json.RawMessage
+	if err = json.Unmarshal(body, &content); err != nil || content == nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.BadJSON("Bad JSON content"),
@@ -122,6 +148,9 @@ func SaveAccountData(
 	}
 	dataRes := api.InputAccountDataResponse{}
 	if err := userAPI.InputAccountData(req.Context(), &dataReq, &dataRes); err != nil {
+		if resErr := storageQuotaExceeded(err); resErr != nil {
+			return *resErr
+		}
 		util.GetLogger(req.Context()).WithError(err).Error("userAPI.InputAccountData failed")
 		return util.ErrorResponse(err)
 	}
@@ -132,6 +161,19 @@ func SaveAccountData(
 	}
 }
 
+// storageQuotaExceeded returns an error response if the user API rejected a
+// write because it would take the user over their storage quota.
+func storageQuotaExceeded(err error) *util.JSONResponse {
+	var quotaErr *api.ErrorStorageQuotaExceeded
+	if !errors.As(err, &quotaErr) {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusRequestEntityTooLarge,
+		JSON: jsonerror.TooLarge(quotaErr.Message),
+	}
+}
+
 type fullyReadEvent struct {
 	EventID string `json:"event_id"`
 }
@@ -0,0 +1,86 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+type accountDataUserAPI struct {
+	api.ClientUserAPI
+	global map[string]json.RawMessage
+	rooms  map[string]map[string]json.RawMessage
+}
+
+func (a *accountDataUserAPI) QueryAccountData(_ context.Context, _ *api.QueryAccountDataRequest, res *api.QueryAccountDataResponse) error {
+	res.GlobalAccountData = a.global
+	res.RoomAccountData = a.rooms
+	return nil
+}
+
+func (a *accountDataUserAPI) InputAccountData(_ context.Context, req *api.InputAccountDataRequest, _ *api.InputAccountDataResponse) error {
+	if req.DataType == "org.example.quota" {
+		return &api.ErrorStorageQuotaExceeded{Message: "over quota"}
+	}
+	if req.RoomID != "" {
+		if a.rooms[req.RoomID] == nil {
+			a.rooms[req.RoomID] = map[string]json.RawMessage{}
+		}
+		a.rooms[req.RoomID][req.DataType] = req.AccountData
+		return nil
+	}
+	a.global[req.DataType] = req.AccountData
+	return nil
+}
+
+func TestSaveAccountDataLimits(t *testing.T) {
+	const userID = "@alice:localhost"
+	device := &api.Device{UserID: userID}
+	cfg := &config.ClientAPI{
+		AccountData: config.AccountData{
+			MaxSizePerType: 100,
+		},
+	}
+	blob := func(size int) string {
+		// {"a":"..."} is 8 bytes longer than the padding
+		return `{"a":"` + strings.Repeat("x", size-8) + `"}`
+	}
+
+	tests := []struct {
+		name     string
+		roomID   string
+		dataType string
+		body     string
+		wantCode int
+	}{
+		{name: "small account data is saved", dataType: "org.example.small", body: blob(60), wantCode: http.StatusOK},
+		{name: "oversized account data is rejected", dataType: "org.example.large", body: blob(101), wantCode: http.StatusRequestEntityTooLarge},
+		{name: "account data at the limit is saved", dataType: "org.example.large", body: blob(80), wantCode: http.StatusOK},
+		{name: "room account data is saved", roomID: "!room:localhost", dataType: "org.example.large", body: blob(80), wantCode: http.StatusOK},
+		{name: "account data over the storage quota is rejected", dataType: "org.example.quota", body: blob(20), wantCode: http.StatusRequestEntityTooLarge},
+		{name: "malformed JSON is rejected", dataType: "org.example.bad", body: `{"a":`, wantCode: http.StatusBadRequest},
+		{name: "non-object JSON is rejected", dataType: "org.example.bad", body: `[]`, wantCode: http.StatusBadRequest},
+		{name: "reserved type is rejected", dataType: "m.push_rules", body: `{}`, wantCode: http.StatusForbidden},
+	}
+
+	userAPI := &accountDataUserAPI{
+		global: map[string]json.RawMessage{},
+		rooms:  map[string]map[string]json.RawMessage{},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/", bytes.NewBufferString(tt.body))
+			res := SaveAccountData(req, cfg, userAPI, device, userID, tt.roomID, tt.dataType, nil)
+			if res.Code != tt.wantCode {
+				t.Fatalf("expected HTTP %d, got %d: %+v", tt.wantCode, res.Code, res.JSON)
+			}
+		})
+	}
+}
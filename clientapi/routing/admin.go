@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -15,7 +16,9 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -116,6 +119,7 @@ func AdminPurgeRoom(req *http.Request, cfg *config.ClientAPI, device *userapi.De
 		context.Background(),
 		&roomserverAPI.PerformAdminPurgeRoomRequest{
 			RoomID: roomID,
+			DryRun: req.URL.Query().Get("dry_run") == "true",
 		},
 		res,
 	); err != nil {
@@ -221,6 +225,52 @@ func AdminReindex(req *http.Request, cfg *config.ClientAPI, device *userapi.Devi
 	}
 }
 
+func AdminBackgroundUpdatesStatus(req *http.Request, updates *sqlutil.BackgroundUpdates) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Updates []sqlutil.BackgroundUpdateStatus `json:"updates"`
+		}{
+			Updates: updates.Status(),
+		},
+	}
+}
+
+func AdminBackgroundUpdateAction(req *http.Request, updates *sqlutil.BackgroundUpdates) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	name := vars["updateName"]
+
+	switch vars["action"] {
+	case "pause":
+		err = updates.Pause(name)
+	case "resume":
+		err = updates.Resume(name)
+	case "run":
+		err = updates.Trigger(name)
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Action must be one of pause, resume or run"),
+		}
+	}
+	switch {
+	case err == sqlutil.ErrBackgroundUpdateNotFound:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Background update %q not found", name)),
+		}
+	case err != nil:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown(err.Error()),
+		}
+	}
+	return AdminBackgroundUpdatesStatus(req, updates)
+}
+
 func AdminMarkAsStale(req *http.Request, cfg *config.ClientAPI, keyAPI api.ClientKeyAPI) util.JSONResponse {
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
@@ -255,6 +305,32 @@ func AdminMarkAsStale(req *http.Request, cfg *config.ClientAPI, keyAPI api.Clien
 	}
 }
 
+// AdminFederationStatus returns the status of outbound federation to a remote
+// server, including the state of its circuit breaker.
+func AdminFederationStatus(req *http.Request, cfg *config.ClientAPI, fsAPI federationAPI.ClientFederationAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	serverName := gomatrixserverlib.ServerName(vars["serverName"])
+	if cfg.Matrix.IsLocalServerName(serverName) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Can not query the federation status of a local server name"),
+		}
+	}
+	res := &federationAPI.QueryServerStatusResponse{}
+	if err = fsAPI.QueryServerStatus(req.Context(), &federationAPI.QueryServerStatusRequest{
+		ServerName: serverName,
+	}, res); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
 func AdminDownloadState(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
 	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 	if err != nil {
@@ -294,3 +370,156 @@ func AdminDownloadState(req *http.Request, cfg *config.ClientAPI, device *userap
 		JSON: map[string]interface{}{},
 	}
 }
+
+// AdminSetRoomState force-sets a state event in a room, e.g. to clear a
+// malicious room name during moderation. The event is sent as the local member
+// of the room with the highest power level.
+func AdminSetRoomState(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	roomID, eventType := vars["roomID"], strings.TrimSuffix(vars["eventType"], "/")
+	if _, _, err = gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid room ID"),
+		}
+	}
+	var content map[string]interface{}
+	if err = json.NewDecoder(req.Body).Decode(&content); err != nil || content == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body must be a JSON object"),
+		}
+	}
+	contentJSON, err := json.Marshal(content)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	res := &roomserverAPI.PerformAdminSetStateResponse{}
+	if err = rsAPI.PerformAdminSetState(req.Context(), &roomserverAPI.PerformAdminSetStateRequest{
+		RoomID:    roomID,
+		UserID:    device.UserID,
+		EventType: eventType,
+		StateKey:  vars["stateKey"],
+		Content:   contentJSON,
+	}, res); err != nil {
+		return jsonerror.InternalAPIError(req.Context(), err)
+	}
+	if err := res.Error; err != nil {
+		return err.JSONResponse()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"event_id": res.EventID,
+			"sender":   res.Sender,
+		},
+	}
+}
+
+// AdminListUserDevices lists the devices of a local user, e.g. so that an
+// admin can see where an account is logged in during incident response.
+func AdminListUserDevices(req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	devices, resErr := adminQueryUserDevices(req.Context(), cfg, userAPI, vars["userID"])
+	if resErr != nil {
+		return *resErr
+	}
+	res := devicesJSON{Devices: []deviceJSON{}}
+	for _, dev := range devices {
+		res.Devices = append(res.Devices, deviceJSON{
+			DeviceID:    dev.ID,
+			DisplayName: dev.DisplayName,
+			LastSeenIP:  stripIPPort(dev.LastSeenIP),
+			LastSeenTS:  dev.LastSeenTS,
+		})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminDeleteUserDevice deletes a device of a local user. As with the user
+// deleting the device themselves, its access token is revoked and its E2EE
+// keys are deleted, and the user's other devices are told about it.
+func AdminDeleteUserDevice(req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	userID, deviceID := vars["userID"], vars["deviceID"]
+	devices, resErr := adminQueryUserDevices(req.Context(), cfg, userAPI, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	found := false
+	for _, dev := range devices {
+		if dev.ID == deviceID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown device"),
+		}
+	}
+	var res userapi.PerformDeviceDeletionResponse
+	if err = userAPI.PerformDeviceDeletion(req.Context(), &userapi.PerformDeviceDeletionRequest{
+		UserID:    userID,
+		DeviceIDs: []string{deviceID},
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformDeviceDeletion failed")
+		return jsonerror.InternalServerError()
+	}
+	util.GetLogger(req.Context()).WithFields(logrus.Fields{
+		"user_id":   userID,
+		"device_id": deviceID,
+	}).Info("Admin deleted device")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// adminQueryUserDevices returns the devices of a local user, or an error
+// response if the user doesn't exist.
+func adminQueryUserDevices(ctx context.Context, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, userID string) ([]userapi.Device, *util.JSONResponse) {
+	localpart, serverName, err := cfg.Matrix.SplitLocalID('@', userID)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	accAvailableResp := &userapi.QueryAccountAvailabilityResponse{}
+	if err = userAPI.QueryAccountAvailability(ctx, &userapi.QueryAccountAvailabilityRequest{
+		Localpart:  localpart,
+		ServerName: serverName,
+	}, accAvailableResp); err != nil {
+		resErr := jsonerror.InternalAPIError(ctx, err)
+		return nil, &resErr
+	}
+	if accAvailableResp.Available {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("User does not exist"),
+		}
+	}
+	var queryRes userapi.QueryDevicesResponse
+	if err = userAPI.QueryDevices(ctx, &userapi.QueryDevicesRequest{
+		UserID: userID,
+	}, &queryRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryDevices failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	return queryRes.Devices, nil
+}
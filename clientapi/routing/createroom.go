@@ -58,6 +58,9 @@ const (
 	presetPublicChat         = "public_chat"
 )
 
+// The algorithm used when rooms are encrypted by default.
+const encryptionAlgorithmMegolm = "m.megolm.v1.aes-sha2"
+
 const (
 	historyVisibilityShared = "shared"
 	// TODO: These should be implemented once history visibility is implemented
@@ -149,16 +152,71 @@ func CreateRoom(
 	if resErr = r.Validate(); resErr != nil {
 		return *resErr
 	}
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, cfg)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.InvalidArgumentValue(err.Error()),
 		}
 	}
+	if resErr = checkRoomCreationLimit(req.Context(), device, cfg, rsAPI); resErr != nil {
+		return *resErr
+	}
 	return createRoom(req.Context(), r, device, cfg, profileAPI, rsAPI, asAPI, evTime)
 }
 
+// checkRoomCreationLimit returns an error response if the user has already
+// created as many rooms as they are allowed to. Only rooms which the user is
+// still joined to count towards the limit.
+func checkRoomCreationLimit(
+	ctx context.Context, device *api.Device, cfg *config.ClientAPI,
+	rsAPI roomserverAPI.ClientRoomserverAPI,
+) *util.JSONResponse {
+	limit := cfg.RoomCreation.MaxRoomsPerUser
+	if limit <= 0 {
+		return nil
+	}
+	switch device.AccountType {
+	case api.AccountTypeAdmin, api.AccountTypeAppService:
+		return nil
+	}
+	var roomsRes roomserverAPI.QueryRoomsForUserResponse
+	if err := rsAPI.QueryRoomsForUser(ctx, &roomserverAPI.QueryRoomsForUserRequest{
+		UserID:         device.UserID,
+		WantMembership: gomatrixserverlib.Join,
+	}, &roomsRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryRoomsForUser failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if len(roomsRes.RoomIDs) < limit {
+		return nil
+	}
+	createTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}
+	var stateRes roomserverAPI.QueryBulkStateContentResponse
+	if err := rsAPI.QueryBulkStateContent(ctx, &roomserverAPI.QueryBulkStateContentRequest{
+		RoomIDs:     roomsRes.RoomIDs,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{createTuple},
+	}, &stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryBulkStateContent failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	created := 0
+	for _, state := range stateRes.Rooms {
+		if state[createTuple] == device.UserID {
+			created++
+		}
+	}
+	if created < limit {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden(fmt.Sprintf("You cannot create more than %d rooms", limit)),
+	}
+}
+
 // createRoom implements /createRoom
 // nolint: gocyclo
 func createRoom(
@@ -282,13 +340,14 @@ func createRoom(
 		Type:    gomatrixserverlib.MRoomHistoryVisibility,
 		Content: historyVisibilityContent,
 	}
+	displayName, avatarURL := membershipProfile(cfg, profile)
 	membershipEvent := fledglingEvent{
 		Type:     gomatrixserverlib.MRoomMember,
 		StateKey: userID,
 		Content: gomatrixserverlib.MemberContent{
 			Membership:  gomatrixserverlib.Join,
-			DisplayName: profile.DisplayName,
-			AvatarURL:   profile.AvatarURL,
+			DisplayName: displayName,
+			AvatarURL:   avatarURL,
 		},
 	}
 
@@ -327,6 +386,9 @@ func createRoom(
 	var roomAlias string
 	if r.RoomAliasName != "" {
 		roomAlias = fmt.Sprintf("#%s:%s", r.RoomAliasName, userDomain)
+		if resErr := validateRoomAlias(roomAlias, cfg.MaxRoomAliasLength); resErr != nil {
+			return *resErr
+		}
 		// check it's free TODO: This races but is better than nothing
 		hasAliasReq := roomserverAPI.GetRoomIDForAliasRequest{
 			Alias:              roomAlias,
@@ -354,6 +416,14 @@ func createRoom(
 		}
 	}
 
+	// Rooms created with the private presets can be encrypted by default,
+	// unless the initial state says otherwise.
+	encrypt := false
+	switch r.Preset {
+	case presetPrivateChat, presetTrustedPrivateChat:
+		encrypt = cfg.RoomCreation.EncryptPrivateRooms
+	}
+
 	var initialStateEvents []fledglingEvent
 	for i := range r.InitialState {
 		if r.InitialState[i].StateKey != "" {
@@ -383,11 +453,32 @@ func createRoom(
 		case gomatrixserverlib.MRoomTopic:
 			topicEvent = &r.InitialState[i]
 
+		case gomatrixserverlib.MRoomEncryption:
+			// If the room would be encrypted by default, an m.room.encryption
+			// event with empty content opts out, so there's nothing to send.
+			content, ok := r.InitialState[i].Content.(map[string]interface{})
+			optOut := r.InitialState[i].Content == nil || (ok && len(content) == 0)
+			if encrypt && optOut {
+				encrypt = false
+				continue
+			}
+			encrypt = false
+			initialStateEvents = append(initialStateEvents, r.InitialState[i])
+
 		default:
 			initialStateEvents = append(initialStateEvents, r.InitialState[i])
 		}
 	}
 
+	if encrypt {
+		initialStateEvents = append(initialStateEvents, fledglingEvent{
+			Type: gomatrixserverlib.MRoomEncryption,
+			Content: map[string]interface{}{
+				"algorithm": encryptionAlgorithmMegolm,
+			},
+		})
+	}
+
 	// send events into the room in order of:
 	//  1- m.room.create
 	//  2- room creator join member
@@ -0,0 +1,274 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+
+	"github.com/matrix-org/dendrite/appservice"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/keyserver"
+	"github.com/matrix-org/dendrite/roomserver"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestRoomCreationLimit(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		cfg := &base.Cfg.ClientAPI
+		cfg.RoomCreation.MaxRoomsPerUser = 2
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		asAPI := appservice.NewInternalAPI(base, userAPI, rsAPI)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		localpart, serverName, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+			AccountType: uapi.AccountTypeUser,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			Password:    "someRandomPassword",
+		}, &uapi.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+
+		aliceDev := &uapi.Device{UserID: alice.ID}
+		for i := 0; i < cfg.RoomCreation.MaxRoomsPerUser; i++ {
+			if resErr := checkRoomCreationLimit(ctx, aliceDev, cfg, rsAPI); resErr != nil {
+				t.Fatalf("room %d: unexpected error: %+v", i, resErr)
+			}
+			resp := createRoom(ctx, createRoomRequest{}, aliceDev, cfg, userAPI, rsAPI, asAPI, time.Now())
+			if _, ok := resp.JSON.(createRoomResponse); !ok {
+				t.Fatalf("response is not a createRoomResponse: %+v", resp)
+			}
+		}
+
+		testCases := []struct {
+			name      string
+			device    *uapi.Device
+			wantError bool
+		}{
+			{
+				name:      "user at the limit is forbidden",
+				device:    aliceDev,
+				wantError: true,
+			},
+			{
+				name:   "admin at the limit is exempt",
+				device: &uapi.Device{UserID: alice.ID, AccountType: uapi.AccountTypeAdmin},
+			},
+			{
+				name:   "other users are unaffected",
+				device: &uapi.Device{UserID: bob.ID},
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				resErr := checkRoomCreationLimit(ctx, tc.device, cfg, rsAPI)
+				if !tc.wantError {
+					if resErr != nil {
+						t.Fatalf("unexpected error: %+v", resErr)
+					}
+					return
+				}
+				if resErr == nil || resErr.Code != http.StatusForbidden {
+					t.Fatalf("expected HTTP %d, got %+v", http.StatusForbidden, resErr)
+				}
+			})
+		}
+	})
+}
+
+func TestCreateRoomEncryptPrivateRooms(t *testing.T) {
+	alice := test.NewUser(t)
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		cfg := &base.Cfg.ClientAPI
+		cfg.RoomCreation.EncryptPrivateRooms = true
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		asAPI := appservice.NewInternalAPI(base, userAPI, rsAPI)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		localpart, serverName, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+			AccountType: uapi.AccountTypeUser,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			Password:    "someRandomPassword",
+		}, &uapi.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+
+		aliceDev := &uapi.Device{UserID: alice.ID}
+		encryptionTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomEncryption, StateKey: ""}
+
+		testCases := []struct {
+			name          string
+			request       createRoomRequest
+			wantAlgorithm string
+		}{
+			{
+				name:          "private chat is encrypted",
+				request:       createRoomRequest{Preset: presetPrivateChat},
+				wantAlgorithm: encryptionAlgorithmMegolm,
+			},
+			{
+				name:          "trusted private chat is encrypted",
+				request:       createRoomRequest{Preset: presetTrustedPrivateChat},
+				wantAlgorithm: encryptionAlgorithmMegolm,
+			},
+			{
+				name:    "public chat is not encrypted",
+				request: createRoomRequest{Preset: presetPublicChat},
+			},
+			{
+				name: "client can opt out",
+				request: createRoomRequest{
+					Preset: presetPrivateChat,
+					InitialState: []fledglingEvent{
+						{Type: gomatrixserverlib.MRoomEncryption, Content: map[string]interface{}{}},
+					},
+				},
+			},
+			{
+				name: "client can choose the algorithm",
+				request: createRoomRequest{
+					Preset: presetPrivateChat,
+					InitialState: []fledglingEvent{
+						{Type: gomatrixserverlib.MRoomEncryption, Content: map[string]interface{}{"algorithm": "org.example.algorithm"}},
+					},
+				},
+				wantAlgorithm: "org.example.algorithm",
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				resp := createRoom(ctx, tc.request, aliceDev, cfg, userAPI, rsAPI, asAPI, time.Now())
+				room, ok := resp.JSON.(createRoomResponse)
+				if !ok {
+					t.Fatalf("response is not a createRoomResponse: %+v", resp)
+				}
+				var stateRes roomserverAPI.QueryCurrentStateResponse
+				if err := rsAPI.QueryCurrentState(ctx, &roomserverAPI.QueryCurrentStateRequest{
+					RoomID:      room.RoomID,
+					StateTuples: []gomatrixserverlib.StateKeyTuple{encryptionTuple},
+				}, &stateRes); err != nil {
+					t.Fatalf("failed to query current state: %s", err)
+				}
+				ev, ok := stateRes.StateEvents[encryptionTuple]
+				if tc.wantAlgorithm == "" {
+					if ok {
+						t.Fatalf("expected room not to be encrypted, got %s", ev.Content())
+					}
+					return
+				}
+				if !ok {
+					t.Fatalf("expected room to be encrypted")
+				}
+				if got := gjson.GetBytes(ev.Content(), "algorithm").Str; got != tc.wantAlgorithm {
+					t.Fatalf("expected algorithm %q, got %q", tc.wantAlgorithm, got)
+				}
+			})
+		}
+	})
+}
+
+func TestCreateRoomAliasValidation(t *testing.T) {
+	alice := test.NewUser(t)
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		cfg := &base.Cfg.ClientAPI
+		cfg.MaxRoomAliasLength = 32
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		asAPI := appservice.NewInternalAPI(base, userAPI, rsAPI)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		localpart, serverName, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+			AccountType: uapi.AccountTypeUser,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			Password:    "someRandomPassword",
+		}, &uapi.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+
+		aliceDev := &uapi.Device{UserID: alice.ID}
+
+		testCases := []struct {
+			name      string
+			aliasName string
+			wantError bool
+		}{
+			{
+				name:      "valid alias",
+				aliasName: "valid",
+			},
+			{
+				name:      "alias over the limit",
+				aliasName: strings.Repeat("a", cfg.MaxRoomAliasLength),
+				wantError: true,
+			},
+			{
+				name:      "alias with whitespace",
+				aliasName: "not valid",
+				wantError: true,
+			},
+			{
+				name:      "alias with control characters",
+				aliasName: "not\x01valid",
+				wantError: true,
+			},
+			{
+				name:      "alias with a colon",
+				aliasName: "not:valid",
+				wantError: true,
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				resp := createRoom(ctx, createRoomRequest{RoomAliasName: tc.aliasName}, aliceDev, cfg, userAPI, rsAPI, asAPI, time.Now())
+				if !tc.wantError {
+					if _, ok := resp.JSON.(createRoomResponse); !ok {
+						t.Fatalf("response is not a createRoomResponse: %+v", resp)
+					}
+					return
+				}
+				if resp.Code != http.StatusBadRequest {
+					t.Fatalf("expected HTTP 400, got %d: %+v", resp.Code, resp.JSON)
+				}
+				if e, ok := resp.JSON.(*jsonerror.MatrixError); !ok || e.ErrCode != "M_INVALID_PARAM" {
+					t.Fatalf("expected M_INVALID_PARAM, got %+v", resp.JSON)
+				}
+			})
+		}
+	})
+}
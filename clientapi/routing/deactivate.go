@@ -1,22 +1,34 @@
 package routing
 
 import (
+	"encoding/json"
 	"io"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
+type deactivateRequest struct {
+	IDServer string `json:"id_server"`
+}
+
+type deactivateResponse struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
 // Deactivate handles POST requests to /account/deactivate
 func Deactivate(
 	req *http.Request,
 	userInteractiveAuth *auth.UserInteractive,
 	accountAPI api.ClientUserAPI,
 	deviceAPI *api.Device,
+	cfg *config.ClientAPI,
 ) util.JSONResponse {
 	ctx := req.Context()
 	defer req.Body.Close() // nolint:errcheck
@@ -33,15 +45,40 @@ func Deactivate(
 		return *errRes
 	}
 
-	localpart, _, err := gomatrixserverlib.SplitID('@', login.Username())
+	var body deactivateRequest
+	if err = json.Unmarshal(bodyBytes, &body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', login.Username())
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
 
+	// Try to unbind all of the user's 3PIDs from the identity servers before
+	// deactivating the account. This is best effort, so the account is still
+	// deactivated if an identity server is unreachable.
+	threePIDs := &api.QueryThreePIDsForLocalpartResponse{}
+	if err = accountAPI.QueryThreePIDsForLocalpart(ctx, &api.QueryThreePIDsForLocalpartRequest{
+		Localpart:  localpart,
+		ServerName: serverName,
+	}, threePIDs); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryThreePIDsForLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	unbindResult := "no-support"
+	if threepid.UnbindAssociations(ctx, body.IDServer, login.Username(), threePIDs.ThreePIDs, cfg) {
+		unbindResult = "success"
+	}
+
 	var res api.PerformAccountDeactivationResponse
 	err = accountAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
-		Localpart: localpart,
+		Localpart:  localpart,
+		ServerName: serverName,
 	}, &res)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAccountDeactivation failed")
@@ -50,6 +87,6 @@ func Deactivate(
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: deactivateResponse{IDServerUnbindResult: unbindResult},
 	}
 }
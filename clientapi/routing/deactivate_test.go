@@ -0,0 +1,79 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/keyserver"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestDeactivateUnbinds3PIDs(t *testing.T) {
+	alice := test.NewUser(t)
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		// Nothing listens here, so unbinding from the identity server fails.
+		base.Cfg.Global.TrustedIDServers = []string{"localhost:1"}
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		keyAPI.SetUserAPI(userAPI)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		localpart, serverName, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+			AccountType: uapi.AccountTypeUser,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			Password:    "someRandomPassword",
+		}, &uapi.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+		for _, address := range []string{localpart + "@example.com", localpart + "@example.org"} {
+			if err := userAPI.PerformSaveThreePIDAssociation(ctx, &uapi.PerformSaveThreePIDAssociationRequest{
+				ThreePID:   address,
+				Localpart:  localpart,
+				ServerName: serverName,
+				Medium:     "email",
+			}, &struct{}{}); err != nil {
+				t.Fatalf("failed to save 3PID association: %s", err)
+			}
+		}
+
+		body := `{"id_server":"localhost:1","auth":{"type":"m.login.password","identifier":{"type":"m.id.user","user":"` + alice.ID + `"},"password":"someRandomPassword"}}`
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/v3/account/deactivate", strings.NewReader(body))
+		userInteractiveAuth := auth.NewUserInteractive(userAPI, &base.Cfg.ClientAPI)
+		res := Deactivate(req, userInteractiveAuth, userAPI, &uapi.Device{UserID: alice.ID}, &base.Cfg.ClientAPI)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+		}
+		// The identity server is unreachable, which must not stop the deactivation.
+		if got := res.JSON.(deactivateResponse).IDServerUnbindResult; got != "no-support" {
+			t.Fatalf("expected id_server_unbind_result %q, got %q", "no-support", got)
+		}
+
+		accRes := &uapi.QueryAccountByPasswordResponse{}
+		if err := userAPI.QueryAccountByPassword(ctx, &uapi.QueryAccountByPasswordRequest{
+			Localpart: localpart, ServerName: serverName, PlaintextPassword: "someRandomPassword",
+		}, accRes); err != nil {
+			t.Fatal(err)
+		}
+		if accRes.Exists {
+			t.Fatalf("expected the account to be deactivated")
+		}
+	})
+}
@@ -17,6 +17,8 @@ package routing
 import (
 	"fmt"
 	"net/http"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -24,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -112,6 +115,38 @@ func DirectoryRoom(
 	}
 }
 
+// validateRoomAlias checks that a room alias is no longer than maxLength
+// bytes and follows the grammar of the spec, i.e. that it is a '#', then a
+// localpart without ':' or NUL characters, then ':' and a valid server name.
+// Whitespace and control characters are not allowed in the localpart either.
+func validateRoomAlias(alias string, maxLength int) *util.JSONResponse {
+	invalid := func(msg string) *util.JSONResponse {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam(msg),
+		}
+	}
+	if len(alias) > maxLength {
+		return invalid(fmt.Sprintf("Room alias must not be longer than %d bytes", maxLength))
+	}
+	localpart, domain, err := gomatrixserverlib.SplitID('#', alias)
+	if err != nil || localpart == "" {
+		return invalid("Room alias must be in the form '#localpart:domain'")
+	}
+	if !utf8.ValidString(localpart) {
+		return invalid("Room alias must be valid UTF-8")
+	}
+	for _, r := range localpart {
+		if r == 0 || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return invalid(fmt.Sprintf("Room alias must not contain the character %q", r))
+		}
+	}
+	if _, _, ok := gomatrixserverlib.ParseAndValidateServerName(domain); !ok {
+		return invalid("Room alias must have a valid server name")
+	}
+	return nil
+}
+
 // SetLocalAlias implements PUT /directory/room/{roomAlias}
 func SetLocalAlias(
 	req *http.Request,
@@ -135,6 +170,10 @@ func SetLocalAlias(
 		}
 	}
 
+	if resErr := validateRoomAlias(alias, cfg.MaxRoomAliasLength); resErr != nil {
+		return *resErr
+	}
+
 	// Check that the alias does not fall within an exclusive namespace of an
 	// application service
 	// TODO: This code should eventually be refactored with:
@@ -274,22 +313,13 @@ func SetVisibility(
 		return *resErr
 	}
 
-	queryEventsReq := roomserverAPI.QueryLatestEventsAndStateRequest{
-		RoomID: roomID,
-		StateToFetch: []gomatrixserverlib.StateKeyTuple{{
-			EventType: gomatrixserverlib.MRoomPowerLevels,
-			StateKey:  "",
-		}},
-	}
-	var queryEventsRes roomserverAPI.QueryLatestEventsAndStateResponse
-	err := rsAPI.QueryLatestEventsAndState(req.Context(), &queryEventsReq, &queryEventsRes)
-	if err != nil || len(queryEventsRes.StateEvents) == 0 {
-		util.GetLogger(req.Context()).WithError(err).Error("could not query events from room")
+	power, err := eventutil.GetPowerLevels(req.Context(), rsAPI, roomID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("could not get the power levels of the room")
 		return jsonerror.InternalServerError()
 	}
 
 	// NOTSPEC: Check if the user's power is greater than power required to change m.room.canonical_alias event
-	power, _ := gomatrixserverlib.NewPowerLevelContentFromEvent(queryEventsRes.StateEvents[0].Event)
 	if power.UserLevel(dev.UserID) < power.EventLevel(gomatrixserverlib.MRoomCanonicalAlias, true) {
 		return util.JSONResponse{
 			Code: http.StatusForbidden,
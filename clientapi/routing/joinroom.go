@@ -15,12 +15,16 @@
 package routing
 
 import (
+	"context"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	internalHTTPUtil "github.com/matrix-org/dendrite/internal/httputil"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -31,6 +35,7 @@ func JoinRoomByIDOrAlias(
 	device *api.Device,
 	rsAPI roomserverAPI.ClientRoomserverAPI,
 	profileAPI api.ClientUserAPI,
+	cfg *config.ClientAPI,
 	roomIDOrAlias string,
 ) util.JSONResponse {
 	// Prepare to ask the roomserver to perform the room join.
@@ -77,6 +82,12 @@ func JoinRoomByIDOrAlias(
 		joinReq.Content["displayname"] = res.DisplayName
 		joinReq.Content["avatar_url"] = res.AvatarURL
 	}
+	if cfg.MembershipProfile.StripDisplayName {
+		delete(joinReq.Content, "displayname")
+	}
+	if cfg.MembershipProfile.StripAvatarURL {
+		delete(joinReq.Content, "avatar_url")
+	}
 
 	// Ask the roomserver to perform the join.
 	done := make(chan util.JSONResponse, 1)
@@ -116,3 +127,49 @@ func JoinRoomByIDOrAlias(
 		return result
 	}
 }
+
+// limitRoomJoin applies the per-room join rate limits. Local room aliases
+// are resolved first, so that joins by alias and by room ID count against
+// the same room.
+func limitRoomJoin(
+	ctx context.Context, device *api.Device, rsAPI roomserverAPI.ClientRoomserverAPI,
+	limits *internalHTTPUtil.RateLimits, roomIDOrAlias string,
+) *util.JSONResponse {
+	if !limits.Enabled() {
+		return nil
+	}
+	roomID := roomIDOrAlias
+	if strings.HasPrefix(roomIDOrAlias, "#") {
+		var aliasRes roomserverAPI.GetRoomIDForAliasResponse
+		if err := rsAPI.GetRoomIDForAlias(ctx, &roomserverAPI.GetRoomIDForAliasRequest{Alias: roomIDOrAlias}, &aliasRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rsAPI.GetRoomIDForAlias failed")
+		} else if aliasRes.RoomID != "" {
+			roomID = aliasRes.RoomID
+		}
+	}
+	return limits.LimitRoomJoin(roomID, device)
+}
+
+// checkGuestCanJoin returns an error response unless guests are allowed to
+// join the room, i.e. its m.room.guest_access is "can_join".
+func checkGuestCanJoin(
+	ctx context.Context, rsAPI roomserverAPI.ClientRoomserverAPI, roomID string,
+) *util.JSONResponse {
+	guestAccessTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomGuestAccess, StateKey: ""}
+	var stateRes roomserverAPI.QueryBulkStateContentResponse
+	if err := rsAPI.QueryBulkStateContent(ctx, &roomserverAPI.QueryBulkStateContentRequest{
+		RoomIDs:     []string{roomID},
+		StateTuples: []gomatrixserverlib.StateKeyTuple{guestAccessTuple},
+	}, &stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryBulkStateContent failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if stateRes.Rooms[roomID][guestAccessTuple] == "can_join" {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.GuestAccessForbidden("Guest access is forbidden"),
+	}
+}
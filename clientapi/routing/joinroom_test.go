@@ -10,8 +10,11 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/dendrite/appservice"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/keyserver"
 	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/dendrite/test/testrig"
 	"github.com/matrix-org/dendrite/userapi"
@@ -96,6 +99,7 @@ func TestJoinRoomByIDOrAlias(t *testing.T) {
 			device      *uapi.Device
 			roomID      string
 			wantHTTP200 bool
+			wantErrCode string
 		}{
 			{
 				name:        "User can join successfully by alias",
@@ -110,9 +114,10 @@ func TestJoinRoomByIDOrAlias(t *testing.T) {
 				wantHTTP200: true,
 			},
 			{
-				name:   "join is forbidden if user is guest",
-				device: charlieDev,
-				roomID: crResp.RoomID,
+				name:        "join is forbidden if user is guest",
+				device:      charlieDev,
+				roomID:      crResp.RoomID,
+				wantErrCode: "M_GUEST_ACCESS_FORBIDDEN",
 			},
 			{
 				name:   "room does not exist",
@@ -140,19 +145,69 @@ func TestJoinRoomByIDOrAlias(t *testing.T) {
 				roomID: "#doesnotexist:test",
 			},
 			{
-				name:   "room with guest_access event",
-				device: charlieDev,
-				roomID: crRespWithGuestAccess.RoomID,
+				name:        "guest can join room with guest_access can_join",
+				device:      charlieDev,
+				roomID:      crRespWithGuestAccess.RoomID,
+				wantHTTP200: true,
 			},
 		}
 
 		for _, tc := range testCases {
 			t.Run(tc.name, func(t *testing.T) {
-				joinResp := JoinRoomByIDOrAlias(req, tc.device, rsAPI, userAPI, tc.roomID)
+				joinResp := JoinRoomByIDOrAlias(req, tc.device, rsAPI, userAPI, &base.Cfg.ClientAPI, tc.roomID)
 				if tc.wantHTTP200 && !joinResp.Is2xx() {
 					t.Fatalf("expected join room to succeed, but didn't: %+v", joinResp)
 				}
+				if tc.wantErrCode != "" {
+					matrixErr, ok := joinResp.JSON.(*jsonerror.MatrixError)
+					if joinResp.Code != http.StatusForbidden || !ok || matrixErr.ErrCode != tc.wantErrCode {
+						t.Fatalf("expected HTTP %d with %s, got %+v", http.StatusForbidden, tc.wantErrCode, joinResp)
+					}
+				}
 			})
 		}
+
+		// Guests can't get around guest access by sending their own membership.
+		t.Run("guest join via state event is forbidden", func(t *testing.T) {
+			stateReq, err := http.NewRequest(http.MethodPut, "/", bytes.NewBufferString(`{"membership":"join"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			stateKey := charlie.ID
+			resp := SendEvent(stateReq, charlieDev, crResp.RoomID, gomatrixserverlib.MRoomMember, nil, &stateKey, &base.Cfg.ClientAPI, rsAPI, nil)
+			matrixErr, ok := resp.JSON.(*jsonerror.MatrixError)
+			if resp.Code != http.StatusForbidden || !ok || matrixErr.ErrCode != "M_GUEST_ACCESS_FORBIDDEN" {
+				t.Fatalf("expected HTTP %d with M_GUEST_ACCESS_FORBIDDEN, got %+v", http.StatusForbidden, resp)
+			}
+		})
+
+		// Joins by alias and by room ID count against the same room.
+		t.Run("join flood is throttled", func(t *testing.T) {
+			limits := httputil.NewRateLimits(&config.RateLimiting{
+				Enabled:   true,
+				Threshold: 2,
+				CooloffMS: 60000,
+			}, nil)
+			for _, roomIDOrAlias := range []string{crResp.RoomAlias, crResp.RoomID} {
+				if res := limitRoomJoin(ctx, bobDev, rsAPI, limits, roomIDOrAlias); res != nil {
+					t.Fatalf("join to %s was unexpectedly rate limited: %+v", roomIDOrAlias, res)
+				}
+			}
+			res := limitRoomJoin(ctx, charlieDev, rsAPI, limits, crResp.RoomAlias)
+			if res == nil {
+				t.Fatalf("expected join to be rate limited")
+			}
+			limitErr, ok := res.JSON.(*jsonerror.LimitExceededError)
+			if res.Code != http.StatusTooManyRequests || !ok || limitErr.ErrCode != "M_LIMIT_EXCEEDED" {
+				t.Fatalf("expected HTTP %d with M_LIMIT_EXCEEDED, got %+v", http.StatusTooManyRequests, res)
+			}
+			if res = limitRoomJoin(ctx, charlieDev, rsAPI, limits, crRespWithGuestAccess.RoomID); res != nil {
+				t.Fatalf("join to another room was unexpectedly rate limited: %+v", res)
+			}
+			adminDev := &uapi.Device{UserID: alice.ID, AccountType: uapi.AccountTypeAdmin}
+			if res = limitRoomJoin(ctx, adminDev, rsAPI, limits, crResp.RoomID); res != nil {
+				t.Fatalf("join by an admin was unexpectedly rate limited: %+v", res)
+			}
+		})
 	})
 }
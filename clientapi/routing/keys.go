@@ -23,7 +23,9 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	internalHTTPUtil "github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
 
@@ -32,13 +34,30 @@ type uploadKeysRequest struct {
 	OneTimeKeys map[string]json.RawMessage `json:"one_time_keys"`
 }
 
-func UploadKeys(req *http.Request, keyAPI api.ClientKeyAPI, device *userapi.Device) util.JSONResponse {
+// keyUploadRateLimits are the per-device rate limits of /keys/upload.
+type keyUploadRateLimits struct {
+	deviceKeys  *internalHTTPUtil.RateLimits
+	oneTimeKeys *internalHTTPUtil.RateLimits
+}
+
+func UploadKeys(req *http.Request, keyAPI api.ClientKeyAPI, device *userapi.Device, rateLimits *keyUploadRateLimits) util.JSONResponse {
 	var r uploadKeysRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
 	if resErr != nil {
 		return *resErr
 	}
 
+	if r.DeviceKeys != nil {
+		if resErr = rateLimits.deviceKeys.Limit(req, device); resErr != nil {
+			return *resErr
+		}
+	}
+	if len(r.OneTimeKeys) > 0 {
+		if resErr = rateLimits.oneTimeKeys.Limit(req, device); resErr != nil {
+			return *resErr
+		}
+	}
+
 	uploadReq := &api.PerformUploadKeysRequest{
 		DeviceID: device.ID,
 		UserID:   device.UserID,
@@ -112,12 +131,23 @@ func QueryKeys(req *http.Request, keyAPI api.ClientKeyAPI, device *userapi.Devic
 	if resErr != nil {
 		return *resErr
 	}
+	// The token is the since token of the /sync that told the client about
+	// the device list changes, if any. An unparseable token is ignored, as
+	// it only allows us to avoid querying remote servers.
+	var deviceListPosition int64
+	if r.Token != "" {
+		if token, err := types.NewStreamTokenFromString(r.Token); err == nil {
+			deviceListPosition = int64(token.DeviceListPosition)
+		} else {
+			util.GetLogger(req.Context()).WithError(err).Debug("Ignoring invalid /keys/query token")
+		}
+	}
 	queryRes := api.QueryKeysResponse{}
 	if err := keyAPI.QueryKeys(req.Context(), &api.QueryKeysRequest{
-		UserID:        device.UserID,
-		UserToDevices: r.DeviceKeys,
-		Timeout:       r.GetTimeout(),
-		// TODO: Token?
+		UserID:             device.UserID,
+		UserToDevices:      r.DeviceKeys,
+		Timeout:            r.GetTimeout(),
+		DeviceListPosition: deviceListPosition,
 	}, &queryRes); err != nil {
 		return util.ErrorResponse(err)
 	}
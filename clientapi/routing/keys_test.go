@@ -0,0 +1,109 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+type uploadKeysKeyAPI struct {
+	api.ClientKeyAPI
+	uploads int
+}
+
+func (k *uploadKeysKeyAPI) PerformUploadKeys(_ context.Context, _ *api.PerformUploadKeysRequest, _ *api.PerformUploadKeysResponse) error {
+	k.uploads++
+	return nil
+}
+
+func TestUploadKeysRateLimiting(t *testing.T) {
+	cfg := config.KeyUploads{}
+	cfg.Defaults()
+	newRateLimits := func() *keyUploadRateLimits {
+		return &keyUploadRateLimits{
+			deviceKeys:  httputil.NewRateLimits(&cfg.DeviceKeys, nil),
+			oneTimeKeys: httputil.NewRateLimits(&cfg.OneTimeKeys, nil),
+		}
+	}
+	upload := func(rateLimits *keyUploadRateLimits, keyAPI api.ClientKeyAPI, device *userapi.Device, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		res := UploadKeys(req, keyAPI, device, rateLimits)
+		if res.Code == http.StatusTooManyRequests {
+			if e, ok := res.JSON.(*jsonerror.LimitExceededError); !ok || e.ErrCode != "M_LIMIT_EXCEEDED" {
+				t.Fatalf("expected M_LIMIT_EXCEEDED, got %+v", res.JSON)
+			}
+		}
+		return res.Code
+	}
+	oneTimeKeys := func(n int) string {
+		keys := make([]string, n)
+		for i := range keys {
+			keys[i] = fmt.Sprintf(`"signed_curve25519:%d":{"key":"key%d"}`, i, i)
+		}
+		return `{"one_time_keys":{` + strings.Join(keys, ",") + `}}`
+	}
+	alice := &userapi.Device{ID: "ALICE", UserID: "@alice:test"}
+	bob := &userapi.Device{ID: "BOB", UserID: "@bob:test"}
+
+	t.Run("normal replenishment passes", func(t *testing.T) {
+		rateLimits, keyAPI := newRateLimits(), &uploadKeysKeyAPI{}
+		if code := upload(rateLimits, keyAPI, alice, `{"device_keys":{},"one_time_keys":{}}`); code != http.StatusOK {
+			t.Fatalf("expected the initial upload to succeed, got HTTP %d", code)
+		}
+		// Clients upload several batches of one-time keys in a row when they run low.
+		for i := 0; i < 5; i++ {
+			if code := upload(rateLimits, keyAPI, alice, oneTimeKeys(50)); code != http.StatusOK {
+				t.Fatalf("expected replenishing one-time keys to succeed, got HTTP %d", code)
+			}
+		}
+		if keyAPI.uploads != 6 {
+			t.Fatalf("expected 6 uploads, got %d", keyAPI.uploads)
+		}
+	})
+
+	t.Run("excessive one-time key uploads are throttled", func(t *testing.T) {
+		rateLimits, keyAPI := newRateLimits(), &uploadKeysKeyAPI{}
+		for i := int64(0); i < cfg.OneTimeKeys.Threshold; i++ {
+			if code := upload(rateLimits, keyAPI, alice, oneTimeKeys(1)); code != http.StatusOK {
+				t.Fatalf("expected upload %d to succeed, got HTTP %d", i, code)
+			}
+		}
+		if code := upload(rateLimits, keyAPI, alice, oneTimeKeys(1)); code != http.StatusTooManyRequests {
+			t.Fatalf("expected HTTP %d, got %d", http.StatusTooManyRequests, code)
+		}
+		if keyAPI.uploads != int(cfg.OneTimeKeys.Threshold) {
+			t.Fatalf("expected throttled uploads not to reach the key server, got %d uploads", keyAPI.uploads)
+		}
+		// The limits are per device, and requests without keys aren't limited.
+		if code := upload(rateLimits, keyAPI, bob, oneTimeKeys(1)); code != http.StatusOK {
+			t.Fatalf("expected another device's upload to succeed, got HTTP %d", code)
+		}
+		if code := upload(rateLimits, keyAPI, alice, `{}`); code != http.StatusOK {
+			t.Fatalf("expected a request without keys to succeed, got HTTP %d", code)
+		}
+	})
+
+	t.Run("excessive device key uploads are throttled", func(t *testing.T) {
+		rateLimits, keyAPI := newRateLimits(), &uploadKeysKeyAPI{}
+		for i := int64(0); i < cfg.DeviceKeys.Threshold; i++ {
+			if code := upload(rateLimits, keyAPI, alice, `{"device_keys":{}}`); code != http.StatusOK {
+				t.Fatalf("expected upload %d to succeed, got HTTP %d", i, code)
+			}
+		}
+		if code := upload(rateLimits, keyAPI, alice, `{"device_keys":{}}`); code != http.StatusTooManyRequests {
+			t.Fatalf("expected HTTP %d, got %d", http.StatusTooManyRequests, code)
+		}
+		if code := upload(rateLimits, keyAPI, alice, oneTimeKeys(1)); code != http.StatusOK {
+			t.Fatalf("expected one-time keys to be limited separately, got HTTP %d", code)
+		}
+	})
+}
@@ -17,6 +17,7 @@ package routing
 import (
 	"context"
 	"net/http"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
@@ -79,11 +80,17 @@ func ssoLogin(cfg *config.ClientAPI) []stage {
 				brand = config.SSOBrand(idp.ID)
 			}
 		}
+		icon := idp.Icon
+		if cfg.Derived != nil {
+			if localIcon, ok := cfg.Derived.SSOIcons[idp.WithDefaults().ID]; ok {
+				icon = localIcon.ContentURI
+			}
+		}
 		idps = append(idps, identityProvider{
 			ID:    idp.ID,
 			Name:  idp.Name,
 			Brand: brand,
-			Icon:  idp.Icon,
+			Icon:  icon,
 		})
 	}
 	return []stage{
@@ -106,21 +113,40 @@ func tokenLogin(cfg *config.ClientAPI) []stage {
 	}
 }
 
+// loginFlows returns the enabled login flows in the configured order,
+// followed by any others in the default order.
+func loginFlows(cfg *config.ClientAPI) []stage {
+	allFlows := []stage{}
+	seen := map[authtypes.LoginType]bool{}
+	order := append(append([]authtypes.LoginType{}, cfg.Login.FlowOrder...), config.DefaultLoginFlowOrder...)
+	for _, typ := range order {
+		if seen[typ] {
+			continue
+		}
+		seen[typ] = true
+		switch typ {
+		case authtypes.LoginTypePassword:
+			if cfg.Login.PasswordEnabled() {
+				allFlows = append(allFlows, passwordLogin()...)
+			}
+		case authtypes.LoginTypeSSO:
+			allFlows = append(allFlows, ssoLogin(cfg)...)
+		case authtypes.LoginTypeToken:
+			allFlows = append(allFlows, tokenLogin(cfg)...)
+		}
+	}
+	return allFlows
+}
+
 // Login implements GET and POST /login
 func Login(
 	req *http.Request, userAPI userapi.ClientUserAPI,
 	cfg *config.ClientAPI,
 ) util.JSONResponse {
 	if req.Method == http.MethodGet {
-		allFlows := []stage{}
-		if cfg.Login.PasswordEnabled() {
-			allFlows = append(allFlows, passwordLogin()...)
-		}
-		allFlows = append(allFlows, ssoLogin(cfg)...)
-		allFlows = append(allFlows, tokenLogin(cfg)...)
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: flows{Flows: allFlows},
+			JSON: flows{Flows: loginFlows(cfg)},
 		}
 	} else if req.Method == http.MethodPost {
 		login, cleanup, authErr := auth.LoginFromJSONReader(req.Context(), req.Body, userAPI, userAPI, cfg)
@@ -155,15 +181,24 @@ func completeAuth(
 		return jsonerror.InternalServerError()
 	}
 
+	// Name new devices after the client if it didn't name them itself, so
+	// that users can tell them apart. Existing devices keep their name.
+	displayName := login.InitialDisplayName
+	if displayName == nil && login.DeviceID == nil {
+		displayName = defaultDeviceDisplayName(userAgent)
+	}
+
 	var performRes userapi.PerformDeviceCreationResponse
 	err = userAPI.PerformDeviceCreation(ctx, &userapi.PerformDeviceCreationRequest{
-		DeviceDisplayName: login.InitialDisplayName,
+		DeviceDisplayName: displayName,
 		DeviceID:          login.DeviceID,
 		AccessToken:       token,
 		Localpart:         localpart,
 		ServerName:        serverName,
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
+		SSOProvider:       login.SSOProvider,
+		SSOIDToken:        login.SSOIDToken,
 	}, &performRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -181,3 +216,20 @@ func completeAuth(
 		},
 	}
 }
+
+// maxDefaultDeviceDisplayNameLength limits how much of the user agent is used
+// as the display name of a device.
+const maxDefaultDeviceDisplayNameLength = 100
+
+// defaultDeviceDisplayName returns a display name for a device based on the
+// user agent of the client, or nil if there is no user agent.
+func defaultDeviceDisplayName(userAgent string) *string {
+	name := strings.TrimSpace(userAgent)
+	if name == "" {
+		return nil
+	}
+	if runes := []rune(name); len(runes) > maxDefaultDeviceDisplayNameLength {
+		name = string(runes[:maxDefaultDeviceDisplayNameLength])
+	}
+	return &name
+}
@@ -2,9 +2,14 @@ package routing
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -150,3 +155,198 @@ func TestLogin(t *testing.T) {
 		}
 	})
 }
+
+func TestLoginDeviceDisplayName(t *testing.T) {
+	alice := test.NewUser(t)
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		base.Cfg.ClientAPI.RateLimiting.Enabled = false
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		keyAPI.SetUserAPI(userAPI)
+
+		Setup(base, &base.Cfg.ClientAPI, nil, nil, userAPI, nil, nil, nil, nil, nil, keyAPI, nil, &base.Cfg.MSCs, nil)
+
+		password := util.RandomString(8)
+		localpart, serverName, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+			AccountType: uapi.AccountTypeUser,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			Password:    password,
+		}, &uapi.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+
+		testCases := []struct {
+			name            string
+			deviceID        string
+			displayName     string
+			userAgent       string
+			wantDisplayName string
+		}{
+			{
+				name:            "display name is stored",
+				deviceID:        "PHONE",
+				displayName:     "Alice's phone",
+				userAgent:       "TestClient/1.0",
+				wantDisplayName: "Alice's phone",
+			},
+			{
+				name:            "display name defaults to the user agent",
+				userAgent:       "TestClient/1.0",
+				wantDisplayName: "TestClient/1.0",
+			},
+			{
+				name:            "existing device keeps its display name",
+				deviceID:        "PHONE",
+				userAgent:       "TestClient/2.0",
+				wantDisplayName: "Alice's phone",
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				body := map[string]interface{}{
+					"type": authtypes.LoginTypePassword,
+					"identifier": map[string]interface{}{
+						"type": "m.id.user",
+						"user": alice.ID,
+					},
+					"password": password,
+				}
+				if tc.deviceID != "" {
+					body["device_id"] = tc.deviceID
+				}
+				if tc.displayName != "" {
+					body["initial_device_display_name"] = tc.displayName
+				}
+				req := test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/login", test.WithJSONBody(t, body))
+				req.Header.Set("User-Agent", tc.userAgent)
+				rec := httptest.NewRecorder()
+				base.PublicClientAPIMux.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to login: %s", rec.Body.String())
+				}
+				resp := loginResponse{}
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+
+				req = test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/devices", test.WithQueryParams(map[string]string{
+					"access_token": resp.AccessToken,
+				}))
+				rec = httptest.NewRecorder()
+				base.PublicClientAPIMux.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to get devices: %s", rec.Body.String())
+				}
+				devices := devicesJSON{}
+				if err := json.Unmarshal(rec.Body.Bytes(), &devices); err != nil {
+					t.Fatal(err)
+				}
+				for _, dev := range devices.Devices {
+					if dev.DeviceID != resp.DeviceID {
+						continue
+					}
+					if dev.DisplayName != tc.wantDisplayName {
+						t.Fatalf("expected display name %q, got %q", tc.wantDisplayName, dev.DisplayName)
+					}
+					return
+				}
+				t.Fatalf("device %q not found in %s", resp.DeviceID, rec.Body.String())
+			})
+		}
+	})
+}
+
+func TestLoginFlowOrder(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Login: config.Login{
+			SSO: config.SSO{
+				Enabled:   true,
+				Providers: []config.IdentityProvider{{ID: "github", Name: "GitHub"}},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name      string
+		flowOrder []authtypes.LoginType
+		want      []string
+	}{
+		{
+			name: "default order",
+			want: []string{authtypes.LoginTypePassword, authtypes.LoginTypeSSO, authtypes.LoginTypeToken},
+		},
+		{
+			name:      "configured order",
+			flowOrder: []authtypes.LoginType{authtypes.LoginTypeSSO, authtypes.LoginTypeToken, authtypes.LoginTypePassword},
+			want:      []string{authtypes.LoginTypeSSO, authtypes.LoginTypeToken, authtypes.LoginTypePassword},
+		},
+		{
+			name:      "unlisted login types follow in the default order",
+			flowOrder: []authtypes.LoginType{authtypes.LoginTypeToken},
+			want:      []string{authtypes.LoginTypeToken, authtypes.LoginTypePassword, authtypes.LoginTypeSSO},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg.Login.FlowOrder = tc.flowOrder
+			res := Login(httptest.NewRequest(http.MethodGet, "/_matrix/client/v3/login", nil), nil, cfg)
+			if res.Code != http.StatusOK {
+				t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+			}
+			var got []string
+			for _, flow := range res.JSON.(flows).Flows {
+				got = append(got, flow.Type)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("expected flows %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestLoginSSOIcon(t *testing.T) {
+	icon := []byte("\x89PNG\r\n\x1a\n" + "an icon")
+	iconPath := filepath.Join(t.TempDir(), "icon.png")
+	if err := os.WriteFile(iconPath, icon, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Dendrite{}
+	cfg.Defaults(config.DefaultOpts{Generate: true, Monolithic: true})
+	cfg.ClientAPI.Login.SSO = config.SSO{
+		Enabled: true,
+		Providers: []config.IdentityProvider{
+			{ID: "github", Name: "GitHub", IconPath: config.Path(iconPath)},
+			{ID: "gitlab", Name: "GitLab", Icon: "mxc://example.com/gitlab"},
+		},
+	}
+	if err := cfg.Derive(); err != nil {
+		t.Fatalf("failed to derive config: %v", err)
+	}
+
+	res := Login(httptest.NewRequest(http.MethodGet, "/_matrix/client/v3/login", nil), nil, &cfg.ClientAPI)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+	}
+	var got []string
+	for _, flow := range res.JSON.(flows).Flows {
+		for _, idp := range flow.IdentityProviders {
+			got = append(got, idp.Icon)
+		}
+	}
+	hash := sha256.Sum256(icon)
+	want := []string{"mxc://" + string(cfg.Global.ServerName) + "/" + hex.EncodeToString(hash[:]), "mxc://example.com/gitlab"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected icons %v, got %v", want, got)
+	}
+}
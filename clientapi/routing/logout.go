@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -22,9 +23,14 @@ import (
 	"github.com/matrix-org/util"
 )
 
+// ssoLogouter ends sessions at SSO identity providers.
+type ssoLogouter interface {
+	Logout(ctx context.Context, providerID, idToken string) error
+}
+
 // Logout handles POST /logout
 func Logout(
-	req *http.Request, userAPI api.ClientUserAPI, device *api.Device,
+	req *http.Request, userAPI api.ClientUserAPI, device *api.Device, ssoAuth ssoLogouter,
 ) util.JSONResponse {
 	var performRes api.PerformDeviceDeletionResponse
 	err := userAPI.PerformDeviceDeletion(req.Context(), &api.PerformDeviceDeletionRequest{
@@ -35,6 +41,7 @@ func Logout(
 		util.GetLogger(req.Context()).WithError(err).Error("PerformDeviceDeletion failed")
 		return jsonerror.InternalServerError()
 	}
+	propagateSSOLogout(req.Context(), ssoAuth, device)
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
@@ -44,7 +51,7 @@ func Logout(
 
 // LogoutAll handles POST /logout/all
 func LogoutAll(
-	req *http.Request, userAPI api.ClientUserAPI, device *api.Device,
+	req *http.Request, userAPI api.ClientUserAPI, device *api.Device, ssoAuth ssoLogouter,
 ) util.JSONResponse {
 	var performRes api.PerformDeviceDeletionResponse
 	err := userAPI.PerformDeviceDeletion(req.Context(), &api.PerformDeviceDeletionRequest{
@@ -55,9 +62,24 @@ func LogoutAll(
 		util.GetLogger(req.Context()).WithError(err).Error("PerformDeviceDeletion failed")
 		return jsonerror.InternalServerError()
 	}
+	for i := range performRes.Devices {
+		propagateSSOLogout(req.Context(), ssoAuth, &performRes.Devices[i])
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
 	}
 }
+
+// propagateSSOLogout ends the session at the SSO identity provider which
+// the device logged in with, if any. The device has already been logged
+// out, so failures are only logged.
+func propagateSSOLogout(ctx context.Context, ssoAuth ssoLogouter, device *api.Device) {
+	if ssoAuth == nil || device.SSOProvider == "" {
+		return
+	}
+	if err := ssoAuth.Logout(ctx, device.SSOProvider, device.SSOIDToken); err != nil {
+		util.GetLogger(ctx).WithError(err).WithField("ssoProvider", device.SSOProvider).Error("Failed to propagate logout to SSO identity provider")
+	}
+}
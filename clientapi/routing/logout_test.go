@@ -0,0 +1,259 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/keyserver"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestLogout(t *testing.T) {
+	alice := test.NewUser(t)
+
+	// A fake OIDC identity provider, which records calls to its end session endpoint.
+	var endSessionMu sync.Mutex
+	var endSessionQueries []url.Values
+	idpMux := http.NewServeMux()
+	idp := httptest.NewServer(idpMux)
+	defer idp.Close()
+	idpMux.HandleFunc("/discovery", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL + "/",
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"userinfo_endpoint":      idp.URL + "/userinfo",
+			"end_session_endpoint":   idp.URL + "/end_session",
+		})
+	})
+	idpMux.HandleFunc("/end_session", func(w http.ResponseWriter, r *http.Request) {
+		endSessionMu.Lock()
+		defer endSessionMu.Unlock()
+		endSessionQueries = append(endSessionQueries, r.URL.Query())
+	})
+	takeEndSessionQueries := func() []url.Values {
+		endSessionMu.Lock()
+		defer endSessionMu.Unlock()
+		queries := endSessionQueries
+		endSessionQueries = nil
+		return queries
+	}
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		base.Cfg.ClientAPI.RateLimiting.Enabled = false
+		base.Cfg.ClientAPI.Login.SSO = config.SSO{
+			Enabled: true,
+			Providers: []config.IdentityProvider{{
+				ID:   "anidp",
+				Name: "An IdP",
+				OIDC: config.OIDC{
+					OAuth2:       config.OAuth2{ClientID: "aclientid", ClientSecret: "aclientsecret"},
+					DiscoveryURL: idp.URL + "/discovery",
+				},
+				PropagateLogout: true,
+			}},
+		}
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		keyAPI.SetUserAPI(userAPI)
+
+		Setup(base, &base.Cfg.ClientAPI, nil, nil, userAPI, nil, nil, nil, nil, nil, keyAPI, nil, &base.Cfg.MSCs, nil)
+
+		password := util.RandomString(8)
+		localpart, serverName, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+			AccountType: uapi.AccountTypeUser,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			Password:    password,
+		}, &uapi.PerformAccountCreationResponse{}); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+
+		login := func(t *testing.T) loginResponse {
+			t.Helper()
+			req := test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/login", test.WithJSONBody(t, map[string]interface{}{
+				"type": authtypes.LoginTypePassword,
+				"identifier": map[string]interface{}{
+					"type": "m.id.user",
+					"user": alice.ID,
+				},
+				"password": password,
+			}))
+			rec := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("failed to login: %s", rec.Body.String())
+			}
+			var resp loginResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+		logout := func(t *testing.T, accessToken string) *httptest.ResponseRecorder {
+			t.Helper()
+			req := test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/logout", test.WithJSONBody(t, map[string]interface{}{}))
+			req.Header.Set("Authorization", "Bearer "+accessToken)
+			rec := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(rec, req)
+			return rec
+		}
+		assertLoggedOut := func(t *testing.T, resp loginResponse) {
+			t.Helper()
+			var res uapi.QueryDevicesResponse
+			if err := userAPI.QueryDevices(ctx, &uapi.QueryDevicesRequest{UserID: resp.UserID}, &res); err != nil {
+				t.Fatal(err)
+			}
+			for _, dev := range res.Devices {
+				if dev.ID == resp.DeviceID {
+					t.Fatalf("expected device %s to be deleted", resp.DeviceID)
+				}
+			}
+			req := test.NewRequest(t, http.MethodGet, "/_matrix/client/v3/account/whoami")
+			req.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+			rec := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("expected the access token to be invalid after logging out, got HTTP %d: %s", rec.Code, rec.Body.String())
+			}
+		}
+
+		assertUnknownToken := func(t *testing.T, rec *httptest.ResponseRecorder) {
+			t.Helper()
+			var e jsonerror.MatrixError
+			if err := json.Unmarshal(rec.Body.Bytes(), &e); rec.Code != http.StatusUnauthorized || err != nil || e.ErrCode != "M_UNKNOWN_TOKEN" {
+				t.Fatalf("expected HTTP 401 M_UNKNOWN_TOKEN, got %d: %s", rec.Code, rec.Body.String())
+			}
+		}
+
+		t.Run("double logout", func(t *testing.T) {
+			resp := login(t)
+			if rec := logout(t, resp.AccessToken); rec.Code != http.StatusOK {
+				t.Fatalf("expected HTTP 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			assertLoggedOut(t, resp)
+			// The access token doesn't exist any more.
+			assertUnknownToken(t, logout(t, resp.AccessToken))
+		})
+
+		t.Run("concurrent logout", func(t *testing.T) {
+			resp := login(t)
+			recs := make([]*httptest.ResponseRecorder, 5)
+			var wg sync.WaitGroup
+			for i := range recs {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					recs[i] = logout(t, resp.AccessToken)
+				}(i)
+			}
+			wg.Wait()
+			// Requests which were authenticated before the device was deleted
+			// succeed, the others find the access token gone.
+			for _, rec := range recs {
+				if rec.Code != http.StatusOK {
+					assertUnknownToken(t, rec)
+				}
+			}
+			assertLoggedOut(t, resp)
+		})
+
+		ssoLogin := func(t *testing.T, idToken string) loginResponse {
+			t.Helper()
+			var tokenRes uapi.PerformLoginTokenCreationResponse
+			if err := userAPI.PerformLoginTokenCreation(ctx, &uapi.PerformLoginTokenCreationRequest{
+				Data: uapi.LoginTokenData{UserID: alice.ID, SSOProvider: "anidp", SSOIDToken: idToken},
+			}, &tokenRes); err != nil {
+				t.Fatal(err)
+			}
+			req := test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/login", test.WithJSONBody(t, map[string]interface{}{
+				"type":  authtypes.LoginTypeToken,
+				"token": tokenRes.Metadata.Token,
+			}))
+			rec := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("failed to login: %s", rec.Body.String())
+			}
+			var resp loginResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+
+		t.Run("SSO logout", func(t *testing.T) {
+			// Devices which didn't log in with SSO don't propagate their logout.
+			if queries := takeEndSessionQueries(); len(queries) != 0 {
+				t.Fatalf("expected no end session calls for password logins, got %v", queries)
+			}
+
+			resp := ssoLogin(t, "anidtoken")
+			if rec := logout(t, resp.AccessToken); rec.Code != http.StatusOK {
+				t.Fatalf("expected HTTP 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			assertLoggedOut(t, resp)
+			queries := takeEndSessionQueries()
+			if len(queries) != 1 || queries[0].Get("client_id") != "aclientid" || queries[0].Get("id_token_hint") != "anidtoken" {
+				t.Fatalf("expected the end session endpoint to be called once for anidtoken, got %v", queries)
+			}
+		})
+
+		t.Run("SSO logout all", func(t *testing.T) {
+			resps := []loginResponse{login(t), ssoLogin(t, "idtoken1"), ssoLogin(t, "idtoken2")}
+
+			req := test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/logout/all", test.WithJSONBody(t, map[string]interface{}{}))
+			req.Header.Set("Authorization", "Bearer "+resps[0].AccessToken)
+			rec := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected HTTP 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+			for _, resp := range resps {
+				assertLoggedOut(t, resp)
+			}
+
+			// Every removed SSO device ends its own session, not only the
+			// device which made the request.
+			gotIDTokens := map[string]bool{}
+			for _, q := range takeEndSessionQueries() {
+				gotIDTokens[q.Get("id_token_hint")] = true
+			}
+			if want := map[string]bool{"idtoken1": true, "idtoken2": true}; !reflect.DeepEqual(gotIDTokens, want) {
+				t.Fatalf("expected end session calls for %v, got %v", want, gotIDTokens)
+			}
+		})
+
+		t.Run("missing access token", func(t *testing.T) {
+			req := test.NewRequest(t, http.MethodPost, "/_matrix/client/v3/logout", test.WithJSONBody(t, map[string]interface{}{}))
+			rec := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(rec, req)
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("expected HTTP 401, got %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+	})
+}
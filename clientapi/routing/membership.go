@@ -43,7 +43,7 @@ func SendBan(
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.ClientRoomserverAPI, asAPI appserviceAPI.AppServiceInternalAPI,
 ) util.JSONResponse {
-	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, rsAPI)
+	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, cfg, rsAPI)
 	if reqErr != nil {
 		return *reqErr
 	}
@@ -131,7 +131,7 @@ func SendKick(
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.ClientRoomserverAPI, asAPI appserviceAPI.AppServiceInternalAPI,
 ) util.JSONResponse {
-	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, rsAPI)
+	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, cfg, rsAPI)
 	if reqErr != nil {
 		return *reqErr
 	}
@@ -171,7 +171,7 @@ func SendUnban(
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.ClientRoomserverAPI, asAPI appserviceAPI.AppServiceInternalAPI,
 ) util.JSONResponse {
-	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, rsAPI)
+	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, cfg, rsAPI)
 	if reqErr != nil {
 		return *reqErr
 	}
@@ -212,7 +212,7 @@ func SendInvite(
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.ClientRoomserverAPI, asAPI appserviceAPI.AppServiceInternalAPI,
 ) util.JSONResponse {
-	body, evTime, _, reqErr := extractRequestData(req, roomID, rsAPI)
+	body, evTime, _, reqErr := extractRequestData(req, roomID, cfg, rsAPI)
 	if reqErr != nil {
 		return *reqErr
 	}
@@ -311,10 +311,11 @@ func buildMembershipEvent(
 		StateKey: &targetUserID,
 	}
 
+	displayName, avatarURL := membershipProfile(cfg, profile)
 	content := gomatrixserverlib.MemberContent{
 		Membership:  membership,
-		DisplayName: profile.DisplayName,
-		AvatarURL:   profile.AvatarURL,
+		DisplayName: displayName,
+		AvatarURL:   avatarURL,
 		Reason:      reason,
 		IsDirect:    isDirect,
 	}
@@ -357,7 +358,19 @@ func loadProfile(
 	return profile, err
 }
 
-func extractRequestData(req *http.Request, roomID string, rsAPI roomserverAPI.ClientRoomserverAPI) (
+// membershipProfile returns the display name and avatar to put in membership
+// events, leaving out the ones which the server is configured not to share.
+func membershipProfile(cfg *config.ClientAPI, profile *authtypes.Profile) (displayName, avatarURL string) {
+	if !cfg.MembershipProfile.StripDisplayName {
+		displayName = profile.DisplayName
+	}
+	if !cfg.MembershipProfile.StripAvatarURL {
+		avatarURL = profile.AvatarURL
+	}
+	return
+}
+
+func extractRequestData(req *http.Request, roomID string, cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI) (
 	body *threepid.MembershipRequest, evTime time.Time, roomVer gomatrixserverlib.RoomVersion, resErr *util.JSONResponse,
 ) {
 	verReq := roomserverAPI.QueryRoomVersionForRoomRequest{RoomID: roomID}
@@ -376,7 +389,7 @@ func extractRequestData(req *http.Request, roomID string, rsAPI roomserverAPI.Cl
 		return
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, cfg)
 	if err != nil {
 		resErr = &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -0,0 +1,286 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/appservice"
+	"github.com/matrix-org/dendrite/keyserver"
+	"github.com/matrix-org/dendrite/roomserver"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestSendInvite(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		asAPI := appservice.NewInternalAPI(base, userAPI, rsAPI)
+		rsAPI.SetFederationAPI(nil, nil) // creates the rs.Inputer etc
+		rsAPI.SetUserAPI(userAPI)        // needed to reject invites
+
+		for _, u := range []*test.User{alice, bob} {
+			localpart, serverName, _ := gomatrixserverlib.SplitID('@', u.ID)
+			userRes := &uapi.PerformAccountCreationResponse{}
+			if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+				AccountType: u.AccountType,
+				Localpart:   localpart,
+				ServerName:  serverName,
+				Password:    "someRandomPassword",
+			}, userRes); err != nil {
+				t.Errorf("failed to create account: %s", err)
+			}
+		}
+
+		aliceDev := &uapi.Device{UserID: alice.ID}
+		bobDev := &uapi.Device{UserID: bob.ID}
+
+		resp := createRoom(ctx, createRoomRequest{
+			Name:   "testing",
+			Preset: presetPrivateChat,
+		}, aliceDev, &base.Cfg.ClientAPI, userAPI, rsAPI, asAPI, time.Now())
+		crResp, ok := resp.JSON.(createRoomResponse)
+		if !ok {
+			t.Fatalf("response is not a createRoomResponse: %+v", resp)
+		}
+
+		invite := func(t *testing.T, reason string) {
+			t.Helper()
+			body, err := json.Marshal(map[string]string{"user_id": bob.ID, "reason": reason})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res := SendInvite(req, userAPI, aliceDev, crResp.RoomID, &base.Cfg.ClientAPI, rsAPI, asAPI); !res.Is2xx() {
+				t.Fatalf("expected invite to succeed, got %+v", res)
+			}
+		}
+		bobMembership := func(t *testing.T) *roomserverAPI.QueryMembershipForUserResponse {
+			t.Helper()
+			res := &roomserverAPI.QueryMembershipForUserResponse{}
+			if err := rsAPI.QueryMembershipForUser(ctx, &roomserverAPI.QueryMembershipForUserRequest{
+				RoomID: crResp.RoomID,
+				UserID: bob.ID,
+			}, res); err != nil {
+				t.Fatalf("failed to query membership: %s", err)
+			}
+			return res
+		}
+		dummyReq := func(t *testing.T) *http.Request {
+			req, err := http.NewRequest(http.MethodPost, "/", &bytes.Buffer{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return req
+		}
+
+		var inviteEventID string
+		t.Run("invite is sent", func(t *testing.T) {
+			invite(t, "")
+			res := bobMembership(t)
+			if res.Membership != gomatrixserverlib.Invite {
+				t.Fatalf("expected membership %q, got %q", gomatrixserverlib.Invite, res.Membership)
+			}
+			inviteEventID = res.EventID
+		})
+
+		t.Run("identical re-invite is a no-op", func(t *testing.T) {
+			invite(t, "")
+			res := bobMembership(t)
+			if res.Membership != gomatrixserverlib.Invite {
+				t.Fatalf("expected membership %q, got %q", gomatrixserverlib.Invite, res.Membership)
+			}
+			if res.EventID != inviteEventID {
+				t.Fatalf("expected the invite to stay %s, got %s", inviteEventID, res.EventID)
+			}
+		})
+
+		t.Run("re-invite with a different reason replaces the invite", func(t *testing.T) {
+			invite(t, "please join")
+			res := bobMembership(t)
+			if res.Membership != gomatrixserverlib.Invite {
+				t.Fatalf("expected membership %q, got %q", gomatrixserverlib.Invite, res.Membership)
+			}
+			if res.EventID == inviteEventID {
+				t.Fatalf("expected a new invite event, got %s again", res.EventID)
+			}
+			inviteEventID = res.EventID
+		})
+
+		t.Run("re-invite after rejecting the invite", func(t *testing.T) {
+			if res := LeaveRoomByID(dummyReq(t), bobDev, rsAPI, crResp.RoomID); !res.Is2xx() {
+				t.Fatalf("expected rejecting the invite to succeed, got %+v", res)
+			}
+			if res := bobMembership(t); res.Membership != gomatrixserverlib.Leave {
+				t.Fatalf("expected membership %q, got %q", gomatrixserverlib.Leave, res.Membership)
+			}
+			invite(t, "please join")
+			res := bobMembership(t)
+			if res.Membership != gomatrixserverlib.Invite {
+				t.Fatalf("expected membership %q, got %q", gomatrixserverlib.Invite, res.Membership)
+			}
+			if res.EventID == inviteEventID {
+				t.Fatalf("expected a new invite event, got %s again", res.EventID)
+			}
+		})
+
+		t.Run("re-invite after joining and leaving", func(t *testing.T) {
+			if res := JoinRoomByIDOrAlias(dummyReq(t), bobDev, rsAPI, userAPI, &base.Cfg.ClientAPI, crResp.RoomID); !res.Is2xx() {
+				t.Fatalf("expected join to succeed, got %+v", res)
+			}
+			if res := LeaveRoomByID(dummyReq(t), bobDev, rsAPI, crResp.RoomID); !res.Is2xx() {
+				t.Fatalf("expected leave to succeed, got %+v", res)
+			}
+			invite(t, "")
+			res := bobMembership(t)
+			if res.Membership != gomatrixserverlib.Invite {
+				t.Fatalf("expected membership %q, got %q", gomatrixserverlib.Invite, res.Membership)
+			}
+			if res := JoinRoomByIDOrAlias(dummyReq(t), bobDev, rsAPI, userAPI, &base.Cfg.ClientAPI, crResp.RoomID); !res.Is2xx() {
+				t.Fatalf("expected join after re-invite to succeed, got %+v", res)
+			}
+		})
+	})
+}
+
+func TestMembershipProfileStripped(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		cfg := &base.Cfg.ClientAPI
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		asAPI := appservice.NewInternalAPI(base, userAPI, rsAPI)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		for _, u := range []*test.User{alice, bob} {
+			localpart, serverName, _ := gomatrixserverlib.SplitID('@', u.ID)
+			if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+				AccountType: u.AccountType,
+				Localpart:   localpart,
+				ServerName:  serverName,
+				Password:    "someRandomPassword",
+			}, &uapi.PerformAccountCreationResponse{}); err != nil {
+				t.Fatalf("failed to create account: %s", err)
+			}
+			if err := userAPI.SetDisplayName(ctx, &uapi.PerformUpdateDisplayNameRequest{
+				Localpart:   localpart,
+				ServerName:  serverName,
+				DisplayName: "Name of " + localpart,
+			}, &uapi.PerformUpdateDisplayNameResponse{}); err != nil {
+				t.Fatalf("failed to set display name: %s", err)
+			}
+			if err := userAPI.SetAvatarURL(ctx, &uapi.PerformSetAvatarURLRequest{
+				Localpart:  localpart,
+				ServerName: serverName,
+				AvatarURL:  "mxc://test/" + localpart,
+			}, &uapi.PerformSetAvatarURLResponse{}); err != nil {
+				t.Fatalf("failed to set avatar: %s", err)
+			}
+		}
+
+		aliceDev := &uapi.Device{UserID: alice.ID}
+		bobDev := &uapi.Device{UserID: bob.ID}
+
+		testCases := []struct {
+			name             string
+			stripDisplayName bool
+			stripAvatarURL   bool
+		}{
+			{name: "profile is shared by default"},
+			{name: "display names are stripped", stripDisplayName: true},
+			{name: "avatars are stripped", stripAvatarURL: true},
+			{name: "both are stripped", stripDisplayName: true, stripAvatarURL: true},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				cfg.MembershipProfile.StripDisplayName = tc.stripDisplayName
+				cfg.MembershipProfile.StripAvatarURL = tc.stripAvatarURL
+
+				resp := createRoom(ctx, createRoomRequest{Preset: presetPrivateChat}, aliceDev, cfg, userAPI, rsAPI, asAPI, time.Now())
+				crResp, ok := resp.JSON.(createRoomResponse)
+				if !ok {
+					t.Fatalf("response is not a createRoomResponse: %+v", resp)
+				}
+
+				checkMembership := func(t *testing.T, userID, membership string) {
+					t.Helper()
+					tuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: userID}
+					res := &roomserverAPI.QueryCurrentStateResponse{}
+					if err := rsAPI.QueryCurrentState(ctx, &roomserverAPI.QueryCurrentStateRequest{
+						RoomID:      crResp.RoomID,
+						StateTuples: []gomatrixserverlib.StateKeyTuple{tuple},
+					}, res); err != nil {
+						t.Fatalf("failed to query current state: %s", err)
+					}
+					ev, ok := res.StateEvents[tuple]
+					if !ok {
+						t.Fatalf("expected a membership event for %s", userID)
+					}
+					var content map[string]interface{}
+					if err := json.Unmarshal(ev.Content(), &content); err != nil {
+						t.Fatal(err)
+					}
+					if content["membership"] != membership {
+						t.Fatalf("expected membership %q, got %v", membership, content["membership"])
+					}
+					if _, ok := content["displayname"]; ok == tc.stripDisplayName {
+						t.Fatalf("expected displayname present to be %v, got content %s", !tc.stripDisplayName, ev.Content())
+					}
+					if _, ok := content["avatar_url"]; ok == tc.stripAvatarURL {
+						t.Fatalf("expected avatar_url present to be %v, got content %s", !tc.stripAvatarURL, ev.Content())
+					}
+				}
+				checkMembership(t, alice.ID, gomatrixserverlib.Join)
+
+				body, err := json.Marshal(map[string]string{"user_id": bob.ID})
+				if err != nil {
+					t.Fatal(err)
+				}
+				req, err := http.NewRequest(http.MethodPost, "/", bytes.NewBuffer(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res := SendInvite(req, userAPI, aliceDev, crResp.RoomID, cfg, rsAPI, asAPI); !res.Is2xx() {
+					t.Fatalf("expected invite to succeed, got %+v", res)
+				}
+				checkMembership(t, bob.ID, gomatrixserverlib.Invite)
+
+				req, err = http.NewRequest(http.MethodPost, "/", &bytes.Buffer{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if res := JoinRoomByIDOrAlias(req, bobDev, rsAPI, userAPI, cfg, crResp.RoomID); !res.Is2xx() {
+					t.Fatalf("expected join to succeed, got %+v", res)
+				}
+				checkMembership(t, bob.ID, gomatrixserverlib.Join)
+			})
+		}
+	})
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -126,7 +127,7 @@ func SetAvatarURL(
 		}
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, cfg)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -143,8 +144,9 @@ func SetAvatarURL(
 		util.GetLogger(req.Context()).WithError(err).Error("profileAPI.SetAvatarURL failed")
 		return jsonerror.InternalServerError()
 	}
-	// No need to build new membership events, since nothing changed
-	if !setRes.Changed {
+	// No need to build new membership events, since nothing changed or
+	// avatars aren't shared in them
+	if !setRes.Changed || cfg.MembershipProfile.StripAvatarURL {
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: struct{}{},
@@ -225,7 +227,7 @@ func SetDisplayName(
 		}
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, cfg)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -243,8 +245,9 @@ func SetDisplayName(
 		util.GetLogger(req.Context()).WithError(err).Error("profileAPI.SetDisplayName failed")
 		return jsonerror.InternalServerError()
 	}
-	// No need to build new membership events, since nothing changed
-	if !profileRes.Changed {
+	// No need to build new membership events, since nothing changed or
+	// display names aren't shared in them
+	if !profileRes.Changed || cfg.MembershipProfile.StripDisplayName {
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: struct{}{},
@@ -339,7 +342,12 @@ func getProfile(
 		}, nil
 	}
 
-	profile, err := appserviceAPI.RetrieveUserProfile(ctx, userID, asAPI, profileAPI)
+	// Profile lookups can tolerate replication lag, so let them be served
+	// from the read replica if one is configured.
+	profile, err := appserviceAPI.RetrieveUserProfile(sqlutil.WithReadReplica(ctx), userID, asAPI, profileAPI)
+	if err == appserviceAPI.ErrProfileNotExists {
+		return nil, eventutil.ErrProfileNoExists
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -374,8 +382,7 @@ func buildMembershipEvents(
 			Membership: gomatrixserverlib.Join,
 		}
 
-		content.DisplayName = newProfile.DisplayName
-		content.AvatarURL = newProfile.AvatarURL
+		content.DisplayName, content.AvatarURL = membershipProfile(cfg, &newProfile)
 
 		if err := builder.SetContent(content); err != nil {
 			return nil, err
@@ -46,6 +46,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
@@ -74,6 +75,16 @@ type sessionsDict struct {
 	// If a UIA session is started by trying to delete device1, and then UIA is completed by deleting device2,
 	// the delete request will fail for device2 since the UIA was initiated by trying to delete device1.
 	deleteSessionToDeviceID map[string]string
+	// threePIDs holds the email address verified by the m.login.email.identity
+	// stage of a session, which is associated with the account once created.
+	threePIDs map[string]verifiedThreePID
+}
+
+// verifiedThreePID is a 3PID which has been validated by an identity server.
+type verifiedThreePID struct {
+	address     string
+	medium      string
+	validatedAt int64
 }
 
 // defaultTimeout is the timeout used to clean up sessions
@@ -113,6 +124,7 @@ func (d *sessionsDict) deleteSession(sessionID string) {
 	defer d.Unlock()
 	delete(d.params, sessionID)
 	delete(d.sessions, sessionID)
+	delete(d.threePIDs, sessionID)
 	delete(d.deleteSessionToDeviceID, sessionID)
 	delete(d.sessionCompletedResult, sessionID)
 	// stop the timer, e.g. because the registration was completed
@@ -132,6 +144,7 @@ func newSessionsDict() *sessionsDict {
 		sessions:                make(map[string][]authtypes.LoginType),
 		sessionCompletedResult:  make(map[string]registerResponse),
 		params:                  make(map[string]registerRequest),
+		threePIDs:               make(map[string]verifiedThreePID),
 		timer:                   make(map[string]*time.Timer),
 		deleteSessionToDeviceID: make(map[string]string),
 	}
@@ -167,6 +180,20 @@ func (d *sessionsDict) addCompletedSessionStage(sessionID string, stage authtype
 	d.sessions[sessionID] = append(sessions.sessions[sessionID], stage)
 }
 
+func (d *sessionsDict) addThreePID(sessionID string, threePID verifiedThreePID) {
+	d.startTimer(defaultTimeOut, sessionID)
+	d.Lock()
+	defer d.Unlock()
+	d.threePIDs[sessionID] = threePID
+}
+
+func (d *sessionsDict) getThreePID(sessionID string) (verifiedThreePID, bool) {
+	d.RLock()
+	defer d.RUnlock()
+	threePID, ok := d.threePIDs[sessionID]
+	return threePID, ok
+}
+
 func (d *sessionsDict) addDeviceToDelete(sessionID, deviceID string) {
 	d.startTimer(defaultTimeOut, sessionID)
 	d.Lock()
@@ -233,6 +260,8 @@ type authDict struct {
 
 	// Recaptcha
 	Response string `json:"response"`
+	// Email
+	ThreePIDCreds threepid.Credentials `json:"threepid_creds"`
 	// TODO: Lots of custom keys depending on the type
 }
 
@@ -396,6 +425,15 @@ func UsernameMatchesMultipleExclusiveNamespaces(
 	return false
 }
 
+// usernameBlockedResponse is returned when the desired username matches the
+// configured username blocklist.
+func usernameBlockedResponse() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.InvalidUsername("Desired user ID is not allowed on this server."),
+	}
+}
+
 // UsernameMatchesExclusiveNamespaces will check if a given username matches any
 // application service's exclusive users namespace
 func UsernameMatchesExclusiveNamespaces(
@@ -520,8 +558,12 @@ func Register(
 			JSON: jsonerror.InvalidUsername("Numeric user IDs are reserved"),
 		}
 	}
-	// Auto generate a numeric username if r.Username is empty
-	if r.Username == "" {
+	// Auto generate a numeric username if r.Username is empty. Numeric
+	// localparts are allocated rather than just looked up, so reuse the one
+	// from an earlier stage of this session if there is one.
+	if data, ok := sessions.getParams(sessionID); ok && r.Username == "" && data.Username != "" {
+		r.Username = data.Username
+	} else if r.Username == "" {
 		nreq := &userapi.QueryNumericLocalpartRequest{
 			ServerName: r.ServerName,
 		}
@@ -559,6 +601,9 @@ func Register(
 		if err = internal.ValidateUsername(r.Username, r.ServerName); err != nil {
 			return *internal.UsernameResponse(err)
 		}
+		if cfg.IsUsernameBlocked(r.Username) {
+			return usernameBlockedResponse()
+		}
 	}
 	if err = internal.ValidatePassword(r.Password); err != nil {
 		return *internal.PasswordResponse(err)
@@ -724,6 +769,28 @@ func handleRegistrationFlow(
 		// Add Dummy to the list of completed registration stages
 		sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeDummy)
 
+	case authtypes.LoginTypeTerms:
+		if len(cfg.Terms.Policies) == 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown("no policies are configured on this server"),
+			}
+		}
+		// The acceptance is recorded once the account has been created
+		sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeTerms)
+
+	case authtypes.LoginTypeEmail:
+		if cfg.RegistrationEmail == config.RegistrationEmailDisabled {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown("email addresses can't be given at registration on this server"),
+			}
+		}
+		if resErr := validateRegistrationEmail(req, r.Auth.ThreePIDCreds, sessionID, cfg, userAPI); resErr != nil {
+			return *resErr
+		}
+		sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeEmail)
+
 	case "":
 		// An empty auth type means that we want to fetch the available
 		// flows. It can also mean that we want to register as an appservice
@@ -742,6 +809,65 @@ func handleRegistrationFlow(
 		req, r, sessionID, cfg, userAPI)
 }
 
+// validateRegistrationEmail checks with the identity server that the email
+// address of the given credentials has been verified, and that it isn't
+// already associated with another account. If so, the address is stored in
+// the session so that it can be associated with the account once created.
+func validateRegistrationEmail(
+	req *http.Request,
+	creds threepid.Credentials,
+	sessionID string,
+	cfg *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+) *util.JSONResponse {
+	verified, address, medium, validatedAt, err := threepid.CheckAssociation(req.Context(), creds, cfg)
+	if err == threepid.ErrNotTrusted {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.NotTrusted(creds.IDServer),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threepid.CheckAssociation failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !verified || medium != "email" {
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_AUTH_FAILED",
+				Err:     "Failed to auth 3pid",
+			},
+		}
+	}
+
+	res := &userapi.QueryLocalpartForThreePIDResponse{}
+	if err = userAPI.QueryLocalpartForThreePID(req.Context(), &userapi.QueryLocalpartForThreePIDRequest{
+		ThreePID: address,
+		Medium:   medium,
+	}, res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryLocalpartForThreePID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if len(res.Localpart) > 0 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_IN_USE",
+				Err:     "This email address is already in use",
+			},
+		}
+	}
+
+	sessions.addThreePID(sessionID, verifiedThreePID{
+		address:     address,
+		medium:      medium,
+		validatedAt: validatedAt,
+	})
+	return nil
+}
+
 // handleApplicationServiceRegistration handles the registration of an
 // application service's user by validating the AS from its access token and
 // registering the user. Its two first parameters must be the two return values
@@ -799,11 +925,35 @@ func checkAndCompleteFlow(
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
 		// This flow was completed, registration can continue
-		return completeRegistration(
+		res := completeRegistration(
 			req.Context(), userAPI, r.Username, r.ServerName, "", r.Password, "", req.RemoteAddr,
 			req.UserAgent(), sessionID, r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
 			userapi.AccountTypeUser,
 		)
+		if threePID, ok := sessions.getThreePID(sessionID); res.Code == http.StatusOK && ok && containsLoginType(flow, authtypes.LoginTypeEmail) {
+			if err := userAPI.PerformSaveThreePIDAssociation(req.Context(), &userapi.PerformSaveThreePIDAssociationRequest{
+				ThreePID:    threePID.address,
+				Localpart:   r.Username,
+				ServerName:  r.ServerName,
+				Medium:      threePID.medium,
+				ValidatedAt: threePID.validatedAt,
+			}, &struct{}{}); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformSaveThreePIDAssociation failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+		if res.Code == http.StatusOK && containsLoginType(flow, authtypes.LoginTypeTerms) {
+			// The account exists by now, so failing to record the acceptance
+			// only means that the user will be asked to accept the terms again.
+			if err := userAPI.PerformTermsAcceptance(req.Context(), &userapi.PerformTermsAcceptanceRequest{
+				Localpart:  r.Username,
+				ServerName: r.ServerName,
+				Policies:   cfg.Terms.Versions(),
+			}, &struct{}{}); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformTermsAcceptance failed")
+			}
+		}
+		return res
 	}
 	sessions.addParams(sessionID, r)
 	// There are still more stages to complete.
@@ -969,6 +1119,16 @@ func checkFlows(
 	return true
 }
 
+// containsLoginType returns whether the given stages include the login type.
+func containsLoginType(stages []authtypes.LoginType, loginType authtypes.LoginType) bool {
+	for _, stage := range stages {
+		if stage == loginType {
+			return true
+		}
+	}
+	return false
+}
+
 // checkFlowCompleted checks if a registration flow complies with any allowed flow
 // dictated by the server. Order of stages does not matter. A user may complete
 // extra stages as long as the required stages of at least one flow is met.
@@ -1021,6 +1181,9 @@ func RegisterAvailable(
 	if err := internal.ValidateUsername(username, domain); err != nil {
 		return *internal.UsernameResponse(err)
 	}
+	if cfg.IsUsernameBlocked(username) {
+		return usernameBlockedResponse()
+	}
 
 	// Check if this username is reserved by an application service
 	userID := userutil.MakeUserID(username, domain)
@@ -16,7 +16,9 @@ package routing
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -29,6 +31,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/keyserver"
 	"github.com/matrix-org/dendrite/roomserver"
@@ -296,6 +299,7 @@ func Test_register(t *testing.T) {
 		guestsDisabled       bool
 		enableRecaptcha      bool
 		captchaBody          string
+		usernameBlocklist    []string
 		wantResponse         util.JSONResponse
 	}{
 		{
@@ -362,6 +366,29 @@ func Test_register(t *testing.T) {
 				JSON: jsonerror.InvalidUsername("Numeric user IDs are reserved"),
 			},
 		},
+		{
+			name:              "blocked username",
+			username:          "Administrator",
+			usernameBlocklist: []string{"ADMIN*", "/^support[0-9]*$/"},
+			wantResponse: util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidUsername("Desired user ID is not allowed on this server."),
+			},
+		},
+		{
+			name:              "blocked username by regular expression",
+			username:          "support42",
+			usernameBlocklist: []string{"ADMIN*", "/^support[0-9]*$/"},
+			wantResponse: util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidUsername("Desired user ID is not allowed on this server."),
+			},
+		},
+		{
+			name:              "username not in blocklist",
+			username:          "supportive",
+			usernameBlocklist: []string{"ADMIN*", "/^support[0-9]*$/"},
+		},
 		{
 			name:      "disabled recaptcha login",
 			loginType: authtypes.LoginTypeRecaptcha,
@@ -436,6 +463,7 @@ func Test_register(t *testing.T) {
 					base.Cfg.ClientAPI.RecaptchaSiteVerifyAPI = srv.URL
 				}
 
+				base.Cfg.ClientAPI.UsernameBlocklist = tc.usernameBlocklist
 				if err := base.Cfg.Derive(); err != nil {
 					t.Fatalf("failed to derive config: %s", err)
 				}
@@ -663,3 +691,185 @@ func TestRegisterAdminUsingSharedSecret(t *testing.T) {
 		assert.Equal(t, expectedDisplayName, profileRes.DisplayName)
 	})
 }
+
+// failingThreePIDUserAPI fails to save 3PID associations.
+type failingThreePIDUserAPI struct {
+	api.ClientUserAPI
+}
+
+func (failingThreePIDUserAPI) PerformSaveThreePIDAssociation(context.Context, *api.PerformSaveThreePIDAssociationRequest, *struct{}) error {
+	return errors.New("failed to save 3PID")
+}
+
+func TestRegisterWithEmail(t *testing.T) {
+	// A fake identity server which has validated the session "validated" only.
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sid") != "validated" {
+			_, _ = w.Write([]byte(`{"errcode":"M_SESSION_NOT_VALIDATED","error":"not validated"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"medium":"email","address":"alice@example.com","validated_at":1234}`))
+	}))
+	defer srv.Close()
+	oldClient := http.DefaultClient
+	http.DefaultClient = srv.Client()
+	defer func() { http.DefaultClient = oldClient }()
+	idServer := strings.TrimPrefix(srv.URL, "https://")
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		base.Cfg.ClientAPI.RegistrationDisabled = false
+		base.Cfg.Global.TrustedIDServers = []string{idServer}
+		cfg := &base.Cfg.ClientAPI
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		keyAPI.SetUserAPI(userAPI)
+
+		registerWith := func(t *testing.T, userAPI api.ClientUserAPI, reg registerRequest) util.JSONResponse {
+			t.Helper()
+			body := &bytes.Buffer{}
+			if err := json.NewEncoder(body).Encode(reg); err != nil {
+				t.Fatal(err)
+			}
+			return Register(httptest.NewRequest(http.MethodPost, "/", body), userAPI, cfg)
+		}
+		register := func(t *testing.T, reg registerRequest) util.JSONResponse {
+			t.Helper()
+			return registerWith(t, userAPI, reg)
+		}
+		startSession := func(t *testing.T, reg registerRequest) userInteractiveResponse {
+			t.Helper()
+			resp := register(t, reg)
+			uia, ok := resp.JSON.(userInteractiveResponse)
+			if !ok {
+				t.Fatalf("expected a userInteractiveResponse, got %T: %+v", resp.JSON, resp.JSON)
+			}
+			return uia
+		}
+		emailAuth := func(session, sid string) authDict {
+			return authDict{Type: authtypes.LoginTypeEmail, Session: session, ThreePIDCreds: threepid.Credentials{
+				SID: sid, IDServer: idServer, Secret: "secret",
+			}}
+		}
+
+		t.Run("save fails", func(t *testing.T) {
+			cfg.RegistrationEmail = config.RegistrationEmailRequired
+			if err := base.Cfg.Derive(); err != nil {
+				t.Fatalf("failed to derive config: %s", err)
+			}
+
+			reg := registerRequest{Username: "savefails", Password: "someRandomPassword"}
+			uia := startSession(t, reg)
+			reg.Auth = emailAuth(uia.Session, "validated")
+			if resp := registerWith(t, failingThreePIDUserAPI{userAPI}, reg); resp.Code != http.StatusInternalServerError {
+				t.Fatalf("expected HTTP %d when the email can't be saved, got %d: %+v", http.StatusInternalServerError, resp.Code, resp.JSON)
+			}
+		})
+
+		t.Run("required", func(t *testing.T) {
+			cfg.RegistrationEmail = config.RegistrationEmailRequired
+			if err := base.Cfg.Derive(); err != nil {
+				t.Fatalf("failed to derive config: %s", err)
+			}
+
+			reg := registerRequest{Username: "required", Password: "someRandomPassword"}
+			uia := startSession(t, reg)
+			if len(uia.Flows) != 1 || !reflect.DeepEqual(uia.Flows[0].Stages, []authtypes.LoginType{authtypes.LoginTypeEmail}) {
+				t.Fatalf("expected a single m.login.email.identity flow, got %+v", uia.Flows)
+			}
+
+			// The dummy stage doesn't complete the flow any more.
+			reg.Auth = authDict{Type: authtypes.LoginTypeDummy, Session: uia.Session}
+			if resp := register(t, reg); resp.Code != http.StatusUnauthorized {
+				t.Fatalf("expected HTTP %d without email, got %d: %+v", http.StatusUnauthorized, resp.Code, resp.JSON)
+			}
+
+			// Neither does an email address which hasn't been verified yet.
+			reg.Auth = emailAuth(uia.Session, "pending")
+			resp := register(t, reg)
+			if e, ok := resp.JSON.(jsonerror.MatrixError); resp.Code != http.StatusUnauthorized || !ok || e.ErrCode != "M_THREEPID_AUTH_FAILED" {
+				t.Fatalf("expected M_THREEPID_AUTH_FAILED for an unverified email, got %d: %+v", resp.Code, resp.JSON)
+			}
+
+			// Identity servers which aren't trusted are refused.
+			reg.Auth = emailAuth(uia.Session, "validated")
+			reg.Auth.ThreePIDCreds.IDServer = "untrusted.example.com"
+			if resp = register(t, reg); resp.Code != http.StatusBadRequest {
+				t.Fatalf("expected HTTP %d for an untrusted identity server, got %d: %+v", http.StatusBadRequest, resp.Code, resp.JSON)
+			}
+
+			reg.Auth = emailAuth(uia.Session, "validated")
+			resp = register(t, reg)
+			if _, ok := resp.JSON.(registerResponse); !ok {
+				t.Fatalf("expected a registerResponse, got %T: %+v", resp.JSON, resp.JSON)
+			}
+			res := &api.QueryThreePIDsForLocalpartResponse{}
+			if err := userAPI.QueryThreePIDsForLocalpart(base.Context(), &api.QueryThreePIDsForLocalpartRequest{
+				Localpart: "required", ServerName: base.Cfg.Global.ServerName,
+			}, res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.ThreePIDs) != 1 || res.ThreePIDs[0].Address != "alice@example.com" || res.ThreePIDs[0].ValidatedAt != 1234 {
+				t.Fatalf("expected the verified email to be associated with the account, got %+v", res.ThreePIDs)
+			}
+
+			// The address can't be used to register another account.
+			reg = registerRequest{Username: "required2", Password: "someRandomPassword"}
+			uia = startSession(t, reg)
+			reg.Auth = emailAuth(uia.Session, "validated")
+			resp = register(t, reg)
+			if e, ok := resp.JSON.(jsonerror.MatrixError); resp.Code != http.StatusBadRequest || !ok || e.ErrCode != "M_THREEPID_IN_USE" {
+				t.Fatalf("expected M_THREEPID_IN_USE for an email in use, got %d: %+v", resp.Code, resp.JSON)
+			}
+		})
+
+		t.Run("optional", func(t *testing.T) {
+			cfg.RegistrationEmail = config.RegistrationEmailOptional
+			if err := base.Cfg.Derive(); err != nil {
+				t.Fatalf("failed to derive config: %s", err)
+			}
+
+			reg := registerRequest{Username: "optional", Password: "someRandomPassword"}
+			uia := startSession(t, reg)
+			wantFlows := []authtypes.Flow{
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeEmail}},
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}},
+			}
+			if !reflect.DeepEqual(uia.Flows, wantFlows) {
+				t.Fatalf("expected flows %+v, got %+v", wantFlows, uia.Flows)
+			}
+
+			reg.Auth = authDict{Type: authtypes.LoginTypeDummy, Session: uia.Session}
+			resp := register(t, reg)
+			if _, ok := resp.JSON.(registerResponse); !ok {
+				t.Fatalf("expected a registerResponse, got %T: %+v", resp.JSON, resp.JSON)
+			}
+			res := &api.QueryThreePIDsForLocalpartResponse{}
+			if err := userAPI.QueryThreePIDsForLocalpart(base.Context(), &api.QueryThreePIDsForLocalpartRequest{
+				Localpart: "optional", ServerName: base.Cfg.Global.ServerName,
+			}, res); err != nil {
+				t.Fatal(err)
+			}
+			if len(res.ThreePIDs) != 0 {
+				t.Fatalf("expected no email to be associated with the account, got %+v", res.ThreePIDs)
+			}
+		})
+
+		t.Run("disabled", func(t *testing.T) {
+			cfg.RegistrationEmail = config.RegistrationEmailDisabled
+			if err := base.Cfg.Derive(); err != nil {
+				t.Fatalf("failed to derive config: %s", err)
+			}
+
+			reg := registerRequest{Username: "disabled", Password: "someRandomPassword"}
+			uia := startSession(t, reg)
+			reg.Auth = emailAuth(uia.Session, "validated")
+			if resp := register(t, reg); resp.Code != http.StatusBadRequest {
+				t.Fatalf("expected HTTP %d with email disabled, got %d: %+v", http.StatusBadRequest, resp.Code, resp.JSON)
+			}
+		})
+	})
+}
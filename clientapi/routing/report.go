@@ -0,0 +1,149 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+type reportEventRequest struct {
+	Reason string `json:"reason"`
+	Score  *int   `json:"score"`
+}
+
+// ReportEvent implements POST /rooms/{roomID}/report/{eventID}. The report is
+// logged for the server admins and, if enabled, forwarded to the server that
+// the reported event came from.
+func ReportEvent(
+	req *http.Request, device *userapi.Device, roomID, eventID string, cfg *config.ClientAPI,
+	rsAPI roomserverAPI.ClientRoomserverAPI,
+	federation *gomatrixserverlib.FederationClient,
+) util.JSONResponse {
+	var r reportEventRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Score != nil && (*r.Score < -100 || *r.Score > 0) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("score must be between -100 and 0"),
+		}
+	}
+
+	if resErr := checkMemberInRoom(req.Context(), rsAPI, device.UserID, roomID); resErr != nil {
+		return *resErr
+	}
+	ev := roomserverAPI.GetEvent(req.Context(), rsAPI, eventID)
+	if ev == nil || ev.RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("unknown event ID"),
+		}
+	}
+
+	logger := util.GetLogger(req.Context()).WithFields(logrus.Fields{
+		"room_id":  roomID,
+		"event_id": eventID,
+		"reporter": device.UserID,
+		"sender":   ev.Sender(),
+		"reason":   r.Reason,
+	})
+	if r.Score != nil {
+		logger = logger.WithField("score", *r.Score)
+	}
+	logger.Warn("Event reported by user")
+
+	if destination, ok := reportForwardDestination(cfg, ev.Sender()); ok {
+		reason := ""
+		if cfg.ReportForwarding.IncludeReason {
+			reason = r.Reason
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+			defer cancel()
+			if err := forwardReport(ctx, cfg, federation, device.UserID, destination, roomID, eventID, reason); err != nil {
+				logger.WithError(err).WithField("destination", destination).Warn("Failed to forward event report")
+			}
+		}()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// reportForwardDestination returns the server that a report about an event
+// from the given sender should be forwarded to, if any. Reports are only
+// forwarded if enabled, and never for events sent by our own users.
+func reportForwardDestination(cfg *config.ClientAPI, sender string) (gomatrixserverlib.ServerName, bool) {
+	if !cfg.ReportForwarding.Enabled {
+		return "", false
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', sender)
+	if err != nil || cfg.Matrix.IsLocalServerName(domain) {
+		return "", false
+	}
+	return domain, true
+}
+
+// forwardReport sends a report to the destination using the MSC3843 federation
+// endpoint. The request is signed by the reporter's server, but doesn't include
+// the reporter's user ID.
+func forwardReport(
+	ctx context.Context, cfg *config.ClientAPI,
+	federation *gomatrixserverlib.FederationClient,
+	reporter string, destination gomatrixserverlib.ServerName,
+	roomID, eventID, reason string,
+) error {
+	_, domain, err := gomatrixserverlib.SplitID('@', reporter)
+	if err != nil {
+		return err
+	}
+	identity, err := cfg.Matrix.SigningIdentityFor(domain)
+	if err != nil {
+		return err
+	}
+	fedReq := gomatrixserverlib.NewFederationRequest(
+		http.MethodPost, identity.ServerName, destination,
+		"/_matrix/federation/unstable/fi.mau.msc3843/rooms/"+url.PathEscape(roomID)+"/report/"+url.PathEscape(eventID),
+	)
+	if err = fedReq.SetContent(map[string]interface{}{
+		"reason": reason,
+	}); err != nil {
+		return err
+	}
+	if err = fedReq.Sign(identity.ServerName, identity.KeyID, identity.PrivateKey); err != nil {
+		return err
+	}
+	request, err := fedReq.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	return federation.DoRequestAndParseResponse(ctx, request, &struct{}{})
+}
@@ -0,0 +1,43 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestReportForwardDestination(t *testing.T) {
+	global := &config.Global{}
+	global.ServerName = "localhost"
+	global.VirtualHosts = []*config.VirtualHost{
+		{SigningIdentity: gomatrixserverlib.SigningIdentity{ServerName: "virtual"}},
+	}
+
+	tests := []struct {
+		name    string
+		enabled bool
+		sender  string
+		wantOK  bool
+		want    gomatrixserverlib.ServerName
+	}{
+		{name: "disabled", enabled: false, sender: "@alice:remote", wantOK: false},
+		{name: "remote sender", enabled: true, sender: "@alice:remote", wantOK: true, want: "remote"},
+		{name: "local sender", enabled: true, sender: "@alice:localhost", wantOK: false},
+		{name: "virtual host sender", enabled: true, sender: "@alice:virtual", wantOK: false},
+		{name: "invalid sender", enabled: true, sender: "alice", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.ClientAPI{
+				Matrix:           global,
+				ReportForwarding: config.ReportForwarding{Enabled: tt.enabled},
+			}
+			got, ok := reportForwardDestination(cfg, tt.sender)
+			if ok != tt.wantOK || got != tt.want {
+				t.Fatalf("got (%q, %v), want (%q, %v)", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
@@ -92,6 +92,9 @@ func PutTag(
 	tagContent.Tags[tag] = properties
 
 	if err = saveTagData(req, userID, roomID, userAPI, tagContent); err != nil {
+		if resErr := storageQuotaExceeded(err); resErr != nil {
+			return *resErr
+		}
 		util.GetLogger(req.Context()).WithError(err).Error("saveTagData failed")
 		return jsonerror.InternalServerError()
 	}
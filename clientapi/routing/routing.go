@@ -76,7 +76,15 @@ func Setup(
 		prometheus.MustRegister(amtRegUsers, sendEventDuration)
 	}
 
-	rateLimits := httputil.NewRateLimits(&cfg.RateLimiting)
+	publicAPIMux.Use(httputil.LimitRequestBodySize(cfg.MaxRequestBodySize))
+
+	rateLimits := httputil.NewRateLimits(&cfg.RateLimiting, cfg.Derived.ApplicationServices)
+	roomCreationRateLimits := httputil.NewRateLimits(&cfg.RoomCreation.RateLimiting, cfg.Derived.ApplicationServices)
+	roomJoinRateLimits := httputil.NewRateLimits(&cfg.Matrix.RoomJoins.RateLimiting, cfg.Derived.ApplicationServices)
+	keyUploadRateLimits := &keyUploadRateLimits{
+		deviceKeys:  httputil.NewRateLimits(&cfg.KeyUploads.DeviceKeys, cfg.Derived.ApplicationServices),
+		oneTimeKeys: httputil.NewRateLimits(&cfg.KeyUploads.OneTimeKeys, cfg.Derived.ApplicationServices),
+	}
 	userInteractiveAuth := auth.NewUserInteractive(userAPI, cfg)
 
 	var ssoAuthenticator *sso.Authenticator
@@ -87,6 +95,14 @@ func Setup(
 			logrus.WithError(err).Fatal("failed to create SSO authenticator")
 		}
 	}
+	var ssoLogout ssoLogouter
+	if ssoAuthenticator != nil {
+		ssoLogout = ssoAuthenticator
+	}
+	var ssoLinks *ssoLinkTokens
+	if cfg.Login.SSO.Enabled && cfg.Login.SSO.AllowAccountLinking {
+		ssoLinks = newSSOLinkTokens()
+	}
 
 	unstableFeatures := map[string]bool{
 		"org.matrix.e2e_cross_signing": true,
@@ -195,12 +211,54 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/federation/status/{serverName}",
+		httputil.MakeAdminAPI("admin_federation_status", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminFederationStatus(req, cfg, federationSender)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms/{roomID}/state/{eventType:[^/]+/?}",
+		httputil.MakeAdminAPI("admin_set_room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminSetRoomState(req, device, rsAPI)
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms/{roomID}/state/{eventType}/{stateKey}",
+		httputil.MakeAdminAPI("admin_set_room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminSetRoomState(req, device, rsAPI)
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
+
 	dendriteAdminRouter.Handle("/admin/fulltext/reindex",
 		httputil.MakeAdminAPI("admin_fultext_reindex", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return AdminReindex(req, cfg, device, natsClient)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/background_updates/status",
+		httputil.MakeAdminAPI("admin_background_updates_status", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminBackgroundUpdatesStatus(req, base.BackgroundUpdates)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/background_updates/{updateName}/{action:pause|resume|run}",
+		httputil.MakeAdminAPI("admin_background_updates_action", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminBackgroundUpdateAction(req, base.BackgroundUpdates)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/users/{userID}/devices",
+		httputil.MakeAdminAPI("admin_list_user_devices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListUserDevices(req, cfg, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/users/{userID}/devices/{deviceID}",
+		httputil.MakeAdminAPI("admin_delete_user_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminDeleteUserDevice(req, cfg, userAPI)
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
+
 	dendriteAdminRouter.Handle("/admin/refreshDevices/{userID}",
 		httputil.MakeAdminAPI("admin_refresh_devices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return AdminMarkAsStale(req, cfg, keyAPI)
@@ -209,7 +267,7 @@ func Setup(
 
 	// server notifications
 	if cfg.Matrix.ServerNotices.Enabled {
-		logrus.Info("Enabling server notices at /_synapse/admin/v1/send_server_notice")
+		logrus.Info("Enabling server notices at /_synapse/admin/v1/send_server_notice and /_dendrite/admin/server_notices")
 		serverNotificationSender, err := getSenderDevice(ctx, rsAPI, userAPI, cfg)
 		if err != nil {
 			logrus.WithError(err).Fatal("unable to get account for sending sending server notices")
@@ -249,6 +307,27 @@ func Setup(
 				)
 			}),
 		).Methods(http.MethodPost, http.MethodOptions)
+
+		serverNoticesJobs := NewServerNoticesJobs(base.ProcessContext)
+		dendriteAdminRouter.Handle("/admin/server_notices",
+			httputil.MakeAdminAPI("admin_send_server_notices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return SendServerNotices(
+					req, serverNoticesJobs, &cfg.Matrix.ServerNotices,
+					cfg, userAPI, rsAPI, asAPI,
+					device, serverNotificationSender,
+				)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+
+		dendriteAdminRouter.Handle("/admin/server_notices/{jobID}",
+			httputil.MakeAdminAPI("admin_server_notices_job", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return ServerNoticesJob(serverNoticesJobs, vars["jobID"])
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
 	}
 
 	// You can't just do PathPrefix("/(r0|v3)") because regexps only apply when inside named path variables.
@@ -263,6 +342,12 @@ func Setup(
 
 	v3mux.Handle("/createRoom",
 		httputil.MakeAuthAPI("createRoom", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := roomCreationRateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			if r := checkTermsAccepted(req, cfg, userAPI, device); r != nil {
+				return *r
+			}
 			return CreateRoom(req, device, cfg, userAPI, rsAPI, asAPI)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
@@ -271,12 +356,18 @@ func Setup(
 			if r := rateLimits.Limit(req, device); r != nil {
 				return *r
 			}
+			if r := checkTermsAccepted(req, cfg, userAPI, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if r := limitRoomJoin(req.Context(), device, rsAPI, roomJoinRateLimits, vars["roomIDOrAlias"]); r != nil {
+				return *r
+			}
 			return JoinRoomByIDOrAlias(
-				req, device, rsAPI, userAPI, vars["roomIDOrAlias"],
+				req, device, rsAPI, userAPI, cfg, vars["roomIDOrAlias"],
 			)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
@@ -307,12 +398,18 @@ func Setup(
 			if r := rateLimits.Limit(req, device); r != nil {
 				return *r
 			}
+			if r := checkTermsAccepted(req, cfg, userAPI, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			if r := limitRoomJoin(req.Context(), device, rsAPI, roomJoinRateLimits, vars["roomID"]); r != nil {
+				return *r
+			}
 			return JoinRoomByIDOrAlias(
-				req, device, rsAPI, userAPI, vars["roomID"],
+				req, device, rsAPI, userAPI, cfg, vars["roomID"],
 			)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
@@ -382,6 +479,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/send/{eventType}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkTermsAccepted(req, cfg, userAPI, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -391,6 +491,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkTermsAccepted(req, cfg, userAPI, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -439,6 +542,9 @@ func Setup(
 
 	v3mux.Handle("/rooms/{roomID}/state/{eventType:[^/]+/?}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkTermsAccepted(req, cfg, userAPI, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -451,6 +557,9 @@ func Setup(
 
 	v3mux.Handle("/rooms/{roomID}/state/{eventType}/{stateKey}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := checkTermsAccepted(req, cfg, userAPI, device); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -551,13 +660,13 @@ func Setup(
 
 	v3mux.Handle("/logout",
 		httputil.MakeAuthAPI("logout", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return Logout(req, userAPI, device)
+			return Logout(req, userAPI, device, ssoLogout)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	v3mux.Handle("/logout/all",
 		httputil.MakeAuthAPI("logout", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return LogoutAll(req, userAPI, device)
+			return LogoutAll(req, userAPI, device, ssoLogout)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -593,6 +702,16 @@ func Setup(
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
+	v3mux.Handle("/rooms/{roomID}/report/{eventID}",
+		httputil.MakeAuthAPI("rooms_report", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ReportEvent(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI, federation)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	v3mux.Handle("/sendToDevice/{eventType}/{txnID}",
 		httputil.MakeAuthAPI("send_to_device", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -641,7 +760,7 @@ func Setup(
 			if r := rateLimits.Limit(req, device); r != nil {
 				return *r
 			}
-			return Deactivate(req, userInteractiveAuth, userAPI, device)
+			return Deactivate(req, userInteractiveAuth, userAPI, device, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -658,20 +777,26 @@ func Setup(
 
 	v3mux.Handle("/login/sso/callback",
 		httputil.MakeExternalAPI("login", func(req *http.Request) util.JSONResponse {
-			return SSOCallback(req, userAPI, ssoAuthenticator, &cfg.Login.SSO, cfg.Matrix.ServerName)
+			return SSOCallback(req, userAPI, ssoAuthenticator, &cfg.Login.SSO, cfg.Matrix.ServerName, ssoLinks)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	unstableMux.Handle("/org.matrix.dendrite/sso/link",
+		httputil.MakeAuthAPI("sso_link", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return SSOLinkStart(req, device, ssoLinks, cfg.Matrix.ServerName)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	v3mux.Handle("/login/sso/redirect",
 		httputil.MakeExternalAPI("login", func(req *http.Request) util.JSONResponse {
-			return SSORedirect(req, "", ssoAuthenticator, &cfg.Login.SSO)
+			return SSORedirect(req, "", ssoAuthenticator, &cfg.Login.SSO, ssoLinks)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	v3mux.Handle("/login/sso/redirect/{idpID}",
 		httputil.MakeExternalAPI("login", func(req *http.Request) util.JSONResponse {
 			vars := mux.Vars(req)
-			return SSORedirect(req, vars["idpID"], ssoAuthenticator, &cfg.Login.SSO)
+			return SSORedirect(req, vars["idpID"], ssoAuthenticator, &cfg.Login.SSO, ssoLinks)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -892,12 +1017,23 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	unstableMux.Handle("/account/3pid/delete",
-		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return Forget3PID(req, userAPI)
+	forget3PID := httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return Forget3PID(req, userAPI, device, cfg)
+	})
+	unstableMux.Handle("/org.matrix.dendrite/terms",
+		httputil.MakeAuthAPI("terms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetTerms(req, cfg, userAPI, device)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	unstableMux.Handle("/org.matrix.dendrite/terms",
+		httputil.MakeAuthAPI("terms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AcceptTerms(req, cfg, userAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	v3mux.Handle("/account/3pid/delete", forget3PID).Methods(http.MethodPost, http.MethodOptions)
+	unstableMux.Handle("/account/3pid/delete", forget3PID).Methods(http.MethodPost, http.MethodOptions)
+
 	v3mux.Handle("/{path:(?:account/3pid|register)}/email/requestToken",
 		httputil.MakeExternalAPI("account_3pid_request_token", func(req *http.Request) util.JSONResponse {
 			return RequestEmailToken(req, userAPI, cfg)
@@ -961,23 +1097,13 @@ func Setup(
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
-	v3mux.Handle("/rooms/{roomID}/initialSync",
-		httputil.MakeExternalAPI("rooms_initial_sync", func(req *http.Request) util.JSONResponse {
-			// TODO: Allow people to peek into rooms.
-			return util.JSONResponse{
-				Code: http.StatusForbidden,
-				JSON: jsonerror.GuestAccessForbidden("Guest access not implemented"),
-			}
-		}),
-	).Methods(http.MethodGet, http.MethodOptions)
-
 	v3mux.Handle("/user/{userID}/account_data/{type}",
 		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SaveAccountData(req, userAPI, device, vars["userID"], "", vars["type"], syncProducer)
+			return SaveAccountData(req, cfg, userAPI, device, vars["userID"], "", vars["type"], syncProducer)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -987,7 +1113,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SaveAccountData(req, userAPI, device, vars["userID"], vars["roomID"], vars["type"], syncProducer)
+			return SaveAccountData(req, cfg, userAPI, device, vars["userID"], vars["roomID"], vars["type"], syncProducer)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
@@ -1160,16 +1286,6 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 
 	// Stub implementations for sytest
-	v3mux.Handle("/events",
-		httputil.MakeAuthAPI("events", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{
-				"chunk": []interface{}{},
-				"start": "",
-				"end":   "",
-			}}
-		}, httputil.WithAllowGuests()),
-	).Methods(http.MethodGet, http.MethodOptions)
-
 	v3mux.Handle("/initialSync",
 		httputil.MakeAuthAPI("initial_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{
@@ -1406,12 +1522,12 @@ func Setup(
 	// Supplying a device ID is deprecated.
 	v3mux.Handle("/keys/upload/{deviceID}",
 		httputil.MakeAuthAPI("keys_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return UploadKeys(req, keyAPI, device)
+			return UploadKeys(req, keyAPI, device, keyUploadRateLimits)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/keys/upload",
 		httputil.MakeAuthAPI("keys_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return UploadKeys(req, keyAPI, device)
+			return UploadKeys(req, keyAPI, device, keyUploadRateLimits)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/keys/query",
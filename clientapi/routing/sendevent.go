@@ -17,6 +17,7 @@ package routing
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
@@ -121,7 +122,15 @@ func SendEvent(
 		delete(r, "join_authorised_via_users_server")
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	// Guests can only join rooms which allow guest access, whichever way they
+	// try to join.
+	if eventType == gomatrixserverlib.MRoomMember && device.AccountType == userapi.AccountTypeGuest && r["membership"] == gomatrixserverlib.Join {
+		if resErr = checkGuestCanJoin(req.Context(), rsAPI, roomID); resErr != nil {
+			return *resErr
+		}
+	}
+
+	evTime, err := httputil.ParseTSParam(req, cfg)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -192,6 +201,12 @@ func SendEvent(
 		txnAndSessionID,
 		false,
 	); err != nil {
+		// The room state may have changed since the event was built, in which
+		// case the roomserver rejects it. That's the user's fault, not ours.
+		var notAllowed *gomatrixserverlib.NotAllowed
+		if errors.As(err, &notAllowed) {
+			return notAllowedResponse(e, currentAuthState(req.Context(), rsAPI, e), err)
+		}
 		util.GetLogger(req.Context()).WithError(err).Error("SendEvents failed")
 		return jsonerror.InternalServerError()
 	}
@@ -318,10 +333,11 @@ func generateSendEvent(
 	}
 	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
 	if err = gomatrixserverlib.Allowed(e.Event, &provider); err != nil {
-		return nil, &util.JSONResponse{
-			Code: http.StatusForbidden,
-			JSON: jsonerror.Forbidden(err.Error()), // TODO: Is this error string comprehensible to the client?
-		}
+		resErr := notAllowedResponse(e.Event, stateEvents, err)
+		return nil, &resErr
+	}
+	if resErr := checkServerACLPowerLevel(ctx, e.Event, &provider, cfg); resErr != nil {
+		return nil, resErr
 	}
 
 	// User should not be able to send a tombstone event to the same room.
@@ -342,5 +358,159 @@ func generateSendEvent(
 		}
 	}
 
+	if resErr := checkEventReplacement(ctx, e.Event, rsAPI); resErr != nil {
+		return nil, resErr
+	}
+
 	return e.Event, nil
 }
+
+// checkServerACLPowerLevel checks that the sender of a server ACL event has at
+// least the power level which is configured for changing server ACLs, as well
+// as the power level that the room itself requires.
+func checkServerACLPowerLevel(
+	ctx context.Context, e *gomatrixserverlib.Event, provider gomatrixserverlib.AuthEventProvider, cfg *config.ClientAPI,
+) *util.JSONResponse {
+	if e.Type() != "m.room.server_acl" || cfg.ServerACLPowerLevel <= 0 {
+		return nil
+	}
+	var creator string
+	if createEvent, err := provider.Create(); err == nil && createEvent != nil {
+		creator = createEvent.Sender()
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(provider, creator)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.NewPowerLevelContentFromAuthEvents failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if level := powerLevels.UserLevel(e.Sender()); level < cfg.ServerACLPowerLevel {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(fmt.Sprintf(
+				"You need a power level of at least %d to change the server ACLs, but you only have %d", cfg.ServerACLPowerLevel, level,
+			)),
+		}
+	}
+	return nil
+}
+
+// eventReplacementContent is the part of the content of an event which is
+// relevant to it replacing (i.e. editing) another event.
+type eventReplacementContent struct {
+	RelatesTo *struct {
+		RelType string `json:"rel_type"`
+		EventID string `json:"event_id"`
+	} `json:"m.relates_to"`
+	NewContent json.RawMessage `json:"m.new_content"`
+}
+
+// checkEventReplacement checks that, if the event replaces another one, it
+// follows the rules in https://spec.matrix.org/v1.5/client-server-api/#validity-of-replacement-events:
+// the original event must exist in the same room, have the same type and
+// sender, neither event may be a state event, and the original event must not
+// be a replacement itself. Replacements of events which aren't encrypted must
+// also have m.new_content.
+func checkEventReplacement(ctx context.Context, e *gomatrixserverlib.Event, rsAPI api.ClientRoomserverAPI) *util.JSONResponse {
+	var content eventReplacementContent
+	if err := json.Unmarshal(e.Content(), &content); err != nil || content.RelatesTo == nil || content.RelatesTo.RelType != "m.replace" {
+		return nil
+	}
+	forbidden := func(msg string) *util.JSONResponse {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(msg),
+		}
+	}
+	if e.StateKey() != nil {
+		return forbidden("State events can't replace other events")
+	}
+	if e.Type() != "m.room.encrypted" && len(content.NewContent) == 0 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Replacement events must have m.new_content"),
+		}
+	}
+
+	res := api.QueryEventsByIDResponse{}
+	if err := rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{EventIDs: []string{content.RelatesTo.EventID}}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryEventsByID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if len(res.Events) == 0 || res.Events[0].RoomID() != e.RoomID() {
+		return forbidden("The event to replace doesn't exist in this room")
+	}
+	original := res.Events[0]
+	if original.StateKey() != nil {
+		return forbidden("State events can't be replaced")
+	}
+	if original.Type() != e.Type() {
+		return forbidden(fmt.Sprintf("Events of type %s can't be replaced by events of type %s", original.Type(), e.Type()))
+	}
+	if original.Sender() != e.Sender() {
+		return forbidden("You can only replace your own events")
+	}
+	var originalContent eventReplacementContent
+	if err := json.Unmarshal(original.Content(), &originalContent); err == nil && originalContent.RelatesTo != nil && originalContent.RelatesTo.RelType == "m.replace" {
+		return forbidden("Replacement events can't be replaced")
+	}
+	return nil
+}
+
+// currentAuthState returns the current membership of the sender and the power
+// levels of the room, which are what most often stop an event being allowed,
+// along with the create event needed to apply the default power levels.
+func currentAuthState(ctx context.Context, rsAPI api.ClientRoomserverAPI, e *gomatrixserverlib.Event) []*gomatrixserverlib.Event {
+	stateRes := api.QueryCurrentStateResponse{}
+	if err := rsAPI.QueryCurrentState(ctx, &api.QueryCurrentStateRequest{
+		RoomID: e.RoomID(),
+		StateTuples: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""},
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: e.Sender()},
+			{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""},
+		},
+	}, &stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryCurrentState failed")
+		return nil
+	}
+	stateEvents := make([]*gomatrixserverlib.Event, 0, len(stateRes.StateEvents))
+	for _, ev := range stateRes.StateEvents {
+		stateEvents = append(stateEvents, ev.Event)
+	}
+	return stateEvents
+}
+
+// notAllowedResponse returns an M_FORBIDDEN response for an event which failed
+// auth checks. The room state is used to explain the common reasons in terms
+// the user will understand, falling back to the auth error otherwise.
+func notAllowedResponse(e *gomatrixserverlib.Event, stateEvents []*gomatrixserverlib.Event, err error) util.JSONResponse {
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	membership := gomatrixserverlib.Leave
+	if member, _ := provider.Member(e.Sender()); member != nil {
+		if m, merr := member.Membership(); merr == nil {
+			membership = m
+		}
+	}
+	msg := err.Error()
+	switch {
+	case membership == gomatrixserverlib.Ban:
+		msg = "You are banned from this room"
+	case e.Type() == gomatrixserverlib.MRoomMember:
+		// Membership changes have their own rules, so the auth error is
+		// as good an explanation as any.
+	case membership != gomatrixserverlib.Join:
+		msg = "You are not in this room"
+	default:
+		create, _ := provider.Create()
+		plEvent, _ := provider.PowerLevels()
+		pl, plErr := eventutil.PowerLevelsFromState(create, plEvent)
+		if plErr == nil && pl.UserLevel(e.Sender()) < pl.EventLevel(e.Type(), e.StateKey() != nil) {
+			msg = fmt.Sprintf("You don't have permission to send %s events in this room", e.Type())
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden(msg),
+	}
+}
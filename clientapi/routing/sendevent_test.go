@@ -0,0 +1,313 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestSendEventForbidden(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	charlie := test.NewUser(t)
+	dave := test.NewUser(t)
+
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	for _, u := range []*test.User{bob, dave} {
+		room.CreateAndInsert(t, u, gomatrixserverlib.MRoomMember, map[string]interface{}{
+			"membership": "join",
+		}, test.WithStateKey(u.ID))
+	}
+	room.CreateAndInsert(t, alice, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": "ban",
+	}, test.WithStateKey(bob.ID))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		emptyStateKey := ""
+		testCases := []struct {
+			name      string
+			user      *test.User
+			eventType string
+			stateKey  *string
+			wantMsg   string
+		}{
+			{
+				name:      "banned user",
+				user:      bob,
+				eventType: "m.room.message",
+				wantMsg:   "You are banned from this room",
+			},
+			{
+				name:      "user not in room",
+				user:      charlie,
+				eventType: "m.room.message",
+				wantMsg:   "You are not in this room",
+			},
+			{
+				name:      "insufficient power level",
+				user:      dave,
+				eventType: gomatrixserverlib.MRoomName,
+				stateKey:  &emptyStateKey,
+				wantMsg:   "You don't have permission to send m.room.name events in this room",
+			},
+			{
+				name:      "insufficient power level to change history visibility",
+				user:      dave,
+				eventType: gomatrixserverlib.MRoomHistoryVisibility,
+				stateKey:  &emptyStateKey,
+				wantMsg:   "You don't have permission to send m.room.history_visibility events in this room",
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				device := &uapi.Device{UserID: tc.user.ID}
+				content := map[string]interface{}{"body": "hello", "name": "hello", "history_visibility": "joined"}
+				_, resErr := generateSendEvent(ctx, content, device, room.ID, tc.eventType, tc.stateKey, &base.Cfg.ClientAPI, rsAPI, time.Now())
+				if resErr == nil {
+					t.Fatalf("expected an error, but the event was allowed")
+				}
+				if resErr.Code != http.StatusForbidden {
+					t.Fatalf("expected HTTP %d, got %d: %+v", http.StatusForbidden, resErr.Code, resErr.JSON)
+				}
+				matrixErr, ok := resErr.JSON.(*jsonerror.MatrixError)
+				if !ok || matrixErr.ErrCode != "M_FORBIDDEN" {
+					t.Fatalf("expected M_FORBIDDEN, got %+v", resErr.JSON)
+				}
+				if !strings.Contains(matrixErr.Err, tc.wantMsg) {
+					t.Fatalf("expected message %q, got %q", tc.wantMsg, matrixErr.Err)
+				}
+			})
+		}
+	})
+}
+
+func TestSendEventReplacement(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	room.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+	message := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{
+		"msgtype": "m.text", "body": "hello",
+	})
+	topic := room.CreateAndInsert(t, alice, gomatrixserverlib.MRoomTopic, map[string]interface{}{
+		"topic": "hello",
+	}, test.WithStateKey(""))
+	edit := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{
+		"msgtype":       "m.text",
+		"body":          "* hello!",
+		"m.new_content": map[string]interface{}{"msgtype": "m.text", "body": "hello!"},
+		"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": message.EventID()},
+	})
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		replacement := func(eventID string) map[string]interface{} {
+			return map[string]interface{}{
+				"msgtype":       "m.text",
+				"body":          "* goodbye",
+				"m.new_content": map[string]interface{}{"msgtype": "m.text", "body": "goodbye"},
+				"m.relates_to":  map[string]interface{}{"rel_type": "m.replace", "event_id": eventID},
+			}
+		}
+		testCases := []struct {
+			name      string
+			user      *test.User
+			eventType string
+			content   map[string]interface{}
+			wantCode  int
+		}{
+			{
+				name:      "editing own message",
+				user:      alice,
+				eventType: "m.room.message",
+				content:   replacement(message.EventID()),
+				wantCode:  http.StatusOK,
+			},
+			{
+				name:      "editing another user's message",
+				user:      bob,
+				eventType: "m.room.message",
+				content:   replacement(message.EventID()),
+				wantCode:  http.StatusForbidden,
+			},
+			{
+				name:      "editing an unknown event",
+				user:      alice,
+				eventType: "m.room.message",
+				content:   replacement("$unknown:test"),
+				wantCode:  http.StatusForbidden,
+			},
+			{
+				name:      "editing with a different event type",
+				user:      alice,
+				eventType: "m.sticker",
+				content:   replacement(message.EventID()),
+				wantCode:  http.StatusForbidden,
+			},
+			{
+				name:      "editing a state event",
+				user:      alice,
+				eventType: "m.room.message",
+				content:   replacement(topic.EventID()),
+				wantCode:  http.StatusForbidden,
+			},
+			{
+				name:      "editing an edit",
+				user:      alice,
+				eventType: "m.room.message",
+				content:   replacement(edit.EventID()),
+				wantCode:  http.StatusForbidden,
+			},
+			{
+				name:      "edit without m.new_content",
+				user:      alice,
+				eventType: "m.room.message",
+				content: map[string]interface{}{
+					"msgtype":      "m.text",
+					"body":         "* goodbye",
+					"m.relates_to": map[string]interface{}{"rel_type": "m.replace", "event_id": message.EventID()},
+				},
+				wantCode: http.StatusBadRequest,
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				device := &uapi.Device{UserID: tc.user.ID}
+				_, resErr := generateSendEvent(ctx, tc.content, device, room.ID, tc.eventType, nil, &base.Cfg.ClientAPI, rsAPI, time.Now())
+				if tc.wantCode == http.StatusOK {
+					if resErr != nil {
+						t.Fatalf("expected the edit to be allowed, got %+v", resErr)
+					}
+					return
+				}
+				if resErr == nil {
+					t.Fatalf("expected an error, but the edit was allowed")
+				}
+				if resErr.Code != tc.wantCode {
+					t.Fatalf("expected HTTP %d, got %d: %+v", tc.wantCode, resErr.Code, resErr.JSON)
+				}
+				if matrixErr, ok := resErr.JSON.(*jsonerror.MatrixError); tc.wantCode == http.StatusForbidden && (!ok || matrixErr.ErrCode != "M_FORBIDDEN") {
+					t.Fatalf("expected M_FORBIDDEN, got %+v", resErr.JSON)
+				}
+			})
+		}
+	})
+}
+
+func TestSendEventServerACLPowerLevel(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	room.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+	// The room lets bob change the server ACLs.
+	room.CreateAndInsert(t, alice, gomatrixserverlib.MRoomPowerLevels, map[string]interface{}{
+		"users":  map[string]int64{alice.ID: 100, bob.ID: 60},
+		"events": map[string]int64{"m.room.server_acl": 50},
+	}, test.WithStateKey(""))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		emptyStateKey := ""
+		testCases := []struct {
+			name            string
+			user            *test.User
+			minPowerLevel   int64
+			wantCode        int
+			wantErrContains string
+		}{
+			{
+				name:          "room power levels apply by default",
+				user:          bob,
+				minPowerLevel: 0,
+			},
+			{
+				name:          "user above the configured power level",
+				user:          alice,
+				minPowerLevel: 75,
+			},
+			{
+				name:            "user below the configured power level",
+				user:            bob,
+				minPowerLevel:   75,
+				wantCode:        http.StatusForbidden,
+				wantErrContains: "You need a power level of at least 75 to change the server ACLs",
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				cfg := base.Cfg.ClientAPI
+				cfg.ServerACLPowerLevel = tc.minPowerLevel
+				device := &uapi.Device{UserID: tc.user.ID}
+				content := map[string]interface{}{"allow": []string{"*"}, "deny": []string{"evil.example.com"}}
+				_, resErr := generateSendEvent(ctx, content, device, room.ID, "m.room.server_acl", &emptyStateKey, &cfg, rsAPI, time.Now())
+				if tc.wantCode == 0 {
+					if resErr != nil {
+						t.Fatalf("expected the event to be allowed, got %+v", resErr.JSON)
+					}
+					return
+				}
+				if resErr == nil {
+					t.Fatalf("expected an error, but the event was allowed")
+				}
+				if resErr.Code != tc.wantCode {
+					t.Fatalf("expected HTTP %d, got %d: %+v", tc.wantCode, resErr.Code, resErr.JSON)
+				}
+				matrixErr, ok := resErr.JSON.(*jsonerror.MatrixError)
+				if !ok || matrixErr.ErrCode != "M_FORBIDDEN" {
+					t.Fatalf("expected M_FORBIDDEN, got %+v", resErr.JSON)
+				}
+				if !strings.Contains(matrixErr.Err, tc.wantErrContains) {
+					t.Fatalf("expected message %q, got %q", tc.wantErrContains, matrixErr.Err)
+				}
+			})
+		}
+	})
+}
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/gomatrix"
@@ -33,10 +34,12 @@ import (
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/internal/transactions"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
 
@@ -79,7 +82,6 @@ func SendServerNotice(
 		}
 	}
 
-	ctx := req.Context()
 	var r sendServerNoticeRequest
 	resErr := httputil.UnmarshalJSONRequest(req, &r)
 	if resErr != nil {
@@ -94,16 +96,62 @@ func SendServerNotice(
 		}
 	}
 
+	var txnAndSessionID *api.TransactionID
+	if txnID != nil {
+		txnAndSessionID = &api.TransactionID{
+			TransactionID: *txnID,
+			SessionID:     device.SessionID,
+		}
+	}
+
+	eventID, resErr := sendServerNoticeToUser(
+		req, r.UserID, r.Content.MsgType, r.Content.Body,
+		cfgNotices, cfgClient, userAPI, rsAPI, asAPI,
+		device, senderDevice, txnAndSessionID,
+	)
+	if resErr != nil {
+		return *resErr
+	}
+
+	res := util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: sendEventResponse{eventID},
+	}
+	// Add response to transactionsCache
+	if txnID != nil {
+		txnCache.AddTransaction(device.AccessToken, *txnID, req.URL, &res)
+	}
+	return res
+}
+
+// sendServerNoticeToUser sends a message to the server notice room of a user,
+// creating the room or re-inviting the user to it first if needed. It returns
+// the ID of the message event.
+func sendServerNoticeToUser(
+	req *http.Request,
+	userID, msgType, body string,
+	cfgNotices *config.ServerNotices,
+	cfgClient *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+	rsAPI api.ClientRoomserverAPI,
+	asAPI appserviceAPI.AppServiceInternalAPI,
+	device *userapi.Device,
+	senderDevice *userapi.Device,
+	txnAndSessionID *api.TransactionID,
+) (string, *util.JSONResponse) {
+	ctx := req.Context()
+
 	// get rooms for specified user
 	allUserRooms := []string{}
 	userRooms := api.QueryRoomsForUserResponse{}
 	// Get rooms the user is either joined, invited or has left.
 	for _, membership := range []string{"join", "invite", "leave"} {
 		if err := rsAPI.QueryRoomsForUser(ctx, &api.QueryRoomsForUserRequest{
-			UserID:         r.UserID,
+			UserID:         userID,
 			WantMembership: membership,
 		}, &userRooms); err != nil {
-			return util.ErrorResponse(err)
+			res := util.ErrorResponse(err)
+			return "", &res
 		}
 		allUserRooms = append(allUserRooms, userRooms.RoomIDs...)
 	}
@@ -115,7 +163,8 @@ func SendServerNotice(
 		UserID:         senderUserID,
 		WantMembership: "join",
 	}, &senderRooms); err != nil {
-		return util.ErrorResponse(err)
+		res := util.ErrorResponse(err)
+		return "", &res
 	}
 
 	// check if we have rooms in common
@@ -129,7 +178,8 @@ func SendServerNotice(
 	}
 
 	if len(commonRooms) > 1 {
-		return util.ErrorResponse(fmt.Errorf("expected to find one room, but got %d", len(commonRooms)))
+		res := util.ErrorResponse(fmt.Errorf("expected to find one room, but got %d", len(commonRooms)))
+		return "", &res
 	}
 
 	var (
@@ -140,19 +190,21 @@ func SendServerNotice(
 	// create a new room for the user
 	if len(commonRooms) == 0 {
 		powerLevelContent := eventutil.InitialPowerLevelsContent(senderUserID)
-		powerLevelContent.Users[r.UserID] = -10 // taken from Synapse
+		powerLevelContent.Users[userID] = -10 // taken from Synapse
 		pl, err := json.Marshal(powerLevelContent)
 		if err != nil {
-			return util.ErrorResponse(err)
+			res := util.ErrorResponse(err)
+			return "", &res
 		}
 		createContent := map[string]interface{}{}
 		createContent["m.federate"] = false
 		cc, err := json.Marshal(createContent)
 		if err != nil {
-			return util.ErrorResponse(err)
+			res := util.ErrorResponse(err)
+			return "", &res
 		}
 		crReq := createRoomRequest{
-			Invite:                    []string{r.UserID},
+			Invite:                    []string{userID},
 			Name:                      cfgNotices.RoomName,
 			Visibility:                "private",
 			Preset:                    presetPrivateChat,
@@ -174,29 +226,31 @@ func SendServerNotice(
 					Order: 1.0,
 				},
 			}}
-			if err = saveTagData(req, r.UserID, roomID, userAPI, serverAlertTag); err != nil {
+			if err = saveTagData(req, userID, roomID, userAPI, serverAlertTag); err != nil {
 				util.GetLogger(ctx).WithError(err).Error("saveTagData failed")
-				return jsonerror.InternalServerError()
+				res := jsonerror.InternalServerError()
+				return "", &res
 			}
 
 		default:
 			// if we didn't get a createRoomResponse, we probably received an error, so return that.
-			return roomRes
+			return "", &roomRes
 		}
 	} else {
 		// we've found a room in common, check the membership
 		roomID = commonRooms[0]
 		membershipRes := api.QueryMembershipForUserResponse{}
-		err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{UserID: r.UserID, RoomID: roomID}, &membershipRes)
+		err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{UserID: userID, RoomID: roomID}, &membershipRes)
 		if err != nil {
 			util.GetLogger(ctx).WithError(err).Error("unable to query membership for user")
-			return jsonerror.InternalServerError()
+			res := jsonerror.InternalServerError()
+			return "", &res
 		}
 		if !membershipRes.IsInRoom {
 			// re-invite the user
-			res, err := sendInvite(ctx, userAPI, senderDevice, roomID, r.UserID, "Server notice room", cfgClient, rsAPI, asAPI, time.Now())
+			res, err := sendInvite(ctx, userAPI, senderDevice, roomID, userID, "Server notice room", cfgClient, rsAPI, asAPI, time.Now())
 			if err != nil {
-				return res
+				return "", &res
 			}
 		}
 	}
@@ -204,24 +258,16 @@ func SendServerNotice(
 	startedGeneratingEvent := time.Now()
 
 	request := map[string]interface{}{
-		"body":    r.Content.Body,
-		"msgtype": r.Content.MsgType,
+		"body":    body,
+		"msgtype": msgType,
 	}
 	e, resErr := generateSendEvent(ctx, request, senderDevice, roomID, "m.room.message", nil, cfgClient, rsAPI, time.Now())
 	if resErr != nil {
 		logrus.Errorf("failed to send message: %+v", resErr)
-		return *resErr
+		return "", resErr
 	}
 	timeToGenerateEvent := time.Since(startedGeneratingEvent)
 
-	var txnAndSessionID *api.TransactionID
-	if txnID != nil {
-		txnAndSessionID = &api.TransactionID{
-			TransactionID: *txnID,
-			SessionID:     device.SessionID,
-		}
-	}
-
 	// pass the new event to the roomserver and receive the correct event ID
 	// event ID in case of duplicate transaction is discarded
 	startedSubmittingEvent := time.Now()
@@ -238,7 +284,8 @@ func SendServerNotice(
 		false,
 	); err != nil {
 		util.GetLogger(ctx).WithError(err).Error("SendEvents failed")
-		return jsonerror.InternalServerError()
+		res := jsonerror.InternalServerError()
+		return "", &res
 	}
 	util.GetLogger(ctx).WithFields(logrus.Fields{
 		"event_id":     e.EventID(),
@@ -247,21 +294,260 @@ func SendServerNotice(
 	}).Info("Sent event to roomserver")
 	timeToSubmitEvent := time.Since(startedSubmittingEvent)
 
-	res := util.JSONResponse{
-		Code: http.StatusOK,
-		JSON: sendEventResponse{e.EventID()},
-	}
-	// Add response to transactionsCache
-	if txnID != nil {
-		txnCache.AddTransaction(device.AccessToken, *txnID, req.URL, &res)
-	}
-
 	// Take a note of how long it took to generate the event vs submit
 	// it to the roomserver.
 	sendEventDuration.With(prometheus.Labels{"action": "build"}).Observe(float64(timeToGenerateEvent.Milliseconds()))
 	sendEventDuration.With(prometheus.Labels{"action": "submit"}).Observe(float64(timeToSubmitEvent.Milliseconds()))
 
-	return res
+	return e.EventID(), nil
+}
+
+// sendServerNoticesRequest is a request to send a server notice to a list of
+// users, or to all local users.
+type sendServerNoticesRequest struct {
+	UserIDs  []string `json:"user_ids,omitempty"`
+	AllUsers bool     `json:"all_users,omitempty"`
+	Content  struct {
+		MsgType string `json:"msgtype,omitempty"`
+		Body    string `json:"body,omitempty"`
+	} `json:"content,omitempty"`
+}
+
+// serverNoticeResult is the outcome of sending a server notice to one user.
+type serverNoticeResult struct {
+	EventID string `json:"event_id,omitempty"`
+	ErrCode string `json:"errcode,omitempty"`
+	Err     string `json:"error,omitempty"`
+}
+
+type sendServerNoticesResponse struct {
+	Results map[string]serverNoticeResult `json:"results"`
+}
+
+type sendServerNoticesJobResponse struct {
+	JobID string `json:"job_id"`
+}
+
+type serverNoticesJobResponse struct {
+	Done    bool                          `json:"done"`
+	Results map[string]serverNoticeResult `json:"results"`
+}
+
+// serverNoticesConcurrency is how many server notices are sent at once when
+// sending a notice to many users, so that the roomserver isn't flooded.
+const serverNoticesConcurrency = 4
+
+// serverNoticesJobRetention is how long the results of sending a server notice
+// to all users are kept for once it has finished.
+const serverNoticesJobRetention = time.Hour
+
+// ServerNoticesJobs keeps track of the server notices which are being sent to
+// all users in the background, so that admins can check on their progress.
+type ServerNoticesJobs struct {
+	processCtx *process.ProcessContext
+	mu         sync.Mutex
+	jobs       map[string]*serverNoticesJob
+}
+
+type serverNoticesJob struct {
+	mu      sync.Mutex
+	done    bool
+	results map[string]serverNoticeResult
+}
+
+// NewServerNoticesJobs creates a ServerNoticesJobs which sends server notices
+// until the process is shut down.
+func NewServerNoticesJobs(processCtx *process.ProcessContext) *ServerNoticesJobs {
+	return &ServerNoticesJobs{
+		processCtx: processCtx,
+		jobs:       map[string]*serverNoticesJob{},
+	}
+}
+
+// start runs f in the background on the process context, returning the ID of
+// the job. The job is forgotten some time after f has returned.
+func (j *ServerNoticesJobs) start(f func(ctx context.Context, setResult func(userID string, result serverNoticeResult))) string {
+	job := &serverNoticesJob{results: map[string]serverNoticeResult{}}
+	jobID := util.RandomString(16)
+	j.mu.Lock()
+	j.jobs[jobID] = job
+	j.mu.Unlock()
+
+	j.processCtx.ComponentStarted()
+	go func() {
+		defer j.processCtx.ComponentFinished()
+		f(j.processCtx.Context(), func(userID string, result serverNoticeResult) {
+			job.mu.Lock()
+			job.results[userID] = result
+			job.mu.Unlock()
+		})
+		job.mu.Lock()
+		job.done = true
+		job.mu.Unlock()
+		time.AfterFunc(serverNoticesJobRetention, func() {
+			j.mu.Lock()
+			delete(j.jobs, jobID)
+			j.mu.Unlock()
+		})
+	}()
+	return jobID
+}
+
+// SendServerNotices sends a server notice to a list of users, reporting whether
+// it was sent to each of them. If the notice is for all local users then it is
+// sent in the background and the ID of the job is returned instead, which can
+// be passed to ServerNoticesJob to find out how it went. It can only be invoked
+// by an admin.
+func SendServerNotices(
+	req *http.Request,
+	jobs *ServerNoticesJobs,
+	cfgNotices *config.ServerNotices,
+	cfgClient *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+	rsAPI api.ClientRoomserverAPI,
+	asAPI appserviceAPI.AppServiceInternalAPI,
+	device *userapi.Device,
+	senderDevice *userapi.Device,
+) util.JSONResponse {
+	var r sendServerNoticesRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if (len(r.UserIDs) == 0 && !r.AllUsers) || r.Content.MsgType == "" || r.Content.Body == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Invalid request"),
+		}
+	}
+
+	send := func(ctx context.Context, userIDs []string, setResult func(userID string, result serverNoticeResult)) {
+		sendServerNoticesToUsers(
+			req.WithContext(ctx), userIDs, r.Content.MsgType, r.Content.Body,
+			cfgNotices, cfgClient, userAPI, rsAPI, asAPI,
+			device, senderDevice, setResult,
+		)
+	}
+
+	if r.AllUsers {
+		jobID := jobs.start(func(ctx context.Context, setResult func(userID string, result serverNoticeResult)) {
+			// Server notice rooms don't federate, so only the users on the
+			// server name of the notices user can be sent notices, and not
+			// the users of virtual hosts.
+			userIDs := r.UserIDs
+			var res userapi.QueryLocalpartsResponse
+			if err := userAPI.QueryLocalparts(ctx, &userapi.QueryLocalpartsRequest{
+				ServerName: cfgClient.Matrix.ServerName,
+			}, &res); err != nil {
+				util.GetLogger(ctx).WithError(err).Error("userAPI.QueryLocalparts failed")
+			}
+			for _, localpart := range res.Localparts {
+				if userID := userutil.MakeUserID(localpart, cfgClient.Matrix.ServerName); userID != senderDevice.UserID {
+					userIDs = append(userIDs, userID)
+				}
+			}
+			send(ctx, userIDs, setResult)
+		})
+		return util.JSONResponse{
+			Code: http.StatusAccepted,
+			JSON: sendServerNoticesJobResponse{JobID: jobID},
+		}
+	}
+
+	results := make(map[string]serverNoticeResult, len(r.UserIDs))
+	var mu sync.Mutex
+	send(req.Context(), r.UserIDs, func(userID string, result serverNoticeResult) {
+		mu.Lock()
+		results[userID] = result
+		mu.Unlock()
+	})
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: sendServerNoticesResponse{Results: results},
+	}
+}
+
+// ServerNoticesJob reports on the progress of sending a server notice to all
+// users. It can only be invoked by an admin.
+func ServerNoticesJob(jobs *ServerNoticesJobs, jobID string) util.JSONResponse {
+	jobs.mu.Lock()
+	job, ok := jobs.jobs[jobID]
+	jobs.mu.Unlock()
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown job"),
+		}
+	}
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	res := serverNoticesJobResponse{
+		Done:    job.done,
+		Results: make(map[string]serverNoticeResult, len(job.results)),
+	}
+	for userID, result := range job.results {
+		res.Results[userID] = result
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// sendServerNoticesToUsers sends a server notice to each of the given users,
+// a few at a time, passing the outcome for each of them to setResult.
+func sendServerNoticesToUsers(
+	req *http.Request,
+	userIDs []string,
+	msgType, body string,
+	cfgNotices *config.ServerNotices,
+	cfgClient *config.ClientAPI,
+	userAPI userapi.ClientUserAPI,
+	rsAPI api.ClientRoomserverAPI,
+	asAPI appserviceAPI.AppServiceInternalAPI,
+	device *userapi.Device,
+	senderDevice *userapi.Device,
+	setResult func(userID string, result serverNoticeResult),
+) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, serverNoticesConcurrency)
+	seen := make(map[string]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		if _, ok := seen[userID]; ok {
+			continue
+		}
+		seen[userID] = struct{}{}
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || domain != cfgClient.Matrix.ServerName {
+			setResult(userID, serverNoticeResult{
+				ErrCode: "M_INVALID_PARAM",
+				Err:     fmt.Sprintf("Server notices can only be sent to users on %s", cfgClient.Matrix.ServerName),
+			})
+			continue
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			var result serverNoticeResult
+			eventID, resErr := sendServerNoticeToUser(
+				req, userID, msgType, body,
+				cfgNotices, cfgClient, userAPI, rsAPI, asAPI,
+				device, senderDevice, nil,
+			)
+			if resErr == nil {
+				result.EventID = eventID
+			} else if e, ok := resErr.JSON.(*jsonerror.MatrixError); ok {
+				result.ErrCode, result.Err = e.ErrCode, e.Err
+			} else {
+				result.ErrCode, result.Err = "M_UNKNOWN", "Failed to send the server notice"
+			}
+			setResult(userID, result)
+		}(userID)
+	}
+	wg.Wait()
 }
 
 func (r sendServerNoticeRequest) valid() (ok bool) {
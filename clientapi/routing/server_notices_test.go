@@ -1,7 +1,25 @@
 package routing
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
 	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/appservice"
+	"github.com/matrix-org/dendrite/keyserver"
+	"github.com/matrix-org/dendrite/roomserver"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
 )
 
 func Test_sendServerNoticeRequest_validate(t *testing.T) {
@@ -81,3 +99,171 @@ func Test_sendServerNoticeRequest_validate(t *testing.T) {
 		})
 	}
 }
+
+func TestSendServerNotices(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	guest := test.NewUser(t, test.WithAccountType(uapi.AccountTypeGuest))
+	charlie := test.NewUser(t, test.WithSigningServer("vhost", "ed25519:vhost", test.PrivateKeyB))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		cfg := &base.Cfg.ClientAPI
+		cfg.Matrix.ServerNotices = config.ServerNotices{
+			Enabled:     true,
+			LocalPart:   "_server",
+			DisplayName: "Server Alert",
+			RoomName:    "Server Alert",
+		}
+		cfg.Matrix.VirtualHosts = append(cfg.Matrix.VirtualHosts, &config.VirtualHost{
+			SigningIdentity: gomatrixserverlib.SigningIdentity{ServerName: "vhost"},
+		})
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		asAPI := appservice.NewInternalAPI(base, userAPI, rsAPI)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		for _, u := range []*test.User{alice, bob, guest, charlie} {
+			localpart, serverName, _ := gomatrixserverlib.SplitID('@', u.ID)
+			if err := userAPI.PerformAccountCreation(ctx, &uapi.PerformAccountCreationRequest{
+				AccountType: u.AccountType,
+				Localpart:   localpart,
+				ServerName:  serverName,
+				Password:    "someRandomPassword",
+			}, &uapi.PerformAccountCreationResponse{}); err != nil {
+				t.Fatalf("failed to create account: %s", err)
+			}
+		}
+
+		senderDevice, err := getSenderDevice(ctx, rsAPI, userAPI, cfg)
+		if err != nil {
+			t.Fatalf("failed to get the server notices device: %s", err)
+		}
+		adminDev := &uapi.Device{UserID: "@admin:test", AccountType: uapi.AccountTypeAdmin}
+		jobs := NewServerNoticesJobs(base.ProcessContext)
+
+		sendNotices := func(t *testing.T, body map[string]interface{}) util.JSONResponse {
+			t.Helper()
+			b, err := json.Marshal(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodPost, "/", bytes.NewBuffer(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return SendServerNotices(req, jobs, &cfg.Matrix.ServerNotices, cfg, userAPI, rsAPI, asAPI, adminDev, senderDevice)
+		}
+		content := map[string]string{"msgtype": "m.text", "body": "Hello world!"}
+
+		testCases := []struct {
+			name        string
+			request     map[string]interface{}
+			wantSent    []string
+			wantFailed  []string
+			wantInvalid bool
+			wantJob     bool
+		}{
+			{
+				name:        "no users",
+				request:     map[string]interface{}{"content": content},
+				wantInvalid: true,
+			},
+			{
+				name:        "no content",
+				request:     map[string]interface{}{"user_ids": []string{alice.ID}},
+				wantInvalid: true,
+			},
+			{
+				name: "list of users",
+				request: map[string]interface{}{
+					"user_ids": []string{alice.ID, bob.ID, alice.ID, "@someone:remote", "not a user ID", charlie.ID},
+					"content":  content,
+				},
+				wantSent:   []string{alice.ID, bob.ID},
+				wantFailed: []string{"@someone:remote", "not a user ID", charlie.ID},
+			},
+			{
+				name:     "all users",
+				request:  map[string]interface{}{"all_users": true, "content": content},
+				wantSent: []string{alice.ID, bob.ID},
+				wantJob:  true,
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				res := sendNotices(t, tc.request)
+				if tc.wantInvalid {
+					if res.Code != http.StatusBadRequest {
+						t.Fatalf("expected HTTP 400, got %d: %+v", res.Code, res.JSON)
+					}
+					return
+				}
+				var results map[string]serverNoticeResult
+				if tc.wantJob {
+					if res.Code != http.StatusAccepted {
+						t.Fatalf("expected HTTP 202, got %d: %+v", res.Code, res.JSON)
+					}
+					jobID := res.JSON.(sendServerNoticesJobResponse).JobID
+					deadline := time.Now().Add(10 * time.Second)
+					for {
+						jobRes := ServerNoticesJob(jobs, jobID)
+						if jobRes.Code != http.StatusOK {
+							t.Fatalf("expected HTTP 200, got %d: %+v", jobRes.Code, jobRes.JSON)
+						}
+						if job := jobRes.JSON.(serverNoticesJobResponse); job.Done {
+							results = job.Results
+							break
+						}
+						if time.Now().After(deadline) {
+							t.Fatalf("timed out waiting for the server notices to be sent")
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+				} else {
+					if res.Code != http.StatusOK {
+						t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+					}
+					results = res.JSON.(sendServerNoticesResponse).Results
+				}
+				if len(results) != len(tc.wantSent)+len(tc.wantFailed) {
+					t.Fatalf("expected %d results, got %+v", len(tc.wantSent)+len(tc.wantFailed), results)
+				}
+				for _, userID := range tc.wantFailed {
+					if result := results[userID]; result.EventID != "" || result.ErrCode == "" {
+						t.Fatalf("expected the notice to %s to fail, got %+v", userID, result)
+					}
+				}
+				for _, userID := range tc.wantSent {
+					result := results[userID]
+					if result.EventID == "" {
+						t.Fatalf("expected the notice to %s to be sent, got %+v", userID, result)
+					}
+					var eventsRes roomserverAPI.QueryEventsByIDResponse
+					if err := rsAPI.QueryEventsByID(ctx, &roomserverAPI.QueryEventsByIDRequest{
+						EventIDs: []string{result.EventID},
+					}, &eventsRes); err != nil {
+						t.Fatalf("failed to query events: %s", err)
+					}
+					if len(eventsRes.Events) != 1 {
+						t.Fatalf("expected the notice to %s to be stored, got %d events", userID, len(eventsRes.Events))
+					}
+					membershipRes := roomserverAPI.QueryMembershipForUserResponse{}
+					if err := rsAPI.QueryMembershipForUser(ctx, &roomserverAPI.QueryMembershipForUserRequest{
+						UserID: userID,
+						RoomID: eventsRes.Events[0].RoomID(),
+					}, &membershipRes); err != nil {
+						t.Fatalf("failed to query membership: %s", err)
+					}
+					if membershipRes.Membership != gomatrixserverlib.Invite {
+						t.Fatalf("expected %s to be invited to the server notice room, got %q", userID, membershipRes.Membership)
+					}
+				}
+			})
+		}
+	})
+}
@@ -16,6 +16,7 @@ package routing
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"net/http"
@@ -23,6 +24,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/sso"
@@ -41,6 +43,7 @@ func SSORedirect(
 	idpID string,
 	auth ssoAuthenticator,
 	cfg *config.SSO,
+	links *ssoLinkTokens,
 ) util.JSONResponse {
 	ctx := req.Context()
 
@@ -70,6 +73,16 @@ func SSORedirect(
 		}
 	}
 
+	linkToken := req.URL.Query().Get(ssoLinkTokenParam)
+	if linkToken != "" {
+		if _, ok := links.lookup(linkToken, ssoLinkBinding(req)); !ok {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("unknown or expired " + ssoLinkTokenParam),
+			}
+		}
+	}
+
 	if idpID == "" {
 		idpID = cfg.DefaultProviderID
 		if idpID == "" && len(cfg.Providers) > 0 {
@@ -89,7 +102,7 @@ func SSORedirect(
 	callbackURL = callbackURL.ResolveReference(&url.URL{
 		RawQuery: url.Values{"provider": []string{idpID}}.Encode(),
 	})
-	nonce := formatNonce(redirectURL)
+	nonce := formatNonce(redirectURL, linkToken)
 	u, err := auth.AuthorizationURL(ctx, idpID, callbackURL.String(), nonce)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("Failed to get SSO authorization URL")
@@ -154,6 +167,7 @@ func SSOCallback(
 	auth ssoAuthenticator,
 	cfg *config.SSO,
 	serverName gomatrixserverlib.ServerName,
+	links *ssoLinkTokens,
 ) util.JSONResponse {
 	if auth == nil {
 		return util.JSONResponse{
@@ -180,7 +194,7 @@ func SSOCallback(
 			JSON: jsonerror.MissingArgument("no nonce cookie: " + err.Error()),
 		}
 	}
-	finalRedirectURL, err := parseNonce(nonce.Value)
+	finalRedirectURL, linkToken, err := parseNonce(nonce.Value)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -215,6 +229,14 @@ func SSOCallback(
 		return util.RedirectResponse(result.RedirectURL)
 	}
 
+	if !ssoGroupsAllowed(cfg, idpID, result.Groups) {
+		util.GetLogger(ctx).WithField("ssoIdentifier", result.Identifier).WithField("groups", result.Groups).Info("SSO user not in an allowed group")
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(fmt.Sprintf("You are not in a group which is allowed to log in with identity provider %q", idpID)),
+		}
+	}
+
 	localpart, err := verifySSOUserIdentifier(ctx, userAPI, result.Identifier)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).WithField("ssoIdentifier", result.Identifier).Error("failed to find user")
@@ -223,8 +245,18 @@ func SSOCallback(
 			JSON: jsonerror.Forbidden("ID not associated with a local account"),
 		}
 	}
+	if linkToken != "" {
+		return linkSSOAccount(ctx, userAPI, links, linkToken, ssoLinkBinding(req), result.Identifier, localpart, finalRedirectURL)
+	}
 	if localpart == "" {
 		// The user doesn't exist.
+		if ssoRegistrationPolicy(cfg, idpID) == config.SSORegistrationDisabled {
+			util.GetLogger(ctx).WithField("ssoIdentifier", result.Identifier).Info("SSO registration disabled for identity provider")
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(fmt.Sprintf("Registration is disabled for identity provider %q, and the ID is not associated with a local account", idpID)),
+			}
+		}
 		// TODO: let the user select the local part, and whether to associate email addresses.
 		util.GetLogger(ctx).WithField("localpart", result.SuggestedUserID).WithField("ssoIdentifier", result.Identifier).Info("SSO registering account")
 		localpart = result.SuggestedUserID
@@ -248,7 +280,7 @@ func SSOCallback(
 		}
 	}
 
-	token, err := createLoginToken(ctx, userAPI, userutil.MakeUserID(localpart, serverName))
+	token, err := createLoginToken(ctx, userAPI, userutil.MakeUserID(localpart, serverName), idpID, result.IDToken)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Errorf("PerformLoginTokenCreation failed")
 		return jsonerror.InternalServerError()
@@ -258,13 +290,49 @@ func SSOCallback(
 	rquery := finalRedirectURL.Query()
 	rquery.Set("loginToken", token.Token)
 	resp := util.RedirectResponse(finalRedirectURL.ResolveReference(&url.URL{RawQuery: rquery.Encode()}).String())
-	resp.Headers["Set-Cookie"] = (&http.Cookie{
+	resp.Headers["Set-Cookie"] = clearNonceCookie()
+	return resp
+}
+
+// ssoRegistrationPolicy returns the registration policy of the given
+// identity provider.
+func ssoRegistrationPolicy(cfg *config.SSO, idpID string) config.SSORegistrationPolicy {
+	for _, idp := range cfg.Providers {
+		if idp = idp.WithDefaults(); idp.ID == idpID {
+			return idp.Registration
+		}
+	}
+	return config.SSORegistrationAuto
+}
+
+// ssoGroupsAllowed returns whether a user in the given groups may log in
+// with the given identity provider.
+func ssoGroupsAllowed(cfg *config.SSO, idpID string, groups []string) bool {
+	for _, idp := range cfg.Providers {
+		if idp.WithDefaults().ID != idpID || len(idp.AllowedGroups) == 0 {
+			continue
+		}
+		for _, allowed := range idp.AllowedGroups {
+			for _, group := range groups {
+				if group == allowed {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// clearNonceCookie returns a Set-Cookie header value which removes the
+// nonce cookie once the callback is done with it.
+func clearNonceCookie() string {
+	return (&http.Cookie{
 		Name:   "sso_nonce",
 		Value:  "",
 		MaxAge: -1,
 		Secure: true,
 	}).String()
-	return resp
 }
 
 type ssoAuthenticator interface {
@@ -281,34 +349,42 @@ type userAPIForSSO interface {
 	QueryNumericLocalpart(ctx context.Context, req *userapi.QueryNumericLocalpartRequest, res *userapi.QueryNumericLocalpartResponse) error
 }
 
-// formatNonce creates a random nonce that also contains the URL.
-func formatNonce(redirectURL string) string {
-	return util.RandomString(16) + "." + base64.RawURLEncoding.EncodeToString([]byte(redirectURL))
+// formatNonce creates a random nonce that also contains the URL and,
+// if linking an account, the link token.
+func formatNonce(redirectURL, linkToken string) string {
+	nonce := util.RandomString(16) + "." + base64.RawURLEncoding.EncodeToString([]byte(redirectURL))
+	if linkToken != "" {
+		nonce += "." + linkToken
+	}
+	return nonce
 }
 
-// parseNonce extracts the embedded URL from the nonce. The nonce
-// should have been validated to be the original before calling this
-// function. The URL is not integrity protected.
-func parseNonce(s string) (redirectURL *url.URL, _ error) {
+// parseNonce extracts the embedded URL and link token from the
+// nonce. The nonce should have been validated to be the original
+// before calling this function. The URL is not integrity protected.
+func parseNonce(s string) (redirectURL *url.URL, linkToken string, _ error) {
 	if s == "" {
-		return nil, jsonerror.MissingArgument("empty SSO nonce cookie")
+		return nil, "", jsonerror.MissingArgument("empty SSO nonce cookie")
 	}
 
 	ss := strings.Split(s, ".")
 	if len(ss) < 2 {
-		return nil, jsonerror.InvalidArgumentValue("malformed SSO nonce cookie")
+		return nil, "", jsonerror.InvalidArgumentValue("malformed SSO nonce cookie")
 	}
 
 	urlbs, err := base64.RawURLEncoding.DecodeString(ss[1])
 	if err != nil {
-		return nil, jsonerror.InvalidArgumentValue("invalid redirect URL in SSO nonce cookie")
+		return nil, "", jsonerror.InvalidArgumentValue("invalid redirect URL in SSO nonce cookie")
 	}
 	u, err := url.Parse(string(urlbs))
 	if err != nil {
-		return nil, jsonerror.InvalidArgumentValue("invalid redirect URL in SSO nonce cookie: " + err.Error())
+		return nil, "", jsonerror.InvalidArgumentValue("invalid redirect URL in SSO nonce cookie: " + err.Error())
+	}
+	if len(ss) > 2 {
+		linkToken = ss[2]
 	}
 
-	return u, nil
+	return u, linkToken, nil
 }
 
 // verifySSOUserIdentifier resolves an sso.UserIdentifier to a local
@@ -370,12 +446,206 @@ func registerSSOAccount(ctx context.Context, userAPI userAPIForSSO, ssoID *sso.U
 }
 
 // createLoginToken produces a new login token, valid for the given
-// user.
-func createLoginToken(ctx context.Context, userAPI userAPIForSSO, userID string) (*userapi.LoginTokenMetadata, error) {
-	req := userapi.PerformLoginTokenCreationRequest{Data: userapi.LoginTokenData{UserID: userID}}
+// user, who logged in with the given identity provider.
+func createLoginToken(ctx context.Context, userAPI userAPIForSSO, userID, idpID, idToken string) (*userapi.LoginTokenMetadata, error) {
+	req := userapi.PerformLoginTokenCreationRequest{Data: userapi.LoginTokenData{UserID: userID, SSOProvider: idpID, SSOIDToken: idToken}}
 	var resp userapi.PerformLoginTokenCreationResponse
 	if err := userAPI.PerformLoginTokenCreation(ctx, &req, &resp); err != nil {
 		return nil, err
 	}
 	return &resp.Metadata, nil
 }
+
+// ssoLinkTokenParam is the /login/sso/redirect query parameter which
+// makes the callback link the SSO identity to an existing account.
+const ssoLinkTokenParam = "org.matrix.dendrite.link_token"
+
+// ssoLinkTokenLifetime is how long a link token can be used for, which
+// matches the lifetime of the nonce cookie.
+const ssoLinkTokenLifetime = 10 * time.Minute
+
+// ssoLinkCookie is the cookie which binds a link token to the browser
+// it was created for, so that a link token can't be used to link the
+// SSO identity of someone who was tricked into following the link.
+const ssoLinkCookie = "sso_link"
+
+// ssoLinkTokens remembers which user asked to link an SSO identity to
+// their account. A nil *ssoLinkTokens means account linking is disabled.
+type ssoLinkTokens struct {
+	sync.Mutex
+	tokens map[string]ssoLinkToken
+}
+
+type ssoLinkToken struct {
+	userID  string
+	binding string
+	expires time.Time
+}
+
+func newSSOLinkTokens() *ssoLinkTokens {
+	return &ssoLinkTokens{tokens: map[string]ssoLinkToken{}}
+}
+
+// create returns a new link token for the user and the secret to store
+// in the ssoLinkCookie, dropping any tokens which have expired.
+func (t *ssoLinkTokens) create(userID string) (token, binding string) {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	for token, link := range t.tokens {
+		if now.After(link.expires) {
+			delete(t.tokens, token)
+		}
+	}
+	token, binding = util.RandomString(32), util.RandomString(32)
+	t.tokens[token] = ssoLinkToken{userID: userID, binding: binding, expires: now.Add(ssoLinkTokenLifetime)}
+	return token, binding
+}
+
+// lookup returns the user the link token was created for, provided the
+// binding matches the one returned by create.
+func (t *ssoLinkTokens) lookup(token, binding string) (userID string, ok bool) {
+	if t == nil {
+		return "", false
+	}
+	t.Lock()
+	defer t.Unlock()
+	link, ok := t.tokens[token]
+	if !ok || time.Now().After(link.expires) {
+		return "", false
+	}
+	if subtle.ConstantTimeCompare([]byte(link.binding), []byte(binding)) != 1 {
+		return "", false
+	}
+	return link.userID, true
+}
+
+// take is like lookup, but the link token can't be used again afterwards.
+func (t *ssoLinkTokens) take(token, binding string) (userID string, ok bool) {
+	userID, ok = t.lookup(token, binding)
+	if ok {
+		t.Lock()
+		delete(t.tokens, token)
+		t.Unlock()
+	}
+	return userID, ok
+}
+
+// ssoLinkBinding returns the value of the ssoLinkCookie in the request.
+func ssoLinkBinding(req *http.Request) string {
+	cookie, err := req.Cookie(ssoLinkCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// SSOLinkStart implements POST /_matrix/client/unstable/org.matrix.dendrite/sso/link.
+// It returns a link token to pass to /login/sso/redirect, so that the
+// SSO identity the user logs in with is linked to their account. The
+// link token only works in the browser which received the cookie set
+// here.
+func SSOLinkStart(
+	req *http.Request,
+	device *userapi.Device,
+	links *ssoLinkTokens,
+	serverName gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	if links == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("SSO account linking is disabled"),
+		}
+	}
+	// SSO associations only store the localpart, which SSO logins
+	// resolve on the primary server name.
+	_, domain, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	if domain != serverName {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("SSO identities can only be linked to accounts on " + string(serverName)),
+		}
+	}
+	token, binding := links.create(device.UserID)
+	cookie := &http.Cookie{
+		Name:     ssoLinkCookie,
+		Value:    binding,
+		Path:     "/_matrix/client",
+		Expires:  time.Now().Add(ssoLinkTokenLifetime),
+		Secure:   req.URL.Scheme != "http",
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	}
+	if !cookie.Secure {
+		cookie.SameSite = http.SameSiteDefaultMode
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"link_token":    token,
+			"expires_in_ms": ssoLinkTokenLifetime.Milliseconds(),
+		},
+		Headers: map[string]string{"Set-Cookie": cookie.String()},
+	}
+}
+
+// linkSSOAccount associates the SSO identifier with the account which
+// created the link token, and redirects back to the client without a
+// login token. Identifiers which are already associated with another
+// account are rejected.
+func linkSSOAccount(
+	ctx context.Context,
+	userAPI userAPIForSSO,
+	links *ssoLinkTokens,
+	linkToken, binding string,
+	ssoID *sso.UserIdentifier,
+	linkedLocalpart string,
+	finalRedirectURL *url.URL,
+) util.JSONResponse {
+	userID, ok := links.take(linkToken, binding)
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("unknown or expired " + ssoLinkTokenParam),
+		}
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	logger := util.GetLogger(ctx).WithField("localpart", localpart).WithField("ssoIdentifier", ssoID)
+	switch linkedLocalpart {
+	case localpart:
+		// Already linked to this account.
+	case "":
+		err = userAPI.PerformSaveSSOAssociation(ctx, &userapi.PerformSaveSSOAssociationRequest{
+			Namespace: ssoID.Namespace,
+			Issuer:    ssoID.Issuer,
+			Subject:   ssoID.Subject,
+			Localpart: localpart,
+		}, &struct{}{})
+		if err != nil {
+			logger.WithError(err).Error("failed to link SSO identity")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: jsonerror.Unknown("failed to associate SSO credentials with account: " + err.Error()),
+			}
+		}
+		logger.Info("SSO identity linked to account")
+	default:
+		logger.WithField("linkedLocalpart", linkedLocalpart).Warn("SSO identity already linked to another account")
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("SSO identity is already linked to another account"),
+		}
+	}
+
+	resp := util.RedirectResponse(finalRedirectURL.String())
+	resp.Headers["Set-Cookie"] = clearNonceCookie()
+	return resp
+}
@@ -11,8 +11,10 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/matrix-org/dendrite/clientapi/auth/sso"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/setup/config"
 	uapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
 )
 
 func TestSSORedirect(t *testing.T) {
@@ -96,7 +98,7 @@ func TestSSORedirect(t *testing.T) {
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
-			got := SSORedirect(&tst.Req, tst.IDPID, &tst.Auth, &tst.Config)
+			got := SSORedirect(&tst.Req, tst.IDPID, &tst.Auth, &tst.Config, nil)
 
 			if want := http.StatusFound; got.Code != want {
 				t.Errorf("SSORedirect Code: got %v, want %v", got.Code, want)
@@ -154,7 +156,7 @@ func TestSSORedirectError(t *testing.T) {
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
-			got := SSORedirect(&tst.Req, tst.IDPID, &tst.Auth, &tst.Config)
+			got := SSORedirect(&tst.Req, tst.IDPID, &tst.Auth, &tst.Config, nil)
 
 			if got.Code != tst.WantCode {
 				t.Errorf("SSORedirect Code: got %v, want %v", got.Code, tst.WantCode)
@@ -213,7 +215,7 @@ func TestSSOCallback(t *testing.T) {
 			WantLocationRE:  `http://matrix.example.com/continue\?loginToken=atoken`,
 			WantSetCookieRE: "sso_nonce=;",
 
-			WantLoginTokenCreation: []*uapi.PerformLoginTokenCreationRequest{{Data: uapi.LoginTokenData{UserID: "@alocalpart:aservername"}}},
+			WantLoginTokenCreation: []*uapi.PerformLoginTokenCreationRequest{{Data: uapi.LoginTokenData{UserID: "@alocalpart:aservername", SSOProvider: "aprovider"}}},
 			WantQueryLocalpart:     []*uapi.QueryLocalpartForSSORequest{{Namespace: "anamespace", Issuer: "anissuer", Subject: "asubject"}},
 		},
 		{
@@ -247,7 +249,7 @@ func TestSSOCallback(t *testing.T) {
 			WantSetCookieRE: "sso_nonce=;",
 
 			WantAccountCreation:    []*uapi.PerformAccountCreationRequest{{Localpart: "asuggestedid", AccountType: uapi.AccountTypeUser, OnConflict: uapi.ConflictAbort}},
-			WantLoginTokenCreation: []*uapi.PerformLoginTokenCreationRequest{{Data: uapi.LoginTokenData{UserID: "@asuggestedid:aservername"}}},
+			WantLoginTokenCreation: []*uapi.PerformLoginTokenCreationRequest{{Data: uapi.LoginTokenData{UserID: "@asuggestedid:aservername", SSOProvider: "aprovider"}}},
 			WantSaveSSOAssociation: []*uapi.PerformSaveSSOAssociationRequest{{Namespace: "anamespace", Issuer: "anissuer", Subject: "asubject", Localpart: "asuggestedid"}},
 			WantQueryLocalpart:     []*uapi.QueryLocalpartForSSORequest{{Namespace: "anamespace", Issuer: "anissuer", Subject: "asubject"}},
 		},
@@ -281,7 +283,7 @@ func TestSSOCallback(t *testing.T) {
 			WantSetCookieRE: "sso_nonce=;",
 
 			WantAccountCreation:    []*uapi.PerformAccountCreationRequest{{Localpart: "12345", AccountType: uapi.AccountTypeUser, OnConflict: uapi.ConflictAbort}},
-			WantLoginTokenCreation: []*uapi.PerformLoginTokenCreationRequest{{Data: uapi.LoginTokenData{UserID: "@12345:aservername"}}},
+			WantLoginTokenCreation: []*uapi.PerformLoginTokenCreationRequest{{Data: uapi.LoginTokenData{UserID: "@12345:aservername", SSOProvider: "aprovider"}}},
 			WantSaveSSOAssociation: []*uapi.PerformSaveSSOAssociationRequest{{Namespace: "anamespace", Issuer: "anissuer", Subject: "asubject", Localpart: "12345"}},
 			WantQueryLocalpart:     []*uapi.QueryLocalpartForSSORequest{{Namespace: "anamespace", Issuer: "anissuer", Subject: "asubject"}},
 		},
@@ -313,7 +315,7 @@ func TestSSOCallback(t *testing.T) {
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
-			got := SSOCallback(&tst.Req, &tst.UserAPI, &tst.Auth, &tst.Config, "aservername")
+			got := SSOCallback(&tst.Req, &tst.UserAPI, &tst.Auth, &tst.Config, "aservername", nil)
 
 			if want := http.StatusFound; got.Code != want {
 				t.Log(got)
@@ -348,6 +350,137 @@ func TestSSOCallback(t *testing.T) {
 	}
 }
 
+func TestSSOCallbackRegistrationPolicy(t *testing.T) {
+	nonce := "1234." + base64.RawURLEncoding.EncodeToString([]byte("http://matrix.example.com/continue"))
+	cfg := config.SSO{
+		Providers: []config.IdentityProvider{
+			{ID: "autoprovider"},
+			{ID: "loginprovider", Registration: config.SSORegistrationDisabled},
+		},
+	}
+	auth := fakeSSOAuthenticator{
+		callbackResult: sso.CallbackResult{
+			Identifier: &sso.UserIdentifier{
+				Namespace: "anamespace",
+				Issuer:    "anissuer",
+				Subject:   "asubject",
+			},
+			SuggestedUserID: "asuggestedid",
+		},
+	}
+
+	tsts := []struct {
+		Name      string
+		Provider  string
+		Localpart string
+
+		WantCode            int
+		WantAccountCreation bool
+	}{
+		{Name: "autoRegisters", Provider: "autoprovider", WantCode: http.StatusFound, WantAccountCreation: true},
+		{Name: "autoLogsIn", Provider: "autoprovider", Localpart: "alocalpart", WantCode: http.StatusFound},
+		{Name: "loginOnlyRefusesRegistration", Provider: "loginprovider", WantCode: http.StatusForbidden},
+		{Name: "loginOnlyLogsIn", Provider: "loginprovider", Localpart: "alocalpart", WantCode: http.StatusFound},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			req := &http.Request{
+				Host: "matrix.example.com",
+				URL: &url.URL{
+					Path: "/_matrix/v4/login/sso/callback",
+					RawQuery: url.Values{
+						"provider": []string{tst.Provider},
+					}.Encode(),
+				},
+				Header: http.Header{
+					"Cookie": []string{(&http.Cookie{
+						Name:  "sso_nonce",
+						Value: nonce,
+					}).String()},
+				},
+			}
+			userAPI := fakeUserAPIForSSO{localpart: tst.Localpart}
+			got := SSOCallback(req, &userAPI, &auth, &cfg, "aservername", nil)
+
+			if got.Code != tst.WantCode {
+				t.Errorf("SSOCallback Code: got %v, want %v: %+v", got.Code, tst.WantCode, got.JSON)
+			}
+			if gotCreation := len(userAPI.gotAccountCreation) > 0; gotCreation != tst.WantAccountCreation {
+				t.Errorf("PerformAccountCreation called: got %v, want %v", gotCreation, tst.WantAccountCreation)
+			}
+			if tst.WantCode != http.StatusFound && len(userAPI.gotLoginTokenCreation) > 0 {
+				t.Errorf("PerformLoginTokenCreation called for a refused login")
+			}
+		})
+	}
+}
+
+func TestSSOCallbackAllowedGroups(t *testing.T) {
+	nonce := "1234." + base64.RawURLEncoding.EncodeToString([]byte("http://matrix.example.com/continue"))
+	cfg := config.SSO{
+		Providers: []config.IdentityProvider{
+			{ID: "aprovider", AllowedGroups: []string{"agroup", "anothergroup"}},
+			{ID: "openprovider"},
+		},
+	}
+
+	tsts := []struct {
+		Name     string
+		Provider string
+		Groups   []string
+
+		WantCode int
+	}{
+		{Name: "inGroup", Provider: "aprovider", Groups: []string{"somegroup", "anothergroup"}, WantCode: http.StatusFound},
+		{Name: "notInGroup", Provider: "aprovider", Groups: []string{"somegroup"}, WantCode: http.StatusForbidden},
+		{Name: "noGroups", Provider: "aprovider", WantCode: http.StatusForbidden},
+		{Name: "noAllowedGroups", Provider: "openprovider", WantCode: http.StatusFound},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			req := &http.Request{
+				Host: "matrix.example.com",
+				URL: &url.URL{
+					Path: "/_matrix/v4/login/sso/callback",
+					RawQuery: url.Values{
+						"provider": []string{tst.Provider},
+					}.Encode(),
+				},
+				Header: http.Header{
+					"Cookie": []string{(&http.Cookie{
+						Name:  "sso_nonce",
+						Value: nonce,
+					}).String()},
+				},
+			}
+			auth := fakeSSOAuthenticator{
+				callbackResult: sso.CallbackResult{
+					Identifier: &sso.UserIdentifier{
+						Namespace: "anamespace",
+						Issuer:    "anissuer",
+						Subject:   "asubject",
+					},
+					Groups: tst.Groups,
+				},
+			}
+			userAPI := fakeUserAPIForSSO{localpart: "alocalpart"}
+			got := SSOCallback(req, &userAPI, &auth, &cfg, "aservername", nil)
+
+			if got.Code != tst.WantCode {
+				t.Errorf("SSOCallback Code: got %v, want %v: %+v", got.Code, tst.WantCode, got.JSON)
+			}
+			if tst.WantCode == http.StatusForbidden {
+				if jerr, ok := got.JSON.(*jsonerror.MatrixError); !ok || jerr.ErrCode != "M_FORBIDDEN" {
+					t.Errorf("SSOCallback JSON: got %+v, want M_FORBIDDEN", got.JSON)
+				}
+				if len(userAPI.gotLoginTokenCreation) > 0 {
+					t.Errorf("PerformLoginTokenCreation called for a refused login")
+				}
+			}
+		})
+	}
+}
+
 func TestSSOCallbackError(t *testing.T) {
 	nonce := "1234." + base64.RawURLEncoding.EncodeToString([]byte("http://matrix.example.com/continue"))
 	goodReq := http.Request{
@@ -490,7 +623,7 @@ func TestSSOCallbackError(t *testing.T) {
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
-			got := SSOCallback(&tst.Req, &tst.UserAPI, &tst.Auth, &tst.Config, "aservername")
+			got := SSOCallback(&tst.Req, &tst.UserAPI, &tst.Auth, &tst.Config, "aservername", nil)
 
 			if got.Code != tst.WantCode {
 				t.Log(got)
@@ -571,3 +704,186 @@ func (userAPI *fakeUserAPIForSSO) QueryNumericLocalpart(ctx context.Context, req
 	res.ID = 12345
 	return userAPI.numericLocalpartErr
 }
+
+func TestSSOLink(t *testing.T) {
+	cfg := config.SSO{Providers: []config.IdentityProvider{{ID: "aprovider"}}}
+	auth := fakeSSOAuthenticator{
+		callbackResult: sso.CallbackResult{
+			Identifier: &sso.UserIdentifier{
+				Namespace: "anamespace",
+				Issuer:    "anissuer",
+				Subject:   "asubject",
+			},
+		},
+	}
+	alice := &uapi.Device{UserID: "@alice:aservername"}
+
+	// startLink returns the link token and the cookie it is bound to.
+	startLink := func(t *testing.T, links *ssoLinkTokens, device *uapi.Device) (string, *http.Cookie) {
+		t.Helper()
+		res := SSOLinkStart(&http.Request{URL: &url.URL{}}, device, links, "aservername")
+		if res.Code != http.StatusOK {
+			t.Fatalf("SSOLinkStart Code: got %v, want %v", res.Code, http.StatusOK)
+		}
+		cookies := (&http.Response{Header: http.Header{"Set-Cookie": []string{res.Headers["Set-Cookie"]}}}).Cookies()
+		if len(cookies) != 1 {
+			t.Fatalf("SSOLinkStart Set-Cookie: got %q, want one cookie", res.Headers["Set-Cookie"])
+		}
+		cookie := cookies[0]
+		if cookie.Name != ssoLinkCookie || !cookie.HttpOnly {
+			t.Errorf("SSOLinkStart Set-Cookie: got %+v, want an HttpOnly %q cookie", cookie, ssoLinkCookie)
+		}
+		return res.JSON.(map[string]interface{})["link_token"].(string), cookie
+	}
+	redirectWith := func(links *ssoLinkTokens, linkToken string, linkCookie *http.Cookie) util.JSONResponse {
+		req := &http.Request{
+			Host: "matrix.example.com",
+			URL: &url.URL{
+				Path: "/_matrix/v4/login/sso/redirect",
+				RawQuery: url.Values{
+					"redirectUrl":     []string{"http://matrix.example.com/continue"},
+					ssoLinkTokenParam: []string{linkToken},
+				}.Encode(),
+			},
+			Header: http.Header{},
+		}
+		if linkCookie != nil {
+			req.AddCookie(&http.Cookie{Name: linkCookie.Name, Value: linkCookie.Value})
+		}
+		return SSORedirect(req, "", &auth, &cfg, links)
+	}
+	// linkWith goes through the redirect with the link token and the
+	// callback with the link cookie, returning the callback response.
+	linkWith := func(t *testing.T, links *ssoLinkTokens, userAPI *fakeUserAPIForSSO, linkToken string, linkCookie *http.Cookie) util.JSONResponse {
+		t.Helper()
+		redirect := redirectWith(links, linkToken, linkCookie)
+		if redirect.Code != http.StatusFound {
+			t.Fatalf("SSORedirect Code: got %v, want %v", redirect.Code, http.StatusFound)
+		}
+		location, err := url.Parse(redirect.Headers["Location"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &http.Request{
+			Host: "matrix.example.com",
+			URL: &url.URL{
+				Path: "/_matrix/v4/login/sso/callback",
+				RawQuery: url.Values{
+					"provider": []string{"aprovider"},
+				}.Encode(),
+			},
+			Header: http.Header{},
+		}
+		req.AddCookie(&http.Cookie{Name: "sso_nonce", Value: location.Query().Get("nonce")})
+		if linkCookie != nil {
+			req.AddCookie(&http.Cookie{Name: linkCookie.Name, Value: linkCookie.Value})
+		}
+		return SSOCallback(req, userAPI, &auth, &cfg, "aservername", links)
+	}
+
+	t.Run("links the identity to the account", func(t *testing.T) {
+		links := newSSOLinkTokens()
+		userAPI := &fakeUserAPIForSSO{}
+		linkToken, linkCookie := startLink(t, links, alice)
+
+		got := linkWith(t, links, userAPI, linkToken, linkCookie)
+		if got.Code != http.StatusFound {
+			t.Fatalf("SSOCallback Code: got %v, want %v: %+v", got.Code, http.StatusFound, got.JSON)
+		}
+		if want := "http://matrix.example.com/continue"; got.Headers["Location"] != want {
+			t.Errorf("SSOCallback Location: got %q, want %q", got.Headers["Location"], want)
+		}
+		want := []*uapi.PerformSaveSSOAssociationRequest{{Namespace: "anamespace", Issuer: "anissuer", Subject: "asubject", Localpart: "alice"}}
+		if diff := cmp.Diff(want, userAPI.gotSaveSSOAssociation); diff != "" {
+			t.Errorf("PerformSaveSSOAssociation: +got -want:\n%s", diff)
+		}
+		if len(userAPI.gotAccountCreation) != 0 || len(userAPI.gotLoginTokenCreation) != 0 {
+			t.Errorf("expected linking not to register or log in, got %+v and %+v", userAPI.gotAccountCreation, userAPI.gotLoginTokenCreation)
+		}
+
+		// Link tokens can only be used once.
+		if got = redirectWith(links, linkToken, linkCookie); got.Code != http.StatusBadRequest {
+			t.Errorf("SSORedirect Code with a used link token: got %v, want %v", got.Code, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("already linked to the account", func(t *testing.T) {
+		links := newSSOLinkTokens()
+		userAPI := &fakeUserAPIForSSO{localpart: "alice"}
+
+		linkToken, linkCookie := startLink(t, links, alice)
+
+		got := linkWith(t, links, userAPI, linkToken, linkCookie)
+		if got.Code != http.StatusFound {
+			t.Fatalf("SSOCallback Code: got %v, want %v: %+v", got.Code, http.StatusFound, got.JSON)
+		}
+		if len(userAPI.gotSaveSSOAssociation) != 0 {
+			t.Errorf("expected no new association, got %+v", userAPI.gotSaveSSOAssociation)
+		}
+	})
+
+	t.Run("rejects an identity linked to another account", func(t *testing.T) {
+		links := newSSOLinkTokens()
+		userAPI := &fakeUserAPIForSSO{localpart: "bob"}
+
+		linkToken, linkCookie := startLink(t, links, alice)
+
+		got := linkWith(t, links, userAPI, linkToken, linkCookie)
+		if got.Code != http.StatusForbidden {
+			t.Fatalf("SSOCallback Code: got %v, want %v: %+v", got.Code, http.StatusForbidden, got.JSON)
+		}
+		if len(userAPI.gotSaveSSOAssociation) != 0 || len(userAPI.gotLoginTokenCreation) != 0 {
+			t.Errorf("expected no association or login, got %+v and %+v", userAPI.gotSaveSSOAssociation, userAPI.gotLoginTokenCreation)
+		}
+	})
+
+	t.Run("rejects link tokens without the link cookie", func(t *testing.T) {
+		links := newSSOLinkTokens()
+		userAPI := &fakeUserAPIForSSO{}
+		linkToken, linkCookie := startLink(t, links, alice)
+
+		if got := redirectWith(links, linkToken, nil); got.Code != http.StatusBadRequest {
+			t.Errorf("SSORedirect Code without the link cookie: got %v, want %v", got.Code, http.StatusBadRequest)
+		}
+		otherCookie := &http.Cookie{Name: ssoLinkCookie, Value: "anothervalue"}
+		if got := redirectWith(links, linkToken, otherCookie); got.Code != http.StatusBadRequest {
+			t.Errorf("SSORedirect Code with another link cookie: got %v, want %v", got.Code, http.StatusBadRequest)
+		}
+
+		// The callback checks the cookie too, in case the redirect was
+		// made by the user who started linking.
+		redirect := redirectWith(links, linkToken, linkCookie)
+		if redirect.Code != http.StatusFound {
+			t.Fatalf("SSORedirect Code: got %v, want %v", redirect.Code, http.StatusFound)
+		}
+		location, err := url.Parse(redirect.Headers["Location"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &http.Request{
+			Host:   "matrix.example.com",
+			URL:    &url.URL{Path: "/_matrix/v4/login/sso/callback", RawQuery: "provider=aprovider"},
+			Header: http.Header{},
+		}
+		req.AddCookie(&http.Cookie{Name: "sso_nonce", Value: location.Query().Get("nonce")})
+		if got := SSOCallback(req, userAPI, &auth, &cfg, "aservername", links); got.Code != http.StatusBadRequest {
+			t.Errorf("SSOCallback Code without the link cookie: got %v, want %v", got.Code, http.StatusBadRequest)
+		}
+		if len(userAPI.gotSaveSSOAssociation) != 0 || len(userAPI.gotLoginTokenCreation) != 0 {
+			t.Errorf("expected no association or login, got %+v and %+v", userAPI.gotSaveSSOAssociation, userAPI.gotLoginTokenCreation)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		if got := SSOLinkStart(&http.Request{URL: &url.URL{}}, alice, nil, "aservername"); got.Code != http.StatusNotFound {
+			t.Errorf("SSOLinkStart Code: got %v, want %v", got.Code, http.StatusNotFound)
+		}
+	})
+
+	t.Run("rejects accounts on other server names", func(t *testing.T) {
+		got := SSOLinkStart(&http.Request{URL: &url.URL{}}, &uapi.Device{UserID: "@alice:avirtualhost"}, newSSOLinkTokens(), "aservername")
+		if got.Code != http.StatusForbidden {
+			t.Errorf("SSOLinkStart Code: got %v, want %v", got.Code, http.StatusForbidden)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+type termsResponse struct {
+	// The policies in the same format as the m.login.terms registration stage
+	Policies interface{} `json:"policies"`
+	// The IDs of the policies the user has accepted the current version of
+	Accepted []string `json:"accepted"`
+}
+
+type acceptTermsRequest struct {
+	// The IDs of the policies which the user accepts the current version of
+	Accepts []string `json:"accepts"`
+}
+
+// queryAcceptedTerms returns the policy versions the user has accepted.
+func queryAcceptedTerms(req *http.Request, userAPI userapi.ClientUserAPI, device *userapi.Device) (map[string]string, error) {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		return nil, err
+	}
+	res := &userapi.QueryAcceptedTermsResponse{}
+	if err = userAPI.QueryAcceptedTerms(req.Context(), &userapi.QueryAcceptedTermsRequest{
+		Localpart:  localpart,
+		ServerName: domain,
+	}, res); err != nil {
+		return nil, err
+	}
+	return res.Policies, nil
+}
+
+// checkTermsAccepted returns an error response if terms enforcement is
+// enabled and the user has not accepted the current version of every policy.
+// Guests and application service users are not required to accept the terms.
+func checkTermsAccepted(
+	req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, device *userapi.Device,
+) *util.JSONResponse {
+	if !cfg.Terms.EnforceAcceptance || device.AccountType == userapi.AccountTypeGuest || device.AppserviceID != "" {
+		return nil
+	}
+	accepted, err := queryAcceptedTerms(req, userAPI, device)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAcceptedTerms failed")
+		res := jsonerror.InternalServerError()
+		return &res
+	}
+	if cfg.Terms.Accepted(accepted) {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.ConsentNotGiven("You must accept the current version of this server's policies before you can continue."),
+	}
+}
+
+// GetTerms returns the server's policies and which of them the user has
+// accepted the current version of.
+func GetTerms(
+	req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, device *userapi.Device,
+) util.JSONResponse {
+	accepted, err := queryAcceptedTerms(req, userAPI, device)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAcceptedTerms failed")
+		return jsonerror.InternalServerError()
+	}
+	res := termsResponse{
+		Policies: cfg.Terms.Params()["policies"],
+		Accepted: []string{},
+	}
+	for _, policy := range cfg.Terms.Policies {
+		if accepted[policy.ID] == policy.Version {
+			res.Accepted = append(res.Accepted, policy.ID)
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AcceptTerms records that the user accepts the current version of the
+// given policies.
+func AcceptTerms(
+	req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, device *userapi.Device,
+) util.JSONResponse {
+	var body acceptTermsRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	versions := cfg.Terms.Versions()
+	policies := make(map[string]string, len(body.Accepts))
+	for _, policyID := range body.Accepts {
+		version, ok := versions[policyID]
+		if !ok {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("unknown policy " + policyID),
+			}
+		}
+		policies[policyID] = version
+	}
+
+	localpart, domain, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = userAPI.PerformTermsAcceptance(req.Context(), &userapi.PerformTermsAcceptanceRequest{
+		Localpart:  localpart,
+		ServerName: domain,
+		Policies:   policies,
+	}, &struct{}{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformTermsAcceptance failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
@@ -0,0 +1,128 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/keyserver"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestTermsAcceptance(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+
+		base.Cfg.ClientAPI.RegistrationDisabled = false
+		base.Cfg.ClientAPI.Terms = config.Terms{
+			Policies: []config.TermsPolicy{
+				{
+					ID:      "privacy_policy",
+					Version: "1.0",
+					Languages: map[string]config.TermsPolicyLanguage{
+						"en": {Name: "Privacy Policy", URL: "https://example.com/privacy-en.html"},
+						"fr": {Name: "Politique de confidentialité", URL: "https://example.com/privacy-fr.html"},
+					},
+				},
+			},
+			EnforceAcceptance: true,
+		}
+		if err := base.Cfg.Derive(); err != nil {
+			t.Fatalf("failed to derive config: %s", err)
+		}
+		cfg := &base.Cfg.ClientAPI
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		keyAPI.SetUserAPI(userAPI)
+
+		// The first request should advertise the terms stage and the policies.
+		reg := registerRequest{Username: "terms", Password: "someRandomPassword"}
+		body := &bytes.Buffer{}
+		if err := json.NewEncoder(body).Encode(reg); err != nil {
+			t.Fatal(err)
+		}
+		resp := Register(httptest.NewRequest(http.MethodPost, "/", body), userAPI, cfg)
+		uia, ok := resp.JSON.(userInteractiveResponse)
+		if !ok {
+			t.Fatalf("expected a userInteractiveResponse, got %T: %+v", resp.JSON, resp.JSON)
+		}
+		if len(uia.Flows) != 1 || len(uia.Flows[0].Stages) != 1 || uia.Flows[0].Stages[0] != authtypes.LoginTypeTerms {
+			t.Fatalf("expected a single m.login.terms flow, got %+v", uia.Flows)
+		}
+		params, err := json.Marshal(uia.Params[authtypes.LoginTypeTerms])
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantParams := `{"policies":{"privacy_policy":{"en":{"name":"Privacy Policy","url":"https://example.com/privacy-en.html"},"fr":{"name":"Politique de confidentialité","url":"https://example.com/privacy-fr.html"},"version":"1.0"}}}`
+		if string(params) != wantParams {
+			t.Fatalf("unexpected m.login.terms params\n got: %s\nwant: %s", params, wantParams)
+		}
+
+		// Completing the terms stage should register the user and record the acceptance.
+		reg.Auth = authDict{Type: authtypes.LoginTypeTerms, Session: uia.Session}
+		if err = json.NewEncoder(body).Encode(reg); err != nil {
+			t.Fatal(err)
+		}
+		resp = Register(httptest.NewRequest(http.MethodPost, "/", body), userAPI, cfg)
+		rr, ok := resp.JSON.(registerResponse)
+		if !ok {
+			t.Fatalf("expected a registerResponse, got %T: %+v", resp.JSON, resp.JSON)
+		}
+		device := &uapi.Device{UserID: rr.UserID, AccountType: uapi.AccountTypeUser}
+
+		accepted := &uapi.QueryAcceptedTermsResponse{}
+		if err = userAPI.QueryAcceptedTerms(base.Context(), &uapi.QueryAcceptedTermsRequest{
+			Localpart: "terms", ServerName: base.Cfg.Global.ServerName,
+		}, accepted); err != nil {
+			t.Fatal(err)
+		}
+		if accepted.Policies["privacy_policy"] != "1.0" {
+			t.Fatalf("expected acceptance of privacy_policy 1.0 to be recorded, got %+v", accepted.Policies)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		if r := checkTermsAccepted(req, cfg, userAPI, device); r != nil {
+			t.Fatalf("expected user to be allowed after registration, got %+v", r)
+		}
+
+		// Bumping the version should block the user until they accept again.
+		cfg.Terms.Policies[0].Version = "2.0"
+		if r := checkTermsAccepted(req, cfg, userAPI, device); r == nil || r.Code != http.StatusForbidden {
+			t.Fatalf("expected user to be blocked after a version bump, got %+v", r)
+		}
+		guest := &uapi.Device{UserID: "@1:test", AccountType: uapi.AccountTypeGuest}
+		if r := checkTermsAccepted(req, cfg, userAPI, guest); r != nil {
+			t.Fatalf("expected guests not to be blocked, got %+v", r)
+		}
+
+		res := AcceptTerms(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"accepts":["unknown_policy"]}`)), cfg, userAPI, device)
+		if res.Code != http.StatusBadRequest {
+			t.Fatalf("expected HTTP %d for an unknown policy, got %d", http.StatusBadRequest, res.Code)
+		}
+		res = AcceptTerms(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"accepts":["privacy_policy"]}`)), cfg, userAPI, device)
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected HTTP %d, got %d: %+v", http.StatusOK, res.Code, res.JSON)
+		}
+		if r := checkTermsAccepted(req, cfg, userAPI, device); r != nil {
+			t.Fatalf("expected user to be allowed after accepting again, got %+v", r)
+		}
+
+		res = GetTerms(httptest.NewRequest(http.MethodGet, "/", nil), cfg, userAPI, device)
+		terms, ok := res.JSON.(termsResponse)
+		if !ok || len(terms.Accepted) != 1 || terms.Accepted[0] != "privacy_policy" {
+			t.Fatalf("expected privacy_policy to be accepted, got %+v", res.JSON)
+		}
+	})
+}
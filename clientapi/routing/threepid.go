@@ -100,7 +100,7 @@ func CheckAndSave3PIDAssociation(
 	}
 
 	// Check if the association has been validated
-	verified, address, medium, err := threepid.CheckAssociation(req.Context(), body.Creds, cfg)
+	verified, address, medium, validatedAt, err := threepid.CheckAssociation(req.Context(), body.Creds, cfg)
 	if err == threepid.ErrNotTrusted {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -143,10 +143,11 @@ func CheckAndSave3PIDAssociation(
 	}
 
 	if err = threePIDAPI.PerformSaveThreePIDAssociation(req.Context(), &api.PerformSaveThreePIDAssociationRequest{
-		ThreePID:   address,
-		Localpart:  localpart,
-		ServerName: domain,
-		Medium:     medium,
+		ThreePID:    address,
+		Localpart:   localpart,
+		ServerName:  domain,
+		Medium:      medium,
+		ValidatedAt: validatedAt,
 	}, &struct{}{}); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("threePIDAPI.PerformSaveThreePIDAssociation failed")
 		return jsonerror.InternalServerError()
@@ -184,20 +185,79 @@ func GetAssociated3PIDs(
 	}
 }
 
+type forget3PIDRequest struct {
+	IDServer string `json:"id_server"`
+	Medium   string `json:"medium"`
+	Address  string `json:"address"`
+}
+
+type forget3PIDResponse struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
 // Forget3PID implements POST /account/3pid/delete
-func Forget3PID(req *http.Request, threepidAPI api.ClientUserAPI) util.JSONResponse {
-	var body authtypes.ThreePID
+func Forget3PID(
+	req *http.Request, threepidAPI api.ClientUserAPI, device *api.Device,
+	cfg *config.ClientAPI,
+) util.JSONResponse {
+	var body forget3PIDRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
+	if body.Medium == "" || body.Address == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("medium and address must be supplied"),
+		}
+	}
+
+	localpart, domain, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
 
-	if err := threepidAPI.PerformForgetThreePID(req.Context(), &api.PerformForgetThreePIDRequest{}, &struct{}{}); err != nil {
+	// Only allow users to remove their own associations
+	res := &api.QueryLocalpartForThreePIDResponse{}
+	if err = threepidAPI.QueryLocalpartForThreePID(req.Context(), &api.QueryLocalpartForThreePIDRequest{
+		ThreePID: body.Address,
+		Medium:   body.Medium,
+	}, res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("threepidAPI.QueryLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.Localpart != localpart || res.ServerName != domain {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_NOT_FOUND",
+				Err:     "The third-party identifier is not associated with this account",
+			},
+		}
+	}
+
+	// Try to remove the association from the identity server too. This is
+	// best effort, as the identity server may be unreachable or not support
+	// unbinding, in which case we still remove the local association.
+	unbindResult := "no-support"
+	if body.IDServer != "" {
+		if err = threepid.UnbindAssociation(req.Context(), body.IDServer, device.UserID, body.Medium, body.Address, cfg); err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("id_server", body.IDServer).Warn("Failed to unbind 3PID from identity server")
+		} else {
+			unbindResult = "success"
+		}
+	}
+
+	if err = threepidAPI.PerformForgetThreePID(req.Context(), &api.PerformForgetThreePIDRequest{
+		ThreePID: body.Address,
+		Medium:   body.Medium,
+	}, &struct{}{}); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("threepidAPI.PerformForgetThreePID failed")
 		return jsonerror.InternalServerError()
 	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: forget3PIDResponse{IDServerUnbindResult: unbindResult},
 	}
 }
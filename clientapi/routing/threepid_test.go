@@ -0,0 +1,188 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/keyserver"
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/dendrite/userapi"
+	uapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestForget3PID(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		// Nothing listens here, so unbinding from the identity server fails.
+		base.Cfg.Global.TrustedIDServers = []string{"localhost:1"}
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		keyAPI.SetUserAPI(userAPI)
+
+		for _, u := range []*test.User{alice, bob} {
+			localpart, serverName, _ := gomatrixserverlib.SplitID('@', u.ID)
+			if err := userAPI.PerformSaveThreePIDAssociation(ctx, &uapi.PerformSaveThreePIDAssociationRequest{
+				ThreePID:   localpart + "@example.com",
+				Localpart:  localpart,
+				ServerName: serverName,
+				Medium:     "email",
+			}, &struct{}{}); err != nil {
+				t.Fatalf("failed to save 3PID association: %s", err)
+			}
+		}
+		aliceLocalpart, _, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		bobLocalpart, _, _ := gomatrixserverlib.SplitID('@', bob.ID)
+		device := &uapi.Device{UserID: alice.ID}
+
+		testCases := []struct {
+			name             string
+			body             string
+			wantCode         int
+			wantUnbindResult string
+		}{
+			{
+				name:     "missing address",
+				body:     `{"medium":"email"}`,
+				wantCode: http.StatusBadRequest,
+			},
+			{
+				name:     "cannot remove another user's 3PID",
+				body:     `{"medium":"email","address":"` + bobLocalpart + `@example.com"}`,
+				wantCode: http.StatusBadRequest,
+			},
+			{
+				name:             "unreachable identity server",
+				body:             `{"medium":"email","address":"` + aliceLocalpart + `@example.com","id_server":"localhost:1"}`,
+				wantCode:         http.StatusOK,
+				wantUnbindResult: "no-support",
+			},
+			{
+				name:     "already removed",
+				body:     `{"medium":"email","address":"` + aliceLocalpart + `@example.com"}`,
+				wantCode: http.StatusBadRequest,
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				req := httptest.NewRequest(http.MethodPost, "/_matrix/client/v3/account/3pid/delete", strings.NewReader(tc.body))
+				res := Forget3PID(req, userAPI, device, &base.Cfg.ClientAPI)
+				if res.Code != tc.wantCode {
+					t.Fatalf("expected HTTP %d, got %d: %+v", tc.wantCode, res.Code, res.JSON)
+				}
+				if tc.wantCode != http.StatusOK {
+					return
+				}
+				body, err := json.Marshal(res.JSON)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var forgetRes forget3PIDResponse
+				if err = json.Unmarshal(body, &forgetRes); err != nil {
+					t.Fatal(err)
+				}
+				if forgetRes.IDServerUnbindResult != tc.wantUnbindResult {
+					t.Fatalf("expected id_server_unbind_result %q, got %q", tc.wantUnbindResult, forgetRes.IDServerUnbindResult)
+				}
+			})
+		}
+
+		// Alice's association should be gone, but Bob's should not.
+		threePIDs := &uapi.QueryThreePIDsForLocalpartResponse{}
+		if err := userAPI.QueryThreePIDsForLocalpart(ctx, &uapi.QueryThreePIDsForLocalpartRequest{
+			Localpart: aliceLocalpart, ServerName: base.Cfg.Global.ServerName,
+		}, threePIDs); err != nil {
+			t.Fatal(err)
+		}
+		if len(threePIDs.ThreePIDs) != 0 {
+			t.Fatalf("expected alice to have no 3PIDs, got %+v", threePIDs.ThreePIDs)
+		}
+		if err := userAPI.QueryThreePIDsForLocalpart(ctx, &uapi.QueryThreePIDsForLocalpartRequest{
+			Localpart: bobLocalpart, ServerName: base.Cfg.Global.ServerName,
+		}, threePIDs); err != nil {
+			t.Fatal(err)
+		}
+		if len(threePIDs.ThreePIDs) != 1 {
+			t.Fatalf("expected bob to still have a 3PID, got %+v", threePIDs.ThreePIDs)
+		}
+	})
+}
+
+func TestGetAssociated3PIDs(t *testing.T) {
+	alice := test.NewUser(t)
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		keyAPI.SetUserAPI(userAPI)
+
+		localpart, serverName, _ := gomatrixserverlib.SplitID('@', alice.ID)
+		validatedAt := int64(gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour)))
+		before := int64(gomatrixserverlib.AsTimestamp(time.Now()))
+		if err := userAPI.PerformSaveThreePIDAssociation(ctx, &uapi.PerformSaveThreePIDAssociationRequest{
+			ThreePID:    "alice@example.com",
+			Localpart:   localpart,
+			ServerName:  serverName,
+			Medium:      "email",
+			ValidatedAt: validatedAt,
+		}, &struct{}{}); err != nil {
+			t.Fatalf("failed to save 3PID association: %s", err)
+		}
+		after := int64(gomatrixserverlib.AsTimestamp(time.Now()))
+
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/client/v3/account/3pid", nil)
+		res := GetAssociated3PIDs(req, userAPI, &uapi.Device{UserID: alice.ID})
+		if res.Code != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+		}
+		body, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var threePIDs struct {
+			ThreePIDs []struct {
+				Medium      string `json:"medium"`
+				Address     string `json:"address"`
+				AddedAt     int64  `json:"added_at"`
+				ValidatedAt int64  `json:"validated_at"`
+			} `json:"threepids"`
+		}
+		if err = json.Unmarshal(body, &threePIDs); err != nil {
+			t.Fatal(err)
+		}
+		if len(threePIDs.ThreePIDs) != 1 {
+			t.Fatalf("expected 1 3PID, got %s", body)
+		}
+		got := threePIDs.ThreePIDs[0]
+		if got.Medium != "email" || got.Address != "alice@example.com" {
+			t.Fatalf("unexpected 3PID %s", body)
+		}
+		if got.ValidatedAt != validatedAt {
+			t.Fatalf("expected validated_at %d, got %d", validatedAt, got.ValidatedAt)
+		}
+		if got.AddedAt < before || got.AddedAt > after {
+			t.Fatalf("expected added_at between %d and %d, got %d", before, after, got.AddedAt)
+		}
+	})
+}
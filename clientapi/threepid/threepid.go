@@ -23,10 +23,21 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/setup/config"
 )
 
+// httpClient is used for requests to identity servers which we make on
+// behalf of the homeserver.
+var httpClient = &http.Client{
+	Timeout: time.Second * 30,
+}
+
 // EmailAssociationRequest represents the request defined at https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-register-email-requesttoken
 type EmailAssociationRequest struct {
 	IDServer    string `json:"id_server"`
@@ -97,24 +108,25 @@ func CreateSession(
 // identity server.
 // Returns a boolean set to true if the association has been validated, false if not.
 // If the association has been validated, also returns the related third-party
-// identifier and its medium.
+// identifier, its medium and when it was validated, in milliseconds since the
+// epoch.
 // Returns an error if there was a problem sending the request or decoding the
 // response, or if the identity server responded with a non-OK status.
 func CheckAssociation(
 	ctx context.Context, creds Credentials, cfg *config.ClientAPI,
-) (bool, string, string, error) {
+) (bool, string, string, int64, error) {
 	if err := isTrusted(creds.IDServer, cfg); err != nil {
-		return false, "", "", err
+		return false, "", "", 0, err
 	}
 
 	requestURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/3pid/getValidated3pid?sid=%s&client_secret=%s", creds.IDServer, creds.SID, creds.Secret)
 	req, err := http.NewRequest(http.MethodGet, requestURL, nil)
 	if err != nil {
-		return false, "", "", err
+		return false, "", "", 0, err
 	}
 	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return false, "", "", err
+		return false, "", "", 0, err
 	}
 
 	var respBody struct {
@@ -126,16 +138,16 @@ func CheckAssociation(
 	}
 
 	if err = json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
-		return false, "", "", err
+		return false, "", "", 0, err
 	}
 
 	if respBody.ErrCode == "M_SESSION_NOT_VALIDATED" {
-		return false, "", "", nil
+		return false, "", "", 0, nil
 	} else if len(respBody.ErrCode) > 0 {
-		return false, "", "", errors.New(respBody.Error)
+		return false, "", "", 0, errors.New(respBody.Error)
 	}
 
-	return true, respBody.Address, respBody.Medium, nil
+	return true, respBody.Address, respBody.Medium, respBody.ValidatedAt, nil
 }
 
 // PublishAssociation publishes a validated association between a third-party
@@ -174,6 +186,90 @@ func PublishAssociation(creds Credentials, userID string, cfg *config.ClientAPI)
 	return nil
 }
 
+// UnbindAssociation asks an identity server to remove the association between
+// a third-party identifier and a Matrix ID. The request is signed with the
+// signing key of the user's server.
+// Returns an error if there was a problem sending the request, or if the
+// identity server responded with a non-OK status.
+func UnbindAssociation(
+	ctx context.Context, idServer, userID, medium, address string, cfg *config.ClientAPI,
+) error {
+	if err := isTrusted(idServer, cfg); err != nil {
+		return err
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+	identity, err := cfg.Matrix.SigningIdentityFor(domain)
+	if err != nil {
+		return err
+	}
+
+	fedReq := gomatrixserverlib.NewFederationRequest(
+		http.MethodPost, identity.ServerName, gomatrixserverlib.ServerName(idServer),
+		"/_matrix/identity/api/v1/3pid/unbind",
+	)
+	if err = fedReq.SetContent(map[string]interface{}{
+		"mxid": userID,
+		"threepid": map[string]string{
+			"medium":  medium,
+			"address": address,
+		},
+	}); err != nil {
+		return err
+	}
+	if err = fedReq.Sign(identity.ServerName, identity.KeyID, identity.PrivateKey); err != nil {
+		return err
+	}
+	request, err := fedReq.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	request.URL.Scheme = "https"
+
+	resp, err := httpClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	// Error if the status isn't OK
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not unbind the association on the server %s: HTTP %d", idServer, resp.StatusCode)
+	}
+
+	return nil
+}
+
+// UnbindAssociations tries to unbind each of the user's third-party identifiers
+// from the given identity server. If no identity server is given, we don't know
+// which one the identifier was bound with, so each of the trusted identity
+// servers is tried instead. Failures are logged rather than returned, as the
+// identity servers may be unreachable or not support unbinding.
+// Returns true if every identifier was unbound from at least one server.
+func UnbindAssociations(
+	ctx context.Context, idServer, userID string, threePIDs []authtypes.ThreePID, cfg *config.ClientAPI,
+) bool {
+	idServers := cfg.Matrix.TrustedIDServers
+	if idServer != "" {
+		idServers = []string{idServer}
+	}
+	allUnbound := true
+	for _, threePID := range threePIDs {
+		unbound := false
+		for _, server := range idServers {
+			if err := UnbindAssociation(ctx, server, userID, threePID.Medium, threePID.Address, cfg); err != nil {
+				util.GetLogger(ctx).WithError(err).WithField("id_server", server).Warn("Failed to unbind 3PID from identity server")
+				continue
+			}
+			unbound = true
+		}
+		allUnbound = allUnbound && unbound
+	}
+	return allUnbound
+}
+
 // isTrusted checks if a given identity server is part of the list of trusted
 // identity servers in the configuration file.
 // Returns an error if the server isn't trusted.
@@ -0,0 +1,178 @@
+package threepid
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestUnbindAssociation(t *testing.T) {
+	var gotPath, gotAuth string
+	var gotBody struct {
+		MXID     string            `json:"mxid"`
+		ThreePID map[string]string `json:"threepid"`
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&gotBody); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	oldClient := httpClient
+	httpClient = srv.Client()
+	defer func() { httpClient = oldClient }()
+
+	idServer := strings.TrimPrefix(srv.URL, "https://")
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			SigningIdentity: gomatrixserverlib.SigningIdentity{
+				ServerName: "test",
+				KeyID:      "ed25519:test",
+				PrivateKey: privateKey,
+			},
+			TrustedIDServers: []string{idServer},
+		},
+	}
+
+	if err := UnbindAssociation(context.Background(), "untrusted.server", "@alice:test", "email", "alice@example.com", cfg); err != ErrNotTrusted {
+		t.Fatalf("expected ErrNotTrusted for untrusted identity server, got %v", err)
+	}
+
+	if err := UnbindAssociation(context.Background(), idServer, "@alice:test", "email", "alice@example.com", cfg); err != nil {
+		t.Fatalf("failed to unbind association: %s", err)
+	}
+	if gotPath != "/_matrix/identity/api/v1/3pid/unbind" {
+		t.Fatalf("unexpected request path %q", gotPath)
+	}
+	if !strings.HasPrefix(gotAuth, "X-Matrix origin=") {
+		t.Fatalf("expected request to be signed, got Authorization %q", gotAuth)
+	}
+	if gotBody.MXID != "@alice:test" || gotBody.ThreePID["medium"] != "email" || gotBody.ThreePID["address"] != "alice@example.com" {
+		t.Fatalf("unexpected request body %+v", gotBody)
+	}
+}
+
+func TestUnbindAssociations(t *testing.T) {
+	var mu sync.Mutex
+	unbinds := map[string][]string{}
+	// The identity server refuses to unbind addresses at bad.example.com.
+	newIDServer := func() (*httptest.Server, string) {
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body struct {
+				ThreePID map[string]string `json:"threepid"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			unbinds[r.Host] = append(unbinds[r.Host], body.ThreePID["address"])
+			mu.Unlock()
+			if strings.HasSuffix(body.ThreePID["address"], "@bad.example.com") {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_, _ = w.Write([]byte("{}"))
+		}))
+		return srv, strings.TrimPrefix(srv.URL, "https://")
+	}
+	srv1, idServer1 := newIDServer()
+	defer srv1.Close()
+	srv2, idServer2 := newIDServer()
+	defer srv2.Close()
+
+	// Both servers use the same test certificate, so either client trusts both.
+	oldClient := httpClient
+	httpClient = srv1.Client()
+	defer func() { httpClient = oldClient }()
+
+	_, privateKey, _ := ed25519.GenerateKey(nil)
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			SigningIdentity: gomatrixserverlib.SigningIdentity{
+				ServerName: "test",
+				KeyID:      "ed25519:test",
+				PrivateKey: privateKey,
+			},
+			TrustedIDServers: []string{idServer1, idServer2},
+		},
+	}
+	threePIDs := []authtypes.ThreePID{
+		{Medium: "email", Address: "alice@example.com"},
+		{Medium: "msisdn", Address: "441234567890"},
+	}
+
+	tests := []struct {
+		name        string
+		idServer    string
+		threePIDs   []authtypes.ThreePID
+		wantUnbinds map[string][]string
+		wantResult  bool
+	}{
+		{
+			name:      "unbinds each 3PID from the given identity server",
+			idServer:  idServer2,
+			threePIDs: threePIDs,
+			wantUnbinds: map[string][]string{
+				idServer2: {"alice@example.com", "441234567890"},
+			},
+			wantResult: true,
+		},
+		{
+			name:      "unbinds each 3PID from all trusted identity servers",
+			threePIDs: threePIDs,
+			wantUnbinds: map[string][]string{
+				idServer1: {"alice@example.com", "441234567890"},
+				idServer2: {"alice@example.com", "441234567890"},
+			},
+			wantResult: true,
+		},
+		{
+			name:     "keeps going when unbinding fails",
+			idServer: idServer1,
+			threePIDs: []authtypes.ThreePID{
+				{Medium: "email", Address: "alice@bad.example.com"},
+				{Medium: "email", Address: "alice@example.com"},
+			},
+			wantUnbinds: map[string][]string{
+				idServer1: {"alice@bad.example.com", "alice@example.com"},
+			},
+			wantResult: false,
+		},
+		{
+			name:        "untrusted identity server",
+			idServer:    "untrusted.server",
+			threePIDs:   threePIDs,
+			wantUnbinds: map[string][]string{},
+			wantResult:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unbinds = map[string][]string{}
+			if got := UnbindAssociations(context.Background(), tt.idServer, "@alice:test", tt.threePIDs, cfg); got != tt.wantResult {
+				t.Fatalf("expected result %v, got %v", tt.wantResult, got)
+			}
+			if !reflect.DeepEqual(unbinds, tt.wantUnbinds) {
+				t.Fatalf("expected unbinds %v, got %v", tt.wantUnbinds, unbinds)
+			}
+		})
+	}
+}
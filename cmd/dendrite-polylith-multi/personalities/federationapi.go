@@ -16,6 +16,7 @@ package personalities
 
 import (
 	"github.com/matrix-org/dendrite/federationapi"
+	"github.com/matrix-org/dendrite/relayapi"
 	basepkg "github.com/matrix-org/dendrite/setup/base"
 	"github.com/matrix-org/dendrite/setup/config"
 )
@@ -33,6 +34,7 @@ func FederationAPI(base *basepkg.BaseDendrite, cfg *config.Dendrite) {
 		userAPI, federation, keyRing,
 		rsAPI, fsAPI, keyAPI, nil,
 	)
+	relayapi.AddPublicRoutes(base, keyRing)
 
 	federationapi.AddInternalRoutes(base.InternalAPIMux, fsAPI, base.EnableMetrics)
 
@@ -29,6 +29,7 @@ func SyncAPI(base *basepkg.BaseDendrite, cfg *config.Dendrite) {
 		base,
 		userAPI, rsAPI,
 		base.KeyServerHTTPClient(),
+		base.FederationAPIHTTPClient(),
 	)
 
 	base.SetupAndServeHTTP(
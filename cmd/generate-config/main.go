@@ -88,6 +88,8 @@ func buildConfig(fs *flag.FlagSet, args []string) (*config.Dendrite, error) {
 		if *defaultsForCI {
 			cfg.AppServiceAPI.DisableTLSValidation = true
 			cfg.ClientAPI.RateLimiting.Enabled = false
+			cfg.ClientAPI.KeyUploads.DeviceKeys.Enabled = false
+			cfg.ClientAPI.KeyUploads.OneTimeKeys.Enabled = false
 			cfg.ClientAPI.Login.SSO.Enabled = true
 			cfg.ClientAPI.Login.SSO.Providers = []config.IdentityProvider{
 				{
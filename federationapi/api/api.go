@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/matrix-org/gomatrix"
@@ -44,6 +45,18 @@ type ClientFederationAPI interface {
 	// containing only the server names (without information for membership events).
 	// The response will include this server if they are joined to the room.
 	QueryJoinedHostServerNamesInRoom(ctx context.Context, request *QueryJoinedHostServerNamesInRoomRequest, response *QueryJoinedHostServerNamesInRoomResponse) error
+	// Query the status of outbound federation to a server, e.g. whether it is
+	// backed off or its circuit breaker is open.
+	QueryServerStatus(ctx context.Context, request *QueryServerStatusRequest, response *QueryServerStatusResponse) error
+}
+
+// SyncFederationAPI is the subset of the federation API which the sync API
+// uses to fetch events which it doesn't have from other servers in the room.
+type SyncFederationAPI interface {
+	KeyRing() *gomatrixserverlib.KeyRing
+	// Query the server names of the joined hosts in a room.
+	QueryJoinedHostServerNamesInRoom(ctx context.Context, request *QueryJoinedHostServerNamesInRoomRequest, response *QueryJoinedHostServerNamesInRoomResponse) error
+	GetEvent(ctx context.Context, origin, s gomatrixserverlib.ServerName, eventID string) (res gomatrixserverlib.Transaction, err error)
 }
 
 type RoomserverFederationAPI interface {
@@ -108,6 +121,10 @@ type FederationClient interface {
 	LookupState(ctx context.Context, origin, s gomatrixserverlib.ServerName, roomID string, eventID string, roomVersion gomatrixserverlib.RoomVersion) (res gomatrixserverlib.RespState, err error)
 	LookupStateIDs(ctx context.Context, origin, s gomatrixserverlib.ServerName, roomID string, eventID string) (res gomatrixserverlib.RespStateIDs, err error)
 	LookupMissingEvents(ctx context.Context, origin, s gomatrixserverlib.ServerName, roomID string, missing gomatrixserverlib.MissingEvents, roomVersion gomatrixserverlib.RoomVersion) (res gomatrixserverlib.RespMissingEvents, err error)
+
+	// DoRequestAndParseResponse sends a federation request which has already
+	// been signed, for endpoints which gomatrixserverlib doesn't support yet.
+	DoRequestAndParseResponse(ctx context.Context, req *http.Request, result interface{}) error
 }
 
 // FederationClientError is returned from FederationClient methods in the event of a problem.
@@ -214,6 +231,29 @@ type QueryJoinedHostServerNamesInRoomResponse struct {
 	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
 }
 
+// QueryServerStatusRequest is a request to QueryServerStatus
+type QueryServerStatusRequest struct {
+	ServerName gomatrixserverlib.ServerName `json:"server_name"`
+}
+
+// QueryServerStatusResponse is a response to QueryServerStatus
+type QueryServerStatusResponse struct {
+	Blacklisted bool `json:"blacklisted"`
+	// When the current or previous backoff ends, if there has been one.
+	BackoffUntil   gomatrixserverlib.Timestamp `json:"backoff_until_ts,omitempty"`
+	CircuitBreaker CircuitBreakerStatus        `json:"circuit_breaker"`
+}
+
+// CircuitBreakerStatus is the status of the circuit breaker of a server.
+type CircuitBreakerStatus struct {
+	Enabled bool `json:"enabled"`
+	// "closed", "open" or "half_open"
+	State               string `json:"state"`
+	ConsecutiveFailures uint32 `json:"consecutive_failures"`
+	// When an open circuit breaker half-opens.
+	OpenUntil gomatrixserverlib.Timestamp `json:"open_until_ts,omitempty"`
+}
+
 type PerformBroadcastEDURequest struct {
 }
 
@@ -114,6 +114,10 @@ func NewInternalAPI(
 	}
 
 	stats := statistics.NewStatistics(federationDB, cfg.FederationMaxRetries+1)
+	if cfg.CircuitBreaker.Enabled {
+		stats.CircuitBreakerThreshold = cfg.CircuitBreaker.FailureThreshold
+		stats.CircuitBreakerOpenDuration = cfg.CircuitBreaker.OpenDuration
+	}
 
 	js, nats := base.NATS.Prepare(base.ProcessContext, &cfg.Matrix.JetStream)
 
@@ -123,7 +127,7 @@ func NewInternalAPI(
 		federationDB, base.ProcessContext,
 		cfg.Matrix.DisableFederation,
 		cfg.Matrix.ServerName, federation, rsAPI, &stats,
-		signingInfo,
+		signingInfo, cfg.EDUFilters,
 	)
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
@@ -175,5 +179,13 @@ func NewInternalAPI(
 	}
 	time.AfterFunc(time.Minute, cleanExpiredEDUs)
 
-	return internal.NewFederationInternalAPI(federationDB, cfg, rsAPI, federation, &stats, caches, queues, keyRing)
+	fsAPI := internal.NewFederationInternalAPI(federationDB, cfg, rsAPI, federation, &stats, caches, queues, keyRing)
+	if cfg.CatchUp.Enabled {
+		// Give the other components a chance to start up first, as the
+		// roomserver needs the federation API to fetch missing events.
+		time.AfterFunc(time.Minute, func() {
+			fsAPI.CatchUp(base.Context())
+		})
+	}
+	return fsAPI
 }
@@ -13,6 +13,7 @@ import (
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/matrix-org/dendrite/federationapi"
 	"github.com/matrix-org/dendrite/federationapi/api"
@@ -342,3 +343,99 @@ func TestRoomsV3URLEscapeDoNot404(t *testing.T) {
 		}
 	}
 }
+
+// blockingJoinClient blocks every make_join until it is released, so that
+// joins stay in progress for as long as the test needs.
+type blockingJoinClient struct {
+	api.FederationClient
+	entered chan string
+	release chan struct{}
+}
+
+func (f *blockingJoinClient) MakeJoin(ctx context.Context, origin, s gomatrixserverlib.ServerName, roomID, userID string, roomVersions []gomatrixserverlib.RoomVersion) (res gomatrixserverlib.RespMakeJoin, err error) {
+	f.entered <- roomID
+	<-f.release
+	return res, fmt.Errorf("not joining")
+}
+
+func federatedJoinsInFlight(t *testing.T) float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "dendrite_federationapi_federated_joins_in_flight" {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("federated joins metric not found")
+	return 0
+}
+
+func TestFederationAPIMaxConcurrentJoins(t *testing.T) {
+	for _, queue := range []bool{false, true} {
+		t.Run(fmt.Sprintf("queue=%v", queue), func(t *testing.T) {
+			base, baseClose := testrig.CreateBaseDendrite(t, test.DBTypeSQLite)
+			defer baseClose()
+			base.Cfg.FederationAPI.MaxConcurrentJoins = 1
+			base.Cfg.FederationAPI.QueueExcessJoins = queue
+
+			fc := &blockingJoinClient{entered: make(chan string), release: make(chan struct{})}
+			fsapi := federationapi.NewInternalAPI(base, fc, &fedRoomserverAPI{}, base.Caches, nil, true)
+			user := test.NewUser(t)
+			join := func(roomID string, serverName gomatrixserverlib.ServerName) *api.PerformJoinResponse {
+				res := &api.PerformJoinResponse{}
+				fsapi.PerformJoin(context.Background(), &api.PerformJoinRequest{
+					RoomID:      roomID,
+					UserID:      user.ID,
+					ServerNames: []gomatrixserverlib.ServerName{serverName},
+				}, res)
+				return res
+			}
+
+			firstDone := make(chan struct{})
+			go func() {
+				join("!first:server.a", "server.a")
+				close(firstDone)
+			}()
+			if roomID := <-fc.entered; roomID != "!first:server.a" {
+				t.Fatalf("unexpected join to %s", roomID)
+			}
+			if inFlight := federatedJoinsInFlight(t); inFlight != 1 {
+				t.Fatalf("expected 1 join in flight, got %v", inFlight)
+			}
+
+			if !queue {
+				res := join("!second:server.b", "server.b")
+				if res.LastError == nil || res.LastError.Code != 429 || !strings.Contains(res.LastError.Message, "M_LIMIT_EXCEEDED") {
+					t.Fatalf("expected the second join to be rejected, got %+v", res.LastError)
+				}
+				fc.release <- struct{}{}
+				<-firstDone
+				return
+			}
+
+			secondDone := make(chan struct{})
+			go func() {
+				join("!second:server.b", "server.b")
+				close(secondDone)
+			}()
+			select {
+			case roomID := <-fc.entered:
+				t.Fatalf("join to %s started before the first join finished", roomID)
+			case <-time.After(100 * time.Millisecond):
+			}
+			fc.release <- struct{}{}
+			<-firstDone
+			if roomID := <-fc.entered; roomID != "!second:server.b" {
+				t.Fatalf("unexpected join to %s", roomID)
+			}
+			fc.release <- struct{}{}
+			<-secondDone
+			if inFlight := federatedJoinsInFlight(t); inFlight != 0 {
+				t.Fatalf("expected no joins in flight, got %v", inFlight)
+			}
+		})
+	}
+}
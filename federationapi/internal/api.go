@@ -29,7 +29,8 @@ type FederationInternalAPI struct {
 	federation api.FederationClient
 	keyRing    *gomatrixserverlib.KeyRing
 	queues     *queue.OutgoingQueues
-	joins      sync.Map // joins currently in progress
+	joins      sync.Map      // joins currently in progress
+	joinSlots  chan struct{} // limits concurrent joins, nil if unlimited
 }
 
 func NewFederationInternalAPI(
@@ -49,15 +50,15 @@ func NewFederationInternalAPI(
 	if keyRing == nil {
 		keyRing = &gomatrixserverlib.KeyRing{
 			KeyFetchers: []gomatrixserverlib.KeyFetcher{},
-			KeyDatabase: serverKeyDB,
 		}
+		keyRing.KeyDatabase = newRefreshingKeyDatabase(serverKeyDB, keyRing, cfg.KeyFetching.RefreshBeforeExpiry)
 
 		addDirectFetcher := func() {
 			keyRing.KeyFetchers = append(
 				keyRing.KeyFetchers,
-				&gomatrixserverlib.DirectKeyFetcher{
+				newFailureCachingKeyFetcher(&gomatrixserverlib.DirectKeyFetcher{
 					Client: federation,
-				},
+				}, cfg.KeyFetching.FailureCacheDuration),
 			)
 		}
 
@@ -87,7 +88,7 @@ func NewFederationInternalAPI(
 				perspective.PerspectiveServerKeys[key.KeyID] = rawkey
 			}
 
-			keyRing.KeyFetchers = append(keyRing.KeyFetchers, perspective)
+			keyRing.KeyFetchers = append(keyRing.KeyFetchers, newFailureCachingKeyFetcher(perspective, cfg.KeyFetching.FailureCacheDuration))
 
 			logrus.WithFields(logrus.Fields{
 				"server_name":     ps.ServerName,
@@ -96,6 +97,11 @@ func NewFederationInternalAPI(
 		}
 	}
 
+	var joinSlots chan struct{}
+	if cfg.MaxConcurrentJoins > 0 {
+		joinSlots = make(chan struct{}, cfg.MaxConcurrentJoins)
+	}
+
 	return &FederationInternalAPI{
 		db:         db,
 		cfg:        cfg,
@@ -104,6 +110,7 @@ func NewFederationInternalAPI(
 		federation: federation,
 		statistics: statistics,
 		queues:     queues,
+		joinSlots:  joinSlots,
 	}
 }
 
@@ -125,21 +132,55 @@ func (a *FederationInternalAPI) isBlacklistedOrBackingOff(s gomatrixserverlib.Se
 	return stats, nil
 }
 
-func failBlacklistableError(err error, stats *statistics.ServerStatistics) (until time.Time, blacklisted bool) {
+// isServerFailure returns whether the error shows that the remote server
+// failed to handle the request, rather than that it rejected the request.
+func isServerFailure(err error) bool {
 	if err == nil {
-		return
+		return false
 	}
 	mxerr, ok := err.(gomatrix.HTTPError)
 	if !ok {
-		return stats.Failure()
+		return true
 	}
 	if mxerr.Code == 401 { // invalid signature in X-Matrix header
-		return stats.Failure()
+		return true
 	}
 	if mxerr.Code >= 500 && mxerr.Code < 600 { // internal server errors
-		return stats.Failure()
+		return true
+	}
+	return false
+}
+
+func failBlacklistableError(err error, stats *statistics.ServerStatistics) (until time.Time, blacklisted bool) {
+	if !isServerFailure(err) {
+		return
+	}
+	return stats.Failure()
+}
+
+// allowedByCircuitBreaker returns an error if the circuit breaker for the
+// server is open, in which case the request must not be sent. Otherwise, the
+// outcome of the request must be reported with reportToCircuitBreaker.
+func allowedByCircuitBreaker(s gomatrixserverlib.ServerName, breaker *statistics.CircuitBreaker) error {
+	if breaker.Allow() {
+		return nil
+	}
+	var retryAfter time.Duration
+	if _, _, openUntil := breaker.Status(); openUntil != nil {
+		retryAfter = time.Until(*openUntil)
+	}
+	return &api.FederationClientError{
+		Err:        fmt.Sprintf("circuit breaker for server %q is open", s),
+		RetryAfter: retryAfter,
+	}
+}
+
+func reportToCircuitBreaker(breaker *statistics.CircuitBreaker, err error) {
+	if isServerFailure(err) {
+		breaker.Failure()
+	} else {
+		breaker.Success()
 	}
-	return
 }
 
 func (a *FederationInternalAPI) doRequestIfNotBackingOffOrBlacklisted(
@@ -149,7 +190,12 @@ func (a *FederationInternalAPI) doRequestIfNotBackingOffOrBlacklisted(
 	if err != nil {
 		return nil, err
 	}
+	breaker := stats.CircuitBreaker()
+	if err = allowedByCircuitBreaker(s, breaker); err != nil {
+		return nil, err
+	}
 	res, err := request()
+	reportToCircuitBreaker(breaker, err)
 	if err != nil {
 		until, blacklisted := failBlacklistableError(err, stats)
 		now := time.Now()
@@ -177,5 +223,11 @@ func (a *FederationInternalAPI) doRequestIfNotBlacklisted(
 			Blacklisted: true,
 		}
 	}
-	return request()
+	breaker := stats.CircuitBreaker()
+	if err := allowedByCircuitBreaker(s, breaker); err != nil {
+		return nil, err
+	}
+	res, err := request()
+	reportToCircuitBreaker(breaker, err)
+	return res, err
 }
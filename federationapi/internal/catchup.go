@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// CatchUp looks for events which were sent in joined rooms while we weren't
+// running, by asking other servers in each room for their latest events. Any
+// which we don't have are sent to the roomserver as new events, which makes it
+// fetch the missing events between them and what we already have. Rooms are
+// caught up on one at a time, waiting between them as configured, until all
+// are done or the context is cancelled.
+func (a *FederationInternalAPI) CatchUp(ctx context.Context) {
+	roomIDs, err := a.db.GetJoinedRooms(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get joined rooms to catch up on")
+		return
+	}
+	if max := a.cfg.CatchUp.MaxRooms; max > 0 && len(roomIDs) > max {
+		roomIDs = roomIDs[:max]
+	}
+	logrus.Infof("Catching up on missed events in %d rooms", len(roomIDs))
+	for i, roomID := range roomIDs {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(a.cfg.CatchUp.Interval):
+			}
+		}
+		if err = a.catchUpRoom(ctx, roomID); err != nil {
+			logrus.WithError(err).WithField("room_id", roomID).Warn("Failed to catch up on missed events")
+		}
+	}
+}
+
+// catchUpRoom asks other servers in the room for their latest event, on behalf
+// of the server name of one of our joined users, and sends any which we don't
+// already have to the roomserver.
+func (a *FederationInternalAPI) catchUpRoom(ctx context.Context, roomID string) error {
+	var membershipRes roomserverAPI.QueryMembershipsForRoomResponse
+	if err := a.rsAPI.QueryMembershipsForRoom(ctx, &roomserverAPI.QueryMembershipsForRoomRequest{
+		RoomID:     roomID,
+		JoinedOnly: true,
+		LocalOnly:  true,
+	}, &membershipRes); err != nil {
+		return fmt.Errorf("a.rsAPI.QueryMembershipsForRoom: %w", err)
+	}
+	if len(membershipRes.JoinEvents) == 0 || membershipRes.JoinEvents[0].StateKey == nil {
+		return nil
+	}
+	userID := *membershipRes.JoinEvents[0].StateKey
+	_, origin, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return err
+	}
+
+	var versionRes roomserverAPI.QueryRoomVersionForRoomResponse
+	if err = a.rsAPI.QueryRoomVersionForRoom(ctx, &roomserverAPI.QueryRoomVersionForRoomRequest{
+		RoomID: roomID,
+	}, &versionRes); err != nil {
+		return fmt.Errorf("a.rsAPI.QueryRoomVersionForRoom: %w", err)
+	}
+
+	joinedHosts, err := a.db.GetJoinedHosts(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("a.db.GetJoinedHosts: %w", err)
+	}
+	servers := make([]gomatrixserverlib.ServerName, 0, a.cfg.CatchUp.MaxServersPerRoom)
+	seen := map[gomatrixserverlib.ServerName]struct{}{}
+	for _, host := range joinedHosts {
+		if len(servers) == a.cfg.CatchUp.MaxServersPerRoom {
+			break
+		}
+		if _, ok := seen[host.ServerName]; ok || a.cfg.Matrix.IsLocalServerName(host.ServerName) {
+			continue
+		}
+		seen[host.ServerName] = struct{}{}
+		if _, err = a.isBlacklistedOrBackingOff(host.ServerName); err != nil {
+			continue
+		}
+		servers = append(servers, host.ServerName)
+	}
+
+	for _, server := range servers {
+		latest, err := a.latestEventID(ctx, origin, server, roomID)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"room_id": roomID,
+				"server":  server,
+			}).Debug("Failed to get latest event")
+			continue
+		}
+		missing, err := a.unknownEventIDs(ctx, []string{latest})
+		if err != nil {
+			return err
+		}
+		events := make([]*gomatrixserverlib.HeaderedEvent, 0, len(missing))
+		for _, eventID := range missing {
+			event, err := a.fetchEvent(ctx, origin, server, eventID, versionRes.RoomVersion)
+			if err != nil {
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"room_id":  roomID,
+					"server":   server,
+					"event_id": eventID,
+				}).Debug("Failed to fetch latest event")
+				continue
+			}
+			if event.RoomID() != roomID {
+				continue
+			}
+			events = append(events, event.Headered(versionRes.RoomVersion))
+		}
+		if len(events) == 0 {
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"room_id": roomID,
+			"server":  server,
+		}).Infof("Catching up on %d missed latest events", len(events))
+		if err = roomserverAPI.SendEvents(
+			ctx, a.rsAPI, roomserverAPI.KindNew, events,
+			origin, server, roomserverAPI.DoNotSendToOtherServers, nil, false,
+		); err != nil {
+			return fmt.Errorf("roomserverAPI.SendEvents: %w", err)
+		}
+	}
+	return nil
+}
+
+// latestEventID returns the ID of the latest event in the room according to
+// the given server, using the timestamp_to_event endpoint. Unlike make_join,
+// this is a plain query, so it's sent directly rather than through the
+// backoff tracking: a server which doesn't support the endpoint yet shouldn't
+// be backed off from for it.
+func (a *FederationInternalAPI) latestEventID(
+	ctx context.Context, origin, s gomatrixserverlib.ServerName, roomID string,
+) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	identity, err := a.cfg.Matrix.SigningIdentityFor(origin)
+	if err != nil {
+		return "", err
+	}
+	fedReq := gomatrixserverlib.NewFederationRequest(
+		http.MethodGet, identity.ServerName, s,
+		"/_matrix/federation/v1/timestamp_to_event/"+url.PathEscape(roomID)+
+			"?dir=b&ts="+strconv.FormatInt(int64(gomatrixserverlib.AsTimestamp(time.Now())), 10),
+	)
+	if err = fedReq.Sign(identity.ServerName, identity.KeyID, identity.PrivateKey); err != nil {
+		return "", err
+	}
+	req, err := fedReq.HTTPRequest()
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		EventID string `json:"event_id"`
+	}
+	if err = a.federation.DoRequestAndParseResponse(ctx, req, &res); err != nil {
+		return "", err
+	}
+	if res.EventID == "" {
+		return "", fmt.Errorf("no event_id in timestamp_to_event response")
+	}
+	return res.EventID, nil
+}
+
+// unknownEventIDs returns the event IDs which the roomserver doesn't have.
+func (a *FederationInternalAPI) unknownEventIDs(ctx context.Context, eventIDs []string) ([]string, error) {
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	var res roomserverAPI.QueryEventsByIDResponse
+	if err := a.rsAPI.QueryEventsByID(ctx, &roomserverAPI.QueryEventsByIDRequest{
+		EventIDs: eventIDs,
+	}, &res); err != nil {
+		return nil, fmt.Errorf("a.rsAPI.QueryEventsByID: %w", err)
+	}
+	known := make(map[string]struct{}, len(res.Events))
+	for _, event := range res.Events {
+		known[event.EventID()] = struct{}{}
+	}
+	var unknown []string
+	for _, eventID := range eventIDs {
+		if _, ok := known[eventID]; !ok {
+			unknown = append(unknown, eventID)
+		}
+	}
+	return unknown, nil
+}
+
+// fetchEvent fetches an event from the given server and checks its signatures.
+func (a *FederationInternalAPI) fetchEvent(
+	ctx context.Context, origin, s gomatrixserverlib.ServerName,
+	eventID string, roomVersion gomatrixserverlib.RoomVersion,
+) (*gomatrixserverlib.Event, error) {
+	txn, err := a.GetEvent(ctx, origin, s, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if len(txn.PDUs) != 1 {
+		return nil, fmt.Errorf("expected 1 event, got %d", len(txn.PDUs))
+	}
+	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(txn.PDUs[0], roomVersion)
+	if err != nil {
+		return nil, err
+	}
+	if event.EventID() != eventID {
+		return nil, fmt.Errorf("expected event %q, got %q", eventID, event.EventID())
+	}
+	if err = event.VerifyEventSignatures(ctx, a.keyRing); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/federationapi/statistics"
+	"github.com/matrix-org/dendrite/federationapi/storage"
+	"github.com/matrix-org/dendrite/federationapi/types"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+)
+
+type catchUpRoomserverAPI struct {
+	roomserverAPI.FederationRoomserverAPI
+	room   *test.Room
+	joined string
+	known  map[string]*gomatrixserverlib.HeaderedEvent
+	inputs []roomserverAPI.InputRoomEvent
+}
+
+func (r *catchUpRoomserverAPI) QueryMembershipsForRoom(_ context.Context, req *roomserverAPI.QueryMembershipsForRoomRequest, res *roomserverAPI.QueryMembershipsForRoomResponse) error {
+	if req.RoomID == r.room.ID && req.JoinedOnly && req.LocalOnly {
+		res.JoinEvents = []gomatrixserverlib.ClientEvent{{StateKey: &r.joined}}
+	}
+	return nil
+}
+
+func (r *catchUpRoomserverAPI) QueryRoomVersionForRoom(_ context.Context, _ *roomserverAPI.QueryRoomVersionForRoomRequest, res *roomserverAPI.QueryRoomVersionForRoomResponse) error {
+	res.RoomVersion = r.room.Version
+	return nil
+}
+
+func (r *catchUpRoomserverAPI) QueryEventsByID(_ context.Context, req *roomserverAPI.QueryEventsByIDRequest, res *roomserverAPI.QueryEventsByIDResponse) error {
+	for _, eventID := range req.EventIDs {
+		if ev, ok := r.known[eventID]; ok {
+			res.Events = append(res.Events, ev)
+		}
+	}
+	return nil
+}
+
+// InputRoomEvents accepts new events as the real roomserver would once it has
+// fetched the missing events before them from the origin.
+func (r *catchUpRoomserverAPI) InputRoomEvents(_ context.Context, req *roomserverAPI.InputRoomEventsRequest, _ *roomserverAPI.InputRoomEventsResponse) error {
+	r.inputs = append(r.inputs, req.InputRoomEvents...)
+	for _, ev := range r.room.Events() {
+		r.known[ev.EventID()] = ev
+	}
+	return nil
+}
+
+type catchUpFedClient struct {
+	api.FederationClient
+	sync.Mutex
+	roomID   string
+	latest   map[gomatrixserverlib.ServerName]string
+	events   map[string]*gomatrixserverlib.HeaderedEvent
+	requests map[gomatrixserverlib.ServerName]int
+}
+
+func (f *catchUpFedClient) DoRequestAndParseResponse(_ context.Context, req *http.Request, result interface{}) error {
+	f.Lock()
+	defer f.Unlock()
+	s := gomatrixserverlib.ServerName(req.URL.Host)
+	f.requests[s]++
+	latest, ok := f.latest[s]
+	if !ok {
+		return fmt.Errorf("unexpected request to %s", s)
+	}
+	if req.Method != http.MethodGet || req.URL.Path != "/_matrix/federation/v1/timestamp_to_event/"+f.roomID || req.URL.Query().Get("dir") != "b" {
+		return fmt.Errorf("unexpected request %s %s", req.Method, req.URL)
+	}
+	return json.Unmarshal([]byte(fmt.Sprintf(`{"event_id":%q,"origin_server_ts":0}`, latest)), result)
+}
+
+func (f *catchUpFedClient) GetEvent(_ context.Context, _, _ gomatrixserverlib.ServerName, eventID string) (res gomatrixserverlib.Transaction, err error) {
+	ev, ok := f.events[eventID]
+	if !ok {
+		return res, fmt.Errorf("unknown event %s", eventID)
+	}
+	res.PDUs = []json.RawMessage{ev.JSON()}
+	return res, nil
+}
+
+func TestCatchUp(t *testing.T) {
+	remoteKeyID := gomatrixserverlib.KeyID("ed25519:remote")
+	remote := test.NewUser(t, test.WithSigningServer("remote", remoteKeyID, test.PrivateKeyA))
+	local := test.NewUser(t)
+	room := test.NewRoom(t, remote)
+	room.CreateAndInsert(t, local, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(local.ID))
+
+	// Everything so far was received before going offline, and the rest is
+	// only known to the remote server.
+	known := map[string]*gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range room.Events() {
+		known[ev.EventID()] = ev
+	}
+	lastKnown := room.Events()[len(room.Events())-1].EventID()
+	for i := 0; i < 3; i++ {
+		room.CreateAndInsert(t, remote, "m.room.message", map[string]interface{}{
+			"body": fmt.Sprintf("missed %d", i),
+		})
+	}
+	latest := room.Events()[len(room.Events())-1]
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		b, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		connStr, dbClose := test.PrepareDBConnectionString(t, dbType)
+		defer dbClose()
+		db, err := storage.NewDatabase(b, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		}, b.Caches, func(server gomatrixserverlib.ServerName) bool { return server == "test" })
+		if err != nil {
+			t.Fatalf("NewDatabase returned %s", err)
+		}
+		ctx := context.Background()
+		if _, err = db.UpdateRoom(ctx, room.ID, []types.JoinedHost{
+			{MemberEventID: "$local", ServerName: "test"},
+			{MemberEventID: "$remote", ServerName: "remote"},
+			{MemberEventID: "$uptodate", ServerName: "uptodate"},
+			{MemberEventID: "$blacklisted", ServerName: "blacklisted"},
+		}, nil, false); err != nil {
+			t.Fatalf("UpdateRoom returned %s", err)
+		}
+		if err = db.AddServerToBlacklist("blacklisted"); err != nil {
+			t.Fatalf("AddServerToBlacklist returned %s", err)
+		}
+
+		rsAPI := &catchUpRoomserverAPI{room: room, joined: local.ID, known: map[string]*gomatrixserverlib.HeaderedEvent{}}
+		for eventID, ev := range known {
+			rsAPI.known[eventID] = ev
+		}
+		fedClient := &catchUpFedClient{
+			roomID: room.ID,
+			latest: map[gomatrixserverlib.ServerName]string{
+				"remote":   latest.EventID(),
+				"uptodate": lastKnown,
+			},
+			events:   map[string]*gomatrixserverlib.HeaderedEvent{},
+			requests: map[gomatrixserverlib.ServerName]int{},
+		}
+		for _, ev := range room.Events() {
+			fedClient.events[ev.EventID()] = ev
+		}
+		stats := statistics.NewStatistics(db, 16)
+		keyResult := keyValidFor(time.Hour)
+		keyResult.VerifyKey.Key = gomatrixserverlib.Base64Bytes(test.PrivateKeyA.Public().(ed25519.PublicKey))
+		fsAPI := &FederationInternalAPI{
+			db: db,
+			cfg: &config.FederationAPI{
+				Matrix: &config.Global{
+					SigningIdentity: gomatrixserverlib.SigningIdentity{
+						ServerName: "test",
+						KeyID:      "ed25519:test",
+						PrivateKey: test.PrivateKeyA,
+					},
+				},
+				CatchUp: config.CatchUp{Enabled: true, MaxServersPerRoom: 3},
+			},
+			rsAPI:      rsAPI,
+			federation: fedClient,
+			statistics: &stats,
+			keyRing: &gomatrixserverlib.KeyRing{
+				KeyDatabase: fakeKeyDatabase{newFakeKeyFetcher(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+					{ServerName: "remote", KeyID: remoteKeyID}: keyResult,
+				})},
+			},
+		}
+
+		fsAPI.CatchUp(ctx)
+
+		if len(rsAPI.inputs) != 1 {
+			t.Fatalf("expected 1 event to be sent to the roomserver, got %d", len(rsAPI.inputs))
+		}
+		input := rsAPI.inputs[0]
+		if input.Event.EventID() != latest.EventID() {
+			t.Fatalf("expected the latest event %s to be sent to the roomserver, got %s", latest.EventID(), input.Event.EventID())
+		}
+		if input.Kind != roomserverAPI.KindNew || input.Origin != "remote" {
+			t.Fatalf("expected a new event from the remote server so that the gap is filled from it, got kind %d from %q", input.Kind, input.Origin)
+		}
+		for _, ev := range room.Events() {
+			if _, ok := rsAPI.known[ev.EventID()]; !ok {
+				t.Fatalf("expected event %s to be known after catching up", ev.EventID())
+			}
+		}
+		for server, want := range map[gomatrixserverlib.ServerName]int{"remote": 1, "uptodate": 1, "test": 0, "blacklisted": 0} {
+			if got := fedClient.requests[server]; got != want {
+				t.Errorf("expected %d requests to %s, got %d", want, server, got)
+			}
+		}
+
+		// Once caught up, there's nothing more to do.
+		fsAPI.CatchUp(ctx)
+		if len(rsAPI.inputs) != 1 {
+			t.Fatalf("expected no more events to be sent to the roomserver, got %d", len(rsAPI.inputs)-1)
+		}
+
+		// Only as many servers per room as configured are asked.
+		fsAPI.cfg.CatchUp.MaxServersPerRoom = 1
+		fsAPI.CatchUp(ctx)
+		if got := fedClient.requests["remote"] + fedClient.requests["uptodate"]; got != 5 {
+			t.Fatalf("expected 1 more request, got %d", got-4)
+		}
+	})
+}
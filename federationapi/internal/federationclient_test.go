@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/federationapi/statistics"
+	"github.com/matrix-org/dendrite/federationapi/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+)
+
+type circuitBreakerFedClient struct {
+	api.FederationClient
+	err   error
+	calls int
+}
+
+func (f *circuitBreakerFedClient) GetEvent(_ context.Context, _, _ gomatrixserverlib.ServerName, _ string) (gomatrixserverlib.Transaction, error) {
+	f.calls++
+	return gomatrixserverlib.Transaction{}, f.err
+}
+
+func TestCircuitBreakerShortCircuitsRequests(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		b, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		connStr, dbClose := test.PrepareDBConnectionString(t, dbType)
+		defer dbClose()
+		db, err := storage.NewDatabase(b, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		}, b.Caches, func(server gomatrixserverlib.ServerName) bool { return server == "test" })
+		if err != nil {
+			t.Fatalf("NewDatabase returned %s", err)
+		}
+		ctx := context.Background()
+
+		fedClient := &circuitBreakerFedClient{}
+		stats := statistics.NewStatistics(db, 16)
+		stats.CircuitBreakerThreshold = 2
+		stats.CircuitBreakerOpenDuration = time.Hour
+		fsAPI := &FederationInternalAPI{
+			db:         db,
+			cfg:        &config.FederationAPI{},
+			federation: fedClient,
+			statistics: &stats,
+		}
+		wantStatus := func(serverName gomatrixserverlib.ServerName, wantState statistics.CircuitBreakerState, wantFailures uint32) {
+			t.Helper()
+			res := &api.QueryServerStatusResponse{}
+			if err = fsAPI.QueryServerStatus(ctx, &api.QueryServerStatusRequest{ServerName: serverName}, res); err != nil {
+				t.Fatalf("QueryServerStatus returned %s", err)
+			}
+			if !res.CircuitBreaker.Enabled || res.CircuitBreaker.State != string(wantState) || res.CircuitBreaker.ConsecutiveFailures != wantFailures {
+				t.Fatalf("expected circuit breaker %q with %d failures, got %+v", wantState, wantFailures, res.CircuitBreaker)
+			}
+		}
+
+		// Requests which the server rejects don't count as failures.
+		fedClient.err = gomatrix.HTTPError{Code: 404}
+		for i := 0; i < 3; i++ {
+			_, _ = fsAPI.GetEvent(ctx, "test", "rejecting", "$event")
+		}
+		if fedClient.calls != 3 {
+			t.Fatalf("expected 3 requests to be sent, got %d", fedClient.calls)
+		}
+		wantStatus("rejecting", statistics.CircuitBreakerClosed, 0)
+
+		// Requests which fail open the breaker, after which they aren't sent.
+		fedClient.calls = 0
+		fedClient.err = gomatrix.HTTPError{Code: 502}
+		for i := 0; i < 3; i++ {
+			_, err = fsAPI.GetEvent(ctx, "test", "failing", "$event")
+		}
+		if fedClient.calls != 2 {
+			t.Fatalf("expected 2 requests to be sent, got %d", fedClient.calls)
+		}
+		fedErr, ok := err.(*api.FederationClientError)
+		if !ok || !strings.Contains(fedErr.Err, "circuit breaker") || fedErr.RetryAfter <= 0 {
+			t.Fatalf("expected the last request to be refused by the circuit breaker, got %v", err)
+		}
+		wantStatus("failing", statistics.CircuitBreakerOpen, 2)
+
+		// Other servers aren't affected.
+		wantStatus("rejecting", statistics.CircuitBreakerClosed, 0)
+	})
+}
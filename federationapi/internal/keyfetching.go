@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// keyRefreshInterval is how often we'll try to refresh the keys of any one
+// server in the background, in case the server doesn't give us newer keys.
+const keyRefreshInterval = 5 * time.Minute
+
+// There is no separate prefetching of the keys of servers we haven't seen
+// before: the first fetch for a server retrieves all of its current keys, and
+// the key ring stores all of them, not only the ones which were asked for.
+
+// A failureCachingKeyFetcher wraps a key fetcher so that, once it has failed
+// to fetch a key of a server, it won't ask for that key again until the
+// failure cache duration has passed. Other keys of the same server are still
+// fetched, so that a server which has rotated its key isn't held back by a
+// request for an old key which it no longer serves.
+type failureCachingKeyFetcher struct {
+	gomatrixserverlib.KeyFetcher
+	duration    time.Duration
+	failedMutex sync.Mutex
+	failedKey   map[gomatrixserverlib.PublicKeyLookupRequest]time.Time // when to try again
+}
+
+func newFailureCachingKeyFetcher(fetcher gomatrixserverlib.KeyFetcher, duration time.Duration) gomatrixserverlib.KeyFetcher {
+	if duration <= 0 {
+		return fetcher
+	}
+	return &failureCachingKeyFetcher{
+		KeyFetcher: fetcher,
+		duration:   duration,
+		failedKey:  map[gomatrixserverlib.PublicKeyLookupRequest]time.Time{},
+	}
+}
+
+// FetchKeys implements gomatrixserverlib.KeyFetcher
+func (f *failureCachingKeyFetcher) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	now := time.Now()
+	wanted := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(requests))
+	f.failedMutex.Lock()
+	for req, ts := range requests {
+		if retryAt, ok := f.failedKey[req]; ok {
+			if now.Before(retryAt) {
+				continue
+			}
+			delete(f.failedKey, req)
+		}
+		wanted[req] = ts
+	}
+	f.failedMutex.Unlock()
+	if len(wanted) == 0 {
+		return map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}, nil
+	}
+
+	results, err := f.KeyFetcher.FetchKeys(ctx, wanted)
+	if ctx.Err() != nil {
+		// The caller gave up waiting, which says nothing about the server.
+		return results, err
+	}
+
+	f.failedMutex.Lock()
+	defer f.failedMutex.Unlock()
+	for req := range wanted {
+		if _, ok := results[req]; !ok {
+			f.failedKey[req] = now.Add(f.duration)
+		}
+	}
+	return results, err
+}
+
+// A refreshingKeyDatabase wraps a key database so that keys which will soon
+// stop being valid are fetched again in the background, before anyone has to
+// wait for them.
+type refreshingKeyDatabase struct {
+	gomatrixserverlib.KeyDatabase
+	keyRing         *gomatrixserverlib.KeyRing
+	refreshBefore   time.Duration
+	refreshedMutex  sync.Mutex
+	refreshedServer map[gomatrixserverlib.ServerName]time.Time // when we last tried
+}
+
+func newRefreshingKeyDatabase(db gomatrixserverlib.KeyDatabase, keyRing *gomatrixserverlib.KeyRing, refreshBefore time.Duration) gomatrixserverlib.KeyDatabase {
+	if refreshBefore <= 0 {
+		return db
+	}
+	return &refreshingKeyDatabase{
+		KeyDatabase:     db,
+		keyRing:         keyRing,
+		refreshBefore:   refreshBefore,
+		refreshedServer: map[gomatrixserverlib.ServerName]time.Time{},
+	}
+}
+
+// FetchKeys implements gomatrixserverlib.KeyDatabase
+func (d *refreshingKeyDatabase) FetchKeys(
+	ctx context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results, err := d.KeyDatabase.FetchKeys(ctx, requests)
+	if err != nil {
+		return results, err
+	}
+
+	// Work out which of the keys are still valid, but not for much longer.
+	now := time.Now()
+	refreshAt := gomatrixserverlib.AsTimestamp(now.Add(d.refreshBefore))
+	due := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	d.refreshedMutex.Lock()
+	for req, res := range results {
+		if res.ExpiredTS != gomatrixserverlib.PublicKeyNotExpired {
+			continue
+		}
+		if res.ValidUntilTS <= gomatrixserverlib.AsTimestamp(now) || res.ValidUntilTS > refreshAt {
+			continue
+		}
+		if last, ok := d.refreshedServer[req.ServerName]; ok && now.Sub(last) < keyRefreshInterval {
+			continue
+		}
+		due[req] = res
+	}
+	for req := range due {
+		d.refreshedServer[req.ServerName] = now
+	}
+	d.refreshedMutex.Unlock()
+
+	if len(due) > 0 {
+		go d.refresh(due)
+	}
+	return results, nil
+}
+
+// refresh fetches fresh copies of the given keys and stores any which are
+// valid for longer than the ones that we already have.
+func (d *refreshingKeyDatabase) refresh(
+	current map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) {
+	// Create a context that limits our requests to 30 seconds.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	requests := make(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp, len(current))
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	for req := range current {
+		requests[req] = now
+	}
+	for _, fetcher := range d.keyRing.KeyFetchers {
+		if len(requests) == 0 {
+			break
+		}
+		fetched, err := fetcher.FetchKeys(ctx, requests)
+		if err != nil {
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"fetcher_name": fetcher.FetcherName(),
+			}).Warnf("Failed to refresh %d key(s)", len(requests))
+			continue
+		}
+		storeResults := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+		for req, res := range fetched {
+			if prev, ok := current[req]; ok && res.ValidUntilTS > prev.ValidUntilTS {
+				storeResults[req] = res
+				delete(requests, req)
+			}
+		}
+		if len(storeResults) == 0 {
+			continue
+		}
+		if err = d.KeyDatabase.StoreKeys(ctx, storeResults); err != nil {
+			logrus.WithError(err).Errorf("Failed to store %d refreshed key(s)", len(storeResults))
+			return
+		}
+	}
+}
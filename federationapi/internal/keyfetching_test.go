@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type fakeKeyFetcher struct {
+	sync.Mutex
+	keys  map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult
+	calls map[gomatrixserverlib.PublicKeyLookupRequest]int
+}
+
+func newFakeKeyFetcher(keys map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult) *fakeKeyFetcher {
+	return &fakeKeyFetcher{
+		keys:  keys,
+		calls: map[gomatrixserverlib.PublicKeyLookupRequest]int{},
+	}
+}
+
+func (f *fakeKeyFetcher) FetcherName() string {
+	return "fakeKeyFetcher"
+}
+
+func (f *fakeKeyFetcher) FetchKeys(
+	_ context.Context,
+	requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	f.Lock()
+	defer f.Unlock()
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		f.calls[req]++
+		if res, ok := f.keys[req]; ok {
+			results[req] = res
+		}
+	}
+	return results, nil
+}
+
+func (f *fakeKeyFetcher) callsFor(req gomatrixserverlib.PublicKeyLookupRequest) int {
+	f.Lock()
+	defer f.Unlock()
+	return f.calls[req]
+}
+
+type fakeKeyDatabase struct {
+	*fakeKeyFetcher
+}
+
+func (d fakeKeyDatabase) StoreKeys(
+	_ context.Context,
+	results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	d.Lock()
+	defer d.Unlock()
+	for req, res := range results {
+		d.keys[req] = res
+	}
+	return nil
+}
+
+func keyValidFor(d time.Duration) gomatrixserverlib.PublicKeyLookupResult {
+	return gomatrixserverlib.PublicKeyLookupResult{
+		ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+		ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(d)),
+	}
+}
+
+func TestFailureCachingKeyFetcher(t *testing.T) {
+	good := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "good", KeyID: "ed25519:auto"}
+	bad := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "bad", KeyID: "ed25519:auto"}
+	old := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "rotated", KeyID: "ed25519:old"}
+	rotated := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "rotated", KeyID: "ed25519:new"}
+	inner := newFakeKeyFetcher(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		good:    keyValidFor(time.Hour),
+		rotated: keyValidFor(time.Hour),
+	})
+	fetcher := newFailureCachingKeyFetcher(inner, time.Hour).(*failureCachingKeyFetcher)
+
+	fetch := func(reqs ...gomatrixserverlib.PublicKeyLookupRequest) map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult {
+		t.Helper()
+		now := gomatrixserverlib.AsTimestamp(time.Now())
+		requests := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{}
+		for _, req := range reqs {
+			requests[req] = now
+		}
+		results, err := fetcher.FetchKeys(context.Background(), requests)
+		if err != nil {
+			t.Fatalf("failed to fetch keys: %s", err)
+		}
+		return results
+	}
+
+	if results := fetch(good, bad); len(results) != 1 {
+		t.Fatalf("expected only the key for %q, got %d keys", good.ServerName, len(results))
+	}
+	if got := inner.callsFor(bad); got != 1 {
+		t.Fatalf("expected 1 request for %q, got %d", bad.ServerName, got)
+	}
+
+	// The failure is remembered, so the unreachable server isn't asked again.
+	fetch(good, bad)
+	if got := inner.callsFor(bad); got != 1 {
+		t.Fatalf("expected failure to be cached, but %q was requested %d times", bad.ServerName, got)
+	}
+	if got := inner.callsFor(good); got != 2 {
+		t.Fatalf("expected 2 requests for %q, got %d", good.ServerName, got)
+	}
+
+	// Once the failure has expired, the server is asked again.
+	fetcher.failedMutex.Lock()
+	fetcher.failedKey[bad] = time.Now().Add(-time.Second)
+	fetcher.failedMutex.Unlock()
+	fetch(good, bad)
+	if got := inner.callsFor(bad); got != 2 {
+		t.Fatalf("expected expired failure to be retried, but %q was requested %d times", bad.ServerName, got)
+	}
+
+	// A failure to fetch one key of a server doesn't stop another key of the
+	// same server from being fetched.
+	fetch(old)
+	fetch(old)
+	if got := inner.callsFor(old); got != 1 {
+		t.Fatalf("expected failure to be cached, but %q was requested %d times", old.KeyID, got)
+	}
+	if results := fetch(rotated); len(results) != 1 {
+		t.Fatalf("expected key %q of %q", rotated.KeyID, rotated.ServerName)
+	}
+	if got := inner.callsFor(rotated); got != 1 {
+		t.Fatalf("expected 1 request for %q, got %d", rotated.KeyID, got)
+	}
+}
+
+func TestRefreshingKeyDatabase(t *testing.T) {
+	fresh := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "fresh", KeyID: "ed25519:auto"}
+	expiring := gomatrixserverlib.PublicKeyLookupRequest{ServerName: "expiring", KeyID: "ed25519:auto"}
+	stored := keyValidFor(10 * time.Minute)
+	db := fakeKeyDatabase{newFakeKeyFetcher(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		fresh:    keyValidFor(24 * time.Hour),
+		expiring: stored,
+	})}
+	remote := newFakeKeyFetcher(map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		fresh:    keyValidFor(7 * 24 * time.Hour),
+		expiring: keyValidFor(7 * 24 * time.Hour),
+	})
+	keyRing := &gomatrixserverlib.KeyRing{
+		KeyFetchers: []gomatrixserverlib.KeyFetcher{remote},
+	}
+	keyRing.KeyDatabase = newRefreshingKeyDatabase(db, keyRing, time.Hour)
+
+	fetch := func() {
+		t.Helper()
+		now := gomatrixserverlib.AsTimestamp(time.Now())
+		results, err := keyRing.KeyDatabase.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			fresh:    now,
+			expiring: now,
+		})
+		if err != nil {
+			t.Fatalf("failed to fetch keys: %s", err)
+		}
+		if len(results) != 2 {
+			t.Fatalf("expected 2 keys from the database, got %d", len(results))
+		}
+	}
+
+	// The key which is about to expire is refreshed in the background.
+	fetch()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.Lock()
+		refreshed := db.keys[expiring].ValidUntilTS > stored.ValidUntilTS
+		db.Unlock()
+		if refreshed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected key for %q to be refreshed", expiring.ServerName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Keys which are still valid for long enough come from the database and
+	// aren't fetched again.
+	fetch()
+	if got := remote.callsFor(fresh); got != 0 {
+		t.Fatalf("expected no requests for %q, got %d", fresh.ServerName, got)
+	}
+	if got := remote.callsFor(expiring); got != 1 {
+		t.Fatalf("expected 1 request for %q, got %d", expiring.ServerName, got)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
 	"github.com/matrix-org/dendrite/federationapi/api"
@@ -18,6 +19,28 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/version"
 )
 
+func init() {
+	prometheus.MustRegister(federatedJoinsInFlight, federatedJoinsQueued)
+}
+
+var federatedJoinsInFlight = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "federated_joins_in_flight",
+		Help:      "Number of federated joins currently in progress",
+	},
+)
+
+var federatedJoinsQueued = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "federationapi",
+		Name:      "federated_joins_queued",
+		Help:      "Number of federated joins waiting for another join to finish",
+	},
+)
+
 // PerformLeaveRequest implements api.FederationInternalAPI
 func (r *FederationInternalAPI) PerformDirectoryLookup(
 	ctx context.Context,
@@ -66,6 +89,20 @@ func (r *FederationInternalAPI) PerformJoin(
 	r.joins.Store(j, nil)
 	defer r.joins.Delete(j)
 
+	// Wait for, or give up on, a free slot if the number of concurrent
+	// joins is limited.
+	if !r.acquireJoinSlot(ctx) {
+		response.LastError = &gomatrix.HTTPError{
+			Code: 429,
+			Message: `{
+				"errcode": "M_LIMIT_EXCEEDED",
+				"error": "Too many federated joins are in progress. Please try again later."
+			}`,
+		}
+		return
+	}
+	defer r.releaseJoinSlot()
+
 	// Look up the supported room versions.
 	var supportedVersions []gomatrixserverlib.RoomVersion
 	for version := range version.SupportedRoomVersions() {
@@ -88,7 +125,7 @@ func (r *FederationInternalAPI) PerformJoin(
 
 	// Try each server that we were provided until we land on one that
 	// successfully completes the make-join send-join dance.
-	var lastErr error
+	var lastErr, roomVersionErr error
 	for _, serverName := range request.ServerNames {
 		if err := r.performJoinUsingServer(
 			ctx,
@@ -104,6 +141,9 @@ func (r *FederationInternalAPI) PerformJoin(
 				"room_id":     request.RoomID,
 			}).Warnf("Failed to join room through server")
 			lastErr = err
+			if isRoomVersionError(err) {
+				roomVersionErr = err
+			}
 			continue
 		}
 
@@ -112,7 +152,12 @@ func (r *FederationInternalAPI) PerformJoin(
 		return
 	}
 
-	// If we reach here then we didn't complete a join for some reason.
+	// If we reach here then we didn't complete a join for some reason. A room
+	// version error tells the user more than whatever the other servers
+	// returned, so prefer it.
+	if roomVersionErr != nil {
+		lastErr = roomVersionErr
+	}
 	var httpErr gomatrix.HTTPError
 	if ok := errors.As(lastErr, &httpErr); ok {
 		httpErr.Message = string(httpErr.Contents)
@@ -136,6 +181,63 @@ func (r *FederationInternalAPI) PerformJoin(
 	)
 }
 
+// roomVersionError returns an HTTP 400 error with the given errcode, as if it
+// were returned by the remote server, so that it is passed on to the client.
+func roomVersionError(errCode, msg string) error {
+	contents, _ := json.Marshal(gomatrix.RespError{ErrCode: errCode, Err: msg})
+	return gomatrix.HTTPError{
+		Code:     400,
+		Message:  msg,
+		Contents: contents,
+	}
+}
+
+// isRoomVersionError returns true if the error is because either we or the
+// remote server don't support the version of the room.
+func isRoomVersionError(err error) bool {
+	var httpErr gomatrix.HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	var respErr gomatrix.RespError
+	if json.Unmarshal(httpErr.Contents, &respErr) != nil {
+		return false
+	}
+	return respErr.ErrCode == "M_INCOMPATIBLE_ROOM_VERSION" || respErr.ErrCode == "M_UNSUPPORTED_ROOM_VERSION"
+}
+
+// acquireJoinSlot reserves one of the slots for concurrent federated joins,
+// queueing for one to become free if configured to do so. It returns false
+// if no slot could be reserved.
+func (r *FederationInternalAPI) acquireJoinSlot(ctx context.Context) bool {
+	if r.joinSlots != nil {
+		select {
+		case r.joinSlots <- struct{}{}:
+		default:
+			if !r.cfg.QueueExcessJoins {
+				return false
+			}
+			federatedJoinsQueued.Inc()
+			defer federatedJoinsQueued.Dec()
+			select {
+			case r.joinSlots <- struct{}{}:
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+	federatedJoinsInFlight.Inc()
+	return true
+}
+
+// releaseJoinSlot frees a slot reserved with acquireJoinSlot.
+func (r *FederationInternalAPI) releaseJoinSlot() {
+	federatedJoinsInFlight.Dec()
+	if r.joinSlots != nil {
+		<-r.joinSlots
+	}
+}
+
 func (r *FederationInternalAPI) performJoinUsingServer(
 	ctx context.Context,
 	roomID, userID string,
@@ -192,8 +294,11 @@ func (r *FederationInternalAPI) performJoinUsingServer(
 	if respMakeJoin.RoomVersion == "" {
 		respMakeJoin.RoomVersion = setDefaultRoomVersionFromJoinEvent(respMakeJoin.JoinEvent)
 	}
-	if _, err = respMakeJoin.RoomVersion.EventFormat(); err != nil {
-		return fmt.Errorf("respMakeJoin.RoomVersion.EventFormat: %w", err)
+	if _, err = version.SupportedRoomVersion(respMakeJoin.RoomVersion); err != nil {
+		return roomVersionError(
+			"M_UNSUPPORTED_ROOM_VERSION",
+			fmt.Sprintf("The room uses room version %q which is not supported by this server", respMakeJoin.RoomVersion),
+		)
 	}
 
 	// Build the join event.
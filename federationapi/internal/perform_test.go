@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/federationapi/statistics"
+	"github.com/matrix-org/dendrite/federationapi/storage"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+)
+
+type roomVersionFedClient struct {
+	api.FederationClient
+	makeJoin   func() (gomatrixserverlib.RespMakeJoin, error)
+	makeJoins  int
+	sendJoins  int
+	remoteVers []gomatrixserverlib.RoomVersion
+}
+
+func (f *roomVersionFedClient) MakeJoin(_ context.Context, _, s gomatrixserverlib.ServerName, _, _ string, vers []gomatrixserverlib.RoomVersion) (gomatrixserverlib.RespMakeJoin, error) {
+	f.makeJoins++
+	f.remoteVers = vers
+	if s == "remote3" {
+		return gomatrixserverlib.RespMakeJoin{}, gomatrix.HTTPError{Code: 502}
+	}
+	return f.makeJoin()
+}
+
+func (f *roomVersionFedClient) SendJoin(_ context.Context, _, _ gomatrixserverlib.ServerName, _ *gomatrixserverlib.Event) (res gomatrixserverlib.RespSendJoin, err error) {
+	f.sendJoins++
+	return res, gomatrix.HTTPError{Code: 500}
+}
+
+func TestPerformJoinRoomVersion(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+
+	testCases := []struct {
+		name        string
+		makeJoin    func() (gomatrixserverlib.RespMakeJoin, error)
+		wantErrCode string
+	}{
+		{
+			name: "room version we don't support",
+			makeJoin: func() (res gomatrixserverlib.RespMakeJoin, err error) {
+				err = json.Unmarshal([]byte(`{"room_version":"org.example.unknown","event":{}}`), &res)
+				return res, err
+			},
+			wantErrCode: "M_UNSUPPORTED_ROOM_VERSION",
+		},
+		{
+			name: "room version the remote server doesn't think we support",
+			makeJoin: func() (res gomatrixserverlib.RespMakeJoin, err error) {
+				return res, gomatrix.HTTPError{
+					Code:     400,
+					Contents: []byte(`{"errcode":"M_INCOMPATIBLE_ROOM_VERSION","error":"Your homeserver does not support the features required to join this room","room_version":"org.example.unknown"}`),
+				}
+			},
+			wantErrCode: "M_INCOMPATIBLE_ROOM_VERSION",
+		},
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		b, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+		connStr, dbClose := test.PrepareDBConnectionString(t, dbType)
+		defer dbClose()
+		db, err := storage.NewDatabase(b, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		}, b.Caches, func(server gomatrixserverlib.ServerName) bool { return server == "test" })
+		if err != nil {
+			t.Fatalf("NewDatabase returned %s", err)
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				fedClient := &roomVersionFedClient{makeJoin: tc.makeJoin}
+				stats := statistics.NewStatistics(db, 16)
+				fsAPI := &FederationInternalAPI{
+					db: db,
+					cfg: &config.FederationAPI{
+						Matrix: &config.Global{
+							SigningIdentity: gomatrixserverlib.SigningIdentity{
+								ServerName: "test",
+								KeyID:      "ed25519:test",
+								PrivateKey: test.PrivateKeyA,
+							},
+						},
+					},
+					federation: fedClient,
+					statistics: &stats,
+				}
+
+				res := &api.PerformJoinResponse{}
+				fsAPI.PerformJoin(context.Background(), &api.PerformJoinRequest{
+					RoomID:      room.ID,
+					UserID:      "@bob:test",
+					ServerNames: []gomatrixserverlib.ServerName{"remote1", "remote2", "remote3"},
+				}, res)
+
+				if len(fedClient.remoteVers) != len(version.SupportedRoomVersions()) {
+					t.Fatalf("expected all %d supported room versions to be sent, got %v", len(version.SupportedRoomVersions()), fedClient.remoteVers)
+				}
+				for _, v := range fedClient.remoteVers {
+					if _, err := version.SupportedRoomVersion(v); err != nil {
+						t.Fatalf("expected only supported room versions to be sent, got %q", v)
+					}
+				}
+				// Every server is tried, but the room version error is
+				// reported rather than the error of the last server.
+				if fedClient.makeJoins != 3 {
+					t.Fatalf("expected every server to be tried, got %d make_joins", fedClient.makeJoins)
+				}
+				if fedClient.sendJoins != 0 {
+					t.Fatalf("expected no send_join, got %d", fedClient.sendJoins)
+				}
+				if res.LastError == nil {
+					t.Fatalf("expected the join to fail")
+				}
+				if res.LastError.Code != 400 {
+					t.Fatalf("expected HTTP 400, got %d", res.LastError.Code)
+				}
+				var respErr gomatrix.RespError
+				if err := json.Unmarshal([]byte(res.LastError.Message), &respErr); err != nil {
+					t.Fatalf("expected a Matrix error, got %q", res.LastError.Message)
+				}
+				if respErr.ErrCode != tc.wantErrCode {
+					t.Fatalf("expected %s, got %s", tc.wantErrCode, respErr.ErrCode)
+				}
+			})
+		}
+	})
+}
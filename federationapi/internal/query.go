@@ -25,6 +25,31 @@ func (f *FederationInternalAPI) QueryJoinedHostServerNamesInRoom(
 	return
 }
 
+// QueryServerStatus implements api.FederationInternalAPI
+func (f *FederationInternalAPI) QueryServerStatus(
+	ctx context.Context,
+	request *api.QueryServerStatusRequest,
+	response *api.QueryServerStatusResponse,
+) error {
+	stats := f.statistics.ForServer(request.ServerName)
+	until, blacklisted := stats.BackoffInfo()
+	response.Blacklisted = blacklisted
+	if until != nil && !until.IsZero() {
+		response.BackoffUntil = gomatrixserverlib.AsTimestamp(*until)
+	}
+	breaker := stats.CircuitBreaker()
+	state, failures, openUntil := breaker.Status()
+	response.CircuitBreaker = api.CircuitBreakerStatus{
+		Enabled:             breaker != nil,
+		State:               string(state),
+		ConsecutiveFailures: failures,
+	}
+	if openUntil != nil {
+		response.CircuitBreaker.OpenUntil = gomatrixserverlib.AsTimestamp(*openUntil)
+	}
+	return nil
+}
+
 func (a *FederationInternalAPI) fetchServerKeysDirectly(ctx context.Context, serverName gomatrixserverlib.ServerName) (*gomatrixserverlib.ServerKeys, error) {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
 	defer cancel()
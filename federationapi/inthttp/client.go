@@ -16,6 +16,7 @@ import (
 const (
 	FederationAPIQueryJoinedHostServerNamesInRoomPath = "/federationapi/queryJoinedHostServerNamesInRoom"
 	FederationAPIQueryServerKeysPath                  = "/federationapi/queryServerKeys"
+	FederationAPIQueryServerStatusPath                = "/federationapi/queryServerStatus"
 
 	FederationAPIPerformDirectoryLookupRequestPath = "/federationapi/performDirectoryLookup"
 	FederationAPIPerformJoinRequestPath            = "/federationapi/performJoinRequest"
@@ -109,6 +110,18 @@ func (h *httpFederationInternalAPI) QueryJoinedHostServerNamesInRoom(
 	)
 }
 
+// QueryServerStatus implements FederationInternalAPI
+func (h *httpFederationInternalAPI) QueryServerStatus(
+	ctx context.Context,
+	request *api.QueryServerStatusRequest,
+	response *api.QueryServerStatusResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"QueryServerStatus", h.federationAPIURL+FederationAPIQueryServerStatusPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
 // Handle an instruction to make_join & send_join with a remote server.
 func (h *httpFederationInternalAPI) PerformJoin(
 	ctx context.Context,
@@ -23,6 +23,11 @@ func AddRoutes(intAPI api.FederationInternalAPI, internalAPIMux *mux.Router, ena
 		httputil.MakeInternalRPCAPI("FederationAPIQueryJoinedHostServerNamesInRoom", enableMetrics, intAPI.QueryJoinedHostServerNamesInRoom),
 	)
 
+	internalAPIMux.Handle(
+		FederationAPIQueryServerStatusPath,
+		httputil.MakeInternalRPCAPI("FederationAPIQueryServerStatus", enableMetrics, intAPI.QueryServerStatus),
+	)
+
 	internalAPIMux.Handle(
 		FederationAPIPerformInviteRequestPath,
 		httputil.MakeInternalRPCAPI("FederationAPIPerformInvite", enableMetrics, intAPI.PerformInvite),
@@ -32,6 +32,7 @@ import (
 	"github.com/matrix-org/dendrite/federationapi/storage"
 	"github.com/matrix-org/dendrite/federationapi/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/setup/process"
 )
 
@@ -46,6 +47,7 @@ type OutgoingQueues struct {
 	client      fedapi.FederationClient
 	statistics  *statistics.Statistics
 	signing     map[gomatrixserverlib.ServerName]*gomatrixserverlib.SigningIdentity
+	eduFilters  config.EDUFilters
 	queuesMutex sync.Mutex // protects the below
 	queues      map[gomatrixserverlib.ServerName]*destinationQueue
 }
@@ -91,6 +93,7 @@ func NewOutgoingQueues(
 	rsAPI api.FederationRoomserverAPI,
 	statistics *statistics.Statistics,
 	signing []*gomatrixserverlib.SigningIdentity,
+	eduFilters config.EDUFilters,
 ) *OutgoingQueues {
 	queues := &OutgoingQueues{
 		disabled:   disabled,
@@ -101,6 +104,7 @@ func NewOutgoingQueues(
 		client:     client,
 		statistics: statistics,
 		signing:    map[gomatrixserverlib.ServerName]*gomatrixserverlib.SigningIdentity{},
+		eduFilters: eduFilters,
 		queues:     map[gomatrixserverlib.ServerName]*destinationQueue{},
 	}
 	for _, identity := range signing {
@@ -212,16 +216,7 @@ func (oqs *OutgoingQueues) SendEvent(
 	}
 
 	// Check if any of the destinations are prohibited by server ACLs.
-	for destination := range destmap {
-		if api.IsServerBannedFromRoom(
-			oqs.process.Context(),
-			oqs.rsAPI,
-			ev.RoomID(),
-			destination,
-		) {
-			delete(destmap, destination)
-		}
-	}
+	oqs.removeBannedDestinations(destmap, ev.RoomID())
 
 	// If there are no remaining destinations then give up.
 	if len(destmap) == 0 {
@@ -274,6 +269,43 @@ func (oqs *OutgoingQueues) SendEvent(
 	return nil
 }
 
+// removeBannedDestinations removes any destinations which are prohibited by
+// the server ACLs of any of the given rooms.
+func (oqs *OutgoingQueues) removeBannedDestinations(
+	destmap map[gomatrixserverlib.ServerName]struct{}, roomIDs ...string,
+) {
+	for destination := range destmap {
+		for _, roomID := range roomIDs {
+			if api.IsServerBannedFromRoom(
+				oqs.process.Context(),
+				oqs.rsAPI,
+				roomID,
+				destination,
+			) {
+				delete(destmap, destination)
+				break
+			}
+		}
+	}
+}
+
+// eduRoomIDs returns the rooms that an EDU is about, if any. Receipts are
+// keyed by room ID, whereas other room EDUs have a room_id field.
+func eduRoomIDs(e *gomatrixserverlib.EDU) []string {
+	if e.Type == gomatrixserverlib.MReceipt {
+		var roomIDs []string
+		gjson.ParseBytes(e.Content).ForEach(func(key, _ gjson.Result) bool {
+			roomIDs = append(roomIDs, key.Str)
+			return true
+		})
+		return roomIDs
+	}
+	if result := gjson.GetBytes(e.Content, "room_id"); result.Exists() {
+		return []string{result.Str}
+	}
+	return nil
+}
+
 // SendEDU sends an EDU event to the destinations.
 func (oqs *OutgoingQueues) SendEDU(
 	e *gomatrixserverlib.EDU, origin gomatrixserverlib.ServerName,
@@ -301,21 +333,17 @@ func (oqs *OutgoingQueues) SendEDU(
 		delete(destmap, local)
 	}
 
-	// There is absolutely no guarantee that the EDU will have a room_id
-	// field, as it is not required by the spec. However, if it *does*
-	// (e.g. typing notifications) then we should try to make sure we don't
+	// There is absolutely no guarantee that the EDU will be about a room,
+	// as it is not required by the spec. However, if it is (e.g. typing
+	// notifications or receipts) then we should try to make sure we don't
 	// bother sending them to servers that are prohibited by the server
 	// ACLs.
-	if result := gjson.GetBytes(e.Content, "room_id"); result.Exists() {
-		for destination := range destmap {
-			if api.IsServerBannedFromRoom(
-				oqs.process.Context(),
-				oqs.rsAPI,
-				result.Str,
-				destination,
-			) {
-				delete(destmap, destination)
-			}
+	oqs.removeBannedDestinations(destmap, eduRoomIDs(e)...)
+
+	// Some destinations may be configured not to receive this type of EDU.
+	for destination := range destmap {
+		if !oqs.eduFilters.Allowed(destination, e.Type) {
+			delete(destmap, destination)
 		}
 	}
 
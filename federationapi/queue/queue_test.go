@@ -281,10 +281,16 @@ func (d *fakeDatabase) IsServerBlacklisted(serverName gomatrixserverlib.ServerNa
 
 type stubFederationRoomServerAPI struct {
 	rsapi.FederationRoomserverAPI
+	bannedServers map[string][]gomatrixserverlib.ServerName // room ID -> servers denied by the ACLs
 }
 
 func (r *stubFederationRoomServerAPI) QueryServerBannedFromRoom(ctx context.Context, req *rsapi.QueryServerBannedFromRoomRequest, res *rsapi.QueryServerBannedFromRoomResponse) error {
 	res.Banned = false
+	for _, serverName := range r.bannedServers[req.RoomID] {
+		if serverName == req.ServerName {
+			res.Banned = true
+		}
+	}
 	return nil
 }
 
@@ -335,7 +341,7 @@ func testSetup(failuresUntilBlacklist uint32, shouldTxSucceed bool, t *testing.T
 			ServerName: "localhost",
 		},
 	}
-	queues := NewOutgoingQueues(db, processContext, false, "localhost", fc, rs, &stats, signingInfo)
+	queues := NewOutgoingQueues(db, processContext, false, "localhost", fc, rs, &stats, signingInfo, nil)
 
 	return db, fc, queues, processContext, close
 }
@@ -1038,3 +1044,123 @@ func TestQueueInteractsWithRealDatabasePDUAndEDU(t *testing.T) {
 		poll.WaitOn(t, checkRetry, poll.WithTimeout(10*time.Second), poll.WithDelay(100*time.Millisecond))
 	})
 }
+
+func TestSendPDUNotSentToServersDeniedByACLs(t *testing.T) {
+	t.Parallel()
+	roomID := "!room:localhost"
+	allowed := gomatrixserverlib.ServerName("allowed")
+	denied := gomatrixserverlib.ServerName("denied")
+	db, fc, queues, pc, close := testSetup(16, true, t, test.DBTypeSQLite, false)
+	defer close()
+	defer func() {
+		pc.ShutdownDendrite()
+		<-pc.WaitForShutdown()
+	}()
+	queues.rsAPI = &stubFederationRoomServerAPI{
+		bannedServers: map[string][]gomatrixserverlib.ServerName{roomID: {denied}},
+	}
+
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"type":"m.room.message","room_id":"`+roomID+`"}`), false, gomatrixserverlib.RoomVersionV10)
+	assert.NoError(t, err)
+	err = queues.SendEvent(ev.Headered(gomatrixserverlib.RoomVersionV10), "localhost", []gomatrixserverlib.ServerName{allowed, denied})
+	assert.NoError(t, err)
+
+	check := func(log poll.LogT) poll.Result {
+		if fc.txCount.Load() == 1 {
+			return poll.Success()
+		}
+		return poll.Continue("waiting for the event to be sent. Currently %d", fc.txCount.Load())
+	}
+	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
+
+	queues.queuesMutex.Lock()
+	defer queues.queuesMutex.Unlock()
+	assert.Contains(t, queues.queues, allowed)
+	assert.NotContains(t, queues.queues, denied)
+	data, err := db.GetPendingPDUs(pc.Context(), denied, 100)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+}
+
+func TestSendEDUNotSentToServersDeniedByACLs(t *testing.T) {
+	t.Parallel()
+	roomID := "!room:localhost"
+	allowed := gomatrixserverlib.ServerName("allowed")
+	denied := gomatrixserverlib.ServerName("denied")
+	edus := map[string]*gomatrixserverlib.EDU{
+		"typing": {
+			Type:    gomatrixserverlib.MTyping,
+			Content: []byte(`{"room_id":"` + roomID + `","user_id":"@alice:localhost","typing":true}`),
+		},
+		"receipt": {
+			Type:    gomatrixserverlib.MReceipt,
+			Content: []byte(`{"` + roomID + `":{"m.read":{"@alice:localhost":{"data":{"ts":1},"event_ids":["$event"]}}}}`),
+		},
+	}
+	for name, edu := range edus {
+		edu := edu
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			db, _, queues, pc, close := testSetup(16, false, t, test.DBTypeSQLite, false)
+			defer close()
+			defer func() {
+				pc.ShutdownDendrite()
+				<-pc.WaitForShutdown()
+			}()
+			queues.rsAPI = &stubFederationRoomServerAPI{
+				bannedServers: map[string][]gomatrixserverlib.ServerName{roomID: {denied}},
+			}
+
+			err := queues.SendEDU(edu, "localhost", []gomatrixserverlib.ServerName{allowed, denied})
+			assert.NoError(t, err)
+
+			data, err := db.GetPendingEDUs(pc.Context(), allowed, 100)
+			assert.NoError(t, err)
+			assert.Len(t, data, 1)
+			data, err = db.GetPendingEDUs(pc.Context(), denied, 100)
+			assert.NoError(t, err)
+			assert.Empty(t, data)
+		})
+	}
+}
+
+func TestSendEDUNotSentToFilteredDestinations(t *testing.T) {
+	t.Parallel()
+	roomID := "!room:localhost"
+	filtered := gomatrixserverlib.ServerName("filtered")
+	db, fc, queues, pc, close := testSetup(16, true, t, test.DBTypeSQLite, false)
+	defer close()
+	defer func() {
+		pc.ShutdownDendrite()
+		<-pc.WaitForShutdown()
+	}()
+	queues.rsAPI = &stubFederationRoomServerAPI{}
+	queues.eduFilters = config.EDUFilters{
+		{ServerName: filtered, Deny: []string{gomatrixserverlib.MTyping}},
+	}
+
+	// The typing notification must not be queued for the filtered destination.
+	edu := &gomatrixserverlib.EDU{
+		Type:    gomatrixserverlib.MTyping,
+		Content: []byte(`{"room_id":"` + roomID + `","user_id":"@alice:localhost","typing":true}`),
+	}
+	err := queues.SendEDU(edu, "localhost", []gomatrixserverlib.ServerName{filtered})
+	assert.NoError(t, err)
+	data, err := db.GetPendingEDUs(pc.Context(), filtered, 100)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+
+	// Events must still be sent to it.
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{"type":"m.room.message","room_id":"`+roomID+`"}`), false, gomatrixserverlib.RoomVersionV10)
+	assert.NoError(t, err)
+	err = queues.SendEvent(ev.Headered(gomatrixserverlib.RoomVersionV10), "localhost", []gomatrixserverlib.ServerName{filtered})
+	assert.NoError(t, err)
+
+	check := func(log poll.LogT) poll.Result {
+		if fc.txCount.Load() == 1 {
+			return poll.Success()
+		}
+		return poll.Continue("waiting for the event to be sent. Currently %d", fc.txCount.Load())
+	}
+	poll.WaitOn(t, check, poll.WithTimeout(5*time.Second), poll.WithDelay(100*time.Millisecond))
+}
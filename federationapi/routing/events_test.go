@@ -0,0 +1,108 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/test"
+)
+
+type getEventRoomserverAPI struct {
+	api.FederationRoomserverAPI
+	event *gomatrixserverlib.HeaderedEvent
+	// servers which are allowed to see the event by history visibility
+	allowed map[gomatrixserverlib.ServerName]bool
+	// servers which are denied by the room's server ACLs
+	banned map[gomatrixserverlib.ServerName]bool
+}
+
+func (r *getEventRoomserverAPI) QueryServerAllowedToSeeEvent(_ context.Context, req *api.QueryServerAllowedToSeeEventRequest, res *api.QueryServerAllowedToSeeEventResponse) error {
+	res.AllowedToSeeEvent = req.EventID == r.event.EventID() && r.allowed[req.ServerName]
+	return nil
+}
+
+func (r *getEventRoomserverAPI) QueryEventsByID(_ context.Context, req *api.QueryEventsByIDRequest, res *api.QueryEventsByIDResponse) error {
+	for _, eventID := range req.EventIDs {
+		if eventID == r.event.EventID() {
+			res.Events = append(res.Events, r.event)
+		}
+	}
+	return nil
+}
+
+func (r *getEventRoomserverAPI) QueryServerBannedFromRoom(_ context.Context, req *api.QueryServerBannedFromRoomRequest, res *api.QueryServerBannedFromRoomResponse) error {
+	res.Banned = req.RoomID == r.event.RoomID() && r.banned[req.ServerName]
+	return nil
+}
+
+func TestGetEvent(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	event := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+
+	rsAPI := &getEventRoomserverAPI{
+		event: event,
+		allowed: map[gomatrixserverlib.ServerName]bool{
+			"allowed": true,
+			"acled":   true,
+		},
+		banned: map[gomatrixserverlib.ServerName]bool{
+			"acled": true,
+		},
+	}
+
+	tests := []struct {
+		name     string
+		origin   gomatrixserverlib.ServerName
+		eventID  string
+		wantCode int
+	}{
+		{
+			name:     "allowed server can fetch a visible event",
+			origin:   "allowed",
+			eventID:  event.EventID(),
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "server denied by ACLs is refused",
+			origin:   "acled",
+			eventID:  event.EventID(),
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "server which can't see the event is refused",
+			origin:   "other",
+			eventID:  event.EventID(),
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "unknown event is refused",
+			origin:   "allowed",
+			eventID:  "$unknown:test",
+			wantCode: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fedReq := gomatrixserverlib.NewFederationRequest(http.MethodGet, tt.origin, "test", "/event/"+tt.eventID)
+			res := GetEvent(context.Background(), &fedReq, rsAPI, tt.eventID, "test")
+			if res.Code != tt.wantCode {
+				t.Fatalf("expected HTTP %d, got %d: %+v", tt.wantCode, res.Code, res.JSON)
+			}
+			if res.Code != http.StatusOK {
+				return
+			}
+			txn, ok := res.JSON.(gomatrixserverlib.Transaction)
+			if !ok || len(txn.PDUs) != 1 {
+				t.Fatalf("expected a transaction with the event, got %+v", res.JSON)
+			}
+			if string(txn.PDUs[0]) != string(event.JSON()) {
+				t.Fatalf("expected event %s, got %s", event.JSON(), txn.PDUs[0])
+			}
+		})
+	}
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/util"
@@ -50,33 +51,41 @@ func GetProfile(
 		}
 	}
 
+	switch field {
+	case "", "displayname", "avatar_url":
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("The request body did not contain an allowed value of argument 'field'. Allowed values are either: 'avatar_url', 'displayname'."),
+		}
+	}
+
 	var profileRes userapi.QueryProfileResponse
-	err = userAPI.QueryProfile(httpReq.Context(), &userapi.QueryProfileRequest{
+	err = userAPI.QueryProfile(sqlutil.WithReadReplica(httpReq.Context()), &userapi.QueryProfileRequest{
 		UserID: userID,
 	}, &profileRes)
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("userAPI.QueryProfile failed")
 		return jsonerror.InternalServerError()
 	}
+	if !profileRes.UserExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The user does not exist or does not have a profile"),
+		}
+	}
 
 	var res interface{}
-	code := http.StatusOK
-
-	if field != "" {
-		switch field {
-		case "displayname":
-			res = eventutil.DisplayName{
-				DisplayName: profileRes.DisplayName,
-			}
-		case "avatar_url":
-			res = eventutil.AvatarURL{
-				AvatarURL: profileRes.AvatarURL,
-			}
-		default:
-			code = http.StatusBadRequest
-			res = jsonerror.InvalidArgumentValue("The request body did not contain an allowed value of argument 'field'. Allowed values are either: 'avatar_url', 'displayname'.")
+	switch field {
+	case "displayname":
+		res = eventutil.DisplayName{
+			DisplayName: profileRes.DisplayName,
+		}
+	case "avatar_url":
+		res = eventutil.AvatarURL{
+			AvatarURL: profileRes.AvatarURL,
 		}
-	} else {
+	default:
 		res = eventutil.ProfileResponse{
 			AvatarURL:   profileRes.AvatarURL,
 			DisplayName: profileRes.DisplayName,
@@ -84,7 +93,7 @@ func GetProfile(
 	}
 
 	return util.JSONResponse{
-		Code: code,
+		Code: http.StatusOK,
 		JSON: res,
 	}
 }
@@ -0,0 +1,123 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+type profileUserAPI struct {
+	userapi.FederationUserAPI
+	profiles map[string]userapi.QueryProfileResponse
+}
+
+func (p *profileUserAPI) QueryProfile(_ context.Context, req *userapi.QueryProfileRequest, res *userapi.QueryProfileResponse) error {
+	if profile, ok := p.profiles[req.UserID]; ok {
+		*res = profile
+	}
+	return nil
+}
+
+func TestGetProfile(t *testing.T) {
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			SigningIdentity: gomatrixserverlib.SigningIdentity{ServerName: "test"},
+		},
+	}
+	userAPI := &profileUserAPI{
+		profiles: map[string]userapi.QueryProfileResponse{
+			"@alice:test": {UserExists: true, DisplayName: "Alice", AvatarURL: "mxc://test/alice"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		userID   string
+		field    string
+		wantCode int
+		wantBody map[string]string
+	}{
+		{
+			name:     "whole profile",
+			userID:   "@alice:test",
+			wantCode: http.StatusOK,
+			wantBody: map[string]string{"displayname": "Alice", "avatar_url": "mxc://test/alice"},
+		},
+		{
+			name:     "display name only",
+			userID:   "@alice:test",
+			field:    "displayname",
+			wantCode: http.StatusOK,
+			wantBody: map[string]string{"displayname": "Alice"},
+		},
+		{
+			name:     "avatar URL only",
+			userID:   "@alice:test",
+			field:    "avatar_url",
+			wantCode: http.StatusOK,
+			wantBody: map[string]string{"avatar_url": "mxc://test/alice"},
+		},
+		{
+			name:     "unknown field",
+			userID:   "@alice:test",
+			field:    "email",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "unknown local user",
+			userID:   "@bob:test",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "unknown local user with field",
+			userID:   "@bob:test",
+			field:    "displayname",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "remote user",
+			userID:   "@alice:remote",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{"user_id": {tt.userID}}
+			if tt.field != "" {
+				query.Set("field", tt.field)
+			}
+			req := httptest.NewRequest(http.MethodGet, "/query/profile?"+query.Encode(), nil)
+			res := GetProfile(req, userAPI, cfg)
+			if res.Code != tt.wantCode {
+				t.Fatalf("expected HTTP %d, got %d: %+v", tt.wantCode, res.Code, res.JSON)
+			}
+			if tt.wantBody == nil {
+				return
+			}
+			body, err := json.Marshal(res.JSON)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]string
+			if err = json.Unmarshal(body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.wantBody) {
+				t.Fatalf("expected %v, got %s", tt.wantBody, body)
+			}
+			for k, v := range tt.wantBody {
+				if got[k] != v {
+					t.Fatalf("expected %v, got %s", tt.wantBody, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// ReportEvent implements the MSC3843 endpoint which lets another server forward
+// a user's report about an event sent by one of our users. The report is logged
+// for the server admins.
+func ReportEvent(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg *config.FederationAPI,
+	rsAPI api.FederationRoomserverAPI,
+	roomID, eventID string,
+) util.JSONResponse {
+	var r struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(request.Content(), &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	// Only accept reports from servers which can see the event.
+	if resErr := allowedToSeeEvent(httpReq.Context(), request.Origin(), rsAPI, eventID); resErr != nil {
+		return *resErr
+	}
+	ev, resErr := fetchEvent(httpReq.Context(), rsAPI, eventID)
+	if resErr != nil {
+		return *resErr
+	}
+	if ev.RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event not found"),
+		}
+	}
+	// Reports about events from other servers should go to those servers.
+	_, domain, err := gomatrixserverlib.SplitID('@', ev.Sender())
+	if err != nil || !cfg.Matrix.IsLocalServerName(domain) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Event was not sent by a user on this server"),
+		}
+	}
+
+	util.GetLogger(httpReq.Context()).WithFields(logrus.Fields{
+		"origin":   request.Origin(),
+		"room_id":  roomID,
+		"event_id": eventID,
+		"sender":   ev.Sender(),
+		"reason":   r.Reason,
+	}).Warn("Event reported by remote server")
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
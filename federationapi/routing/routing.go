@@ -69,6 +69,7 @@ func Setup(
 	if base.EnableMetrics {
 		prometheus.MustRegister(
 			pduCountTotal, eduCountTotal,
+			txnsInFlight, txnsRejectedTotal,
 		)
 	}
 
@@ -80,6 +81,10 @@ func Setup(
 		FsAPI: fsAPI,
 	}
 
+	// Joins over federation are limited per room in the same way as local
+	// joins, but there are no local devices to exempt.
+	roomJoinRateLimits := httputil.NewRateLimits(&cfg.Matrix.RoomJoins.RateLimiting, nil)
+
 	localKeys := httputil.MakeExternalAPI("localkeys", func(req *http.Request) util.JSONResponse {
 		return LocalKeys(cfg, gomatrixserverlib.ServerName(req.Host))
 	})
@@ -130,12 +135,13 @@ func Setup(
 	v2keysmux.Handle("/query/{serverName}/{keyID}", notaryKeys).Methods(http.MethodGet)
 
 	mu := internal.NewMutexByRoom()
+	txnLimiter := newTransactionLimiter(cfg)
 	v1fedmux.Handle("/send/{txnID}", MakeFedAPI(
 		"federation_send", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
-				cfg, rsAPI, keyAPI, keys, federation, mu, servers, producer,
+				cfg, rsAPI, keyAPI, keys, federation, mu, servers, producer, txnLimiter,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
@@ -174,7 +180,7 @@ func Setup(
 
 	v1fedmux.Handle("/3pid/onbind", httputil.MakeExternalAPI("3pid_onbind",
 		func(req *http.Request) util.JSONResponse {
-			return CreateInvitesFrom3PIDInvites(req, rsAPI, cfg, federation, userAPI)
+			return CreateInvitesFrom3PIDInvites(req, rsAPI, cfg, &base.Cfg.ClientAPI.MembershipProfile, federation, userAPI)
 		},
 	)).Methods(http.MethodPost, http.MethodOptions)
 
@@ -259,6 +265,21 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
+	fedMux.Handle("/unstable/fi.mau.msc3843/rooms/{roomID}/report/{eventID}", MakeFedAPI(
+		"federation_report_event", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.Forbidden("Forbidden by server ACLs"),
+				}
+			}
+			return ReportEvent(
+				httpReq, request, cfg, rsAPI, vars["roomID"], vars["eventID"],
+			)
+		},
+	)).Methods(http.MethodPost)
+
 	v1fedmux.Handle("/user/devices/{userID}", MakeFedAPI(
 		"federation_user_devices", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
@@ -342,6 +363,9 @@ func Setup(
 			}
 			roomID := vars["roomID"]
 			eventID := vars["eventID"]
+			if r := roomJoinRateLimits.LimitRoomJoin(roomID, nil); r != nil {
+				return *r
+			}
 			res := SendJoin(
 				httpReq, request, cfg, rsAPI, keys, roomID, eventID,
 			)
@@ -374,6 +398,9 @@ func Setup(
 			}
 			roomID := vars["roomID"]
 			eventID := vars["eventID"]
+			if r := roomJoinRateLimits.LimitRoomJoin(roomID, nil); r != nil {
+				return *r
+			}
 			return SendJoin(
 				httpReq, request, cfg, rsAPI, keys, roomID, eventID,
 			)
@@ -479,6 +506,19 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
+	v1fedmux.Handle("/timestamp_to_event/{roomID}", MakeFedAPI(
+		"federation_timestamp_to_event", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.Forbidden("Forbidden by server ACLs"),
+				}
+			}
+			return TimestampToEvent(httpReq, rsAPI, vars["roomID"])
+		},
+	)).Methods(http.MethodGet)
+
 	v1fedmux.Handle("/publicRooms",
 		httputil.MakeExternalAPI("federation_public_rooms", func(req *http.Request) util.JSONResponse {
 			return GetPostPublicRooms(req, rsAPI)
@@ -27,12 +27,14 @@ import (
 	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/federationapi/producers"
 	"github.com/matrix-org/dendrite/federationapi/types"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -91,6 +93,7 @@ func Send(
 	mu *internal.MutexByRoom,
 	servers federationAPI.ServersInRoomProvider,
 	producer *producers.SyncAPIProducer,
+	limiter *transactionLimiter,
 ) util.JSONResponse {
 	// First we should check if this origin has already submitted this
 	// txn ID to us. If they have and the txnIDs map contains an entry,
@@ -123,6 +126,19 @@ func Send(
 	defer close(ch)
 	defer inFlightTxnsPerOrigin.Delete(index)
 
+	// Make sure that neither this origin nor everyone together are sending us
+	// more transactions than we're willing to process at once. If they are,
+	// ask the origin to back off and retry the transaction later.
+	if !limiter.acquire(request.Origin()) {
+		res := util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("Too many transactions are being processed, please try again later", 1000),
+		}
+		ch <- res
+		return res
+	}
+	defer limiter.release(request.Origin())
+
 	t := txnReq{
 		rsAPI:                  rsAPI,
 		keys:                   keys,
@@ -133,6 +149,7 @@ func Send(
 		roomsMu:                mu,
 		producer:               producer,
 		inboundPresenceEnabled: cfg.Matrix.Presence.EnableInbound,
+		eventLimits:            &cfg.Matrix.EventLimits,
 	}
 
 	var txnEvents struct {
@@ -193,6 +210,7 @@ type txnReq struct {
 	servers                federationAPI.ServersInRoomProvider
 	producer               *producers.SyncAPIProducer
 	inboundPresenceEnabled bool
+	eventLimits            *config.EventLimits
 }
 
 // A subset of FederationClient functionality that txn requires. Useful for testing.
@@ -244,25 +262,30 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 		roomVersion := getRoomVersion(header.RoomID)
 		event, err := gomatrixserverlib.NewEventFromUntrustedJSON(pdu, roomVersion)
 		if err != nil {
-			if _, ok := err.(gomatrixserverlib.BadJSONError); ok {
-				// Room version 6 states that homeservers should strictly enforce canonical JSON
-				// on PDUs.
-				//
-				// This enforces that the entire transaction is rejected if a single bad PDU is
-				// sent. It is unclear if this is the correct behaviour or not.
-				//
-				// See https://github.com/matrix-org/synapse/issues/7543
-				return nil, &util.JSONResponse{
-					Code: 400,
-					JSON: jsonerror.BadJSON("PDU contains bad JSON"),
+			// A single bad PDU must not fail the whole transaction, so report
+			// the failure against the event ID if we are able to work it out.
+			// This includes PDUs which fail the canonical JSON checks that
+			// room version 6 onwards enforce.
+			util.GetLogger(ctx).WithError(err).Debugf("Transaction: Failed to parse event JSON of event %s", string(pdu))
+			if eventID := eventIDFromPDU(pdu, roomVersion); eventID != "" {
+				results[eventID] = gomatrixserverlib.PDUResult{
+					Error: err.Error(),
 				}
 			}
-			util.GetLogger(ctx).WithError(err).Debugf("Transaction: Failed to parse event JSON of event %s", string(pdu))
 			continue
 		}
 		if event.Type() == gomatrixserverlib.MRoomCreate && event.StateKeyEquals("") {
 			continue
 		}
+		if t.eventLimits != nil {
+			if err = eventutil.CheckEventLimits(event, t.eventLimits); err != nil {
+				util.GetLogger(ctx).WithError(err).Debugf("Transaction: Event %q exceeds limits", event.EventID())
+				results[event.EventID()] = gomatrixserverlib.PDUResult{
+					Error: err.Error(),
+				}
+				continue
+			}
+		}
 		if api.IsServerBannedFromRoom(ctx, t.rsAPI, event.RoomID(), t.Origin) {
 			results[event.EventID()] = gomatrixserverlib.PDUResult{
 				Error: "Forbidden by server ACLs",
@@ -308,6 +331,22 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 	return &gomatrixserverlib.RespSend{PDUs: results}, nil
 }
 
+// eventIDFromPDU attempts to work out the event ID of a PDU which could not be
+// parsed, so that the failure can be reported in the per-PDU results. Returns
+// an empty string if the event ID can't be determined.
+func eventIDFromPDU(pdu json.RawMessage, roomVersion gomatrixserverlib.RoomVersion) string {
+	if format, err := roomVersion.EventFormat(); err == nil && format == gomatrixserverlib.EventFormatV2 {
+		// The event ID is the reference hash of the event, which we can
+		// still calculate even if the event isn't valid.
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON(pdu, false, roomVersion)
+		if err != nil {
+			return ""
+		}
+		return event.EventID()
+	}
+	return gjson.GetBytes(pdu, "event_id").Str
+}
+
 // nolint:gocyclo
 func (t *txnReq) processEDUs(ctx context.Context) {
 	for _, e := range t.EDUs {
@@ -4,13 +4,18 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/sjson"
 )
 
 const (
@@ -550,3 +555,136 @@ func TestTransactionFetchMissingStateByStateIDs(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{eventB, eventC, eventD})
 }
 */
+
+// The purpose of this test is to check that a transaction containing an invalid PDU still processes the
+// valid PDUs, and reports the failure against the invalid PDU's event ID rather than failing the transaction.
+func TestTransactionWithInvalidPDU(t *testing.T) {
+	rsAPI := &testRoomserverAPI{}
+	invalidPDU, err := sjson.SetBytes(testData[len(testData)-2], "sender", "not-a-user-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalidEventID := testEvents[len(testEvents)-2].EventID()
+	pdus := []json.RawMessage{
+		invalidPDU,
+		testData[len(testData)-1], // a valid message event
+	}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	res, jsonErr := txn.processTransaction(context.Background())
+	if jsonErr != nil {
+		t.Fatalf("expected transaction to succeed, got %+v", jsonErr)
+	}
+	if len(res.PDUs) != len(pdus) {
+		t.Fatalf("expected results for %d PDUs, got %d", len(pdus), len(res.PDUs))
+	}
+	if result, ok := res.PDUs[invalidEventID]; !ok || result.Error == "" {
+		t.Fatalf("expected an error result for invalid PDU %s, got %+v", invalidEventID, res.PDUs)
+	}
+	if result, ok := res.PDUs[testEvents[len(testEvents)-1].EventID()]; !ok || result.Error != "" {
+		t.Fatalf("expected a successful result for valid PDU, got %+v", res.PDUs)
+	}
+	// only the valid event should reach the roomserver
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
+}
+
+// The purpose of this test is to check that an event referencing more prev_events than
+// allowed is rejected without being passed to the roomserver.
+func TestTransactionRejectsTooManyPrevEvents(t *testing.T) {
+	rsAPI := &testRoomserverAPI{}
+	limits := &config.EventLimits{}
+	limits.Defaults()
+	prevEvents := make([]string, limits.MaxPrevEvents+1)
+	for i := range prevEvents {
+		prevEvents[i] = fmt.Sprintf(`["$prev%d:localhost",{"sha256":"c5yVDfOelBE6fypHMs2Y3kdbZDSHSmnFe9XRaGzKBp8"}]`, i)
+	}
+	overLimitPDU, err := sjson.SetRawBytes(testData[len(testData)-2], "prev_events", []byte("["+strings.Join(prevEvents, ",")+"]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	overLimitEventID := testEvents[len(testEvents)-2].EventID()
+	pdus := []json.RawMessage{
+		overLimitPDU,
+		testData[len(testData)-1], // a valid message event
+	}
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, pdus)
+	txn.eventLimits = limits
+	res, jsonErr := txn.processTransaction(context.Background())
+	if jsonErr != nil {
+		t.Fatalf("expected transaction to succeed, got %+v", jsonErr)
+	}
+	if result, ok := res.PDUs[overLimitEventID]; !ok || !strings.Contains(result.Error, "prev_events") {
+		t.Fatalf("expected a prev_events error for PDU %s, got %+v", overLimitEventID, res.PDUs)
+	}
+	if result, ok := res.PDUs[testEvents[len(testEvents)-1].EventID()]; !ok || result.Error != "" {
+		t.Fatalf("expected a successful result for valid PDU, got %+v", res.PDUs)
+	}
+	// only the valid event should reach the roomserver
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
+}
+
+func TestEventIDFromPDU(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	ev := room.Events()[0]
+
+	if got := eventIDFromPDU(ev.JSON(), room.Version); got != ev.EventID() {
+		t.Fatalf("expected event ID %s, got %s", ev.EventID(), got)
+	}
+	if got := eventIDFromPDU(testData[0], testRoomVersion); got != testEvents[0].EventID() {
+		t.Fatalf("expected event ID %s, got %s", testEvents[0].EventID(), got)
+	}
+}
+
+func TestSendLimitsConcurrentTransactions(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Defaults(config.DefaultOpts{Monolithic: true})
+	cfg.Global.ServerName = testDestination
+	cfg.FederationAPI.MaxConcurrentTransactions = 3
+	cfg.FederationAPI.MaxConcurrentTransactionsPerOrigin = 1
+	limiter := newTransactionLimiter(&cfg.FederationAPI)
+
+	send := func(origin gomatrixserverlib.ServerName) int {
+		txnID := gomatrixserverlib.TransactionID(fmt.Sprintf("%d", time.Now().UnixNano()))
+		request := gomatrixserverlib.NewFederationRequest(http.MethodPut, origin, testDestination, "/_matrix/federation/v1/send/"+string(txnID))
+		if err := request.SetContent(map[string]interface{}{"pdus": []interface{}{}, "edus": []interface{}{}}); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		httpReq := httptest.NewRequest(http.MethodPut, "/", nil)
+		res := Send(
+			httpReq, &request, txnID, &cfg.FederationAPI, &testRoomserverAPI{}, nil,
+			&test.NopJSONVerifier{}, nil, internal.NewMutexByRoom(), nil, nil, limiter,
+		)
+		return res.Code
+	}
+
+	// A burst from one origin which is still being processed uses up all of
+	// that origin's slots, so further transactions from it are rejected.
+	busyOrigin := gomatrixserverlib.ServerName("busy.server")
+	if !limiter.acquire(busyOrigin) {
+		t.Fatalf("expected to acquire a slot for %s", busyOrigin)
+	}
+	if code := send(busyOrigin); code != http.StatusTooManyRequests {
+		t.Fatalf("expected HTTP %d for %s, got %d", http.StatusTooManyRequests, busyOrigin, code)
+	}
+
+	// Other origins aren't affected by the busy one.
+	if code := send(testOrigin); code != http.StatusOK {
+		t.Fatalf("expected HTTP %d for %s, got %d", http.StatusOK, testOrigin, code)
+	}
+
+	// Once the total limit is reached, every origin is rejected.
+	for _, origin := range []gomatrixserverlib.ServerName{"other1.server", "other2.server"} {
+		if !limiter.acquire(origin) {
+			t.Fatalf("expected to acquire a slot for %s", origin)
+		}
+	}
+	if code := send(testOrigin); code != http.StatusTooManyRequests {
+		t.Fatalf("expected HTTP %d for %s at the total limit, got %d", http.StatusTooManyRequests, testOrigin, code)
+	}
+
+	// Finishing the busy origin's transaction frees up its slot again.
+	limiter.release(busyOrigin)
+	if code := send(busyOrigin); code != http.StatusOK {
+		t.Fatalf("expected HTTP %d for %s, got %d", http.StatusOK, busyOrigin, code)
+	}
+}
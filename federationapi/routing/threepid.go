@@ -57,7 +57,7 @@ var (
 // CreateInvitesFrom3PIDInvites implements POST /_matrix/federation/v1/3pid/onbind
 func CreateInvitesFrom3PIDInvites(
 	req *http.Request, rsAPI api.FederationRoomserverAPI,
-	cfg *config.FederationAPI,
+	cfg *config.FederationAPI, membershipProfile *config.MembershipProfile,
 	federation federationAPI.FederationClient,
 	userAPI userapi.FederationUserAPI,
 ) util.JSONResponse {
@@ -78,7 +78,7 @@ func CreateInvitesFrom3PIDInvites(
 		}
 
 		event, err := createInviteFrom3PIDInvite(
-			req.Context(), rsAPI, cfg, inv, federation, userAPI,
+			req.Context(), rsAPI, cfg, membershipProfile, inv, federation, userAPI,
 		)
 		if err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("createInviteFrom3PIDInvite failed")
@@ -224,12 +224,14 @@ func ExchangeThirdPartyInvite(
 }
 
 // createInviteFrom3PIDInvite processes an invite provided by the identity server
-// and creates a m.room.member event (with "invite" membership) from it.
+// and creates a m.room.member event (with "invite" membership) from it. The
+// invited user's display name and avatar are left out of it if the server is
+// configured not to share them in membership events.
 // Returns an error if there was a problem building the event or fetching the
 // necessary data to do so.
 func createInviteFrom3PIDInvite(
 	ctx context.Context, rsAPI api.FederationRoomserverAPI,
-	cfg *config.FederationAPI,
+	cfg *config.FederationAPI, membershipProfile *config.MembershipProfile,
 	inv invite, federation federationAPI.FederationClient,
 	userAPI userapi.FederationUserAPI,
 ) (*gomatrixserverlib.Event, error) {
@@ -265,13 +267,17 @@ func createInviteFrom3PIDInvite(
 	}
 
 	content := gomatrixserverlib.MemberContent{
-		AvatarURL:   res.AvatarURL,
-		DisplayName: res.DisplayName,
-		Membership:  gomatrixserverlib.Invite,
+		Membership: gomatrixserverlib.Invite,
 		ThirdPartyInvite: &gomatrixserverlib.MemberThirdPartyInvite{
 			Signed: inv.Signed,
 		},
 	}
+	if !membershipProfile.StripDisplayName {
+		content.DisplayName = res.DisplayName
+	}
+	if !membershipProfile.StripAvatarURL {
+		content.AvatarURL = res.AvatarURL
+	}
 
 	if err = builder.SetContent(content); err != nil {
 		return nil, err
@@ -390,7 +396,8 @@ func sendToRemoteServer(
 // event with the state key matching a given m.room.member event's content's token.
 // If such an event is found, fills the "display_name" attribute of the
 // "third_party_invite" structure in the m.room.member event with the display_name
-// from the m.room.third_party_invite event.
+// from the m.room.third_party_invite event. The display_name is usually an
+// obfuscated 3PID, so it isn't used as the m.room.member event's "displayname".
 // Returns an error if there was a problem parsing the m.room.third_party_invite
 // event's content or updating the m.room.member event's content.
 // Returns nil if no m.room.third_party_invite with a matching token could be
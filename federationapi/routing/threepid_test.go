@@ -0,0 +1,223 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+type threePIDRoomserverAPI struct {
+	api.FederationRoomserverAPI
+	room   *test.Room
+	inputs []api.InputRoomEvent
+}
+
+func (r *threePIDRoomserverAPI) QueryRoomVersionForRoom(_ context.Context, _ *api.QueryRoomVersionForRoomRequest, res *api.QueryRoomVersionForRoomResponse) error {
+	res.RoomVersion = r.room.Version
+	return nil
+}
+
+func (r *threePIDRoomserverAPI) QueryLatestEventsAndState(_ context.Context, _ *api.QueryLatestEventsAndStateRequest, res *api.QueryLatestEventsAndStateResponse) error {
+	latest := r.room.Events()[len(r.room.Events())-1]
+	res.RoomExists = true
+	res.RoomVersion = r.room.Version
+	res.Depth = latest.Depth() + 1
+	res.LatestEvents = []gomatrixserverlib.EventReference{latest.EventReference()}
+	res.StateEvents = r.room.CurrentState()
+	return nil
+}
+
+func (r *threePIDRoomserverAPI) InputRoomEvents(_ context.Context, req *api.InputRoomEventsRequest, _ *api.InputRoomEventsResponse) error {
+	r.inputs = append(r.inputs, req.InputRoomEvents...)
+	return nil
+}
+
+// threePIDFedClient signs invites as the invited user's server would, by
+// returning them unchanged.
+type threePIDFedClient struct {
+	federationAPI.FederationClient
+}
+
+func (f *threePIDFedClient) SendInviteV2(_ context.Context, _, _ gomatrixserverlib.ServerName, req gomatrixserverlib.InviteV2Request) (gomatrixserverlib.RespInviteV2, error) {
+	return gomatrixserverlib.RespInviteV2{Event: req.Event().JSON()}, nil
+}
+
+func TestExchangeThirdPartyInviteDisplayName(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	token := "atoken"
+	room.CreateAndInsert(t, alice, "m.room.third_party_invite", gomatrixserverlib.ThirdPartyInviteContent{
+		DisplayName:    "b...@example.com",
+		KeyValidityURL: "https://identity.example.com/_matrix/identity/v2/pubkey/isvalid",
+		PublicKey:      "apublickey",
+	}, test.WithStateKey(token))
+
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			SigningIdentity: gomatrixserverlib.SigningIdentity{
+				ServerName: "test",
+				KeyID:      "ed25519:test",
+				PrivateKey: test.PrivateKeyA,
+			},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		displayName     string
+		wantDisplayName string
+	}{
+		{
+			name:            "invite display name isn't used as displayname",
+			wantDisplayName: "",
+		},
+		{
+			name:            "own display name is kept",
+			displayName:     "Bob",
+			wantDisplayName: "Bob",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bob := "@bob:remote"
+			builder := gomatrixserverlib.EventBuilder{
+				Type:     gomatrixserverlib.MRoomMember,
+				Sender:   alice.ID,
+				RoomID:   room.ID,
+				StateKey: &bob,
+			}
+			if err := builder.SetContent(gomatrixserverlib.MemberContent{
+				Membership:  gomatrixserverlib.Invite,
+				DisplayName: tt.displayName,
+				ThirdPartyInvite: &gomatrixserverlib.MemberThirdPartyInvite{
+					Signed: gomatrixserverlib.MemberThirdPartyInviteSigned{
+						MXID:  bob,
+						Token: token,
+					},
+				},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			fedReq := gomatrixserverlib.NewFederationRequest(http.MethodPut, "remote", "test", "/exchange_third_party_invite/"+room.ID)
+			if err := fedReq.SetContent(builder); err != nil {
+				t.Fatal(err)
+			}
+
+			rsAPI := &threePIDRoomserverAPI{room: room}
+			httpReq := httptest.NewRequest(http.MethodPut, "/exchange_third_party_invite/"+room.ID, nil)
+			res := ExchangeThirdPartyInvite(httpReq, &fedReq, room.ID, rsAPI, cfg, &threePIDFedClient{})
+			if res.Code != http.StatusOK {
+				t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+			}
+			if len(rsAPI.inputs) != 1 {
+				t.Fatalf("expected 1 event to be sent to the roomserver, got %d", len(rsAPI.inputs))
+			}
+
+			var content gomatrixserverlib.MemberContent
+			if err := json.Unmarshal(rsAPI.inputs[0].Event.Content(), &content); err != nil {
+				t.Fatal(err)
+			}
+			if content.Membership != gomatrixserverlib.Invite {
+				t.Fatalf("expected an invite, got membership %q", content.Membership)
+			}
+			if content.DisplayName != tt.wantDisplayName {
+				t.Fatalf("expected displayname %q, got %q", tt.wantDisplayName, content.DisplayName)
+			}
+			if content.ThirdPartyInvite == nil || content.ThirdPartyInvite.DisplayName != "b...@example.com" {
+				t.Fatalf("expected the third party invite display name to be kept, got %+v", content.ThirdPartyInvite)
+			}
+		})
+	}
+}
+
+type threePIDUserAPI struct {
+	userapi.FederationUserAPI
+}
+
+func (u *threePIDUserAPI) QueryProfile(_ context.Context, _ *userapi.QueryProfileRequest, res *userapi.QueryProfileResponse) error {
+	res.UserExists = true
+	res.DisplayName = "Bob"
+	res.AvatarURL = "mxc://test/bob"
+	return nil
+}
+
+func TestCreateInviteFrom3PIDInviteMembershipProfile(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+
+	cfg := &config.FederationAPI{
+		Matrix: &config.Global{
+			SigningIdentity: gomatrixserverlib.SigningIdentity{
+				ServerName: "test",
+				KeyID:      "ed25519:test",
+				PrivateKey: test.PrivateKeyA,
+			},
+		},
+	}
+
+	tests := []struct {
+		name              string
+		membershipProfile config.MembershipProfile
+		wantDisplayName   string
+		wantAvatarURL     string
+	}{
+		{
+			name:            "profile is copied",
+			wantDisplayName: "Bob",
+			wantAvatarURL:   "mxc://test/bob",
+		},
+		{
+			name:              "display name is stripped",
+			membershipProfile: config.MembershipProfile{StripDisplayName: true},
+			wantAvatarURL:     "mxc://test/bob",
+		},
+		{
+			name:              "avatar is stripped",
+			membershipProfile: config.MembershipProfile{StripAvatarURL: true},
+			wantDisplayName:   "Bob",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bob := "@bob:test"
+			inv := invite{
+				MXID:   bob,
+				RoomID: room.ID,
+				Sender: alice.ID,
+				Token:  "atoken",
+				Signed: gomatrixserverlib.MemberThirdPartyInviteSigned{
+					MXID:  bob,
+					Token: "atoken",
+				},
+			}
+			event, err := createInviteFrom3PIDInvite(
+				context.Background(), &threePIDRoomserverAPI{room: room}, cfg, &tt.membershipProfile,
+				inv, &threePIDFedClient{}, &threePIDUserAPI{},
+			)
+			if err != nil {
+				t.Fatalf("failed to create invite: %s", err)
+			}
+
+			var content gomatrixserverlib.MemberContent
+			if err = json.Unmarshal(event.Content(), &content); err != nil {
+				t.Fatal(err)
+			}
+			if content.DisplayName != tt.wantDisplayName {
+				t.Fatalf("expected displayname %q, got %q", tt.wantDisplayName, content.DisplayName)
+			}
+			if content.AvatarURL != tt.wantAvatarURL {
+				t.Fatalf("expected avatar_url %q, got %q", tt.wantAvatarURL, content.AvatarURL)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+type timestampToEventResponse struct {
+	EventID        string                      `json:"event_id"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
+// TimestampToEvent implements GET /_matrix/federation/v1/timestamp_to_event/{roomID}
+// https://spec.matrix.org/v1.6/server-server-api/#get_matrixfederationv1timestamp_to_eventroomid
+func TimestampToEvent(
+	httpReq *http.Request,
+	rsAPI api.FederationRoomserverAPI,
+	roomID string,
+) util.JSONResponse {
+	if _, _, err := gomatrixserverlib.SplitID('!', roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Bad room ID: " + err.Error()),
+		}
+	}
+
+	query := httpReq.URL.Query()
+	ts, err := strconv.ParseUint(query.Get("ts"), 10, 64)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("ts must be a timestamp in milliseconds"),
+		}
+	}
+	dir := query.Get("dir")
+	if dir != "f" && dir != "b" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("dir must be either 'f' or 'b'"),
+		}
+	}
+
+	// If we don't think we belong to this room then we can't answer.
+	if jsonErr := ErrorIfLocalServerNotInRoom(httpReq.Context(), rsAPI, roomID); jsonErr != nil {
+		return *jsonErr
+	}
+
+	var res api.QueryEventByTimestampResponse
+	if err = rsAPI.QueryEventByTimestamp(httpReq.Context(), &api.QueryEventByTimestampRequest{
+		RoomID:    roomID,
+		Timestamp: gomatrixserverlib.Timestamp(ts),
+		Backwards: dir == "b",
+	}, &res); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryEventByTimestamp failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.EventID == "" {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Unable to find event from %d in direction %s", ts, dir)),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: timestampToEventResponse{
+			EventID:        res.EventID,
+			OriginServerTS: res.OriginServerTS,
+		},
+	}
+}
@@ -0,0 +1,99 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/roomserver"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+)
+
+func TestTimestampToEvent(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+		rsAPI := roomserver.NewInternalAPI(base)
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(nil, nil)
+
+		alice := test.NewUser(t)
+		room := test.NewRoom(t, alice)
+		start := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+		first := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "first"}, test.WithTimestamp(start))
+		second := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "second"}, test.WithTimestamp(start.Add(time.Minute)))
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		tests := []struct {
+			name      string
+			ts        time.Time
+			dir       string
+			wantEvent *gomatrixserverlib.HeaderedEvent
+		}{
+			{name: "forwards from an event", ts: start, dir: "f", wantEvent: first},
+			{name: "forwards between events", ts: start.Add(time.Second), dir: "f", wantEvent: second},
+			{name: "forwards after last event", ts: start.Add(time.Hour), dir: "f"},
+			{name: "backwards between events", ts: start.Add(time.Second), dir: "b", wantEvent: first},
+			{name: "backwards after last event", ts: start.Add(time.Hour), dir: "b", wantEvent: second},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				ts := gomatrixserverlib.AsTimestamp(tt.ts)
+				local := api.QueryEventByTimestampResponse{}
+				if err := rsAPI.QueryEventByTimestamp(context.Background(), &api.QueryEventByTimestampRequest{
+					RoomID:    room.ID,
+					Timestamp: ts,
+					Backwards: tt.dir == "b",
+				}, &local); err != nil {
+					t.Fatalf("failed to query event by timestamp: %v", err)
+				}
+
+				req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/timestamp_to_event/%s?ts=%d&dir=%s", room.ID, ts, tt.dir), nil)
+				res := TimestampToEvent(req, rsAPI, room.ID)
+
+				if tt.wantEvent == nil {
+					if local.EventID != "" {
+						t.Fatalf("expected no local event, got %s", local.EventID)
+					}
+					if res.Code != http.StatusNotFound {
+						t.Fatalf("expected HTTP 404, got %d: %+v", res.Code, res.JSON)
+					}
+					return
+				}
+				if local.EventID != tt.wantEvent.EventID() || local.OriginServerTS != tt.wantEvent.OriginServerTS() {
+					t.Fatalf("expected local event %s at %d, got %s at %d", tt.wantEvent.EventID(), tt.wantEvent.OriginServerTS(), local.EventID, local.OriginServerTS)
+				}
+				if res.Code != http.StatusOK {
+					t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+				}
+				federated := res.JSON.(timestampToEventResponse)
+				if federated.EventID != local.EventID || federated.OriginServerTS != local.OriginServerTS {
+					t.Fatalf("federated response %+v doesn't match local response %+v", federated, local)
+				}
+			})
+		}
+
+		t.Run("invalid direction", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/timestamp_to_event/%s?ts=0&dir=x", room.ID), nil)
+			if res := TimestampToEvent(req, rsAPI, room.ID); res.Code != http.StatusBadRequest {
+				t.Fatalf("expected HTTP 400, got %d", res.Code)
+			}
+		})
+
+		t.Run("unknown room", func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/timestamp_to_event/!unknown:test?ts=0&dir=f", nil)
+			if res := TimestampToEvent(req, rsAPI, "!unknown:test"); res.Code != http.StatusNotFound {
+				t.Fatalf("expected HTTP 404, got %d", res.Code)
+			}
+		})
+	})
+}
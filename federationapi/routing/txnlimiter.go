@@ -0,0 +1,100 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"sync"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+const (
+	// The transaction was rejected because its origin had too many in flight
+	txnRejectedOrigin = "origin"
+	// The transaction was rejected because too many were in flight in total
+	txnRejectedTotal = "total"
+)
+
+var (
+	txnsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "recv_txns_in_flight",
+			Help:      "Number of incoming transactions currently being processed",
+		},
+	)
+	txnsRejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "federationapi",
+			Name:      "recv_txns_rejected",
+			Help:      "Number of incoming transactions rejected because too many were being processed",
+		},
+		[]string{"limit"}, // 'origin' or 'total'
+	)
+)
+
+// transactionLimiter limits how many inbound transactions are processed at
+// the same time, both in total and per origin.
+type transactionLimiter struct {
+	mu           sync.Mutex
+	maxTotal     int
+	maxPerOrigin int
+	total        int
+	perOrigin    map[gomatrixserverlib.ServerName]int
+}
+
+func newTransactionLimiter(cfg *config.FederationAPI) *transactionLimiter {
+	return &transactionLimiter{
+		maxTotal:     cfg.MaxConcurrentTransactions,
+		maxPerOrigin: cfg.MaxConcurrentTransactionsPerOrigin,
+		perOrigin:    make(map[gomatrixserverlib.ServerName]int),
+	}
+}
+
+// acquire reserves a slot for processing a transaction from the given origin,
+// returning false if either limit has been reached. Every successful call must
+// be followed by a call to release.
+func (l *transactionLimiter) acquire(origin gomatrixserverlib.ServerName) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxPerOrigin > 0 && l.perOrigin[origin] >= l.maxPerOrigin {
+		txnsRejectedTotal.WithLabelValues(txnRejectedOrigin).Inc()
+		return false
+	}
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		txnsRejectedTotal.WithLabelValues(txnRejectedTotal).Inc()
+		return false
+	}
+	l.total++
+	l.perOrigin[origin]++
+	txnsInFlight.Inc()
+	return true
+}
+
+// release frees a slot reserved with acquire.
+func (l *transactionLimiter) release(origin gomatrixserverlib.ServerName) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perOrigin[origin]--; l.perOrigin[origin] <= 0 {
+		delete(l.perOrigin, origin)
+	}
+	txnsInFlight.Dec()
+}
@@ -0,0 +1,106 @@
+package statistics
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreakerState is the state of a CircuitBreaker.
+type CircuitBreakerState string
+
+const (
+	// Requests are sent as usual.
+	CircuitBreakerClosed CircuitBreakerState = "closed"
+	// Requests are refused without being sent.
+	CircuitBreakerOpen CircuitBreakerState = "open"
+	// A single request is being sent to find out whether the host has
+	// recovered, and all others are refused until it completes.
+	CircuitBreakerHalfOpen CircuitBreakerState = "half_open"
+)
+
+// CircuitBreaker stops requests from being sent to a remote host after
+// too many of them failed in a row. Once the breaker has been open for a
+// while, it half-opens to let a single request through: if that succeeds
+// then the breaker closes again, otherwise it stays open for another while.
+// A nil CircuitBreaker is disabled and always lets requests through.
+type CircuitBreaker struct {
+	threshold    uint32           // consecutive failures which open the breaker
+	openDuration time.Duration    // how long the breaker stays open
+	now          func() time.Time // replaced in tests
+	mutex        sync.Mutex
+	state        CircuitBreakerState
+	failures     uint32    // consecutive failures so far
+	openUntil    time.Time // when an open breaker half-opens
+}
+
+func NewCircuitBreaker(threshold uint32, openDuration time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold:    threshold,
+		openDuration: openDuration,
+		now:          time.Now,
+		state:        CircuitBreakerClosed,
+	}
+}
+
+// Allow returns whether a request may be sent. If it does, the outcome of
+// the request must be reported with Success or Failure afterwards.
+func (b *CircuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case CircuitBreakerOpen:
+		if b.now().Before(b.openUntil) {
+			return false
+		}
+		b.state = CircuitBreakerHalfOpen
+		return true
+	case CircuitBreakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// Success reports that a request succeeded, which closes the breaker.
+func (b *CircuitBreaker) Success() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.state = CircuitBreakerClosed
+	b.failures = 0
+}
+
+// Failure reports that a request failed, which opens the breaker if it
+// was half-open or if there have now been too many failures in a row.
+func (b *CircuitBreaker) Failure() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.state == CircuitBreakerHalfOpen || b.failures >= b.threshold {
+		b.state = CircuitBreakerOpen
+		b.openUntil = b.now().Add(b.openDuration)
+	}
+}
+
+// Status returns the state of the breaker, the number of requests which
+// failed in a row and, if the breaker is open, when it will half-open.
+func (b *CircuitBreaker) Status() (CircuitBreakerState, uint32, *time.Time) {
+	if b == nil {
+		return CircuitBreakerClosed, 0, nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state != CircuitBreakerOpen {
+		return b.state, b.failures, nil
+	}
+	openUntil := b.openUntil
+	return b.state, b.failures, &openUntil
+}
@@ -0,0 +1,83 @@
+package statistics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breaker := NewCircuitBreaker(3, time.Minute)
+	breaker.now = func() time.Time { return now }
+
+	wantStatus := func(wantState CircuitBreakerState, wantFailures uint32) {
+		t.Helper()
+		state, failures, openUntil := breaker.Status()
+		if state != wantState || failures != wantFailures {
+			t.Fatalf("expected state %q with %d failures, got %q with %d failures", wantState, wantFailures, state, failures)
+		}
+		if (state == CircuitBreakerOpen) != (openUntil != nil) {
+			t.Fatalf("expected an open until time only for an open breaker, got %v", openUntil)
+		}
+	}
+
+	// A closed breaker lets requests through until enough fail in a row.
+	for i := uint32(1); i < 3; i++ {
+		if !breaker.Allow() {
+			t.Fatalf("expected request %d to be allowed", i)
+		}
+		breaker.Failure()
+		wantStatus(CircuitBreakerClosed, i)
+	}
+	breaker.Success()
+	wantStatus(CircuitBreakerClosed, 0)
+	for i := uint32(1); i <= 3; i++ {
+		breaker.Allow()
+		breaker.Failure()
+	}
+	wantStatus(CircuitBreakerOpen, 3)
+
+	// An open breaker refuses requests until it half-opens.
+	if breaker.Allow() {
+		t.Fatalf("expected an open breaker to refuse requests")
+	}
+	now = now.Add(time.Minute)
+	if !breaker.Allow() {
+		t.Fatalf("expected the breaker to let a request through to probe the server")
+	}
+	wantStatus(CircuitBreakerHalfOpen, 3)
+	if breaker.Allow() {
+		t.Fatalf("expected a half-open breaker to refuse requests while probing")
+	}
+
+	// A failed probe opens the breaker again.
+	breaker.Failure()
+	wantStatus(CircuitBreakerOpen, 4)
+	if breaker.Allow() {
+		t.Fatalf("expected the breaker to be open again")
+	}
+
+	// A successful probe closes the breaker.
+	now = now.Add(time.Minute)
+	if !breaker.Allow() {
+		t.Fatalf("expected the breaker to let a request through to probe the server")
+	}
+	breaker.Success()
+	wantStatus(CircuitBreakerClosed, 0)
+	if !breaker.Allow() {
+		t.Fatalf("expected a closed breaker to let requests through")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	var breaker *CircuitBreaker
+	for i := 0; i < 10; i++ {
+		breaker.Failure()
+		if !breaker.Allow() {
+			t.Fatalf("expected a disabled breaker to let requests through")
+		}
+	}
+	if state, _, _ := breaker.Status(); state != CircuitBreakerClosed {
+		t.Fatalf("expected a disabled breaker to be closed, got %q", state)
+	}
+}
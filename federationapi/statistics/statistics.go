@@ -28,6 +28,13 @@ type Statistics struct {
 	// just blacklist the host altogether? The backoff is exponential,
 	// so the max time here to attempt is 2**failures seconds.
 	FailuresUntilBlacklist uint32
+
+	// How many requests to a host must fail in a row to open its circuit
+	// breaker, and how long the breaker then stays open before letting a
+	// request through to find out whether the host has recovered. If the
+	// threshold is 0, circuit breakers are disabled.
+	CircuitBreakerThreshold    uint32
+	CircuitBreakerOpenDuration time.Duration
 }
 
 func NewStatistics(db storage.Database, failuresUntilBlacklist uint32) Statistics {
@@ -53,6 +60,9 @@ func (s *Statistics) ForServer(serverName gomatrixserverlib.ServerName) *ServerS
 			statistics: s,
 			serverName: serverName,
 		}
+		if s.CircuitBreakerThreshold > 0 {
+			server.circuitBreaker = NewCircuitBreaker(s.CircuitBreakerThreshold, s.CircuitBreakerOpenDuration)
+		}
 		s.servers[serverName] = server
 		s.mutex.Unlock()
 		blacklisted, err := s.DB.IsServerBlacklisted(serverName)
@@ -78,6 +88,7 @@ type ServerStatistics struct {
 	backoffCount    atomic.Uint32                // number of times BackoffDuration has been called
 	successCounter  atomic.Uint32                // how many times have we succeeded?
 	backoffNotifier func()                       // notifies destination queue when backoff completes
+	circuitBreaker  *CircuitBreaker              // nil if circuit breakers are disabled
 	notifierMutex   sync.Mutex
 }
 
@@ -217,3 +228,9 @@ func (s *ServerStatistics) RemoveBlacklist() {
 func (s *ServerStatistics) SuccessCount() uint32 {
 	return s.successCounter.Load()
 }
+
+// CircuitBreaker returns the circuit breaker for requests to the server,
+// which is nil if circuit breakers are disabled.
+func (s *ServerStatistics) CircuitBreaker() *CircuitBreaker {
+	return s.circuitBreaker
+}
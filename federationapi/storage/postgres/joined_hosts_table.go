@@ -63,6 +63,9 @@ const selectJoinedHostsSQL = "" +
 const selectAllJoinedHostsSQL = "" +
 	"SELECT DISTINCT server_name FROM federationsender_joined_hosts"
 
+const selectJoinedRoomsSQL = "" +
+	"SELECT DISTINCT room_id FROM federationsender_joined_hosts ORDER BY room_id"
+
 const selectJoinedHostsForRoomsSQL = "" +
 	"SELECT DISTINCT server_name FROM federationsender_joined_hosts WHERE room_id = ANY($1)"
 
@@ -78,6 +81,7 @@ type joinedHostsStatements struct {
 	deleteJoinedHostsForRoomStmt                      *sql.Stmt
 	selectJoinedHostsStmt                             *sql.Stmt
 	selectAllJoinedHostsStmt                          *sql.Stmt
+	selectJoinedRoomsStmt                             *sql.Stmt
 	selectJoinedHostsForRoomsStmt                     *sql.Stmt
 	selectJoinedHostsForRoomsExcludingBlacklistedStmt *sql.Stmt
 }
@@ -105,6 +109,9 @@ func NewPostgresJoinedHostsTable(db *sql.DB) (s *joinedHostsStatements, err erro
 	if s.selectAllJoinedHostsStmt, err = s.db.Prepare(selectAllJoinedHostsSQL); err != nil {
 		return
 	}
+	if s.selectJoinedRoomsStmt, err = s.db.Prepare(selectJoinedRoomsSQL); err != nil {
+		return
+	}
 	if s.selectJoinedHostsForRoomsStmt, err = s.db.Prepare(selectJoinedHostsForRoomsSQL); err != nil {
 		return
 	}
@@ -175,6 +182,27 @@ func (s *joinedHostsStatements) SelectAllJoinedHosts(
 	return result, rows.Err()
 }
 
+func (s *joinedHostsStatements) SelectJoinedRooms(
+	ctx context.Context,
+) ([]string, error) {
+	rows, err := s.selectJoinedRoomsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectJoinedRooms: rows.close() failed")
+
+	var result []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		result = append(result, roomID)
+	}
+
+	return result, rows.Err()
+}
+
 func (s *joinedHostsStatements) SelectJoinedHostsForRooms(
 	ctx context.Context, roomIDs []string, excludingBlacklisted bool,
 ) ([]gomatrixserverlib.ServerName, error) {
@@ -117,6 +117,13 @@ func (d *Database) GetAllJoinedHosts(ctx context.Context) ([]gomatrixserverlib.S
 	return d.FederationJoinedHosts.SelectAllJoinedHosts(ctx)
 }
 
+// GetJoinedRooms returns the IDs of all rooms known to the
+// federation sender which have joined hosts, ordered by room ID.
+// Returns an error if something goes wrong.
+func (d *Database) GetJoinedRooms(ctx context.Context) ([]string, error) {
+	return d.FederationJoinedHosts.SelectJoinedRooms(ctx)
+}
+
 func (d *Database) GetJoinedHostsForRooms(ctx context.Context, roomIDs []string, excludeSelf, excludeBlacklisted bool) ([]gomatrixserverlib.ServerName, error) {
 	servers, err := d.FederationJoinedHosts.SelectJoinedHostsForRooms(ctx, roomIDs, excludeBlacklisted)
 	if err != nil {
@@ -2,6 +2,7 @@ package storage_test
 
 import (
 	"context"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
@@ -11,6 +12,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/matrix-org/dendrite/federationapi/storage"
+	"github.com/matrix-org/dendrite/federationapi/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/dendrite/test/testrig"
@@ -246,3 +248,24 @@ func TestInboundPeeking(t *testing.T) {
 		assert.ElementsMatch(t, gotPeekIDs, peekIDs)
 	})
 }
+
+func TestGetJoinedRooms(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateFederationDatabase(t, dbType)
+		defer close()
+		for i, roomID := range []string{"!c:localhost", "!a:localhost", "!b:localhost"} {
+			if _, err := db.UpdateRoom(ctx, roomID, []types.JoinedHost{
+				{MemberEventID: fmt.Sprintf("$local%d", i), ServerName: "localhost"},
+				{MemberEventID: fmt.Sprintf("$remote%d", i), ServerName: "remote"},
+			}, nil, false); err != nil {
+				t.Fatalf("UpdateRoom returned %s", err)
+			}
+		}
+		roomIDs, err := db.GetJoinedRooms(ctx)
+		if err != nil {
+			t.Fatalf("GetJoinedRooms returned %s", err)
+		}
+		assert.Equal(t, []string{"!a:localhost", "!b:localhost", "!c:localhost"}, roomIDs)
+	})
+}
@@ -0,0 +1,177 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package caching
+
+import (
+	"container/list"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	lruHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "caching_lru",
+		Name:      "hits_total",
+		Help:      "Number of lookups which found an entry in the cache",
+	}, []string{"cache"})
+	lruMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "caching_lru",
+		Name:      "misses_total",
+		Help:      "Number of lookups which didn't find an entry in the cache",
+	}, []string{"cache"})
+	lruEvictions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "caching_lru",
+		Name:      "evictions_total",
+		Help:      "Number of entries evicted because the cache was full",
+	}, []string{"cache"})
+	lruMetricsOnce sync.Once
+)
+
+// NewCaches creates the caches as configured. Caches with a maximum number
+// of entries get their own LRU cache, and the rest share a ristretto cache
+// bounded by the estimated maximum size.
+func NewCaches(cfg *config.Cache, enablePrometheus bool) *Caches {
+	caches := NewRistrettoCache(cfg.EstimatedMaxSize, cfg.MaxAge, enablePrometheus)
+	if enablePrometheus {
+		lruMetricsOnce.Do(func() {
+			prometheus.MustRegister(lruHits, lruMisses, lruEvictions)
+		})
+	}
+	if n := cfg.MaxEntries.RoomVersions; n > 0 {
+		caches.RoomVersions = NewLRUCache[string, gomatrixserverlib.RoomVersion]("room_versions", n, cfg.MaxAge, false)
+	}
+	if n := cfg.MaxEntries.ServerKeys; n > 0 {
+		caches.ServerKeys = NewLRUCache[string, gomatrixserverlib.PublicKeyLookupResult]("server_keys", n, cfg.MaxAge, true)
+	}
+	if n := cfg.MaxEntries.EventStateKeys; n > 0 {
+		caches.RoomServerStateKeys = NewLRUCache[types.EventStateKeyNID, string]("event_state_keys", n, cfg.MaxAge, false)
+	}
+	if n := cfg.MaxEntries.LazyLoading; n > 0 {
+		caches.LazyLoading = NewLRUCache[lazyLoadingCacheKey, string]("lazy_loading", n, cfg.MaxAge, true)
+	}
+	return caches
+}
+
+// LRUCache is a cache holding at most a fixed number of entries, which evicts
+// the least recently used entry to make room for a new one.
+type LRUCache[K comparable, V any] struct {
+	sync.Mutex
+	name       string
+	maxEntries int
+	maxAge     time.Duration
+	mutable    bool
+	entries    map[K]*list.Element
+	order      *list.List // most recently used at the front
+}
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// NewLRUCache creates an LRUCache holding at most maxEntries entries, each of
+// which expires after maxAge if it is positive. As with the ristretto caches,
+// changing the value of an entry in an immutable cache panics.
+func NewLRUCache[K comparable, V any](name string, maxEntries int, maxAge time.Duration, mutable bool) *LRUCache[K, V] {
+	return &LRUCache[K, V]{
+		name:       name,
+		maxEntries: maxEntries,
+		maxAge:     maxAge,
+		mutable:    mutable,
+		entries:    make(map[K]*list.Element, maxEntries),
+		order:      list.New(),
+	}
+}
+
+func (c *LRUCache[K, V]) Get(key K) (value V, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	element, ok := c.entries[key]
+	if ok {
+		entry := element.Value.(*lruEntry[K, V])
+		if c.maxAge > 0 && time.Now().After(entry.expires) {
+			c.remove(element)
+			ok = false
+		} else {
+			c.order.MoveToFront(element)
+			lruHits.WithLabelValues(c.name).Inc()
+			return entry.value, true
+		}
+	}
+	lruMisses.WithLabelValues(c.name).Inc()
+	return value, false
+}
+
+func (c *LRUCache[K, V]) Set(key K, value V) {
+	c.Lock()
+	defer c.Unlock()
+	var expires time.Time
+	if c.maxAge > 0 {
+		expires = time.Now().Add(c.maxAge)
+	}
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*lruEntry[K, V])
+		if !c.mutable && !reflect.DeepEqual(entry.value, value) {
+			panic(fmt.Sprintf("invalid use of immutable cache tries to change value of %v from %v to %v", key, entry.value, value))
+		}
+		entry.value, entry.expires = value, expires
+		c.order.MoveToFront(element)
+		return
+	}
+	for c.order.Len() >= c.maxEntries {
+		c.remove(c.order.Back())
+		lruEvictions.WithLabelValues(c.name).Inc()
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[K, V]{
+		key:     key,
+		value:   value,
+		expires: expires,
+	})
+}
+
+func (c *LRUCache[K, V]) Unset(key K) {
+	if !c.mutable {
+		panic(fmt.Sprintf("invalid use of immutable cache tries to unset value of %v", key))
+	}
+	c.Lock()
+	defer c.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// Len returns the number of entries in the cache, including any which have
+// expired but not yet been removed.
+func (c *LRUCache[K, V]) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
+
+func (c *LRUCache[K, V]) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*lruEntry[K, V]).key)
+}
@@ -0,0 +1,84 @@
+package caching
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestLRUCacheBoundedSize(t *testing.T) {
+	cache := NewLRUCache[int, string]("test", 3, time.Hour, true)
+	for i := 0; i < 3; i++ {
+		cache.Set(i, "value")
+	}
+	// Using 0 makes 1 the least recently used entry.
+	if _, ok := cache.Get(0); !ok {
+		t.Fatalf("expected entry 0 to be cached")
+	}
+	cache.Set(3, "value")
+
+	if got := cache.Len(); got != 3 {
+		t.Fatalf("expected the cache to hold 3 entries, got %d", got)
+	}
+	if _, ok := cache.Get(1); ok {
+		t.Fatalf("expected the least recently used entry to be evicted")
+	}
+	for _, key := range []int{0, 2, 3} {
+		if _, ok := cache.Get(key); !ok {
+			t.Fatalf("expected entry %d to be cached", key)
+		}
+	}
+
+	cache.Unset(0)
+	if _, ok := cache.Get(0); ok {
+		t.Fatalf("expected entry 0 to be removed")
+	}
+}
+
+func TestLRUCacheExpiry(t *testing.T) {
+	cache := NewLRUCache[string, string]("test", 10, time.Millisecond, false)
+	cache.Set("key", "value")
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := cache.Get("key"); ok {
+		t.Fatalf("expected entry to have expired")
+	}
+	if got := cache.Len(); got != 0 {
+		t.Fatalf("expected expired entry to be removed, got %d entries", got)
+	}
+}
+
+func TestLRUCacheImmutable(t *testing.T) {
+	cache := NewLRUCache[string, string]("test", 10, time.Hour, false)
+	cache.Set("key", "value")
+	cache.Set("key", "value") // setting the same value is fine
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected changing an immutable value to panic")
+		}
+	}()
+	cache.Set("key", "other")
+}
+
+func TestNewCachesMaxEntries(t *testing.T) {
+	cfg := &config.Cache{}
+	cfg.Defaults()
+	cfg.EstimatedMaxSize = 1024 * 1024
+	cfg.MaxEntries.RoomVersions = 5
+
+	caches := NewCaches(cfg, false)
+	roomVersions, ok := caches.RoomVersions.(*LRUCache[string, gomatrixserverlib.RoomVersion])
+	if !ok {
+		t.Fatalf("expected the room versions cache to be an LRU cache, got %T", caches.RoomVersions)
+	}
+	if _, ok = caches.ServerKeys.(*LRUCache[string, gomatrixserverlib.PublicKeyLookupResult]); ok {
+		t.Fatalf("expected the server keys cache to be shared")
+	}
+	for i := 0; i < 10; i++ {
+		caches.StoreRoomVersion(string(rune('a'+i)), gomatrixserverlib.RoomVersionV10)
+	}
+	if got := roomVersions.Len(); got != 5 {
+		t.Fatalf("expected the configured size to bound the cache to 5 entries, got %d", got)
+	}
+}
@@ -70,6 +70,20 @@ func NewRistrettoCache(maxCost config.DataUnit, maxAge time.Duration, enableProm
 		}, func() float64 {
 			return float64(cache.Metrics.CostAdded() - cache.Metrics.CostEvicted())
 		})
+		promauto.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "caching_ristretto",
+			Name:      "hits_total",
+		}, func() float64 {
+			return float64(cache.Metrics.Hits())
+		})
+		promauto.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "dendrite",
+			Subsystem: "caching_ristretto",
+			Name:      "misses_total",
+		}, func() float64 {
+			return float64(cache.Metrics.Misses())
+		})
 	}
 	return &Caches{
 		RoomVersions: &RistrettoCachePartition[string, gomatrixserverlib.RoomVersion]{ // room ID -> room version
@@ -62,7 +62,7 @@ func BuildEvent(
 	identity *gomatrixserverlib.SigningIdentity, evTime time.Time,
 	eventsNeeded *gomatrixserverlib.StateNeeded, queryRes *api.QueryLatestEventsAndStateResponse,
 ) (*gomatrixserverlib.HeaderedEvent, error) {
-	if err := addPrevEventsToEvent(builder, eventsNeeded, queryRes); err != nil {
+	if err := addPrevEventsToEvent(builder, eventsNeeded, queryRes, &cfg.EventLimits); err != nil {
 		return nil, err
 	}
 
@@ -105,6 +105,7 @@ func addPrevEventsToEvent(
 	builder *gomatrixserverlib.EventBuilder,
 	eventsNeeded *gomatrixserverlib.StateNeeded,
 	queryRes *api.QueryLatestEventsAndStateResponse,
+	limits *config.EventLimits,
 ) error {
 	if !queryRes.RoomExists {
 		return ErrRoomNoExists
@@ -131,7 +132,7 @@ func addPrevEventsToEvent(
 		return fmt.Errorf("eventsNeeded.AuthEventReferences: %w", err)
 	}
 
-	truncAuth, truncPrev := truncateAuthAndPrevEvents(refs, queryRes.LatestEvents)
+	truncAuth, truncPrev := truncateAuthAndPrevEvents(refs, queryRes.LatestEvents, limits)
 	switch eventFormat {
 	case gomatrixserverlib.EventFormatV1:
 		builder.AuthEvents = truncAuth
@@ -152,23 +153,37 @@ func addPrevEventsToEvent(
 }
 
 // truncateAuthAndPrevEvents limits the number of events we add into
-// an event as prev_events or auth_events.
-// NOTSPEC: The limits here feel a bit arbitrary but they are currently
-// here because of https://github.com/matrix-org/matrix-doc/issues/2307
-// and because Synapse will just drop events that don't comply.
-func truncateAuthAndPrevEvents(auth, prev []gomatrixserverlib.EventReference) (
+// an event as prev_events or auth_events, so that we don't create events
+// which we or other servers would reject.
+func truncateAuthAndPrevEvents(auth, prev []gomatrixserverlib.EventReference, limits *config.EventLimits) (
 	truncAuth, truncPrev []gomatrixserverlib.EventReference,
 ) {
 	truncAuth, truncPrev = auth, prev
-	if len(truncAuth) > 10 {
-		truncAuth = truncAuth[:10]
+	if limits.MaxAuthEvents > 0 && len(truncAuth) > limits.MaxAuthEvents {
+		truncAuth = truncAuth[:limits.MaxAuthEvents]
 	}
-	if len(truncPrev) > 20 {
-		truncPrev = truncPrev[:20]
+	if limits.MaxPrevEvents > 0 && len(truncPrev) > limits.MaxPrevEvents {
+		truncPrev = truncPrev[:limits.MaxPrevEvents]
 	}
 	return
 }
 
+// CheckEventLimits returns an error if the event references more prev_events
+// or auth_events than the given limits allow, or if its depth is out of range.
+// A limit of 0 means that there is no limit.
+func CheckEventLimits(event *gomatrixserverlib.Event, limits *config.EventLimits) error {
+	if n := len(event.PrevEventIDs()); limits.MaxPrevEvents > 0 && n > limits.MaxPrevEvents {
+		return fmt.Errorf("event %s has %d prev_events, exceeding the maximum of %d", event.EventID(), n, limits.MaxPrevEvents)
+	}
+	if n := len(event.AuthEventIDs()); limits.MaxAuthEvents > 0 && n > limits.MaxAuthEvents {
+		return fmt.Errorf("event %s has %d auth_events, exceeding the maximum of %d", event.EventID(), n, limits.MaxAuthEvents)
+	}
+	if depth := event.Depth(); depth < 0 || depth > config.MaxEventDepth {
+		return fmt.Errorf("event %s has invalid depth %d", event.EventID(), depth)
+	}
+	return nil
+}
+
 // RedactEvent redacts the given event and sets the unsigned field appropriately. This should be used by
 // downstream components to the roomserver when an OutputTypeRedactedEvent occurs.
 func RedactEvent(redactionEvent, redactedEvent *gomatrixserverlib.Event) error {
@@ -0,0 +1,171 @@
+package eventutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// TestRedactEventContent checks which content fields survive a redaction in
+// different room versions, both when redacting a stored event and when
+// redacting event JSON for federation. Room version 11 isn't supported by
+// gomatrixserverlib yet, so it has no test vectors here.
+func TestRedactEventContent(t *testing.T) {
+	redactionJSON := `{"type":"m.room.redaction","room_id":"!room:test","sender":"@creator:test","redacts":"$redacted","content":{},"depth":3,"origin_server_ts":0,"prev_events":[],"auth_events":[],"hashes":{"sha256":""},"signatures":{}}`
+	creator, member := "@creator:test", "@member:test"
+
+	tests := []struct {
+		name      string
+		eventType string
+		stateKey  *string
+		content   string
+		want      map[gomatrixserverlib.RoomVersion]string
+	}{
+		{
+			name:      "message",
+			eventType: "m.room.message",
+			content:   `{"msgtype":"m.text","body":"hello"}`,
+			want: map[gomatrixserverlib.RoomVersion]string{
+				gomatrixserverlib.RoomVersionV6:  `{}`,
+				gomatrixserverlib.RoomVersionV10: `{}`,
+			},
+		},
+		{
+			name:      "create",
+			eventType: gomatrixserverlib.MRoomCreate,
+			stateKey:  new(string),
+			content:   fmt.Sprintf(`{"creator":%q,"m.federate":false,"room_version":"6"}`, creator),
+			want: map[gomatrixserverlib.RoomVersion]string{
+				gomatrixserverlib.RoomVersionV6:  fmt.Sprintf(`{"creator":%q}`, creator),
+				gomatrixserverlib.RoomVersionV10: fmt.Sprintf(`{"creator":%q}`, creator),
+			},
+		},
+		{
+			name:      "join rules keep allow from v8",
+			eventType: gomatrixserverlib.MRoomJoinRules,
+			stateKey:  new(string),
+			content:   `{"join_rule":"restricted","allow":[{"type":"m.room_membership","room_id":"!other:test"}],"other":"x"}`,
+			want: map[gomatrixserverlib.RoomVersion]string{
+				gomatrixserverlib.RoomVersionV6:  `{"join_rule":"restricted"}`,
+				gomatrixserverlib.RoomVersionV10: `{"join_rule":"restricted","allow":[{"type":"m.room_membership","room_id":"!other:test"}]}`,
+			},
+		},
+		{
+			name:      "membership keeps join_authorised_via_users_server from v9",
+			eventType: gomatrixserverlib.MRoomMember,
+			stateKey:  &member,
+			content:   fmt.Sprintf(`{"membership":"join","displayname":"Member","join_authorised_via_users_server":%q}`, creator),
+			want: map[gomatrixserverlib.RoomVersion]string{
+				gomatrixserverlib.RoomVersionV6:  `{"membership":"join"}`,
+				gomatrixserverlib.RoomVersionV10: fmt.Sprintf(`{"membership":"join","join_authorised_via_users_server":%q}`, creator),
+			},
+		},
+		{
+			name:      "power levels",
+			eventType: gomatrixserverlib.MRoomPowerLevels,
+			stateKey:  new(string),
+			content:   fmt.Sprintf(`{"users":{%q:100},"users_default":0,"events":{"m.room.name":50},"events_default":0,"state_default":50,"ban":50,"kick":50,"redact":50,"invite":0,"notifications":{"room":50}}`, creator),
+			want: map[gomatrixserverlib.RoomVersion]string{
+				gomatrixserverlib.RoomVersionV6:  fmt.Sprintf(`{"users":{%q:100},"users_default":0,"events":{"m.room.name":50},"events_default":0,"state_default":50,"ban":50,"kick":50,"redact":50}`, creator),
+				gomatrixserverlib.RoomVersionV10: fmt.Sprintf(`{"users":{%q:100},"users_default":0,"events":{"m.room.name":50},"events_default":0,"state_default":50,"ban":50,"kick":50,"redact":50}`, creator),
+			},
+		},
+		{
+			name:      "history visibility",
+			eventType: gomatrixserverlib.MRoomHistoryVisibility,
+			stateKey:  new(string),
+			content:   `{"history_visibility":"shared","other":"x"}`,
+			want: map[gomatrixserverlib.RoomVersion]string{
+				gomatrixserverlib.RoomVersionV6:  `{"history_visibility":"shared"}`,
+				gomatrixserverlib.RoomVersionV10: `{"history_visibility":"shared"}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for roomVersion, want := range tt.want {
+			t.Run(fmt.Sprintf("%s v%s", tt.name, roomVersion), func(t *testing.T) {
+				stateKey := ""
+				if tt.stateKey != nil {
+					stateKey = fmt.Sprintf(`"state_key":%q,`, *tt.stateKey)
+				}
+				eventJSON := []byte(fmt.Sprintf(
+					`{"type":%q,"room_id":"!room:test","sender":%q,%s"content":%s,"depth":2,"origin_server_ts":0,"prev_events":[],"auth_events":[],"hashes":{"sha256":""},"signatures":{}}`,
+					tt.eventType, creator, stateKey, tt.content,
+				))
+				ev, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, roomVersion)
+				if err != nil {
+					t.Fatalf("failed to create event: %s", err)
+				}
+				redaction, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(redactionJSON), false, roomVersion)
+				if err != nil {
+					t.Fatalf("failed to create redaction: %s", err)
+				}
+
+				// Redacting JSON for federation, e.g. in /send_join.
+				redactedJSON, err := gomatrixserverlib.RedactEventJSON(ev.JSON(), roomVersion)
+				if err != nil {
+					t.Fatalf("RedactEventJSON failed: %s", err)
+				}
+				var redacted struct {
+					Content json.RawMessage `json:"content"`
+				}
+				if err = json.Unmarshal(redactedJSON, &redacted); err != nil {
+					t.Fatal(err)
+				}
+				assertSameJSON(t, "RedactEventJSON", want, redacted.Content)
+
+				// Redacting an event when a redaction is received.
+				if err = RedactEvent(redaction, ev); err != nil {
+					t.Fatalf("RedactEvent failed: %s", err)
+				}
+				assertSameJSON(t, "RedactEvent", want, ev.Content())
+			})
+		}
+	}
+}
+
+func TestCheckEventLimits(t *testing.T) {
+	prevEvents := make([]string, config.DefaultMaxPrevEvents+1)
+	for i := range prevEvents {
+		prevEvents[i] = fmt.Sprintf("$prev%d", i)
+	}
+	prevJSON, err := json.Marshal(prevEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventJSON := fmt.Sprintf(`{"type":"m.room.message","room_id":"!room:test","sender":"@creator:test","content":{},"depth":3,"origin_server_ts":0,"prev_events":%s,"auth_events":[],"hashes":{"sha256":""},"signatures":{}}`, prevJSON)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits := &config.EventLimits{}
+	limits.Defaults()
+	if err = CheckEventLimits(ev, limits); err == nil {
+		t.Fatalf("expected an event with %d prev_events to exceed the limits", len(prevEvents))
+	}
+	limits.MaxPrevEvents = 0
+	if err = CheckEventLimits(ev, limits); err != nil {
+		t.Fatalf("expected a limit of 0 to be unlimited, got %v", err)
+	}
+}
+
+func assertSameJSON(t *testing.T, what, want string, got []byte) {
+	t.Helper()
+	var wantValue, gotValue interface{}
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(wantValue, gotValue) {
+		t.Errorf("%s: expected content %s, got %s", what, want, got)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package eventutil
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+)
+
+var (
+	createTuple      = gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}
+	powerLevelsTuple = gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}
+)
+
+// PowerLevelsFromState returns the power levels of a room from its
+// m.room.create and m.room.power_levels events. The power levels event may
+// be nil, in which case the same defaults as in the auth rules are used: the
+// room creator has the highest power level, everyone else has 0 and sending
+// state events requires 50. Anything which checks power levels outside of
+// the auth rules should use this, so that it agrees with them.
+func PowerLevelsFromState(create, powerLevels *gomatrixserverlib.Event) (*gomatrixserverlib.PowerLevelContent, error) {
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for _, ev := range []*gomatrixserverlib.Event{create, powerLevels} {
+		if ev == nil {
+			continue
+		}
+		if err := authEvents.AddEvent(ev); err != nil {
+			return nil, fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+	}
+	createContent, err := gomatrixserverlib.NewCreateContentFromAuthEvents(&authEvents)
+	if err != nil {
+		return nil, err
+	}
+	pl, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(&authEvents, createContent.Creator)
+	if err != nil {
+		return nil, err
+	}
+	return &pl, nil
+}
+
+// GetPowerLevels returns the current power levels of a room, applying the
+// defaults from PowerLevelsFromState if it has no m.room.power_levels event.
+func GetPowerLevels(ctx context.Context, rsAPI api.QueryEventsAPI, roomID string) (*gomatrixserverlib.PowerLevelContent, error) {
+	var res api.QueryCurrentStateResponse
+	if err := rsAPI.QueryCurrentState(ctx, &api.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{createTuple, powerLevelsTuple},
+	}, &res); err != nil {
+		return nil, fmt.Errorf("rsAPI.QueryCurrentState: %w", err)
+	}
+	var create, powerLevels *gomatrixserverlib.Event
+	if ev, ok := res.StateEvents[createTuple]; ok && ev != nil {
+		create = ev.Event
+	}
+	if ev, ok := res.StateEvents[powerLevelsTuple]; ok && ev != nil {
+		powerLevels = ev.Event
+	}
+	return PowerLevelsFromState(create, powerLevels)
+}
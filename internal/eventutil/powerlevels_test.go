@@ -0,0 +1,111 @@
+package eventutil
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	testCreator = "@creator:test"
+	testMember  = "@member:test"
+	testRoomID  = "!room:test"
+)
+
+func mustEvent(t *testing.T, id, evType, sender string, stateKey *string, content string) *gomatrixserverlib.Event {
+	t.Helper()
+	sk := ""
+	if stateKey != nil {
+		sk = fmt.Sprintf(`"state_key":%q,`, *stateKey)
+	}
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(fmt.Sprintf(
+		`{"event_id":"$%s:test","room_id":%q,"type":%q,"sender":%q,%s"content":%s,"depth":1,"origin":"test","origin_server_ts":0,"prev_events":[],"auth_events":[],"hashes":{"sha256":""},"signatures":{}}`,
+		id, testRoomID, evType, sender, sk, content,
+	)), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return ev
+}
+
+func TestPowerLevelsFromStateDefaults(t *testing.T) {
+	empty := ""
+	create := mustEvent(t, "create", gomatrixserverlib.MRoomCreate, testCreator, &empty, fmt.Sprintf(`{"creator":%q}`, testCreator))
+
+	pl, err := PowerLevelsFromState(create, nil)
+	if err != nil {
+		t.Fatalf("PowerLevelsFromState failed: %s", err)
+	}
+
+	// https://spec.matrix.org/v1.5/client-server-api/#mroompower_levels
+	// "If the room contains no m.room.power_levels event, the room's creator
+	// has a power level of 100, and all other users have a power level of 0."
+	if got := pl.UserLevel(testCreator); got < 100 {
+		t.Errorf("expected the creator to have at least power level 100, got %d", got)
+	}
+	if got := pl.UserLevel(testMember); got != 0 {
+		t.Errorf("expected other users to have power level 0, got %d", got)
+	}
+	for name, got := range map[string]int64{
+		"users_default":  pl.UsersDefault,
+		"events_default": pl.EventsDefault,
+	} {
+		if got != 0 {
+			t.Errorf("expected %s to be 0, got %d", name, got)
+		}
+	}
+	for name, got := range map[string]int64{
+		"state_default": pl.StateDefault,
+		"ban":           pl.Ban,
+		"kick":          pl.Kick,
+		"redact":        pl.Redact,
+		"room":          pl.NotificationLevel("room"),
+	} {
+		if got != 50 {
+			t.Errorf("expected %s to be 50, got %d", name, got)
+		}
+	}
+
+	// Without a create event we can't know who the creator is.
+	if _, err = PowerLevelsFromState(nil, nil); err == nil {
+		t.Errorf("expected an error without a create event")
+	}
+}
+
+func TestPowerLevelsFromStateAgreesWithAuth(t *testing.T) {
+	empty := ""
+	creator, member := testCreator, testMember
+	create := mustEvent(t, "create", gomatrixserverlib.MRoomCreate, testCreator, &empty, fmt.Sprintf(`{"creator":%q}`, testCreator))
+	joinRules := mustEvent(t, "join_rules", gomatrixserverlib.MRoomJoinRules, testCreator, &empty, `{"join_rule":"public"}`)
+	creatorJoin := mustEvent(t, "creator_join", gomatrixserverlib.MRoomMember, testCreator, &creator, `{"membership":"join"}`)
+	memberJoin := mustEvent(t, "member_join", gomatrixserverlib.MRoomMember, testMember, &member, `{"membership":"join"}`)
+	withPowerLevels := mustEvent(t, "power_levels", gomatrixserverlib.MRoomPowerLevels, testCreator, &empty, fmt.Sprintf(
+		`{"users":{%q:100,%q:50},"events_default":10,"state_default":100}`, testCreator, testMember,
+	))
+
+	for _, powerLevels := range []*gomatrixserverlib.Event{nil, withPowerLevels} {
+		authEvents := gomatrixserverlib.NewAuthEvents([]*gomatrixserverlib.Event{create, joinRules, creatorJoin, memberJoin})
+		if powerLevels != nil {
+			if err := authEvents.AddEvent(powerLevels); err != nil {
+				t.Fatalf("failed to add power levels: %s", err)
+			}
+		}
+		pl, err := PowerLevelsFromState(create, powerLevels)
+		if err != nil {
+			t.Fatalf("PowerLevelsFromState failed: %s", err)
+		}
+		for _, ev := range []*gomatrixserverlib.Event{
+			mustEvent(t, "creator_message", "m.room.message", testCreator, nil, `{"body":"hello"}`),
+			mustEvent(t, "member_message", "m.room.message", testMember, nil, `{"body":"hello"}`),
+			mustEvent(t, "creator_topic", gomatrixserverlib.MRoomTopic, testCreator, &empty, `{"topic":"hello"}`),
+			mustEvent(t, "member_topic", gomatrixserverlib.MRoomTopic, testMember, &empty, `{"topic":"hello"}`),
+		} {
+			want := gomatrixserverlib.Allowed(ev, &authEvents) == nil
+			got := pl.UserLevel(ev.Sender()) >= pl.EventLevel(ev.Type(), ev.StateKey() != nil)
+			if got != want {
+				t.Errorf("power levels event %v: expected %s from %s to be allowed %v, got %v", powerLevels != nil, ev.Type(), ev.Sender(), want, got)
+			}
+		}
+	}
+}
@@ -63,6 +63,9 @@ func PostJSON[reqtype, restype any, errtype error](
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		req.Header.Set(RequestIDHeader, requestID)
+	}
 
 	res, err := httpClient.Do(req.WithContext(ctx))
 	if res != nil {
@@ -143,8 +143,9 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 	if os.Getenv("DENDRITE_TRACE_HTTP") == "1" {
 		verbose = true
 	}
-	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
+	h := util.MakeJSONAPI(util.NewJSONRequestHandler(withRequestIDLogger(f)))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
+		req = withRequestID(w, req)
 		nextWriter := w
 		if verbose {
 			logger := logrus.NewEntry(logrus.StandardLogger())
@@ -228,8 +229,9 @@ func MakeHTMLAPI(metricsName string, enableMetrics bool, f func(http.ResponseWri
 // If we are passed a tracing context in the request headers then we use that
 // as the parent of any tracing spans we create.
 func MakeInternalAPI(metricsName string, enableMetrics bool, f func(*http.Request) util.JSONResponse) http.Handler {
-	h := util.MakeJSONAPI(util.NewJSONRequestHandler(f))
+	h := util.MakeJSONAPI(util.NewJSONRequestHandler(withRequestIDLogger(f)))
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
+		req = withRequestID(w, req)
 		carrier := opentracing.HTTPHeadersCarrier(req.Header)
 		tracer := opentracing.GlobalTracer()
 		clientContext, err := tracer.Extract(opentracing.HTTPHeaders, carrier)
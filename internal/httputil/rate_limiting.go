@@ -8,6 +8,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
@@ -19,15 +20,21 @@ type RateLimits struct {
 	requestThreshold int64
 	cooloffDuration  time.Duration
 	exemptUserIDs    map[string]struct{}
+	appServices      []config.ApplicationService
 }
 
-func NewRateLimits(cfg *config.RateLimiting) *RateLimits {
+// NewRateLimits creates rate limits from the given config. The sender of an
+// application service is always exempt from them, as are the users in the
+// namespaces of application services which set `rate_limited: false` in
+// their registration.
+func NewRateLimits(cfg *config.RateLimiting, appServices []config.ApplicationService) *RateLimits {
 	l := &RateLimits{
 		limits:           make(map[string]chan struct{}),
 		enabled:          cfg.Enabled,
 		requestThreshold: cfg.Threshold,
 		cooloffDuration:  time.Duration(cfg.CooloffMS) * time.Millisecond,
 		exemptUserIDs:    map[string]struct{}{},
+		appServices:      appServices,
 	}
 	for _, userID := range cfg.ExemptUserIDs {
 		l.exemptUserIDs[userID] = struct{}{}
@@ -58,35 +65,45 @@ func (l *RateLimits) clean() {
 	}
 }
 
+// Enabled returns true if the rate limits are applied.
+func (l *RateLimits) Enabled() bool {
+	return l.enabled
+}
+
+// appServiceFor returns the application service which the device belongs to,
+// either because the appservice is acting on its own behalf or as one of its
+// users, or nil if the device doesn't belong to an appservice.
+func (l *RateLimits) appServiceFor(device *userapi.Device) *config.ApplicationService {
+	for i := range l.appServices {
+		as := &l.appServices[i]
+		switch {
+		case device.AppserviceID != "":
+			if as.ID == device.AppserviceID {
+				return as
+			}
+		case device.AccountType == userapi.AccountTypeAppService:
+			if as.IsInterestedInUserID(device.UserID) {
+				return as
+			}
+		}
+	}
+	return nil
+}
+
 func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSONResponse {
 	// If rate limiting is disabled then do nothing.
 	if !l.enabled {
 		return nil
 	}
 
-	// Take a read lock out on the cleaner mutex. The cleaner expects to
-	// be able to take a write lock, which isn't possible while there are
-	// readers, so this has the effect of blocking the cleaner goroutine
-	// from doing its work until there are no requests in flight.
-	l.cleanMutex.RLock()
-	defer l.cleanMutex.RUnlock()
-
 	// First of all, work out if X-Forwarded-For was sent to us. If not
 	// then we'll just use the IP address of the caller.
 	var caller string
 	if device != nil {
-		switch device.AccountType {
-		case userapi.AccountTypeAdmin:
-			return nil // don't rate-limit server administrators
-		case userapi.AccountTypeAppService:
-			return nil // don't rate-limit appservice users
-		default:
-			if _, ok := l.exemptUserIDs[device.UserID]; ok {
-				// If the user is exempt from rate limiting then do nothing.
-				return nil
-			}
-			caller = device.UserID + device.ID
+		if l.isExempt(device) {
+			return nil
 		}
+		caller = device.UserID + device.ID
 	} else {
 		if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
 			caller = forwardedFor
@@ -95,30 +112,83 @@ func (l *RateLimits) Limit(req *http.Request, device *userapi.Device) *util.JSON
 		}
 	}
 
-	// Look up the caller's channel, if they have one.
+	return l.limit(caller, "You are sending too many requests too quickly!")
+}
+
+// LimitRoomJoin applies the rate limits to all joins to the given room,
+// rather than to each caller, so that a flood of joins from many users is
+// throttled. The device is nil for joins over federation, otherwise it is
+// only used to exempt the joining user from the limits.
+func (l *RateLimits) LimitRoomJoin(roomID string, device *userapi.Device) *util.JSONResponse {
+	if !l.enabled {
+		return nil
+	}
+	if device != nil && l.isExempt(device) {
+		return nil
+	}
+	return l.limit(roomID, "Too many users are joining this room, try again later")
+}
+
+// isExempt returns true if the device is not subject to rate limiting.
+func (l *RateLimits) isExempt(device *userapi.Device) bool {
+	if device.AccountType == userapi.AccountTypeAdmin {
+		return true // don't rate-limit server administrators
+	}
+	if _, ok := l.exemptUserIDs[device.UserID]; ok {
+		// If the user is exempt from rate limiting then do nothing.
+		return true
+	}
+	if as := l.appServiceFor(device); as != nil {
+		if !as.RateLimited {
+			// The appservice has asked not to be rate-limited.
+			return true
+		}
+		if device.AppserviceID == as.ID {
+			// The appservice is acting as its own sender, which is never
+			// rate-limited. The rate_limited flag only applies to the users
+			// in its namespaces.
+			if localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID); err == nil && localpart == as.SenderLocalpart {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// limit takes a slot for the given key, returning M_LIMIT_EXCEEDED with
+// the given message if there are none free.
+func (l *RateLimits) limit(key, msg string) *util.JSONResponse {
+	// Take a read lock out on the cleaner mutex. The cleaner expects to
+	// be able to take a write lock, which isn't possible while there are
+	// readers, so this has the effect of blocking the cleaner goroutine
+	// from doing its work until there are no requests in flight.
+	l.cleanMutex.RLock()
+	defer l.cleanMutex.RUnlock()
+
+	// Look up the key's channel, if there is one.
 	l.limitsMutex.RLock()
-	rateLimit, ok := l.limits[caller]
+	rateLimit, ok := l.limits[key]
 	l.limitsMutex.RUnlock()
 
-	// If the caller doesn't have a channel, create one and write it
+	// If the key doesn't have a channel, create one and write it
 	// back to the map.
 	if !ok {
 		rateLimit = make(chan struct{}, l.requestThreshold)
 
 		l.limitsMutex.Lock()
-		l.limits[caller] = rateLimit
+		l.limits[key] = rateLimit
 		l.limitsMutex.Unlock()
 	}
 
-	// Check if the user has got free resource slots for this request.
-	// If they don't then we'll return an error.
+	// Check if there are free resource slots for this request.
+	// If there aren't then we'll return an error.
 	select {
 	case rateLimit <- struct{}{}:
 	default:
 		// We hit the rate limit. Tell the client to back off.
 		return &util.JSONResponse{
 			Code: http.StatusTooManyRequests,
-			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", l.cooloffDuration.Milliseconds()),
+			JSON: jsonerror.LimitExceeded(msg, l.cooloffDuration.Milliseconds()),
 		}
 	}
 
@@ -0,0 +1,141 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestRateLimitsAppServices(t *testing.T) {
+	appService := func(id string, rateLimited bool) config.ApplicationService {
+		return config.ApplicationService{
+			ID:              id,
+			SenderLocalpart: id,
+			RateLimited:     rateLimited,
+			NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+				"users": {{
+					Regex:        "@" + id + "_.*:test",
+					RegexpObject: regexp.MustCompile("@" + id + "_.*:test"),
+				}},
+			},
+		}
+	}
+	l := NewRateLimits(&config.RateLimiting{
+		Enabled:   true,
+		Threshold: 1,
+		CooloffMS: 60000,
+	}, []config.ApplicationService{
+		appService("unlimited", false),
+		appService("limited", true),
+	})
+
+	tests := []struct {
+		name        string
+		device      *userapi.Device
+		wantLimited bool
+	}{
+		{
+			name:   "appservice with rate_limited false is exempt",
+			device: &userapi.Device{ID: "AS_Device", UserID: "@unlimited:test", AppserviceID: "unlimited", AccountType: userapi.AccountTypeAppService},
+		},
+		{
+			name:   "appservice masquerading as a namespaced user is exempt",
+			device: &userapi.Device{ID: "AS_Device", UserID: "@unlimited_alice:test", AppserviceID: "unlimited", AccountType: userapi.AccountTypeAppService},
+		},
+		{
+			name:   "namespaced user of an exempt appservice is exempt",
+			device: &userapi.Device{ID: "DEVICE", UserID: "@unlimited_bob:test", AccountType: userapi.AccountTypeAppService},
+		},
+		{
+			name:   "appservice sender with rate_limited true is exempt",
+			device: &userapi.Device{ID: "AS_Device", UserID: "@limited:test", AppserviceID: "limited", AccountType: userapi.AccountTypeAppService},
+		},
+		{
+			name:        "appservice with rate_limited true masquerading as a namespaced user is limited",
+			device:      &userapi.Device{ID: "AS_Device", UserID: "@limited_alice:test", AppserviceID: "limited", AccountType: userapi.AccountTypeAppService},
+			wantLimited: true,
+		},
+		{
+			name:        "namespaced user of an appservice with rate_limited true is limited",
+			device:      &userapi.Device{ID: "DEVICE", UserID: "@limited_bob:test", AccountType: userapi.AccountTypeAppService},
+			wantLimited: true,
+		},
+		{
+			name:        "normal user in the namespace of an exempt appservice is limited",
+			device:      &userapi.Device{ID: "DEVICE", UserID: "@unlimited_charlie:test", AccountType: userapi.AccountTypeUser},
+			wantLimited: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/", nil)
+			if res := l.Limit(req, tt.device); res != nil {
+				t.Fatalf("first request was unexpectedly rate limited: %+v", res)
+			}
+			res := l.Limit(req, tt.device)
+			if limited := res != nil; limited != tt.wantLimited {
+				t.Fatalf("expected rate limited to be %v, got %v", tt.wantLimited, limited)
+			}
+			if tt.wantLimited && res.Code != http.StatusTooManyRequests {
+				t.Fatalf("expected HTTP %d, got %d", http.StatusTooManyRequests, res.Code)
+			}
+		})
+	}
+}
+
+func TestRateLimitsRoomJoins(t *testing.T) {
+	l := NewRateLimits(&config.RateLimiting{
+		Enabled:       true,
+		Threshold:     3,
+		CooloffMS:     60000,
+		ExemptUserIDs: []string{"@exempt:test"},
+	}, nil)
+
+	device := func(localpart string, accountType userapi.AccountType) *userapi.Device {
+		return &userapi.Device{ID: "DEVICE", UserID: "@" + localpart + ":test", AccountType: accountType}
+	}
+
+	// A flood of joins from different users and over federation is
+	// throttled once the room's threshold is reached.
+	joins := []*userapi.Device{
+		device("alice", userapi.AccountTypeUser),
+		device("bob", userapi.AccountTypeUser),
+		nil,
+	}
+	for i, dev := range joins {
+		if res := l.LimitRoomJoin("!flooded:test", dev); res != nil {
+			t.Fatalf("join %d was unexpectedly rate limited: %+v", i, res)
+		}
+	}
+	for _, dev := range []*userapi.Device{device("charlie", userapi.AccountTypeUser), nil} {
+		res := l.LimitRoomJoin("!flooded:test", dev)
+		if res == nil {
+			t.Fatalf("expected join to be rate limited")
+		}
+		if res.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected HTTP %d, got %d", http.StatusTooManyRequests, res.Code)
+		}
+	}
+
+	// Other rooms are not affected.
+	if res := l.LimitRoomJoin("!other:test", device("charlie", userapi.AccountTypeUser)); res != nil {
+		t.Fatalf("join to another room was unexpectedly rate limited: %+v", res)
+	}
+
+	// Server administrators and exempt users can still join.
+	for _, dev := range []*userapi.Device{device("admin", userapi.AccountTypeAdmin), device("exempt", userapi.AccountTypeUser)} {
+		if res := l.LimitRoomJoin("!flooded:test", dev); res != nil {
+			t.Fatalf("join by %s was unexpectedly rate limited: %+v", dev.UserID, res)
+		}
+	}
+
+	// The per-room limits are separate from the per-device limits.
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	if res := l.Limit(req, device("charlie", userapi.AccountTypeUser)); res != nil {
+		t.Fatalf("request was unexpectedly rate limited: %+v", res)
+	}
+}
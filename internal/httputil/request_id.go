@@ -0,0 +1,87 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/util"
+)
+
+// RequestIDHeader carries the ID of a request, so that the logs of a request
+// can be correlated across components. It is accepted from reverse proxies,
+// returned in responses and sent on internal API calls.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID which is accepted from the
+// request headers. Longer IDs are replaced with a new one.
+const maxRequestIDLength = 64
+
+type requestIDContextKey struct{}
+
+// ContextWithRequestID returns a copy of the context with the given request ID.
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// RequestIDFromContext returns the request ID of the context, or an empty
+// string if there isn't one.
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// withRequestID adds the request ID to the request context and the response
+// headers. The ID is taken from the request headers if it is valid, otherwise
+// a new one is generated.
+func withRequestID(w http.ResponseWriter, req *http.Request) *http.Request {
+	requestID := req.Header.Get(RequestIDHeader)
+	if !validRequestID(requestID) {
+		requestID = util.RandomString(12)
+	}
+	w.Header().Set(RequestIDHeader, requestID)
+	return req.WithContext(ContextWithRequestID(req.Context(), requestID))
+}
+
+// withRequestIDLogger replaces the random request ID which util sets on the
+// request logger with the request ID from the context, so that all of the logs
+// for a request share the same ID.
+func withRequestIDLogger(f func(*http.Request) util.JSONResponse) func(*http.Request) util.JSONResponse {
+	return func(req *http.Request) util.JSONResponse {
+		if requestID := RequestIDFromContext(req.Context()); requestID != "" {
+			logger := util.GetLogger(req.Context()).WithField("req.id", requestID)
+			req = req.WithContext(util.ContextWithLogger(req.Context(), logger))
+		}
+		return f(req)
+	}
+}
+
+// validRequestID returns true if the request ID is short and only contains
+// characters which are safe to log.
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range requestID {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/util"
+	"github.com/opentracing/opentracing-go"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+)
+
+type requestIDTestError struct {
+	Message string `json:"message"`
+}
+
+func (e *requestIDTestError) Error() string {
+	return e.Message
+}
+
+func TestRequestIDCorrelation(t *testing.T) {
+	hook := logrustest.NewGlobal()
+	defer hook.Reset()
+
+	// An internal API, as called between components in a polylith.
+	internalAPI := httptest.NewServer(MakeInternalAPI("test_internal", false, func(req *http.Request) util.JSONResponse {
+		util.GetLogger(req.Context()).Info("internal")
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	}))
+	defer internalAPI.Close()
+
+	external := MakeExternalAPI("test_external", func(req *http.Request) util.JSONResponse {
+		util.GetLogger(req.Context()).Info("external")
+		span := opentracing.StartSpan("test_internal")
+		defer span.Finish()
+		if err := PostJSON[struct{}, struct{}, *requestIDTestError](
+			req.Context(), span, internalAPI.Client(), internalAPI.URL+"/test", &struct{}{}, &struct{}{},
+		); err != nil {
+			t.Errorf("failed to call internal API: %s", err)
+		}
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	})
+
+	tests := []struct {
+		name          string
+		requestID     string
+		wantRequestID string
+	}{
+		{
+			name: "new request ID",
+		},
+		{
+			name:          "request ID from a reverse proxy",
+			requestID:     "7f3c2a9e-proxy_id.1",
+			wantRequestID: "7f3c2a9e-proxy_id.1",
+		},
+		{
+			name:      "invalid request ID is replaced",
+			requestID: "not a valid\nrequest ID",
+		},
+		{
+			name:      "overlong request ID is replaced",
+			requestID: strings.Repeat("a", maxRequestIDLength+1),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook.Reset()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.requestID != "" {
+				req.Header.Set(RequestIDHeader, tt.requestID)
+			}
+			rec := httptest.NewRecorder()
+			external.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("expected HTTP 200, got %d: %s", rec.Code, rec.Body.String())
+			}
+
+			requestID := rec.Header().Get(RequestIDHeader)
+			if requestID == "" {
+				t.Fatalf("expected a request ID in the response")
+			}
+			if tt.wantRequestID != "" && requestID != tt.wantRequestID {
+				t.Fatalf("expected request ID %q, got %q", tt.wantRequestID, requestID)
+			}
+			if tt.wantRequestID == "" && requestID == tt.requestID {
+				t.Fatalf("expected request ID %q to be replaced", tt.requestID)
+			}
+
+			logged := map[string]bool{}
+			for _, entry := range hook.AllEntries() {
+				if entry.Message != "external" && entry.Message != "internal" {
+					continue
+				}
+				logged[entry.Message] = true
+				if got := entry.Data["req.id"]; got != requestID {
+					t.Errorf("expected %q log to have request ID %q, got %q", entry.Message, requestID, got)
+				}
+			}
+			if !logged["external"] || !logged["internal"] {
+				t.Fatalf("expected logs from both APIs, got %v", logged)
+			}
+		})
+	}
+}
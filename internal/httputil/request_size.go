@@ -0,0 +1,67 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+)
+
+// LimitRequestBodySize returns a Gorilla middleware which rejects requests
+// with bodies larger than maxBytes with M_TOO_LARGE. Requests are rejected
+// based on their Content-Length before any of the body is read. Bodies with
+// no Content-Length, e.g. chunked ones, are read up to the limit and rejected
+// as soon as it is exceeded. A maxBytes of 0 means no limit.
+func LimitRequestBodySize(maxBytes int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		if maxBytes <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch {
+			case req.ContentLength > maxBytes:
+				writeTooLarge(w, maxBytes)
+				return
+			case req.ContentLength >= 0:
+				// The server never reads past the Content-Length.
+			default:
+				body, err := io.ReadAll(io.LimitReader(req.Body, maxBytes+1))
+				if err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if int64(len(body)) > maxBytes {
+					writeTooLarge(w, maxBytes)
+					return
+				}
+				req.Body = io.NopCloser(bytes.NewReader(body))
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+func writeTooLarge(w http.ResponseWriter, maxBytes int64) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	_ = json.NewEncoder(w).Encode(jsonerror.TooLarge(fmt.Sprintf("Request body must not be larger than %d bytes", maxBytes)))
+}
@@ -0,0 +1,121 @@
+package httputil
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// countingReader counts how many bytes of a request body have been read.
+type countingReader struct {
+	r    io.Reader
+	read int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func TestLimitRequestBodySize(t *testing.T) {
+	const maxBytes = 1024
+
+	tests := []struct {
+		name          string
+		bodySize      int64
+		contentLength int64
+		wantCode      int
+		wantMaxRead   int64
+	}{
+		{
+			name:          "small body",
+			bodySize:      100,
+			contentLength: 100,
+			wantCode:      http.StatusOK,
+			wantMaxRead:   100,
+		},
+		{
+			name:          "body at the limit",
+			bodySize:      maxBytes,
+			contentLength: maxBytes,
+			wantCode:      http.StatusOK,
+			wantMaxRead:   maxBytes,
+		},
+		{
+			name:          "oversized Content-Length is rejected without reading",
+			bodySize:      maxBytes * 1024,
+			contentLength: maxBytes * 1024,
+			wantCode:      http.StatusRequestEntityTooLarge,
+			wantMaxRead:   0,
+		},
+		{
+			name:          "small chunked body",
+			bodySize:      100,
+			contentLength: -1,
+			wantCode:      http.StatusOK,
+			wantMaxRead:   100,
+		},
+		{
+			name:          "oversized chunked body is rejected at the limit",
+			bodySize:      maxBytes * 1024,
+			contentLength: -1,
+			wantCode:      http.StatusRequestEntityTooLarge,
+			wantMaxRead:   maxBytes + 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handled bool
+			var handledBody []byte
+			h := LimitRequestBodySize(maxBytes)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				handled = true
+				var err error
+				if handledBody, err = io.ReadAll(req.Body); err != nil {
+					t.Fatalf("failed to read body: %s", err)
+				}
+			}))
+
+			body := &countingReader{r: strings.NewReader(strings.Repeat("a", int(tt.bodySize)))}
+			req := httptest.NewRequest(http.MethodPut, "/", body)
+			req.ContentLength = tt.contentLength
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected HTTP %d, got %d", tt.wantCode, rec.Code)
+			}
+			if body.read > tt.wantMaxRead {
+				t.Fatalf("expected at most %d bytes to be read, got %d", tt.wantMaxRead, body.read)
+			}
+			if tt.wantCode != http.StatusOK {
+				if handled {
+					t.Fatalf("expected the request not to reach the handler")
+				}
+				var e struct {
+					ErrCode string `json:"errcode"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &e); err != nil || e.ErrCode != "M_TOO_LARGE" {
+					t.Fatalf("expected M_TOO_LARGE, got %s", rec.Body.String())
+				}
+				return
+			}
+			if int64(len(handledBody)) != tt.bodySize {
+				t.Fatalf("expected the handler to read %d bytes, got %d", tt.bodySize, len(handledBody))
+			}
+		})
+	}
+
+	t.Run("no limit", func(t *testing.T) {
+		h := LimitRequestBodySize(0)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+		req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(strings.Repeat("a", maxBytes*2)))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d", rec.Code)
+		}
+	})
+}
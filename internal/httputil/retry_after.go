@@ -0,0 +1,112 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// ParseRetryAfter parses the value of a Retry-After header, which is either
+// a number of seconds or an HTTP date, into the delay from now.
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
+
+// retryAfterTransport retries requests which are rejected with 429 Too Many
+// Requests once the delay given by the Retry-After header has passed.
+type retryAfterTransport struct {
+	transport  http.RoundTripper
+	maxDelay   time.Duration
+	maxRetries int
+}
+
+// NewRetryAfterTransport wraps the given transport so that rate-limited
+// requests are retried as configured. If retries are disabled, the transport
+// is returned as-is.
+func NewRetryAfterTransport(transport http.RoundTripper, cfg *config.RetryAfterOptions) http.RoundTripper {
+	if !cfg.Enabled || cfg.MaxRetries == 0 {
+		return transport
+	}
+	return &retryAfterTransport{
+		transport:  transport,
+		maxDelay:   cfg.MaxDelay,
+		maxRetries: cfg.MaxRetries,
+	}
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := t.transport.RoundTrip(req)
+		if err != nil || res.StatusCode != http.StatusTooManyRequests || attempt >= t.maxRetries {
+			return res, err
+		}
+		delay, ok := ParseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		if !ok || delay > t.maxDelay {
+			return res, nil
+		}
+		// The request body has already been sent, so we can only retry if
+		// we can get a fresh copy of it.
+		retry := req.Clone(req.Context())
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return res, nil
+			}
+			if retry.Body, err = req.GetBody(); err != nil {
+				return res, nil
+			}
+		}
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+
+		logrus.WithFields(logrus.Fields{
+			"host":  req.URL.Host,
+			"path":  req.URL.Path,
+			"delay": delay,
+		}).Debug("Request was rate-limited, retrying after Retry-After delay")
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		req = retry
+	}
+}
@@ -0,0 +1,146 @@
+package httputil
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		want     time.Duration
+		wantOK   bool
+		testName string
+	}{
+		{value: "", testName: "empty"},
+		{value: "rubbish", testName: "invalid"},
+		{value: "-5", testName: "negative"},
+		{value: "0", wantOK: true, testName: "zero seconds"},
+		{value: " 120 ", want: time.Minute * 2, wantOK: true, testName: "seconds"},
+		{value: "Sun, 01 Jan 2023 12:00:30 GMT", want: time.Second * 30, wantOK: true, testName: "future date"},
+		{value: "Sun, 01 Jan 2023 11:00:00 GMT", want: 0, wantOK: true, testName: "past date"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.testName, func(t *testing.T) {
+			got, ok := ParseRetryAfter(tt.value, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Fatalf("ParseRetryAfter(%q) = %s, %v, want %s, %v", tt.value, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	tests := []struct {
+		name         string
+		retryAfter   string
+		cfg          config.RetryAfterOptions
+		wantStatus   int
+		wantAttempts int
+		wantDelay    time.Duration
+	}{
+		{
+			name:         "retries after the delay",
+			retryAfter:   "1",
+			cfg:          config.RetryAfterOptions{Enabled: true, MaxDelay: time.Second * 5, MaxRetries: 2},
+			wantStatus:   http.StatusOK,
+			wantAttempts: 2,
+			wantDelay:    time.Second,
+		},
+		{
+			name:         "delay above the cap",
+			retryAfter:   "60",
+			cfg:          config.RetryAfterOptions{Enabled: true, MaxDelay: time.Second * 5, MaxRetries: 2},
+			wantStatus:   http.StatusTooManyRequests,
+			wantAttempts: 1,
+		},
+		{
+			name:         "no Retry-After header",
+			cfg:          config.RetryAfterOptions{Enabled: true, MaxDelay: time.Second * 5, MaxRetries: 2},
+			wantStatus:   http.StatusTooManyRequests,
+			wantAttempts: 1,
+		},
+		{
+			name:         "disabled",
+			retryAfter:   "0",
+			cfg:          config.RetryAfterOptions{Enabled: false, MaxDelay: time.Second * 5, MaxRetries: 2},
+			wantStatus:   http.StatusTooManyRequests,
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts []time.Time
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts = append(attempts, time.Now())
+				if body, _ := io.ReadAll(r.Body); string(body) != "hello" {
+					t.Errorf("expected the request body to be sent on every attempt, got %q", body)
+				}
+				if len(attempts) == 1 {
+					if tt.retryAfter != "" {
+						w.Header().Set("Retry-After", tt.retryAfter)
+					}
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer srv.Close()
+
+			client := &http.Client{Transport: NewRetryAfterTransport(http.DefaultTransport, &tt.cfg)}
+			req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL, strings.NewReader("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, res.StatusCode)
+			}
+			if len(attempts) != tt.wantAttempts {
+				t.Fatalf("expected %d attempts, got %d", tt.wantAttempts, len(attempts))
+			}
+			if len(attempts) > 1 {
+				if delay := attempts[1].Sub(attempts[0]); delay < tt.wantDelay {
+					t.Fatalf("expected the retry to be delayed by at least %s, got %s", tt.wantDelay, delay)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryAfterTransportContextCancelled(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: NewRetryAfterTransport(http.DefaultTransport, &config.RetryAfterOptions{
+		Enabled: true, MaxDelay: time.Minute, MaxRetries: 1,
+	})}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err = client.Do(req); err == nil {
+		t.Fatal("expected the request to fail when the context is cancelled")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Fatalf("expected the wait to be interrupted, took %s", elapsed)
+	}
+}
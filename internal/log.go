@@ -86,6 +86,21 @@ func callerPrettyfier(f *runtime.Frame) (string, string) {
 	return funcname, filename
 }
 
+// jsonFormatter returns a formatter for structured JSON logs. The calling
+// function and file are logged as fields of their own, without the newline
+// that callerPrettyfier adds.
+func jsonFormatter() logrus.Formatter {
+	return &utcFormatter{
+		&logrus.JSONFormatter{
+			TimestampFormat: "2006-01-02T15:04:05.000000000Z07:00",
+			CallerPrettyfier: func(f *runtime.Frame) (string, string) {
+				s := strings.Split(f.Function, ".")
+				return s[len(s)-1], fmt.Sprintf("%s:%d", path.Base(f.File), f.Line)
+			},
+		},
+	}
+}
+
 // SetupPprof starts a pprof listener. We use the DefaultServeMux here because it is
 // simplest, and it gives us the freedom to run pprof on a separate port.
 func SetupPprof() {
@@ -133,19 +148,24 @@ func setupFileHook(hook config.LogrusHook, level logrus.Level, componentName str
 		logrus.Fatalf("Couldn't create directory %s: %q", path.Dir(fullPath), err)
 	}
 
+	var formatter logrus.Formatter = &utcFormatter{
+		&logrus.TextFormatter{
+			TimestampFormat:  "2006-01-02T15:04:05.000000000Z07:00",
+			DisableColors:    true,
+			DisableTimestamp: false,
+			DisableSorting:   false,
+			QuoteEmptyFields: true,
+		},
+	}
+	if hook.Format == "json" {
+		formatter = jsonFormatter()
+	}
+
 	logrus.AddHook(&logLevelHook{
 		level,
 		dugong.NewFSHook(
 			fullPath,
-			&utcFormatter{
-				&logrus.TextFormatter{
-					TimestampFormat:  "2006-01-02T15:04:05.000000000Z07:00",
-					DisableColors:    true,
-					DisableTimestamp: false,
-					DisableSorting:   false,
-					QuoteEmptyFields: true,
-				},
-			},
+			formatter,
 			&dugong.DailyRotationSchedule{GZip: true},
 		),
 	})
@@ -53,6 +53,10 @@ func SetupHookLogging(hooks []config.LogrusHook, componentName string) {
 			checkSyslogHookParams(hook.Params)
 			setupSyslogHook(hook, level, componentName)
 		case "std":
+			if hook.Format == "json" {
+				// The std hook uses the formatter of the standard logger.
+				logrus.SetFormatter(jsonFormatter())
+			}
 			setupStdLogHook(level)
 		default:
 			logrus.Fatalf("Unrecognised logging hook type: %s", hook.Type)
@@ -10,6 +10,8 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/setup/config"
 
 	"github.com/opentracing/opentracing-go"
 )
@@ -18,17 +20,18 @@ type httpClient struct {
 	hc *http.Client
 }
 
-// NewHTTPClient creates a new Push Gateway client.
-func NewHTTPClient(disableTLSValidation bool) Client {
+// NewHTTPClient creates a new Push Gateway client. Rate-limited requests are
+// retried as configured by retryAfter.
+func NewHTTPClient(disableTLSValidation bool, retryAfter *config.RetryAfterOptions) Client {
 	hc := &http.Client{
 		Timeout: 30 * time.Second,
-		Transport: &http.Transport{
+		Transport: httputil.NewRetryAfterTransport(&http.Transport{
 			DisableKeepAlives: true,
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: disableTLSValidation,
 			},
 			Proxy: http.ProxyFromEnvironment,
-		},
+		}, retryAfter),
 	}
 	return &httpClient{hc: hc}
 }
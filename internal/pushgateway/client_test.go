@@ -7,6 +7,9 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
 )
 
 func TestNotify(t *testing.T) {
@@ -33,7 +36,7 @@ func TestNotify(t *testing.T) {
 	}))
 	defer svr.Close()
 
-	cl := NewHTTPClient(true)
+	cl := NewHTTPClient(true, &config.RetryAfterOptions{})
 	gotResponse := NotifyResponse{}
 
 	// Test happy path
@@ -52,3 +55,32 @@ func TestNotify(t *testing.T) {
 		t.Errorf("expected notifying the pushgateway to fail, but it succeeded")
 	}
 }
+
+func TestNotifyRetryAfter(t *testing.T) {
+	var attempts []time.Time
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(NotifyResponse{})
+	}))
+	defer svr.Close()
+
+	cl := NewHTTPClient(true, &config.RetryAfterOptions{
+		Enabled:    true,
+		MaxDelay:   time.Second * 5,
+		MaxRetries: 1,
+	})
+	if err := cl.Notify(context.Background(), svr.URL, &NotifyRequest{}, &NotifyResponse{}); err != nil {
+		t.Fatalf("expected the notification to succeed after retrying, got %s", err)
+	}
+	if len(attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(attempts))
+	}
+	if delay := attempts[1].Sub(attempts[0]); delay < time.Second {
+		t.Fatalf("expected the retry to wait for the Retry-After delay, waited %s", delay)
+	}
+}
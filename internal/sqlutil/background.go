@@ -0,0 +1,255 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/setup/process"
+)
+
+// BackgroundUpdate is a long-running storage job, such as compressing room
+// state, which runs in batches after startup rather than blocking it like a
+// migration. Batches must be idempotent, as an update is
+// started from scratch every time Dendrite starts or the update is triggered.
+type BackgroundUpdate struct {
+	// A unique name for the update
+	Name string
+	// Batch processes the next batch of items, returning how many
+	// were processed and whether the update has finished.
+	Batch func(ctx context.Context) (processed int64, done bool, err error)
+	// Total optionally estimates the number of items to process, so
+	// that progress can be reported.
+	Total func(ctx context.Context) (int64, error)
+}
+
+type BackgroundUpdateState string
+
+const (
+	BackgroundUpdatePending   BackgroundUpdateState = "pending"
+	BackgroundUpdateRunning   BackgroundUpdateState = "running"
+	BackgroundUpdatePaused    BackgroundUpdateState = "paused"
+	BackgroundUpdateCompleted BackgroundUpdateState = "completed"
+	BackgroundUpdateFailed    BackgroundUpdateState = "failed"
+)
+
+// BackgroundUpdateStatus reports the progress of a background update.
+type BackgroundUpdateStatus struct {
+	Name      string                `json:"name"`
+	State     BackgroundUpdateState `json:"state"`
+	Processed int64                 `json:"processed"`
+	Total     int64                 `json:"total,omitempty"`
+	Error     string                `json:"error,omitempty"`
+}
+
+type backgroundUpdate struct {
+	BackgroundUpdate
+	status BackgroundUpdateStatus
+}
+
+// BackgroundUpdates is a registry of background updates. Updates are run one
+// batch at a time, in the order they were registered, and can be paused,
+// resumed or triggered again while Dendrite is running.
+type BackgroundUpdates struct {
+	mu      sync.Mutex
+	updates []*backgroundUpdate
+	wake    chan struct{}
+}
+
+// NewBackgroundUpdates creates a registry of background updates. If a process
+// context is given, registered updates are run until it shuts down.
+func NewBackgroundUpdates(process *process.ProcessContext) *BackgroundUpdates {
+	b := &BackgroundUpdates{
+		wake: make(chan struct{}, 1),
+	}
+	if process != nil {
+		process.ComponentStarted()
+		go func() {
+			defer process.ComponentFinished()
+			for {
+				if b.runBatch(process.Context()) {
+					continue
+				}
+				select {
+				case <-b.wake:
+				case <-process.WaitForShutdown():
+					return
+				}
+			}
+		}()
+	}
+	return b
+}
+
+// Register adds a background update, which will be run after any updates
+// registered before it.
+func (b *BackgroundUpdates) Register(update BackgroundUpdate) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.find(update.Name) != nil {
+		return fmt.Errorf("background update %q is already registered", update.Name)
+	}
+	b.updates = append(b.updates, &backgroundUpdate{
+		BackgroundUpdate: update,
+		status: BackgroundUpdateStatus{
+			Name:  update.Name,
+			State: BackgroundUpdatePending,
+		},
+	})
+	b.notify()
+	return nil
+}
+
+// Status returns the status of all registered background updates.
+func (b *BackgroundUpdates) Status() []BackgroundUpdateStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	statuses := make([]BackgroundUpdateStatus, 0, len(b.updates))
+	for _, u := range b.updates {
+		statuses = append(statuses, u.status)
+	}
+	return statuses
+}
+
+// Pause stops a background update after its current batch. Completed or
+// failed updates can't be paused.
+func (b *BackgroundUpdates) Pause(name string) error {
+	return b.transition(name, func(u *backgroundUpdate) error {
+		switch u.status.State {
+		case BackgroundUpdatePending, BackgroundUpdateRunning:
+			u.status.State = BackgroundUpdatePaused
+			return nil
+		case BackgroundUpdatePaused:
+			return nil
+		}
+		return fmt.Errorf("background update %q is %s", name, u.status.State)
+	})
+}
+
+// Resume continues a paused background update.
+func (b *BackgroundUpdates) Resume(name string) error {
+	return b.transition(name, func(u *backgroundUpdate) error {
+		if u.status.State != BackgroundUpdatePaused {
+			return fmt.Errorf("background update %q is not paused", name)
+		}
+		u.status.State = BackgroundUpdatePending
+		return nil
+	})
+}
+
+// Trigger runs a background update again from the start, for example to
+// retry it after it failed. A running update is not interrupted.
+func (b *BackgroundUpdates) Trigger(name string) error {
+	return b.transition(name, func(u *backgroundUpdate) error {
+		if u.status.State == BackgroundUpdateRunning || u.status.State == BackgroundUpdatePending {
+			return nil
+		}
+		u.status = BackgroundUpdateStatus{
+			Name:  u.Name,
+			State: BackgroundUpdatePending,
+		}
+		return nil
+	})
+}
+
+func (b *BackgroundUpdates) transition(name string, fn func(u *backgroundUpdate) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u := b.find(name)
+	if u == nil {
+		return ErrBackgroundUpdateNotFound
+	}
+	if err := fn(u); err != nil {
+		return err
+	}
+	b.notify()
+	return nil
+}
+
+// ErrBackgroundUpdateNotFound is returned when there is no background update
+// with the given name.
+var ErrBackgroundUpdateNotFound = fmt.Errorf("background update not found")
+
+func (b *BackgroundUpdates) find(name string) *backgroundUpdate {
+	for _, u := range b.updates {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+func (b *BackgroundUpdates) notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runBatch runs a single batch of the first runnable background update.
+// It returns false if there was nothing to run.
+func (b *BackgroundUpdates) runBatch(ctx context.Context) bool {
+	b.mu.Lock()
+	var u *backgroundUpdate
+	for _, candidate := range b.updates {
+		if candidate.status.State == BackgroundUpdatePending || candidate.status.State == BackgroundUpdateRunning {
+			u = candidate
+			break
+		}
+	}
+	if u == nil {
+		b.mu.Unlock()
+		return false
+	}
+	starting := u.status.State == BackgroundUpdatePending && u.status.Processed == 0
+	u.status.State = BackgroundUpdateRunning
+	b.mu.Unlock()
+
+	logger := logrus.WithField("background_update", u.Name)
+	if starting {
+		logger.Info("Starting background update")
+		if u.Total != nil {
+			total, err := u.Total(ctx)
+			if err != nil {
+				logger.WithError(err).Warn("Failed to estimate the size of background update")
+			}
+			b.mu.Lock()
+			u.status.Total = total
+			b.mu.Unlock()
+		}
+	}
+
+	processed, done, err := u.Batch(ctx)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	u.status.Processed += processed
+	switch {
+	case err != nil:
+		logger.WithError(err).Error("Background update failed")
+		u.status.State = BackgroundUpdateFailed
+		u.status.Error = err.Error()
+	case done:
+		logger.Info("Background update completed")
+		u.status.State = BackgroundUpdateCompleted
+	case u.status.State == BackgroundUpdatePaused:
+		logger.Info("Background update paused")
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package sqlutil
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// countingUpdate returns a background update which processes batchSize
+// items per batch, out of total.
+func countingUpdate(name string, total, batchSize int64) BackgroundUpdate {
+	var processed int64
+	return BackgroundUpdate{
+		Name: name,
+		Batch: func(ctx context.Context) (int64, bool, error) {
+			n := batchSize
+			if processed+n > total {
+				n = total - processed
+			}
+			processed += n
+			return n, processed >= total, nil
+		},
+		Total: func(ctx context.Context) (int64, error) {
+			return total, nil
+		},
+	}
+}
+
+func TestBackgroundUpdatesStatus(t *testing.T) {
+	ctx := context.Background()
+	updates := NewBackgroundUpdates(nil)
+	if err := updates.Register(countingUpdate("first", 10, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := updates.Register(countingUpdate("second", 2, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := updates.Register(countingUpdate("first", 1, 1)); err == nil {
+		t.Fatal("expected an error registering a duplicate update")
+	}
+
+	wantStatus := func(want ...BackgroundUpdateStatus) {
+		t.Helper()
+		got := updates.Status()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("unexpected status\n got: %+v\nwant: %+v", got, want)
+		}
+	}
+	wantStatus(
+		BackgroundUpdateStatus{Name: "first", State: BackgroundUpdatePending},
+		BackgroundUpdateStatus{Name: "second", State: BackgroundUpdatePending},
+	)
+
+	updates.runBatch(ctx)
+	wantStatus(
+		BackgroundUpdateStatus{Name: "first", State: BackgroundUpdateRunning, Processed: 4, Total: 10},
+		BackgroundUpdateStatus{Name: "second", State: BackgroundUpdatePending},
+	)
+
+	for updates.runBatch(ctx) {
+	}
+	wantStatus(
+		BackgroundUpdateStatus{Name: "first", State: BackgroundUpdateCompleted, Processed: 10, Total: 10},
+		BackgroundUpdateStatus{Name: "second", State: BackgroundUpdateCompleted, Processed: 2, Total: 2},
+	)
+}
+
+func TestBackgroundUpdatesFailure(t *testing.T) {
+	ctx := context.Background()
+	updates := NewBackgroundUpdates(nil)
+	fail := true
+	if err := updates.Register(BackgroundUpdate{
+		Name: "flaky",
+		Batch: func(ctx context.Context) (int64, bool, error) {
+			if fail {
+				return 0, false, fmt.Errorf("oops")
+			}
+			return 1, true, nil
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	updates.runBatch(ctx)
+	if status := updates.Status()[0]; status.State != BackgroundUpdateFailed || status.Error != "oops" {
+		t.Fatalf("expected the update to have failed, got %+v", status)
+	}
+	if updates.runBatch(ctx) {
+		t.Fatal("expected a failed update not to be retried automatically")
+	}
+
+	fail = false
+	if err := updates.Trigger("flaky"); err != nil {
+		t.Fatal(err)
+	}
+	updates.runBatch(ctx)
+	if status := updates.Status()[0]; status.State != BackgroundUpdateCompleted || status.Error != "" {
+		t.Fatalf("expected the update to have completed, got %+v", status)
+	}
+}
+
+func TestBackgroundUpdatesPause(t *testing.T) {
+	ctx := context.Background()
+	updates := NewBackgroundUpdates(nil)
+	if err := updates.Register(countingUpdate("first", 10, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := updates.Register(countingUpdate("second", 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	updates.runBatch(ctx)
+	if err := updates.Pause("first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := updates.Pause("unknown"); err != ErrBackgroundUpdateNotFound {
+		t.Fatalf("expected ErrBackgroundUpdateNotFound, got %v", err)
+	}
+
+	// The paused update is skipped in favour of the next one.
+	updates.runBatch(ctx)
+	status := updates.Status()
+	if status[0].State != BackgroundUpdatePaused || status[0].Processed != 5 {
+		t.Fatalf("expected the first update to be paused, got %+v", status[0])
+	}
+	if status[1].State != BackgroundUpdateCompleted {
+		t.Fatalf("expected the second update to have completed, got %+v", status[1])
+	}
+	if updates.runBatch(ctx) {
+		t.Fatal("expected nothing to run while the update is paused")
+	}
+	if err := updates.Pause("second"); err == nil {
+		t.Fatal("expected an error pausing a completed update")
+	}
+
+	// Resuming continues where the update left off.
+	if err := updates.Resume("first"); err != nil {
+		t.Fatal(err)
+	}
+	updates.runBatch(ctx)
+	if status := updates.Status()[0]; status.State != BackgroundUpdateCompleted || status.Processed != 10 {
+		t.Fatalf("expected the first update to have completed, got %+v", status)
+	}
+	if err := updates.Resume("first"); err == nil {
+		t.Fatal("expected an error resuming an update which isn't paused")
+	}
+}
@@ -0,0 +1,326 @@
+// Copyright 2026 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+)
+
+type readReplicaContextKey struct{}
+
+// WithReadReplica marks the context so that queries and read-only transactions
+// made with it may be served by the read replica, if one is configured. Only use
+// this for reads which can tolerate replication lag: anything which needs to see
+// a write that was just made (read-after-write) should use the primary instead.
+func WithReadReplica(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readReplicaContextKey{}, true)
+}
+
+// WithPrimary marks the context so that all queries made with it are served by
+// the primary, even if the context was previously marked with WithReadReplica.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readReplicaContextKey{}, false)
+}
+
+func useReadReplica(ctx context.Context) bool {
+	replica, _ := ctx.Value(readReplicaContextKey{}).(bool)
+	return replica
+}
+
+// openWithReadReplica opens a database which sends everything to the primary
+// unless the context has been marked with WithReadReplica, in which case
+// queries outside of a transaction and read-only transactions are sent to the
+// replica instead. Writes and read-write transactions always use the primary.
+func openWithReadReplica(driverName, primaryDSN, replicaDSN string) (*sql.DB, error) {
+	d, err := lookupDriver(driverName)
+	if err != nil {
+		return nil, err
+	}
+	primary, err := dsnConnector(d, primaryDSN)
+	if err != nil {
+		return nil, fmt.Errorf("primary: %w", err)
+	}
+	replica, err := dsnConnector(d, replicaDSN)
+	if err != nil {
+		return nil, fmt.Errorf("read replica: %w", err)
+	}
+	return sql.OpenDB(&replicaConnector{primary: primary, replica: replica}), nil
+}
+
+// lookupDriver finds a registered driver by name. Opening a database doesn't
+// connect to it, so this is safe to do with an empty data source name.
+func lookupDriver(driverName string) (driver.Driver, error) {
+	db, err := sql.Open(driverName, "")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close() // nolint: errcheck
+	return db.Driver(), nil
+}
+
+func dsnConnector(d driver.Driver, dsn string) (driver.Connector, error) {
+	if dc, ok := d.(driver.DriverContext); ok {
+		return dc.OpenConnector(dsn)
+	}
+	return &simpleConnector{driver: d, dsn: dsn}, nil
+}
+
+// simpleConnector is a connector for drivers which don't implement
+// driver.DriverContext.
+type simpleConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (c *simpleConnector) Connect(_ context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *simpleConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type replicaConnector struct {
+	primary driver.Connector
+	replica driver.Connector
+}
+
+func (c *replicaConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.primary.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &replicaConn{connector: c, primary: conn}, nil
+}
+
+func (c *replicaConnector) Driver() driver.Driver {
+	return c.primary.Driver()
+}
+
+type replicaTxState int
+
+const (
+	replicaNoTx replicaTxState = iota
+	replicaPrimaryTx
+	replicaReplicaTx
+)
+
+// replicaConn pairs a connection to the primary with a lazily opened
+// connection to the replica. database/sql never uses a connection from
+// more than one goroutine at a time, so no locking is needed here.
+type replicaConn struct {
+	connector *replicaConnector
+	primary   driver.Conn
+	replica   driver.Conn
+	tx        replicaTxState
+}
+
+func (c *replicaConn) useReplica(ctx context.Context) bool {
+	switch c.tx {
+	case replicaReplicaTx:
+		return true
+	case replicaPrimaryTx:
+		return false
+	default:
+		return useReadReplica(ctx)
+	}
+}
+
+func (c *replicaConn) connectReplica(ctx context.Context) (driver.Conn, error) {
+	if c.replica == nil {
+		conn, err := c.connector.replica.Connect(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to read replica: %w", err)
+		}
+		c.replica = conn
+	}
+	return c.replica, nil
+}
+
+func (c *replicaConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *replicaConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt := &replicaStmt{conn: c, query: query}
+	// Always prepare on the primary, so that syntax errors are reported
+	// straight away. The replica statement is prepared on first use.
+	if _, err := stmt.target(WithPrimary(ctx)); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+func (c *replicaConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *replicaConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	conn, state := c.primary, replicaPrimaryTx
+	if opts.ReadOnly && useReadReplica(ctx) {
+		replica, err := c.connectReplica(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, state = replica, replicaReplicaTx
+	}
+	beginner, ok := conn.(driver.ConnBeginTx)
+	if !ok {
+		return nil, errors.New("sqlutil: driver does not support ConnBeginTx")
+	}
+	tx, err := beginner.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.tx = state
+	return &replicaTx{conn: c, tx: tx}, nil
+}
+
+func (c *replicaConn) ResetSession(ctx context.Context) error {
+	for _, conn := range []driver.Conn{c.primary, c.replica} {
+		if resetter, ok := conn.(driver.SessionResetter); ok {
+			if err := resetter.ResetSession(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *replicaConn) IsValid() bool {
+	for _, conn := range []driver.Conn{c.primary, c.replica} {
+		if validator, ok := conn.(driver.Validator); ok && !validator.IsValid() {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *replicaConn) Close() error {
+	err := c.primary.Close()
+	if c.replica != nil {
+		if rerr := c.replica.Close(); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+type replicaTx struct {
+	conn *replicaConn
+	tx   driver.Tx
+}
+
+func (t *replicaTx) Commit() error {
+	t.conn.tx = replicaNoTx
+	return t.tx.Commit()
+}
+
+func (t *replicaTx) Rollback() error {
+	t.conn.tx = replicaNoTx
+	return t.tx.Rollback()
+}
+
+// replicaStmt is a statement which is prepared on whichever of the primary or
+// the replica it is executed against. database/sql reuses statements prepared
+// on a connection for transactions on that connection, so the choice has to be
+// made at execution time rather than when preparing.
+type replicaStmt struct {
+	conn    *replicaConn
+	query   string
+	primary driver.Stmt
+	replica driver.Stmt
+}
+
+func (s *replicaStmt) target(ctx context.Context) (driver.Stmt, error) {
+	conn, stmt := s.conn.primary, &s.primary
+	if s.conn.useReplica(ctx) {
+		replica, err := s.conn.connectReplica(ctx)
+		if err != nil {
+			return nil, err
+		}
+		conn, stmt = replica, &s.replica
+	}
+	if *stmt == nil {
+		preparer, ok := conn.(driver.ConnPrepareContext)
+		if !ok {
+			return nil, errors.New("sqlutil: driver does not support ConnPrepareContext")
+		}
+		prepared, err := preparer.PrepareContext(ctx, s.query)
+		if err != nil {
+			return nil, err
+		}
+		*stmt = prepared
+	}
+	return *stmt, nil
+}
+
+func (s *replicaStmt) NumInput() int {
+	return s.primary.NumInput()
+}
+
+func (s *replicaStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("sqlutil: Exec without context is not supported")
+}
+
+func (s *replicaStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("sqlutil: Query without context is not supported")
+}
+
+func (s *replicaStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	// Writes always go to the primary. If we're in a read-only transaction
+	// on the replica then the database will reject the write for us.
+	if s.conn.tx == replicaNoTx {
+		ctx = WithPrimary(ctx)
+	}
+	stmt, err := s.target(ctx)
+	if err != nil {
+		return nil, err
+	}
+	execer, ok := stmt.(driver.StmtExecContext)
+	if !ok {
+		return nil, errors.New("sqlutil: driver does not support StmtExecContext")
+	}
+	return execer.ExecContext(ctx, args)
+}
+
+func (s *replicaStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	stmt, err := s.target(ctx)
+	if err != nil {
+		return nil, err
+	}
+	queryer, ok := stmt.(driver.StmtQueryContext)
+	if !ok {
+		return nil, errors.New("sqlutil: driver does not support StmtQueryContext")
+	}
+	return queryer.QueryContext(ctx, args)
+}
+
+func (s *replicaStmt) Close() error {
+	var err error
+	for _, stmt := range []driver.Stmt{s.primary, s.replica} {
+		if stmt == nil {
+			continue
+		}
+		if cerr := stmt.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
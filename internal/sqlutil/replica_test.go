@@ -0,0 +1,87 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestReadReplicaRouting(t *testing.T) {
+	_, primary, err := sqlmock.NewWithDSN("replica-test-primary")
+	assertNoError(t, err, "Failed to make primary DB")
+	_, replica, err := sqlmock.NewWithDSN("replica-test-replica")
+	assertNoError(t, err, "Failed to make replica DB")
+
+	db, err := openWithReadReplica("sqlmock", "replica-test-primary", "replica-test-replica")
+	assertNoError(t, err, "Failed to open DB with read replica")
+	db.SetMaxOpenConns(1)
+
+	primary.ExpectPrepare(`SELECT name FROM profiles`)
+	stmt, err := db.Prepare("SELECT name FROM profiles WHERE id = $1")
+	assertNoError(t, err, "Failed to prepare statement")
+
+	queryName := func(ctx context.Context, stmt *sql.Stmt) string {
+		t.Helper()
+		var name string
+		if err = stmt.QueryRowContext(ctx, 1).Scan(&name); err != nil {
+			t.Fatalf("failed to query: %s", err)
+		}
+		return name
+	}
+
+	// Queries which have been marked as safe to use the replica go there.
+	replica.ExpectPrepare(`SELECT name FROM profiles`).
+		ExpectQuery().WillReturnRows(replica.NewRows([]string{"name"}).AddRow("replica"))
+	if name := queryName(WithReadReplica(context.Background()), stmt); name != "replica" {
+		t.Fatalf("expected read query to use the replica, got %q", name)
+	}
+
+	// Anything else goes to the primary.
+	primary.ExpectQuery(`SELECT name FROM profiles`).
+		WillReturnRows(primary.NewRows([]string{"name"}).AddRow("primary"))
+	if name := queryName(context.Background(), stmt); name != "primary" {
+		t.Fatalf("expected unmarked query to use the primary, got %q", name)
+	}
+
+	// Writes go to the primary even if the context is marked.
+	primary.ExpectPrepare(`UPDATE profiles`).
+		ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
+	if _, err = db.ExecContext(WithReadReplica(context.Background()), "UPDATE profiles SET name = $1", "x"); err != nil {
+		t.Fatalf("failed to exec: %s", err)
+	}
+
+	// Read-only transactions go to the replica.
+	replica.ExpectBegin()
+	replica.ExpectQuery(`SELECT name FROM profiles`).
+		WillReturnRows(replica.NewRows([]string{"name"}).AddRow("replica"))
+	replica.ExpectCommit()
+	ctx := WithReadReplica(context.Background())
+	txn, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	assertNoError(t, err, "Failed to begin read-only transaction")
+	if name := queryName(ctx, TxStmtContext(ctx, txn, stmt)); name != "replica" {
+		t.Fatalf("expected read-only transaction to use the replica, got %q", name)
+	}
+	assertNoError(t, txn.Commit(), "Failed to commit read-only transaction")
+
+	// Read-write transactions, which may need to read their own writes,
+	// go to the primary even if the context is marked.
+	primary.ExpectBegin()
+	primary.ExpectQuery(`SELECT name FROM profiles`).
+		WillReturnRows(primary.NewRows([]string{"name"}).AddRow("primary"))
+	primary.ExpectCommit()
+	txn, err = db.BeginTx(ctx, nil)
+	assertNoError(t, err, "Failed to begin transaction")
+	if name := queryName(ctx, TxStmtContext(ctx, txn, stmt)); name != "primary" {
+		t.Fatalf("expected read-write transaction to use the primary, got %q", name)
+	}
+	assertNoError(t, txn.Commit(), "Failed to commit transaction")
+
+	if err = primary.ExpectationsWereMet(); err != nil {
+		t.Fatalf("primary: %s", err)
+	}
+	if err = replica.ExpectationsWereMet(); err != nil {
+		t.Fatalf("replica: %s", err)
+	}
+}
@@ -14,7 +14,8 @@ var skipSanityChecks = flag.Bool("skip-db-sanity", false, "Ignore sanity checks
 
 // Open opens a database specified by its database driver name and a driver-specific data source name,
 // usually consisting of at least a database name and connection information. Includes tracing driver
-// if DENDRITE_TRACE_SQL=1
+// if DENDRITE_TRACE_SQL=1. If a read replica is configured then read-only queries made with a context
+// from WithReadReplica will be sent to it.
 func Open(dbProperties *config.DatabaseOptions, writer Writer) (*sql.DB, error) {
 	var err error
 	var driverName, dsn string
@@ -36,7 +37,15 @@ func Open(dbProperties *config.DatabaseOptions, writer Writer) (*sql.DB, error)
 		// install the wrapped driver
 		driverName += "-trace"
 	}
-	db, err := sql.Open(driverName, dsn)
+	var db *sql.DB
+	if replica := dbProperties.ReadReplicaConnectionString; replica != "" {
+		if !replica.IsPostgres() || driverName == SQLITE_DRIVER_NAME {
+			return nil, fmt.Errorf("read replicas are only supported with PostgreSQL databases")
+		}
+		db, err = openWithReadReplica(driverName, dsn, string(replica))
+	} else {
+		db, err = sql.Open(driverName, dsn)
+	}
 	if err != nil {
 		return nil, err
 	}
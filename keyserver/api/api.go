@@ -265,6 +265,11 @@ type QueryKeysRequest struct {
 	// Maps user IDs to a list of devices
 	UserToDevices map[string][]string
 	Timeout       time.Duration
+	// The device list position of the sync token the client passed, if any.
+	// When set, the device lists of remote users which we are tracking are
+	// returned from the database, since they are at least as up-to-date as
+	// the device list changes the client has seen in /sync.
+	DeviceListPosition int64
 }
 
 type QueryKeysResponse struct {
@@ -125,6 +125,9 @@ type DeviceListUpdaterDatabase interface {
 	// PrevIDsExists returns true if all prev IDs exist for this user.
 	PrevIDsExists(ctx context.Context, userID string, prevIDs []int64) (bool, error)
 
+	// MaxStreamIDForUser returns the latest stream ID we know about for this user, or 0 if there is none.
+	MaxStreamIDForUser(ctx context.Context, userID string) (int64, error)
+
 	// DeviceKeysJSON populates the KeyJSON for the given keys. If any proided `keys` have a `KeyJSON` or `StreamID` already then it will be replaced.
 	DeviceKeysJSON(ctx context.Context, keys []api.DeviceMessage) error
 
@@ -261,6 +264,22 @@ func (u *DeviceListUpdater) update(ctx context.Context, event gomatrixserverlib.
 	if len(event.PrevID) == 0 {
 		exists = false
 	}
+	// if we already know about a later stream ID, e.g. because a resync was triggered by an
+	// update which arrived before this one, then this update is already reflected and can be
+	// dropped rather than being treated as a gap.
+	latest, err := u.db.MaxStreamIDForUser(ctx, event.UserID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get latest stream ID for %s: %w", event.UserID, err)
+	}
+	if latest > 0 && event.StreamID <= latest {
+		util.GetLogger(ctx).WithFields(logrus.Fields{
+			"user_id":   event.UserID,
+			"device_id": event.DeviceID,
+			"stream_id": event.StreamID,
+			"latest":    latest,
+		}).Debug("Ignoring device list update which we already have")
+		return false, nil
+	}
 	util.GetLogger(ctx).WithFields(logrus.Fields{
 		"prev_ids_exist": exists,
 		"user_id":        event.UserID,
@@ -338,8 +357,12 @@ func (u *DeviceListUpdater) notifyWorkers(userID string) {
 	_, _ = hash.Write([]byte(remoteServer))
 	index := int(int64(hash.Sum32()) % int64(len(u.workerChans)))
 
-	ch := u.assignChannel(userID)
-	u.workerChans[index] <- remoteServer
+	// if a resync for this user is already pending then wait for that one
+	// to finish rather than asking the workers again
+	ch, pending := u.assignChannel(userID)
+	if !pending {
+		u.workerChans[index] <- remoteServer
+	}
 	select {
 	case <-ch:
 	case <-time.After(10 * time.Second):
@@ -348,15 +371,17 @@ func (u *DeviceListUpdater) notifyWorkers(userID string) {
 	}
 }
 
-func (u *DeviceListUpdater) assignChannel(userID string) chan bool {
+// assignChannel returns the channel which is closed when the device list of
+// the given user has been resynced, and whether a resync was already pending.
+func (u *DeviceListUpdater) assignChannel(userID string) (chan bool, bool) {
 	u.userIDToChanMu.Lock()
 	defer u.userIDToChanMu.Unlock()
 	if ch, ok := u.userIDToChan[userID]; ok {
-		return ch
+		return ch, true
 	}
 	ch := make(chan bool)
 	u.userIDToChan[userID] = ch
-	return ch
+	return ch, false
 }
 
 func (u *DeviceListUpdater) clearChannel(userID string) {
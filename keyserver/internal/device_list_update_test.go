@@ -107,10 +107,24 @@ func (d *mockDeviceListUpdaterDatabase) isStale(userID string) bool {
 // StoreRemoteDeviceKeys persists the given keys. Keys with the same user ID and device ID will be replaced. An empty KeyJSON removes the key
 // for this (user, device). Does not modify the stream ID for keys.
 func (d *mockDeviceListUpdaterDatabase) StoreRemoteDeviceKeys(ctx context.Context, keys []api.DeviceMessage, clear []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	d.storedKeys = append(d.storedKeys, keys...)
 	return nil
 }
 
+func (d *mockDeviceListUpdaterDatabase) MaxStreamIDForUser(ctx context.Context, userID string) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var streamID int64
+	for _, key := range d.storedKeys {
+		if key.UserID == userID && key.StreamID > streamID {
+			streamID = key.StreamID
+		}
+	}
+	return streamID, nil
+}
+
 // PrevIDsExists returns true if all prev IDs exist for this user.
 func (d *mockDeviceListUpdaterDatabase) PrevIDsExists(ctx context.Context, userID string, prevIDs []int64) (bool, error) {
 	return d.prevIDsExist(userID, prevIDs), nil
@@ -280,6 +294,75 @@ func TestUpdateNoPrevID(t *testing.T) {
 
 }
 
+// Test that an update which arrives out of order triggers a single full resync, and that
+// the update which should have arrived first is dropped rather than triggering another.
+func TestUpdateOutOfOrder(t *testing.T) {
+	db := &mockDeviceListUpdaterDatabase{
+		staleUsers: make(map[string]bool),
+		prevIDsExist: func(string, []int64) bool {
+			return false
+		},
+	}
+	ap := &mockDeviceListUpdaterAPI{}
+	producer := &mockKeyChangeProducer{}
+	remoteUserID := "@alice:example.somewhere"
+	keyJSON := `{"user_id":"` + remoteUserID + `","device_id":"JLAFKJWSCS","algorithms":["m.olm.v1.curve25519-aes-sha2","m.megolm.v1.aes-sha2"],"keys":{"curve25519:JLAFKJWSCS":"3C5BFWi2Y8MaVvjM8M22DBmh24PmgR0nPvJOIArzgyI","ed25519:JLAFKJWSCS":"lEuiRJBit0IG6nUf5pUzWTUEsRVVe/HJkoKuEww9ULI"},"signatures":{"` + remoteUserID + `":{"ed25519:JLAFKJWSCS":"dSO80A01XiigH3uBiDVx/EjzaoycHcjq9lfQX0uWsqxl2giMIiSPR8a4d291W1ihKJL/a+myXS367WT6NAIcBA"}}}`
+	var requestsMu sync.Mutex
+	requests := 0
+	fedClient := newFedClient(func(req *http.Request) (*http.Response, error) {
+		requestsMu.Lock()
+		requests++
+		requestsMu.Unlock()
+		return &http.Response{
+			StatusCode: 200,
+			Body: io.NopCloser(strings.NewReader(`
+			{
+				"user_id": "` + remoteUserID + `",
+				"stream_id": 5,
+				"devices": [
+				  {
+					"device_id": "JLAFKJWSCS",
+					"keys": ` + keyJSON + `,
+					"device_display_name": "Mobile Phone"
+				  }
+				]
+			  }
+			`)),
+		}, nil
+	})
+	updater := NewDeviceListUpdater(process.NewProcessContext(), db, ap, producer, fedClient, 1, nil, "example.test")
+	if err := updater.Start(); err != nil {
+		t.Fatalf("failed to start updater: %s", err)
+	}
+
+	// stream ID 5 arrives before stream ID 4, so we haven't seen its prev ID
+	for _, streamID := range []int64{5, 4} {
+		event := gomatrixserverlib.DeviceListUpdateEvent{
+			DeviceDisplayName: "Mobile Phone",
+			DeviceID:          "JLAFKJWSCS",
+			Keys:              []byte(keyJSON),
+			PrevID:            []int64{streamID - 1},
+			StreamID:          streamID,
+			UserID:            remoteUserID,
+		}
+		if err := updater.Update(ctx, event); err != nil {
+			t.Fatalf("Update returned an error: %s", err)
+		}
+	}
+
+	requestsMu.Lock()
+	defer requestsMu.Unlock()
+	if requests != 1 {
+		t.Fatalf("expected a single /user/devices request, got %d", requests)
+	}
+	if db.isStale(remoteUserID) {
+		t.Errorf("%s still marked as stale", remoteUserID)
+	}
+	if latest, _ := db.MaxStreamIDForUser(ctx, remoteUserID); latest != 5 {
+		t.Errorf("expected latest stream ID 5, got %d", latest)
+	}
+}
+
 // Test that if we make N calls to ManualUpdate for the same user, we only do it once, assuming the
 // update is still ongoing.
 func TestDebounce(t *testing.T) {
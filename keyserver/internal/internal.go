@@ -142,9 +142,13 @@ func (a *KeyInternalAPI) claimRemoteKeys(
 
 	for d, k := range domainToDeviceKeys {
 		go func(domain string, keysToClaim map[string]map[string]string) {
-			fedCtx, cancel := context.WithTimeout(ctx, timeout)
-			defer cancel()
 			defer wg.Done()
+			fedCtx := ctx
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				fedCtx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
 
 			claimKeyRes, err := a.FedClient.ClaimKeys(fedCtx, a.Cfg.Matrix.ServerName, gomatrixserverlib.ServerName(domain), keysToClaim)
 
@@ -153,15 +157,25 @@ func (a *KeyInternalAPI) claimRemoteKeys(
 
 			if err != nil {
 				util.GetLogger(ctx).WithError(err).WithField("server", domain).Error("ClaimKeys failed")
+				message := err.Error()
+				if fedCtx.Err() == context.DeadlineExceeded {
+					message = "timed out waiting for server"
+				}
 				res.Failures[domain] = map[string]interface{}{
-					"message": err.Error(),
+					"message": message,
 				}
 				failures++
 				return
 			}
 
 			for userID, deviceIDToKeys := range claimKeyRes.OneTimeKeys {
-				res.OneTimeKeys[userID] = make(map[string]map[string]json.RawMessage)
+				// Only accept keys for the users we asked this server about.
+				if _, ok := keysToClaim[userID]; !ok {
+					continue
+				}
+				if _, ok := res.OneTimeKeys[userID]; !ok {
+					res.OneTimeKeys[userID] = make(map[string]map[string]json.RawMessage)
+				}
 				for deviceID, keys := range deviceIDToKeys {
 					res.OneTimeKeys[userID][deviceID] = keys
 					claimed += len(keys)
@@ -178,7 +192,7 @@ func (a *KeyInternalAPI) claimRemoteKeys(
 }
 
 func (a *KeyInternalAPI) PerformDeleteKeys(ctx context.Context, req *api.PerformDeleteKeysRequest, res *api.PerformDeleteKeysResponse) error {
-	if err := a.DB.DeleteDeviceKeys(ctx, req.UserID, req.KeyIDs); err != nil {
+	if err := a.deleteDeviceKeys(ctx, req.UserID, req.KeyIDs); err != nil {
 		res.Error = &api.KeyError{
 			Err: fmt.Sprintf("Failed to delete device keys: %s", err),
 		}
@@ -186,6 +200,20 @@ func (a *KeyInternalAPI) PerformDeleteKeys(ctx context.Context, req *api.Perform
 	return nil
 }
 
+// deleteDeviceKeys deletes the device keys of the given devices and emits
+// the deletions. This is the only place which emits key changes for deleted
+// devices, so that other servers see each deletion exactly once.
+func (a *KeyInternalAPI) deleteDeviceKeys(ctx context.Context, userID string, deviceIDs []gomatrixserverlib.KeyID) error {
+	deleted, err := a.DB.DeleteDeviceKeys(ctx, userID, deviceIDs)
+	if err != nil {
+		return err
+	}
+	if err = a.Producer.ProduceKeyChanges(deleted); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to emit device key deletions")
+	}
+	return nil
+}
+
 func (a *KeyInternalAPI) QueryOneTimeKeys(ctx context.Context, req *api.QueryOneTimeKeysRequest, res *api.QueryOneTimeKeysResponse) error {
 	count, err := a.DB.OneTimeKeysCount(ctx, req.UserID, req.DeviceID)
 	if err != nil {
@@ -322,7 +350,7 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 	}
 
 	// attempt to satisfy key queries from the local database first as we should get device updates pushed to us
-	domainToDeviceKeys = a.remoteKeysFromDatabase(ctx, res, &respMu, domainToDeviceKeys)
+	domainToDeviceKeys = a.remoteKeysFromDatabase(ctx, res, &respMu, domainToDeviceKeys, domainToCrossSigningKeys, req.DeviceListPosition > 0)
 	if len(domainToDeviceKeys) > 0 || len(domainToCrossSigningKeys) > 0 {
 		// perform key queries for remote devices
 		a.queryRemoteKeys(ctx, req.Timeout, res, domainToDeviceKeys, domainToCrossSigningKeys)
@@ -405,12 +433,35 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 
 func (a *KeyInternalAPI) remoteKeysFromDatabase(
 	ctx context.Context, res *api.QueryKeysResponse, respMu *sync.Mutex, domainToDeviceKeys map[string]map[string][]string,
+	domainToCrossSigningKeys map[string]map[string]struct{}, hasSyncPosition bool,
 ) map[string]map[string][]string {
 	fetchRemote := make(map[string]map[string][]string)
 	for domain, userToDeviceMap := range domainToDeviceKeys {
+		// if the client has told us which device list changes it has already seen in /sync
+		// then the database is consistent with that for any device list which we track and
+		// which is up to date. Device lists we don't track aren't kept up to date at all.
+		var upToDateUsers map[string]struct{}
+		if hasSyncPosition {
+			var err error
+			if upToDateUsers, err = a.upToDateDeviceLists(ctx, domain); err != nil {
+				util.GetLogger(ctx).WithError(err).Error("a.upToDateDeviceLists failed")
+			}
+		}
 		for userID, deviceIDs := range userToDeviceMap {
 			// we can't safely return keys from the db when all devices are requested as we don't
-			// know if one has just been added.
+			// know if one has just been added, unless we know the client's sync position.
+			if _, upToDate := upToDateUsers[userID]; len(deviceIDs) == 0 && upToDate {
+				err := a.populateResponseWithDeviceKeysFromDatabase(ctx, res, respMu, userID, deviceIDs)
+				if err == nil {
+					// cross-signing keys for users we track are kept up to date by EDUs too
+					delete(domainToCrossSigningKeys[domain], userID)
+					if len(domainToCrossSigningKeys[domain]) == 0 {
+						delete(domainToCrossSigningKeys, domain)
+					}
+					continue
+				}
+				util.GetLogger(ctx).WithError(err).Debug("populateResponseWithDeviceKeysFromDatabase")
+			}
 			if len(deviceIDs) > 0 {
 				err := a.populateResponseWithDeviceKeysFromDatabase(ctx, res, respMu, userID, deviceIDs)
 				if err == nil {
@@ -429,6 +480,20 @@ func (a *KeyInternalAPI) remoteKeysFromDatabase(
 	return fetchRemote
 }
 
+// upToDateDeviceLists returns the set of users on the given domain whose device lists we
+// track and are up to date.
+func (a *KeyInternalAPI) upToDateDeviceLists(ctx context.Context, domain string) (map[string]struct{}, error) {
+	userIDs, err := a.DB.UpToDateDeviceLists(ctx, []gomatrixserverlib.ServerName{gomatrixserverlib.ServerName(domain)})
+	if err != nil {
+		return nil, err
+	}
+	upToDate := make(map[string]struct{}, len(userIDs))
+	for _, userID := range userIDs {
+		upToDate[userID] = struct{}{}
+	}
+	return upToDate, nil
+}
+
 func (a *KeyInternalAPI) queryRemoteKeys(
 	ctx context.Context, timeout time.Duration, res *api.QueryKeysResponse,
 	domainToDeviceKeys map[string]map[string][]string, domainToCrossSigningKeys map[string]map[string]struct{},
@@ -662,7 +727,7 @@ func (a *KeyInternalAPI) uploadLocalDeviceKeys(ctx context.Context, req *api.Per
 	}
 
 	if len(toClean) > 0 {
-		if err = a.DB.DeleteDeviceKeys(ctx, req.UserID, toClean); err != nil {
+		if err = a.deleteDeviceKeys(ctx, req.UserID, toClean); err != nil {
 			logrus.WithField("user_id", req.UserID).WithError(err).Errorf("Failed to clean up %d stale keyserver device key entries", len(toClean))
 		} else {
 			logrus.WithField("user_id", req.UserID).Debugf("Cleaned up %d stale keyserver device key entries", len(toClean))
@@ -696,15 +761,16 @@ func (a *KeyInternalAPI) uploadLocalDeviceKeys(ctx context.Context, req *api.Per
 			if !a.Cfg.Matrix.IsLocalServerName(serverName) {
 				continue // ignore remote users
 			}
-			if len(key.KeyJSON) == 0 {
-				keysToStore = append(keysToStore, key.WithStreamID(0))
-				continue // deleted keys don't need sanity checking
-			}
 			// check that the device in question actually exists in the user
-			// API before we try and store a key for it
+			// API before we try and store a key for it. Keys of deleted devices
+			// are removed by deleteDeviceKeys instead.
 			if _, ok := existingDeviceMap[key.DeviceID]; !ok {
 				continue
 			}
+			if len(key.KeyJSON) == 0 {
+				keysToStore = append(keysToStore, key.WithStreamID(0))
+				continue // empty keys don't need sanity checking
+			}
 			gotUserID := gjson.GetBytes(key.KeyJSON, "user_id").Str
 			gotDeviceID := gjson.GetBytes(key.KeyJSON, "device_id").Str
 			if gotUserID == key.UserID && gotDeviceID == key.DeviceID {
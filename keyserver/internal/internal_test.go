@@ -2,14 +2,25 @@ package internal_test
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/nats-io/nats.go"
+	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/keyserver/internal"
+	"github.com/matrix-org/dendrite/keyserver/producers"
 	"github.com/matrix-org/dendrite/keyserver/storage"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
 	"github.com/matrix-org/dendrite/test"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
 
 func mustCreateDatabase(t *testing.T, dbType test.DBType) (storage.Database, func()) {
@@ -154,3 +165,371 @@ func Test_QueryDeviceMessages(t *testing.T) {
 		}
 	})
 }
+
+type mockKeyserverFederationAPI struct {
+	mu             sync.Mutex
+	userDevicesReq int
+	res            gomatrixserverlib.RespUserDevices
+	claimKeys      func(ctx context.Context, s gomatrixserverlib.ServerName, oneTimeKeys map[string]map[string]string) (gomatrixserverlib.RespClaimKeys, error)
+}
+
+func (f *mockKeyserverFederationAPI) GetUserDevices(ctx context.Context, origin, s gomatrixserverlib.ServerName, userID string) (gomatrixserverlib.RespUserDevices, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.userDevicesReq++
+	return f.res, nil
+}
+
+func (f *mockKeyserverFederationAPI) userDevicesRequests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := f.userDevicesReq
+	f.userDevicesReq = 0
+	return n
+}
+
+func (f *mockKeyserverFederationAPI) ClaimKeys(ctx context.Context, origin, s gomatrixserverlib.ServerName, oneTimeKeys map[string]map[string]string) (gomatrixserverlib.RespClaimKeys, error) {
+	if f.claimKeys != nil {
+		return f.claimKeys(ctx, s, oneTimeKeys)
+	}
+	return gomatrixserverlib.RespClaimKeys{}, nil
+}
+
+func (f *mockKeyserverFederationAPI) QueryKeys(ctx context.Context, origin, s gomatrixserverlib.ServerName, keys map[string][]string) (gomatrixserverlib.RespQueryKeys, error) {
+	return gomatrixserverlib.RespQueryKeys{}, nil
+}
+
+type mockKeyChangeProducer struct{}
+
+func (p *mockKeyChangeProducer) ProduceKeyChanges(keys []api.DeviceMessage) error {
+	return nil
+}
+
+func Test_QueryKeysWithSyncPosition(t *testing.T) {
+	ctx := context.Background()
+	bob := "@bob:remote.server"
+	cachedKeyJSON := `{"user_id":"` + bob + `","device_id":"BOBDEVICE","algorithms":["cached"],"keys":{}}`
+	fedClient := &mockKeyserverFederationAPI{
+		res: gomatrixserverlib.RespUserDevices{
+			UserID:   bob,
+			StreamID: 2,
+			Devices: []gomatrixserverlib.RespUserDevice{{
+				DeviceID: "BOBDEVICE",
+				Keys: gomatrixserverlib.RespUserDeviceKeys{
+					UserID:     bob,
+					DeviceID:   "BOBDEVICE",
+					Algorithms: []string{"fresh"},
+				},
+			}},
+		},
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, closeDB := mustCreateDatabase(t, dbType)
+		defer closeDB()
+		storeCachedKeys := func(streamID int64) {
+			t.Helper()
+			if err := db.StoreRemoteDeviceKeys(ctx, []api.DeviceMessage{{
+				Type:       api.TypeDeviceKeyUpdate,
+				DeviceKeys: &api.DeviceKeys{UserID: bob, DeviceID: "BOBDEVICE", KeyJSON: []byte(cachedKeyJSON)},
+				StreamID:   streamID,
+			}}, nil); err != nil {
+				t.Fatalf("failed to store remote device keys: %s", err)
+			}
+		}
+		storeCachedKeys(1)
+
+		cfg := &config.KeyServer{Matrix: &config.Global{}}
+		cfg.Matrix.ServerName = "localhost"
+		a := &internal.KeyInternalAPI{
+			DB:        db,
+			Cfg:       cfg,
+			FedClient: fedClient,
+		}
+		a.Updater = internal.NewDeviceListUpdater(process.NewProcessContext(), db, a, &mockKeyChangeProducer{}, fedClient, 1, nil, "localhost")
+		if err := a.Updater.Start(); err != nil {
+			t.Fatalf("failed to start device list updater: %s", err)
+		}
+
+		queryAlgorithms := func(deviceListPosition int64) string {
+			t.Helper()
+			res := &api.QueryKeysResponse{}
+			if err := a.QueryKeys(ctx, &api.QueryKeysRequest{
+				UserToDevices:      map[string][]string{bob: {}},
+				DeviceListPosition: deviceListPosition,
+			}, res); err != nil {
+				t.Fatalf("QueryKeys failed: %s", err)
+			}
+			return gjson.GetBytes(res.DeviceKeys[bob]["BOBDEVICE"], "algorithms.0").Str
+		}
+
+		// a device list which we don't track isn't kept up to date, so it must be
+		// fetched from the remote server even with a sync position
+		if got := queryAlgorithms(5); got != "fresh" {
+			t.Fatalf("expected fresh keys for an untracked device list, got %q", got)
+		}
+		if n := fedClient.userDevicesRequests(); n != 1 {
+			t.Fatalf("expected a single federation request for an untracked device list, got %d", n)
+		}
+
+		// with a sync position, a tracked and up to date device list is returned from the database
+		storeCachedKeys(3)
+		if err := db.MarkDeviceListStale(ctx, bob, false); err != nil {
+			t.Fatal(err)
+		}
+		if got := queryAlgorithms(5); got != "cached" {
+			t.Fatalf("expected cached keys with a sync position, got %q", got)
+		}
+		if n := fedClient.userDevicesRequests(); n != 0 {
+			t.Fatalf("expected no federation requests with a sync position, got %d", n)
+		}
+
+		// without a sync position, the device list is fetched from the remote server
+		if got := queryAlgorithms(0); got != "fresh" {
+			t.Fatalf("expected fresh keys without a sync position, got %q", got)
+		}
+		if n := fedClient.userDevicesRequests(); n != 1 {
+			t.Fatalf("expected a federation request without a sync position, got %d", n)
+		}
+
+		// a stale device list must still be fetched from the remote server
+		storeCachedKeys(4)
+		if err := db.MarkDeviceListStale(ctx, bob, true); err != nil {
+			t.Fatal(err)
+		}
+		if got := queryAlgorithms(5); got != "fresh" {
+			t.Fatalf("expected fresh keys for a stale device list, got %q", got)
+		}
+		if n := fedClient.userDevicesRequests(); n != 1 {
+			t.Fatalf("expected a federation request for a stale device list, got %d", n)
+		}
+	})
+}
+
+// recordingJetStream records the key changes published by a producers.KeyChange.
+type recordingJetStream struct {
+	nats.JetStreamContext
+	mu   sync.Mutex
+	keys []api.DeviceMessage
+}
+
+func (js *recordingJetStream) PublishMsg(m *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	var key api.DeviceMessage
+	if err := json.Unmarshal(m.Data, &key); err != nil {
+		return nil, err
+	}
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.keys = append(js.keys, key)
+	return &nats.PubAck{}, nil
+}
+
+func (js *recordingJetStream) take() []api.DeviceMessage {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	keys := js.keys
+	js.keys = nil
+	return keys
+}
+
+type mockKeyserverUserAPI struct {
+	userapi.KeyserverUserAPI
+	deviceIDs []string
+}
+
+func (u *mockKeyserverUserAPI) QueryDevices(ctx context.Context, req *userapi.QueryDevicesRequest, res *userapi.QueryDevicesResponse) error {
+	res.UserExists = true
+	for _, deviceID := range u.deviceIDs {
+		res.Devices = append(res.Devices, userapi.Device{ID: deviceID, UserID: req.UserID})
+	}
+	return nil
+}
+
+func Test_PerformDeleteKeys(t *testing.T) {
+	ctx := context.Background()
+	alice := "@alice:localhost"
+	keyJSON := func(deviceID string) []byte {
+		return []byte(`{"user_id":"` + alice + `","device_id":"` + deviceID + `"}`)
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, closeDB := mustCreateDatabase(t, dbType)
+		defer closeDB()
+		if err := db.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{
+			{Type: api.TypeDeviceKeyUpdate, DeviceKeys: &api.DeviceKeys{UserID: alice, DeviceID: "AAA", KeyJSON: keyJSON("AAA")}},
+			{Type: api.TypeDeviceKeyUpdate, DeviceKeys: &api.DeviceKeys{UserID: alice, DeviceID: "BBB", KeyJSON: keyJSON("BBB")}},
+		}); err != nil {
+			t.Fatalf("failed to store device keys: %s", err)
+		}
+
+		cfg := &config.KeyServer{Matrix: &config.Global{}}
+		cfg.Matrix.ServerName = "localhost"
+		js := &recordingJetStream{}
+		a := &internal.KeyInternalAPI{
+			DB:       db,
+			Cfg:      cfg,
+			Producer: &producers.KeyChange{JetStream: js, DB: db},
+			// AAA has already been deleted from the user API
+			UserAPI: &mockKeyserverUserAPI{deviceIDs: []string{"BBB"}},
+		}
+
+		res := &api.PerformDeleteKeysResponse{}
+		if err := a.PerformDeleteKeys(ctx, &api.PerformDeleteKeysRequest{
+			UserID: alice,
+			KeyIDs: []gomatrixserverlib.KeyID{"AAA"},
+		}, res); err != nil || res.Error != nil {
+			t.Fatalf("PerformDeleteKeys failed: %v %v", err, res.Error)
+		}
+		emitted := js.take()
+		if len(emitted) != 1 || emitted[0].DeviceID != "AAA" || len(emitted[0].KeyJSON) != 0 || emitted[0].StreamID != 3 {
+			t.Fatalf("expected a single deletion of AAA with stream ID 3, got %+v", emitted)
+		}
+
+		// Uploading keys afterwards must not emit the deletion again, neither
+		// for an empty key of the deleted device nor when cleaning up.
+		uploadRes := &api.PerformUploadKeysResponse{}
+		if err := a.PerformUploadKeys(ctx, &api.PerformUploadKeysRequest{
+			UserID: alice,
+			DeviceKeys: []api.DeviceKeys{
+				{UserID: alice, DeviceID: "AAA"},
+				{UserID: alice, DeviceID: "BBB", KeyJSON: keyJSON("BBB")},
+			},
+		}, uploadRes); err != nil || uploadRes.Error != nil {
+			t.Fatalf("PerformUploadKeys failed: %v %v", err, uploadRes.Error)
+		}
+		if emitted = js.take(); len(emitted) != 0 {
+			t.Fatalf("expected no key changes, got %+v", emitted)
+		}
+	})
+}
+
+func Test_PerformClaimKeys(t *testing.T) {
+	ctx := context.Background()
+	alice := "@alice:localhost"
+	bob := "@bob:remote.server"
+	charlie := "@charlie:slow.server"
+	keyJSON := json.RawMessage(`{"key":"foo"}`)
+
+	fedClient := &mockKeyserverFederationAPI{
+		claimKeys: func(ctx context.Context, s gomatrixserverlib.ServerName, oneTimeKeys map[string]map[string]string) (gomatrixserverlib.RespClaimKeys, error) {
+			switch s {
+			case "remote.server":
+				return gomatrixserverlib.RespClaimKeys{
+					OneTimeKeys: map[string]map[string]map[string]json.RawMessage{
+						bob: {"BOBDEVICE": {"signed_curve25519:BBBB": keyJSON}},
+						// Keys for users we didn't ask about must be ignored.
+						alice: {"ALICEDEVICE": {"signed_curve25519:EVIL": keyJSON}},
+					},
+				}, nil
+			default:
+				// The slow server never answers before the timeout.
+				<-ctx.Done()
+				return gomatrixserverlib.RespClaimKeys{}, ctx.Err()
+			}
+		},
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, closeDB := mustCreateDatabase(t, dbType)
+		defer closeDB()
+		if _, err := db.StoreOneTimeKeys(ctx, api.OneTimeKeys{
+			UserID:   alice,
+			DeviceID: "ALICEDEVICE",
+			KeyJSON:  map[string]json.RawMessage{"signed_curve25519:AAAA": keyJSON},
+		}); err != nil {
+			t.Fatalf("failed to store one-time keys: %s", err)
+		}
+
+		cfg := &config.KeyServer{Matrix: &config.Global{}}
+		cfg.Matrix.ServerName = "localhost"
+		a := &internal.KeyInternalAPI{
+			DB:        db,
+			Cfg:       cfg,
+			FedClient: fedClient,
+		}
+
+		res := &api.PerformClaimKeysResponse{}
+		start := time.Now()
+		if err := a.PerformClaimKeys(ctx, &api.PerformClaimKeysRequest{
+			OneTimeKeys: map[string]map[string]string{
+				alice:   {"ALICEDEVICE": "signed_curve25519"},
+				bob:     {"BOBDEVICE": "signed_curve25519"},
+				charlie: {"CHARLIEDEVICE": "signed_curve25519"},
+			},
+			Timeout: 100 * time.Millisecond,
+		}, res); err != nil {
+			t.Fatalf("PerformClaimKeys failed: %s", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("expected the claim to respect the timeout, took %s", elapsed)
+		}
+		if res.Error != nil {
+			t.Fatalf("unexpected error: %s", res.Error)
+		}
+
+		want := map[string]map[string]map[string]json.RawMessage{
+			alice: {"ALICEDEVICE": {"signed_curve25519:AAAA": keyJSON}},
+			bob:   {"BOBDEVICE": {"signed_curve25519:BBBB": keyJSON}},
+		}
+		if !reflect.DeepEqual(res.OneTimeKeys, want) {
+			t.Fatalf("unexpected one-time keys:\n got: %s\nwant: %s", res.OneTimeKeys, want)
+		}
+		if _, ok := res.Failures["slow.server"]; !ok || len(res.Failures) != 1 {
+			t.Fatalf("expected only slow.server to fail, got %+v", res.Failures)
+		}
+	})
+}
+
+func Test_OneTimeKeysCountPerAlgorithm(t *testing.T) {
+	ctx := context.Background()
+	alice := "@alice:localhost"
+	oneTimeKeys := func(deviceID, algorithm string, n int) api.OneTimeKeys {
+		keys := api.OneTimeKeys{
+			UserID:   alice,
+			DeviceID: deviceID,
+			KeyJSON:  map[string]json.RawMessage{},
+		}
+		for i := 0; i < n; i++ {
+			keys.KeyJSON[fmt.Sprintf("%s:%s%d", algorithm, deviceID, i)] = json.RawMessage(fmt.Sprintf(`{"key":"%d"}`, i))
+		}
+		return keys
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, closeDB := mustCreateDatabase(t, dbType)
+		defer closeDB()
+		a := &internal.KeyInternalAPI{DB: db}
+
+		// upload checks the counts returned from the upload, and the counts which
+		// /sync reads from the keyserver.
+		upload := func(keys api.OneTimeKeys, want map[string]int) {
+			t.Helper()
+			uploadRes := &api.PerformUploadKeysResponse{}
+			if err := a.PerformUploadKeys(ctx, &api.PerformUploadKeysRequest{
+				UserID:      keys.UserID,
+				DeviceID:    keys.DeviceID,
+				OneTimeKeys: []api.OneTimeKeys{keys},
+			}, uploadRes); err != nil || uploadRes.Error != nil {
+				t.Fatalf("failed to upload one-time keys: %v %v", err, uploadRes.Error)
+			}
+			if len(uploadRes.OneTimeKeyCounts) != 1 || !reflect.DeepEqual(uploadRes.OneTimeKeyCounts[0].KeyCount, want) {
+				t.Fatalf("expected upload counts %v, got %+v", want, uploadRes.OneTimeKeyCounts)
+			}
+			queryRes := &api.QueryOneTimeKeysResponse{}
+			if err := a.QueryOneTimeKeys(ctx, &api.QueryOneTimeKeysRequest{
+				UserID:   keys.UserID,
+				DeviceID: keys.DeviceID,
+			}, queryRes); err != nil || queryRes.Error != nil {
+				t.Fatalf("failed to query one-time keys: %v %v", err, queryRes.Error)
+			}
+			if !reflect.DeepEqual(queryRes.Count.KeyCount, want) {
+				t.Fatalf("expected query counts %v, got %v", want, queryRes.Count.KeyCount)
+			}
+		}
+
+		// Counts used to be truncated at 100 keys across all algorithms.
+		upload(oneTimeKeys("DEVICEA", "signed_curve25519", 120), map[string]int{"signed_curve25519": 120})
+		upload(oneTimeKeys("DEVICEA", "curve25519", 3), map[string]int{"signed_curve25519": 120, "curve25519": 3})
+		upload(oneTimeKeys("DEVICEB", "signed_curve25519", 7), map[string]int{"signed_curve25519": 7})
+	})
+}
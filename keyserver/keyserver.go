@@ -15,6 +15,8 @@
 package keyserver
 
 import (
+	"time"
+
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 
@@ -32,6 +34,10 @@ import (
 	"github.com/matrix-org/dendrite/setup/jetstream"
 )
 
+// deviceKeyTombstoneRetention is how long the empty keys of deleted devices
+// are kept, so that remote servers can still match their stream IDs.
+const deviceKeyTombstoneRetention = 7 * 24 * time.Hour
+
 // AddInternalRoutes registers HTTP handlers for the internal API. Invokes functions
 // on the given input API.
 func AddInternalRoutes(router *mux.Router, intAPI api.KeyInternalAPI, enableMetrics bool) {
@@ -90,5 +96,15 @@ func NewInternalAPI(
 		logrus.WithError(err).Panic("failed to start signing key consumer")
 	}
 
+	var cleanTombstones func()
+	cleanTombstones = func() {
+		before := time.Now().Add(-deviceKeyTombstoneRetention)
+		if err := db.DeleteDeviceKeyTombstones(base.Context(), before); err != nil {
+			logrus.WithError(err).Error("Failed to clean old device key tombstones")
+		}
+		time.AfterFunc(time.Hour, cleanTombstones)
+	}
+	time.AfterFunc(time.Minute, cleanTombstones)
+
 	return ap
 }
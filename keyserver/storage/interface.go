@@ -17,6 +17,7 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/keyserver/types"
@@ -51,13 +52,21 @@ type Database interface {
 	// PrevIDsExists returns true if all prev IDs exist for this user.
 	PrevIDsExists(ctx context.Context, userID string, prevIDs []int64) (bool, error)
 
+	// MaxStreamIDForUser returns the latest stream ID we know about for this user, or 0 if there is none.
+	MaxStreamIDForUser(ctx context.Context, userID string) (int64, error)
+
 	// DeviceKeysForUser returns the device keys for the device IDs given. If the length of deviceIDs is 0, all devices are selected.
 	// If there are some missing keys, they are omitted from the returned slice. There is no ordering on the returned slice.
 	DeviceKeysForUser(ctx context.Context, userID string, deviceIDs []string, includeEmpty bool) ([]api.DeviceMessage, error)
 
 	// DeleteDeviceKeys removes the device keys for a given user/device, and any accompanying
-	// cross-signing signatures relating to that device.
-	DeleteDeviceKeys(ctx context.Context, userID string, deviceIDs []gomatrixserverlib.KeyID) error
+	// cross-signing signatures relating to that device. The device keys are replaced with empty
+	// keys under new stream IDs, which are returned so that the deletions can be sent to other servers.
+	DeleteDeviceKeys(ctx context.Context, userID string, deviceIDs []gomatrixserverlib.KeyID) ([]api.DeviceMessage, error)
+
+	// DeleteDeviceKeyTombstones removes the empty keys left behind by DeleteDeviceKeys before the given time,
+	// keeping the one with the highest stream ID for each user.
+	DeleteDeviceKeyTombstones(ctx context.Context, before time.Time) error
 
 	// ClaimKeys based on the 3-uple of user_id, device_id and algorithm name. Returns the keys claimed. Returns no error if a key
 	// cannot be claimed or if none exist for this (user, device, algorithm), instead it is omitted from the returned slice.
@@ -76,6 +85,10 @@ type Database interface {
 	// If no domains are given, all user IDs with stale device lists are returned.
 	StaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
 
+	// UpToDateDeviceLists returns a list of user IDs ending with the domains provided whose device lists
+	// we track and are not stale. If no domains are given, all such user IDs are returned.
+	UpToDateDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
+
 	// MarkDeviceListStale sets the stale bit for this user to isStale.
 	MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error
 
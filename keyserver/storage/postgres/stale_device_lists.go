@@ -86,9 +86,17 @@ func (s *staleDeviceListsStatements) InsertStaleDeviceList(ctx context.Context,
 }
 
 func (s *staleDeviceListsStatements) SelectUserIDsWithStaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error) {
+	return s.selectUserIDsWithDeviceLists(ctx, domains, true)
+}
+
+func (s *staleDeviceListsStatements) SelectUserIDsWithUpToDateDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error) {
+	return s.selectUserIDsWithDeviceLists(ctx, domains, false)
+}
+
+func (s *staleDeviceListsStatements) selectUserIDsWithDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName, isStale bool) ([]string, error) {
 	// we only query for 1 domain or all domains so optimise for those use cases
 	if len(domains) == 0 {
-		rows, err := s.selectStaleDeviceListsStmt.QueryContext(ctx, true)
+		rows, err := s.selectStaleDeviceListsStmt.QueryContext(ctx, isStale)
 		if err != nil {
 			return nil, err
 		}
@@ -96,7 +104,7 @@ func (s *staleDeviceListsStatements) SelectUserIDsWithStaleDeviceLists(ctx conte
 	}
 	var result []string
 	for _, domain := range domains {
-		rows, err := s.selectStaleDeviceListsWithDomainsStmt.QueryContext(ctx, true, string(domain))
+		rows, err := s.selectStaleDeviceListsWithDomainsStmt.QueryContext(ctx, isStale, string(domain))
 		if err != nil {
 			return nil, err
 		}
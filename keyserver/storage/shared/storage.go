@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/keyserver/api"
@@ -59,11 +60,21 @@ func (d *Database) DeviceKeysJSON(ctx context.Context, keys []api.DeviceMessage)
 }
 
 func (d *Database) PrevIDsExists(ctx context.Context, userID string, prevIDs []int64) (bool, error) {
+	// several devices can share a stream ID after a full resync, so compare
+	// against the number of distinct prev IDs
+	distinct := make(map[int64]struct{}, len(prevIDs))
+	for _, id := range prevIDs {
+		distinct[id] = struct{}{}
+	}
 	count, err := d.DeviceKeysTable.CountStreamIDsForUser(ctx, userID, prevIDs)
 	if err != nil {
 		return false, err
 	}
-	return count == len(prevIDs), nil
+	return count == len(distinct), nil
+}
+
+func (d *Database) MaxStreamIDForUser(ctx context.Context, userID string) (int64, error) {
+	return d.DeviceKeysTable.SelectMaxStreamIDForUser(ctx, nil, userID)
 }
 
 func (d *Database) StoreRemoteDeviceKeys(ctx context.Context, keys []api.DeviceMessage, clearUserIDs []string) error {
@@ -148,6 +159,12 @@ func (d *Database) StaleDeviceLists(ctx context.Context, domains []gomatrixserve
 	return d.StaleDeviceListsTable.SelectUserIDsWithStaleDeviceLists(ctx, domains)
 }
 
+// UpToDateDeviceLists returns a list of user IDs ending with the domains provided whose device lists
+// we track and are not stale. If no domains are given, all such user IDs are returned.
+func (d *Database) UpToDateDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error) {
+	return d.StaleDeviceListsTable.SelectUserIDsWithUpToDateDeviceLists(ctx, domains)
+}
+
 // MarkDeviceListStale sets the stale bit for this user to isStale.
 func (d *Database) MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error {
 	return d.Writer.Do(nil, nil, func(_ *sql.Tx) error {
@@ -156,22 +173,68 @@ func (d *Database) MarkDeviceListStale(ctx context.Context, userID string, isSta
 }
 
 // DeleteDeviceKeys removes the device keys for a given user/device, and any accompanying
-// cross-signing signatures relating to that device.
-func (d *Database) DeleteDeviceKeys(ctx context.Context, userID string, deviceIDs []gomatrixserverlib.KeyID) error {
-	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		for _, deviceID := range deviceIDs {
-			if err := d.CrossSigningSigsTable.DeleteCrossSigningSigsForTarget(ctx, txn, userID, deviceID); err != nil && err != sql.ErrNoRows {
+// cross-signing signatures relating to that device. Rather than removing the device keys
+// outright, they are replaced with an empty key under a new stream ID so that the stream
+// ID of the user's device list never goes backwards. The replaced keys are returned so
+// that the deletions can be sent to other servers.
+func (d *Database) DeleteDeviceKeys(ctx context.Context, userID string, deviceIDs []gomatrixserverlib.KeyID) ([]api.DeviceMessage, error) {
+	ids := make([]string, 0, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		ids = append(ids, string(deviceID))
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	existing, err := d.DeviceKeysTable.SelectBatchDeviceKeys(ctx, userID, ids, false)
+	if err != nil {
+		return nil, fmt.Errorf("d.DeviceKeysTable.SelectBatchDeviceKeys: %w", err)
+	}
+	var deleted []api.DeviceMessage
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for _, deviceID := range ids {
+			if err := d.CrossSigningSigsTable.DeleteCrossSigningSigsForTarget(ctx, txn, userID, gomatrixserverlib.KeyID(deviceID)); err != nil && err != sql.ErrNoRows {
 				return fmt.Errorf("d.CrossSigningSigsTable.DeleteCrossSigningSigsForTarget: %w", err)
 			}
-			if err := d.DeviceKeysTable.DeleteDeviceKeys(ctx, txn, userID, string(deviceID)); err != nil && err != sql.ErrNoRows {
-				return fmt.Errorf("d.DeviceKeysTable.DeleteDeviceKeys: %w", err)
-			}
-			if err := d.OneTimeKeysTable.DeleteOneTimeKeys(ctx, txn, userID, string(deviceID)); err != nil && err != sql.ErrNoRows {
+			if err := d.OneTimeKeysTable.DeleteOneTimeKeys(ctx, txn, userID, deviceID); err != nil && err != sql.ErrNoRows {
 				return fmt.Errorf("d.OneTimeKeysTable.DeleteOneTimeKeys: %w", err)
 			}
 		}
+		if len(existing) == 0 {
+			return nil
+		}
+		streamID, err := d.DeviceKeysTable.SelectMaxStreamIDForUser(ctx, txn, userID)
+		if err != nil {
+			return fmt.Errorf("d.DeviceKeysTable.SelectMaxStreamIDForUser: %w", err)
+		}
+		deleted = make([]api.DeviceMessage, 0, len(existing))
+		for _, key := range existing {
+			streamID++
+			deleted = append(deleted, api.DeviceMessage{
+				Type: api.TypeDeviceKeyUpdate,
+				DeviceKeys: &api.DeviceKeys{
+					UserID:   userID,
+					DeviceID: key.DeviceID,
+				},
+				StreamID: streamID,
+			})
+		}
+		if err := d.DeviceKeysTable.InsertDeviceKeys(ctx, txn, deleted); err != nil {
+			return fmt.Errorf("d.DeviceKeysTable.InsertDeviceKeys: %w", err)
+		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// DeleteDeviceKeyTombstones removes the empty keys left behind by DeleteDeviceKeys before the given time,
+// keeping the one with the highest stream ID for each user.
+func (d *Database) DeleteDeviceKeyTombstones(ctx context.Context, before time.Time) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.DeviceKeysTable.DeleteDeviceKeyTombstones(ctx, txn, before)
+	})
 }
 
 // CrossSigningKeysForUser returns the latest known cross-signing keys for a user, if any.
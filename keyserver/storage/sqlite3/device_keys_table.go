@@ -44,7 +44,7 @@ const upsertDeviceKeysSQL = "" +
 	"INSERT INTO keyserver_device_keys (user_id, device_id, ts_added_secs, key_json, stream_id, display_name)" +
 	" VALUES ($1, $2, $3, $4, $5, $6)" +
 	" ON CONFLICT (user_id, device_id)" +
-	" DO UPDATE SET key_json = $4, stream_id = $5, display_name = $6"
+	" DO UPDATE SET ts_added_secs = $3, key_json = $4, stream_id = $5, display_name = $6"
 
 const selectDeviceKeysSQL = "" +
 	"SELECT key_json, stream_id, display_name FROM keyserver_device_keys WHERE user_id=$1 AND device_id=$2"
@@ -59,7 +59,7 @@ const selectMaxStreamForUserSQL = "" +
 	"SELECT MAX(stream_id) FROM keyserver_device_keys WHERE user_id=$1"
 
 const countStreamIDsForUserSQL = "" +
-	"SELECT COUNT(*) FROM keyserver_device_keys WHERE user_id=$1 AND stream_id IN ($2)"
+	"SELECT COUNT(DISTINCT stream_id) FROM keyserver_device_keys WHERE user_id=$1 AND stream_id IN ($2)"
 
 const deleteDeviceKeysSQL = "" +
 	"DELETE FROM keyserver_device_keys WHERE user_id=$1 AND device_id=$2"
@@ -67,6 +67,12 @@ const deleteDeviceKeysSQL = "" +
 const deleteAllDeviceKeysSQL = "" +
 	"DELETE FROM keyserver_device_keys WHERE user_id=$1"
 
+// The tombstone with the highest stream ID of each user is kept, so that
+// the user's stream ID never goes backwards.
+const deleteDeviceKeyTombstonesSQL = "" +
+	"DELETE FROM keyserver_device_keys WHERE key_json = '' AND ts_added_secs < $1" +
+	" AND stream_id < (SELECT MAX(stream_id) FROM keyserver_device_keys AS latest WHERE latest.user_id = keyserver_device_keys.user_id)"
+
 type deviceKeysStatements struct {
 	db                                   *sql.DB
 	upsertDeviceKeysStmt                 *sql.Stmt
@@ -76,6 +82,7 @@ type deviceKeysStatements struct {
 	selectMaxStreamForUserStmt           *sql.Stmt
 	deleteDeviceKeysStmt                 *sql.Stmt
 	deleteAllDeviceKeysStmt              *sql.Stmt
+	deleteDeviceKeyTombstonesStmt        *sql.Stmt
 }
 
 func NewSqliteDeviceKeysTable(db *sql.DB) (tables.DeviceKeys, error) {
@@ -107,6 +114,9 @@ func NewSqliteDeviceKeysTable(db *sql.DB) (tables.DeviceKeys, error) {
 	if s.deleteAllDeviceKeysStmt, err = db.Prepare(deleteAllDeviceKeysSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteDeviceKeyTombstonesStmt, err = db.Prepare(deleteDeviceKeyTombstonesSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -120,6 +130,11 @@ func (s *deviceKeysStatements) DeleteAllDeviceKeys(ctx context.Context, txn *sql
 	return err
 }
 
+func (s *deviceKeysStatements) DeleteDeviceKeyTombstones(ctx context.Context, txn *sql.Tx, before time.Time) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteDeviceKeyTombstonesStmt).ExecContext(ctx, before.Unix())
+	return err
+}
+
 func (s *deviceKeysStatements) SelectBatchDeviceKeys(ctx context.Context, userID string, deviceIDs []string, includeEmpty bool) ([]api.DeviceMessage, error) {
 	deviceIDMap := make(map[string]bool)
 	for _, d := range deviceIDs {
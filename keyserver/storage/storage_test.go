@@ -5,12 +5,14 @@ import (
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/keyserver/storage"
 	"github.com/matrix-org/dendrite/keyserver/types"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/dendrite/test/testrig"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 var ctx = context.Background()
@@ -195,3 +197,152 @@ func TestDeviceKeysStreamIDGeneration(t *testing.T) {
 		}
 	})
 }
+
+// Deleting device keys must advance the user's stream ID rather than removing it, so that
+// remote servers can detect the change and the stream ID never goes backwards.
+func TestDeleteDeviceKeysAdvancesStreamID(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, clean := MustCreateDatabase(t, dbType)
+		defer clean()
+		alice := "@alice:TestDeleteDeviceKeysAdvancesStreamID"
+		msgs := []api.DeviceMessage{
+			{
+				Type:       api.TypeDeviceKeyUpdate,
+				DeviceKeys: &api.DeviceKeys{DeviceID: "AAA", UserID: alice, KeyJSON: []byte(`{"key":"v1"}`)},
+			},
+			{
+				Type:       api.TypeDeviceKeyUpdate,
+				DeviceKeys: &api.DeviceKeys{DeviceID: "BBB", UserID: alice, KeyJSON: []byte(`{"key":"v1"}`)},
+			},
+		}
+		MustNotError(t, db.StoreLocalDeviceKeys(ctx, msgs))
+
+		// delete the device with the highest stream ID, as well as one we don't know about
+		deleted, err := db.DeleteDeviceKeys(ctx, alice, []gomatrixserverlib.KeyID{"BBB", "CCC"})
+		MustNotError(t, err)
+		if len(deleted) != 1 || deleted[0].DeviceID != "BBB" || deleted[0].StreamID != 3 || len(deleted[0].KeyJSON) != 0 {
+			t.Fatalf("Expected DeleteDeviceKeys to return BBB with StreamID=3, got %+v", deleted)
+		}
+
+		msgs, err = db.DeviceKeysForUser(ctx, alice, nil, true)
+		MustNotError(t, err)
+		wantStreamIDs := map[string]int64{"AAA": 1, "BBB": 3}
+		if len(msgs) != len(wantStreamIDs) {
+			t.Fatalf("DeviceKeysForUser: wrong number of devices, got %d want %d", len(msgs), len(wantStreamIDs))
+		}
+		for _, m := range msgs {
+			if m.StreamID != wantStreamIDs[m.DeviceID] {
+				t.Errorf("DeviceKeysForUser: wrong returned stream ID for %s, got %d want %d", m.DeviceID, m.StreamID, wantStreamIDs[m.DeviceID])
+			}
+		}
+
+		// deleting again doesn't advance the stream ID
+		deleted, err = db.DeleteDeviceKeys(ctx, alice, []gomatrixserverlib.KeyID{"BBB"})
+		MustNotError(t, err)
+		if len(deleted) != 0 {
+			t.Fatalf("Expected no deletions for an already deleted device, got %+v", deleted)
+		}
+
+		// new keys continue from the deletion
+		msgs = []api.DeviceMessage{{
+			Type:       api.TypeDeviceKeyUpdate,
+			DeviceKeys: &api.DeviceKeys{DeviceID: "AAA", UserID: alice, KeyJSON: []byte(`{"key":"v2"}`)},
+		}}
+		MustNotError(t, db.StoreLocalDeviceKeys(ctx, msgs))
+		if msgs[0].StreamID != 4 {
+			t.Fatalf("Expected StoreLocalDeviceKeys to set StreamID=4 after a deletion, got %d", msgs[0].StreamID)
+		}
+	})
+}
+
+// After a full resync all of a remote user's devices share the same stream ID, which must
+// still count as a single prev ID.
+func TestPrevIDsExistAfterResync(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, clean := MustCreateDatabase(t, dbType)
+		defer clean()
+		bob := "@bob:TestPrevIDsExistAfterResync"
+		msgs := []api.DeviceMessage{
+			{
+				Type:       api.TypeDeviceKeyUpdate,
+				DeviceKeys: &api.DeviceKeys{DeviceID: "AAA", UserID: bob, KeyJSON: []byte(`{"key":"v1"}`)},
+				StreamID:   5,
+			},
+			{
+				Type:       api.TypeDeviceKeyUpdate,
+				DeviceKeys: &api.DeviceKeys{DeviceID: "BBB", UserID: bob, KeyJSON: []byte(`{"key":"v1"}`)},
+				StreamID:   5,
+			},
+		}
+		MustNotError(t, db.StoreRemoteDeviceKeys(ctx, msgs, []string{bob}))
+
+		exists, err := db.PrevIDsExists(ctx, bob, []int64{5})
+		MustNotError(t, err)
+		if !exists {
+			t.Fatalf("Expected prev ID 5 to exist")
+		}
+		exists, err = db.PrevIDsExists(ctx, bob, []int64{4, 5})
+		MustNotError(t, err)
+		if exists {
+			t.Fatalf("Expected prev IDs 4 and 5 not to exist")
+		}
+		latest, err := db.MaxStreamIDForUser(ctx, bob)
+		MustNotError(t, err)
+		if latest != 5 {
+			t.Fatalf("Expected MaxStreamIDForUser to return 5, got %d", latest)
+		}
+	})
+}
+
+// Old tombstones of deleted devices are removed, except for the one holding the user's
+// highest stream ID.
+func TestDeleteDeviceKeyTombstones(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, clean := MustCreateDatabase(t, dbType)
+		defer clean()
+		alice := "@alice:TestDeleteDeviceKeyTombstones"
+		msgs := []api.DeviceMessage{
+			{
+				Type:       api.TypeDeviceKeyUpdate,
+				DeviceKeys: &api.DeviceKeys{DeviceID: "AAA", UserID: alice, KeyJSON: []byte(`{"key":"v1"}`)},
+			},
+			{
+				Type:       api.TypeDeviceKeyUpdate,
+				DeviceKeys: &api.DeviceKeys{DeviceID: "BBB", UserID: alice, KeyJSON: []byte(`{"key":"v1"}`)},
+			},
+			{
+				Type:       api.TypeDeviceKeyUpdate,
+				DeviceKeys: &api.DeviceKeys{DeviceID: "CCC", UserID: alice, KeyJSON: []byte(`{"key":"v1"}`)},
+			},
+		}
+		MustNotError(t, db.StoreLocalDeviceKeys(ctx, msgs))
+		_, err := db.DeleteDeviceKeys(ctx, alice, []gomatrixserverlib.KeyID{"AAA", "BBB"})
+		MustNotError(t, err)
+
+		// tombstones newer than the cutoff are kept
+		MustNotError(t, db.DeleteDeviceKeyTombstones(ctx, time.Now().Add(-time.Hour)))
+		msgs, err = db.DeviceKeysForUser(ctx, alice, nil, true)
+		MustNotError(t, err)
+		if len(msgs) != 3 {
+			t.Fatalf("Expected recent tombstones to be kept, got %+v", msgs)
+		}
+
+		MustNotError(t, db.DeleteDeviceKeyTombstones(ctx, time.Now().Add(time.Hour)))
+		msgs, err = db.DeviceKeysForUser(ctx, alice, nil, true)
+		MustNotError(t, err)
+		wantStreamIDs := map[string]int64{"BBB": 5, "CCC": 3}
+		if len(msgs) != len(wantStreamIDs) {
+			t.Fatalf("DeviceKeysForUser: wrong number of devices, got %+v want %v", msgs, wantStreamIDs)
+		}
+		for _, m := range msgs {
+			if m.StreamID != wantStreamIDs[m.DeviceID] {
+				t.Errorf("DeviceKeysForUser: wrong returned stream ID for %s, got %d want %d", m.DeviceID, m.StreamID, wantStreamIDs[m.DeviceID])
+			}
+		}
+		streamID, err := db.MaxStreamIDForUser(ctx, alice)
+		MustNotError(t, err)
+		if streamID != 5 {
+			t.Fatalf("Expected the stream ID to be kept at 5, got %d", streamID)
+		}
+	})
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/keyserver/types"
@@ -42,6 +43,9 @@ type DeviceKeys interface {
 	SelectBatchDeviceKeys(ctx context.Context, userID string, deviceIDs []string, includeEmpty bool) ([]api.DeviceMessage, error)
 	DeleteDeviceKeys(ctx context.Context, txn *sql.Tx, userID, deviceID string) error
 	DeleteAllDeviceKeys(ctx context.Context, txn *sql.Tx, userID string) error
+	// DeleteDeviceKeyTombstones removes the empty keys left behind by deleted devices which were
+	// deleted before the given time, except for those holding the highest stream ID of a user.
+	DeleteDeviceKeyTombstones(ctx context.Context, txn *sql.Tx, before time.Time) error
 }
 
 type KeyChanges interface {
@@ -56,6 +60,7 @@ type KeyChanges interface {
 type StaleDeviceLists interface {
 	InsertStaleDeviceList(ctx context.Context, userID string, isStale bool) error
 	SelectUserIDsWithStaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
+	SelectUserIDsWithUpToDateDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
 	DeleteStaleDeviceLists(ctx context.Context, txn *sql.Tx, userIDs []string) error
 }
 
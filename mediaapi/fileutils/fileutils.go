@@ -21,6 +21,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -146,6 +147,23 @@ func WriteTempFile(
 	return
 }
 
+// DetectContentType sniffs the content type of the temporary file in tmpDir
+// from its contents rather than trusting what the uploader claimed.
+func DetectContentType(tmpDir types.Path) (string, error) {
+	file, err := os.Open(filepath.Join(string(tmpDir), "content"))
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+	// http.DetectContentType only needs 512 bytes
+	buf := make([]byte, 512)
+	n, err := file.Read(buf)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read file: %w", err)
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
 // moveFile attempts to move the file src to dst
 func moveFile(src types.Path, dst types.Path) error {
 	dstDir := filepath.Dir(string(dst))
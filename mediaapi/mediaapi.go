@@ -15,8 +15,11 @@
 package mediaapi
 
 import (
+	"context"
+
 	"github.com/matrix-org/dendrite/mediaapi/routing"
 	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
 	"github.com/matrix-org/dendrite/setup/base"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -37,7 +40,13 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to connect to media db")
 	}
 
+	if err = routing.StoreSSOIcons(context.Background(), cfg, base.Cfg.Derived.SSOIcons, mediaDB, &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}); err != nil {
+		logrus.WithError(err).Panicf("failed to store identity provider icons")
+	}
+
 	routing.Setup(
-		base.PublicMediaAPIMux, cfg, rateCfg, mediaDB, userAPI, client,
+		base.PublicMediaAPIMux, base.DendriteAdminMux, cfg, rateCfg, base.Cfg.Derived.ApplicationServices, mediaDB, userAPI, client,
 	)
 }
@@ -0,0 +1,109 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// mediaFilesMutex is held for reading while a file is stored along with its
+// metadata or thumbnails are generated from it, and for writing while media is
+// deleted. Media with the same hash share a file, so this stops a file from
+// being removed just as new media is stored which refers to it.
+var mediaFilesMutex sync.RWMutex
+
+// DeleteMedia implements DELETE /_dendrite/admin/media/{serverName}/{mediaId}
+func DeleteMedia(req *http.Request, cfg *config.MediaAPI, db storage.Database) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	mediaID := types.MediaID(vars["mediaId"])
+	mediaOrigin := gomatrixserverlib.ServerName(vars["serverName"])
+	logger := util.GetLogger(req.Context()).WithFields(log.Fields{
+		"media_id":     mediaID,
+		"media_origin": mediaOrigin,
+	})
+
+	deleted, err := deleteMedia(req.Context(), cfg.AbsBasePath, db, mediaID, mediaOrigin, logger)
+	if err != nil {
+		logger.WithError(err).Error("Failed to delete media")
+		return jsonerror.InternalServerError()
+	}
+	if !deleted {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Media not found"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// deleteMedia removes the metadata about the media and its thumbnails. The file
+// and thumbnails on disk are only removed once no other media refers to them.
+// Returns false if there is no such media.
+func deleteMedia(
+	ctx context.Context,
+	absBasePath config.Path,
+	db storage.Database,
+	mediaID types.MediaID,
+	mediaOrigin gomatrixserverlib.ServerName,
+	logger *log.Entry,
+) (bool, error) {
+	mediaFilesMutex.Lock()
+	defer mediaFilesMutex.Unlock()
+
+	mediaMetadata, err := db.GetMediaMetadata(ctx, mediaID, mediaOrigin)
+	if err != nil {
+		return false, err
+	}
+	if mediaMetadata == nil {
+		return false, nil
+	}
+	filePath, err := fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash, absBasePath)
+	if err != nil {
+		return false, err
+	}
+
+	remaining, err := db.DeleteMediaMetadata(ctx, mediaID, mediaOrigin)
+	if err != nil {
+		return false, err
+	}
+	if remaining > 0 {
+		logger.WithField("remaining", remaining).Info("Deleted media, file is still in use by other media")
+		return true, nil
+	}
+	// The thumbnails are stored alongside the file, so this removes them too.
+	fileutils.RemoveDir(types.Path(filepath.Dir(filePath)), logger)
+	logger.Info("Deleted media and its file")
+	return true, nil
+}
@@ -0,0 +1,115 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestDeleteDeduplicatedMedia(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		db, err := storage.NewMediaAPIDatasource(nil, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("failed to open mediaapi database: %v", err)
+		}
+
+		basePath := config.Path(t.TempDir())
+		cfg := &config.MediaAPI{
+			BasePath:    basePath,
+			AbsBasePath: basePath,
+		}
+		ctx := context.Background()
+		logger := log.New().WithField("mediaapi", "test")
+
+		// Upload the same file twice, which should only be stored once.
+		var uploads []*types.MediaMetadata
+		for _, uploadName := range []string{"first", "second"} {
+			r := &uploadRequest{
+				MediaMetadata: &types.MediaMetadata{
+					Origin:     "test",
+					UploadName: types.Filename(uploadName),
+					UserID:     "@alice:test",
+				},
+				Logger: logger,
+			}
+			if resErr := r.doUpload(ctx, strings.NewReader("same file"), cfg, db, nil); resErr != nil {
+				t.Fatalf("failed to upload %s file: %+v", uploadName, resErr.JSON)
+			}
+			uploads = append(uploads, r.MediaMetadata)
+		}
+		if uploads[0].MediaID == uploads[1].MediaID {
+			t.Fatalf("expected the uploads to have different media IDs, got %q", uploads[0].MediaID)
+		}
+		if uploads[0].Base64Hash != uploads[1].Base64Hash {
+			t.Fatalf("expected the uploads to have the same hash, got %q and %q", uploads[0].Base64Hash, uploads[1].Base64Hash)
+		}
+		if uploads[1].FileSizeBytes != types.FileSizeBytes(len("same file")) {
+			t.Fatalf("expected the second upload to have the size of the file, got %d", uploads[1].FileSizeBytes)
+		}
+		filePath, err := fileutils.GetPathFromBase64Hash(uploads[0].Base64Hash, basePath)
+		if err != nil {
+			t.Fatalf("failed to get file path: %v", err)
+		}
+
+		thumbnail := &types.ThumbnailMetadata{
+			MediaMetadata: &types.MediaMetadata{
+				MediaID:       uploads[0].MediaID,
+				Origin:        uploads[0].Origin,
+				ContentType:   "image/png",
+				FileSizeBytes: 6,
+			},
+			ThumbnailSize: types.ThumbnailSize{Width: 5, Height: 5, ResizeMethod: types.Crop},
+		}
+		if err = db.StoreThumbnail(ctx, thumbnail); err != nil {
+			t.Fatalf("failed to store thumbnail: %v", err)
+		}
+
+		// Deleting the first upload keeps the file, as the second still refers to it.
+		deleted, err := deleteMedia(ctx, basePath, db, uploads[0].MediaID, uploads[0].Origin, logger)
+		if err != nil || !deleted {
+			t.Fatalf("expected the first upload to be deleted, got %v, %v", deleted, err)
+		}
+		if _, err = os.Stat(filePath); err != nil {
+			t.Fatalf("expected the file to still exist: %v", err)
+		}
+		if metadata, _ := db.GetMediaMetadata(ctx, uploads[0].MediaID, uploads[0].Origin); metadata != nil {
+			t.Fatalf("expected the first upload's metadata to be deleted, got %+v", metadata)
+		}
+		if thumbnails, _ := db.GetThumbnails(ctx, uploads[0].MediaID, uploads[0].Origin); len(thumbnails) != 0 {
+			t.Fatalf("expected the first upload's thumbnails to be deleted, got %d", len(thumbnails))
+		}
+
+		// Deleting the last upload removes the file.
+		req := httptest.NewRequest(http.MethodDelete, "/admin/media/test/"+string(uploads[1].MediaID), nil)
+		req = mux.SetURLVars(req, map[string]string{
+			"serverName": string(uploads[1].Origin),
+			"mediaId":    string(uploads[1].MediaID),
+		})
+		if res := DeleteMedia(req, cfg, db); res.Code != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d: %+v", res.Code, res.JSON)
+		}
+		if _, err = os.Stat(filePath); !os.IsNotExist(err) {
+			t.Fatalf("expected the file to be removed, got %v", err)
+		}
+
+		// Deleting it again doesn't find it.
+		if res := DeleteMedia(req, cfg, db); res.Code != http.StatusNotFound {
+			t.Fatalf("expected HTTP 404, got %d: %+v", res.Code, res.JSON)
+		}
+	})
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -28,6 +29,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -51,6 +53,11 @@ var mediaIDRegex = regexp.MustCompile("^[" + mediaIDCharacters + "]+$")
 var rfc2183 = regexp.MustCompile(`filename\=utf-8\"(.*)\"`)
 var rfc6266 = regexp.MustCompile(`filename\*\=utf-8\'\'(.*)`)
 
+var (
+	errRemoteFileNotFound = errors.New("remote file does not exist")
+	errRemoteFileTooLarge = errors.New("remote file is too large")
+)
+
 // downloadRequest metadata included in or derivable from a download or thumbnail request
 // https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-media-r0-download-servername-mediaid
 // http://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-media-r0-thumbnail-servername-mediaid
@@ -60,6 +67,7 @@ type downloadRequest struct {
 	ThumbnailSize      types.ThumbnailSize
 	Logger             *log.Entry
 	DownloadFilename   string
+	IfNoneMatch        string
 }
 
 // Download implements GET /download and GET /thumbnail
@@ -92,6 +100,7 @@ func Download(
 			"MediaID": mediaID,
 		}),
 		DownloadFilename: customFilename,
+		IfNoneMatch:      req.Header.Get("If-None-Match"),
 	}
 
 	if dReq.IsThumbnailRequest {
@@ -127,10 +136,7 @@ func Download(
 	)
 	if err != nil {
 		// TODO: Handle the fact we might have started writing the response
-		dReq.jsonErrorResponse(w, util.JSONResponse{
-			Code: http.StatusNotFound,
-			JSON: jsonerror.NotFound("Failed to download: " + err.Error()),
-		})
+		dReq.jsonErrorResponse(w, downloadErrorResponse(err))
 		return
 	}
 
@@ -144,6 +150,33 @@ func Download(
 
 }
 
+// downloadErrorResponse returns the response for a failed download, telling the
+// client whether the remote file was too large or the remote server too slow.
+func downloadErrorResponse(err error) util.JSONResponse {
+	switch {
+	case errors.Is(err, errRemoteFileTooLarge):
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.TooLarge("Failed to download: " + err.Error()),
+		}
+	case isTimeout(err):
+		return util.JSONResponse{
+			Code: http.StatusGatewayTimeout,
+			JSON: jsonerror.Unknown("Failed to download: timed out fetching remote file"),
+		}
+	default:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Failed to download: " + err.Error()),
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
 func (r *downloadRequest) jsonErrorResponse(w http.ResponseWriter, res util.JSONResponse) {
 	// Marshal JSON response into raw bytes to send as the HTTP body
 	resBytes, err := json.Marshal(res.JSON)
@@ -235,7 +268,7 @@ func (r *downloadRequest) doDownload(
 	return r.respondFromLocalFile(
 		ctx, w, cfg.AbsBasePath, activeThumbnailGeneration,
 		cfg.MaxThumbnailGenerators, db,
-		cfg.DynamicThumbnails, cfg.ThumbnailSizes,
+		cfg.DynamicThumbnails, cfg.ThumbnailSizes, cfg.CacheControl,
 	)
 }
 
@@ -250,6 +283,7 @@ func (r *downloadRequest) respondFromLocalFile(
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
+	cacheControl config.MediaCacheControl,
 ) (*types.MediaMetadata, error) {
 	filePath, err := fileutils.GetPathFromBase64Hash(r.MediaMetadata.Base64Hash, absBasePath)
 	if err != nil {
@@ -275,6 +309,7 @@ func (r *downloadRequest) respondFromLocalFile(
 
 	var responseFile *os.File
 	var responseMetadata *types.MediaMetadata
+	etag := `"` + string(r.MediaMetadata.Base64Hash) + `"`
 	if r.IsThumbnailRequest {
 		thumbFile, thumbMetadata, resErr := r.getThumbnailFile(
 			ctx, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
@@ -299,6 +334,8 @@ func (r *downloadRequest) respondFromLocalFile(
 			r.Logger.Trace("Responding with thumbnail")
 			responseFile = thumbFile
 			responseMetadata = thumbMetadata.MediaMetadata
+			size := thumbMetadata.ThumbnailSize
+			etag = fmt.Sprintf(`"%s-%dx%d-%s"`, r.MediaMetadata.Base64Hash, size.Width, size.Height, size.ResizeMethod)
 		}
 	} else {
 		r.Logger.WithFields(log.Fields{
@@ -314,6 +351,17 @@ func (r *downloadRequest) respondFromLocalFile(
 		}
 	}
 
+	// The content of a media URL never changes, so the hash of the file is
+	// enough to tell whether the client's cached copy is still valid.
+	w.Header().Set("ETag", etag)
+	if value := cacheControlHeader(cacheControl); value != "" {
+		w.Header().Set("Cache-Control", value)
+	}
+	if etagMatches(r.IfNoneMatch, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return responseMetadata, nil
+	}
+
 	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
 	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
 	contentSecurityPolicy := "default-src 'none';" +
@@ -322,6 +370,7 @@ func (r *downloadRequest) respondFromLocalFile(
 		" style-src 'unsafe-inline';" +
 		" object-src 'self';"
 	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
 	if _, err := io.Copy(w, responseFile); err != nil {
 		return nil, fmt.Errorf("io.Copy: %w", err)
@@ -329,6 +378,76 @@ func (r *downloadRequest) respondFromLocalFile(
 	return responseMetadata, nil
 }
 
+// cacheControlHeader returns the value of the Cache-Control header to send
+// with media, or an empty string if no header should be sent.
+func cacheControlHeader(cacheControl config.MediaCacheControl) string {
+	if cacheControl.MaxAge <= 0 {
+		return ""
+	}
+	value := fmt.Sprintf("public, max-age=%d", int64(cacheControl.MaxAge/time.Second))
+	if cacheControl.Immutable {
+		value += ", immutable"
+	}
+	return value
+}
+
+// etagMatches returns true if the If-None-Match header value matches the ETag,
+// using the weak comparison required for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// inlineContentTypes are the content types which are safe for a browser to
+// display inline. Anything else, e.g. HTML or SVG which could contain scripts,
+// is served as an attachment instead.
+var inlineContentTypes = map[string]struct{}{
+	"text/css":            {},
+	"text/plain":          {},
+	"text/csv":            {},
+	"application/json":    {},
+	"application/ld+json": {},
+	"image/jpeg":          {},
+	"image/gif":           {},
+	"image/png":           {},
+	"image/apng":          {},
+	"image/webp":          {},
+	"image/avif":          {},
+	"video/mp4":           {},
+	"video/webm":          {},
+	"video/ogg":           {},
+	"video/quicktime":     {},
+	"audio/mp4":           {},
+	"audio/webm":          {},
+	"audio/aac":           {},
+	"audio/mpeg":          {},
+	"audio/ogg":           {},
+	"audio/wave":          {},
+	"audio/wav":           {},
+	"audio/x-wav":         {},
+	"audio/x-pn-wav":      {},
+	"audio/flac":          {},
+	"audio/x-flac":        {},
+}
+
+// contentDispositionFor returns the Content-Disposition type to use when
+// serving media of the given content type.
+func contentDispositionFor(contentType types.ContentType) string {
+	mediaType, _, err := mime.ParseMediaType(string(contentType))
+	if err != nil {
+		return "attachment"
+	}
+	if _, ok := inlineContentTypes[mediaType]; ok {
+		return "inline"
+	}
+	return "attachment"
+}
+
 func (r *downloadRequest) addDownloadFilenameToHeaders(
 	w http.ResponseWriter,
 	responseMetadata *types.MediaMetadata,
@@ -340,7 +459,9 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 		filename = r.DownloadFilename
 	}
 
+	disposition := contentDispositionFor(responseMetadata.ContentType)
 	if len(filename) == 0 {
+		w.Header().Set("Content-Disposition", disposition)
 		return nil
 	}
 
@@ -376,14 +497,14 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 		// that would otherwise be parsed as a control character in the
 		// Content-Disposition header
 		w.Header().Set("Content-Disposition", fmt.Sprintf(
-			`inline; filename=%s%s%s`,
-			quote, unescaped, quote,
+			`%s; filename=%s%s%s`,
+			disposition, quote, unescaped, quote,
 		))
 	} else {
 		// For UTF-8 filenames, we quote always, as that's the standard
 		w.Header().Set("Content-Disposition", fmt.Sprintf(
-			`inline; filename*=utf-8''%s`,
-			url.QueryEscape(unescaped),
+			`%s; filename*=utf-8''%s`,
+			disposition, url.QueryEscape(unescaped),
 		))
 	}
 
@@ -519,6 +640,11 @@ func (r *downloadRequest) getRemoteFile(
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (errorResponse error) {
+	// If fetching the file failed recently then don't try again yet.
+	if err := r.getRecentRemoteFailure(activeRemoteRequests); err != nil {
+		return err
+	}
+
 	// Note: getMediaMetadataFromActiveRequest uses mutexes and conditions from activeRemoteRequests
 	mediaMetadata, resErr := r.getMediaMetadataFromActiveRequest(activeRemoteRequests)
 	if resErr != nil {
@@ -550,12 +676,13 @@ func (r *downloadRequest) getRemoteFile(
 			// If we do not have a record, we need to fetch the remote file first and then respond from the local file
 			err := r.fetchRemoteFileAndStoreMetadata(
 				ctx, client,
-				cfg.AbsBasePath, cfg.MaxFileSizeBytes, db,
+				cfg.AbsBasePath, cfg.RemoteMaxFileSizeBytes(), cfg.RemoteFetch.Timeout, db,
 				cfg.ThumbnailSizes, activeThumbnailGeneration,
 				cfg.MaxThumbnailGenerators,
 			)
 			if err != nil {
 				r.Logger.WithError(err).Errorf("r.fetchRemoteFileAndStoreMetadata: failed to fetch remote file")
+				r.storeRemoteFailure(activeRemoteRequests, err, cfg.RemoteFetch.FailureCacheDuration)
 				return err
 			}
 		} else {
@@ -612,24 +739,89 @@ func (r *downloadRequest) broadcastMediaMetadata(activeRemoteRequests *types.Act
 	delete(activeRemoteRequests.MXCToResult, mxcURL)
 }
 
+// getRecentRemoteFailure returns the error from a recent failed attempt to
+// fetch the remote file, if there was one.
+func (r *downloadRequest) getRecentRemoteFailure(activeRemoteRequests *types.ActiveRemoteRequests) error {
+	mxcURL := "mxc://" + string(r.MediaMetadata.Origin) + "/" + string(r.MediaMetadata.MediaID)
+
+	activeRemoteRequests.Lock()
+	defer activeRemoteRequests.Unlock()
+
+	failure, ok := activeRemoteRequests.MXCToFailure[mxcURL]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(failure.Expires) {
+		delete(activeRemoteRequests.MXCToFailure, mxcURL)
+		return nil
+	}
+	r.Logger.Trace("Remote file failed to fetch recently, not trying again yet.")
+	return failure.Error
+}
+
+// storeRemoteFailure remembers that fetching the remote file failed, so that
+// requests for it in the next cacheDuration fail without contacting the remote
+// server. Only failures caused by the remote server are remembered.
+func (r *downloadRequest) storeRemoteFailure(activeRemoteRequests *types.ActiveRemoteRequests, err error, cacheDuration time.Duration) {
+	if cacheDuration <= 0 {
+		return
+	}
+	if !errors.Is(err, errRemoteFileNotFound) && !errors.Is(err, errRemoteFileTooLarge) && !isTimeout(err) {
+		return
+	}
+	mxcURL := "mxc://" + string(r.MediaMetadata.Origin) + "/" + string(r.MediaMetadata.MediaID)
+
+	activeRemoteRequests.Lock()
+	defer activeRemoteRequests.Unlock()
+
+	now := time.Now()
+	if activeRemoteRequests.MXCToFailure == nil {
+		activeRemoteRequests.MXCToFailure = map[string]*types.RemoteRequestFailure{}
+	}
+	// Drop any expired failures so that the map doesn't grow without bound.
+	for key, failure := range activeRemoteRequests.MXCToFailure {
+		if now.After(failure.Expires) {
+			delete(activeRemoteRequests.MXCToFailure, key)
+		}
+	}
+	activeRemoteRequests.MXCToFailure[mxcURL] = &types.RemoteRequestFailure{
+		Error:   err,
+		Expires: now.Add(cacheDuration),
+	}
+}
+
 // fetchRemoteFileAndStoreMetadata fetches the file from the remote server and stores its metadata in the database
 func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	ctx context.Context,
 	client *gomatrixserverlib.Client,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
+	timeout time.Duration,
 	db storage.Database,
 	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) error {
-	finalPath, duplicate, err := r.fetchRemoteFile(
-		ctx, client, absBasePath, maxFileSizeBytes,
+	tmpDir, err := r.fetchRemoteFile(
+		ctx, client, absBasePath, maxFileSizeBytes, timeout,
 	)
 	if err != nil {
 		return err
 	}
 
+	mediaFilesMutex.RLock()
+	defer mediaFilesMutex.RUnlock()
+
+	// The database is the source of truth so we need to have moved the file first
+	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	if err != nil {
+		return fmt.Errorf("fileutils.MoveFileWithHashCheck: %w", err)
+	}
+	if duplicate {
+		r.Logger.WithField("dst", finalPath).Trace("File was stored previously - discarding duplicate")
+		// Continue on to store the metadata in the database
+	}
+
 	r.Logger.WithFields(log.Fields{
 		"Base64Hash":    r.MediaMetadata.Base64Hash,
 		"UploadName":    r.MediaMetadata.UploadName,
@@ -652,6 +844,8 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	}
 
 	go func() {
+		mediaFilesMutex.RLock()
+		defer mediaFilesMutex.RUnlock()
 		busy, err := thumbnailer.GenerateThumbnails(
 			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
@@ -687,8 +881,8 @@ func (r *downloadRequest) GetContentLengthAndReader(contentLengthHeader string,
 		}
 		if maxFileSizeBytes > 0 && parsedLength > int64(maxFileSizeBytes) {
 			return 0, nil, fmt.Errorf(
-				"remote file size (%d bytes) exceeds locally configured max media size (%d bytes)",
-				parsedLength, maxFileSizeBytes,
+				"%w: size (%d bytes) exceeds locally configured max media size (%d bytes)",
+				errRemoteFileTooLarge, parsedLength, maxFileSizeBytes,
 			)
 		}
 
@@ -699,11 +893,12 @@ func (r *downloadRequest) GetContentLengthAndReader(contentLengthHeader string,
 	} else {
 		// Content-Length header is missing. If we have a maximum file size
 		// configured then we'll just make sure that the reader is limited to
-		// that size. We'll return a zero content length, but that's OK, since
-		// ultimately it will get rewritten later when the temp file is written
-		// to disk.
+		// one byte more than that size, so that an oversized file can be
+		// detected once it has been written to disk. We'll return a zero
+		// content length, but that's OK, since ultimately it will get
+		// rewritten later when the temp file is written to disk.
 		if maxFileSizeBytes > 0 {
-			reader = io.NopCloser(io.LimitReader(*body, int64(maxFileSizeBytes)))
+			reader = io.NopCloser(io.LimitReader(*body, int64(maxFileSizeBytes)+1))
 		}
 		contentLength = 0
 	}
@@ -716,29 +911,40 @@ func (r *downloadRequest) fetchRemoteFile(
 	client *gomatrixserverlib.Client,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
-) (types.Path, bool, error) {
+	timeout time.Duration,
+) (types.Path, error) {
 	r.Logger.Debug("Fetching remote file")
 
+	// The timeout covers both the request and reading the file, so that a
+	// remote server can't hold the request open by sending the file slowly.
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	// create request for remote file
 	resp, err := client.CreateMediaDownloadRequest(ctx, r.MediaMetadata.Origin, string(r.MediaMetadata.MediaID))
-	if err != nil || (resp != nil && resp.StatusCode != http.StatusOK) {
-		if resp != nil && resp.StatusCode == http.StatusNotFound {
-			return "", false, fmt.Errorf("File with media ID %q does not exist on %s", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
-		}
-		return "", false, fmt.Errorf("file with media ID %q could not be downloaded from %s", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+	if err != nil {
+		return "", fmt.Errorf("file with media ID %q could not be downloaded from %s: %w", r.MediaMetadata.MediaID, r.MediaMetadata.Origin, err)
 	}
 	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusNotFound {
+			return "", fmt.Errorf("File with media ID %q does not exist on %s: %w", r.MediaMetadata.MediaID, r.MediaMetadata.Origin, errRemoteFileNotFound)
+		}
+		return "", fmt.Errorf("file with media ID %q could not be downloaded from %s", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+	}
 
 	// The reader returned here will be limited either by the Content-Length
 	// and/or the configured maximum media size.
 	contentLength, reader, parseErr := r.GetContentLengthAndReader(resp.Header.Get("Content-Length"), &resp.Body, maxFileSizeBytes)
 	if parseErr != nil {
-		return "", false, parseErr
+		return "", parseErr
 	}
 
 	if maxFileSizeBytes > 0 && contentLength > int64(maxFileSizeBytes) {
-		// TODO: Bubble up this as a 413
-		return "", false, fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
+		return "", fmt.Errorf("%w (%v > %v bytes)", errRemoteFileTooLarge, contentLength, maxFileSizeBytes)
 	}
 
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(contentLength)
@@ -766,13 +972,22 @@ func (r *downloadRequest) fetchRemoteFile(
 	// The file data is hashed but is NOT used as the MediaID, unlike in Upload. The hash is useful as a
 	// method of deduplicating files to save storage, as well as a way to conduct
 	// integrity checks on the file data in the repository.
-	// Data is truncated to maxFileSizeBytes. Content-Length was reported as 0 < Content-Length <= maxFileSizeBytes so this is OK.
+	// Data is truncated to one byte over maxFileSizeBytes, so that oversized files without a Content-Length are detected below.
 	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, reader, absBasePath)
 	if err != nil {
 		r.Logger.WithError(err).WithFields(log.Fields{
 			"MaxFileSizeBytes": maxFileSizeBytes,
 		}).Warn("Error while downloading file from remote server")
-		return "", false, errors.New("file could not be downloaded from remote server")
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return "", fmt.Errorf("file could not be downloaded from remote server: %w", ctxErr)
+		}
+		return "", errors.New("file could not be downloaded from remote server")
+	}
+	if maxFileSizeBytes > 0 && bytesWritten > types.FileSizeBytes(maxFileSizeBytes) {
+		// The remote server didn't send a Content-Length, and sent more than
+		// the maximum, so the file must have been truncated.
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		return "", fmt.Errorf("%w (more than %v bytes)", errRemoteFileTooLarge, maxFileSizeBytes)
 	}
 
 	r.Logger.Trace("Remote file transferred")
@@ -783,15 +998,5 @@ func (r *downloadRequest) fetchRemoteFile(
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(bytesWritten)
 	r.MediaMetadata.Base64Hash = hash
 
-	// The database is the source of truth so we need to have moved the file first
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
-	if err != nil {
-		return "", false, fmt.Errorf("fileutils.MoveFileWithHashCheck: %w", err)
-	}
-	if duplicate {
-		r.Logger.WithField("dst", finalPath).Trace("File was stored previously - discarding duplicate")
-		// Continue on to store the metadata in the database
-	}
-
-	return types.Path(finalPath), duplicate, nil
+	return tmpDir, nil
 }
@@ -0,0 +1,304 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestDownload_SafeHeaders(t *testing.T) {
+	basePath := t.TempDir()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		BasePath:    config.Path(basePath),
+		AbsBasePath: config.Path(basePath),
+	}
+	cfg.Matrix.ServerName = "test"
+
+	db, err := storage.NewMediaAPIDatasource(nil, &config.DatabaseOptions{
+		ConnectionString:       config.DataSource("file:" + filepath.Join(t.TempDir(), "mediaapi.db")),
+		MaxOpenConnections:     100,
+		MaxIdleConnections:     2,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	if err != nil {
+		t.Fatalf("error opening mediaapi database: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		content     string
+		contentType types.ContentType
+		uploadName  types.Filename
+		disposition string
+	}{
+		{
+			name:        "plain text is inline",
+			content:     "hello world",
+			contentType: "text/plain",
+			uploadName:  "hello.txt",
+			disposition: "inline; filename=hello.txt",
+		},
+		{
+			name:        "html is an attachment",
+			content:     "<html><script>alert(1)</script></html>",
+			contentType: "text/html",
+			uploadName:  "page.html",
+			disposition: "attachment; filename=page.html",
+		},
+		{
+			name:        "html without a filename is an attachment",
+			content:     "<html><body>hello</body></html>",
+			contentType: "text/html",
+			disposition: "attachment",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &uploadRequest{
+				MediaMetadata: &types.MediaMetadata{
+					Origin:      cfg.Matrix.ServerName,
+					ContentType: tt.contentType,
+					UploadName:  tt.uploadName,
+				},
+				Logger: log.New().WithField("mediaapi", "test"),
+			}
+			if resErr := r.doUpload(context.Background(), strings.NewReader(tt.content), cfg, db, nil); resErr != nil {
+				t.Fatalf("failed to upload: %+v", resErr)
+			}
+
+			// doUpload assigns a new media ID to the upload
+			mediaID := r.MediaMetadata.MediaID
+			req := httptest.NewRequest(http.MethodGet, "/_matrix/media/v3/download/test/"+string(mediaID), nil)
+			w := httptest.NewRecorder()
+			Download(w, req, cfg.Matrix.ServerName, mediaID, cfg, db, nil, nil, nil, false, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected HTTP 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("expected X-Content-Type-Options: nosniff, got %q", got)
+			}
+			if got := w.Header().Get("Content-Security-Policy"); !strings.Contains(got, "script-src 'none'") {
+				t.Errorf("expected Content-Security-Policy to forbid scripts, got %q", got)
+			}
+			if got := w.Header().Get("Content-Disposition"); got != tt.disposition {
+				t.Errorf("expected Content-Disposition %q, got %q", tt.disposition, got)
+			}
+			if got := w.Body.String(); got != tt.content {
+				t.Errorf("expected body %q, got %q", tt.content, got)
+			}
+		})
+	}
+}
+
+func TestDownload_ETag(t *testing.T) {
+	basePath := t.TempDir()
+	cfg := &config.MediaAPI{
+		Matrix:      &config.Global{},
+		BasePath:    config.Path(basePath),
+		AbsBasePath: config.Path(basePath),
+		CacheControl: config.MediaCacheControl{
+			MaxAge:    24 * time.Hour,
+			Immutable: true,
+		},
+	}
+	cfg.Matrix.ServerName = "test"
+
+	db, err := storage.NewMediaAPIDatasource(nil, &config.DatabaseOptions{
+		ConnectionString:       config.DataSource("file:" + filepath.Join(t.TempDir(), "mediaapi.db")),
+		MaxOpenConnections:     100,
+		MaxIdleConnections:     2,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	if err != nil {
+		t.Fatalf("error opening mediaapi database: %v", err)
+	}
+
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:      cfg.Matrix.ServerName,
+			ContentType: "text/plain",
+		},
+		Logger: log.New().WithField("mediaapi", "test"),
+	}
+	if resErr := r.doUpload(context.Background(), strings.NewReader("hello world"), cfg, db, nil); resErr != nil {
+		t.Fatalf("failed to upload: %+v", resErr)
+	}
+	mediaID := r.MediaMetadata.MediaID
+
+	download := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/_matrix/media/v3/download/test/"+string(mediaID), nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		Download(w, req, cfg.Matrix.ServerName, mediaID, cfg, db, nil, nil, nil, false, "")
+		return w
+	}
+
+	w := download("")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected HTTP 200, got %d: %s", w.Code, w.Body.String())
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected an ETag header")
+	}
+	if got, want := w.Header().Get("Cache-Control"), "public, max-age=86400, immutable"; got != want {
+		t.Fatalf("expected Cache-Control %q, got %q", want, got)
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		wantCode    int
+	}{
+		{name: "matching ETag", ifNoneMatch: etag, wantCode: http.StatusNotModified},
+		{name: "weak matching ETag", ifNoneMatch: "W/" + etag, wantCode: http.StatusNotModified},
+		{name: "one of several ETags", ifNoneMatch: `"other", ` + etag, wantCode: http.StatusNotModified},
+		{name: "any ETag", ifNoneMatch: "*", wantCode: http.StatusNotModified},
+		{name: "different ETag", ifNoneMatch: `"other"`, wantCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := download(tt.ifNoneMatch)
+			if w.Code != tt.wantCode {
+				t.Fatalf("expected HTTP %d, got %d", tt.wantCode, w.Code)
+			}
+			if got := w.Header().Get("ETag"); got != etag {
+				t.Errorf("expected ETag %q, got %q", etag, got)
+			}
+			if tt.wantCode == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("expected no body, got %q", w.Body.String())
+			}
+			if tt.wantCode == http.StatusOK && w.Body.String() != "hello world" {
+				t.Errorf("expected body %q, got %q", "hello world", w.Body.String())
+			}
+		})
+	}
+}
+
+// rewriteTransport sends all requests to the given test server, whatever
+// server name they were addressed to.
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestDownload_RemoteLimits(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/large"):
+			_, _ = w.Write([]byte(strings.Repeat("a", 100)))
+		case strings.HasSuffix(req.URL.Path, "/chunked"):
+			// Flushing before writing the body means there is no Content-Length.
+			w.(http.Flusher).Flush()
+			_, _ = w.Write([]byte(strings.Repeat("a", 100)))
+		case strings.HasSuffix(req.URL.Path, "/slow"):
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := gomatrixserverlib.NewClient(gomatrixserverlib.WithTransport(rewriteTransport{target: target}))
+
+	basePath := t.TempDir()
+	cfg := &config.MediaAPI{
+		Matrix:           &config.Global{},
+		BasePath:         config.Path(basePath),
+		AbsBasePath:      config.Path(basePath),
+		MaxFileSizeBytes: 1000,
+		RemoteFetch: config.RemoteFetch{
+			Timeout:              100 * time.Millisecond,
+			MaxFileSizeBytes:     10,
+			FailureCacheDuration: time.Minute,
+		},
+	}
+	cfg.Matrix.ServerName = "test"
+
+	db, err := storage.NewMediaAPIDatasource(nil, &config.DatabaseOptions{
+		ConnectionString:       config.DataSource("file:" + filepath.Join(t.TempDir(), "mediaapi.db")),
+		MaxOpenConnections:     100,
+		MaxIdleConnections:     2,
+		ConnMaxLifetimeSeconds: -1,
+	})
+	if err != nil {
+		t.Fatalf("error opening mediaapi database: %v", err)
+	}
+	activeRemoteRequests := &types.ActiveRemoteRequests{
+		MXCToResult:  map[string]*types.RemoteRequestResult{},
+		MXCToFailure: map[string]*types.RemoteRequestFailure{},
+	}
+
+	tests := []struct {
+		name        string
+		mediaID     types.MediaID
+		wantCode    int
+		wantErrCode string
+	}{
+		{name: "oversized file is rejected", mediaID: "large", wantCode: http.StatusBadGateway, wantErrCode: "M_TOO_LARGE"},
+		{name: "oversized file without content length is rejected", mediaID: "chunked", wantCode: http.StatusBadGateway, wantErrCode: "M_TOO_LARGE"},
+		{name: "slow file times out", mediaID: "slow", wantCode: http.StatusGatewayTimeout, wantErrCode: "M_UNKNOWN"},
+		{name: "missing file is not found", mediaID: "missing", wantCode: http.StatusNotFound, wantErrCode: "M_NOT_FOUND"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&hits, 0)
+			// The second request should fail in the same way, but without
+			// contacting the remote server.
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/_matrix/media/v3/download/remote/"+string(tt.mediaID), nil)
+				w := httptest.NewRecorder()
+				Download(w, req, "remote", tt.mediaID, cfg, db, client, activeRemoteRequests, nil, false, "")
+				if w.Code != tt.wantCode {
+					t.Fatalf("expected HTTP %d, got %d: %s", tt.wantCode, w.Code, w.Body.String())
+				}
+				var res jsonerror.MatrixError
+				if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+					t.Fatalf("failed to decode response: %s", err)
+				}
+				if res.ErrCode != tt.wantErrCode {
+					t.Fatalf("expected errcode %s, got %s", tt.wantErrCode, res.ErrCode)
+				}
+			}
+			if got := atomic.LoadInt32(&hits); got != 1 {
+				t.Fatalf("expected the remote server to be contacted once, got %d", got)
+			}
+			metadata, err := db.GetMediaMetadata(context.Background(), tt.mediaID, "remote")
+			if err != nil {
+				t.Fatalf("failed to query media metadata: %s", err)
+			}
+			if metadata != nil {
+				t.Fatalf("expected no media to be stored, got %+v", metadata)
+			}
+		})
+	}
+}
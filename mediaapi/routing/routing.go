@@ -45,13 +45,15 @@ type configResponse struct {
 // nolint: gocyclo
 func Setup(
 	publicAPIMux *mux.Router,
+	dendriteAdminMux *mux.Router,
 	cfg *config.MediaAPI,
 	rateLimit *config.RateLimiting,
+	appServices []config.ApplicationService,
 	db storage.Database,
 	userAPI userapi.MediaUserAPI,
 	client *gomatrixserverlib.Client,
 ) {
-	rateLimits := httputil.NewRateLimits(rateLimit)
+	rateLimits := httputil.NewRateLimits(rateLimit, appServices)
 
 	v3mux := publicAPIMux.PathPrefix("/{apiversion:(?:r0|v1|v3)}/").Subrouter()
 
@@ -87,7 +89,8 @@ func Setup(
 	v3mux.Handle("/config", configHandler).Methods(http.MethodGet, http.MethodOptions)
 
 	activeRemoteRequests := &types.ActiveRemoteRequests{
-		MXCToResult: map[string]*types.RemoteRequestResult{},
+		MXCToResult:  map[string]*types.RemoteRequestResult{},
+		MXCToFailure: map[string]*types.RemoteRequestFailure{},
 	}
 
 	downloadHandler := makeDownloadAPI("download", cfg, rateLimits, db, client, activeRemoteRequests, activeThumbnailGeneration)
@@ -97,6 +100,12 @@ func Setup(
 	v3mux.Handle("/thumbnail/{serverName}/{mediaId}",
 		makeDownloadAPI("thumbnail", cfg, rateLimits, db, client, activeRemoteRequests, activeThumbnailGeneration),
 	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminMux.Handle("/admin/media/{serverName}/{mediaId}",
+		httputil.MakeAdminAPI("admin_delete_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return DeleteMedia(req, cfg, db)
+		}),
+	).Methods(http.MethodDelete, http.MethodOptions)
 }
 
 func makeDownloadAPI(
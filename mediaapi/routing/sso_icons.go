@@ -0,0 +1,98 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// StoreSSOIcons stores the identity provider icons which are read from
+// local images in the media repository. The media ID of an icon is derived
+// from its content, so icons which are already stored are skipped and an
+// icon is only stored again once its image changes.
+func StoreSSOIcons(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	icons map[string]config.SSOIcon,
+	db storage.Database,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) error {
+	for idpID, icon := range icons {
+		logger := log.WithField("identity_provider", idpID).WithField("media_id", icon.MediaID)
+		existingMetadata, err := db.GetMediaMetadata(ctx, types.MediaID(icon.MediaID), cfg.Matrix.ServerName)
+		if err != nil {
+			return fmt.Errorf("db.GetMediaMetadata: %w", err)
+		}
+		if existingMetadata != nil {
+			continue
+		}
+		if err = storeSSOIcon(ctx, cfg, icon, db, activeThumbnailGeneration, logger); err != nil {
+			return fmt.Errorf("failed to store icon of identity provider %q: %w", idpID, err)
+		}
+		logger.Info("Stored identity provider icon")
+	}
+	return nil
+}
+
+func storeSSOIcon(
+	ctx context.Context,
+	cfg *config.MediaAPI,
+	icon config.SSOIcon,
+	db storage.Database,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	logger *log.Entry,
+) error {
+	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, bytes.NewReader(icon.Data), cfg.AbsBasePath)
+	if err != nil {
+		return err
+	}
+	contentType, err := fileutils.DetectContentType(tmpDir)
+	if err != nil {
+		fileutils.RemoveDir(tmpDir, logger)
+		return err
+	}
+
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			MediaID:           types.MediaID(icon.MediaID),
+			Origin:            cfg.Matrix.ServerName,
+			ContentType:       types.ContentType(contentType),
+			FileSizeBytes:     bytesWritten,
+			CreationTimestamp: gomatrixserverlib.AsTimestamp(time.Now()),
+			UploadName:        types.Filename(url.PathEscape(filepath.Base(icon.Path))),
+			Base64Hash:        hash,
+		},
+		Logger: logger,
+	}
+	if resErr := r.storeFileAndMetadata(
+		ctx, tmpDir, cfg.AbsBasePath, db, cfg.ThumbnailSizes,
+		activeThumbnailGeneration, cfg.MaxThumbnailGenerators,
+	); resErr != nil {
+		return fmt.Errorf("%v", resErr.JSON)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package routing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+)
+
+func TestStoreSSOIcons(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		db, err := storage.NewMediaAPIDatasource(nil, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("failed to open mediaapi database: %v", err)
+		}
+
+		basePath := config.Path(t.TempDir())
+		cfg := &config.MediaAPI{
+			Matrix:      &config.Global{},
+			BasePath:    basePath,
+			AbsBasePath: basePath,
+		}
+		cfg.Matrix.ServerName = "test"
+		ctx := context.Background()
+		activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+			PathToResult: map[string]*types.ThumbnailGenerationResult{},
+		}
+
+		iconPath := filepath.Join(t.TempDir(), "icon.png")
+		writeIcon := func(content string) map[string]config.SSOIcon {
+			t.Helper()
+			hash := sha256.Sum256([]byte(content))
+			return map[string]config.SSOIcon{
+				"github": {Path: iconPath, Data: []byte(content), MediaID: hex.EncodeToString(hash[:])},
+			}
+		}
+		wantStored := func(icons map[string]config.SSOIcon) *types.MediaMetadata {
+			t.Helper()
+			mediaID := types.MediaID(icons["github"].MediaID)
+			metadata, err := db.GetMediaMetadata(ctx, mediaID, "test")
+			if err != nil || metadata == nil {
+				t.Fatalf("expected the icon to be stored as %q, got %v", mediaID, err)
+			}
+			if metadata.ContentType != "image/png" || metadata.UploadName != "icon.png" {
+				t.Fatalf("unexpected metadata %+v", metadata)
+			}
+			filePath, err := fileutils.GetPathFromBase64Hash(metadata.Base64Hash, basePath)
+			if err != nil {
+				t.Fatalf("failed to get file path: %v", err)
+			}
+			if _, err = os.Stat(filePath); err != nil {
+				t.Fatalf("expected the icon file to exist: %v", err)
+			}
+			return metadata
+		}
+
+		icons := writeIcon("\x89PNG\r\n\x1a\n" + "an icon")
+		if err = StoreSSOIcons(ctx, cfg, icons, db, activeThumbnailGeneration); err != nil {
+			t.Fatalf("StoreSSOIcons failed: %v", err)
+		}
+		stored := wantStored(icons)
+
+		// Icons which are already stored aren't stored again.
+		if err = StoreSSOIcons(ctx, cfg, icons, db, activeThumbnailGeneration); err != nil {
+			t.Fatalf("StoreSSOIcons failed: %v", err)
+		}
+		if again := wantStored(icons); *again != *stored {
+			t.Fatalf("expected the icon not to be stored again, got %+v and %+v", stored, again)
+		}
+
+		// A changed icon is stored under a new media ID.
+		changedIcons := writeIcon("\x89PNG\r\n\x1a\n" + "another icon")
+		if err = StoreSSOIcons(ctx, cfg, changedIcons, db, activeThumbnailGeneration); err != nil {
+			t.Fatalf("StoreSSOIcons failed: %v", err)
+		}
+		if changed := wantStored(changedIcons); changed.Base64Hash == stored.Base64Hash {
+			t.Fatalf("expected the changed icon to be stored, got %+v", changed)
+		}
+	})
+}
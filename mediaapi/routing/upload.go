@@ -90,9 +90,12 @@ func parseAndValidateRequest(req *http.Request, cfg *config.MediaAPI, dev *usera
 		Logger: util.GetLogger(req.Context()).WithField("Origin", cfg.Matrix.ServerName),
 	}
 
-	if resErr := r.Validate(cfg.MaxFileSizeBytes); resErr != nil {
+	if resErr := r.Validate(cfg.MaxFileSizeBytesFor(string(r.MediaMetadata.ContentType))); resErr != nil {
 		return nil, resErr
 	}
+	if r.MediaMetadata.ContentType != "" && !cfg.ContentTypeAllowed(string(r.MediaMetadata.ContentType)) {
+		return nil, contentTypeForbiddenJSONResponse(string(r.MediaMetadata.ContentType))
+	}
 
 	return r, nil
 }
@@ -148,20 +151,21 @@ func (r *uploadRequest) doUpload(
 	//   r.storeFileAndMetadata(ctx, tmpDir, ...)
 	// before you return from doUpload else we will leak a temp file. We could make this nicer with a `WithTransaction` style of
 	// nested function to guarantee either storage or cleanup.
-	if cfg.MaxFileSizeBytes > 0 {
-		if cfg.MaxFileSizeBytes+1 <= 0 {
+	maxFileSizeBytes := cfg.MaxFileSizeBytesFor(string(r.MediaMetadata.ContentType))
+	if maxFileSizeBytes > 0 {
+		if maxFileSizeBytes+1 <= 0 {
 			r.Logger.WithFields(log.Fields{
-				"MaxFileSizeBytes": cfg.MaxFileSizeBytes,
+				"MaxFileSizeBytes": maxFileSizeBytes,
 			}).Warnf("Configured MaxFileSizeBytes overflows int64, defaulting to %d bytes", config.DefaultMaxFileSizeBytes)
-			cfg.MaxFileSizeBytes = config.DefaultMaxFileSizeBytes
+			maxFileSizeBytes = config.DefaultMaxFileSizeBytes
 		}
-		reqReader = io.LimitReader(reqReader, int64(cfg.MaxFileSizeBytes)+1)
+		reqReader = io.LimitReader(reqReader, int64(maxFileSizeBytes)+1)
 	}
 
 	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, reqReader, cfg.AbsBasePath)
 	if err != nil {
 		r.Logger.WithError(err).WithFields(log.Fields{
-			"MaxFileSizeBytes": cfg.MaxFileSizeBytes,
+			"MaxFileSizeBytes": maxFileSizeBytes,
 		}).Warn("Error while transferring file")
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -170,9 +174,30 @@ func (r *uploadRequest) doUpload(
 	}
 
 	// Check if temp file size exceeds max file size configuration
-	if cfg.MaxFileSizeBytes > 0 && bytesWritten > types.FileSizeBytes(cfg.MaxFileSizeBytes) {
+	if maxFileSizeBytes > 0 && bytesWritten > types.FileSizeBytes(maxFileSizeBytes) {
 		fileutils.RemoveDir(tmpDir, r.Logger) // delete temp file
-		return requestEntityTooLargeJSONResponse(cfg.MaxFileSizeBytes)
+		return requestEntityTooLargeJSONResponse(maxFileSizeBytes)
+	}
+
+	// Don't trust the Content-Type header given by the client, check what the
+	// uploaded file actually looks like too.
+	sniffedContentType, err := fileutils.DetectContentType(tmpDir)
+	if err != nil {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		r.Logger.WithError(err).Error("Failed to detect content type of uploaded file")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !cfg.ContentTypeAllowed(sniffedContentType) {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		r.Logger.WithField("sniffedContentType", sniffedContentType).Info("Rejecting upload of disallowed content type")
+		return contentTypeForbiddenJSONResponse(sniffedContentType)
+	}
+	// The file may have a smaller limit than the client's Content-Type suggested.
+	if sniffedMax := cfg.MaxFileSizeBytesFor(sniffedContentType); sniffedMax > 0 && bytesWritten > types.FileSizeBytes(sniffedMax) {
+		fileutils.RemoveDir(tmpDir, r.Logger)
+		r.Logger.WithField("sniffedContentType", sniffedContentType).Info("Rejecting upload which is too large for its content type")
+		return requestEntityTooLargeJSONResponse(sniffedMax)
 	}
 
 	// Look up the media by the file hash. If we already have the file but under a
@@ -203,7 +228,7 @@ func (r *uploadRequest) doUpload(
 			MediaID:           mediaID,
 			Origin:            r.MediaMetadata.Origin,
 			ContentType:       r.MediaMetadata.ContentType,
-			FileSizeBytes:     r.MediaMetadata.FileSizeBytes,
+			FileSizeBytes:     bytesWritten,
 			CreationTimestamp: r.MediaMetadata.CreationTimestamp,
 			UploadName:        r.MediaMetadata.UploadName,
 			Base64Hash:        hash,
@@ -239,7 +264,14 @@ func (r *uploadRequest) doUpload(
 func requestEntityTooLargeJSONResponse(maxFileSizeBytes config.FileSizeBytes) *util.JSONResponse {
 	return &util.JSONResponse{
 		Code: http.StatusRequestEntityTooLarge,
-		JSON: jsonerror.Unknown(fmt.Sprintf("HTTP Content-Length is greater than the maximum allowed upload size (%v).", maxFileSizeBytes)),
+		JSON: jsonerror.TooLarge(fmt.Sprintf("HTTP Content-Length is greater than the maximum allowed upload size (%v).", maxFileSizeBytes)),
+	}
+}
+
+func contentTypeForbiddenJSONResponse(contentType string) *util.JSONResponse {
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden(fmt.Sprintf("Uploading media of content type %q is not allowed.", contentType)),
 	}
 }
 
@@ -285,8 +317,10 @@ func (r *uploadRequest) storeFileAndMetadata(
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) *util.JSONResponse {
+	mediaFilesMutex.RLock()
 	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
 	if err != nil {
+		mediaFilesMutex.RUnlock()
 		r.Logger.WithError(err).Error("Failed to move file.")
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -305,13 +339,19 @@ func (r *uploadRequest) storeFileAndMetadata(
 		if !duplicate {
 			fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
 		}
+		mediaFilesMutex.RUnlock()
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.Unknown("Failed to upload"),
 		}
 	}
+	mediaFilesMutex.RUnlock()
 
 	go func() {
+		// Hold the lock while the thumbnails are generated, else the file
+		// could be removed from under the thumbnailer.
+		mediaFilesMutex.RLock()
+		defer mediaFilesMutex.RUnlock()
 		file, err := os.Open(string(finalPath))
 		if err != nil {
 			r.Logger.WithError(err).Error("unable to open file")
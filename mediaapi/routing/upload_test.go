@@ -50,6 +50,20 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 	_ = os.Mkdir(testdataPath, os.ModePerm)
 	defer fileutils.RemoveDir(types.Path(testdataPath), nil)
 
+	// Images and videos which are larger than max_file_size_bytes, but within
+	// the larger limit for videos.
+	largeImage := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", 24)
+	largeVideo := "\x1a\x45\xdf\xa3" + strings.Repeat("x", 28)
+	contentTypeCfg := &config.MediaAPI{
+		MaxFileSizeBytes: maxSize,
+		BasePath:         config.Path(testdataPath),
+		AbsBasePath:      config.Path(testdataPath),
+		ContentTypeMaxFileSizes: []config.ContentTypeMaxFileSize{
+			{ContentType: "video/*", MaxFileSizeBytes: 64},
+			{ContentType: "image/*", MaxFileSizeBytes: 16},
+		},
+	}
+
 	db, err := storage.NewMediaAPIDatasource(nil, &config.DatabaseOptions{
 		ConnectionString:       "file::memory:?cache=shared",
 		MaxOpenConnections:     100,
@@ -138,6 +152,82 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "upload not ok (disallowed content type)",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader("test"),
+				cfg: &config.MediaAPI{
+					MaxFileSizeBytes:    maxSize,
+					BasePath:            config.Path(testdataPath),
+					AbsBasePath:         config.Path(testdataPath),
+					AllowedContentTypes: []string{"image/*"},
+				},
+				db: db,
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					MediaID:     "1340",
+					UploadName:  "test.png",
+					ContentType: "image/png",
+				},
+			},
+			want: contentTypeForbiddenJSONResponse("text/plain; charset=utf-8"),
+		},
+		{
+			name: "upload not ok (image over content type limit)",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader(largeImage),
+				cfg:       contentTypeCfg,
+				db:        db,
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					MediaID:     "1341",
+					UploadName:  "large.png",
+					ContentType: "image/png",
+				},
+			},
+			want: requestEntityTooLargeJSONResponse(16),
+		},
+		{
+			name: "upload ok (video within content type limit)",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader(largeVideo),
+				cfg:       contentTypeCfg,
+				db:        db,
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					MediaID:     "1342",
+					UploadName:  "large.webm",
+					ContentType: "video/webm",
+				},
+			},
+		},
+		{
+			name: "upload not ok (image claiming to be a video)",
+			args: args{
+				ctx:       context.Background(),
+				reqReader: strings.NewReader(largeImage),
+				cfg:       contentTypeCfg,
+				db:        db,
+			},
+			fields: fields{
+				Logger: logger,
+				MediaMetadata: &types.MediaMetadata{
+					MediaID:     "1343",
+					UploadName:  "large.webm",
+					ContentType: "video/webm",
+				},
+			},
+			want: requestEntityTooLargeJSONResponse(16),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
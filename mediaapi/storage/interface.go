@@ -30,6 +30,9 @@ type MediaRepository interface {
 	StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error
 	GetMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.MediaMetadata, error)
 	GetMediaMetadataByHash(ctx context.Context, mediaHash types.Base64Hash, mediaOrigin gomatrixserverlib.ServerName) (*types.MediaMetadata, error)
+	// DeleteMediaMetadata removes the metadata about the media and its thumbnails. Media with the
+	// same hash share the same file, so it returns how many media still refer to the file.
+	DeleteMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (remaining int, err error)
 }
 
 type Thumbnails interface {
@@ -68,10 +68,16 @@ const selectThumbnailsSQL = `
 SELECT content_type, file_size_bytes, creation_ts, width, height, resize_method FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2 ORDER BY creation_ts ASC
 `
 
+// Note: this deletes all thumbnails for a media_origin and media_id
+const deleteThumbnailsSQL = `
+DELETE FROM mediaapi_thumbnail WHERE media_id = $1 AND media_origin = $2
+`
+
 type thumbnailStatements struct {
 	insertThumbnailStmt  *sql.Stmt
 	selectThumbnailStmt  *sql.Stmt
 	selectThumbnailsStmt *sql.Stmt
+	deleteThumbnailsStmt *sql.Stmt
 }
 
 func NewPostgresThumbnailsTable(db *sql.DB) (tables.Thumbnails, error) {
@@ -85,6 +91,7 @@ func NewPostgresThumbnailsTable(db *sql.DB) (tables.Thumbnails, error) {
 		{&s.insertThumbnailStmt, insertThumbnailSQL},
 		{&s.selectThumbnailStmt, selectThumbnailSQL},
 		{&s.selectThumbnailsStmt, selectThumbnailsSQL},
+		{&s.deleteThumbnailsStmt, deleteThumbnailsSQL},
 	}.Prepare(db)
 }
 
@@ -175,3 +182,10 @@ func (s *thumbnailStatements) SelectThumbnails(
 
 	return thumbnails, rows.Err()
 }
+
+func (s *thumbnailStatements) DeleteThumbnails(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteThumbnailsStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
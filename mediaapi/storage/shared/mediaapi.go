@@ -61,6 +61,27 @@ func (d Database) GetMediaMetadataByHash(ctx context.Context, mediaHash types.Ba
 	return mediaMetadata, err
 }
 
+// DeleteMediaMetadata removes the metadata about the media and its thumbnails from the database.
+// Media with the same hash are stored in the same file, so this returns the number of media
+// which still refer to the file. The file should only be removed once there are none left.
+func (d Database) DeleteMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (remaining int, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		mediaMetadata, err := d.MediaRepository.SelectMedia(ctx, txn, mediaID, mediaOrigin)
+		if err != nil {
+			return err
+		}
+		if err = d.MediaRepository.DeleteMedia(ctx, txn, mediaID, mediaOrigin); err != nil {
+			return err
+		}
+		if err = d.Thumbnails.DeleteThumbnails(ctx, txn, mediaID, mediaOrigin); err != nil {
+			return err
+		}
+		remaining, err = d.MediaRepository.SelectMediaCountByHash(ctx, txn, mediaMetadata.Base64Hash)
+		return err
+	})
+	return
+}
+
 // StoreThumbnail inserts the metadata about the thumbnail into the database.
 // Returns an error if the combination of MediaID and Origin are not unique in the table.
 func (d Database) StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error {
@@ -65,11 +65,22 @@ const selectMediaByHashSQL = `
 SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
 `
 
+// Note: this counts the media with the hash across all origins, as they are all stored in the same file
+const selectMediaCountByHashSQL = `
+SELECT COUNT(*) FROM mediaapi_media_repository WHERE base64hash = $1
+`
+
+const deleteMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+`
+
 type mediaStatements struct {
-	db                    *sql.DB
-	insertMediaStmt       *sql.Stmt
-	selectMediaStmt       *sql.Stmt
-	selectMediaByHashStmt *sql.Stmt
+	db                         *sql.DB
+	insertMediaStmt            *sql.Stmt
+	selectMediaStmt            *sql.Stmt
+	selectMediaByHashStmt      *sql.Stmt
+	selectMediaCountByHashStmt *sql.Stmt
+	deleteMediaStmt            *sql.Stmt
 }
 
 func NewSQLiteMediaRepositoryTable(db *sql.DB) (tables.MediaRepository, error) {
@@ -85,6 +96,8 @@ func NewSQLiteMediaRepositoryTable(db *sql.DB) (tables.MediaRepository, error) {
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
 		{&s.selectMediaByHashStmt, selectMediaByHashSQL},
+		{&s.selectMediaCountByHashStmt, selectMediaCountByHashSQL},
+		{&s.deleteMediaStmt, deleteMediaSQL},
 	}.Prepare(db)
 }
 
@@ -145,3 +158,19 @@ func (s *mediaStatements) SelectMediaByHash(
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) SelectMediaCountByHash(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (count int, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectMediaCountByHashStmt).QueryRowContext(
+		ctx, mediaHash,
+	).Scan(&count)
+	return
+}
+
+func (s *mediaStatements) DeleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
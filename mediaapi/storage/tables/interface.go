@@ -34,6 +34,7 @@ type Thumbnails interface {
 		ctx context.Context, txn *sql.Tx, mediaID types.MediaID,
 		mediaOrigin gomatrixserverlib.ServerName,
 	) ([]*types.ThumbnailMetadata, error)
+	DeleteThumbnails(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
 }
 
 type MediaRepository interface {
@@ -43,4 +44,6 @@ type MediaRepository interface {
 		ctx context.Context, txn *sql.Tx,
 		mediaHash types.Base64Hash, mediaOrigin gomatrixserverlib.ServerName,
 	) (*types.MediaMetadata, error)
+	SelectMediaCountByHash(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (int, error)
+	DeleteMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) error
 }
@@ -16,6 +16,7 @@ package types
 
 import (
 	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -73,6 +74,16 @@ type ActiveRemoteRequests struct {
 	sync.Mutex
 	// The string key is an mxc:// URL
 	MXCToResult map[string]*RemoteRequestResult
+	// Recent failures to fetch a remote file, keyed by mxc:// URL, so that
+	// repeated requests for it fail without contacting the remote server.
+	MXCToFailure map[string]*RemoteRequestFailure
+}
+
+// RemoteRequestFailure records why a remote file could not be fetched, and
+// until when that should be remembered.
+type RemoteRequestFailure struct {
+	Error   error
+	Expires time.Time
 }
 
 // ThumbnailSize contains a single thumbnail size configuration
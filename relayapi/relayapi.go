@@ -0,0 +1,44 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package relayapi
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/relayapi/routing"
+	"github.com/matrix-org/dendrite/relayapi/storage"
+	"github.com/matrix-org/dendrite/setup/base"
+)
+
+// AddPublicRoutes sets up and registers HTTP handlers for the RelayAPI
+// component. Nothing is registered unless this server is configured to
+// relay for at least one destination.
+func AddPublicRoutes(
+	base *base.BaseDendrite,
+	keyRing gomatrixserverlib.JSONVerifier,
+) {
+	cfg := &base.Cfg.RelayAPI
+	if len(cfg.Destinations) == 0 {
+		return
+	}
+
+	relayDB, err := storage.NewDatabase(base, &cfg.Database)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to connect to relay db")
+	}
+
+	routing.Setup(base.PublicFederationAPIMux, cfg, relayDB, keyRing)
+}
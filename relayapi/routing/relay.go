@@ -0,0 +1,142 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/relayapi/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// RelayTransactionResponse is the response to GET /relay_txn.
+type RelayTransactionResponse struct {
+	// The next queued transaction, or empty if there is nothing queued.
+	Transaction json.RawMessage `json:"transaction,omitempty"`
+	// The ID the origin gave to the transaction.
+	TransactionID gomatrixserverlib.TransactionID `json:"transaction_id,omitempty"`
+	// The entry ID of the transaction, which must be passed back as the
+	// entry_id query parameter on the next request to acknowledge it.
+	EntryID int64 `json:"entry_id"`
+	// Whether there are more transactions queued after this one.
+	EntriesQueued bool `json:"entries_queued"`
+}
+
+// SendTransactionToRelay implements PUT /_matrix/federation/v1/send_relay/{txnID}/{serverName}
+// which stores a transaction for a server that we relay for, until that server
+// comes to collect it.
+func SendTransactionToRelay(
+	httpReq *http.Request,
+	fedReq *gomatrixserverlib.FederationRequest,
+	cfg *config.RelayAPI,
+	db storage.Database,
+	txnID gomatrixserverlib.TransactionID,
+	destination gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	if !cfg.IsDestination(destination) {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("This server does not relay for " + string(destination)),
+		}
+	}
+
+	var txn gomatrixserverlib.Transaction
+	if err := json.Unmarshal(fedReq.Content(), &txn); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	if txn.Origin != fedReq.Origin() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The transaction origin does not match the request origin"),
+		}
+	}
+	// Transactions are limited to 50 PDUs and 100 EDUs, the same as /send.
+	if len(txn.PDUs) > 50 || len(txn.EDUs) > 100 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("max 50 pdus / 100 edus"),
+		}
+	}
+
+	expiresAt := gomatrixserverlib.AsTimestamp(time.Now().Add(cfg.TransactionExpiry))
+	if err := db.StoreTransaction(httpReq.Context(), destination, fedReq.Origin(), txnID, fedReq.Content(), expiresAt); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("db.StoreTransaction failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// GetTransactionFromRelay implements GET /_matrix/federation/v1/relay_txn
+// which the servers we relay for poll to collect their queued transactions,
+// one at a time. Passing the entry_id of the previously collected transaction
+// acknowledges it so that it is removed from the queue.
+func GetTransactionFromRelay(
+	httpReq *http.Request,
+	fedReq *gomatrixserverlib.FederationRequest,
+	cfg *config.RelayAPI,
+	db storage.Database,
+) util.JSONResponse {
+	destination := fedReq.Origin()
+	if !cfg.IsDestination(destination) {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("This server does not relay for " + string(destination)),
+		}
+	}
+
+	var ackEntryID int64
+	if entryID := httpReq.URL.Query().Get("entry_id"); entryID != "" {
+		var err error
+		if ackEntryID, err = strconv.ParseInt(entryID, 10, 64); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("entry_id must be an integer"),
+			}
+		}
+	}
+
+	queued, moreQueued, err := db.GetNextTransaction(httpReq.Context(), destination, ackEntryID)
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("db.GetNextTransaction failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := RelayTransactionResponse{
+		EntriesQueued: moreQueued,
+	}
+	if queued != nil {
+		res.Transaction = queued.JSON
+		res.TransactionID = queued.TransactionID
+		res.EntryID = queued.EntryID
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,93 @@
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/relayapi/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestRelayStoreAndForward(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, close := test.PrepareDBConnectionString(t, dbType)
+		defer close()
+		db, err := storage.NewDatabase(nil, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("failed to open database: %v", err)
+		}
+		cfg := &config.RelayAPI{
+			Matrix:            &config.Global{},
+			Destinations:      []gomatrixserverlib.ServerName{"offline"},
+			TransactionExpiry: time.Hour,
+		}
+		cfg.Matrix.ServerName = "relay"
+
+		txn := gomatrixserverlib.Transaction{
+			TransactionID:  "txn1",
+			Origin:         "sender",
+			Destination:    "offline",
+			OriginServerTS: gomatrixserverlib.AsTimestamp(time.Now()),
+			PDUs:           []json.RawMessage{[]byte(`{"type":"m.room.message"}`)},
+		}
+		send := func(destination gomatrixserverlib.ServerName, txn gomatrixserverlib.Transaction) int {
+			fedReq := gomatrixserverlib.NewFederationRequest(http.MethodPut, "sender", "relay", "/_matrix/federation/v1/send_relay/txn1/"+string(destination))
+			if err = fedReq.SetContent(txn); err != nil {
+				t.Fatalf("failed to set content: %v", err)
+			}
+			req := httptest.NewRequest(http.MethodPut, fedReq.RequestURI(), nil)
+			return SendTransactionToRelay(req, &fedReq, cfg, db, txn.TransactionID, destination).Code
+		}
+		poll := func(origin gomatrixserverlib.ServerName, query string) (int, RelayTransactionResponse) {
+			fedReq := gomatrixserverlib.NewFederationRequest(http.MethodGet, origin, "relay", "/_matrix/federation/v1/relay_txn"+query)
+			req := httptest.NewRequest(http.MethodGet, fedReq.RequestURI(), nil)
+			res := GetTransactionFromRelay(req, &fedReq, cfg, db)
+			body, _ := res.JSON.(RelayTransactionResponse)
+			return res.Code, body
+		}
+
+		if code := send("unknown", txn); code != http.StatusNotFound {
+			t.Fatalf("expected HTTP 404 for a server we don't relay for, got %d", code)
+		}
+		if code := send("offline", txn); code != http.StatusOK {
+			t.Fatalf("expected HTTP 200 storing the transaction, got %d", code)
+		}
+
+		// Only the destination can collect its transactions.
+		if code, _ := poll("sender", ""); code != http.StatusNotFound {
+			t.Fatalf("expected HTTP 404 polling as another server, got %d", code)
+		}
+
+		code, res := poll("offline", "")
+		if code != http.StatusOK {
+			t.Fatalf("expected HTTP 200 polling, got %d", code)
+		}
+		var got gomatrixserverlib.Transaction
+		if err = json.Unmarshal(res.Transaction, &got); err != nil {
+			t.Fatalf("failed to unmarshal transaction: %v", err)
+		}
+		if res.TransactionID != txn.TransactionID || got.Origin != txn.Origin || len(got.PDUs) != 1 {
+			t.Fatalf("unexpected transaction: %s", res.Transaction)
+		}
+		if res.EntriesQueued {
+			t.Fatalf("expected no more entries queued")
+		}
+
+		// Acknowledging the transaction removes it from the queue.
+		code, res = poll("offline", "?entry_id="+strconv.FormatInt(res.EntryID, 10))
+		if code != http.StatusOK {
+			t.Fatalf("expected HTTP 200 polling, got %d", code)
+		}
+		if res.Transaction != nil {
+			t.Fatalf("expected empty queue, got %s", res.Transaction)
+		}
+	})
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/relayapi/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// Setup registers HTTP handlers with the given ServeMux.
+// The provided publicAPIMux MUST have `UseEncodedPath()` enabled or else
+// path unescaping will happen twice.
+func Setup(
+	fedMux *mux.Router,
+	cfg *config.RelayAPI,
+	db storage.Database,
+	keys gomatrixserverlib.JSONVerifier,
+) {
+	v1fedmux := fedMux.PathPrefix("/v1").Subrouter()
+
+	v1fedmux.Handle("/send_relay/{txnID}/{serverName}", makeFedAPI(
+		"relay_send_transaction", cfg.Matrix, keys,
+		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return SendTransactionToRelay(
+				httpReq, request, cfg, db,
+				gomatrixserverlib.TransactionID(vars["txnID"]),
+				gomatrixserverlib.ServerName(vars["serverName"]),
+			)
+		},
+	)).Methods(http.MethodPut, http.MethodOptions)
+
+	v1fedmux.Handle("/relay_txn", makeFedAPI(
+		"relay_get_transaction", cfg.Matrix, keys,
+		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+			return GetTransactionFromRelay(httpReq, request, cfg, db)
+		},
+	)).Methods(http.MethodGet, http.MethodOptions)
+}
+
+// makeFedAPI makes an http.Handler that checks matrix federation authentication.
+func makeFedAPI(
+	metricsName string, cfg *config.Global,
+	keyRing gomatrixserverlib.JSONVerifier,
+	f func(*http.Request, *gomatrixserverlib.FederationRequest, map[string]string) util.JSONResponse,
+) http.Handler {
+	h := func(req *http.Request) util.JSONResponse {
+		fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+			req, time.Now(), cfg.ServerName, cfg.IsLocalServerName, keyRing,
+		)
+		if fedReq == nil {
+			return errResp
+		}
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.MatrixErrorResponse(400, "M_UNRECOGNISED", "badly encoded query params")
+		}
+		return f(req, fedReq, vars)
+	}
+	return httputil.MakeExternalAPI(metricsName, h)
+}
@@ -0,0 +1,39 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/relayapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type Database interface {
+	// StoreTransaction queues a transaction for the destination until it is
+	// collected or expires. Storing the same transaction twice is a no-op.
+	StoreTransaction(
+		ctx context.Context,
+		destination, origin gomatrixserverlib.ServerName, transactionID gomatrixserverlib.TransactionID,
+		transactionJSON []byte, expiresAt gomatrixserverlib.Timestamp,
+	) error
+	// GetNextTransaction acknowledges all transactions for the destination up to
+	// and including ackEntryID and returns the next queued one, along with whether
+	// there are more queued after it. Returns a nil transaction if there is nothing
+	// left in the queue.
+	GetNextTransaction(
+		ctx context.Context, destination gomatrixserverlib.ServerName, ackEntryID int64,
+	) (queued *types.QueuedTransaction, moreQueued bool, err error)
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/relayapi/storage/tables"
+	"github.com/matrix-org/dendrite/relayapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type Database struct {
+	DB         *sql.DB
+	Writer     sqlutil.Writer
+	RelayQueue tables.RelayQueue
+}
+
+func (d *Database) StoreTransaction(
+	ctx context.Context,
+	destination, origin gomatrixserverlib.ServerName, transactionID gomatrixserverlib.TransactionID,
+	transactionJSON []byte, expiresAt gomatrixserverlib.Timestamp,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.RelayQueue.InsertTransaction(ctx, txn, destination, origin, transactionID, transactionJSON, expiresAt)
+	})
+}
+
+func (d *Database) GetNextTransaction(
+	ctx context.Context, destination gomatrixserverlib.ServerName, ackEntryID int64,
+) (queued *types.QueuedTransaction, moreQueued bool, err error) {
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if ackEntryID > 0 {
+			if err = d.RelayQueue.DeleteTransactions(ctx, txn, destination, ackEntryID); err != nil {
+				return err
+			}
+		}
+		if err = d.RelayQueue.DeleteExpiredTransactions(ctx, txn, now); err != nil {
+			return err
+		}
+		queued, err = d.RelayQueue.SelectNextTransaction(ctx, txn, destination, now)
+		if err == sql.ErrNoRows {
+			queued = nil
+			return nil
+		} else if err != nil {
+			return err
+		}
+		count, err := d.RelayQueue.SelectQueuedCount(ctx, txn, destination, queued.EntryID, now)
+		if err != nil {
+			return err
+		}
+		moreQueued = count > 0
+		return nil
+	})
+	return
+}
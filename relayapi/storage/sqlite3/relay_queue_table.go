@@ -0,0 +1,140 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/relayapi/storage/tables"
+	"github.com/matrix-org/dendrite/relayapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const relayQueueSchema = `
+-- The relayapi_queue table holds transactions which are waiting to be collected
+-- by the servers we are relaying for.
+CREATE TABLE IF NOT EXISTS relayapi_queue (
+    entry_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    -- The server the transaction is destined for.
+    destination TEXT NOT NULL,
+    -- The server the transaction was sent from.
+    origin TEXT NOT NULL,
+    transaction_id TEXT NOT NULL,
+    transaction_json TEXT NOT NULL,
+    -- When the transaction will be discarded if it has not been collected.
+    expires_at BIGINT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS relayapi_queue_transaction_idx
+    ON relayapi_queue (destination, origin, transaction_id);
+CREATE INDEX IF NOT EXISTS relayapi_queue_destination_idx
+    ON relayapi_queue (destination, entry_id);
+`
+
+const insertRelayQueueSQL = "" +
+	"INSERT INTO relayapi_queue (destination, origin, transaction_id, transaction_json, expires_at)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectNextRelayQueueSQL = "" +
+	"SELECT entry_id, origin, transaction_id, transaction_json FROM relayapi_queue" +
+	" WHERE destination = $1 AND expires_at > $2" +
+	" ORDER BY entry_id ASC LIMIT 1"
+
+const selectRelayQueueCountSQL = "" +
+	"SELECT COUNT(*) FROM relayapi_queue" +
+	" WHERE destination = $1 AND entry_id > $2 AND expires_at > $3"
+
+const deleteRelayQueueSQL = "" +
+	"DELETE FROM relayapi_queue WHERE destination = $1 AND entry_id <= $2"
+
+const deleteExpiredRelayQueueSQL = "" +
+	"DELETE FROM relayapi_queue WHERE expires_at <= $1"
+
+type relayQueueStatements struct {
+	insertRelayQueueStmt        *sql.Stmt
+	selectNextRelayQueueStmt    *sql.Stmt
+	selectRelayQueueCountStmt   *sql.Stmt
+	deleteRelayQueueStmt        *sql.Stmt
+	deleteExpiredRelayQueueStmt *sql.Stmt
+}
+
+func NewSQLiteRelayQueueTable(db *sql.DB) (tables.RelayQueue, error) {
+	s := &relayQueueStatements{}
+	_, err := db.Exec(relayQueueSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertRelayQueueStmt, insertRelayQueueSQL},
+		{&s.selectNextRelayQueueStmt, selectNextRelayQueueSQL},
+		{&s.selectRelayQueueCountStmt, selectRelayQueueCountSQL},
+		{&s.deleteRelayQueueStmt, deleteRelayQueueSQL},
+		{&s.deleteExpiredRelayQueueStmt, deleteExpiredRelayQueueSQL},
+	}.Prepare(db)
+}
+
+func (s *relayQueueStatements) InsertTransaction(
+	ctx context.Context, txn *sql.Tx,
+	destination, origin gomatrixserverlib.ServerName, transactionID gomatrixserverlib.TransactionID,
+	transactionJSON []byte, expiresAt gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertRelayQueueStmt)
+	_, err := stmt.ExecContext(ctx, destination, origin, transactionID, transactionJSON, expiresAt)
+	return err
+}
+
+func (s *relayQueueStatements) SelectNextTransaction(
+	ctx context.Context, txn *sql.Tx,
+	destination gomatrixserverlib.ServerName, now gomatrixserverlib.Timestamp,
+) (*types.QueuedTransaction, error) {
+	var queued types.QueuedTransaction
+	stmt := sqlutil.TxStmt(txn, s.selectNextRelayQueueStmt)
+	err := stmt.QueryRowContext(ctx, destination, now).Scan(
+		&queued.EntryID, &queued.Origin, &queued.TransactionID, &queued.JSON,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &queued, nil
+}
+
+func (s *relayQueueStatements) SelectQueuedCount(
+	ctx context.Context, txn *sql.Tx,
+	destination gomatrixserverlib.ServerName, afterEntryID int64, now gomatrixserverlib.Timestamp,
+) (count int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRelayQueueCountStmt)
+	err = stmt.QueryRowContext(ctx, destination, afterEntryID, now).Scan(&count)
+	return
+}
+
+func (s *relayQueueStatements) DeleteTransactions(
+	ctx context.Context, txn *sql.Tx,
+	destination gomatrixserverlib.ServerName, upToEntryID int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRelayQueueStmt)
+	_, err := stmt.ExecContext(ctx, destination, upToEntryID)
+	return err
+}
+
+func (s *relayQueueStatements) DeleteExpiredTransactions(
+	ctx context.Context, txn *sql.Tx, now gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteExpiredRelayQueueStmt)
+	_, err := stmt.ExecContext(ctx, now)
+	return err
+}
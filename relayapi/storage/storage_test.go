@@ -0,0 +1,82 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/relayapi/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustCreateDatabase(t *testing.T, dbType test.DBType) (storage.Database, func()) {
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := storage.NewDatabase(nil, &config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	})
+	if err != nil {
+		t.Fatalf("NewDatabase returned %s", err)
+	}
+	return db, close
+}
+
+func TestRelayQueue(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		destination := gomatrixserverlib.ServerName("offline")
+		expiresAt := gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour))
+
+		for _, txnID := range []gomatrixserverlib.TransactionID{"txn1", "txn2", "txn1"} {
+			if err := db.StoreTransaction(ctx, destination, "origin", txnID, []byte(`{"txn":"`+txnID+`"}`), expiresAt); err != nil {
+				t.Fatalf("failed to store transaction: %v", err)
+			}
+		}
+		expired := gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour))
+		if err := db.StoreTransaction(ctx, destination, "origin", "expired", []byte(`{"txn":"expired"}`), expired); err != nil {
+			t.Fatalf("failed to store transaction: %v", err)
+		}
+
+		queued, more, err := db.GetNextTransaction(ctx, destination, 0)
+		if err != nil {
+			t.Fatalf("failed to get transaction: %v", err)
+		}
+		if queued == nil || queued.TransactionID != "txn1" || queued.Origin != "origin" || string(queued.JSON) != `{"txn":"txn1"}` || !more {
+			t.Fatalf("expected txn1 with more queued, got %+v (more queued: %v)", queued, more)
+		}
+
+		// Without acknowledging, we get the same transaction again.
+		again, _, err := db.GetNextTransaction(ctx, destination, 0)
+		if err != nil {
+			t.Fatalf("failed to get transaction: %v", err)
+		}
+		if again == nil || again.EntryID != queued.EntryID {
+			t.Fatalf("expected txn1 again, got %+v", again)
+		}
+
+		// The duplicate txn1 was not stored and the expired one is not returned.
+		queued, more, err = db.GetNextTransaction(ctx, destination, queued.EntryID)
+		if err != nil {
+			t.Fatalf("failed to get transaction: %v", err)
+		}
+		if queued == nil || queued.TransactionID != "txn2" || more {
+			t.Fatalf("expected txn2 with nothing more queued, got %+v (more queued: %v)", queued, more)
+		}
+
+		queued, more, err = db.GetNextTransaction(ctx, destination, queued.EntryID)
+		if err != nil {
+			t.Fatalf("failed to get transaction: %v", err)
+		}
+		if queued != nil || more {
+			t.Fatalf("expected empty queue, got %+v", queued)
+		}
+
+		// Other destinations are unaffected.
+		if queued, _, err = db.GetNextTransaction(ctx, "other", 0); err != nil || queued != nil {
+			t.Fatalf("expected empty queue for other destination, got %+v (err: %v)", queued, err)
+		}
+	})
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tables
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/relayapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// RelayQueue holds the transactions that are waiting to be collected by the
+// servers we relay for.
+type RelayQueue interface {
+	InsertTransaction(
+		ctx context.Context, txn *sql.Tx,
+		destination, origin gomatrixserverlib.ServerName, transactionID gomatrixserverlib.TransactionID,
+		transactionJSON []byte, expiresAt gomatrixserverlib.Timestamp,
+	) error
+	// SelectNextTransaction returns the oldest unexpired transaction for the
+	// destination. Returns sql.ErrNoRows if there is nothing queued.
+	SelectNextTransaction(
+		ctx context.Context, txn *sql.Tx,
+		destination gomatrixserverlib.ServerName, now gomatrixserverlib.Timestamp,
+	) (*types.QueuedTransaction, error)
+	// SelectQueuedCount returns the number of unexpired transactions for the
+	// destination which were queued after the given entry.
+	SelectQueuedCount(
+		ctx context.Context, txn *sql.Tx,
+		destination gomatrixserverlib.ServerName, afterEntryID int64, now gomatrixserverlib.Timestamp,
+	) (int64, error)
+	// DeleteTransactions deletes all transactions for the destination up to
+	// and including the given entry.
+	DeleteTransactions(ctx context.Context, txn *sql.Tx, destination gomatrixserverlib.ServerName, upToEntryID int64) error
+	DeleteExpiredTransactions(ctx context.Context, txn *sql.Tx, now gomatrixserverlib.Timestamp) error
+}
@@ -0,0 +1,28 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "github.com/matrix-org/gomatrixserverlib"
+
+// QueuedTransaction is a transaction which is waiting to be collected by the
+// server it is destined for.
+type QueuedTransaction struct {
+	// The position of the transaction in the relay queue.
+	EntryID       int64
+	Origin        gomatrixserverlib.ServerName
+	TransactionID gomatrixserverlib.TransactionID
+	// The transaction body, as it was sent by the origin.
+	JSON []byte
+}
@@ -157,6 +157,16 @@ func (t *RoomserverInternalAPITrace) PerformAdminDownloadState(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) PerformAdminSetState(
+	ctx context.Context,
+	req *PerformAdminSetStateRequest,
+	res *PerformAdminSetStateResponse,
+) error {
+	err := t.Impl.PerformAdminSetState(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformAdminSetState req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) PerformInboundPeek(
 	ctx context.Context,
 	req *PerformInboundPeekRequest,
@@ -418,6 +428,16 @@ func (t *RoomserverInternalAPITrace) QueryMembershipAtEvent(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) QueryEventByTimestamp(
+	ctx context.Context,
+	request *QueryEventByTimestampRequest,
+	response *QueryEventByTimestampResponse,
+) error {
+	err := t.Impl.QueryEventByTimestamp(ctx, request, response)
+	util.GetLogger(ctx).WithError(err).Infof("QueryEventByTimestamp req=%+v res=%+v", js(request), js(response))
+	return err
+}
+
 func js(thing interface{}) string {
 	b, err := json.Marshal(thing)
 	if err != nil {
@@ -17,6 +17,8 @@ type PerformError struct {
 	Msg        string
 	RemoteCode int // remote HTTP status code, for PerformErrRemote
 	Code       PerformErrorCode
+	// The room which replaced the room, for PerformErrorRoomTombstoned
+	ReplacementRoom string
 }
 
 func (p *PerformError) Error() string {
@@ -46,6 +48,11 @@ func (p *PerformError) JSONResponse() util.JSONResponse {
 			Code: http.StatusForbidden,
 			JSON: jsonerror.Forbidden(p.Msg),
 		}
+	case PerformErrorRoomTombstoned:
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.RoomTombstoned(p.Msg, p.ReplacementRoom),
+		}
 	case PerformErrRemote:
 		// if the code is 0 then something bad happened and it isn't
 		// a remote HTTP error being encapsulated, e.g network error to remote.
@@ -73,6 +80,8 @@ const (
 	PerformErrorNoOperation PerformErrorCode = 4
 	// PerformErrRemote means that the request failed and the PerformError.Msg is the raw remote JSON error response
 	PerformErrRemote PerformErrorCode = 5
+	// PerformErrorRoomTombstoned means that the room has been replaced by PerformError.ReplacementRoom.
+	PerformErrorRoomTombstoned PerformErrorCode = 6
 )
 
 type PerformJoinRequest struct {
@@ -243,10 +252,24 @@ type PerformAdminEvacuateUserResponse struct {
 
 type PerformAdminPurgeRoomRequest struct {
 	RoomID string `json:"room_id"`
+	// If set, only report what would be purged without deleting anything.
+	DryRun bool `json:"dry_run,omitempty"`
 }
 
 type PerformAdminPurgeRoomResponse struct {
-	Error *PerformError `json:"error,omitempty"`
+	Error  *PerformError    `json:"error,omitempty"`
+	Report *PurgeRoomReport `json:"report,omitempty"`
+}
+
+// PurgeRoomReport describes the impact of purging a room.
+type PurgeRoomReport struct {
+	Events         int64 `json:"events"`
+	StateEvents    int64 `json:"state_events"`
+	StateSnapshots int64 `json:"state_snapshots"`
+	// MediaEvents is the number of events which reference media.
+	MediaEvents int64 `json:"media_events"`
+	// LocalUsers are the local users currently joined to the room.
+	LocalUsers []string `json:"local_users"`
 }
 
 type PerformAdminDownloadStateRequest struct {
@@ -258,3 +281,22 @@ type PerformAdminDownloadStateRequest struct {
 type PerformAdminDownloadStateResponse struct {
 	Error *PerformError `json:"error,omitempty"`
 }
+
+// PerformAdminSetStateRequest is a request to force-set a state event in a
+// room, e.g. to clear a malicious room name, on behalf of an admin.
+type PerformAdminSetStateRequest struct {
+	RoomID string `json:"room_id"`
+	// The admin requesting the change, for the audit log
+	UserID    string          `json:"user_id"`
+	EventType string          `json:"event_type"`
+	StateKey  string          `json:"state_key"`
+	Content   json.RawMessage `json:"content"`
+}
+
+type PerformAdminSetStateResponse struct {
+	Error *PerformError `json:"error,omitempty"`
+	// The ID of the new state event
+	EventID string `json:"event_id"`
+	// The local user the state event was sent as
+	Sender string `json:"sender"`
+}
@@ -353,6 +353,21 @@ type QueryServerBannedFromRoomResponse struct {
 	Banned bool `json:"banned"`
 }
 
+// QueryEventByTimestampRequest is a request to QueryEventByTimestamp
+type QueryEventByTimestampRequest struct {
+	RoomID    string                      `json:"room_id"`
+	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
+	// Whether to look for the closest event before the timestamp rather than after it
+	Backwards bool `json:"backwards"`
+}
+
+// QueryEventByTimestampResponse is a response to QueryEventByTimestamp
+type QueryEventByTimestampResponse struct {
+	// The ID of the closest event, or empty if there is no event in that direction
+	EventID        string                      `json:"event_id"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
 type QueryRestrictedJoinAllowedRequest struct {
 	UserID string `json:"user_id"`
 	RoomID string `json:"room_id"`
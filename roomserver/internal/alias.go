@@ -159,17 +159,10 @@ func (r *RoomserverInternalAPI) RemoveRoomAlias(
 	}
 
 	if creatorID != request.UserID {
-		var plEvent *gomatrixserverlib.HeaderedEvent
 		var pls *gomatrixserverlib.PowerLevelContent
-
-		plEvent, err = r.DB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomPowerLevels, "")
-		if err != nil {
-			return fmt.Errorf("r.DB.GetStateEvent: %w", err)
-		}
-
-		pls, err = plEvent.PowerLevels()
+		pls, err = helpers.PowerLevels(ctx, r.DB, roomID)
 		if err != nil {
-			return fmt.Errorf("plEvent.PowerLevels: %w", err)
+			return fmt.Errorf("helpers.PowerLevels: %w", err)
 		}
 
 		if pls.UserLevel(request.UserID) < pls.EventLevel(gomatrixserverlib.MRoomCanonicalAlias, true) {
@@ -127,6 +127,13 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		ACLs:                r.ServerACLs,
 		Queryer:             r.Queryer,
 	}
+	if r.Cfg.StateCompression.Enabled {
+		// State compression runs in the input workers, so can only be
+		// registered once the inputer exists.
+		if err = r.Base.BackgroundUpdates.Register(r.stateCompressionUpdate()); err != nil {
+			logrus.WithError(err).Error("Failed to register state compression")
+		}
+	}
 	r.Inviter = &perform.Inviter{
 		DB:      r.DB,
 		Cfg:     r.Cfg,
@@ -11,6 +11,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/roomserver/state"
@@ -96,6 +97,22 @@ func IsServerCurrentlyInRoom(ctx context.Context, db storage.Database, serverNam
 	return auth.IsAnyUserOnServerWithMembership(serverName, gmslEvents, gomatrixserverlib.Join), nil
 }
 
+// PowerLevels returns the current power levels of a room. If the room has no
+// m.room.power_levels event then the defaults from the auth rules are used.
+func PowerLevels(ctx context.Context, db storage.Database, roomID string) (*gomatrixserverlib.PowerLevelContent, error) {
+	var events [2]*gomatrixserverlib.Event
+	for i, evType := range []string{gomatrixserverlib.MRoomCreate, gomatrixserverlib.MRoomPowerLevels} {
+		ev, err := db.GetStateEvent(ctx, roomID, evType, "")
+		if err != nil {
+			return nil, fmt.Errorf("db.GetStateEvent: %w", err)
+		}
+		if ev != nil {
+			events[i] = ev.Event
+		}
+	}
+	return eventutil.PowerLevelsFromState(events[0], events[1])
+}
+
 func IsInvitePending(
 	ctx context.Context, db storage.Database,
 	roomID, userID string,
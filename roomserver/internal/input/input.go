@@ -28,11 +28,13 @@ import (
 	"github.com/Arceliar/phony"
 	"github.com/getsentry/sentry-go"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
 	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
 	fedapi "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
@@ -170,6 +172,17 @@ func (r *Inputer) startWorkerForRoom(roomID string) {
 	}
 }
 
+// RunInRoomWorker runs f in the worker for the room, waiting for it to
+// return. No events are processed for the room while f runs, so it can
+// safely change how the state of the room is stored.
+func (r *Inputer) RunInRoomWorker(roomID string, f func()) {
+	v, _ := r.workers.LoadOrStore(roomID, &worker{
+		r:      r,
+		roomID: roomID,
+	})
+	phony.Block(v.(*worker), f)
+}
+
 // Start creates an ephemeral non-durable consumer on the roomserver
 // input topic. It is configured to deliver us headers only because we
 // don't actually care about the contents of the message at this point,
@@ -282,15 +295,24 @@ func (w *worker) _next() {
 	// a string, because we might want to return that to the caller if
 	// it was a synchronous request.
 	var errString string
+	var rejected bool
+	processCtx := w.r.ProcessContext.Context()
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	if requestID := msg.Header.Get(jetstream.RequestID); requestID != "" {
+		// Log with the ID of the request which sent the event, if any.
+		logger = logger.WithField("req.id", requestID)
+		processCtx = util.ContextWithLogger(httputil.ContextWithRequestID(processCtx, requestID), logger)
+	}
 	if err = w.r.processRoomEvent(
-		w.r.ProcessContext.Context(),
+		processCtx,
 		gomatrixserverlib.ServerName(msg.Header.Get("virtual_host")),
 		&inputRoomEvent,
 	); err != nil {
 		switch err.(type) {
 		case types.RejectedError:
+			rejected = true
 			// Don't send events that were rejected to Sentry
-			logrus.WithError(err).WithFields(logrus.Fields{
+			logger.WithError(err).WithFields(logrus.Fields{
 				"room_id":  w.roomID,
 				"event_id": inputRoomEvent.Event.EventID(),
 				"type":     inputRoomEvent.Event.Type(),
@@ -299,7 +321,7 @@ func (w *worker) _next() {
 			if !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
 				sentry.CaptureException(err)
 			}
-			logrus.WithError(err).WithFields(logrus.Fields{
+			logger.WithError(err).WithFields(logrus.Fields{
 				"room_id":  w.roomID,
 				"event_id": inputRoomEvent.Event.EventID(),
 				"type":     inputRoomEvent.Event.Type(),
@@ -316,9 +338,19 @@ func (w *worker) _next() {
 	// waiting for a response. The temporary inbox name is present in
 	// that field, so send back the error string (if any). If there
 	// was no error then we'll return a blank message, which means
-	// that everything was OK.
+	// that everything was OK. If the event was rejected then we'll
+	// say so in a header, so that the caller can tell that apart from
+	// a failure to process the event.
 	if replyTo := msg.Header.Get("sync"); replyTo != "" {
-		if err = w.r.NATSClient.Publish(replyTo, []byte(errString)); err != nil {
+		reply := &nats.Msg{
+			Subject: replyTo,
+			Data:    []byte(errString),
+			Header:  nats.Header{},
+		}
+		if rejected {
+			reply.Header.Set(replyRejectedHeader, "true")
+		}
+		if err = w.r.NATSClient.PublishMsg(reply); err != nil {
 			logrus.WithError(err).WithFields(logrus.Fields{
 				"room_id":  w.roomID,
 				"event_id": inputRoomEvent.Event.EventID(),
@@ -328,6 +360,10 @@ func (w *worker) _next() {
 	}
 }
 
+// replyRejectedHeader is set on the reply to a synchronous input request
+// if the event was rejected, e.g. because it failed auth checks.
+const replyRejectedHeader = "rejected"
+
 // queueInputRoomEvents queues events into the roomserver input
 // stream in NATS.
 func (r *Inputer) queueInputRoomEvents(
@@ -367,6 +403,9 @@ func (r *Inputer) queueInputRoomEvents(
 			msg.Header.Set("sync", replyTo)
 		}
 		msg.Header.Set("virtual_host", string(request.VirtualHost))
+		if requestID := httputil.RequestIDFromContext(ctx); requestID != "" {
+			msg.Header.Set(jetstream.RequestID, requestID)
+		}
 		msg.Data, err = json.Marshal(e)
 		if err != nil {
 			return nil, fmt.Errorf("json.Marshal: %w", err)
@@ -415,6 +454,7 @@ func (r *Inputer) InputRoomEvents(
 		}
 		if len(msg.Data) > 0 {
 			response.ErrMsg = string(msg.Data)
+			response.NotAllowed = msg.Header.Get(replyRejectedHeader) != ""
 		}
 	}
 
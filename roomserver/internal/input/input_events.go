@@ -131,6 +131,17 @@ func (r *Inputer) processRoomEvent(
 		return fmt.Errorf("event has invalid sender %q", input.Event.Sender())
 	}
 
+	// Reject new local events which reference too much of the event graph.
+	// Events received over federation are checked when the transaction
+	// arrives, while outliers, backfilled and old events are part of the
+	// room's history already and so must be accepted as they are.
+	if input.Kind == api.KindNew && r.Cfg.Matrix.IsLocalServerName(senderDomain) {
+		if err = eventutil.CheckEventLimits(event, &r.Cfg.Matrix.EventLimits); err != nil {
+			logger.WithError(err).Warn("Event exceeds limits, rejecting")
+			return types.RejectedError(err.Error())
+		}
+	}
+
 	// If we already know about this outlier and it hasn't been rejected
 	// then we won't attempt to reprocess it. If it was rejected or has now
 	// arrived as a different kind of event, then we can attempt to reprocess,
@@ -308,12 +319,13 @@ func (r *Inputer) processRoomEvent(
 	}
 
 	var softfail bool
+	var softfailErr error
 	if input.Kind == api.KindNew {
 		// Check that the event passes authentication checks based on the
 		// current room state.
-		softfail, err = helpers.CheckForSoftFail(ctx, r.DB, headered, input.StateEventIDs)
-		if err != nil {
-			logger.WithError(err).Warn("Error authing soft-failed event")
+		softfail, softfailErr = helpers.CheckForSoftFail(ctx, r.DB, headered, input.StateEventIDs)
+		if softfailErr != nil {
+			logger.WithError(softfailErr).Warn("Error authing soft-failed event")
 		}
 	}
 
@@ -385,6 +397,12 @@ func (r *Inputer) processRoomEvent(
 
 	case softfail:
 		logger.WithError(rejectionErr).Warn("Stored soft-failed event")
+		if rejectionErr == nil {
+			// Tell a synchronous caller why the event was soft-failed, so
+			// that e.g. a client finds out that it isn't allowed to send it
+			// any more, rather than thinking that it was sent.
+			rejectionErr = softfailErr
+		}
 		if rejectionErr != nil {
 			return types.RejectedError(rejectionErr.Error())
 		}
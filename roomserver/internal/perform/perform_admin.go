@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/eventutil"
@@ -257,6 +258,19 @@ func (r *Admin) PerformAdminPurgeRoom(
 		return nil
 	}
 
+	if req.DryRun {
+		report, err := r.purgeRoomReport(ctx, req.RoomID)
+		if err != nil {
+			res.Error = &api.PerformError{
+				Code: api.PerformErrorBadRequest,
+				Msg:  err.Error(),
+			}
+			return nil
+		}
+		res.Report = report
+		return nil
+	}
+
 	logrus.WithField("room_id", req.RoomID).Warn("Purging room from roomserver")
 	if err := r.DB.PurgeRoom(ctx, req.RoomID); err != nil {
 		logrus.WithField("room_id", req.RoomID).WithError(err).Warn("Failed to purge room from roomserver")
@@ -279,6 +293,43 @@ func (r *Admin) PerformAdminPurgeRoom(
 	})
 }
 
+// purgeRoomReport works out how much data purging the room would remove and
+// which local users would be affected, without modifying anything.
+func (r *Admin) purgeRoomReport(ctx context.Context, roomID string) (*api.PurgeRoomReport, error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if roomInfo == nil {
+		return nil, fmt.Errorf("room %s does not exist", roomID)
+	}
+	counts, err := r.DB.PurgeRoomCounts(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.PurgeRoomCounts: %w", err)
+	}
+	memberNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, true)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
+	}
+	memberEvents, err := r.DB.Events(ctx, memberNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.Events: %w", err)
+	}
+	report := &api.PurgeRoomReport{
+		Events:         counts.Events,
+		StateEvents:    counts.StateEvents,
+		StateSnapshots: counts.StateSnapshots,
+		MediaEvents:    counts.MediaEvents,
+		LocalUsers:     make([]string, 0, len(memberEvents)),
+	}
+	for _, ev := range memberEvents {
+		if ev.StateKey() != nil {
+			report.LocalUsers = append(report.LocalUsers, *ev.StateKey())
+		}
+	}
+	return report, nil
+}
+
 func (r *Admin) PerformAdminDownloadState(
 	ctx context.Context,
 	req *api.PerformAdminDownloadStateRequest,
@@ -434,3 +485,162 @@ func (r *Admin) PerformAdminDownloadState(
 
 	return nil
 }
+
+// PerformAdminSetState sends a state event into a room on behalf of an admin,
+// e.g. to clear a malicious room name. The admin usually isn't in the room, so
+// the event is sent as the local member with the highest power level, which
+// must be allowed to send it by the room's power levels.
+func (r *Admin) PerformAdminSetState(
+	ctx context.Context,
+	req *api.PerformAdminSetStateRequest,
+	res *api.PerformAdminSetStateResponse,
+) error {
+	roomInfo, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("r.DB.RoomInfo: %s", err),
+		}
+		return nil
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room %s not found", req.RoomID),
+		}
+		return nil
+	}
+
+	latestRes := &api.QueryLatestEventsAndStateResponse{}
+	if err = r.Queryer.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+		RoomID: req.RoomID,
+	}, latestRes); err != nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("r.Queryer.QueryLatestEventsAndState: %s", err),
+		}
+		return nil
+	}
+
+	var create, powerLevels *gomatrixserverlib.Event
+	var localMembers []string
+	for _, ev := range latestRes.StateEvents {
+		switch {
+		case ev.Type() == gomatrixserverlib.MRoomCreate && ev.StateKeyEquals(""):
+			create = ev.Event
+		case ev.Type() == gomatrixserverlib.MRoomPowerLevels && ev.StateKeyEquals(""):
+			powerLevels = ev.Event
+		case ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKey() != nil:
+			membership, err := ev.Membership()
+			if err != nil || membership != gomatrixserverlib.Join {
+				continue
+			}
+			_, domain, err := gomatrixserverlib.SplitID('@', *ev.StateKey())
+			if err != nil || !r.Cfg.Matrix.IsLocalServerName(domain) {
+				continue
+			}
+			localMembers = append(localMembers, *ev.StateKey())
+		}
+	}
+	pl, err := eventutil.PowerLevelsFromState(create, powerLevels)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("eventutil.PowerLevelsFromState: %s", err),
+		}
+		return nil
+	}
+
+	// Pick the most powerful local member, preferring the lowest user ID so
+	// that the choice is stable.
+	sort.Strings(localMembers)
+	sender := ""
+	for _, userID := range localMembers {
+		if sender == "" || pl.UserLevel(userID) > pl.UserLevel(sender) {
+			sender = userID
+		}
+	}
+	if sender == "" || pl.UserLevel(sender) < pl.EventLevel(req.EventType, true) {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("No local user in room %s has enough power to send %s", req.RoomID, req.EventType),
+		}
+		return nil
+	}
+	_, senderDomain, err := gomatrixserverlib.SplitID('@', sender)
+	if err != nil {
+		return err
+	}
+	identity, err := r.Cfg.Matrix.SigningIdentityFor(senderDomain)
+	if err != nil {
+		return err
+	}
+
+	stateKey := req.StateKey
+	builder := &gomatrixserverlib.EventBuilder{
+		RoomID:   req.RoomID,
+		Type:     req.EventType,
+		StateKey: &stateKey,
+		Sender:   sender,
+		Content:  gomatrixserverlib.RawJSON(req.Content),
+	}
+	eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(builder)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("gomatrixserverlib.StateNeededForEventBuilder: %s", err),
+		}
+		return nil
+	}
+	ev, err := eventutil.BuildEvent(ctx, builder, r.Cfg.Matrix, identity, time.Now(), &eventsNeeded, latestRes)
+	if err != nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("eventutil.BuildEvent: %s", err),
+		}
+		return nil
+	}
+
+	inputReq := &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{
+			{
+				Kind:         api.KindNew,
+				Event:        ev,
+				Origin:       senderDomain,
+				SendAsServer: string(senderDomain),
+			},
+		},
+		Asynchronous: false,
+	}
+	inputRes := &api.InputRoomEventsResponse{}
+	if err = r.Inputer.InputRoomEvents(ctx, inputReq, inputRes); err != nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("r.Inputer.InputRoomEvents: %s", err),
+		}
+		return nil
+	}
+	if inputRes.ErrMsg != "" {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  inputRes.ErrMsg,
+		}
+		if inputRes.NotAllowed {
+			res.Error.Code = api.PerformErrorNotAllowed
+		}
+		return nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"admin":      req.UserID,
+		"room_id":    req.RoomID,
+		"event_type": req.EventType,
+		"state_key":  req.StateKey,
+		"sender":     sender,
+		"event_id":   ev.EventID(),
+	}).Warn("Admin force-set room state")
+
+	res.EventID = ev.EventID()
+	res.Sender = sender
+	return nil
+}
@@ -16,6 +16,7 @@ package perform
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
 	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
@@ -139,8 +140,9 @@ func (r *Inviter) PerformInvite(
 	}
 
 	var isAlreadyJoined bool
+	var membershipEventNID types.EventNID
 	if info != nil {
-		_, isAlreadyJoined, _, err = r.DB.GetMembership(ctx, info.RoomNID, *event.StateKey())
+		membershipEventNID, isAlreadyJoined, _, err = r.DB.GetMembership(ctx, info.RoomNID, *event.StateKey())
 		if err != nil {
 			return nil, fmt.Errorf("r.DB.GetMembership: %w", err)
 		}
@@ -190,6 +192,21 @@ func (r *Inviter) PerformInvite(
 		return updateMembershipTableManually()
 	}
 
+	// If the user has already been invited by the same user for the same
+	// reason, then there's nothing to do: re-inviting them should succeed
+	// without sending another invite. If they have since left the room, or
+	// the invite differs, it replaces their current membership as normal.
+	if membershipEventNID != 0 {
+		var isDuplicate bool
+		if isDuplicate, err = r.isDuplicateInvite(ctx, membershipEventNID, event); err != nil {
+			return nil, fmt.Errorf("r.isDuplicateInvite: %w", err)
+		}
+		if isDuplicate {
+			logger.Debugf("user already has an identical pending invite")
+			return nil, nil
+		}
+	}
+
 	// The invite originated locally. Therefore we have a responsibility to
 	// try and see if the user is allowed to make this invite. We can't do
 	// this for invites coming in over federation - we have to take those on
@@ -261,6 +278,31 @@ func (r *Inviter) PerformInvite(
 	return outputUpdates, nil
 }
 
+// isDuplicateInvite returns whether the current membership event of the
+// invite's target is an invite from the same sender with the same content
+// as far as the invite itself is concerned.
+func (r *Inviter) isDuplicateInvite(
+	ctx context.Context, membershipEventNID types.EventNID, event *gomatrixserverlib.HeaderedEvent,
+) (bool, error) {
+	events, err := r.DB.Events(ctx, []types.EventNID{membershipEventNID})
+	if err != nil {
+		return false, fmt.Errorf("r.DB.Events: %w", err)
+	}
+	if len(events) != 1 || events[0].Sender() != event.Sender() {
+		return false, nil
+	}
+	var current, invite gomatrixserverlib.MemberContent
+	if err = json.Unmarshal(events[0].Content(), &current); err != nil {
+		return false, nil
+	}
+	if err = json.Unmarshal(event.Content(), &invite); err != nil {
+		return false, nil
+	}
+	return current.Membership == gomatrixserverlib.Invite &&
+		current.Reason == invite.Reason &&
+		current.IsDirect == invite.IsDirect, nil
+}
+
 func buildInviteStrippedState(
 	ctx context.Context,
 	db storage.Database,
@@ -179,6 +179,12 @@ func (r *Joiner) performJoinRoomByID(
 		}
 	}
 
+	// The room may have been replaced by another one, in which case we might
+	// refuse the join or join the replacement room instead.
+	if err := r.handleTombstonedRoom(ctx, req); err != nil {
+		return "", "", err
+	}
+
 	// Get the domain part of the room ID.
 	_, domain, err := gomatrixserverlib.SplitID('!', req.RoomIDOrAlias)
 	if err != nil {
@@ -380,6 +386,82 @@ func (r *Joiner) performJoinRoomByID(
 	return req.RoomIDOrAlias, userDomain, nil
 }
 
+// maxTombstoneHops limits how many replacement rooms are followed, in case
+// tombstones point at each other.
+const maxTombstoneHops = 10
+
+// handleTombstonedRoom applies the configured behaviour for joining a room
+// which has an m.room.tombstone event. When following tombstones, the request
+// is updated to join the replacement room.
+func (r *Joiner) handleTombstonedRoom(ctx context.Context, req *rsAPI.PerformJoinRequest) error {
+	follow := r.Cfg.TombstonedRoomJoins == config.TombstonedRoomJoinsFollow
+	if !follow && r.Cfg.TombstonedRoomJoins != config.TombstonedRoomJoinsReject {
+		return nil
+	}
+	for hops := 0; hops < maxTombstoneHops; hops++ {
+		replacement, via, err := r.tombstoneReplacement(ctx, req.RoomIDOrAlias, req.UserID)
+		if err != nil || replacement == "" {
+			return err
+		}
+		if !follow {
+			return &rsAPI.PerformError{
+				Code:            rsAPI.PerformErrorRoomTombstoned,
+				Msg:             fmt.Sprintf("Room %q has been replaced by %q", req.RoomIDOrAlias, replacement),
+				ReplacementRoom: replacement,
+			}
+		}
+		logrus.WithContext(ctx).WithFields(logrus.Fields{
+			"room_id":          req.RoomIDOrAlias,
+			"replacement_room": replacement,
+		}).Info("Joining replacement of tombstoned room")
+		req.RoomIDOrAlias = replacement
+		if via != "" && !r.Cfg.Matrix.IsLocalServerName(via) {
+			req.ServerNames = append(req.ServerNames, via)
+		}
+	}
+	return nil
+}
+
+// tombstoneReplacement returns the room which replaced the given room, and
+// the server which sent the tombstone, if the room has been replaced and the
+// user isn't already in it.
+func (r *Joiner) tombstoneReplacement(
+	ctx context.Context, roomID, userID string,
+) (string, gomatrixserverlib.ServerName, error) {
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return "", "", fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub() {
+		return "", "", nil
+	}
+	tombstone, err := r.DB.GetStateEvent(ctx, roomID, "m.room.tombstone", "")
+	if err != nil {
+		return "", "", fmt.Errorf("r.DB.GetStateEvent: %w", err)
+	}
+	if tombstone == nil {
+		return "", "", nil
+	}
+	replacement := gjson.GetBytes(tombstone.Content(), "replacement_room").Str
+	if replacement == "" || replacement == roomID {
+		return "", "", nil
+	}
+	// Users who are already in the room can still rejoin it, e.g. to update
+	// their profile.
+	membershipRes := &api.QueryMembershipForUserResponse{}
+	if err = r.Queryer.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: userID,
+	}, membershipRes); err != nil {
+		return "", "", fmt.Errorf("r.Queryer.QueryMembershipForUser: %w", err)
+	}
+	if membershipRes.IsInRoom {
+		return "", "", nil
+	}
+	_, via, _ := gomatrixserverlib.SplitID('@', tombstone.Sender())
+	return replacement, via, nil
+}
+
 func (r *Joiner) performFederatedJoinRoomByID(
 	ctx context.Context,
 	req *rsAPI.PerformJoinRequest,
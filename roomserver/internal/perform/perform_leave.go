@@ -30,6 +30,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/internal/input"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 )
@@ -142,8 +143,34 @@ func (r *Leaver) performLeaveRoomByID(
 	if err != nil {
 		return nil, fmt.Errorf("error getting membership: %w", err)
 	}
-	if membership != gomatrixserverlib.Join && membership != gomatrixserverlib.Invite {
-		return nil, fmt.Errorf("user %q is not joined to the room (membership is %q)", req.UserID, membership)
+	// The same leave event covers leaving the room, rejecting an invite from
+	// a local user (remote invites were handled above) and retracting a knock.
+	// Rejected invites are retired by the membership update when the event is
+	// processed, so that the sync API hears about it.
+	logger := util.GetLogger(ctx).WithField("room_id", req.RoomID)
+	switch membership {
+	case gomatrixserverlib.Join:
+		logger.Debug("Leaving room")
+	case gomatrixserverlib.Invite:
+		logger.Debug("Rejecting invite from local user")
+	case gomatrixserverlib.Knock:
+		// If none of our users are joined to the room then we can't build
+		// a leave event which other servers will accept, so ask one of the
+		// servers in the room to do it for us instead.
+		info, err := r.DB.RoomInfo(ctx, req.RoomID)
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.RoomInfo: %w", err)
+		}
+		inRoom, err := r.DB.GetLocalServerInRoom(ctx, info.RoomNID)
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.GetLocalServerInRoom: %w", err)
+		}
+		if !inRoom {
+			return r.performFederatedRetractKnock(ctx, req, info)
+		}
+		logger.Debug("Retracting knock")
+	default:
+		return nil, fmt.Errorf("user %q is not joined to, invited to or knocking on the room (membership is %q)", req.UserID, membership)
 	}
 
 	// Prepare the template for the leave event.
@@ -201,6 +228,67 @@ func (r *Leaver) performLeaveRoomByID(
 	return nil, nil
 }
 
+func (r *Leaver) performFederatedRetractKnock(
+	ctx context.Context,
+	req *api.PerformLeaveRequest,
+	info *types.RoomInfo,
+) ([]api.OutputEvent, error) {
+	// Work out which servers we last knew to be in the room, including the
+	// one which created it, to make_leave and send_leave through.
+	var serverNames []gomatrixserverlib.ServerName
+	if _, domain, err := gomatrixserverlib.SplitID('!', req.RoomID); err == nil && !r.Cfg.Matrix.IsLocalServerName(domain) {
+		serverNames = append(serverNames, domain)
+	}
+	eventNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, true, false)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
+	}
+	events, err := r.DB.Events(ctx, eventNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.Events: %w", err)
+	}
+	for _, event := range events {
+		if event.StateKey() == nil {
+			continue
+		}
+		_, domain, err := gomatrixserverlib.SplitID('@', *event.StateKey())
+		if err == nil && !r.Cfg.Matrix.IsLocalServerName(domain) {
+			serverNames = append(serverNames, domain)
+		}
+	}
+	if len(serverNames) == 0 {
+		return nil, fmt.Errorf("no servers to retract the knock on room %q through", req.RoomID)
+	}
+
+	// Ask the federation sender to perform a federated leave for us.
+	leaveReq := fsAPI.PerformLeaveRequest{
+		RoomID:      req.RoomID,
+		UserID:      req.UserID,
+		ServerNames: serverNames,
+	}
+	leaveRes := fsAPI.PerformLeaveResponse{}
+	if err = r.FSAPI.PerformLeave(ctx, &leaveReq, &leaveRes); err != nil {
+		return nil, fmt.Errorf("r.FSAPI.PerformLeave: %w", err)
+	}
+
+	// As we aren't in the room, we won't receive the leave event back over
+	// federation, so forget about the knock ourselves.
+	updater, err := r.DB.MembershipUpdater(ctx, req.RoomID, req.UserID, true, info.RoomVersion)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.MembershipUpdater: %w", err)
+	}
+	if err = updater.Delete(); err != nil {
+		if rerr := updater.Rollback(); rerr != nil {
+			util.GetLogger(ctx).WithError(rerr).Errorf("failed to rollback deleting membership")
+		}
+		return nil, fmt.Errorf("updater.Delete: %w", err)
+	}
+	if err = updater.Commit(); err != nil {
+		return nil, fmt.Errorf("updater.Commit: %w", err)
+	}
+	return nil, nil
+}
+
 func (r *Leaver) performFederatedRejectInvite(
 	ctx context.Context,
 	req *api.PerformLeaveRequest,
@@ -147,11 +147,7 @@ func (r *Upgrader) performRoomUpgrade(
 }
 
 func (r *Upgrader) getRoomPowerLevels(ctx context.Context, roomID string) (*gomatrixserverlib.PowerLevelContent, *api.PerformError) {
-	oldPowerLevelsEvent := api.GetStateEvent(ctx, r.URSAPI, roomID, gomatrixserverlib.StateKeyTuple{
-		EventType: gomatrixserverlib.MRoomPowerLevels,
-		StateKey:  "",
-	})
-	powerLevelContent, err := oldPowerLevelsEvent.PowerLevels()
+	powerLevelContent, err := eventutil.GetPowerLevels(ctx, r.URSAPI, roomID)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error()
 		return nil, &api.PerformError{
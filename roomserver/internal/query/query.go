@@ -849,6 +849,24 @@ func (r *Queryer) QueryServerBannedFromRoom(ctx context.Context, req *api.QueryS
 	return nil
 }
 
+// QueryEventByTimestamp looks up the event sent closest to the given timestamp
+// in the given direction. If the room or a matching event isn't known then the
+// response is left empty.
+func (r *Queryer) QueryEventByTimestamp(ctx context.Context, req *api.QueryEventByTimestampRequest, res *api.QueryEventByTimestampResponse) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if info == nil || info.IsStub() {
+		return nil
+	}
+	res.EventID, res.OriginServerTS, err = r.DB.EventIDByTimestamp(ctx, info.RoomNID, req.Timestamp, req.Backwards)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	return err
+}
+
 func (r *Queryer) QueryAuthChain(ctx context.Context, req *api.QueryAuthChainRequest, res *api.QueryAuthChainResponse) error {
 	chain, err := GetAuthChain(ctx, r.DB.EventsFromIDs, req.EventIDs)
 	if err != nil {
@@ -902,6 +920,17 @@ func (r *Queryer) QueryRestrictedJoinAllowed(ctx context.Context, req *api.Query
 	if !res.Restricted {
 		return nil
 	}
+	// If the user is banned from the room then the allow rules can't be
+	// used to let them back in, regardless of which rooms they are in.
+	memberEvent, err := r.DB.GetStateEvent(ctx, req.RoomID, gomatrixserverlib.MRoomMember, req.UserID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetStateEvent: %w", err)
+	}
+	if memberEvent != nil {
+		if membership, merr := memberEvent.Membership(); merr == nil && membership == gomatrixserverlib.Ban {
+			return nil
+		}
+	}
 	// If the user is already invited to the room then the join is allowed
 	// but we don't specify an authorised via user, since the event auth
 	// will allow the join anyway.
@@ -915,13 +944,9 @@ func (r *Queryer) QueryRestrictedJoinAllowed(ctx context.Context, req *api.Query
 	// We need to get the power levels content so that we can determine which
 	// users in the room are entitled to issue invites. We need to use one of
 	// these users as the authorising user.
-	powerLevelsEvent, err := r.DB.GetStateEvent(ctx, req.RoomID, gomatrixserverlib.MRoomPowerLevels, "")
+	powerLevels, err := helpers.PowerLevels(ctx, r.DB, req.RoomID)
 	if err != nil {
-		return fmt.Errorf("r.DB.GetStateEvent: %w", err)
-	}
-	var powerLevels gomatrixserverlib.PowerLevelContent
-	if err = json.Unmarshal(powerLevelsEvent.Content(), &powerLevels); err != nil {
-		return fmt.Errorf("json.Unmarshal: %w", err)
+		return fmt.Errorf("helpers.PowerLevels: %w", err)
 	}
 	// Step through the join rules and see if the user matches any of them.
 	for _, rule := range joinRules.Allow {
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// stateCompressionUpdateName is the name of the background update which
+// compresses room state.
+const stateCompressionUpdateName = "roomserver_state_compression"
+
+// stateCompressionUpdate returns a background update which compresses the
+// state of every room, one room per batch.
+func (r *RoomserverInternalAPI) stateCompressionUpdate() sqlutil.BackgroundUpdate {
+	var roomIDs []string
+	var started bool
+	return sqlutil.BackgroundUpdate{
+		Name: stateCompressionUpdateName,
+		Total: func(ctx context.Context) (int64, error) {
+			rooms, err := r.DB.GetKnownRooms(ctx)
+			return int64(len(rooms)), err
+		},
+		Batch: func(ctx context.Context) (int64, bool, error) {
+			if !started {
+				var err error
+				if roomIDs, err = r.DB.GetKnownRooms(ctx); err != nil {
+					return 0, false, fmt.Errorf("r.DB.GetKnownRooms: %w", err)
+				}
+				started = true
+			}
+			if len(roomIDs) == 0 {
+				started = false
+				return 0, true, nil
+			}
+			roomID := roomIDs[0]
+			roomIDs = roomIDs[1:]
+			// Compress the state in the input worker for the room, as new
+			// state may refer to state blocks which compression deletes.
+			var res *types.StateCompressionResult
+			var err error
+			r.Inputer.RunInRoomWorker(roomID, func() {
+				res, err = r.DB.CompressState(ctx, roomID)
+			})
+			if err != nil {
+				started = false
+				return 0, false, fmt.Errorf("failed to compress state of room %s: %w", roomID, err)
+			}
+			if res.CompressedSnapshots > 0 || res.MergedSnapshots > 0 || res.DeletedStateBlocks > 0 {
+				logrus.WithFields(logrus.Fields{
+					"room_id":              roomID,
+					"compressed_snapshots": res.CompressedSnapshots,
+					"merged_snapshots":     res.MergedSnapshots,
+					"deleted_state_blocks": res.DeletedStateBlocks,
+				}).Info("Compressed room state")
+			}
+			if len(roomIDs) == 0 {
+				started = false
+				return 1, true, nil
+			}
+			return 1, false, nil
+		},
+	}
+}
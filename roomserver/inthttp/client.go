@@ -41,6 +41,7 @@ const (
 	RoomserverPerformAdminEvacuateUserPath  = "/roomserver/performAdminEvacuateUser"
 	RoomserverPerformAdminDownloadStatePath = "/roomserver/performAdminDownloadState"
 	RoomserverPerformAdminPurgeRoomPath     = "/roomserver/performAdminPurgeRoom"
+	RoomserverPerformAdminSetStatePath      = "/roomserver/performAdminSetState"
 
 	// Query operations
 	RoomserverQueryLatestEventsAndStatePath    = "/roomserver/queryLatestEventsAndState"
@@ -65,6 +66,7 @@ const (
 	RoomserverQueryRestrictedJoinAllowed       = "/roomserver/queryRestrictedJoinAllowed"
 	RoomserverQueryMembershipAtEventPath       = "/roomserver/queryMembershipAtEvent"
 	RoomserverQueryLeftMembersPath             = "/roomserver/queryLeftMembers"
+	RoomserverQueryEventByTimestampPath        = "/roomserver/queryEventByTimestamp"
 )
 
 type httpRoomserverInternalAPI struct {
@@ -275,6 +277,17 @@ func (h *httpRoomserverInternalAPI) PerformAdminDownloadState(
 	)
 }
 
+func (h *httpRoomserverInternalAPI) PerformAdminSetState(
+	ctx context.Context,
+	request *api.PerformAdminSetStateRequest,
+	response *api.PerformAdminSetStateResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformAdminSetState", h.roomserverURL+RoomserverPerformAdminSetStatePath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
 func (h *httpRoomserverInternalAPI) PerformAdminEvacuateUser(
 	ctx context.Context,
 	request *api.PerformAdminEvacuateUserRequest,
@@ -573,3 +586,10 @@ func (h *httpRoomserverInternalAPI) QueryLeftUsers(ctx context.Context, request
 		h.httpClient, ctx, request, response,
 	)
 }
+
+func (h *httpRoomserverInternalAPI) QueryEventByTimestamp(ctx context.Context, request *api.QueryEventByTimestampRequest, response *api.QueryEventByTimestampResponse) error {
+	return httputil.CallInternalRPCAPI(
+		"RoomserverQueryEventByTimestamp", h.roomserverURL+RoomserverQueryEventByTimestampPath,
+		h.httpClient, ctx, request, response,
+	)
+}
@@ -75,6 +75,11 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router, enableMe
 		httputil.MakeInternalRPCAPI("RoomserverPerformAdminDownloadState", enableMetrics, r.PerformAdminDownloadState),
 	)
 
+	internalAPIMux.Handle(
+		RoomserverPerformAdminSetStatePath,
+		httputil.MakeInternalRPCAPI("RoomserverPerformAdminSetState", enableMetrics, r.PerformAdminSetState),
+	)
+
 	internalAPIMux.Handle(
 		RoomserverQueryPublishedRoomsPath,
 		httputil.MakeInternalRPCAPI("RoomserverQueryPublishedRooms", enableMetrics, r.QueryPublishedRooms),
@@ -213,4 +218,9 @@ func AddRoutes(r api.RoomserverInternalAPI, internalAPIMux *mux.Router, enableMe
 		RoomserverQueryLeftMembersPath,
 		httputil.MakeInternalRPCAPI("RoomserverQueryLeftMembersPath", enableMetrics, r.QueryLeftUsers),
 	)
+
+	internalAPIMux.Handle(
+		RoomserverQueryEventByTimestampPath,
+		httputil.MakeInternalRPCAPI("RoomserverQueryEventByTimestamp", enableMetrics, r.QueryEventByTimestamp),
+	)
 }
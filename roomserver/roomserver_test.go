@@ -2,19 +2,24 @@ package roomserver_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/setup/base"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi"
 
 	userAPI "github.com/matrix-org/dendrite/userapi/api"
 
 	"github.com/matrix-org/dendrite/federationapi"
+	fsAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/keyserver"
 	"github.com/matrix-org/dendrite/setup/jetstream"
 	"github.com/matrix-org/dendrite/syncapi"
@@ -23,7 +28,9 @@ import (
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/inthttp"
+	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/dendrite/test/testrig"
 )
@@ -228,6 +235,89 @@ func Test_QueryLeftUsers(t *testing.T) {
 	})
 }
 
+func TestPurgeRoomDryRun(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{
+		"msgtype": "m.image",
+		"body":    "cat.png",
+		"url":     "mxc://test/cat",
+	})
+	room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "hello",
+	})
+	// Mentioning an mxc:// URI doesn't make this a media event.
+	room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    "see mxc://test/cat",
+	})
+
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, db, close := mustCreateDatabase(t, dbType)
+		defer close()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		purgeResp := &api.PerformAdminPurgeRoomResponse{}
+		if err := rsAPI.PerformAdminPurgeRoom(ctx, &api.PerformAdminPurgeRoomRequest{RoomID: room.ID, DryRun: true}, purgeResp); err != nil {
+			t.Fatal(err)
+		}
+		if purgeResp.Error != nil {
+			t.Fatal(purgeResp.Error)
+		}
+		report := purgeResp.Report
+		if report == nil {
+			t.Fatalf("expected a report for a dry run")
+		}
+
+		var wantStateEvents int64
+		for _, ev := range room.Events() {
+			if ev.StateKey() != nil {
+				wantStateEvents++
+			}
+		}
+		if want := int64(len(room.Events())); report.Events != want {
+			t.Errorf("expected %d events, got %d", want, report.Events)
+		}
+		if report.StateEvents != wantStateEvents {
+			t.Errorf("expected %d state events, got %d", wantStateEvents, report.StateEvents)
+		}
+		if report.StateSnapshots == 0 {
+			t.Errorf("expected state snapshots to be counted")
+		}
+		if report.MediaEvents != 1 {
+			t.Errorf("expected 1 media event, got %d", report.MediaEvents)
+		}
+		if !reflect.DeepEqual(report.LocalUsers, []string{alice.ID}) {
+			t.Errorf("expected local users %v, got %v", []string{alice.ID}, report.LocalUsers)
+		}
+
+		// Nothing should have been deleted.
+		roomInfo, err := db.RoomInfo(ctx, room.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if roomInfo == nil {
+			t.Fatalf("room should still exist after a dry run")
+		}
+		afterCounts, err := db.PurgeRoomCounts(ctx, room.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if afterCounts.Events != report.Events {
+			t.Fatalf("expected %d events after dry run, got %d", report.Events, afterCounts.Events)
+		}
+	})
+}
+
 func TestPurgeRoom(t *testing.T) {
 	alice := test.NewUser(t)
 	bob := test.NewUser(t)
@@ -253,7 +343,7 @@ func TestPurgeRoom(t *testing.T) {
 		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
 
 		// this starts the JetStream consumers
-		syncapi.AddPublicRoutes(base, userAPI, rsAPI, keyAPI)
+		syncapi.AddPublicRoutes(base, userAPI, rsAPI, keyAPI, nil)
 		federationapi.NewInternalAPI(base, fedClient, rsAPI, base.Caches, nil, true)
 		rsAPI.SetFederationAPI(nil, nil)
 
@@ -388,3 +478,438 @@ func TestPurgeRoom(t *testing.T) {
 		}
 	})
 }
+
+func TestRestrictedJoinWhileBanned(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+
+	// Bob is in the room that grants access to the restricted room.
+	allowRoom := test.NewRoom(t, alice)
+	allowRoom.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+
+	restrictedRoom := test.NewRoom(t, alice)
+	restrictedRoom.CreateAndInsert(t, alice, gomatrixserverlib.MRoomJoinRules, map[string]interface{}{
+		"join_rule": gomatrixserverlib.Restricted,
+		"allow": []map[string]interface{}{
+			{"type": gomatrixserverlib.MRoomMembership, "room_id": allowRoom.ID},
+		},
+	}, test.WithStateKey(""))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+		rsAPI := roomserver.NewInternalAPI(base)
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(nil, nil)
+
+		for _, room := range []*test.Room{allowRoom, restrictedRoom} {
+			if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+
+		queryAllowed := func() *api.QueryRestrictedJoinAllowedResponse {
+			res := &api.QueryRestrictedJoinAllowedResponse{}
+			if err := rsAPI.QueryRestrictedJoinAllowed(ctx, &api.QueryRestrictedJoinAllowedRequest{
+				RoomID: restrictedRoom.ID,
+				UserID: bob.ID,
+			}, res); err != nil {
+				t.Fatal(err)
+			}
+			return res
+		}
+
+		if res := queryAllowed(); !res.Allowed || res.AuthorisedVia != alice.ID {
+			t.Fatalf("expected bob to be allowed to join via %s, got %+v", alice.ID, res)
+		}
+
+		banEvent := restrictedRoom.CreateAndInsert(t, alice, gomatrixserverlib.MRoomMember, map[string]interface{}{
+			"membership": gomatrixserverlib.Ban,
+		}, test.WithStateKey(bob.ID))
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{banEvent}, "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		if res := queryAllowed(); res.Allowed || res.AuthorisedVia != "" {
+			t.Fatalf("expected bob not to be allowed to join while banned, got %+v", res)
+		}
+
+		joinRes := &api.PerformJoinResponse{}
+		if err := rsAPI.PerformJoin(ctx, &api.PerformJoinRequest{
+			RoomIDOrAlias: restrictedRoom.ID,
+			UserID:        bob.ID,
+		}, joinRes); err != nil {
+			t.Fatal(err)
+		}
+		if joinRes.Error == nil || joinRes.Error.Code != api.PerformErrorNotAllowed {
+			t.Fatalf("expected the join to be refused, got %+v", joinRes.Error)
+		}
+	})
+}
+
+func TestPerformLeave(t *testing.T) {
+	alice := test.NewUser(t)
+	invited := test.NewUser(t)
+	joined := test.NewUser(t)
+	knocking := test.NewUser(t)
+	stranger := test.NewUser(t)
+
+	room := test.NewRoom(t, alice, test.RoomVersion(gomatrixserverlib.RoomVersionV7))
+	room.CreateAndInsert(t, alice, gomatrixserverlib.MRoomJoinRules, map[string]interface{}{
+		"join_rule": gomatrixserverlib.Knock,
+	}, test.WithStateKey(""))
+	room.CreateAndInsert(t, alice, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": gomatrixserverlib.Invite,
+	}, test.WithStateKey(invited.ID))
+	room.CreateAndInsert(t, alice, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": gomatrixserverlib.Invite,
+	}, test.WithStateKey(joined.ID))
+	room.CreateAndInsert(t, joined, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": gomatrixserverlib.Join,
+	}, test.WithStateKey(joined.ID))
+	room.CreateAndInsert(t, knocking, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": gomatrixserverlib.Knock,
+	}, test.WithStateKey(knocking.ID))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+		rsAPI := roomserver.NewInternalAPI(base)
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(nil, nil)
+		rsAPI.SetUserAPI(userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, nil, rsAPI, nil))
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		testCases := []struct {
+			name           string
+			user           *test.User
+			wantMembership string
+			wantErr        bool
+		}{
+			{name: "reject invite", user: invited, wantMembership: gomatrixserverlib.Invite},
+			{name: "leave after join", user: joined, wantMembership: gomatrixserverlib.Join},
+			{name: "retract knock", user: knocking, wantMembership: gomatrixserverlib.Knock},
+			{name: "not in the room", user: stranger, wantErr: true},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				queryMembership := func() *api.QueryMembershipForUserResponse {
+					res := &api.QueryMembershipForUserResponse{}
+					if err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+						RoomID: room.ID,
+						UserID: tc.user.ID,
+					}, res); err != nil {
+						t.Fatalf("failed to query membership: %s", err)
+					}
+					return res
+				}
+				before := queryMembership()
+				if !tc.wantErr && before.Membership != tc.wantMembership {
+					t.Fatalf("expected membership %q before leaving, got %q", tc.wantMembership, before.Membership)
+				}
+
+				err := rsAPI.PerformLeave(ctx, &api.PerformLeaveRequest{
+					RoomID: room.ID,
+					UserID: tc.user.ID,
+				}, &api.PerformLeaveResponse{})
+				if tc.wantErr {
+					if err == nil {
+						t.Fatalf("expected leaving to fail")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("failed to leave: %s", err)
+				}
+
+				after := queryMembership()
+				if after.Membership != gomatrixserverlib.Leave || after.IsInRoom {
+					t.Fatalf("expected membership %q after leaving, got %+v", gomatrixserverlib.Leave, after)
+				}
+				if after.EventID == before.EventID {
+					t.Fatalf("expected a new membership event, still got %s", after.EventID)
+				}
+			})
+		}
+	})
+}
+
+type fakeFederationLeaveAPI struct {
+	fsAPI.RoomserverFederationAPI
+	leaveRequests []*fsAPI.PerformLeaveRequest
+}
+
+func (f *fakeFederationLeaveAPI) PerformLeave(ctx context.Context, req *fsAPI.PerformLeaveRequest, res *fsAPI.PerformLeaveResponse) error {
+	f.leaveRequests = append(f.leaveRequests, req)
+	return nil
+}
+
+func TestPerformLeaveRetractKnockOverFederation(t *testing.T) {
+	remoteCreator := test.NewUser(t, test.WithSigningServer("remote", "ed25519:remote", test.PrivateKeyA))
+	remoteMember := test.NewUser(t, test.WithSigningServer("other", "ed25519:other", test.PrivateKeyB))
+	knocking := test.NewUser(t)
+
+	// None of our users are joined to the room, so the knock can only be
+	// retracted through one of the servers in it.
+	room := test.NewRoom(t, remoteCreator, test.RoomVersion(gomatrixserverlib.RoomVersionV7))
+	room.CreateAndInsert(t, remoteMember, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": gomatrixserverlib.Join,
+	}, test.WithStateKey(remoteMember.ID))
+	room.CreateAndInsert(t, remoteCreator, gomatrixserverlib.MRoomJoinRules, map[string]interface{}{
+		"join_rule": gomatrixserverlib.Knock,
+	}, test.WithStateKey(""))
+	room.CreateAndInsert(t, knocking, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": gomatrixserverlib.Knock,
+	}, test.WithStateKey(knocking.ID))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+		rsAPI := roomserver.NewInternalAPI(base)
+		fedAPI := &fakeFederationLeaveAPI{}
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(fedAPI, nil)
+		rsAPI.SetUserAPI(userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, nil, rsAPI, nil))
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		if err := rsAPI.PerformLeave(ctx, &api.PerformLeaveRequest{
+			RoomID: room.ID,
+			UserID: knocking.ID,
+		}, &api.PerformLeaveResponse{}); err != nil {
+			t.Fatalf("failed to retract knock: %s", err)
+		}
+
+		if len(fedAPI.leaveRequests) != 1 {
+			t.Fatalf("expected 1 federated leave, got %d", len(fedAPI.leaveRequests))
+		}
+		leaveReq := fedAPI.leaveRequests[0]
+		if leaveReq.RoomID != room.ID || leaveReq.UserID != knocking.ID {
+			t.Fatalf("unexpected federated leave request: %+v", leaveReq)
+		}
+		servers := map[gomatrixserverlib.ServerName]bool{}
+		for _, serverName := range leaveReq.ServerNames {
+			servers[serverName] = true
+		}
+		if !servers["remote"] || !servers["other"] || servers["test"] {
+			t.Fatalf("expected to leave through the remote servers, got %v", leaveReq.ServerNames)
+		}
+
+		res := &api.QueryMembershipForUserResponse{}
+		if err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+			RoomID: room.ID,
+			UserID: knocking.ID,
+		}, res); err != nil {
+			t.Fatalf("failed to query membership: %s", err)
+		}
+		if res.Membership == gomatrixserverlib.Knock {
+			t.Fatalf("expected the knock to be forgotten, got %+v", res)
+		}
+	})
+}
+
+func TestJoinTombstonedRoom(t *testing.T) {
+	alice := test.NewUser(t)
+	replacementRoom := test.NewRoom(t, alice)
+	oldRoom := test.NewRoom(t, alice)
+	oldRoom.CreateAndInsert(t, alice, "m.room.tombstone", map[string]interface{}{
+		"body":             "This room has been replaced",
+		"replacement_room": replacementRoom.ID,
+	}, test.WithStateKey(""))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+		rsAPI := roomserver.NewInternalAPI(base)
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(nil, nil)
+
+		for _, room := range []*test.Room{replacementRoom, oldRoom} {
+			if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+
+		testCases := []struct {
+			behaviour  string
+			wantRoomID string
+			wantErr    bool
+		}{
+			{behaviour: config.TombstonedRoomJoinsAllow, wantRoomID: oldRoom.ID},
+			{behaviour: config.TombstonedRoomJoinsReject, wantErr: true},
+			{behaviour: config.TombstonedRoomJoinsFollow, wantRoomID: replacementRoom.ID},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.behaviour, func(t *testing.T) {
+				base.Cfg.RoomServer.TombstonedRoomJoins = tc.behaviour
+				bob := test.NewUser(t)
+				joinRes := &api.PerformJoinResponse{}
+				if err := rsAPI.PerformJoin(ctx, &api.PerformJoinRequest{
+					RoomIDOrAlias: oldRoom.ID,
+					UserID:        bob.ID,
+				}, joinRes); err != nil {
+					t.Fatal(err)
+				}
+				if tc.wantErr {
+					if joinRes.Error == nil || joinRes.Error.Code != api.PerformErrorRoomTombstoned {
+						t.Fatalf("expected the join to be refused, got %+v", joinRes.Error)
+					}
+					if joinRes.Error.ReplacementRoom != replacementRoom.ID {
+						t.Fatalf("expected replacement room %s, got %s", replacementRoom.ID, joinRes.Error.ReplacementRoom)
+					}
+					res := joinRes.Error.JSONResponse()
+					if jsonErr, ok := res.JSON.(*jsonerror.RoomTombstonedError); !ok || jsonErr.ReplacementRoom != replacementRoom.ID {
+						t.Fatalf("expected the error response to name the replacement room, got %+v", res.JSON)
+					}
+					return
+				}
+				if joinRes.Error != nil {
+					t.Fatalf("failed to join: %+v", joinRes.Error)
+				}
+				if joinRes.RoomID != tc.wantRoomID {
+					t.Fatalf("expected to join %s, joined %s", tc.wantRoomID, joinRes.RoomID)
+				}
+				membershipRes := &api.QueryMembershipForUserResponse{}
+				if err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+					RoomID: tc.wantRoomID,
+					UserID: bob.ID,
+				}, membershipRes); err != nil {
+					t.Fatal(err)
+				}
+				if !membershipRes.IsInRoom {
+					t.Fatalf("expected to be in room %s", tc.wantRoomID)
+				}
+			})
+		}
+	})
+}
+
+func TestSendRejectedEventIsNotAllowed(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+	room.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": "join",
+	}, test.WithStateKey(bob.ID))
+	// Bob's message is allowed by the state before he is banned, but not
+	// by the current state of the room, so the roomserver must reject it.
+	ev := room.CreateEvent(t, bob, "m.room.message", map[string]interface{}{"body": "hello"})
+	room.CreateAndInsert(t, alice, gomatrixserverlib.MRoomMember, map[string]interface{}{
+		"membership": "ban",
+	}, test.WithStateKey(bob.ID))
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+		rsAPI := roomserver.NewInternalAPI(base)
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(nil, nil)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		err := api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{ev}, "test", "test", "test", nil, false)
+		var notAllowed *gomatrixserverlib.NotAllowed
+		if !errors.As(err, &notAllowed) {
+			t.Fatalf("expected a NotAllowed error, got %v", err)
+		}
+	})
+}
+
+func TestCompressState(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	// Every topic change adds a state block which overwrites the previous
+	// topic, so the older blocks become redundant.
+	for i := 0; i < 10; i++ {
+		room.CreateAndInsert(t, alice, "m.room.topic", map[string]interface{}{
+			"topic": fmt.Sprintf("topic %d", i),
+		}, test.WithStateKey(""))
+		room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+	}
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		rsAPI := roomserver.NewInternalAPI(base)
+		// SetFederationAPI starts the room event input consumer
+		rsAPI.SetFederationAPI(nil, nil)
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		roomInfo, err := db.RoomInfo(ctx, room.ID)
+		if err != nil || roomInfo == nil {
+			t.Fatalf("failed to get room info: %v", err)
+		}
+		stateAtEvents := func() map[string][]types.StateEntry {
+			res := map[string][]types.StateEntry{}
+			resolver := state.NewStateResolution(db, roomInfo)
+			for i, ev := range room.Events() {
+				if i%3 != 0 && i != len(room.Events())-1 {
+					continue
+				}
+				entries, err := resolver.LoadStateAtEvent(ctx, ev.EventID())
+				if err != nil {
+					t.Fatalf("failed to load state at event %s: %v", ev.EventID(), err)
+				}
+				res[ev.EventID()] = entries
+			}
+			return res
+		}
+
+		before := stateAtEvents()
+		res, err := db.CompressState(ctx, room.ID)
+		if err != nil {
+			t.Fatalf("failed to compress state: %v", err)
+		}
+		if res.CompressedSnapshots == 0 {
+			t.Fatalf("expected some state snapshots to be compressed, got %+v", res)
+		}
+		if after := stateAtEvents(); !reflect.DeepEqual(before, after) {
+			t.Fatalf("compressing state changed the state at events:\nbefore: %+v\nafter:  %+v", before, after)
+		}
+
+		// Compressing again shouldn't find anything else to do.
+		res, err = db.CompressState(ctx, room.ID)
+		if err != nil {
+			t.Fatalf("failed to compress state: %v", err)
+		}
+		if *res != (types.StateCompressionResult{}) {
+			t.Fatalf("expected nothing to compress, got %+v", res)
+		}
+
+		// The room still works afterwards.
+		topic := room.CreateAndInsert(t, alice, "m.room.topic", map[string]interface{}{
+			"topic": "final topic",
+		}, test.WithStateKey(""))
+		if err = api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{topic}, "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		stateRes := &api.QueryCurrentStateResponse{}
+		if err = rsAPI.QueryCurrentState(ctx, &api.QueryCurrentStateRequest{
+			RoomID:      room.ID,
+			StateTuples: []gomatrixserverlib.StateKeyTuple{{EventType: "m.room.topic", StateKey: ""}},
+		}, stateRes); err != nil {
+			t.Fatalf("failed to query current state: %v", err)
+		}
+		if ev := stateRes.StateEvents[gomatrixserverlib.StateKeyTuple{EventType: "m.room.topic", StateKey: ""}]; ev == nil || ev.EventID() != topic.EventID() {
+			t.Fatalf("expected the current topic to be %s, got %v", topic.EventID(), ev)
+		}
+	})
+}
@@ -98,6 +98,10 @@ type Database interface {
 	// If this returns an error then no further action is required.
 	// IsEventRejected returns true if the event is known and rejected.
 	IsEventRejected(ctx context.Context, roomNID types.RoomNID, eventID string) (rejected bool, err error)
+	// EventIDByTimestamp returns the ID and timestamp of the event in the room sent closest to the
+	// given timestamp, looking forwards from it or backwards if backwards is set.
+	// Returns sql.ErrNoRows if there is no such event.
+	EventIDByTimestamp(ctx context.Context, roomNID types.RoomNID, ts gomatrixserverlib.Timestamp, backwards bool) (string, gomatrixserverlib.Timestamp, error)
 	GetRoomUpdater(ctx context.Context, roomInfo *types.RoomInfo) (*shared.RoomUpdater, error)
 	// Look up event references for the latest events in the room and the current state snapshot.
 	// Returns the latest events, the current state and the maximum depth of the latest events plus 1.
@@ -174,5 +178,10 @@ type Database interface {
 	GetHistoryVisibilityState(ctx context.Context, roomInfo *types.RoomInfo, eventID string, domain string) ([]*gomatrixserverlib.Event, error)
 	GetLeftUsers(ctx context.Context, userIDs []string) ([]string, error)
 	PurgeRoom(ctx context.Context, roomID string) error
+	// PurgeRoomCounts returns how much data purging the given room would remove, without removing anything.
+	PurgeRoomCounts(ctx context.Context, roomID string) (*tables.PurgeRoomCounts, error)
 	UpgradeRoom(ctx context.Context, oldRoomID, newRoomID, eventSender string) error
+	// CompressState removes redundant state blocks and state snapshots from the room,
+	// without changing the state at any event.
+	CompressState(ctx context.Context, roomID string) (*types.StateCompressionResult, error)
 }
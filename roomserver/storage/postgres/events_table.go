@@ -26,6 +26,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/postgres/deltas"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
 )
@@ -67,13 +68,15 @@ CREATE TABLE IF NOT EXISTS roomserver_events (
     reference_sha256 BYTEA NOT NULL,
     -- A list of numeric IDs for events that can authenticate this event.
 	auth_event_nids BIGINT[] NOT NULL,
-	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+	is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+	-- The origin_server_ts of the event, used to find events by timestamp.
+	origin_server_ts BIGINT NOT NULL DEFAULT 0
 );
 `
 
 const insertEventSQL = "" +
-	"INSERT INTO roomserver_events AS e (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected)" +
-	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	"INSERT INTO roomserver_events AS e (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected, origin_server_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)" +
 	" ON CONFLICT ON CONSTRAINT roomserver_event_id_unique DO UPDATE" +
 	" SET is_rejected = $8 WHERE e.event_id = $4 AND e.is_rejected = TRUE" +
 	" RETURNING event_nid, state_snapshot_nid"
@@ -117,6 +120,9 @@ const bulkSelectStateAtEventByIDSQL = "" +
 const updateEventStateSQL = "" +
 	"UPDATE roomserver_events SET state_snapshot_nid = $2 WHERE event_nid = $1"
 
+const updateStateSnapshotNIDsSQL = "" +
+	"UPDATE roomserver_events SET state_snapshot_nid = $1 WHERE room_nid = $2 AND state_snapshot_nid = $3"
+
 const selectEventSentToOutputSQL = "" +
 	"SELECT sent_to_output FROM roomserver_events WHERE event_nid = $1"
 
@@ -151,6 +157,18 @@ const selectRoomNIDsForEventNIDsSQL = "" +
 const selectEventRejectedSQL = "" +
 	"SELECT is_rejected FROM roomserver_events WHERE room_nid = $1 AND event_id = $2"
 
+// Selects the first non-outlier, non-rejected event sent at or after the given timestamp.
+const selectEventIDAfterTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts >= $2 AND state_snapshot_nid != 0 AND is_rejected = FALSE" +
+	" ORDER BY origin_server_ts ASC, event_nid ASC LIMIT 1"
+
+// Selects the last non-outlier, non-rejected event sent at or before the given timestamp.
+const selectEventIDBeforeTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts <= $2 AND state_snapshot_nid != 0 AND is_rejected = FALSE" +
+	" ORDER BY origin_server_ts DESC, event_nid DESC LIMIT 1"
+
 type eventStatements struct {
 	insertEventStmt                               *sql.Stmt
 	selectEventStmt                               *sql.Stmt
@@ -160,6 +178,7 @@ type eventStatements struct {
 	bulkSelectStateEventByNIDStmt                 *sql.Stmt
 	bulkSelectStateAtEventByIDStmt                *sql.Stmt
 	updateEventStateStmt                          *sql.Stmt
+	updateStateSnapshotNIDsStmt                   *sql.Stmt
 	selectEventSentToOutputStmt                   *sql.Stmt
 	updateEventSentToOutputStmt                   *sql.Stmt
 	selectEventIDStmt                             *sql.Stmt
@@ -171,11 +190,22 @@ type eventStatements struct {
 	selectMaxEventDepthStmt                       *sql.Stmt
 	selectRoomNIDsForEventNIDsStmt                *sql.Stmt
 	selectEventRejectedStmt                       *sql.Stmt
+	selectEventIDAfterTimestampStmt               *sql.Stmt
+	selectEventIDBeforeTimestampStmt              *sql.Stmt
 }
 
 func CreateEventsTable(db *sql.DB) error {
 	_, err := db.Exec(eventsSchema)
-	return err
+	if err != nil {
+		return err
+	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "roomserver: add events origin_server_ts",
+		Up:      deltas.UpEventsOriginServerTS,
+		Down:    deltas.DownEventsOriginServerTS,
+	})
+	return m.Up(context.Background())
 }
 
 func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
@@ -190,6 +220,7 @@ func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectStateEventByNIDStmt, bulkSelectStateEventByNIDSQL},
 		{&s.bulkSelectStateAtEventByIDStmt, bulkSelectStateAtEventByIDSQL},
 		{&s.updateEventStateStmt, updateEventStateSQL},
+		{&s.updateStateSnapshotNIDsStmt, updateStateSnapshotNIDsSQL},
 		{&s.updateEventSentToOutputStmt, updateEventSentToOutputSQL},
 		{&s.selectEventSentToOutputStmt, selectEventSentToOutputSQL},
 		{&s.selectEventIDStmt, selectEventIDSQL},
@@ -201,6 +232,8 @@ func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
 		{&s.selectRoomNIDsForEventNIDsStmt, selectRoomNIDsForEventNIDsSQL},
 		{&s.selectEventRejectedStmt, selectEventRejectedSQL},
+		{&s.selectEventIDAfterTimestampStmt, selectEventIDAfterTimestampSQL},
+		{&s.selectEventIDBeforeTimestampStmt, selectEventIDBeforeTimestampSQL},
 	}.Prepare(db)
 }
 
@@ -215,6 +248,7 @@ func (s *eventStatements) InsertEvent(
 	authEventNIDs []types.EventNID,
 	depth int64,
 	isRejected bool,
+	originServerTS gomatrixserverlib.Timestamp,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	var eventNID int64
 	var stateNID int64
@@ -222,7 +256,7 @@ func (s *eventStatements) InsertEvent(
 	err := stmt.QueryRowContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
 		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth,
-		isRejected,
+		isRejected, originServerTS,
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -399,6 +433,14 @@ func (s *eventStatements) UpdateEventState(
 	return err
 }
 
+func (s *eventStatements) UpdateStateSnapshotNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, oldStateNID, newStateNID types.StateSnapshotNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateStateSnapshotNIDsStmt)
+	_, err := stmt.ExecContext(ctx, int64(newStateNID), int64(roomNID), int64(oldStateNID))
+	return err
+}
+
 func (s *eventStatements) SelectEventSentToOutput(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
 ) (sentToOutput bool, err error) {
@@ -600,3 +642,14 @@ func (s *eventStatements) SelectEventRejected(
 	err = stmt.QueryRowContext(ctx, roomNID, eventID).Scan(&rejected)
 	return
 }
+
+func (s *eventStatements) SelectEventIDByTimestamp(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, ts gomatrixserverlib.Timestamp, backwards bool,
+) (eventID string, originServerTS gomatrixserverlib.Timestamp, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventIDAfterTimestampStmt)
+	if backwards {
+		stmt = sqlutil.TxStmt(txn, s.selectEventIDBeforeTimestampStmt)
+	}
+	err = stmt.QueryRowContext(ctx, roomNID, ts).Scan(&eventID, &originServerTS)
+	return
+}
@@ -18,7 +18,9 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
 )
 
@@ -63,6 +65,22 @@ const purgeStateBlockEntriesSQL = "" +
 const purgeStateSnapshotEntriesSQL = "" +
 	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
 
+const selectPurgeRoomEventCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_events WHERE room_nid = $1"
+
+const selectPurgeRoomStateEventCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_events WHERE room_nid = $1 AND event_state_key_nid != 0"
+
+const selectPurgeRoomStateSnapshotCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+// Only events which mention an mxc:// URI are selected, the rest are left to
+// tables.ReferencesMedia.
+const selectPurgeRoomMediaEventJSONSQL = "" +
+	"SELECT event_json FROM roomserver_event_json WHERE event_nid = ANY(" +
+	"	SELECT event_nid FROM roomserver_events WHERE room_nid = $1" +
+	") AND event_json LIKE '%mxc://%'"
+
 type purgeStatements struct {
 	purgeEventJSONStmt            *sql.Stmt
 	purgeEventsStmt               *sql.Stmt
@@ -75,6 +93,10 @@ type purgeStatements struct {
 	purgeRoomStmt                 *sql.Stmt
 	purgeStateBlockEntriesStmt    *sql.Stmt
 	purgeStateSnapshotEntriesStmt *sql.Stmt
+	selectEventCountStmt          *sql.Stmt
+	selectStateEventCountStmt     *sql.Stmt
+	selectStateSnapshotCountStmt  *sql.Stmt
+	selectMediaEventJSONStmt      *sql.Stmt
 }
 
 func PreparePurgeStatements(db *sql.DB) (*purgeStatements, error) {
@@ -92,6 +114,10 @@ func PreparePurgeStatements(db *sql.DB) (*purgeStatements, error) {
 		{&s.purgeRoomStmt, purgeRoomSQL},
 		{&s.purgeStateBlockEntriesStmt, purgeStateBlockEntriesSQL},
 		{&s.purgeStateSnapshotEntriesStmt, purgeStateSnapshotEntriesSQL},
+		{&s.selectEventCountStmt, selectPurgeRoomEventCountSQL},
+		{&s.selectStateEventCountStmt, selectPurgeRoomStateEventCountSQL},
+		{&s.selectStateSnapshotCountStmt, selectPurgeRoomStateSnapshotCountSQL},
+		{&s.selectMediaEventJSONStmt, selectPurgeRoomMediaEventJSONSQL},
 	}.Prepare(db)
 }
 
@@ -131,3 +157,37 @@ func (s *purgeStatements) PurgeRoom(
 	}
 	return nil
 }
+
+func (s *purgeStatements) SelectPurgeRoomCounts(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) (*tables.PurgeRoomCounts, error) {
+	counts := &tables.PurgeRoomCounts{}
+	for _, q := range []struct {
+		stmt  *sql.Stmt
+		count *int64
+	}{
+		{s.selectEventCountStmt, &counts.Events},
+		{s.selectStateEventCountStmt, &counts.StateEvents},
+		{s.selectStateSnapshotCountStmt, &counts.StateSnapshots},
+	} {
+		if err := sqlutil.TxStmt(txn, q.stmt).QueryRowContext(ctx, roomNID).Scan(q.count); err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := sqlutil.TxStmt(txn, s.selectMediaEventJSONStmt).QueryContext(ctx, roomNID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPurgeRoomCounts: rows.close() failed")
+	var eventJSON []byte
+	for rows.Next() {
+		if err = rows.Scan(&eventJSON); err != nil {
+			return nil, err
+		}
+		if tables.ReferencesMedia(eventJSON) {
+			counts.MediaEvents++
+		}
+	}
+	return counts, rows.Err()
+}
@@ -70,6 +70,9 @@ const selectLatestEventNIDsForUpdateSQL = "" +
 const updateLatestEventNIDsSQL = "" +
 	"UPDATE roomserver_rooms SET latest_event_nids = $2, last_event_sent_nid = $3, state_snapshot_nid = $4 WHERE room_nid = $1"
 
+const updateStateSnapshotNIDSQL = "" +
+	"UPDATE roomserver_rooms SET state_snapshot_nid = $1 WHERE room_nid = $2 AND state_snapshot_nid = $3"
+
 const selectRoomVersionsForRoomNIDsSQL = "" +
 	"SELECT room_nid, room_version FROM roomserver_rooms WHERE room_nid = ANY($1)"
 
@@ -92,6 +95,7 @@ type roomStatements struct {
 	selectLatestEventNIDsStmt          *sql.Stmt
 	selectLatestEventNIDsForUpdateStmt *sql.Stmt
 	updateLatestEventNIDsStmt          *sql.Stmt
+	updateStateSnapshotNIDStmt         *sql.Stmt
 	selectRoomVersionsForRoomNIDsStmt  *sql.Stmt
 	selectRoomInfoStmt                 *sql.Stmt
 	selectRoomIDsStmt                  *sql.Stmt
@@ -114,6 +118,7 @@ func PrepareRoomsTable(db *sql.DB) (tables.Rooms, error) {
 		{&s.selectLatestEventNIDsStmt, selectLatestEventNIDsSQL},
 		{&s.selectLatestEventNIDsForUpdateStmt, selectLatestEventNIDsForUpdateSQL},
 		{&s.updateLatestEventNIDsStmt, updateLatestEventNIDsSQL},
+		{&s.updateStateSnapshotNIDStmt, updateStateSnapshotNIDSQL},
 		{&s.selectRoomVersionsForRoomNIDsStmt, selectRoomVersionsForRoomNIDsSQL},
 		{&s.selectRoomInfoStmt, selectRoomInfoSQL},
 		{&s.selectRoomIDsStmt, selectRoomIDsSQL},
@@ -237,6 +242,14 @@ func (s *roomStatements) UpdateLatestEventNIDs(
 	return err
 }
 
+func (s *roomStatements) UpdateStateSnapshotNID(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, oldStateNID, newStateNID types.StateSnapshotNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateStateSnapshotNIDStmt)
+	_, err := stmt.ExecContext(ctx, int64(newStateNID), int64(roomNID), int64(oldStateNID))
+	return err
+}
+
 func (s *roomStatements) SelectRoomVersionsForRoomNIDs(
 	ctx context.Context, txn *sql.Tx, roomNIDs []types.RoomNID,
 ) (map[types.RoomNID]gomatrixserverlib.RoomVersion, error) {
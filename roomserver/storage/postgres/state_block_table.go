@@ -65,9 +65,13 @@ const bulkSelectStateBlockEntriesSQL = "" +
 	"SELECT state_block_nid, event_nids" +
 	" FROM roomserver_state_block WHERE state_block_nid = ANY($1) ORDER BY state_block_nid ASC"
 
+const bulkDeleteStateBlocksSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid = ANY($1)"
+
 type stateBlockStatements struct {
 	insertStateDataStmt             *sql.Stmt
 	bulkSelectStateBlockEntriesStmt *sql.Stmt
+	bulkDeleteStateBlocksStmt       *sql.Stmt
 }
 
 func CreateStateBlockTable(db *sql.DB) error {
@@ -81,6 +85,7 @@ func PrepareStateBlockTable(db *sql.DB) (tables.StateBlock, error) {
 	return s, sqlutil.StatementList{
 		{&s.insertStateDataStmt, insertStateDataSQL},
 		{&s.bulkSelectStateBlockEntriesStmt, bulkSelectStateBlockEntriesSQL},
+		{&s.bulkDeleteStateBlocksStmt, bulkDeleteStateBlocksSQL},
 	}.Prepare(db)
 }
 
@@ -133,6 +138,13 @@ func (s *stateBlockStatements) BulkSelectStateBlockEntries(
 	return results, err
 }
 
+func (s *stateBlockStatements) BulkDeleteStateBlocks(
+	ctx context.Context, txn *sql.Tx, stateBlockNIDs types.StateBlockNIDs,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.bulkDeleteStateBlocksStmt).ExecContext(ctx, stateBlockNIDsAsArray(stateBlockNIDs))
+	return err
+}
+
 func stateBlockNIDsAsArray(stateBlockNIDs []types.StateBlockNID) pq.Int64Array {
 	nids := make([]int64, len(stateBlockNIDs))
 	for i := range stateBlockNIDs {
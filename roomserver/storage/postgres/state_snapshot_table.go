@@ -73,6 +73,20 @@ const bulkSelectStateBlockNIDsSQL = "" +
 	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
 	" WHERE state_snapshot_nid = ANY($1) ORDER BY state_snapshot_nid ASC"
 
+const selectStateSnapshotsForRoomSQL = "" +
+	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
+	" WHERE room_nid = $1 AND state_snapshot_nid > $2 ORDER BY state_snapshot_nid ASC LIMIT $3"
+
+const selectStateSnapshotNIDByHashSQL = "" +
+	"SELECT state_snapshot_nid FROM roomserver_state_snapshots WHERE state_snapshot_hash = $1"
+
+const updateStateBlockNIDsSQL = "" +
+	"UPDATE roomserver_state_snapshots SET state_snapshot_hash = $1, state_block_nids = $2" +
+	" WHERE state_snapshot_nid = $3"
+
+const deleteStateSnapshotSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE state_snapshot_nid = $1"
+
 // Looks up both the history visibility event and relevant membership events from
 // a given domain name from a given state snapshot. This is used to optimise the
 // helpers.CheckServerAllowedToSeeEvent function.
@@ -103,6 +117,10 @@ type stateSnapshotStatements struct {
 	insertStateStmt                         *sql.Stmt
 	bulkSelectStateBlockNIDsStmt            *sql.Stmt
 	bulkSelectStateForHistoryVisibilityStmt *sql.Stmt
+	selectStateSnapshotsStmt                *sql.Stmt
+	selectStateSnapshotNIDByHashStmt        *sql.Stmt
+	updateStateBlockNIDsStmt                *sql.Stmt
+	deleteStateSnapshotStmt                 *sql.Stmt
 }
 
 func CreateStateSnapshotTable(db *sql.DB) error {
@@ -117,6 +135,10 @@ func PrepareStateSnapshotTable(db *sql.DB) (tables.StateSnapshot, error) {
 		{&s.insertStateStmt, insertStateSQL},
 		{&s.bulkSelectStateBlockNIDsStmt, bulkSelectStateBlockNIDsSQL},
 		{&s.bulkSelectStateForHistoryVisibilityStmt, bulkSelectStateForHistoryVisibilitySQL},
+		{&s.selectStateSnapshotsStmt, selectStateSnapshotsForRoomSQL},
+		{&s.selectStateSnapshotNIDByHashStmt, selectStateSnapshotNIDByHashSQL},
+		{&s.updateStateBlockNIDsStmt, updateStateBlockNIDsSQL},
+		{&s.deleteStateSnapshotStmt, deleteStateSnapshotSQL},
 	}.Prepare(db)
 }
 
@@ -185,3 +207,53 @@ func (s *stateSnapshotStatements) BulkSelectStateForHistoryVisibility(
 	}
 	return results, rows.Err()
 }
+
+func (s *stateSnapshotStatements) SelectStateSnapshotsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, afterStateNID types.StateSnapshotNID, limit int,
+) ([]types.StateBlockNIDList, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectStateSnapshotsStmt).QueryContext(ctx, int64(roomNID), int64(afterStateNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint: errcheck
+
+	var results []types.StateBlockNIDList
+	var stateBlockNIDs pq.Int64Array
+	for rows.Next() {
+		var result types.StateBlockNIDList
+		if err = rows.Scan(&result.StateSnapshotNID, &stateBlockNIDs); err != nil {
+			return nil, err
+		}
+		result.StateBlockNIDs = make([]types.StateBlockNID, len(stateBlockNIDs))
+		for k := range stateBlockNIDs {
+			result.StateBlockNIDs[k] = types.StateBlockNID(stateBlockNIDs[k])
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *stateSnapshotStatements) SelectStateSnapshotNIDByStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, nids types.StateBlockNIDs,
+) (stateNID types.StateSnapshotNID, err error) {
+	nids = nids[:util.SortAndUnique(nids)]
+	err = sqlutil.TxStmt(txn, s.selectStateSnapshotNIDByHashStmt).QueryRowContext(ctx, nids.Hash()).Scan(&stateNID)
+	return
+}
+
+func (s *stateSnapshotStatements) UpdateStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID, nids types.StateBlockNIDs,
+) error {
+	nids = nids[:util.SortAndUnique(nids)]
+	_, err := sqlutil.TxStmt(txn, s.updateStateBlockNIDsStmt).ExecContext(
+		ctx, nids.Hash(), stateBlockNIDsAsArray(nids), int64(stateNID),
+	)
+	return err
+}
+
+func (s *stateSnapshotStatements) DeleteStateSnapshot(
+	ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteStateSnapshotStmt).ExecContext(ctx, int64(stateNID))
+	return err
+}
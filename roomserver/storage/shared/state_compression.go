@@ -0,0 +1,216 @@
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// stateCompressionBatchSize is how many state snapshots CompressState loads
+// and compresses in each transaction.
+const stateCompressionBatchSize = 100
+
+// CompressState removes redundant data from the state snapshots of the given
+// room, without changing the state which any of the snapshots resolve to:
+//   - state blocks whose entries are all overwritten by later state blocks
+//     of a snapshot are dropped from it,
+//   - snapshots which are left with exactly the same state blocks as another
+//     snapshot are merged into that one, and
+//   - state blocks which are no longer used by any snapshot are deleted.
+//
+// The snapshots are compressed in batches, each in its own transaction. The
+// caller must make sure that no new state is stored for the room until this
+// returns, as new snapshots may refer to the state blocks which get deleted.
+func (d *Database) CompressState(ctx context.Context, roomID string) (*types.StateCompressionResult, error) {
+	result := &types.StateCompressionResult{}
+	dropped := make(map[types.StateBlockNID]struct{})
+	var after types.StateSnapshotNID
+	for {
+		var snapshots []types.StateBlockNIDList
+		err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+			roomNID, err := d.RoomsTable.SelectRoomNIDForUpdate(ctx, txn, roomID)
+			if err != nil {
+				return fmt.Errorf("failed to lock the room: %w", err)
+			}
+			snapshots, err = d.StateSnapshotTable.SelectStateSnapshotsForRoom(ctx, txn, roomNID, after, stateCompressionBatchSize)
+			if err != nil {
+				return fmt.Errorf("d.StateSnapshotTable.SelectStateSnapshotsForRoom: %w", err)
+			}
+			return d.compressStateSnapshots(ctx, txn, roomID, roomNID, snapshots, dropped, result)
+		})
+		if errors.Is(err, sql.ErrNoRows) {
+			return result, nil // the room has been purged since
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(snapshots) < stateCompressionBatchSize {
+			break
+		}
+		after = snapshots[len(snapshots)-1].StateSnapshotNID
+	}
+	if len(dropped) == 0 {
+		return result, nil
+	}
+
+	// Delete the state blocks which were dropped from snapshots, unless some
+	// other snapshot still uses them.
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		roomNID, err := d.RoomsTable.SelectRoomNIDForUpdate(ctx, txn, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to lock the room: %w", err)
+		}
+		for after = 0; ; {
+			snapshots, err := d.StateSnapshotTable.SelectStateSnapshotsForRoom(ctx, txn, roomNID, after, stateCompressionBatchSize)
+			if err != nil {
+				return fmt.Errorf("d.StateSnapshotTable.SelectStateSnapshotsForRoom: %w", err)
+			}
+			for _, snapshot := range snapshots {
+				for _, blockNID := range snapshot.StateBlockNIDs {
+					delete(dropped, blockNID)
+				}
+			}
+			if len(snapshots) < stateCompressionBatchSize {
+				break
+			}
+			after = snapshots[len(snapshots)-1].StateSnapshotNID
+		}
+		unused := make(types.StateBlockNIDs, 0, len(dropped))
+		for blockNID := range dropped {
+			unused = append(unused, blockNID)
+		}
+		if len(unused) == 0 {
+			return nil
+		}
+		if err = d.StateBlockTable.BulkDeleteStateBlocks(ctx, txn, unused); err != nil {
+			return fmt.Errorf("d.StateBlockTable.BulkDeleteStateBlocks: %w", err)
+		}
+		result.DeletedStateBlocks = len(unused)
+		return nil
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return result, nil
+}
+
+// compressStateSnapshots compresses a batch of the room's state snapshots,
+// adding the state blocks which were dropped from them to dropped.
+func (d *Database) compressStateSnapshots(
+	ctx context.Context, txn *sql.Tx, roomID string, roomNID types.RoomNID,
+	snapshots []types.StateBlockNIDList, dropped map[types.StateBlockNID]struct{},
+	result *types.StateCompressionResult,
+) error {
+	var blockNIDs types.StateBlockNIDs
+	for _, snapshot := range snapshots {
+		blockNIDs = append(blockNIDs, snapshot.StateBlockNIDs...)
+	}
+	blockNIDs = blockNIDs[:util.SortAndUnique(blockNIDs)]
+	if len(blockNIDs) == 0 {
+		return nil
+	}
+	entryLists, err := d.stateEntries(ctx, txn, blockNIDs)
+	if err != nil {
+		return fmt.Errorf("d.stateEntries: %w", err)
+	}
+	entries := make(map[types.StateBlockNID][]types.StateEntry, len(entryLists))
+	for _, list := range entryLists {
+		entries[list.StateBlockNID] = list.StateEntries
+	}
+
+	for _, snapshot := range snapshots {
+		// Work out which state blocks the snapshot actually needs. Snapshots
+		// which need all of their state blocks are left as they are.
+		state, used := resolveStateBlocks(snapshot.StateBlockNIDs, entries)
+		needed := make(types.StateBlockNIDs, 0, len(used))
+		for _, blockNID := range snapshot.StateBlockNIDs {
+			if _, ok := used[blockNID]; ok {
+				needed = append(needed, blockNID)
+			}
+		}
+		sort.Sort(needed)
+		if len(needed) == 0 || len(needed) == len(snapshot.StateBlockNIDs) {
+			continue
+		}
+		if after, _ := resolveStateBlocks(needed, entries); !sameState(state, after) {
+			logrus.WithFields(logrus.Fields{
+				"room_id":            roomID,
+				"state_snapshot_nid": snapshot.StateSnapshotNID,
+			}).Warn("Not compressing state snapshot as it would change the state")
+			continue
+		}
+		for _, blockNID := range snapshot.StateBlockNIDs {
+			// Empty state blocks are shared by all rooms, so never delete them.
+			if _, ok := used[blockNID]; !ok && len(entries[blockNID]) > 0 {
+				dropped[blockNID] = struct{}{}
+			}
+		}
+
+		// If another snapshot has exactly the same state blocks, refer to that
+		// one instead, otherwise update the state blocks of this one.
+		into, err := d.StateSnapshotTable.SelectStateSnapshotNIDByStateBlockNIDs(ctx, txn, needed)
+		switch err {
+		case sql.ErrNoRows:
+			if err = d.StateSnapshotTable.UpdateStateBlockNIDs(ctx, txn, snapshot.StateSnapshotNID, needed); err != nil {
+				return fmt.Errorf("d.StateSnapshotTable.UpdateStateBlockNIDs: %w", err)
+			}
+			result.CompressedSnapshots++
+			continue
+		case nil:
+		default:
+			return fmt.Errorf("d.StateSnapshotTable.SelectStateSnapshotNIDByStateBlockNIDs: %w", err)
+		}
+		if err = d.EventsTable.UpdateStateSnapshotNIDs(ctx, txn, roomNID, snapshot.StateSnapshotNID, into); err != nil {
+			return fmt.Errorf("d.EventsTable.UpdateStateSnapshotNIDs: %w", err)
+		}
+		if err = d.RoomsTable.UpdateStateSnapshotNID(ctx, txn, roomNID, snapshot.StateSnapshotNID, into); err != nil {
+			return fmt.Errorf("d.RoomsTable.UpdateStateSnapshotNID: %w", err)
+		}
+		if err = d.StateSnapshotTable.DeleteStateSnapshot(ctx, txn, snapshot.StateSnapshotNID); err != nil {
+			return fmt.Errorf("d.StateSnapshotTable.DeleteStateSnapshot: %w", err)
+		}
+		result.MergedSnapshots++
+	}
+	return nil
+}
+
+// resolveStateBlocks returns the state which the given state blocks of a
+// snapshot resolve to, along with the state blocks which contribute to it.
+// As in state.LoadStateAtSnapshot, entries in later blocks overwrite entries
+// for the same state key in earlier blocks.
+func resolveStateBlocks(
+	blockNIDs []types.StateBlockNID, entries map[types.StateBlockNID][]types.StateEntry,
+) (map[types.StateKeyTuple]types.EventNID, map[types.StateBlockNID]struct{}) {
+	state := make(map[types.StateKeyTuple]types.EventNID)
+	from := make(map[types.StateKeyTuple]types.StateBlockNID)
+	for _, blockNID := range blockNIDs {
+		for _, entry := range entries[blockNID] {
+			state[entry.StateKeyTuple] = entry.EventNID
+			from[entry.StateKeyTuple] = blockNID
+		}
+	}
+	used := make(map[types.StateBlockNID]struct{}, len(from))
+	for _, blockNID := range from {
+		used[blockNID] = struct{}{}
+	}
+	return state, used
+}
+
+func sameState(a, b map[types.StateKeyTuple]types.EventNID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for tuple, eventNID := range a {
+		if other, ok := b[tuple]; !ok || other != eventNID {
+			return false
+		}
+	}
+	return true
+}
@@ -618,6 +618,12 @@ func (d *Database) IsEventRejected(ctx context.Context, roomNID types.RoomNID, e
 	return d.EventsTable.SelectEventRejected(ctx, nil, roomNID, eventID)
 }
 
+func (d *Database) EventIDByTimestamp(
+	ctx context.Context, roomNID types.RoomNID, ts gomatrixserverlib.Timestamp, backwards bool,
+) (string, gomatrixserverlib.Timestamp, error) {
+	return d.EventsTable.SelectEventIDByTimestamp(ctx, nil, roomNID, ts, backwards)
+}
+
 func (d *Database) StoreEvent(
 	ctx context.Context, event *gomatrixserverlib.Event,
 	authEventNIDs []types.EventNID, isRejected bool,
@@ -696,6 +702,7 @@ func (d *Database) storeEvent(
 			authEventNIDs,
 			event.Depth(),
 			isRejected,
+			event.OriginServerTS(),
 		); err != nil {
 			if err == sql.ErrNoRows {
 				// We've already inserted the event so select the numeric event ID
@@ -1461,6 +1468,18 @@ func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
 	})
 }
 
+// PurgeRoomCounts returns how much data purging the given room would remove.
+func (d *Database) PurgeRoomCounts(ctx context.Context, roomID string) (*tables.PurgeRoomCounts, error) {
+	roomInfo, err := d.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room info: %w", err)
+	}
+	if roomInfo == nil {
+		return nil, fmt.Errorf("room %s does not exist", roomID)
+	}
+	return d.Purge.SelectPurgeRoomCounts(ctx, nil, roomInfo.RoomNID)
+}
+
 func (d *Database) UpgradeRoom(ctx context.Context, oldRoomID, newRoomID, eventSender string) error {
 
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
@@ -27,6 +27,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3/deltas"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
 )
@@ -43,13 +44,14 @@ const eventsSchema = `
     event_id TEXT NOT NULL UNIQUE,
     reference_sha256 BLOB NOT NULL,
 	auth_event_nids TEXT NOT NULL DEFAULT '[]',
-	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+	is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+	origin_server_ts INTEGER NOT NULL DEFAULT 0
   );
 `
 
 const insertEventSQL = `
-	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected)
-	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected, origin_server_ts)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 	  ON CONFLICT DO UPDATE
 	  SET is_rejected = $8 WHERE is_rejected = 1
 	  RETURNING event_nid, state_snapshot_nid;
@@ -90,6 +92,9 @@ const bulkSelectStateAtEventByIDSQL = "" +
 const updateEventStateSQL = "" +
 	"UPDATE roomserver_events SET state_snapshot_nid = $1 WHERE event_nid = $2"
 
+const updateStateSnapshotNIDsSQL = "" +
+	"UPDATE roomserver_events SET state_snapshot_nid = $1 WHERE room_nid = $2 AND state_snapshot_nid = $3"
+
 const selectEventSentToOutputSQL = "" +
 	"SELECT sent_to_output FROM roomserver_events WHERE event_nid = $1"
 
@@ -124,6 +129,18 @@ const selectRoomNIDsForEventNIDsSQL = "" +
 const selectEventRejectedSQL = "" +
 	"SELECT is_rejected FROM roomserver_events WHERE room_nid = $1 AND event_id = $2"
 
+// Selects the first non-outlier, non-rejected event sent at or after the given timestamp.
+const selectEventIDAfterTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts >= $2 AND state_snapshot_nid != 0 AND is_rejected = FALSE" +
+	" ORDER BY origin_server_ts ASC, event_nid ASC LIMIT 1"
+
+// Selects the last non-outlier, non-rejected event sent at or before the given timestamp.
+const selectEventIDBeforeTimestampSQL = "" +
+	"SELECT event_id, origin_server_ts FROM roomserver_events" +
+	" WHERE room_nid = $1 AND origin_server_ts <= $2 AND state_snapshot_nid != 0 AND is_rejected = FALSE" +
+	" ORDER BY origin_server_ts DESC, event_nid DESC LIMIT 1"
+
 type eventStatements struct {
 	db                                            *sql.DB
 	insertEventStmt                               *sql.Stmt
@@ -133,6 +150,7 @@ type eventStatements struct {
 	bulkSelectStateEventByIDExcludingRejectedStmt *sql.Stmt
 	bulkSelectStateAtEventByIDStmt                *sql.Stmt
 	updateEventStateStmt                          *sql.Stmt
+	updateStateSnapshotNIDsStmt                   *sql.Stmt
 	selectEventSentToOutputStmt                   *sql.Stmt
 	updateEventSentToOutputStmt                   *sql.Stmt
 	selectEventIDStmt                             *sql.Stmt
@@ -140,6 +158,8 @@ type eventStatements struct {
 	bulkSelectEventReferenceStmt                  *sql.Stmt
 	bulkSelectEventIDStmt                         *sql.Stmt
 	selectEventRejectedStmt                       *sql.Stmt
+	selectEventIDAfterTimestampStmt               *sql.Stmt
+	selectEventIDBeforeTimestampStmt              *sql.Stmt
 	//bulkSelectEventNIDStmt               *sql.Stmt
 	//bulkSelectUnsentEventNIDStmt         *sql.Stmt
 	//selectRoomNIDsForEventNIDsStmt       *sql.Stmt
@@ -147,7 +167,16 @@ type eventStatements struct {
 
 func CreateEventsTable(db *sql.DB) error {
 	_, err := db.Exec(eventsSchema)
-	return err
+	if err != nil {
+		return err
+	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "roomserver: add events origin_server_ts",
+		Up:      deltas.UpEventsOriginServerTS,
+		Down:    deltas.DownEventsOriginServerTS,
+	})
+	return m.Up(context.Background())
 }
 
 func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
@@ -163,6 +192,7 @@ func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectStateEventByIDExcludingRejectedStmt, bulkSelectStateEventByIDExcludingRejectedSQL},
 		{&s.bulkSelectStateAtEventByIDStmt, bulkSelectStateAtEventByIDSQL},
 		{&s.updateEventStateStmt, updateEventStateSQL},
+		{&s.updateStateSnapshotNIDsStmt, updateStateSnapshotNIDsSQL},
 		{&s.updateEventSentToOutputStmt, updateEventSentToOutputSQL},
 		{&s.selectEventSentToOutputStmt, selectEventSentToOutputSQL},
 		{&s.selectEventIDStmt, selectEventIDSQL},
@@ -173,6 +203,8 @@ func PrepareEventsTable(db *sql.DB) (tables.Events, error) {
 		//{&s.bulkSelectUnsentEventNIDStmt, bulkSelectUnsentEventNIDSQL},
 		//{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
 		{&s.selectEventRejectedStmt, selectEventRejectedSQL},
+		{&s.selectEventIDAfterTimestampStmt, selectEventIDAfterTimestampSQL},
+		{&s.selectEventIDBeforeTimestampStmt, selectEventIDBeforeTimestampSQL},
 	}.Prepare(db)
 }
 
@@ -187,6 +219,7 @@ func (s *eventStatements) InsertEvent(
 	authEventNIDs []types.EventNID,
 	depth int64,
 	isRejected bool,
+	originServerTS gomatrixserverlib.Timestamp,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	// attempt to insert: the last_row_id is the event NID
 	var eventNID int64
@@ -194,7 +227,7 @@ func (s *eventStatements) InsertEvent(
 	insertStmt := sqlutil.TxStmt(txn, s.insertEventStmt)
 	err := insertStmt.QueryRowContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
-		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, isRejected,
+		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, isRejected, originServerTS,
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -423,6 +456,14 @@ func (s *eventStatements) UpdateEventState(
 	return err
 }
 
+func (s *eventStatements) UpdateStateSnapshotNIDs(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, oldStateNID, newStateNID types.StateSnapshotNID,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateStateSnapshotNIDsStmt)
+	_, err := stmt.ExecContext(ctx, int64(newStateNID), int64(roomNID), int64(oldStateNID))
+	return err
+}
+
 func (s *eventStatements) SelectEventSentToOutput(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
 ) (sentToOutput bool, err error) {
@@ -686,3 +727,14 @@ func (s *eventStatements) SelectEventRejected(
 	err = stmt.QueryRowContext(ctx, roomNID, eventID).Scan(&rejected)
 	return
 }
+
+func (s *eventStatements) SelectEventIDByTimestamp(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, ts gomatrixserverlib.Timestamp, backwards bool,
+) (eventID string, originServerTS gomatrixserverlib.Timestamp, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectEventIDAfterTimestampStmt)
+	if backwards {
+		stmt = sqlutil.TxStmt(txn, s.selectEventIDBeforeTimestampStmt)
+	}
+	err = stmt.QueryRowContext(ctx, roomNID, ts).Scan(&eventID, &originServerTS)
+	return
+}
@@ -65,11 +65,29 @@ const bulkSelectStateBlockNIDsSQL = "" +
 const selectStateBlockNIDsForRoomNID = "" +
 	"SELECT state_block_nids FROM roomserver_state_snapshots WHERE room_nid = $1"
 
+const selectStateSnapshotsForRoomSQL = "" +
+	"SELECT state_snapshot_nid, state_block_nids FROM roomserver_state_snapshots" +
+	" WHERE room_nid = $1 AND state_snapshot_nid > $2 ORDER BY state_snapshot_nid ASC LIMIT $3"
+
+const selectStateSnapshotNIDByHashSQL = "" +
+	"SELECT state_snapshot_nid FROM roomserver_state_snapshots WHERE state_snapshot_hash = $1"
+
+const updateStateBlockNIDsSQL = "" +
+	"UPDATE roomserver_state_snapshots SET state_snapshot_hash = $1, state_block_nids = $2" +
+	" WHERE state_snapshot_nid = $3"
+
+const deleteStateSnapshotSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE state_snapshot_nid = $1"
+
 type stateSnapshotStatements struct {
-	db                           *sql.DB
-	insertStateStmt              *sql.Stmt
-	bulkSelectStateBlockNIDsStmt *sql.Stmt
-	selectStateBlockNIDsStmt     *sql.Stmt
+	db                               *sql.DB
+	insertStateStmt                  *sql.Stmt
+	bulkSelectStateBlockNIDsStmt     *sql.Stmt
+	selectStateBlockNIDsStmt         *sql.Stmt
+	selectStateSnapshotsStmt         *sql.Stmt
+	selectStateSnapshotNIDByHashStmt *sql.Stmt
+	updateStateBlockNIDsStmt         *sql.Stmt
+	deleteStateSnapshotStmt          *sql.Stmt
 }
 
 func CreateStateSnapshotTable(db *sql.DB) error {
@@ -86,6 +104,10 @@ func PrepareStateSnapshotTable(db *sql.DB) (*stateSnapshotStatements, error) {
 		{&s.insertStateStmt, insertStateSQL},
 		{&s.bulkSelectStateBlockNIDsStmt, bulkSelectStateBlockNIDsSQL},
 		{&s.selectStateBlockNIDsStmt, selectStateBlockNIDsForRoomNID},
+		{&s.selectStateSnapshotsStmt, selectStateSnapshotsForRoomSQL},
+		{&s.selectStateSnapshotNIDByHashStmt, selectStateSnapshotNIDByHashSQL},
+		{&s.updateStateBlockNIDsStmt, updateStateBlockNIDsSQL},
+		{&s.deleteStateSnapshotStmt, deleteStateSnapshotSQL},
 	}.Prepare(db)
 }
 
@@ -177,3 +199,56 @@ func (s *stateSnapshotStatements) selectStateBlockNIDsForRoomNID(
 
 	return res, rows.Err()
 }
+
+func (s *stateSnapshotStatements) SelectStateSnapshotsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, afterStateNID types.StateSnapshotNID, limit int,
+) ([]types.StateBlockNIDList, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectStateSnapshotsStmt).QueryContext(ctx, int64(roomNID), int64(afterStateNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectStateSnapshotsForRoom: rows.close() failed")
+
+	var results []types.StateBlockNIDList
+	var stateBlockNIDsJSON string
+	for rows.Next() {
+		var result types.StateBlockNIDList
+		if err = rows.Scan(&result.StateSnapshotNID, &stateBlockNIDsJSON); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(stateBlockNIDsJSON), &result.StateBlockNIDs); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *stateSnapshotStatements) SelectStateSnapshotNIDByStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, nids types.StateBlockNIDs,
+) (stateNID types.StateSnapshotNID, err error) {
+	nids = nids[:util.SortAndUnique(nids)]
+	err = sqlutil.TxStmt(txn, s.selectStateSnapshotNIDByHashStmt).QueryRowContext(ctx, nids.Hash()).Scan(&stateNID)
+	return
+}
+
+func (s *stateSnapshotStatements) UpdateStateBlockNIDs(
+	ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID, stateBlockNIDs types.StateBlockNIDs,
+) error {
+	stateBlockNIDs = stateBlockNIDs[:util.SortAndUnique(stateBlockNIDs)]
+	stateBlockNIDsJSON, err := json.Marshal(stateBlockNIDs)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.updateStateBlockNIDsStmt).ExecContext(
+		ctx, stateBlockNIDs.Hash(), string(stateBlockNIDsJSON), int64(stateNID),
+	)
+	return err
+}
+
+func (s *stateSnapshotStatements) DeleteStateSnapshot(
+	ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteStateSnapshotStmt).ExecContext(ctx, int64(stateNID))
+	return err
+}
@@ -25,10 +25,14 @@ func mustCreateEventsTable(t *testing.T, dbType test.DBType) (tables.Events, fun
 	var tab tables.Events
 	switch dbType {
 	case test.DBTypePostgres:
+		err = postgres.CreateEventJSONTable(db)
+		assert.NoError(t, err)
 		err = postgres.CreateEventsTable(db)
 		assert.NoError(t, err)
 		tab, err = postgres.PrepareEventsTable(db)
 	case test.DBTypeSQLite:
+		err = sqlite3.CreateEventJSONTable(db)
+		assert.NoError(t, err)
 		err = sqlite3.CreateEventsTable(db)
 		assert.NoError(t, err)
 		tab, err = sqlite3.PrepareEventsTable(db)
@@ -51,7 +55,7 @@ func Test_EventsTable(t *testing.T) {
 		wantEventReferences := make([]gomatrixserverlib.EventReference, 0, len(room.Events()))
 		wantStateAtEventAndRefs := make([]types.StateAtEventAndReference, 0, len(room.Events()))
 		for _, ev := range room.Events() {
-			eventNID, snapNID, err := tab.InsertEvent(ctx, nil, 1, 1, 1, ev.EventID(), ev.EventReference().EventSHA256, nil, ev.Depth(), false)
+			eventNID, snapNID, err := tab.InsertEvent(ctx, nil, 1, 1, 1, ev.EventID(), ev.EventReference().EventSHA256, nil, ev.Depth(), false, ev.OriginServerTS())
 			assert.NoError(t, err)
 			gotEventNID, gotSnapNID, err := tab.SelectEvent(ctx, nil, ev.EventID())
 			assert.NoError(t, err)
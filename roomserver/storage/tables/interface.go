@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"regexp"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/tidwall/gjson"
@@ -42,6 +43,7 @@ type Events interface {
 		ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventTypeNID types.EventTypeNID,
 		eventStateKeyNID types.EventStateKeyNID, eventID string,
 		referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64, isRejected bool,
+		originServerTS gomatrixserverlib.Timestamp,
 	) (types.EventNID, types.StateSnapshotNID, error)
 	SelectEvent(ctx context.Context, txn *sql.Tx, eventID string) (types.EventNID, types.StateSnapshotNID, error)
 	BulkSelectSnapshotsFromEventIDs(ctx context.Context, txn *sql.Tx, eventIDs []string) (map[types.StateSnapshotNID][]string, error)
@@ -54,6 +56,8 @@ type Events interface {
 	// If we do not have the state for any of the requested events it returns a types.MissingEventError.
 	BulkSelectStateAtEventByID(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.StateAtEvent, error)
 	UpdateEventState(ctx context.Context, txn *sql.Tx, eventNID types.EventNID, stateNID types.StateSnapshotNID) error
+	// UpdateStateSnapshotNIDs points all events in the room which refer to the old state snapshot at the new one.
+	UpdateStateSnapshotNIDs(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, oldStateNID, newStateNID types.StateSnapshotNID) error
 	SelectEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (sentToOutput bool, err error)
 	UpdateEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error
 	SelectEventID(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) (eventID string, err error)
@@ -68,6 +72,10 @@ type Events interface {
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDsForEventNIDs(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (roomNIDs map[types.EventNID]types.RoomNID, err error)
 	SelectEventRejected(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventID string) (rejected bool, err error)
+	// SelectEventIDByTimestamp returns the event in the room sent closest to the given timestamp,
+	// either at or after it, or at or before it if backwards is set. Returns sql.ErrNoRows if
+	// there is no such event.
+	SelectEventIDByTimestamp(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, ts gomatrixserverlib.Timestamp, backwards bool) (eventID string, originServerTS gomatrixserverlib.Timestamp, err error)
 }
 
 type Rooms interface {
@@ -77,6 +85,8 @@ type Rooms interface {
 	SelectLatestEventNIDs(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) ([]types.EventNID, types.StateSnapshotNID, error)
 	SelectLatestEventsNIDsForUpdate(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) ([]types.EventNID, types.EventNID, types.StateSnapshotNID, error)
 	UpdateLatestEventNIDs(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, eventNIDs []types.EventNID, lastEventSentNID types.EventNID, stateSnapshotNID types.StateSnapshotNID) error
+	// UpdateStateSnapshotNID sets the current state snapshot of the room to the new one, if it is currently the old one.
+	UpdateStateSnapshotNID(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, oldStateNID, newStateNID types.StateSnapshotNID) error
 	SelectRoomVersionsForRoomNIDs(ctx context.Context, txn *sql.Tx, roomNID []types.RoomNID) (map[types.RoomNID]gomatrixserverlib.RoomVersion, error)
 	SelectRoomInfo(ctx context.Context, txn *sql.Tx, roomID string) (*types.RoomInfo, error)
 	SelectRoomIDsWithEvents(ctx context.Context, txn *sql.Tx) ([]string, error)
@@ -91,11 +101,22 @@ type StateSnapshot interface {
 	// which users are in a room faster than having to load the entire room state. In the
 	// case of SQLite, this will return tables.OptimisationNotSupportedError.
 	BulkSelectStateForHistoryVisibility(ctx context.Context, txn *sql.Tx, stateSnapshotNID types.StateSnapshotNID, domain string) ([]types.EventNID, error)
+	// SelectStateSnapshotsForRoom returns the state blocks of up to limit state snapshots in the room after
+	// the given state snapshot NID, ordered by state snapshot NID.
+	SelectStateSnapshotsForRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, afterStateNID types.StateSnapshotNID, limit int) ([]types.StateBlockNIDList, error)
+	// SelectStateSnapshotNIDByStateBlockNIDs returns the state snapshot with exactly the given state blocks,
+	// or sql.ErrNoRows if there isn't one.
+	SelectStateSnapshotNIDByStateBlockNIDs(ctx context.Context, txn *sql.Tx, stateBlockNIDs types.StateBlockNIDs) (types.StateSnapshotNID, error)
+	// UpdateStateBlockNIDs replaces the state blocks of a state snapshot. The caller must make sure
+	// that the state which the new blocks encode is the same as before.
+	UpdateStateBlockNIDs(ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID, stateBlockNIDs types.StateBlockNIDs) error
+	DeleteStateSnapshot(ctx context.Context, txn *sql.Tx, stateNID types.StateSnapshotNID) error
 }
 
 type StateBlock interface {
 	BulkInsertStateData(ctx context.Context, txn *sql.Tx, entries types.StateEntries) (types.StateBlockNID, error)
 	BulkSelectStateBlockEntries(ctx context.Context, txn *sql.Tx, stateBlockNIDs types.StateBlockNIDs) ([][]types.EventNID, error)
+	BulkDeleteStateBlocks(ctx context.Context, txn *sql.Tx, stateBlockNIDs types.StateBlockNIDs) error
 	//BulkSelectFilteredStateBlockEntries(ctx context.Context, stateBlockNIDs []types.StateBlockNID, stateKeyTuples []types.StateKeyTuple) ([]types.StateEntryList, error)
 }
 
@@ -178,6 +199,34 @@ type Purge interface {
 	PurgeRoom(
 		ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, roomID string,
 	) error
+	// SelectPurgeRoomCounts returns how much data purging the given room would remove.
+	SelectPurgeRoomCounts(
+		ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+	) (*PurgeRoomCounts, error)
+}
+
+// PurgeRoomCounts describes the amount of data stored for a room.
+type PurgeRoomCounts struct {
+	Events         int64
+	StateEvents    int64
+	StateSnapshots int64
+	// MediaEvents is the number of events which reference media, see
+	// ReferencesMedia.
+	MediaEvents int64
+}
+
+var mxcURIRegex = regexp.MustCompile(`^mxc://[^/]+/[^/]+$`)
+
+// ReferencesMedia returns true if the given event JSON has an mxc:// URI in
+// one of the content keys which refer to media, rather than just mentioning
+// one, e.g. in the body of a message.
+func ReferencesMedia(eventJSON []byte) bool {
+	for _, key := range []string{"content.url", "content.info.thumbnail_url", "content.avatar_url"} {
+		if mxcURIRegex.MatchString(gjson.GetBytes(eventJSON, key).Str) {
+			return true
+		}
+	}
+	return false
 }
 
 // StrippedEvent represents a stripped event for returning extracted content values.
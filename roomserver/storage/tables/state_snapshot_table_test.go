@@ -2,6 +2,7 @@ package tables_test
 
 import (
 	"context"
+	"database/sql"
 	"testing"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -93,3 +94,52 @@ func TestStateSnapshotTable(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestStateSnapshotTableUpdateAndDelete(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateStateSnapshotTable(t, dbType)
+		defer close()
+
+		stateNID1, err := tab.InsertState(ctx, nil, 1, types.StateBlockNIDs{1, 2, 3})
+		assert.NoError(t, err)
+		stateNID2, err := tab.InsertState(ctx, nil, 1, types.StateBlockNIDs{1, 4})
+		assert.NoError(t, err)
+		_, err = tab.InsertState(ctx, nil, 2, types.StateBlockNIDs{5})
+		assert.NoError(t, err)
+
+		snapshots, err := tab.SelectStateSnapshotsForRoom(ctx, nil, 1, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []types.StateBlockNIDList{
+			{StateSnapshotNID: stateNID1, StateBlockNIDs: []types.StateBlockNID{1, 2, 3}},
+			{StateSnapshotNID: stateNID2, StateBlockNIDs: []types.StateBlockNID{1, 4}},
+		}, snapshots)
+		snapshots, err = tab.SelectStateSnapshotsForRoom(ctx, nil, 1, stateNID1, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, []types.StateBlockNIDList{
+			{StateSnapshotNID: stateNID2, StateBlockNIDs: []types.StateBlockNID{1, 4}},
+		}, snapshots)
+
+		stateNID, err := tab.SelectStateSnapshotNIDByStateBlockNIDs(ctx, nil, types.StateBlockNIDs{4, 1})
+		assert.NoError(t, err)
+		assert.Equal(t, stateNID2, stateNID)
+		_, err = tab.SelectStateSnapshotNIDByStateBlockNIDs(ctx, nil, types.StateBlockNIDs{1, 3})
+		assert.Equal(t, sql.ErrNoRows, err)
+
+		// Updating the state blocks also updates the hash, so inserting the
+		// new state blocks returns the updated snapshot.
+		err = tab.UpdateStateBlockNIDs(ctx, nil, stateNID1, types.StateBlockNIDs{3, 1})
+		assert.NoError(t, err)
+		stateNID, err = tab.InsertState(ctx, nil, 1, types.StateBlockNIDs{1, 3})
+		assert.NoError(t, err)
+		assert.Equal(t, stateNID1, stateNID)
+
+		err = tab.DeleteStateSnapshot(ctx, nil, stateNID2)
+		assert.NoError(t, err)
+		snapshots, err = tab.SelectStateSnapshotsForRoom(ctx, nil, 1, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, []types.StateBlockNIDList{
+			{StateSnapshotNID: stateNID1, StateBlockNIDs: []types.StateBlockNID{1, 3}},
+		}, snapshots)
+	})
+}
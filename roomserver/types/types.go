@@ -323,3 +323,14 @@ func (r *RoomInfo) CopyFrom(r2 *RoomInfo) {
 	r.stateSnapshotNID = r2.stateSnapshotNID
 	r.isStub = r2.isStub
 }
+
+// StateCompressionResult reports how much redundant state was removed from a
+// room when compressing its state.
+type StateCompressionResult struct {
+	// The number of state snapshots whose redundant state blocks were dropped.
+	CompressedSnapshots int `json:"compressed_snapshots"`
+	// The number of state snapshots which were merged into an identical one.
+	MergedSnapshots int `json:"merged_snapshots"`
+	// The number of state blocks which were deleted as nothing used them.
+	DeletedStateBlocks int `json:"deleted_state_blocks"`
+}
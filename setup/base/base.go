@@ -92,6 +92,7 @@ type BaseDendrite struct {
 	DatabaseWriter         sqlutil.Writer
 	EnableMetrics          bool
 	Fulltext               *fulltext.Search
+	BackgroundUpdates      *sqlutil.BackgroundUpdates
 	startupLock            sync.Mutex
 }
 
@@ -238,13 +239,14 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, options ...Base
 	// are not inadvertently reading paths without cleaning, else this could introduce a
 	// directory traversal attack e.g /../../../etc/passwd
 
+	processCtx := process.NewProcessContext()
 	return &BaseDendrite{
-		ProcessContext:         process.NewProcessContext(),
+		ProcessContext:         processCtx,
 		componentName:          componentName,
 		UseHTTPAPIs:            useHTTPAPIs,
 		tracerCloser:           closer,
 		Cfg:                    cfg,
-		Caches:                 caching.NewRistrettoCache(cfg.Global.Cache.EstimatedMaxSize, cfg.Global.Cache.MaxAge, enableMetrics),
+		Caches:                 caching.NewCaches(&cfg.Global.Cache, enableMetrics),
 		DNSCache:               dnsCache,
 		PublicClientAPIMux:     mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicClientPathPrefix).Subrouter().UseEncodedPath(),
 		PublicFederationAPIMux: mux.NewRouter().SkipClean(true).PathPrefix(httputil.PublicFederationPathPrefix).Subrouter().UseEncodedPath(),
@@ -260,9 +262,28 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, options ...Base
 		DatabaseWriter:         writer, // set if monolith with global connection pool only
 		EnableMetrics:          enableMetrics,
 		Fulltext:               fts,
+		BackgroundUpdates:      sqlutil.NewBackgroundUpdates(processCtx),
 	}
 }
 
+// withRetryAfter adds a transport to the given client options which retries
+// rate-limited requests, if enabled. The retries wrap the given transport or,
+// if there isn't one, the default transport of a client with the same options.
+func (b *BaseDendrite) withRetryAfter(opts []gomatrixserverlib.ClientOption, transport http.RoundTripper) []gomatrixserverlib.ClientOption {
+	cfg := &b.Cfg.Global.RetryAfter
+	if transport == nil {
+		if !cfg.Enabled {
+			return opts
+		}
+		// The inner client handles timeouts through the outer client.
+		inner := gomatrixserverlib.NewClient(
+			append(append([]gomatrixserverlib.ClientOption{}, opts...), gomatrixserverlib.WithTimeout(0))...,
+		)
+		transport = clientRoundTripper{inner}
+	}
+	return append(opts, gomatrixserverlib.WithTransport(httputil.NewRetryAfterTransport(transport, cfg)))
+}
+
 // Close implements io.Closer
 func (b *BaseDendrite) Close() error {
 	b.ProcessContext.ShutdownDendrite()
@@ -341,7 +362,7 @@ func (b *BaseDendrite) KeyServerHTTPClient() keyserverAPI.KeyInternalAPI {
 
 // PushGatewayHTTPClient returns a new client for interacting with (external) Push Gateways.
 func (b *BaseDendrite) PushGatewayHTTPClient() pushgateway.Client {
-	return pushgateway.NewHTTPClient(b.Cfg.UserAPI.PushGatewayDisableTLSValidation)
+	return pushgateway.NewHTTPClient(b.Cfg.UserAPI.PushGatewayDisableTLSValidation, &b.Cfg.Global.RetryAfter)
 }
 
 // CreateClient creates a new client (normally used for media fetch requests).
@@ -359,11 +380,19 @@ func (b *BaseDendrite) CreateClient() *gomatrixserverlib.Client {
 	if b.Cfg.Global.DNSCache.Enabled {
 		opts = append(opts, gomatrixserverlib.WithDNSCache(b.DNSCache))
 	}
-	client := gomatrixserverlib.NewClient(opts...)
-	client.SetUserAgent(fmt.Sprintf("Dendrite/%s", internal.VersionString()))
+	client := gomatrixserverlib.NewClient(b.withRetryAfter(opts, nil)...)
+	client.SetUserAgent(b.userAgent())
 	return client
 }
 
+// userAgent returns the User-Agent header to send with requests to other servers.
+func (b *BaseDendrite) userAgent() string {
+	if b.Cfg.FederationAPI.UserAgent != "" {
+		return b.Cfg.FederationAPI.UserAgent
+	}
+	return fmt.Sprintf("Dendrite/%s", internal.VersionString())
+}
+
 // CreateFederationClient creates a new federation client. Should only be called
 // once per component.
 func (b *BaseDendrite) CreateFederationClient() *gomatrixserverlib.FederationClient {
@@ -381,10 +410,32 @@ func (b *BaseDendrite) CreateFederationClient() *gomatrixserverlib.FederationCli
 	if b.Cfg.Global.DNSCache.Enabled {
 		opts = append(opts, gomatrixserverlib.WithDNSCache(b.DNSCache))
 	}
+	if len(b.Cfg.FederationAPI.DestinationTLS) > 0 {
+		// The fallback client handles timeouts through the outer client.
+		fallback := gomatrixserverlib.NewClient(
+			append(opts, gomatrixserverlib.WithWellKnownSRVLookups(true), gomatrixserverlib.WithTimeout(0))...,
+		)
+		var dnsCache *gomatrixserverlib.DNSCache
+		if b.Cfg.Global.DNSCache.Enabled {
+			dnsCache = b.DNSCache
+		}
+		transport, err := newDestinationTLSTransport(
+			b.Cfg.FederationAPI.DestinationTLS,
+			b.Cfg.FederationAPI.DisableTLSValidation,
+			!b.Cfg.FederationAPI.DisableHTTPKeepalives,
+			dnsCache, clientRoundTripper{fallback},
+		)
+		if err != nil {
+			logrus.WithError(err).Panic("failed to set up federation destination TLS")
+		}
+		opts = b.withRetryAfter(opts, transport)
+	} else {
+		opts = b.withRetryAfter(opts, nil)
+	}
 	client := gomatrixserverlib.NewFederationClient(
 		identities, opts...,
 	)
-	client.SetUserAgent(fmt.Sprintf("Dendrite/%s", internal.VersionString()))
+	client.SetUserAgent(b.userAgent())
 	return client
 }
 
@@ -0,0 +1,53 @@
+package base
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestFederationClientUserAgent(t *testing.T) {
+	var gotUserAgent string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUserAgent = r.Header.Get("User-Agent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	tests := []struct {
+		name      string
+		userAgent string
+		want      string
+	}{
+		{name: "default", want: "Dendrite/" + internal.VersionString()},
+		{name: "configured", userAgent: "Example/1.0 (+https://example.com)", want: "Example/1.0 (+https://example.com)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Dendrite{}
+			cfg.Defaults(config.DefaultOpts{Monolithic: true})
+			cfg.FederationAPI.DisableTLSValidation = true
+			cfg.FederationAPI.UserAgent = tt.userAgent
+			b := &BaseDendrite{Cfg: cfg}
+
+			req, err := http.NewRequest(http.MethodGet, "matrix://"+host+"/_matrix/federation/v1/version", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := b.CreateFederationClient().DoHTTPRequest(context.Background(), req)
+			if err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+			_ = res.Body.Close()
+			if gotUserAgent != tt.want {
+				t.Fatalf("expected User-Agent %q, got %q", tt.want, gotUserAgent)
+			}
+		})
+	}
+}
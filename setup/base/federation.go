@@ -2,9 +2,19 @@ package base
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/setup/config"
 )
 
 // noOpHTTPTransport is used to disable federation.
@@ -30,3 +40,171 @@ type noOpHTTPRoundTripper struct {
 func (y *noOpHTTPRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
 	return nil, fmt.Errorf("federation prohibited by configuration")
 }
+
+// destinationTLSTransport sends federation requests for destinations with
+// custom TLS settings (client certificates, CAs, SNI) itself, and passes all
+// other requests on to the fallback transport.
+type destinationTLSTransport struct {
+	fallback     http.RoundTripper
+	destinations map[gomatrixserverlib.ServerName]*destinationTLSTripper
+}
+
+// destinationTLSTripper holds the TLS configuration for a single destination
+// and the transports created from it, one per TLS server name.
+type destinationTLSTripper struct {
+	tlsConfig       *tls.Config
+	keepAlives      bool
+	dnsCache        *gomatrixserverlib.DNSCache
+	transports      map[string]*http.Transport
+	transportsMutex sync.Mutex
+	resolution      []gomatrixserverlib.ResolutionResult
+	resolutionTime  time.Time
+	resolutionMutex sync.Mutex
+}
+
+// resolutionCacheDuration is how long the resolved addresses of a destination
+// are used for before they are resolved again, so that changes to its DNS
+// records or .well-known are picked up.
+const resolutionCacheDuration = time.Hour
+
+func newDestinationTLSTransport(
+	cfgs []config.DestinationTLS, skipVerify, keepAlives bool,
+	dnsCache *gomatrixserverlib.DNSCache, fallback http.RoundTripper,
+) (*destinationTLSTransport, error) {
+	t := &destinationTLSTransport{
+		fallback:     fallback,
+		destinations: make(map[gomatrixserverlib.ServerName]*destinationTLSTripper, len(cfgs)),
+	}
+	for _, cfg := range cfgs {
+		tlsConfig := &tls.Config{
+			ServerName:         cfg.SNI,
+			InsecureSkipVerify: skipVerify,
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		}
+		if cfg.ClientCertificatePath != "" {
+			cert, err := tls.LoadX509KeyPair(string(cfg.ClientCertificatePath), string(cfg.ClientPrivateKeyPath))
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate for %q: %w", cfg.ServerName, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		if cfg.CACertificatePath != "" {
+			pem, err := os.ReadFile(string(cfg.CACertificatePath))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA certificate for %q: %w", cfg.ServerName, err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no CA certificates found for %q in %q", cfg.ServerName, cfg.CACertificatePath)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		t.destinations[cfg.ServerName] = &destinationTLSTripper{
+			tlsConfig:  tlsConfig,
+			keepAlives: keepAlives,
+			dnsCache:   dnsCache,
+			transports: make(map[string]*http.Transport),
+		}
+	}
+	return t, nil
+}
+
+func (t *destinationTLSTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if d, ok := t.destinations[gomatrixserverlib.ServerName(req.URL.Host)]; ok {
+		return d.RoundTrip(req)
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+// getTransport returns the transport for the given TLS server name, creating
+// it if needed. The SNI override, if any, takes precedence over the name.
+func (d *destinationTLSTripper) getTransport(tlsServerName string) *http.Transport {
+	d.transportsMutex.Lock()
+	defer d.transportsMutex.Unlock()
+	if d.tlsConfig.ServerName != "" {
+		tlsServerName = d.tlsConfig.ServerName
+	}
+	transport, ok := d.transports[tlsServerName]
+	if !ok {
+		tlsConfig := d.tlsConfig.Clone()
+		tlsConfig.ServerName = tlsServerName
+		dialer := &net.Dialer{Timeout: time.Second * 5}
+		transport = &http.Transport{
+			DisableKeepAlives:   !d.keepAlives,
+			MaxIdleConnsPerHost: 1,
+			IdleConnTimeout:     time.Minute * 5,
+			TLSClientConfig:     tlsConfig,
+			DialContext:         dialer.DialContext,
+			Proxy:               http.ProxyFromEnvironment,
+			ForceAttemptHTTP2:   true,
+		}
+		if d.dnsCache != nil {
+			transport.DialContext = d.dnsCache.DialContext
+		}
+		d.transports[tlsServerName] = transport
+	}
+	return transport
+}
+
+func (d *destinationTLSTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	results, err := d.resolve(req.Context(), gomatrixserverlib.ServerName(req.URL.Host))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, result := range results {
+		r := req.Clone(req.Context())
+		r.URL.Scheme = "https"
+		r.URL.Host = result.Destination
+		r.Host = string(result.Host)
+		var resp *http.Response
+		if resp, err = d.getTransport(result.TLSServerName).RoundTrip(r); err == nil {
+			return resp, nil
+		}
+		util.GetLogger(req.Context()).Debugf("Error sending request to %s: %v", r.URL.String(), err)
+	}
+	// None of the resolved addresses worked, so resolve again next time.
+	d.resolutionMutex.Lock()
+	d.resolution = nil
+	d.resolutionMutex.Unlock()
+	return nil, err
+}
+
+// resolve returns the addresses of the destination, resolving them again if
+// they were resolved more than resolutionCacheDuration ago.
+func (d *destinationTLSTripper) resolve(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]gomatrixserverlib.ResolutionResult, error) {
+	d.resolutionMutex.Lock()
+	results := d.resolution
+	if time.Since(d.resolutionTime) > resolutionCacheDuration {
+		results = nil
+	}
+	d.resolutionMutex.Unlock()
+	if results != nil {
+		return results, nil
+	}
+
+	results, err := gomatrixserverlib.ResolveServer(ctx, serverName)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no address found for matrix host %v", serverName)
+	}
+	d.resolutionMutex.Lock()
+	d.resolution = results
+	d.resolutionTime = time.Now()
+	d.resolutionMutex.Unlock()
+	return results, nil
+}
+
+// clientRoundTripper adapts a gomatrixserverlib.Client, which understands
+// matrix:// URLs, into an http.RoundTripper.
+type clientRoundTripper struct {
+	client *gomatrixserverlib.Client
+}
+
+func (c clientRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.client.DoHTTPRequest(req.Context(), req)
+}
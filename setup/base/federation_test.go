@@ -0,0 +1,163 @@
+package base
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+type recordingRoundTripper struct {
+	hosts []string
+}
+
+func (r *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.hosts = append(r.hosts, req.URL.Host)
+	return nil, fmt.Errorf("fallback transport")
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDestinationTLSTransport_ClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+
+	// Create a self-signed client certificate.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dendrite-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writePEM(t, certPath, "CERTIFICATE", certDER)
+	writePEM(t, keyPath, "PRIVATE KEY", keyDER)
+
+	// Start a server which requires that client certificate.
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	var gotSNI string
+	var gotClientCN string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			gotClientCN = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			gotSNI = hello.ServerName
+			return nil, nil
+		},
+	}
+	srv.StartTLS()
+	defer srv.Close()
+	caPath := filepath.Join(dir, "ca.crt")
+	writePEM(t, caPath, "CERTIFICATE", srv.Certificate().Raw)
+
+	destination := gomatrixserverlib.ServerName(strings.TrimPrefix(srv.URL, "https://"))
+	fallback := &recordingRoundTripper{}
+	transport, err := newDestinationTLSTransport([]config.DestinationTLS{
+		{
+			ServerName:            destination,
+			ClientCertificatePath: config.Path(certPath),
+			ClientPrivateKeyPath:  config.Path(keyPath),
+			CACertificatePath:     config.Path(caPath),
+			SNI:                   "example.com",
+		},
+	}, false, true, nil, fallback)
+	if err != nil {
+		t.Fatalf("failed to create transport: %s", err)
+	}
+	client := gomatrixserverlib.NewClient(gomatrixserverlib.WithTransport(transport))
+
+	req, err := http.NewRequest(http.MethodGet, "matrix://"+string(destination)+"/_matrix/federation/v1/version", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.DoHTTPRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("request to configured destination failed: %s", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected HTTP %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	if gotClientCN != "dendrite-client" {
+		t.Fatalf("expected the configured client certificate to be used, got %q", gotClientCN)
+	}
+	if gotSNI != "example.com" {
+		t.Fatalf("expected SNI %q, got %q", "example.com", gotSNI)
+	}
+	if len(fallback.hosts) != 0 {
+		t.Fatalf("expected the fallback transport not to be used, got %v", fallback.hosts)
+	}
+
+	// Resolved addresses are only used until they expire.
+	tripper := transport.destinations[destination]
+	tripper.resolutionMutex.Lock()
+	tripper.resolution = []gomatrixserverlib.ResolutionResult{{Destination: "127.0.0.1:1", Host: destination}}
+	tripper.resolutionTime = time.Now().Add(-resolutionCacheDuration - time.Minute)
+	tripper.resolutionMutex.Unlock()
+	res, err = client.DoHTTPRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("expected the destination to be resolved again, got %s", err)
+	}
+	_ = res.Body.Close()
+
+	// Other destinations should go through the fallback transport.
+	req, err = http.NewRequest(http.MethodGet, "matrix://other.server/_matrix/federation/v1/version", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.DoHTTPRequest(context.Background(), req); err == nil {
+		t.Fatalf("expected request through the fallback transport to fail")
+	}
+	if len(fallback.hosts) != 1 || fallback.hosts[0] != "other.server" {
+		t.Fatalf("expected the fallback transport to be used for other.server, got %v", fallback.hosts)
+	}
+}
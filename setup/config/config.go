@@ -59,6 +59,7 @@ type Dendrite struct {
 	FederationAPI FederationAPI `yaml:"federation_api"`
 	KeyServer     KeyServer     `yaml:"key_server"`
 	MediaAPI      MediaAPI      `yaml:"media_api"`
+	RelayAPI      RelayAPI      `yaml:"relay_api"`
 	RoomServer    RoomServer    `yaml:"room_server"`
 	SyncAPI       SyncAPI       `yaml:"sync_api"`
 	UserAPI       UserAPI       `yaml:"user_api"`
@@ -94,6 +95,10 @@ type Derived struct {
 		// Params that need to be returned to the client during
 		// registration in order to complete registration stages.
 		Params map[string]interface{} `json:"params"`
+
+		// UsernameBlocklistRegexp matches the localparts which may not be
+		// registered, or is nil if the blocklist is empty.
+		UsernameBlocklistRegexp *regexp.Regexp `json:"-"`
 	}
 
 	// Application services parsed from their config files
@@ -111,6 +116,10 @@ type Derived struct {
 	ExclusiveApplicationServicesAliasRegexp *regexp.Regexp
 	// Note: An Exclusive Regex for room ID isn't necessary as we aren't blocking
 	// servers from creating RoomIDs in exclusive application service namespaces
+
+	// Identity provider icons read from local images, keyed by identity
+	// provider ID. The media API stores them in the media repository.
+	SSOIcons map[string]SSOIcon
 }
 
 type InternalAPIOptions struct {
@@ -180,6 +189,10 @@ type LogrusHook struct {
 	// The level of the logs to produce. Will output only this level and above.
 	Level string `yaml:"level"`
 
+	// The format of the logs, either "text" (the default) or "json" for
+	// structured logs. Only used by the "std" and "file" hooks.
+	Format string `yaml:"format"`
+
 	// The parameters for this hook.
 	Params map[string]interface{} `yaml:"params"`
 }
@@ -309,22 +322,49 @@ func (config *Dendrite) Derive() error {
 
 	config.Derived.Registration.Params = make(map[string]interface{})
 
-	// TODO: Add email auth type
 	// TODO: Add MSISDN auth type
 
 	if config.ClientAPI.RecaptchaEnabled {
 		config.Derived.Registration.Params[authtypes.LoginTypeRecaptcha] = map[string]string{"public_key": config.ClientAPI.RecaptchaPublicKey}
+	}
+	hasTerms := len(config.ClientAPI.Terms.Policies) > 0
+	if hasTerms {
+		config.Derived.Registration.Params[authtypes.LoginTypeTerms] = config.ClientAPI.Terms.Params()
+	}
+	switch {
+	case len(config.ClientAPI.RegistrationFlows) > 0:
+		config.Derived.Registration.Flows = buildRegistrationFlows(config.ClientAPI.RegistrationFlows)
+	case config.ClientAPI.RecaptchaEnabled && hasTerms:
+		config.Derived.Registration.Flows = []authtypes.Flow{
+			{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha, authtypes.LoginTypeTerms}},
+		}
+	case config.ClientAPI.RecaptchaEnabled:
 		config.Derived.Registration.Flows = []authtypes.Flow{
 			{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha}},
 		}
-	} else {
+	case hasTerms:
+		config.Derived.Registration.Flows = []authtypes.Flow{
+			{Stages: []authtypes.LoginType{authtypes.LoginTypeTerms}},
+		}
+	default:
 		config.Derived.Registration.Flows = []authtypes.Flow{
 			{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}},
 		}
 	}
+	config.Derived.Registration.Flows = addRegistrationEmailStage(config.Derived.Registration.Flows, config.ClientAPI.RegistrationEmail)
+
+	var err error
+	if config.Derived.Registration.UsernameBlocklistRegexp, err = usernameBlocklistRegexp(config.ClientAPI.UsernameBlocklist); err != nil {
+		return err
+	}
 
 	// Load application service configuration files
-	if err := loadAppServices(&config.AppServiceAPI, &config.Derived); err != nil {
+	if err = loadAppServices(&config.AppServiceAPI, &config.Derived); err != nil {
+		return err
+	}
+
+	// Load identity provider icons
+	if err = loadSSOIcons(&config.ClientAPI.Login.SSO, config.Global.ServerName, &config.Derived); err != nil {
 		return err
 	}
 
@@ -345,6 +385,7 @@ func (c *Dendrite) Defaults(opts DefaultOpts) {
 	c.FederationAPI.Defaults(opts)
 	c.KeyServer.Defaults(opts)
 	c.MediaAPI.Defaults(opts)
+	c.RelayAPI.Defaults(opts)
 	c.RoomServer.Defaults(opts)
 	c.SyncAPI.Defaults(opts)
 	c.UserAPI.Defaults(opts)
@@ -359,7 +400,7 @@ func (c *Dendrite) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	}
 	for _, c := range []verifiable{
 		&c.Global, &c.ClientAPI, &c.FederationAPI,
-		&c.KeyServer, &c.MediaAPI, &c.RoomServer,
+		&c.KeyServer, &c.MediaAPI, &c.RelayAPI, &c.RoomServer,
 		&c.SyncAPI, &c.UserAPI,
 		&c.AppServiceAPI, &c.MSCs,
 	} {
@@ -373,6 +414,7 @@ func (c *Dendrite) Wiring() {
 	c.FederationAPI.Matrix = &c.Global
 	c.KeyServer.Matrix = &c.Global
 	c.MediaAPI.Matrix = &c.Global
+	c.RelayAPI.Matrix = &c.Global
 	c.RoomServer.Matrix = &c.Global
 	c.SyncAPI.Matrix = &c.Global
 	c.UserAPI.Matrix = &c.Global
@@ -481,6 +523,11 @@ func (config *Dendrite) checkLogging(configErrs *ConfigErrors) {
 	for _, logrusHook := range config.Logging {
 		checkNotEmpty(configErrs, "logging.type", string(logrusHook.Type))
 		checkNotEmpty(configErrs, "logging.level", string(logrusHook.Level))
+		switch logrusHook.Format {
+		case "", "text", "json":
+		default:
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "logging.format", logrusHook.Format))
+		}
 	}
 }
 
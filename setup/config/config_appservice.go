@@ -92,6 +92,81 @@ type ApplicationService struct {
 	RateLimited bool `yaml:"rate_limited"`
 	// Any custom protocols that this application service provides (e.g. IRC)
 	Protocols []string `yaml:"protocols"`
+	// Optionally restricts which of the events in the application service's
+	// namespaces are sent to it. This is not part of the application service
+	// spec, so other homeservers will ignore it.
+	EventFilter ApplicationServiceEventFilter `yaml:"event_filter"`
+}
+
+// ApplicationServiceEventFilter restricts the events sent to an application
+// service by event type and room ID. Event types may contain "*" to match any
+// sequence of characters.
+type ApplicationServiceEventFilter struct {
+	// If not empty, only events of these types are sent
+	Types []string `yaml:"types"`
+	// Events of these types are never sent
+	NotTypes []string `yaml:"not_types"`
+	// If not empty, only events in these rooms are sent
+	Rooms []string `yaml:"rooms"`
+	// Events in these rooms are never sent
+	NotRooms []string `yaml:"not_rooms"`
+}
+
+// Allows returns whether an event of the given type in the given room passes
+// the filter.
+func (f *ApplicationServiceEventFilter) Allows(roomID, eventType string) bool {
+	for _, r := range f.NotRooms {
+		if r == roomID {
+			return false
+		}
+	}
+	for _, t := range f.NotTypes {
+		if eventTypeMatches(t, eventType) {
+			return false
+		}
+	}
+	if len(f.Rooms) > 0 {
+		allowed := false
+		for _, r := range f.Rooms {
+			if r == roomID {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, t := range f.Types {
+		if eventTypeMatches(t, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventTypeMatches returns whether the event type matches the pattern, in
+// which a "*" matches any sequence of characters.
+func eventTypeMatches(pattern, eventType string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == eventType
+	}
+	if !strings.HasPrefix(eventType, parts[0]) {
+		return false
+	}
+	eventType = eventType[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(eventType, part)
+		if i < 0 {
+			return false
+		}
+		eventType = eventType[i+len(part):]
+	}
+	return strings.HasSuffix(eventType, parts[len(parts)-1])
 }
 
 // IsInterestedInRoomID returns a bool on whether an application service's
@@ -344,10 +419,6 @@ func checkErrors(config *AppServiceAPI, derived *Derived) (err error) {
 		idMap[appservice.ID] = true
 		tokenMap[appservice.ASToken] = true
 
-		// TODO: Remove once rate_limited is implemented
-		if appservice.RateLimited {
-			log.Warn("WARNING: Application service option rate_limited is currently unimplemented")
-		}
 		// TODO: Remove once protocols is implemented
 		if len(appservice.Protocols) > 0 {
 			log.Warn("WARNING: Application service option protocols is currently unimplemented")
@@ -0,0 +1,39 @@
+package config
+
+import "testing"
+
+func TestApplicationServiceEventFilter(t *testing.T) {
+	filter := ApplicationServiceEventFilter{
+		Types:    []string{"m.room.*", "org.example.event"},
+		NotTypes: []string{"m.room.redaction"},
+		NotRooms: []string{"!noisy:test"},
+	}
+	tests := []struct {
+		roomID    string
+		eventType string
+		want      bool
+	}{
+		{roomID: "!room:test", eventType: "m.room.message", want: true},
+		{roomID: "!room:test", eventType: "org.example.event", want: true},
+		{roomID: "!room:test", eventType: "org.example.event.other", want: false},
+		{roomID: "!room:test", eventType: "m.reaction", want: false},
+		{roomID: "!room:test", eventType: "m.room.redaction", want: false},
+		{roomID: "!noisy:test", eventType: "m.room.message", want: false},
+	}
+	for _, tt := range tests {
+		if got := filter.Allows(tt.roomID, tt.eventType); got != tt.want {
+			t.Errorf("Allows(%q, %q) = %v, want %v", tt.roomID, tt.eventType, got, tt.want)
+		}
+	}
+
+	onlyRoom := ApplicationServiceEventFilter{Rooms: []string{"!room:test"}}
+	if !onlyRoom.Allows("!room:test", "m.room.message") {
+		t.Errorf("expected events in listed rooms to be allowed")
+	}
+	if onlyRoom.Allows("!other:test", "m.room.message") {
+		t.Errorf("expected events in other rooms to be filtered out")
+	}
+	if !(&ApplicationServiceEventFilter{}).Allows("!other:test", "m.room.message") {
+		t.Errorf("expected an empty filter to allow everything")
+	}
+}
@@ -1,8 +1,18 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type ClientAPI struct {
@@ -48,6 +58,26 @@ type ClientAPI struct {
 	// was successful
 	RecaptchaSiteVerifyAPI string `yaml:"recaptcha_siteverify_api"`
 
+	// The registration flows to advertise to clients, in order of preference.
+	// If empty, a single flow is used which requires reCAPTCHA if it is enabled,
+	// and acceptance of the terms if any policies are configured.
+	RegistrationFlows []RegistrationFlow `yaml:"registration_flows"`
+
+	// Whether users must, may or may not verify an email address when they
+	// register, using the m.login.email.identity registration stage. The
+	// address is verified by one of the trusted identity servers.
+	RegistrationEmail RegistrationEmail `yaml:"registration_email"`
+
+	// Policies which users must accept, e.g. terms of service or a privacy
+	// policy, using the m.login.terms registration stage.
+	Terms Terms `yaml:"terms"`
+
+	// Localparts which may not be registered, e.g. to prevent impersonation of
+	// administrators. Patterns are globs, where "*" matches any run of characters
+	// and "?" matches a single character, unless they are wrapped in slashes, in
+	// which case they are regular expressions. Matching is case-insensitive.
+	UsernameBlocklist []string `yaml:"username_blocklist"`
+
 	Login Login `yaml:"login"`
 
 	// TURN options
@@ -56,9 +86,45 @@ type ClientAPI struct {
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
 
+	// Limits on how many rooms users can create
+	RoomCreation RoomCreation `yaml:"room_creation"`
+
+	// Limits on how often devices can upload their keys
+	KeyUploads KeyUploads `yaml:"key_uploads"`
+
+	// Forwarding of content reports to the server that the reported event
+	// originated from
+	ReportForwarding ReportForwarding `yaml:"report_forwarding"`
+
+	// How to handle event timestamps, supplied by application services with
+	// the "ts" parameter, which are too far in the future
+	FutureTimestamps FutureTimestamps `yaml:"future_timestamps"`
+
+	// Limits on how much account data users can store
+	AccountData AccountData `yaml:"account_data"`
+
+	// Profile fields to leave out of membership events
+	MembershipProfile MembershipProfile `yaml:"membership_profile"`
+
+	// The maximum size in bytes of request bodies. Larger requests are
+	// rejected before their body is read. 0 means no limit.
+	MaxRequestBodySize int64 `yaml:"max_request_body_size"`
+
+	// The maximum length in bytes of room aliases, including the '#' and the
+	// server name. Must not be larger than the spec's limit of 255 bytes.
+	MaxRoomAliasLength int `yaml:"max_room_alias_length"`
+
+	// The minimum power level users need to change the server ACLs of rooms,
+	// on top of the power level the room itself requires. 0 means that only
+	// the room's power levels apply.
+	ServerACLPowerLevel int64 `yaml:"server_acl_power_level"`
+
 	MSCs *MSCs `yaml:"-"`
 }
 
+// maxRoomAliasLength is the longest a room alias can be according to the spec.
+const maxRoomAliasLength = 255
+
 func (c *ClientAPI) Defaults(opts DefaultOpts) {
 	if !opts.Monolithic {
 		c.InternalAPI.Listen = "http://localhost:7771"
@@ -72,8 +138,17 @@ func (c *ClientAPI) Defaults(opts DefaultOpts) {
 	c.RecaptchaBypassSecret = ""
 	c.RecaptchaSiteVerifyAPI = ""
 	c.RegistrationDisabled = true
+	c.RegistrationEmail = RegistrationEmailDisabled
 	c.OpenRegistrationWithoutVerificationEnabled = false
 	c.RateLimiting.Defaults()
+	c.RoomCreation.Defaults()
+	c.KeyUploads.Defaults()
+	c.FutureTimestamps.Defaults()
+	c.AccountData.Defaults()
+	c.MembershipProfile.Defaults()
+	c.MaxRequestBodySize = 10 * 1024 * 1024
+	c.MaxRoomAliasLength = maxRoomAliasLength
+	c.ServerACLPowerLevel = 0
 	c.Login.SSO.Enabled = false
 }
 
@@ -81,6 +156,15 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	c.Login.Verify(configErrs)
 	c.TURN.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
+	c.RoomCreation.Verify(configErrs)
+	c.KeyUploads.Verify(configErrs)
+	c.FutureTimestamps.Verify(configErrs)
+	c.AccountData.Verify(configErrs)
+	checkPositive(configErrs, "client_api.max_request_body_size", c.MaxRequestBodySize)
+	if c.MaxRoomAliasLength <= 0 || c.MaxRoomAliasLength > maxRoomAliasLength {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d, must be between 1 and %d", "client_api.max_room_alias_length", c.MaxRoomAliasLength, maxRoomAliasLength))
+	}
+	checkPositive(configErrs, "client_api.server_acl_power_level", c.ServerACLPowerLevel)
 	if c.RecaptchaEnabled {
 		if c.RecaptchaSiteVerifyAPI == "" {
 			c.RecaptchaSiteVerifyAPI = "https://www.google.com/recaptcha/api/siteverify"
@@ -99,9 +183,27 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkNotEmpty(configErrs, "client_api.recaptcha_siteverify_api", c.RecaptchaSiteVerifyAPI)
 		checkNotEmpty(configErrs, "client_api.recaptcha_sitekey_class", c.RecaptchaSitekeyClass)
 	}
+	c.Terms.Verify(configErrs)
+	for i, pattern := range c.UsernameBlocklist {
+		if _, err := usernameBlocklistRegexp([]string{pattern}); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("client_api.username_blocklist[%d]", i), err))
+		}
+	}
+	for i, flow := range c.RegistrationFlows {
+		flow.Verify(configErrs, fmt.Sprintf("client_api.registration_flows[%d]", i), c)
+	}
+	switch c.RegistrationEmail {
+	case RegistrationEmailDisabled:
+	case RegistrationEmailOptional, RegistrationEmailRequired:
+		if len(c.Matrix.TrustedIDServers) == 0 {
+			configErrs.Add(fmt.Sprintf("config key %q requires %q to be set", "client_api.registration_email", "global.trusted_third_party_id_servers"))
+		}
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "client_api.registration_email", c.RegistrationEmail))
+	}
 	// Ensure there is any spam counter measure when enabling registration
 	if !c.RegistrationDisabled && !c.OpenRegistrationWithoutVerificationEnabled {
-		if !c.RecaptchaEnabled {
+		if !c.RecaptchaEnabled && c.RegistrationEmail != RegistrationEmailRequired {
 			configErrs.Add(
 				"You have tried to enable open registration without any secondary verification methods " +
 					"(such as reCAPTCHA). By enabling open registration, you are SIGNIFICANTLY " +
@@ -120,9 +222,275 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "client_api.external_api.listen", string(c.ExternalAPI.Listen))
 }
 
+// IsUsernameBlocked returns whether the localpart matches any pattern in the
+// username blocklist.
+func (c *ClientAPI) IsUsernameBlocked(localpart string) bool {
+	if c.Derived == nil || c.Derived.Registration.UsernameBlocklistRegexp == nil {
+		return false
+	}
+	return c.Derived.Registration.UsernameBlocklistRegexp.MatchString(localpart)
+}
+
+// usernameBlocklistRegexp compiles the username blocklist patterns into a
+// single case-insensitive regular expression. It returns nil if there are no
+// patterns.
+func usernameBlocklistRegexp(patterns []string) (*regexp.Regexp, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	exprs := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			expr := pattern[1 : len(pattern)-1]
+			if _, err := regexp.Compile(expr); err != nil {
+				return nil, err
+			}
+			exprs = append(exprs, "(?:"+expr+")")
+			continue
+		}
+		if pattern == "" {
+			return nil, fmt.Errorf("empty pattern")
+		}
+		expr := regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		exprs = append(exprs, "^"+expr+"$")
+	}
+	return regexp.Compile("(?i)" + strings.Join(exprs, "|"))
+}
+
+// RegistrationEmail is whether an email address is verified at registration.
+type RegistrationEmail string
+
+const (
+	// No email address can be given at registration
+	RegistrationEmailDisabled RegistrationEmail = "disabled"
+	// Users may verify an email address at registration, or skip it
+	RegistrationEmailOptional RegistrationEmail = "optional"
+	// Users must verify an email address before their account is created
+	RegistrationEmailRequired RegistrationEmail = "required"
+)
+
+// addRegistrationEmailStage adds the m.login.email.identity stage to each of
+// the registration flows, replacing m.login.dummy since it is no longer needed
+// to complete the flow. If the stage is optional, each flow is also advertised
+// without it.
+func addRegistrationEmailStage(flows []authtypes.Flow, mode RegistrationEmail) []authtypes.Flow {
+	if mode != RegistrationEmailOptional && mode != RegistrationEmailRequired {
+		return flows
+	}
+	var result []authtypes.Flow
+	seen := map[string]bool{}
+	add := func(stages []authtypes.LoginType) {
+		key := ""
+		for _, stage := range stages {
+			key += string(stage) + ","
+		}
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, authtypes.Flow{Stages: stages})
+		}
+	}
+	for _, flow := range flows {
+		stages := []authtypes.LoginType{}
+		for _, stage := range flow.Stages {
+			if stage != authtypes.LoginTypeDummy {
+				stages = append(stages, stage)
+			}
+		}
+		add(append(stages, authtypes.LoginTypeEmail))
+		if mode == RegistrationEmailOptional {
+			add(flow.Stages)
+		}
+	}
+	return result
+}
+
+// RegistrationFlow is one way of completing registration. Optional stages
+// may be skipped by the client, in which case the flow is advertised both
+// with and without them.
+type RegistrationFlow struct {
+	Stages []RegistrationStage `yaml:"stages"`
+}
+
+type RegistrationStage struct {
+	// The login type of the stage, e.g. m.login.recaptcha
+	Type authtypes.LoginType `yaml:"type"`
+	// Whether the stage may be skipped
+	Optional bool `yaml:"optional"`
+}
+
+// registrationStageTypes are the stages that registration knows how to complete.
+var registrationStageTypes = map[authtypes.LoginType]bool{
+	authtypes.LoginTypeDummy:     true,
+	authtypes.LoginTypeRecaptcha: true,
+	authtypes.LoginTypeTerms:     true,
+}
+
+func (f *RegistrationFlow) Verify(configErrs *ConfigErrors, key string, c *ClientAPI) {
+	required := 0
+	seen := make(map[authtypes.LoginType]bool, len(f.Stages))
+	for i, stage := range f.Stages {
+		stageKey := fmt.Sprintf("%s.stages[%d].type", key, i)
+		switch {
+		case !registrationStageTypes[stage.Type]:
+			configErrs.Add(fmt.Sprintf("unsupported registration stage for config key %q: %s", stageKey, stage.Type))
+		case stage.Type == authtypes.LoginTypeRecaptcha && !c.RecaptchaEnabled:
+			configErrs.Add(fmt.Sprintf("registration stage for config key %q requires %q to be enabled", stageKey, "client_api.enable_registration_captcha"))
+		case stage.Type == authtypes.LoginTypeTerms && len(c.Terms.Policies) == 0:
+			configErrs.Add(fmt.Sprintf("registration stage for config key %q requires %q to be set", stageKey, "client_api.terms.policies"))
+		case seen[stage.Type]:
+			configErrs.Add(fmt.Sprintf("duplicate registration stage for config key %q: %s", stageKey, stage.Type))
+		}
+		seen[stage.Type] = true
+		if !stage.Optional {
+			required++
+		}
+	}
+	if required == 0 {
+		configErrs.Add(fmt.Sprintf("config key %q must have at least one required stage", key+".stages"))
+	}
+}
+
+// buildRegistrationFlows turns the configured registration flows into the
+// flows advertised to clients. Each combination of optional stages becomes
+// its own flow, starting with all of the optional stages included, and the
+// order of the stages is preserved.
+func buildRegistrationFlows(flows []RegistrationFlow) []authtypes.Flow {
+	var result []authtypes.Flow
+	seen := map[string]bool{}
+	for _, flow := range flows {
+		var optional []int
+		for i, stage := range flow.Stages {
+			if stage.Optional {
+				optional = append(optional, i)
+			}
+		}
+		// Each bit of skip is set if the corresponding optional stage is left out.
+		for skip := 0; skip < 1<<len(optional); skip++ {
+			skipped := make(map[int]bool, len(optional))
+			for bit, i := range optional {
+				skipped[i] = skip&(1<<bit) != 0
+			}
+			stages := []authtypes.LoginType{}
+			key := ""
+			for i, stage := range flow.Stages {
+				if !skipped[i] {
+					stages = append(stages, stage.Type)
+					key += string(stage.Type) + ","
+				}
+			}
+			if len(stages) == 0 || seen[key] {
+				continue
+			}
+			seen[key] = true
+			result = append(result, authtypes.Flow{Stages: stages})
+		}
+	}
+	return result
+}
+
+type Terms struct {
+	// The policies which users must accept
+	Policies []TermsPolicy `yaml:"policies"`
+
+	// If set, users who have not accepted the current version of every policy,
+	// e.g. because a policy was updated since they registered, are blocked from
+	// sending events, joining rooms and creating rooms until they accept them.
+	EnforceAcceptance bool `yaml:"enforce_acceptance"`
+}
+
+type TermsPolicy struct {
+	// The ID of the policy, e.g. privacy_policy
+	ID string `yaml:"id"`
+	// The current version of the policy. Changing it requires users to
+	// accept the policy again.
+	Version string `yaml:"version"`
+	// The policy in each language it is available in, keyed by language
+	// code, e.g. "en"
+	Languages map[string]TermsPolicyLanguage `yaml:"languages"`
+}
+
+type TermsPolicyLanguage struct {
+	// The human-readable name of the policy in this language
+	Name string `yaml:"name"`
+	// The URL of the policy in this language
+	URL string `yaml:"url"`
+}
+
+func (t *Terms) Verify(configErrs *ConfigErrors) {
+	seen := make(map[string]bool, len(t.Policies))
+	for i, policy := range t.Policies {
+		key := fmt.Sprintf("client_api.terms.policies[%d]", i)
+		checkNotEmpty(configErrs, key+".id", policy.ID)
+		checkNotEmpty(configErrs, key+".version", policy.Version)
+		if seen[policy.ID] {
+			configErrs.Add(fmt.Sprintf("duplicate policy for config key %q: %s", key+".id", policy.ID))
+		}
+		seen[policy.ID] = true
+		if len(policy.Languages) == 0 {
+			configErrs.Add(fmt.Sprintf("empty list for config key %q", key+".languages"))
+		}
+		for lang, variant := range policy.Languages {
+			checkNotEmpty(configErrs, fmt.Sprintf("%s.languages.%s.name", key, lang), variant.Name)
+			checkURL(configErrs, fmt.Sprintf("%s.languages.%s.url", key, lang), variant.URL)
+		}
+	}
+	if t.EnforceAcceptance && len(t.Policies) == 0 {
+		configErrs.Add(fmt.Sprintf("config key %q requires %q to be set", "client_api.terms.enforce_acceptance", "client_api.terms.policies"))
+	}
+}
+
+// Versions returns the current version of each policy, keyed by policy ID.
+func (t *Terms) Versions() map[string]string {
+	versions := make(map[string]string, len(t.Policies))
+	for _, policy := range t.Policies {
+		versions[policy.ID] = policy.Version
+	}
+	return versions
+}
+
+// Accepted returns whether the given accepted versions, keyed by policy ID,
+// cover the current version of every policy.
+func (t *Terms) Accepted(accepted map[string]string) bool {
+	for _, policy := range t.Policies {
+		if accepted[policy.ID] != policy.Version {
+			return false
+		}
+	}
+	return true
+}
+
+// Params returns the policies in the format used by the m.login.terms
+// registration stage.
+func (t *Terms) Params() map[string]interface{} {
+	policies := make(map[string]interface{}, len(t.Policies))
+	for _, policy := range t.Policies {
+		p := map[string]interface{}{"version": policy.Version}
+		for lang, variant := range policy.Languages {
+			p[lang] = map[string]string{"name": variant.Name, "url": variant.URL}
+		}
+		policies[policy.ID] = p
+	}
+	return map[string]interface{}{"policies": policies}
+}
+
 type Login struct {
 	SSO      SSO      `yaml:"sso"`
 	Password Password `yaml:"password"`
+
+	// FlowOrder is the order in which the enabled login types are offered to
+	// clients by GET /login. Enabled login types which aren't listed follow in
+	// the default order of DefaultLoginFlowOrder.
+	FlowOrder []authtypes.LoginType `yaml:"flow_order"`
+}
+
+// DefaultLoginFlowOrder is the order in which login types are offered to
+// clients unless client_api.login.flow_order says otherwise.
+var DefaultLoginFlowOrder = []authtypes.LoginType{
+	authtypes.LoginTypePassword,
+	authtypes.LoginTypeSSO,
+	authtypes.LoginTypeToken,
 }
 
 // LoginTokenEnabled returns whether any login type uses
@@ -135,8 +503,34 @@ func (l *Login) PasswordEnabled() bool {
 	return !l.Password.Disabled
 }
 
+// LoginTypeEnabled returns whether the given login type is offered to
+// clients.
+func (l *Login) LoginTypeEnabled(typ authtypes.LoginType) bool {
+	switch typ {
+	case authtypes.LoginTypePassword:
+		return l.PasswordEnabled()
+	case authtypes.LoginTypeSSO:
+		return l.SSO.Enabled
+	case authtypes.LoginTypeToken:
+		return l.LoginTokenEnabled()
+	default:
+		return false
+	}
+}
+
 func (l *Login) Verify(configErrs *ConfigErrors) {
 	l.SSO.Verify(configErrs)
+	seen := make(map[authtypes.LoginType]bool, len(l.FlowOrder))
+	for i, typ := range l.FlowOrder {
+		key := fmt.Sprintf("client_api.login.flow_order[%d]", i)
+		switch {
+		case !l.LoginTypeEnabled(typ):
+			configErrs.Add(fmt.Sprintf("login type for config key %q is not enabled: %s", key, typ))
+		case seen[typ]:
+			configErrs.Add(fmt.Sprintf("duplicate login type for config key %q: %s", key, typ))
+		}
+		seen[typ] = true
+	}
 }
 
 type Password struct {
@@ -163,6 +557,11 @@ type SSO struct {
 	// DefaultProviderID is the provider to use when the client doesn't indicate one.
 	// This is legacy support. If empty, the first provider listed is used.
 	DefaultProviderID string `yaml:"default_provider"`
+
+	// AllowAccountLinking lets logged-in users link an SSO identity to their
+	// existing account, so that future SSO logins with it log into that
+	// account instead of registering a new one.
+	AllowAccountLinking bool `yaml:"allow_account_linking"`
 }
 
 func (sso *SSO) Verify(configErrs *ConfigErrors) {
@@ -212,9 +611,29 @@ type IdentityProvider struct {
 	// Icon is an MXC URI describing how to display the IdP to the user. Prefer using `brand`.
 	Icon string `yaml:"icon"`
 
+	// IconPath is a local image to display the IdP to the user with, instead of `icon`.
+	// It is uploaded to the media repository on startup.
+	IconPath Path `yaml:"icon_path"`
+
 	// Type describes how this IdP is implemented. If this is empty, a default is chosen
 	// based on brand or which subkeys exist.
 	Type IdentityProviderType `yaml:"type"`
+
+	// Registration determines whether logging in with this IdP creates an account
+	// for identities which aren't associated with one yet. Defaults to "auto".
+	Registration SSORegistrationPolicy `yaml:"registration"`
+
+	// AllowedGroups restricts logging in with this IdP to users in at least one of
+	// these groups. If empty, all users may log in.
+	AllowedGroups []string `yaml:"allowed_groups"`
+
+	// GroupsClaim is the path to the user's groups in the IdP's user info response,
+	// in GJSON syntax. Defaults to "groups".
+	GroupsClaim string `yaml:"groups_claim"`
+
+	// PropagateLogout ends the user's session at the IdP when a device which
+	// logged in with it logs out, using the OIDC end session endpoint.
+	PropagateLogout bool `yaml:"propagate_logout"`
 }
 
 func (idp *IdentityProvider) WithDefaults() IdentityProvider {
@@ -235,10 +654,65 @@ func (idp *IdentityProvider) WithDefaults() IdentityProvider {
 	if p.Name == "" {
 		p.Name = oidcDefaultNames[p.Brand]
 	}
+	if p.Registration == "" {
+		p.Registration = SSORegistrationAuto
+	}
+	if p.GroupsClaim == "" {
+		p.GroupsClaim = "groups"
+	}
 
 	return p
 }
 
+// SSOIcon is an identity provider icon which is read from a local image.
+type SSOIcon struct {
+	// Path is the absolute path of the image.
+	Path string
+	// Data is the content of the image. It is stored as read here, so that
+	// the stored image always matches the media ID derived from it.
+	Data []byte
+	// MediaID is the media ID which the image is stored under, derived from
+	// its content so that it only changes when the image does.
+	MediaID string
+	// ContentURI is the MXC URI of the image.
+	ContentURI string
+}
+
+// loadSSOIcons reads the local images configured as identity provider
+// icons, so that they can be stored in the media repository.
+func loadSSOIcons(sso *SSO, serverName gomatrixserverlib.ServerName, derived *Derived) error {
+	derived.SSOIcons = map[string]SSOIcon{}
+	if !sso.Enabled {
+		return nil
+	}
+	for _, idp := range sso.Providers {
+		idp = idp.WithDefaults()
+		if idp.IconPath == "" {
+			continue
+		}
+		path, err := filepath.Abs(string(idp.IconPath))
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read icon of identity provider %q: %w", idp.ID, err)
+		}
+		if contentType := http.DetectContentType(data); !strings.HasPrefix(contentType, "image/") {
+			return fmt.Errorf("icon of identity provider %q is not an image: %s", idp.ID, contentType)
+		}
+		hash := sha256.Sum256(data)
+		mediaID := hex.EncodeToString(hash[:])
+		derived.SSOIcons[idp.ID] = SSOIcon{
+			Path:       path,
+			Data:       data,
+			MediaID:    mediaID,
+			ContentURI: fmt.Sprintf("mxc://%s/%s", serverName, mediaID),
+		}
+	}
+	return nil
+}
+
 type OAuth2 struct {
 	ClientID     string `yaml:"client_id"`
 	ClientSecret string `yaml:"client_secret"`
@@ -262,6 +736,19 @@ func (idp *IdentityProvider) verifyNormalized(configErrs *ConfigErrors) {
 	}
 	if idp.Icon != "" {
 		checkIconURL(configErrs, "client_api.sso.providers.icon", idp.Icon)
+		if idp.IconPath != "" {
+			configErrs.Add(fmt.Sprintf("only one of config keys %q and %q may be set in identity provider %q", "client_api.sso.providers.icon", "client_api.sso.providers.icon_path", idp.ID))
+		}
+	}
+
+	switch idp.Registration {
+	case SSORegistrationAuto, SSORegistrationDisabled:
+	default:
+		configErrs.Add(fmt.Sprintf("unrecognised registration policy in identity provider %q for config key %q: %s", idp.ID, "client_api.sso.providers", idp.Registration))
+	}
+
+	if idp.PropagateLogout && idp.Type != SSOTypeOIDC {
+		configErrs.Add(fmt.Sprintf("logout propagation in identity provider %q for config key %q is only supported with type %q", idp.ID, "client_api.sso.providers.propagate_logout", SSOTypeOIDC))
 	}
 
 	switch idp.Type {
@@ -337,6 +824,19 @@ const (
 	SSOTypeMastodon IdentityProviderType = "mastodon"
 )
 
+// SSORegistrationPolicy determines whether logging in with an identity
+// provider can create new accounts.
+type SSORegistrationPolicy string
+
+const (
+	// SSORegistrationAuto creates an account for identities which aren't
+	// associated with one yet.
+	SSORegistrationAuto SSORegistrationPolicy = "auto"
+	// SSORegistrationDisabled only allows logging in to accounts which are
+	// already associated with the identity.
+	SSORegistrationDisabled SSORegistrationPolicy = "disabled"
+)
+
 type TURN struct {
 	// TODO Guest Support
 	// Whether or not guests can request TURN credentials
@@ -394,3 +894,152 @@ func (r *RateLimiting) Defaults() {
 	r.Threshold = 5
 	r.CooloffMS = 500
 }
+
+// RoomCreation limits how many rooms users can create, to curb spam, and sets
+// defaults for new rooms. Server administrators and application service users
+// are exempt from the limits.
+type RoomCreation struct {
+	// Rate limiting of /createRoom, in addition to the general rate limiting
+	// options. Disabled by default.
+	RateLimiting RateLimiting `yaml:"rate_limiting"`
+
+	// The maximum number of rooms a user can have created and still be joined
+	// to. Leaving a room frees up space for a new one. Zero means no limit.
+	MaxRoomsPerUser int `yaml:"max_rooms_per_user"`
+
+	// Enable end-to-end encryption in rooms created with the private_chat or
+	// trusted_private_chat presets, unless the client opts out by supplying
+	// an m.room.encryption event with empty content in the initial state.
+	EncryptPrivateRooms bool `yaml:"encrypt_private_rooms"`
+}
+
+func (r *RoomCreation) Verify(configErrs *ConfigErrors) {
+	if r.RateLimiting.Enabled {
+		checkPositive(configErrs, "client_api.room_creation.rate_limiting.threshold", r.RateLimiting.Threshold)
+		checkPositive(configErrs, "client_api.room_creation.rate_limiting.cooloff_ms", r.RateLimiting.CooloffMS)
+	}
+	checkPositive(configErrs, "client_api.room_creation.max_rooms_per_user", int64(r.MaxRoomsPerUser))
+}
+
+func (r *RoomCreation) Defaults() {
+	r.RateLimiting.Enabled = false
+	r.RateLimiting.Threshold = 2
+	r.RateLimiting.CooloffMS = 10000
+	r.MaxRoomsPerUser = 0
+	r.EncryptPrivateRooms = false
+}
+
+// KeyUploads limits how often each device can upload its keys with
+// /keys/upload, to protect against buggy or malicious clients. Uploads are
+// counted against the device keys limit if they include device keys, and
+// against the one-time keys limit if they include one-time keys. Server
+// administrators and application service users are exempt from the limits.
+type KeyUploads struct {
+	// Rate limiting of device key uploads. Clients only need to upload their
+	// device keys when a device is first set up.
+	DeviceKeys RateLimiting `yaml:"device_keys"`
+
+	// Rate limiting of one-time key uploads. Clients upload a batch of
+	// one-time keys whenever they run low, so the threshold should allow for
+	// a burst of uploads.
+	OneTimeKeys RateLimiting `yaml:"one_time_keys"`
+}
+
+func (k *KeyUploads) Verify(configErrs *ConfigErrors) {
+	if k.DeviceKeys.Enabled {
+		checkPositive(configErrs, "client_api.key_uploads.device_keys.threshold", k.DeviceKeys.Threshold)
+		checkPositive(configErrs, "client_api.key_uploads.device_keys.cooloff_ms", k.DeviceKeys.CooloffMS)
+	}
+	if k.OneTimeKeys.Enabled {
+		checkPositive(configErrs, "client_api.key_uploads.one_time_keys.threshold", k.OneTimeKeys.Threshold)
+		checkPositive(configErrs, "client_api.key_uploads.one_time_keys.cooloff_ms", k.OneTimeKeys.CooloffMS)
+	}
+}
+
+func (k *KeyUploads) Defaults() {
+	k.DeviceKeys.Enabled = true
+	k.DeviceKeys.Threshold = 5
+	k.DeviceKeys.CooloffMS = 60000
+	k.OneTimeKeys.Enabled = true
+	k.OneTimeKeys.Threshold = 20
+	k.OneTimeKeys.CooloffMS = 5000
+}
+
+// ReportForwarding controls whether reports about events sent by users on other
+// servers are forwarded to those servers, so that their admins can act on them.
+// The reporting user's ID is never forwarded.
+type ReportForwarding struct {
+	// Forward reports to the origin server of the reported event.
+	Enabled bool `yaml:"enabled"`
+	// Include the reporter's free-text reason in the forwarded report. This is
+	// off by default as the reason may identify the reporter.
+	IncludeReason bool `yaml:"include_reason"`
+}
+
+const (
+	// FutureTimestampsClamp replaces future timestamps with the latest allowed time.
+	FutureTimestampsClamp = "clamp"
+	// FutureTimestampsReject rejects requests with future timestamps.
+	FutureTimestampsReject = "reject"
+)
+
+// FutureTimestamps controls what happens to locally created events which have
+// a timestamp further in the future than the allowed clock skew, as this can
+// break the ordering of events in clients.
+type FutureTimestamps struct {
+	// How far in the future a timestamp may be. 0 allows any timestamp.
+	MaxSkew time.Duration `yaml:"max_skew"`
+	// Either "clamp" to use the latest allowed time instead, or "reject" to
+	// refuse to send the event.
+	Policy string `yaml:"policy"`
+}
+
+func (f *FutureTimestamps) Defaults() {
+	f.MaxSkew = 0
+	f.Policy = FutureTimestampsClamp
+}
+
+func (f *FutureTimestamps) Verify(configErrs *ConfigErrors) {
+	if f.MaxSkew < 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "client_api.future_timestamps.max_skew", f.MaxSkew))
+	}
+	switch f.Policy {
+	case FutureTimestampsClamp, FutureTimestampsReject:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q (must be %q or %q)", "client_api.future_timestamps.policy", f.Policy, FutureTimestampsClamp, FutureTimestampsReject))
+	}
+}
+
+// AccountData limits the size of the account data which clients can store, so
+// that it can't be abused as unbounded storage.
+type AccountData struct {
+	// The maximum size in bytes of the content of a single type of account
+	// data. 0 means no limit. The total size of a user's account data is
+	// limited by user_api.storage_quota_per_user.
+	MaxSizePerType int64 `yaml:"max_size_per_type"`
+}
+
+func (a *AccountData) Defaults() {
+	a.MaxSizePerType = 0
+}
+
+func (a *AccountData) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "client_api.account_data.max_size_per_type", a.MaxSizePerType)
+}
+
+// MembershipProfile controls whether the display names and avatars of users
+// are copied into the membership events which this server sends, where they
+// are visible to everyone in the room. Users' profiles can still be looked up
+// with the profile endpoints.
+type MembershipProfile struct {
+	// Leave display names out of membership events.
+	StripDisplayName bool `yaml:"strip_displayname"`
+
+	// Leave avatars out of membership events.
+	StripAvatarURL bool `yaml:"strip_avatar_url"`
+}
+
+func (m *MembershipProfile) Defaults() {
+	m.StripDisplayName = false
+	m.StripAvatarURL = false
+}
@@ -0,0 +1,363 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+func TestRegistrationFlows(t *testing.T) {
+	dummy := RegistrationStage{Type: authtypes.LoginTypeDummy}
+	recaptcha := RegistrationStage{Type: authtypes.LoginTypeRecaptcha}
+	optionalRecaptcha := RegistrationStage{Type: authtypes.LoginTypeRecaptcha, Optional: true}
+	optionalDummy := RegistrationStage{Type: authtypes.LoginTypeDummy, Optional: true}
+
+	testCases := []struct {
+		name             string
+		recaptchaEnabled bool
+		terms            bool
+		email            RegistrationEmail
+		flows            []RegistrationFlow
+		wantFlows        []authtypes.Flow
+		wantErrs         int
+	}{
+		{
+			name:      "default without recaptcha",
+			wantFlows: []authtypes.Flow{{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}}},
+		},
+		{
+			name:             "default with recaptcha",
+			recaptchaEnabled: true,
+			wantFlows:        []authtypes.Flow{{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha}}},
+		},
+		{
+			name:      "default with terms",
+			terms:     true,
+			wantFlows: []authtypes.Flow{{Stages: []authtypes.LoginType{authtypes.LoginTypeTerms}}},
+		},
+		{
+			name:             "default with recaptcha and terms",
+			recaptchaEnabled: true,
+			terms:            true,
+			wantFlows: []authtypes.Flow{
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha, authtypes.LoginTypeTerms}},
+			},
+		},
+		{
+			name:  "optional terms",
+			terms: true,
+			flows: []RegistrationFlow{{Stages: []RegistrationStage{
+				{Type: authtypes.LoginTypeTerms, Optional: true}, dummy,
+			}}},
+			wantFlows: []authtypes.Flow{
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeTerms, authtypes.LoginTypeDummy}},
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}},
+			},
+		},
+		{
+			name:     "terms stage without policies",
+			flows:    []RegistrationFlow{{Stages: []RegistrationStage{{Type: authtypes.LoginTypeTerms}}}},
+			wantErrs: 1,
+		},
+		{
+			name:             "stage order is preserved",
+			recaptchaEnabled: true,
+			flows:            []RegistrationFlow{{Stages: []RegistrationStage{dummy, recaptcha}}},
+			wantFlows: []authtypes.Flow{
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy, authtypes.LoginTypeRecaptcha}},
+			},
+		},
+		{
+			name:             "optional stages are advertised with and without",
+			recaptchaEnabled: true,
+			flows:            []RegistrationFlow{{Stages: []RegistrationStage{optionalRecaptcha, dummy}}},
+			wantFlows: []authtypes.Flow{
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha, authtypes.LoginTypeDummy}},
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}},
+			},
+		},
+		{
+			name:             "multiple alternatives without duplicates",
+			recaptchaEnabled: true,
+			flows: []RegistrationFlow{
+				{Stages: []RegistrationStage{recaptcha, optionalDummy}},
+				{Stages: []RegistrationStage{recaptcha}},
+				{Stages: []RegistrationStage{dummy}},
+			},
+			wantFlows: []authtypes.Flow{
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha, authtypes.LoginTypeDummy}},
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha}},
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}},
+			},
+		},
+		{
+			name:     "recaptcha stage without recaptcha enabled",
+			flows:    []RegistrationFlow{{Stages: []RegistrationStage{recaptcha}}},
+			wantErrs: 1,
+		},
+		{
+			name:     "unsupported stage",
+			flows:    []RegistrationFlow{{Stages: []RegistrationStage{{Type: "m.login.email.identity"}, dummy}}},
+			wantErrs: 1,
+		},
+		{
+			name:     "no required stages",
+			flows:    []RegistrationFlow{{Stages: []RegistrationStage{optionalDummy}}},
+			wantErrs: 1,
+		},
+		{
+			name:     "duplicate stage",
+			flows:    []RegistrationFlow{{Stages: []RegistrationStage{dummy, dummy}}},
+			wantErrs: 1,
+		},
+		{
+			name:      "required email replaces dummy",
+			email:     RegistrationEmailRequired,
+			wantFlows: []authtypes.Flow{{Stages: []authtypes.LoginType{authtypes.LoginTypeEmail}}},
+		},
+		{
+			name:             "required email with recaptcha",
+			recaptchaEnabled: true,
+			email:            RegistrationEmailRequired,
+			wantFlows: []authtypes.Flow{
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha, authtypes.LoginTypeEmail}},
+			},
+		},
+		{
+			name:  "optional email is advertised with and without",
+			email: RegistrationEmailOptional,
+			wantFlows: []authtypes.Flow{
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeEmail}},
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}},
+			},
+		},
+		{
+			name:  "optional email without duplicates",
+			email: RegistrationEmailOptional,
+			flows: []RegistrationFlow{
+				{Stages: []RegistrationStage{dummy}},
+				{Stages: []RegistrationStage{{Type: authtypes.LoginTypeTerms}, dummy}},
+			},
+			terms: true,
+			wantFlows: []authtypes.Flow{
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeEmail}},
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}},
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeTerms, authtypes.LoginTypeEmail}},
+				{Stages: []authtypes.LoginType{authtypes.LoginTypeTerms, authtypes.LoginTypeDummy}},
+			},
+		},
+		{
+			name:     "invalid email mode",
+			email:    "sometimes",
+			wantErrs: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Dendrite{}
+			cfg.Defaults(DefaultOpts{Generate: true, Monolithic: true})
+			cfg.ClientAPI.RecaptchaEnabled = tc.recaptchaEnabled
+			cfg.ClientAPI.RecaptchaPublicKey = "public"
+			cfg.ClientAPI.RecaptchaPrivateKey = "private"
+			cfg.ClientAPI.RegistrationFlows = tc.flows
+			if tc.email != "" {
+				cfg.ClientAPI.RegistrationEmail = tc.email
+			}
+			if tc.terms {
+				cfg.ClientAPI.Terms.Policies = []TermsPolicy{{
+					ID:      "privacy_policy",
+					Version: "1.0",
+					Languages: map[string]TermsPolicyLanguage{
+						"en": {Name: "Privacy Policy", URL: "https://example.com/privacy.html"},
+					},
+				}}
+			}
+
+			var configErrs ConfigErrors
+			cfg.ClientAPI.Verify(&configErrs, true)
+			if len(configErrs) != tc.wantErrs {
+				t.Fatalf("expected %d config errors, got %v", tc.wantErrs, configErrs)
+			}
+			if tc.wantErrs > 0 {
+				return
+			}
+
+			if err := cfg.Derive(); err != nil {
+				t.Fatalf("failed to derive config: %s", err)
+			}
+			if !reflect.DeepEqual(cfg.Derived.Registration.Flows, tc.wantFlows) {
+				t.Fatalf("expected flows %+v, got %+v", tc.wantFlows, cfg.Derived.Registration.Flows)
+			}
+		})
+	}
+}
+
+func TestUsernameBlocklist(t *testing.T) {
+	cfg := Dendrite{}
+	cfg.Defaults(DefaultOpts{Generate: true, Monolithic: true})
+	cfg.ClientAPI.UsernameBlocklist = []string{"admin*", "Mod?", "/^support[0-9]+$/"}
+
+	var configErrs ConfigErrors
+	cfg.ClientAPI.Verify(&configErrs, true)
+	if len(configErrs) != 0 {
+		t.Fatalf("unexpected config errors: %v", configErrs)
+	}
+	if err := cfg.Derive(); err != nil {
+		t.Fatalf("failed to derive config: %s", err)
+	}
+
+	for localpart, want := range map[string]bool{
+		"admin":         true,
+		"Administrator": true,
+		"mod1":          true,
+		"mod":           false,
+		"moderator":     false,
+		"support42":     true,
+		"support":       false,
+		"supportive":    false,
+		"alice":         false,
+		"admin.bot":     true,
+		"xadmin":        false,
+	} {
+		if got := cfg.ClientAPI.IsUsernameBlocked(localpart); got != want {
+			t.Errorf("IsUsernameBlocked(%q): got %v, want %v", localpart, got, want)
+		}
+	}
+
+	cfg.ClientAPI.UsernameBlocklist = []string{"/[/", ""}
+	configErrs = nil
+	cfg.ClientAPI.Verify(&configErrs, true)
+	if len(configErrs) != 2 {
+		t.Fatalf("expected 2 config errors, got %v", configErrs)
+	}
+}
+
+func TestLoginFlowOrder(t *testing.T) {
+	sso := SSO{
+		Enabled: true,
+		Providers: []IdentityProvider{{
+			ID:     "github",
+			Name:   "GitHub",
+			Type:   SSOTypeGitHub,
+			OAuth2: OAuth2{ClientID: "id", ClientSecret: "secret"},
+		}},
+	}
+
+	testCases := []struct {
+		name     string
+		login    Login
+		wantErrs int
+	}{
+		{
+			name:  "default order",
+			login: Login{SSO: sso},
+		},
+		{
+			name:  "enabled login types",
+			login: Login{SSO: sso, FlowOrder: []authtypes.LoginType{authtypes.LoginTypeSSO, authtypes.LoginTypeToken, authtypes.LoginTypePassword}},
+		},
+		{
+			name:     "SSO is disabled",
+			login:    Login{FlowOrder: []authtypes.LoginType{authtypes.LoginTypeSSO, authtypes.LoginTypePassword}},
+			wantErrs: 1,
+		},
+		{
+			name:     "password login is disabled",
+			login:    Login{SSO: sso, Password: Password{Disabled: true}, FlowOrder: []authtypes.LoginType{authtypes.LoginTypePassword}},
+			wantErrs: 1,
+		},
+		{
+			name:     "unsupported login type",
+			login:    Login{FlowOrder: []authtypes.LoginType{authtypes.LoginTypeApplicationService}},
+			wantErrs: 1,
+		},
+		{
+			name:     "duplicate login type",
+			login:    Login{FlowOrder: []authtypes.LoginType{authtypes.LoginTypePassword, authtypes.LoginTypePassword}},
+			wantErrs: 1,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var configErrs ConfigErrors
+			tc.login.Verify(&configErrs)
+			if len(configErrs) != tc.wantErrs {
+				t.Fatalf("expected %d config errors, got %v", tc.wantErrs, configErrs)
+			}
+		})
+	}
+}
+
+func TestLoadSSOIcons(t *testing.T) {
+	dir := t.TempDir()
+	iconPath := filepath.Join(dir, "icon.png")
+	if err := os.WriteFile(iconPath, []byte("\x89PNG\r\n\x1a\n"+"an icon"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	textPath := filepath.Join(dir, "icon.txt")
+	if err := os.WriteFile(textPath, []byte("not an icon"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sso := SSO{
+		Enabled: true,
+		Providers: []IdentityProvider{
+			{ID: "github", IconPath: Path(iconPath)},
+			{ID: "gitlab", Icon: "mxc://example.com/gitlab"},
+		},
+	}
+
+	var derived Derived
+	if err := loadSSOIcons(&sso, "example.com", &derived); err != nil {
+		t.Fatalf("loadSSOIcons failed: %v", err)
+	}
+	if len(derived.SSOIcons) != 1 {
+		t.Fatalf("expected 1 icon, got %+v", derived.SSOIcons)
+	}
+	icon := derived.SSOIcons["github"]
+	if icon.Path != iconPath || string(icon.Data) != "\x89PNG\r\n\x1a\n"+"an icon" || !regexp.MustCompile("^mxc://example.com/[0-9a-f]{64}$").MatchString(icon.ContentURI) || icon.ContentURI != "mxc://example.com/"+icon.MediaID {
+		t.Fatalf("unexpected icon %+v", icon)
+	}
+
+	// The media ID only changes when the image does.
+	var again Derived
+	if err := loadSSOIcons(&sso, "example.com", &again); err != nil {
+		t.Fatalf("loadSSOIcons failed: %v", err)
+	}
+	if again.SSOIcons["github"].MediaID != icon.MediaID {
+		t.Fatalf("expected the same icon, got %+v and %+v", icon, again.SSOIcons["github"])
+	}
+	if err := os.WriteFile(iconPath, []byte("\x89PNG\r\n\x1a\n"+"another icon"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadSSOIcons(&sso, "example.com", &again); err != nil {
+		t.Fatalf("loadSSOIcons failed: %v", err)
+	}
+	if again.SSOIcons["github"].MediaID == icon.MediaID {
+		t.Fatalf("expected a new media ID for the changed image, got %q", icon.MediaID)
+	}
+
+	sso.Providers[0].IconPath = Path(textPath)
+	if err := loadSSOIcons(&sso, "example.com", &derived); err == nil {
+		t.Fatalf("expected an error for an icon which isn't an image")
+	}
+
+	var configErrs ConfigErrors
+	idp := IdentityProvider{
+		ID:       "github",
+		Name:     "GitHub",
+		Type:     SSOTypeGitHub,
+		OAuth2:   OAuth2{ClientID: "id", ClientSecret: "secret"},
+		Icon:     "mxc://example.com/github",
+		IconPath: Path(iconPath),
+	}
+	idp.Verify(&configErrs)
+	if len(configErrs) != 1 {
+		t.Fatalf("expected 1 config error for setting both icon and icon_path, got %v", configErrs)
+	}
+}
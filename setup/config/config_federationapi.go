@@ -1,6 +1,11 @@
 package config
 
-import "github.com/matrix-org/gomatrixserverlib"
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
 
 type FederationAPI struct {
 	Matrix *Global `yaml:"-"`
@@ -27,12 +32,54 @@ type FederationAPI struct {
 	// but we may spend more time on TLS handshakes instead.
 	DisableHTTPKeepalives bool `yaml:"disable_http_keepalives"`
 
+	// The User-Agent header sent with requests to other servers. If empty,
+	// "Dendrite/" followed by the version of Dendrite is sent.
+	UserAgent string `yaml:"user_agent"`
+
 	// Perspective keyservers, to use as a backup when direct key fetch
 	// requests don't succeed
 	KeyPerspectives KeyPerspectives `yaml:"key_perspectives"`
 
 	// Should we prefer direct key fetches over perspective ones?
 	PreferDirectFetch bool `yaml:"prefer_direct_fetch"`
+
+	// Caching of the results of fetching the signing keys of other servers
+	KeyFetching KeyFetching `yaml:"key_fetching"`
+
+	// Per-destination TLS settings, for federation partners which require
+	// mutual TLS or a custom SNI.
+	DestinationTLS []DestinationTLS `yaml:"destination_tls"`
+
+	// The maximum number of federated joins which may be in progress at the
+	// same time. If 0, the number of concurrent joins is not limited.
+	MaxConcurrentJoins int `yaml:"max_concurrent_joins"`
+
+	// Whether joins beyond max_concurrent_joins wait for another join to
+	// finish, rather than being rejected with M_LIMIT_EXCEEDED.
+	QueueExcessJoins bool `yaml:"queue_excess_joins"`
+
+	// The maximum number of inbound transactions which may be processed at
+	// the same time, across all origins. Transactions beyond the limit are
+	// rejected with a 429 so that the origin retries them later. If 0, the
+	// number of concurrent transactions is not limited.
+	MaxConcurrentTransactions int `yaml:"max_concurrent_transactions"`
+
+	// The maximum number of inbound transactions from a single origin which
+	// may be processed at the same time, so that one busy server can't starve
+	// the others. If 0, the number per origin is not limited.
+	MaxConcurrentTransactionsPerOrigin int `yaml:"max_concurrent_transactions_per_origin"`
+
+	// Per-destination rules for which types of EDU are sent, e.g. to stop
+	// sending presence or typing notifications to some servers. PDUs are not
+	// affected.
+	EDUFilters EDUFilters `yaml:"edu_filters"`
+
+	// Catching up on events in joined rooms which were missed while Dendrite
+	// was not running.
+	CatchUp CatchUp `yaml:"catch_up"`
+
+	// Stopping requests to servers which keep failing them for a while.
+	CircuitBreaker CircuitBreaker `yaml:"circuit_breaker"`
 }
 
 func (c *FederationAPI) Defaults(opts DefaultOpts) {
@@ -45,6 +92,10 @@ func (c *FederationAPI) Defaults(opts DefaultOpts) {
 	c.FederationMaxRetries = 16
 	c.DisableTLSValidation = false
 	c.DisableHTTPKeepalives = false
+	c.KeyFetching.FailureCacheDuration = 5 * time.Minute
+	c.KeyFetching.RefreshBeforeExpiry = time.Hour
+	c.CatchUp.Defaults()
+	c.CircuitBreaker.Defaults()
 	if opts.Generate {
 		c.KeyPerspectives = KeyPerspectives{
 			{
@@ -68,17 +119,200 @@ func (c *FederationAPI) Defaults(opts DefaultOpts) {
 }
 
 func (c *FederationAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.MaxConcurrentJoins < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "federation_api.max_concurrent_joins", c.MaxConcurrentJoins))
+	}
+	if c.MaxConcurrentTransactions < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "federation_api.max_concurrent_transactions", c.MaxConcurrentTransactions))
+	}
+	if c.MaxConcurrentTransactionsPerOrigin < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "federation_api.max_concurrent_transactions_per_origin", c.MaxConcurrentTransactionsPerOrigin))
+	}
+	seen := make(map[gomatrixserverlib.ServerName]struct{}, len(c.DestinationTLS))
+	for i := range c.DestinationTLS {
+		d := &c.DestinationTLS[i]
+		d.Verify(configErrs, fmt.Sprintf("federation_api.destination_tls[%d]", i))
+		if _, ok := seen[d.ServerName]; ok {
+			configErrs.Add(fmt.Sprintf("duplicate server name for config key %q: %s", fmt.Sprintf("federation_api.destination_tls[%d].server_name", i), d.ServerName))
+		}
+		seen[d.ServerName] = struct{}{}
+	}
+	c.EDUFilters.Verify(configErrs, "federation_api.edu_filters")
+	c.KeyFetching.Verify(configErrs)
+	c.CatchUp.Verify(configErrs)
+	c.CircuitBreaker.Verify(configErrs)
 	if isMonolith { // polylith required configs below
 		return
 	}
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "federation_api.database.connection_string", string(c.Database.ConnectionString))
 	}
+	c.Database.Verify(configErrs, isMonolith)
 	checkURL(configErrs, "federation_api.external_api.listen", string(c.ExternalAPI.Listen))
 	checkURL(configErrs, "federation_api.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "federation_api.internal_api.connect", string(c.InternalAPI.Connect))
 }
 
+// KeyFetching controls how the results of fetching the signing keys of other
+// servers are cached, on top of the keys themselves being cached.
+type KeyFetching struct {
+	// How long to remember that a key of a server could not be fetched, so
+	// that verifying events from an unreachable server doesn't wait for the
+	// fetch to time out every time. If 0, failures are not remembered.
+	FailureCacheDuration time.Duration `yaml:"failure_cache_duration"`
+
+	// How long before the keys of a server stop being valid to fetch fresh
+	// ones in the background, so that verifying events doesn't have to wait
+	// for them. If 0, keys are only fetched once they are no longer valid.
+	RefreshBeforeExpiry time.Duration `yaml:"refresh_before_expiry"`
+}
+
+func (c *KeyFetching) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "federation_api.key_fetching.failure_cache_duration", int64(c.FailureCacheDuration))
+	checkPositive(configErrs, "federation_api.key_fetching.refresh_before_expiry", int64(c.RefreshBeforeExpiry))
+}
+
+// CatchUp controls how Dendrite catches up on events in joined rooms which
+// were sent while it was not running. Other servers in each room are asked
+// for their latest events, and any which are missing locally are fetched
+// along with the gap before them.
+type CatchUp struct {
+	// Whether to catch up on startup
+	Enabled bool `yaml:"enabled"`
+
+	// The maximum number of rooms to catch up on, in order of room ID. If 0,
+	// all joined rooms are caught up on.
+	MaxRooms int `yaml:"max_rooms"`
+
+	// The maximum number of other servers to ask for the latest events in
+	// each room
+	MaxServersPerRoom int `yaml:"max_servers_per_room"`
+
+	// How long to wait after catching up on a room before moving on to the
+	// next one, so that startup doesn't flood other servers with requests
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (c *CatchUp) Defaults() {
+	c.Enabled = false
+	c.MaxRooms = 0
+	c.MaxServersPerRoom = 3
+	c.Interval = time.Second
+}
+
+func (c *CatchUp) Verify(configErrs *ConfigErrors) {
+	checkPositive(configErrs, "federation_api.catch_up.max_rooms", int64(c.MaxRooms))
+	checkPositive(configErrs, "federation_api.catch_up.interval", int64(c.Interval))
+	if c.Enabled && c.MaxServersPerRoom <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "federation_api.catch_up.max_servers_per_room", c.MaxServersPerRoom))
+	}
+}
+
+// CircuitBreaker controls the circuit breakers of outbound federation
+// requests. Once enough requests to a server have failed in a row, further
+// requests to it fail straight away without being sent. After a while, a
+// single request is let through to find out whether the server has recovered.
+type CircuitBreaker struct {
+	// Whether to use circuit breakers
+	Enabled bool `yaml:"enabled"`
+
+	// How many requests must fail in a row to open the circuit breaker
+	FailureThreshold uint32 `yaml:"failure_threshold"`
+
+	// How long the circuit breaker stays open before a request is let through
+	OpenDuration time.Duration `yaml:"open_duration"`
+}
+
+func (c *CircuitBreaker) Defaults() {
+	c.Enabled = false
+	c.FailureThreshold = 5
+	c.OpenDuration = time.Minute
+}
+
+func (c *CircuitBreaker) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if c.FailureThreshold == 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "federation_api.circuit_breaker.failure_threshold", c.FailureThreshold))
+	}
+	checkPositive(configErrs, "federation_api.circuit_breaker.open_duration", int64(c.OpenDuration))
+}
+
+// DestinationTLS overrides the TLS settings used when making federation
+// requests to a specific server.
+type DestinationTLS struct {
+	// The server name of the remote homeserver these settings apply to
+	ServerName gomatrixserverlib.ServerName `yaml:"server_name"`
+	// The client certificate and private key to present to the remote server,
+	// in PEM format. Both must be set, or neither.
+	ClientCertificatePath Path `yaml:"client_certificate"`
+	ClientPrivateKeyPath  Path `yaml:"client_private_key"`
+	// A PEM file of CA certificates to verify the remote server certificate
+	// against, instead of the system roots
+	CACertificatePath Path `yaml:"ca_certificate"`
+	// The server name to send in the TLS SNI extension and to verify the
+	// remote server certificate against, instead of the resolved one
+	SNI string `yaml:"sni"`
+}
+
+func (c *DestinationTLS) Verify(configErrs *ConfigErrors, key string) {
+	checkNotEmpty(configErrs, key+".server_name", string(c.ServerName))
+	if (c.ClientCertificatePath == "") != (c.ClientPrivateKeyPath == "") {
+		configErrs.Add(fmt.Sprintf("config keys %q and %q must be set together", key+".client_certificate", key+".client_private_key"))
+	}
+}
+
+// EDUFilters is a list of EDUFilter, at most one per destination.
+type EDUFilters []EDUFilter
+
+// EDUFilter restricts which types of EDU, such as m.typing or m.presence, are
+// sent to a destination.
+type EDUFilter struct {
+	// The server name of the remote homeserver this filter applies to
+	ServerName gomatrixserverlib.ServerName `yaml:"server_name"`
+	// If not empty, only EDUs of these types are sent
+	Allow []string `yaml:"allow"`
+	// EDUs of these types are never sent. This takes precedence over allow.
+	Deny []string `yaml:"deny"`
+}
+
+func (f EDUFilters) Verify(configErrs *ConfigErrors, key string) {
+	seen := make(map[gomatrixserverlib.ServerName]struct{}, len(f))
+	for i := range f {
+		serverNameKey := fmt.Sprintf("%s[%d].server_name", key, i)
+		checkNotEmpty(configErrs, serverNameKey, string(f[i].ServerName))
+		if _, ok := seen[f[i].ServerName]; ok {
+			configErrs.Add(fmt.Sprintf("duplicate server name for config key %q: %s", serverNameKey, f[i].ServerName))
+		}
+		seen[f[i].ServerName] = struct{}{}
+	}
+}
+
+// Allowed returns whether EDUs of the given type may be sent to the destination.
+func (f EDUFilters) Allowed(destination gomatrixserverlib.ServerName, eduType string) bool {
+	for i := range f {
+		if f[i].ServerName != destination {
+			continue
+		}
+		for _, t := range f[i].Deny {
+			if t == eduType {
+				return false
+			}
+		}
+		if len(f[i].Allow) == 0 {
+			return true
+		}
+		for _, t := range f[i].Allow {
+			if t == eduType {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
 // The config for setting a proxy to use for server->server requests
 type Proxy struct {
 	// Is the proxy enabled?
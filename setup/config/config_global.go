@@ -71,6 +71,9 @@ type Global struct {
 	// DNS caching options for all outbound HTTP requests
 	DNSCache DNSCacheOptions `yaml:"dns_cache"`
 
+	// How to handle outbound HTTP requests which are rate-limited by the remote side
+	RetryAfter RetryAfterOptions `yaml:"retry_after"`
+
 	// ServerNotices configuration used for sending server notices
 	ServerNotices ServerNotices `yaml:"server_notices"`
 
@@ -79,6 +82,12 @@ type Global struct {
 
 	// Configuration for the caches.
 	Cache Cache `yaml:"cache"`
+
+	// Limits on the size of the event graph an event may reference.
+	EventLimits EventLimits `yaml:"event_limits"`
+
+	// Limits on how quickly users can join any single room.
+	RoomJoins RoomJoins `yaml:"room_joins"`
 }
 
 func (c *Global) Defaults(opts DefaultOpts) {
@@ -99,10 +108,13 @@ func (c *Global) Defaults(opts DefaultOpts) {
 	c.JetStream.Defaults(opts)
 	c.Metrics.Defaults(opts)
 	c.DNSCache.Defaults()
+	c.RetryAfter.Defaults()
 	c.Sentry.Defaults()
 	c.ServerNotices.Defaults(opts)
 	c.ReportStats.Defaults()
 	c.Cache.Defaults()
+	c.EventLimits.Defaults()
+	c.RoomJoins.Defaults()
 }
 
 func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -113,13 +125,17 @@ func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		v.Verify(configErrs)
 	}
 
+	c.DatabaseOptions.Verify(configErrs, isMonolith)
 	c.JetStream.Verify(configErrs, isMonolith)
 	c.Metrics.Verify(configErrs, isMonolith)
 	c.Sentry.Verify(configErrs, isMonolith)
 	c.DNSCache.Verify(configErrs, isMonolith)
+	c.RetryAfter.Verify(configErrs, isMonolith)
 	c.ServerNotices.Verify(configErrs, isMonolith)
 	c.ReportStats.Verify(configErrs, isMonolith)
 	c.Cache.Verify(configErrs, isMonolith)
+	c.EventLimits.Verify(configErrs, isMonolith)
+	c.RoomJoins.Verify(configErrs, isMonolith)
 }
 
 func (c *Global) IsLocalServerName(serverName gomatrixserverlib.ServerName) bool {
@@ -298,6 +314,21 @@ func (c *ServerNotices) Verify(errors *ConfigErrors, isMonolith bool) {}
 type Cache struct {
 	EstimatedMaxSize DataUnit      `yaml:"max_size_estimated"`
 	MaxAge           time.Duration `yaml:"max_age"`
+
+	// The maximum number of entries in individual caches. Caches with a limit
+	// evict their least recently used entries when full, and the rest share
+	// the space given by EstimatedMaxSize.
+	MaxEntries CacheMaxEntries `yaml:"max_entries"`
+}
+
+// CacheMaxEntries holds the maximum number of entries for each of the caches
+// which can be sized individually. 0 means that the cache shares the global
+// cache instead.
+type CacheMaxEntries struct {
+	RoomVersions   int `yaml:"room_versions"`
+	ServerKeys     int `yaml:"server_keys"`
+	EventStateKeys int `yaml:"event_state_keys"`
+	LazyLoading    int `yaml:"lazy_loading"`
 }
 
 func (c *Cache) Defaults() {
@@ -307,6 +338,16 @@ func (c *Cache) Defaults() {
 
 func (c *Cache) Verify(errors *ConfigErrors, isMonolith bool) {
 	checkPositive(errors, "max_size_estimated", int64(c.EstimatedMaxSize))
+	for key, value := range map[string]int{
+		"global.cache.max_entries.room_versions":    c.MaxEntries.RoomVersions,
+		"global.cache.max_entries.server_keys":      c.MaxEntries.ServerKeys,
+		"global.cache.max_entries.event_state_keys": c.MaxEntries.EventStateKeys,
+		"global.cache.max_entries.lazy_loading":     c.MaxEntries.LazyLoading,
+	} {
+		if value < 0 {
+			errors.Add(fmt.Sprintf("invalid value for config key %q: %d", key, value))
+		}
+	}
 }
 
 // ReportStats configures opt-in phone-home statistics reporting.
@@ -329,6 +370,60 @@ func (c *ReportStats) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	}
 }
 
+// The maximum number of prev_events and auth_events allowed by the spec.
+const (
+	DefaultMaxPrevEvents = 20
+	DefaultMaxAuthEvents = 10
+)
+
+// MaxEventDepth is the largest depth an event may have, which is the largest
+// integer that can be represented in canonical JSON.
+const MaxEventDepth = 1<<53 - 1
+
+// EventLimits configures the limits which are enforced on events created
+// locally and received over federation.
+type EventLimits struct {
+	// The maximum number of prev_events an event may reference. 0 means
+	// that there is no limit.
+	MaxPrevEvents int `yaml:"max_prev_events"`
+
+	// The maximum number of auth_events an event may reference. 0 means
+	// that there is no limit.
+	MaxAuthEvents int `yaml:"max_auth_events"`
+}
+
+func (c *EventLimits) Defaults() {
+	c.MaxPrevEvents = DefaultMaxPrevEvents
+	c.MaxAuthEvents = DefaultMaxAuthEvents
+}
+
+func (c *EventLimits) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	checkPositive(configErrs, "global.event_limits.max_prev_events", int64(c.MaxPrevEvents))
+	checkPositive(configErrs, "global.event_limits.max_auth_events", int64(c.MaxAuthEvents))
+}
+
+// RoomJoins limits how quickly users can join any single room, to protect
+// rooms and the server from join floods. Joins from local users and joins
+// over federation are each limited per room. Server administrators and
+// exempt users are not limited.
+type RoomJoins struct {
+	// Rate limiting of joins to each room. Disabled by default.
+	RateLimiting RateLimiting `yaml:"rate_limiting"`
+}
+
+func (c *RoomJoins) Defaults() {
+	c.RateLimiting.Enabled = false
+	c.RateLimiting.Threshold = 10
+	c.RateLimiting.CooloffMS = 10000
+}
+
+func (c *RoomJoins) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.RateLimiting.Enabled {
+		checkPositive(configErrs, "global.room_joins.rate_limiting.threshold", c.RateLimiting.Threshold)
+		checkPositive(configErrs, "global.room_joins.rate_limiting.cooloff_ms", c.RateLimiting.CooloffMS)
+	}
+}
+
 // The configuration to use for Sentry error reporting
 type Sentry struct {
 	Enabled bool `yaml:"enabled"`
@@ -350,6 +445,9 @@ func (c *Sentry) Verify(configErrs *ConfigErrors, isMonolith bool) {
 type DatabaseOptions struct {
 	// The connection string, file:filename.db or postgres://server....
 	ConnectionString DataSource `yaml:"connection_string"`
+	// An optional connection string for a PostgreSQL read replica. If set, read-only
+	// queries which can tolerate replication lag will be served from the replica.
+	ReadReplicaConnectionString DataSource `yaml:"read_replica_connection_string"`
 	// Maximum open connections to the DB (0 = use default, negative means unlimited)
 	MaxOpenConnections int `yaml:"max_open_conns"`
 	// Maximum idle connections to the DB (0 = use default, negative means unlimited)
@@ -365,6 +463,12 @@ func (c *DatabaseOptions) Defaults(conns int) {
 }
 
 func (c *DatabaseOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if c.ReadReplicaConnectionString == "" {
+		return
+	}
+	if !c.ConnectionString.IsPostgres() || !c.ReadReplicaConnectionString.IsPostgres() {
+		configErrs.Add("database.read_replica_connection_string is only supported with PostgreSQL databases")
+	}
 }
 
 // MaxIdleConns returns maximum idle connections to the DB
@@ -402,6 +506,29 @@ func (c *DNSCacheOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkPositive(configErrs, "cache_lifetime", int64(c.CacheLifetime))
 }
 
+// RetryAfterOptions defines how outbound federation, media and push requests
+// which are rejected with 429 Too Many Requests are retried.
+type RetryAfterOptions struct {
+	// Whether to retry rate-limited requests after the Retry-After delay
+	Enabled bool `yaml:"enabled"`
+	// The longest Retry-After delay to wait for. Requests asking us to wait
+	// for longer fail straight away and are retried by the usual backoff.
+	MaxDelay time.Duration `yaml:"max_delay"`
+	// How many times to retry a single request
+	MaxRetries int `yaml:"max_retries"`
+}
+
+func (c *RetryAfterOptions) Defaults() {
+	c.Enabled = true
+	c.MaxDelay = time.Second * 10
+	c.MaxRetries = 2
+}
+
+func (c *RetryAfterOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	checkPositive(configErrs, "global.retry_after.max_delay", int64(c.MaxDelay))
+	checkPositive(configErrs, "global.retry_after.max_retries", int64(c.MaxRetries))
+}
+
 // PresenceOptions defines possible configurations for presence events.
 type PresenceOptions struct {
 	// Whether inbound presence events are allowed
@@ -28,6 +28,7 @@ func (c *KeyServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "key_server.database.connection_string", string(c.Database.ConnectionString))
 	}
+	c.Database.Verify(configErrs, isMonolith)
 	checkURL(configErrs, "key_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "key_server.internal_api.connect", string(c.InternalAPI.Connect))
 }
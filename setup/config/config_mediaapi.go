@@ -2,6 +2,9 @@ package config
 
 import (
 	"fmt"
+	"mime"
+	"strings"
+	"time"
 )
 
 type MediaAPI struct {
@@ -25,6 +28,10 @@ type MediaAPI struct {
 	// Note: if max_file_size_bytes is not set, it will default to 10485760 (10MB)
 	MaxFileSizeBytes FileSizeBytes `yaml:"max_file_size_bytes,omitempty"`
 
+	// Maximum file sizes for particular content types, e.g. to allow larger
+	// videos than images. The first matching entry overrides max_file_size_bytes.
+	ContentTypeMaxFileSizes []ContentTypeMaxFileSize `yaml:"content_type_max_file_sizes"`
+
 	// Whether to dynamically generate thumbnails on-the-fly if the requested resolution is not already generated
 	DynamicThumbnails bool `yaml:"dynamic_thumbnails"`
 
@@ -33,6 +40,57 @@ type MediaAPI struct {
 
 	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// A list of content types which may be uploaded, e.g. "image/png" or "image/*".
+	// If empty, all content types are allowed unless listed in denied_content_types.
+	AllowedContentTypes []string `yaml:"allowed_content_types"`
+
+	// A list of content types which may not be uploaded. This takes precedence
+	// over allowed_content_types.
+	DeniedContentTypes []string `yaml:"denied_content_types"`
+
+	// Limits on fetching media from remote servers over federation.
+	RemoteFetch RemoteFetch `yaml:"remote_fetch"`
+
+	// Caching headers for downloaded media and thumbnails.
+	CacheControl MediaCacheControl `yaml:"cache_control"`
+}
+
+// MediaCacheControl sets the Cache-Control header sent with media. Media IDs are
+// never reused, so the content of a media URL never changes and can be cached
+// for a long time.
+type MediaCacheControl struct {
+	// How long browsers and proxies may cache media for. If 0, no Cache-Control
+	// header is sent.
+	MaxAge time.Duration `yaml:"max_age"`
+
+	// Whether to mark media as immutable, so that browsers don't revalidate it
+	// while it is still fresh.
+	Immutable bool `yaml:"immutable"`
+}
+
+// RemoteFetch limits how media is fetched from remote servers, so that slow or
+// huge remote files can't tie up the media API.
+type RemoteFetch struct {
+	// How long to wait for a remote server to send a file before giving up.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// The maximum size in bytes of a file fetched from a remote server. If 0,
+	// max_file_size_bytes is used instead.
+	MaxFileSizeBytes FileSizeBytes `yaml:"max_file_size_bytes"`
+
+	// How long to remember that a remote file could not be fetched, so that
+	// repeated requests for it fail without contacting the remote server.
+	// If 0, failures are not remembered.
+	FailureCacheDuration time.Duration `yaml:"failure_cache_duration"`
+}
+
+// ContentTypeMaxFileSize is the maximum size of uploaded files of a content type.
+type ContentTypeMaxFileSize struct {
+	// A content type such as "video/mp4" or "video/*"
+	ContentType string `yaml:"content_type"`
+	// The maximum file size in bytes for this content type
+	MaxFileSizeBytes FileSizeBytes `yaml:"max_file_size_bytes"`
 }
 
 // DefaultMaxFileSizeBytes defines the default file size allowed in transfers
@@ -47,6 +105,10 @@ func (c *MediaAPI) Defaults(opts DefaultOpts) {
 	}
 	c.MaxFileSizeBytes = DefaultMaxFileSizeBytes
 	c.MaxThumbnailGenerators = 10
+	c.RemoteFetch.Timeout = time.Minute
+	c.RemoteFetch.FailureCacheDuration = time.Minute
+	c.CacheControl.MaxAge = 365 * 24 * time.Hour
+	c.CacheControl.Immutable = true
 	if opts.Generate {
 		c.ThumbnailSizes = []ThumbnailSize{
 			{
@@ -76,6 +138,28 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkNotEmpty(configErrs, "media_api.base_path", string(c.BasePath))
 	checkPositive(configErrs, "media_api.max_file_size_bytes", int64(c.MaxFileSizeBytes))
 	checkPositive(configErrs, "media_api.max_thumbnail_generators", int64(c.MaxThumbnailGenerators))
+	checkPositive(configErrs, "media_api.remote_fetch.timeout", int64(c.RemoteFetch.Timeout))
+	if c.RemoteFetch.MaxFileSizeBytes < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "media_api.remote_fetch.max_file_size_bytes", c.RemoteFetch.MaxFileSizeBytes))
+	}
+	if c.RemoteFetch.FailureCacheDuration < 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.remote_fetch.failure_cache_duration", c.RemoteFetch.FailureCacheDuration))
+	}
+	if c.CacheControl.MaxAge < 0 {
+		configErrs.Add(fmt.Sprintf("invalid duration for config key %q: %s", "media_api.cache_control.max_age", c.CacheControl.MaxAge))
+	}
+
+	for i, contentType := range c.AllowedContentTypes {
+		checkContentTypePattern(configErrs, fmt.Sprintf("media_api.allowed_content_types[%d]", i), contentType)
+	}
+	for i, contentType := range c.DeniedContentTypes {
+		checkContentTypePattern(configErrs, fmt.Sprintf("media_api.denied_content_types[%d]", i), contentType)
+	}
+
+	for i, limit := range c.ContentTypeMaxFileSizes {
+		checkContentTypePattern(configErrs, fmt.Sprintf("media_api.content_type_max_file_sizes[%d].content_type", i), limit.ContentType)
+		checkPositive(configErrs, fmt.Sprintf("media_api.content_type_max_file_sizes[%d].max_file_size_bytes", i), int64(limit.MaxFileSizeBytes))
+	}
 
 	for i, size := range c.ThumbnailSizes {
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].width", i), int64(size.Width))
@@ -87,7 +171,74 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "media_api.database.connection_string", string(c.Database.ConnectionString))
 	}
+	c.Database.Verify(configErrs, isMonolith)
 	checkURL(configErrs, "media_api.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "media_api.internal_api.connect", string(c.InternalAPI.Connect))
 	checkURL(configErrs, "media_api.external_api.listen", string(c.ExternalAPI.Listen))
 }
+
+// RemoteMaxFileSizeBytes returns the maximum size of a file fetched from a
+// remote server, where 0 means unlimited.
+func (c *MediaAPI) RemoteMaxFileSizeBytes() FileSizeBytes {
+	if c.RemoteFetch.MaxFileSizeBytes > 0 {
+		return c.RemoteFetch.MaxFileSizeBytes
+	}
+	return c.MaxFileSizeBytes
+}
+
+// MaxFileSizeBytesFor returns the maximum size of an uploaded file of the given
+// content type, where 0 means unlimited.
+func (c *MediaAPI) MaxFileSizeBytesFor(contentType string) FileSizeBytes {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return c.MaxFileSizeBytes
+	}
+	for _, limit := range c.ContentTypeMaxFileSizes {
+		if contentTypeMatches(limit.ContentType, mediaType) {
+			return limit.MaxFileSizeBytes
+		}
+	}
+	return c.MaxFileSizeBytes
+}
+
+// ContentTypeAllowed returns whether media of the given content type may be
+// uploaded, according to the allowed and denied content type lists.
+func (c *MediaAPI) ContentTypeAllowed(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range c.DeniedContentTypes {
+		if contentTypeMatches(pattern, mediaType) {
+			return false
+		}
+	}
+	if len(c.AllowedContentTypes) == 0 {
+		return true
+	}
+	for _, pattern := range c.AllowedContentTypes {
+		if contentTypeMatches(pattern, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// contentTypeMatches returns whether a media type such as "image/png" matches a
+// pattern such as "image/png", "image/*" or "*/*".
+func contentTypeMatches(pattern, mediaType string) bool {
+	pattern = strings.ToLower(pattern)
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+	if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+		return strings.HasPrefix(mediaType, prefix)
+	}
+	return false
+}
+
+func checkContentTypePattern(configErrs *ConfigErrors, key, value string) {
+	if parts := strings.Split(value, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		configErrs.Add(fmt.Sprintf("invalid content type for config key %q: %s", key, value))
+	}
+}
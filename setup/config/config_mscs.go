@@ -41,4 +41,5 @@ func (c *MSCs) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "mscs.database.connection_string", string(c.Database.ConnectionString))
 	}
+	c.Database.Verify(configErrs, isMonolith)
 }
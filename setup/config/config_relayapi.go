@@ -0,0 +1,79 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type RelayAPI struct {
+	Matrix *Global `yaml:"-"`
+
+	// The database stores transactions which are waiting to be collected by
+	// the servers we are relaying for.
+	Database DatabaseOptions `yaml:"database,omitempty"`
+
+	// The servers which this server will store and forward transactions for.
+	// These are typically servers which are behind NAT or are often offline.
+	// If empty, the relay is disabled.
+	Destinations []gomatrixserverlib.ServerName `yaml:"destinations"`
+
+	// How long a stored transaction is kept for before it is discarded if the
+	// destination has not collected it.
+	TransactionExpiry time.Duration `yaml:"transaction_expiry"`
+}
+
+func (c *RelayAPI) Defaults(opts DefaultOpts) {
+	if !opts.Monolithic {
+		c.Database.Defaults(5)
+	}
+	c.TransactionExpiry = time.Hour * 24
+	if opts.Generate {
+		if !opts.Monolithic {
+			c.Database.ConnectionString = "file:relayapi.db"
+		}
+	}
+}
+
+func (c *RelayAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	if len(c.Destinations) == 0 {
+		return
+	}
+	for i, destination := range c.Destinations {
+		checkNotEmpty(configErrs, fmt.Sprintf("relay_api.destinations[%d]", i), string(destination))
+	}
+	checkPositive(configErrs, "relay_api.transaction_expiry", int64(c.TransactionExpiry))
+	if isMonolith { // polylith required configs below
+		return
+	}
+	if c.Matrix.DatabaseOptions.ConnectionString == "" {
+		checkNotEmpty(configErrs, "relay_api.database.connection_string", string(c.Database.ConnectionString))
+	}
+	c.Database.Verify(configErrs, isMonolith)
+}
+
+// IsDestination returns whether this server relays transactions for the
+// given server.
+func (c *RelayAPI) IsDestination(serverName gomatrixserverlib.ServerName) bool {
+	for _, destination := range c.Destinations {
+		if destination == serverName {
+			return true
+		}
+	}
+	return false
+}
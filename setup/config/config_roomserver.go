@@ -1,19 +1,46 @@
 package config
 
+import "fmt"
+
 type RoomServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api,omitempty"`
 
 	Database DatabaseOptions `yaml:"database,omitempty"`
+
+	// What to do when a local user tries to join a room which has been replaced
+	// by an m.room.tombstone event. One of "allow", "reject" or "follow".
+	TombstonedRoomJoins string `yaml:"tombstoned_room_joins"`
+
+	// Room state compression, which removes redundant state from the database
+	// in the background.
+	StateCompression StateCompression `yaml:"state_compression"`
 }
 
+type StateCompression struct {
+	// Whether to compress the state of all rooms in the background after
+	// startup. Compression can also be triggered by the admin API.
+	Enabled bool `yaml:"enabled"`
+}
+
+const (
+	// TombstonedRoomJoinsAllow joins the tombstoned room as usual.
+	TombstonedRoomJoinsAllow = "allow"
+	// TombstonedRoomJoinsReject refuses the join with an error naming the
+	// replacement room, so that the client can join that instead.
+	TombstonedRoomJoinsReject = "reject"
+	// TombstonedRoomJoinsFollow joins the replacement room instead.
+	TombstonedRoomJoinsFollow = "follow"
+)
+
 func (c *RoomServer) Defaults(opts DefaultOpts) {
 	if !opts.Monolithic {
 		c.InternalAPI.Listen = "http://localhost:7770"
 		c.InternalAPI.Connect = "http://localhost:7770"
 		c.Database.Defaults(20)
 	}
+	c.TombstonedRoomJoins = TombstonedRoomJoinsAllow
 	if opts.Generate {
 		if !opts.Monolithic {
 			c.Database.ConnectionString = "file:roomserver.db"
@@ -22,12 +49,18 @@ func (c *RoomServer) Defaults(opts DefaultOpts) {
 }
 
 func (c *RoomServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
+	switch c.TombstonedRoomJoins {
+	case TombstonedRoomJoinsAllow, TombstonedRoomJoinsReject, TombstonedRoomJoinsFollow:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.tombstoned_room_joins", c.TombstonedRoomJoins))
+	}
 	if isMonolith { // polylith required configs below
 		return
 	}
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "room_server.database.connection_string", string(c.Database.ConnectionString))
 	}
+	c.Database.Verify(configErrs, isMonolith)
 	checkURL(configErrs, "room_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "room_server.internal_ap.connect", string(c.InternalAPI.Connect))
 }
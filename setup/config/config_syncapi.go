@@ -1,5 +1,10 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 type SyncAPI struct {
 	Matrix *Global `yaml:"-"`
 
@@ -11,6 +16,31 @@ type SyncAPI struct {
 	RealIPHeader string `yaml:"real_ip_header"`
 
 	Fulltext Fulltext `yaml:"search"`
+
+	// The maximum number of /sync requests a single device may have open at
+	// once. Requests beyond this are rejected with M_LIMIT_EXCEEDED. 0 means
+	// that there is no limit.
+	MaxConcurrentSyncsPerDevice int `yaml:"max_concurrent_syncs_per_device"`
+
+	// How long a /sync request may stay open beyond its requested timeout
+	// before it is considered stale and cancelled. Must be greater than 0.
+	StaleSyncGracePeriod time.Duration `yaml:"stale_sync_grace_period"`
+
+	// The maximum number of joined rooms in a complete sync response. If a
+	// user has more, the response includes a continuation to fetch the rest
+	// with. 0 means that there is no limit.
+	MaxRoomsPerInitialSync int `yaml:"max_rooms_per_initial_sync"`
+
+	// Whether incremental syncs with a "since" token ahead of the current
+	// event stream position, or from before history was purged in one of the
+	// user's rooms, are turned into complete syncs instead of returning
+	// inconsistent results.
+	ResetInvalidSinceTokens bool `yaml:"reset_invalid_since_tokens"`
+
+	// Whether to ask other servers in the room for events which clients
+	// request from /rooms/{roomID}/event/{eventID} but which we don't have,
+	// e.g. because they were referenced but never backfilled.
+	FetchMissingEventsOverFederation bool `yaml:"fetch_missing_events_over_federation"`
 }
 
 func (c *SyncAPI) Defaults(opts DefaultOpts) {
@@ -21,6 +51,11 @@ func (c *SyncAPI) Defaults(opts DefaultOpts) {
 		c.Database.Defaults(20)
 	}
 	c.Fulltext.Defaults(opts)
+	c.MaxConcurrentSyncsPerDevice = 0
+	c.StaleSyncGracePeriod = time.Minute
+	c.MaxRoomsPerInitialSync = 0
+	c.ResetInvalidSinceTokens = true
+	c.FetchMissingEventsOverFederation = false
 	if opts.Generate {
 		if !opts.Monolithic {
 			c.Database.ConnectionString = "file:syncapi.db"
@@ -30,12 +65,22 @@ func (c *SyncAPI) Defaults(opts DefaultOpts) {
 
 func (c *SyncAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	c.Fulltext.Verify(configErrs, isMonolith)
+	if c.MaxConcurrentSyncsPerDevice < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "sync_api.max_concurrent_syncs_per_device", c.MaxConcurrentSyncsPerDevice))
+	}
+	if c.StaleSyncGracePeriod <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "sync_api.stale_sync_grace_period", c.StaleSyncGracePeriod))
+	}
+	if c.MaxRoomsPerInitialSync < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "sync_api.max_rooms_per_initial_sync", c.MaxRoomsPerInitialSync))
+	}
 	if isMonolith { // polylith required configs below
 		return
 	}
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "sync_api.database", string(c.Database.ConnectionString))
 	}
+	c.Database.Verify(configErrs, isMonolith)
 	checkURL(configErrs, "sync_api.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "sync_api.internal_api.connect", string(c.InternalAPI.Connect))
 	checkURL(configErrs, "sync_api.external_api.listen", string(c.ExternalAPI.Listen))
@@ -1,6 +1,11 @@
 package config
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 type UserAPI struct {
 	Matrix *Global `yaml:"-"`
@@ -23,6 +28,19 @@ type UserAPI struct {
 	// Users who register on this homeserver will automatically
 	// be joined to the rooms listed under this option.
 	AutoJoinRooms []string `yaml:"auto_join_rooms"`
+
+	// Whether local room aliases listed in auto_join_rooms that do not exist yet
+	// should be created as public rooms when a user registers.
+	AutoCreateAutoJoinRooms bool `yaml:"auto_create_auto_join_rooms"`
+
+	// How often device last-seen information is written to the database. Updates
+	// for the same device within this interval are coalesced into a single write.
+	// If set to 0, every update is written immediately.
+	LastSeenUpdateInterval time.Duration `yaml:"last_seen_update_interval"`
+
+	// The maximum size in bytes of all of a user's account data and sync
+	// filters added together. 0 means no limit.
+	StorageQuotaPerUser int64 `yaml:"storage_quota_per_user"`
 }
 
 const DefaultOpenIDTokenLifetimeMS = 3600000 // 60 minutes
@@ -35,6 +53,8 @@ func (c *UserAPI) Defaults(opts DefaultOpts) {
 	}
 	c.BCryptCost = bcrypt.DefaultCost
 	c.OpenIDTokenLifetimeMS = DefaultOpenIDTokenLifetimeMS
+	c.LastSeenUpdateInterval = time.Minute
+	c.AutoCreateAutoJoinRooms = true
 	if opts.Generate {
 		if !opts.Monolithic {
 			c.AccountDatabase.ConnectionString = "file:userapi_accounts.db"
@@ -44,12 +64,17 @@ func (c *UserAPI) Defaults(opts DefaultOpts) {
 
 func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkPositive(configErrs, "user_api.openid_token_lifetime_ms", c.OpenIDTokenLifetimeMS)
+	if c.LastSeenUpdateInterval < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "user_api.last_seen_update_interval", c.LastSeenUpdateInterval))
+	}
+	checkPositive(configErrs, "user_api.storage_quota_per_user", c.StorageQuotaPerUser)
 	if isMonolith { // polylith required configs below
 		return
 	}
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	}
+	c.AccountDatabase.Verify(configErrs, isMonolith)
 	checkURL(configErrs, "user_api.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "user_api.internal_api.connect", string(c.InternalAPI.Connect))
 }
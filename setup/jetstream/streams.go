@@ -13,6 +13,7 @@ const (
 	RoomID        = "room_id"
 	EventID       = "event_id"
 	RoomEventType = "output_room_event_type"
+	RequestID     = "request_id"
 )
 
 var (
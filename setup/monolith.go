@@ -23,6 +23,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/transactions"
 	keyAPI "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/mediaapi"
+	"github.com/matrix-org/dendrite/relayapi"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/base"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -68,7 +69,10 @@ func (m *Monolith) AddAllPublicRoutes(base *base.BaseDendrite) {
 	mediaapi.AddPublicRoutes(
 		base, m.UserAPI, m.Client,
 	)
+	relayapi.AddPublicRoutes(
+		base, m.KeyRing,
+	)
 	syncapi.AddPublicRoutes(
-		base, m.UserAPI, m.RoomserverAPI, m.KeyAPI,
+		base, m.UserAPI, m.RoomserverAPI, m.KeyAPI, m.FederationAPI,
 	)
 }
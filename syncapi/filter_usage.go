@@ -0,0 +1,68 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package syncapi
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+const (
+	filterUsageUpdateName      = "syncapi_filter_usage"
+	filterUsageUpdateBatchSize = 100
+)
+
+// filterUsageUpdate reports the size of the filters of every user to the user
+// API, so that filters which were stored before the storage quota was enabled
+// count towards it too.
+func filterUsageUpdate(
+	syncDB storage.Database, userAPI userapi.SyncUserAPI, serverName gomatrixserverlib.ServerName,
+) sqlutil.BackgroundUpdate {
+	var afterLocalpart string
+	return sqlutil.BackgroundUpdate{
+		Name: filterUsageUpdateName,
+		Batch: func(ctx context.Context) (int64, bool, error) {
+			sizes, err := syncDB.FilterSizes(ctx, afterLocalpart, filterUsageUpdateBatchSize)
+			if err != nil {
+				afterLocalpart = ""
+				return 0, false, fmt.Errorf("syncDB.FilterSizes: %w", err)
+			}
+			for localpart, size := range sizes {
+				if err = userAPI.PerformFilterUsageUpdate(ctx, &userapi.PerformFilterUsageUpdateRequest{
+					UserID: userutil.MakeUserID(localpart, serverName),
+					Size:   size,
+				}, &userapi.PerformFilterUsageUpdateResponse{}); err != nil {
+					afterLocalpart = ""
+					return 0, false, fmt.Errorf("userAPI.PerformFilterUsageUpdate: %w", err)
+				}
+				if localpart > afterLocalpart {
+					afterLocalpart = localpart
+				}
+			}
+			if len(sizes) < filterUsageUpdateBatchSize {
+				afterLocalpart = ""
+				return int64(len(sizes)), true, nil
+			}
+			return int64(len(sizes)), false, nil
+		},
+	}
+}
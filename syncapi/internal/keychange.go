@@ -33,14 +33,25 @@ import (
 // DeviceOTKCounts adds one-time key counts to the /sync response
 func DeviceOTKCounts(ctx context.Context, keyAPI keyapi.SyncKeyAPI, userID, deviceID string, res *types.Response) error {
 	var queryRes keyapi.QueryOneTimeKeysResponse
-	_ = keyAPI.QueryOneTimeKeys(ctx, &keyapi.QueryOneTimeKeysRequest{
+	if err := keyAPI.QueryOneTimeKeys(ctx, &keyapi.QueryOneTimeKeysRequest{
 		UserID:   userID,
 		DeviceID: deviceID,
-	}, &queryRes)
+	}, &queryRes); err != nil {
+		return err
+	}
 	if queryRes.Error != nil {
 		return queryRes.Error
 	}
-	res.DeviceListsOTKCount = queryRes.Count.KeyCount
+	counts := make(map[string]int, len(queryRes.Count.KeyCount)+1)
+	for algorithm, count := range queryRes.Count.KeyCount {
+		counts[algorithm] = count
+	}
+	// Always report the signed_curve25519 count, even once all of the keys have
+	// been claimed, as some clients only upload more keys when they see it at zero.
+	if _, ok := counts["signed_curve25519"]; !ok {
+		counts["signed_curve25519"] = 0
+	}
+	res.DeviceListsOTKCount = counts
 	return nil
 }
 
@@ -52,7 +52,7 @@ func Context(
 	roomID, eventID string,
 	lazyLoadCache caching.LazyLoadCache,
 ) util.JSONResponse {
-	snapshot, err := syncDB.NewDatabaseSnapshot(req.Context())
+	snapshot, err := syncDB.NewDatabaseSnapshot(sqlutil.WithReadReplica(req.Context()))
 	if err != nil {
 		return jsonerror.InternalServerError()
 	}
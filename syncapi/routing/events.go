@@ -0,0 +1,193 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+const (
+	// defaultEventsTimeout is how long a legacy /events request waits for new
+	// events if the client doesn't say otherwise.
+	defaultEventsTimeout = 30 * time.Second
+	// eventsPollInterval is how often a waiting /events request checks
+	// whether new events have arrived.
+	eventsPollInterval = 100 * time.Millisecond
+	// eventsLimit is the maximum number of events returned at once.
+	eventsLimit = 100
+)
+
+type eventsResponse struct {
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	Start string                          `json:"start"`
+	End   string                          `json:"end"`
+}
+
+// OnIncomingEventsRequest implements the deprecated
+//
+//	GET /events
+//
+// Only peeking into world readable rooms with ?room_id= is supported, in which
+// case new events in the room are streamed to the user whether or not they are
+// a member. Without a room ID, an empty response is returned.
+func OnIncomingEventsRequest(
+	req *http.Request, device *userapi.Device,
+	syncDB storage.Database, rsAPI api.SyncRoomserverAPI, n *notifier.Notifier,
+) util.JSONResponse {
+	ctx := req.Context()
+	roomID := req.URL.Query().Get("room_id")
+	if roomID == "" {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: eventsResponse{Chunk: []gomatrixserverlib.ClientEvent{}},
+		}
+	}
+
+	timeout := defaultEventsTimeout
+	if t := req.URL.Query().Get("timeout"); t != "" {
+		ms, err := strconv.Atoi(t)
+		if err != nil || ms < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("unable to parse timeout"),
+			}
+		}
+		timeout = time.Duration(ms) * time.Millisecond
+	}
+
+	from := n.CurrentPosition().PDUPosition
+	if f := req.URL.Query().Get("from"); f != "" {
+		token, err := types.NewStreamTokenFromString(f)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("unable to parse from token"),
+			}
+		}
+		from = token.PDUPosition
+	}
+
+	worldReadable, err := roomIsWorldReadable(ctx, syncDB, roomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to get history visibility")
+		return jsonerror.InternalServerError()
+	}
+	if !worldReadable {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Room is not world readable"),
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(eventsPollInterval)
+	defer ticker.Stop()
+	for {
+		// Never ask for more positions than events we'll return, so that we
+		// don't skip over any events when there are lots of them.
+		to := n.CurrentPosition().PDUPosition
+		if to > from+eventsLimit {
+			to = from + eventsLimit
+		}
+		var events []*gomatrixserverlib.HeaderedEvent
+		if to > from {
+			events, err = eventsInRange(ctx, syncDB, rsAPI, device, roomID, types.Range{From: from, To: to})
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("failed to get events")
+				return jsonerror.InternalServerError()
+			}
+		}
+		if len(events) > 0 {
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: eventsResponse{
+					Chunk: gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll),
+					Start: types.StreamingToken{PDUPosition: from}.String(),
+					End:   types.StreamingToken{PDUPosition: to}.String(),
+				},
+			}
+		}
+		if to > from {
+			from = to
+		}
+
+		select {
+		case <-timer.C:
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: eventsResponse{
+					Chunk: []gomatrixserverlib.ClientEvent{},
+					Start: types.StreamingToken{PDUPosition: from}.String(),
+					End:   types.StreamingToken{PDUPosition: from}.String(),
+				},
+			}
+		case <-ctx.Done():
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: eventsResponse{Chunk: []gomatrixserverlib.ClientEvent{}},
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// roomIsWorldReadable returns whether the current history visibility of the
+// room allows anyone to read it.
+func roomIsWorldReadable(ctx context.Context, syncDB storage.Database, roomID string) (bool, error) {
+	snapshot, err := syncDB.NewDatabaseSnapshot(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer snapshot.Rollback() // nolint: errcheck
+	return isWorldReadable(ctx, snapshot, roomID)
+}
+
+// eventsInRange returns the events of the room in the given stream range
+// which the user is allowed to see, in chronological order.
+func eventsInRange(
+	ctx context.Context, syncDB storage.Database, rsAPI api.SyncRoomserverAPI,
+	device *userapi.Device, roomID string, r types.Range,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	snapshot, err := syncDB.NewDatabaseSnapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Rollback() // nolint: errcheck
+
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	filter.Limit = eventsLimit
+	streamEvents, _, err := snapshot.RecentEvents(ctx, roomID, r, &filter, true, true)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	events := snapshot.StreamEventsToEvents(device, streamEvents)
+	return internal.ApplyHistoryVisibilityFilter(ctx, snapshot, rsAPI, events, nil, device.UserID, "events")
+}
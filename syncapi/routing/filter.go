@@ -16,6 +16,7 @@ package routing
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 
@@ -70,7 +71,7 @@ type filterResponse struct {
 //
 //	POST /_matrix/client/r0/user/{userId}/filter
 func PutFilter(
-	req *http.Request, device *api.Device, syncDB storage.Database, userID string,
+	req *http.Request, device *api.Device, syncDB storage.Database, userAPI api.SyncUserAPI, userID string,
 ) util.JSONResponse {
 	if userID != device.UserID {
 		return util.JSONResponse{
@@ -118,9 +119,42 @@ func PutFilter(
 		}
 	}
 
+	// Filters count towards the user's storage quota, which is enforced by the
+	// user API, so tell it how large they are before storing a new one. The
+	// size is always taken from what we have stored, so that it can't drift.
+	total, added, err := syncDB.FilterSize(req.Context(), localpart, &filter)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.FilterSize failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = userAPI.PerformFilterUsageUpdate(req.Context(), &api.PerformFilterUsageUpdateRequest{
+		UserID: userID,
+		Size:   total,
+		Added:  added,
+	}, &api.PerformFilterUsageUpdateResponse{}); err != nil {
+		var quotaErr *api.ErrorStorageQuotaExceeded
+		if errors.As(err, &quotaErr) {
+			return util.JSONResponse{
+				Code: http.StatusRequestEntityTooLarge,
+				JSON: jsonerror.TooLarge(quotaErr.Message),
+			}
+		}
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformFilterUsageUpdate failed")
+		return jsonerror.InternalServerError()
+	}
+
 	filterID, err := syncDB.PutFilter(req.Context(), localpart, &filter)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("syncDB.PutFilter failed")
+		if added > 0 {
+			// The filter wasn't stored after all, so don't count it.
+			if err = userAPI.PerformFilterUsageUpdate(req.Context(), &api.PerformFilterUsageUpdateRequest{
+				UserID: userID,
+				Size:   total,
+			}, &api.PerformFilterUsageUpdateResponse{}); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformFilterUsageUpdate failed")
+			}
+		}
 		return jsonerror.InternalServerError()
 	}
 
@@ -15,13 +15,20 @@
 package routing
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/sirupsen/logrus"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/httputil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/syncapi/internal"
@@ -34,6 +41,10 @@ import (
 //	GET /_matrix/client/r0/rooms/{roomId}/event/{eventId}
 //
 // https://spec.matrix.org/v1.4/client-server-api/#get_matrixclientv3roomsroomideventeventid
+//
+// If we don't have the event and fetch_missing_events_over_federation is
+// enabled, the event is requested from the other servers in the room. Such
+// requests are rate limited.
 func GetEvent(
 	req *http.Request,
 	device *userapi.Device,
@@ -42,6 +53,8 @@ func GetEvent(
 	cfg *config.SyncAPI,
 	syncDB storage.Database,
 	rsAPI api.SyncRoomserverAPI,
+	fsAPI federationAPI.SyncFederationAPI,
+	rateLimits *httputil.RateLimits,
 ) util.JSONResponse {
 	ctx := req.Context()
 	db, err := syncDB.NewDatabaseTransaction(ctx)
@@ -60,21 +73,35 @@ func GetEvent(
 		return jsonerror.InternalServerError()
 	}
 
+	// If the request is coming from an appservice, get the user from the request
+	userID := device.UserID
+	if asUserID := req.FormValue("user_id"); device.AppserviceID != "" && asUserID != "" {
+		userID = asUserID
+	}
+
 	// The requested event does not exist in our database
 	if len(events) == 0 {
 		logger.Debugf("GetEvent: requested event doesn't exist locally")
+		if cfg.FetchMissingEventsOverFederation && fsAPI != nil {
+			if limited := rateLimits.Limit(req, device); limited != nil {
+				return *limited
+			}
+			var event *gomatrixserverlib.HeaderedEvent
+			event, err = fetchMissingEvent(ctx, db, rsAPI, fsAPI, roomID, eventID, userID)
+			if err != nil {
+				logger.WithError(err).Warn("GetEvent: failed to fetch event over federation")
+			} else if event != nil {
+				events = append(events, event)
+			}
+		}
+	}
+	if len(events) == 0 {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
 		}
 	}
 
-	// If the request is coming from an appservice, get the user from the request
-	userID := device.UserID
-	if asUserID := req.FormValue("user_id"); device.AppserviceID != "" && asUserID != "" {
-		userID = asUserID
-	}
-
 	// Apply history visibility to determine if the user is allowed to view the event
 	events, err = internal.ApplyHistoryVisibilityFilter(ctx, db, rsAPI, events, nil, userID, "event")
 	if err != nil {
@@ -100,3 +127,149 @@ func GetEvent(
 		JSON: gomatrixserverlib.HeaderedToClientEvent(events[0], gomatrixserverlib.FormatAll),
 	}
 }
+
+// maxMissingEventServers is the maximum number of servers which are asked for
+// an event which we don't have.
+const maxMissingEventServers = 5
+
+// fetchMissingEvent asks the other servers in the room for an event which we
+// don't have. Only users who are joined to the room may cause us to do so.
+// The event is only returned if it belongs to the room, is correctly signed
+// and we have the state before it to take its history visibility from; the
+// caller must still apply history visibility to it.
+// Returns nil if the event can't be fetched.
+func fetchMissingEvent(
+	ctx context.Context,
+	db storage.DatabaseTransaction,
+	rsAPI api.SyncRoomserverAPI,
+	fsAPI federationAPI.SyncFederationAPI,
+	roomID, eventID, userID string,
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	membership, _, err := db.SelectMembershipForUser(ctx, roomID, userID, math.MaxInt64)
+	if err != nil {
+		return nil, fmt.Errorf("db.SelectMembershipForUser: %w", err)
+	}
+	if membership != gomatrixserverlib.Join {
+		return nil, nil
+	}
+	_, origin, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+
+	createEvent, err := db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomCreate, "")
+	if err != nil {
+		return nil, fmt.Errorf("db.GetStateEvent: %w", err)
+	}
+	if createEvent == nil {
+		return nil, nil
+	}
+	roomVersion := createEvent.RoomVersion
+
+	var res federationAPI.QueryJoinedHostServerNamesInRoomResponse
+	if err = fsAPI.QueryJoinedHostServerNamesInRoom(ctx, &federationAPI.QueryJoinedHostServerNamesInRoomRequest{
+		RoomID:             roomID,
+		ExcludeSelf:        true,
+		ExcludeBlacklisted: true,
+	}, &res); err != nil {
+		return nil, fmt.Errorf("fsAPI.QueryJoinedHostServerNamesInRoom: %w", err)
+	}
+
+	serverNames := res.ServerNames
+	if len(serverNames) > maxMissingEventServers {
+		serverNames = serverNames[:maxMissingEventServers]
+	}
+	logger := util.GetLogger(ctx).WithField("event_id", eventID)
+	for _, serverName := range serverNames {
+		event, err := fetchEventFromServer(ctx, fsAPI, origin, serverName, roomVersion, eventID)
+		if err != nil {
+			logger.WithError(err).WithField("server", serverName).Warn("Failed to fetch event from server")
+			if errors.Is(err, context.Canceled) {
+				return nil, err
+			}
+			continue
+		}
+		if event.RoomID() != roomID {
+			logger.WithField("server", serverName).Warnf("Server returned an event from room %q", event.RoomID())
+			continue
+		}
+		visibility, err := historyVisibilityBefore(ctx, rsAPI, event)
+		if err != nil {
+			return nil, err
+		}
+		if visibility == "" {
+			logger.Debug("Not returning event as we don't have the state before it")
+			return nil, nil
+		}
+		headered := event.Headered(roomVersion)
+		headered.Visibility = visibility
+		return headered, nil
+	}
+	return nil, nil
+}
+
+// historyVisibilityBefore returns the history visibility of the room before
+// the event, which is taken from the state after its prev events. Returns an
+// empty visibility if we don't have all of the prev events, as we can't know
+// the state before the event then.
+func historyVisibilityBefore(
+	ctx context.Context,
+	rsAPI api.SyncRoomserverAPI,
+	event *gomatrixserverlib.Event,
+) (gomatrixserverlib.HistoryVisibility, error) {
+	var res api.QueryStateAfterEventsResponse
+	if err := rsAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       event.RoomID(),
+		PrevEventIDs: event.PrevEventIDs(),
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+		},
+	}, &res); err != nil {
+		return "", fmt.Errorf("rsAPI.QueryStateAfterEvents: %w", err)
+	}
+	if !res.RoomExists || !res.PrevEventsExist {
+		return "", nil
+	}
+	visibility := gomatrixserverlib.HistoryVisibilityShared
+	for _, ev := range res.StateEvents {
+		if !ev.StateKeyEquals("") || ev.Type() != gomatrixserverlib.MRoomHistoryVisibility {
+			continue
+		}
+		var err error
+		if visibility, err = ev.HistoryVisibility(); err != nil {
+			return "", fmt.Errorf("ev.HistoryVisibility: %w", err)
+		}
+	}
+	return visibility, nil
+}
+
+// fetchEventFromServer requests an event from the given server, returning it
+// if it has the requested event ID and is correctly signed.
+func fetchEventFromServer(
+	ctx context.Context,
+	fsAPI federationAPI.SyncFederationAPI,
+	origin, serverName gomatrixserverlib.ServerName,
+	roomVersion gomatrixserverlib.RoomVersion,
+	eventID string,
+) (*gomatrixserverlib.Event, error) {
+	reqctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	txn, err := fsAPI.GetEvent(reqctx, origin, serverName, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if len(txn.PDUs) == 0 {
+		return nil, fmt.Errorf("no events returned")
+	}
+	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(txn.PDUs[0], roomVersion)
+	if err != nil {
+		return nil, err
+	}
+	if event.EventID() != eventID {
+		return nil, fmt.Errorf("got event %q instead", event.EventID())
+	}
+	if err = event.VerifyEventSignatures(ctx, fsAPI.KeyRing()); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
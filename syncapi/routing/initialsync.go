@@ -0,0 +1,240 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// roomInitialSyncResponse is the legacy RoomInfo response shape of
+// GET /rooms/{roomID}/initialSync.
+type roomInitialSyncResponse struct {
+	RoomID      string                          `json:"room_id"`
+	Membership  string                          `json:"membership,omitempty"`
+	Messages    roomInitialSyncMessages         `json:"messages"`
+	State       []gomatrixserverlib.ClientEvent `json:"state"`
+	Visibility  string                          `json:"visibility"`
+	AccountData []gomatrixserverlib.ClientEvent `json:"account_data"`
+}
+
+type roomInitialSyncMessages struct {
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	Start string                          `json:"start"`
+	End   string                          `json:"end"`
+}
+
+// RoomInitialSync implements the deprecated
+//
+//	GET /rooms/{roomID}/initialSync
+//
+// which some bridges still use to get a snapshot of a single room. Users who
+// have left the room see the room as it was when they left, and users who were
+// never in the room can only see it if it is world readable.
+func RoomInitialSync(
+	req *http.Request, device *userapi.Device, roomID string, srp *sync.RequestPool,
+	syncDB storage.Database, rsAPI api.SyncRoomserverAPI, userAPI userapi.SyncUserAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	limit := 10
+	if l := req.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("unable to parse limit"),
+			}
+		}
+		// NOTSPEC: same upper bound as /messages and /context
+		if limit > 100 {
+			limit = 100
+		}
+	}
+
+	membershipRes := api.QueryMembershipForUserResponse{}
+	membershipReq := api.QueryMembershipForUserRequest{UserID: device.UserID, RoomID: roomID}
+	if err := rsAPI.QueryMembershipForUser(ctx, &membershipReq, &membershipRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if !membershipRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("room does not exist"),
+		}
+	}
+	if membershipRes.IsRoomForgotten {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("user already forgot about this room"),
+		}
+	}
+
+	snapshot, err := syncDB.NewDatabaseSnapshot(ctx)
+	if err != nil {
+		return jsonerror.InternalServerError()
+	}
+	var succeeded bool
+	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
+
+	// Work out how far into the room the user is allowed to see. Joined and
+	// invited users can see up to now, users who left or were banned only up
+	// to the point that they left.
+	to := srp.Notifier.CurrentPosition().PDUPosition
+	membership := ""
+	left := false
+	if membershipRes.HasBeenInRoom {
+		membership = membershipRes.Membership
+		switch membership {
+		case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+			left = true
+			_, to, err = snapshot.PositionInTopology(ctx, membershipRes.EventID)
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("snapshot.PositionInTopology failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+	} else {
+		var worldReadable bool
+		worldReadable, err = isWorldReadable(ctx, snapshot, roomID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("failed to get history visibility")
+			return jsonerror.InternalServerError()
+		}
+		if !worldReadable {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+			}
+		}
+	}
+
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	filter.Limit = limit
+	recentStreamEvents, _, err := snapshot.RecentEvents(
+		ctx, roomID, types.Range{From: to, To: 0, Backwards: true}, &filter, true, true,
+	)
+	if err != nil && err != sql.ErrNoRows {
+		util.GetLogger(ctx).WithError(err).Error("snapshot.RecentEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	recentEvents := snapshot.StreamEventsToEvents(device, recentStreamEvents)
+	events, err := internal.ApplyHistoryVisibilityFilter(ctx, snapshot, rsAPI, recentEvents, nil, device.UserID, "initialsync")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("unable to apply history visibility filter")
+		return jsonerror.InternalServerError()
+	}
+
+	var stateEvents []*gomatrixserverlib.HeaderedEvent
+	if left {
+		stateRes := api.QueryStateAfterEventsResponse{}
+		stateReq := api.QueryStateAfterEventsRequest{RoomID: roomID, PrevEventIDs: []string{membershipRes.EventID}}
+		if err = rsAPI.QueryStateAfterEvents(ctx, &stateReq, &stateRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryStateAfterEvents failed")
+			return jsonerror.InternalServerError()
+		}
+		stateEvents = stateRes.StateEvents
+	} else {
+		stateFilter := gomatrixserverlib.DefaultStateFilter()
+		stateEvents, err = snapshot.CurrentState(ctx, roomID, &stateFilter, nil)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("snapshot.CurrentState failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	res := roomInitialSyncResponse{
+		RoomID:     roomID,
+		Membership: membership,
+		Messages: roomInitialSyncMessages{
+			Chunk: gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll),
+		},
+		State:       gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatAll),
+		Visibility:  "private",
+		AccountData: []gomatrixserverlib.ClientEvent{},
+	}
+	if len(events) > 0 {
+		var start, end types.TopologyToken
+		start, end, err = getStartEnd(ctx, snapshot, events, events[len(events)-1:])
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("failed to get start and end tokens")
+			return jsonerror.InternalServerError()
+		}
+		start.Decrement()
+		res.Messages.Start = start.String()
+		res.Messages.End = end.String()
+	}
+
+	publishedRes := api.QueryPublishedRoomsResponse{}
+	if err = rsAPI.QueryPublishedRooms(ctx, &api.QueryPublishedRoomsRequest{RoomID: roomID}, &publishedRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryPublishedRooms failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(publishedRes.RoomIDs) > 0 {
+		res.Visibility = "public"
+	}
+
+	if membershipRes.HasBeenInRoom {
+		dataRes := userapi.QueryAccountDataResponse{}
+		dataReq := userapi.QueryAccountDataRequest{UserID: device.UserID, RoomID: roomID}
+		if err = userAPI.QueryAccountData(ctx, &dataReq, &dataRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("userAPI.QueryAccountData failed")
+			return jsonerror.InternalServerError()
+		}
+		for dataType, data := range dataRes.RoomAccountData[roomID] {
+			res.AccountData = append(res.AccountData, gomatrixserverlib.ClientEvent{
+				Type:    dataType,
+				Content: gomatrixserverlib.RawJSON(data),
+			})
+		}
+	}
+
+	succeeded = true
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// isWorldReadable returns whether the current history visibility of the room
+// allows anyone to read it.
+func isWorldReadable(ctx context.Context, snapshot storage.DatabaseTransaction, roomID string) (bool, error) {
+	ev, err := snapshot.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomHistoryVisibility, "")
+	if err != nil || ev == nil {
+		return false, err
+	}
+	var content struct {
+		HistoryVisibility gomatrixserverlib.HistoryVisibility `json:"history_visibility"`
+	}
+	if err = json.Unmarshal(ev.Content(), &content); err != nil {
+		return false, nil
+	}
+	return content.HistoryVisibility == gomatrixserverlib.HistoryVisibilityWorldReadable, nil
+}
@@ -20,6 +20,7 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -29,7 +30,8 @@ import (
 )
 
 type getMembershipResponse struct {
-	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	Chunk     []gomatrixserverlib.ClientEvent `json:"chunk"`
+	NextBatch string                          `json:"next_batch,omitempty"`
 }
 
 // https://matrix.org/docs/spec/client_server/r0.6.0#get-matrix-client-r0-rooms-roomid-joined-members
@@ -53,10 +55,15 @@ type databaseJoinedMember struct {
 //
 //	GET /rooms/{roomId}/members
 //	GET /rooms/{roomId}/joined_members
+//
+// If a limit is given, at most that many members are returned, along with a
+// next_batch token to pass as batch to get the next ones. This allows clients
+// to fetch the members of very large rooms in chunks.
 func GetMemberships(
 	req *http.Request, device *userapi.Device, roomID string,
 	syncDB storage.Database, rsAPI api.SyncRoomserverAPI,
 	joinedOnly bool, membership, notMembership *string, at string,
+	batch string, limit int,
 ) util.JSONResponse {
 	queryReq := api.QueryMembershipForUserRequest{
 		RoomID: roomID,
@@ -83,7 +90,7 @@ func GetMemberships(
 		}
 	}
 
-	db, err := syncDB.NewDatabaseSnapshot(req.Context())
+	db, err := syncDB.NewDatabaseSnapshot(sqlutil.WithReadReplica(req.Context()))
 	if err != nil {
 		return jsonerror.InternalServerError()
 	}
@@ -102,11 +109,24 @@ func GetMemberships(
 		}
 	}
 
-	eventIDs, err := db.SelectMemberships(req.Context(), roomID, atToken, membership, notMembership)
+	// Ask for one more member than the limit, so that we know whether there
+	// are any members left for another batch.
+	queryLimit := limit
+	if limit > 0 {
+		queryLimit = limit + 1
+	}
+	userIDs, eventIDs, err := db.SelectMemberships(req.Context(), roomID, atToken, membership, notMembership, batch, queryLimit)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("db.SelectMemberships failed")
 		return jsonerror.InternalServerError()
 	}
+	var nextBatch string
+	if limit > 0 && len(eventIDs) > limit {
+		// The members are ordered by user ID, so the next batch starts after
+		// the last user ID in this one.
+		eventIDs = eventIDs[:limit]
+		nextBatch = userIDs[limit-1]
+	}
 
 	qryRes := &api.QueryEventsByIDResponse{}
 	if err := rsAPI.QueryEventsByID(req.Context(), &api.QueryEventsByIDRequest{EventIDs: eventIDs}, qryRes); err != nil {
@@ -132,8 +152,12 @@ func GetMemberships(
 			JSON: res,
 		}
 	}
+	res := getMembershipResponse{
+		Chunk:     gomatrixserverlib.HeaderedToClientEvents(result, gomatrixserverlib.FormatAll),
+		NextBatch: nextBatch,
+	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: getMembershipResponse{gomatrixserverlib.HeaderedToClientEvents(result, gomatrixserverlib.FormatAll)},
+		JSON: res,
 	}
 }
@@ -399,15 +399,13 @@ func (r *messagesReq) getStartEnd(events []*gomatrixserverlib.HeaderedEvent) (st
 			// else to go. This seems to fix Element iOS from looping on /messages endlessly.
 			end = types.TopologyToken{}
 		} else {
-			end, err = r.snapshot.EventPositionInTopology(
-				r.ctx, events[0].EventID(),
-			)
 			// A stream/topological position is a cursor located between two events.
 			// While they are identified in the code by the event on their right (if
 			// we consider a left to right chronological order), tokens need to refer
-			// to them by the event on their left, therefore we need to decrement the
-			// end position we send in the response if we're going backward.
-			end.Decrement()
+			// to them by the event on their left, therefore the end position we send
+			// in the response is the one just before the oldest event if we're
+			// going backward.
+			end, err = r.snapshot.GetBackwardTopologyPos(r.ctx, events)
 		}
 	} else {
 		start = *r.from
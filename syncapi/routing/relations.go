@@ -76,7 +76,7 @@ func Relations(
 		}
 	}
 
-	snapshot, err := syncDB.NewDatabaseSnapshot(req.Context())
+	snapshot, err := syncDB.NewDatabaseSnapshot(sqlutil.WithReadReplica(req.Context()))
 	if err != nil {
 		logrus.WithError(err).Error("Failed to get snapshot for relations")
 		return jsonerror.InternalServerError()
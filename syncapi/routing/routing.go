@@ -16,12 +16,14 @@ package routing
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/fulltext"
 	"github.com/matrix-org/dendrite/internal/httputil"
@@ -41,10 +43,15 @@ func Setup(
 	csMux *mux.Router, srp *sync.RequestPool, syncDB storage.Database,
 	userAPI userapi.SyncUserAPI,
 	rsAPI api.SyncRoomserverAPI,
+	fsAPI federationAPI.SyncFederationAPI,
 	cfg *config.SyncAPI,
 	lazyLoadCache caching.LazyLoadCache,
 	fts *fulltext.Search,
+	rateLimit *config.RateLimiting,
+	appServices []config.ApplicationService,
 ) {
+	rateLimits := httputil.NewRateLimits(rateLimit, appServices)
+
 	v1unstablemux := csMux.PathPrefix("/{apiversion:(?:v1|unstable)}/").Subrouter()
 	v3mux := csMux.PathPrefix("/{apiversion:(?:r0|v3)}/").Subrouter()
 
@@ -61,13 +68,29 @@ func Setup(
 		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], device, rsAPI, cfg, srp, lazyLoadCache)
 	}, httputil.WithAllowGuests())).Methods(http.MethodGet, http.MethodOptions)
 
+	v3mux.Handle("/rooms/{roomID}/initialSync",
+		httputil.MakeAuthAPI("rooms_initial_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return RoomInitialSync(req, device, vars["roomID"], srp, syncDB, rsAPI, userAPI)
+		}, httputil.WithAllowGuests()),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	v3mux.Handle("/events",
+		httputil.MakeAuthAPI("events", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return OnIncomingEventsRequest(req, device, syncDB, rsAPI, srp.Notifier)
+		}, httputil.WithAllowGuests()),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	v3mux.Handle("/rooms/{roomID}/event/{eventID}",
 		httputil.MakeAuthAPI("rooms_get_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetEvent(req, device, vars["roomID"], vars["eventID"], cfg, syncDB, rsAPI)
+			return GetEvent(req, device, vars["roomID"], vars["eventID"], cfg, syncDB, rsAPI, fsAPI, rateLimits)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -77,7 +100,7 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return PutFilter(req, device, syncDB, vars["userId"])
+			return PutFilter(req, device, syncDB, userAPI, vars["userId"])
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -189,8 +212,20 @@ func Setup(
 				notMembership = &m
 			}
 
+			var limit int
+			if l := req.URL.Query().Get("limit"); l != "" {
+				limit, err = strconv.Atoi(l)
+				if err != nil || limit < 0 {
+					return util.JSONResponse{
+						Code: http.StatusBadRequest,
+						JSON: jsonerror.InvalidParam("limit must be a non-negative integer"),
+					}
+				}
+			}
+
 			at := req.URL.Query().Get("at")
-			return GetMemberships(req, device, vars["roomID"], syncDB, rsAPI, false, membership, notMembership, at)
+			batch := req.URL.Query().Get("batch")
+			return GetMemberships(req, device, vars["roomID"], syncDB, rsAPI, false, membership, notMembership, at, batch, limit)
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -202,7 +237,7 @@ func Setup(
 			}
 			at := req.URL.Query().Get("at")
 			membership := gomatrixserverlib.Join
-			return GetMemberships(req, device, vars["roomID"], syncDB, rsAPI, true, &membership, nil, at)
+			return GetMemberships(req, device, vars["roomID"], syncDB, rsAPI, true, &membership, nil, at, "", 0)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 }
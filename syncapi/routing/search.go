@@ -62,7 +62,7 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 		searchReq.SearchCategories.RoomEvents.Filter.Limit = 5
 	}
 
-	snapshot, err := syncDB.NewDatabaseSnapshot(req.Context())
+	snapshot, err := syncDB.NewDatabaseSnapshot(sqlutil.WithReadReplica(req.Context()))
 	if err != nil {
 		return jsonerror.InternalServerError()
 	}
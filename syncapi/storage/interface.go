@@ -39,6 +39,9 @@ type DatabaseTransaction interface {
 	MaxStreamPositionForNotificationData(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForPresence(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForRelations(ctx context.Context) (types.StreamPosition, error)
+	// RoomsWithPurgedEvents returns the rooms which the user is joined to, and had joined by the given
+	// position, but which have no events at or before that position any more.
+	RoomsWithPurgedEvents(ctx context.Context, userID string, pos types.StreamPosition) ([]string, error)
 
 	CurrentState(ctx context.Context, roomID string, stateFilterPart *gomatrixserverlib.StateFilter, excludeEventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error)
 	GetStateDeltasForFullStateSync(ctx context.Context, device *userapi.Device, r types.Range, userID string, stateFilter *gomatrixserverlib.StateFilter) ([]types.StateDelta, []string, error)
@@ -170,6 +173,12 @@ type Database interface {
 	// Returns the filterID as a string. Otherwise returns an error if something
 	// goes wrong.
 	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
+	// FilterSize returns the total size in bytes of a user's filters, and how
+	// many bytes putting the passed filter would add to that.
+	FilterSize(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (total, added int64, err error)
+	// FilterSizes returns the total size in bytes of the filters of up to
+	// limit users, ordered by localpart, starting after the given one.
+	FilterSizes(ctx context.Context, afterLocalpart string, limit int) (map[string]int64, error)
 	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event
 	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error
 	// StoreReceipt stores new receipt events
@@ -178,11 +187,15 @@ type Database interface {
 	ReIndex(ctx context.Context, limit, afterID int64) (map[int64]gomatrixserverlib.HeaderedEvent, error)
 	UpdateRelations(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error
 	RedactRelations(ctx context.Context, roomID, redactedEventID string) error
+	// SelectMemberships returns the user IDs and event IDs of the memberships in the room at the given
+	// position, ordered by user ID and starting after fromUserID. At most limit memberships are returned,
+	// unless the limit is 0.
 	SelectMemberships(
 		ctx context.Context,
 		roomID string, pos types.TopologyToken,
 		membership, notMembership *string,
-	) (eventIDs []string, err error)
+		fromUserID string, limit int,
+	) (userIDs, eventIDs []string, err error)
 }
 
 type Presence interface {
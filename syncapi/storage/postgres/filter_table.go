@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -46,6 +47,13 @@ const selectFilterSQL = "" +
 const selectFilterIDByContentSQL = "" +
 	"SELECT id FROM syncapi_filter WHERE localpart = $1 AND filter = $2"
 
+const selectFilterSizeSQL = "" +
+	"SELECT COALESCE(SUM(OCTET_LENGTH(filter)), 0) FROM syncapi_filter WHERE localpart = $1"
+
+const selectFilterSizesSQL = "" +
+	"SELECT localpart, SUM(OCTET_LENGTH(filter)) FROM syncapi_filter WHERE localpart > $1" +
+	" GROUP BY localpart ORDER BY localpart LIMIT $2"
+
 const insertFilterSQL = "" +
 	"INSERT INTO syncapi_filter (filter, id, localpart) VALUES ($1, DEFAULT, $2) RETURNING id"
 
@@ -53,6 +61,8 @@ type filterStatements struct {
 	selectFilterStmt            *sql.Stmt
 	selectFilterIDByContentStmt *sql.Stmt
 	insertFilterStmt            *sql.Stmt
+	selectFilterSizeStmt        *sql.Stmt
+	selectFilterSizesStmt       *sql.Stmt
 }
 
 func NewPostgresFilterTable(db *sql.DB) (tables.Filter, error) {
@@ -70,6 +80,12 @@ func NewPostgresFilterTable(db *sql.DB) (tables.Filter, error) {
 	if s.insertFilterStmt, err = db.Prepare(insertFilterSQL); err != nil {
 		return nil, err
 	}
+	if s.selectFilterSizeStmt, err = db.Prepare(selectFilterSizeSQL); err != nil {
+		return nil, err
+	}
+	if s.selectFilterSizesStmt, err = db.Prepare(selectFilterSizesSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -128,3 +144,52 @@ func (s *filterStatements) InsertFilter(
 		Scan(&filterID)
 	return
 }
+
+func (s *filterStatements) SelectFilterSize(
+	ctx context.Context, txn *sql.Tx, filter *gomatrixserverlib.Filter, localpart string,
+) (total, added int64, err error) {
+	filterJSON, err := json.Marshal(filter)
+	if err != nil {
+		return 0, 0, err
+	}
+	filterJSON, err = gomatrixserverlib.CanonicalJSON(filterJSON)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = sqlutil.TxStmt(txn, s.selectFilterSizeStmt).QueryRowContext(ctx, localpart).Scan(&total); err != nil {
+		return 0, 0, err
+	}
+	// Identical filters are only stored once, see InsertFilter.
+	var existingFilterID string
+	err = sqlutil.TxStmt(txn, s.selectFilterIDByContentStmt).QueryRowContext(
+		ctx, localpart, filterJSON,
+	).Scan(&existingFilterID)
+	switch err {
+	case nil:
+		return total, 0, nil
+	case sql.ErrNoRows:
+		return total, int64(len(filterJSON)), nil
+	default:
+		return 0, 0, err
+	}
+}
+
+func (s *filterStatements) SelectFilterSizes(
+	ctx context.Context, txn *sql.Tx, afterLocalpart string, limit int,
+) (map[string]int64, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectFilterSizesStmt).QueryContext(ctx, afterLocalpart, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectFilterSizes: rows.close() failed")
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var localpart string
+		var size int64
+		if err = rows.Scan(&localpart, &size); err != nil {
+			return nil, err
+		}
+		sizes[localpart] = size
+	}
+	return sizes, rows.Err()
+}
@@ -19,8 +19,10 @@ import (
 	"database/sql"
 	"fmt"
 
+	"github.com/lib/pq"
 	"github.com/matrix-org/gomatrixserverlib"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -65,21 +67,32 @@ const selectMembershipCountSQL = "" +
 const selectMembershipBeforeSQL = "" +
 	"SELECT membership, topological_pos FROM syncapi_memberships WHERE room_id = $1 and user_id = $2 AND topological_pos <= $3 ORDER BY topological_pos DESC LIMIT 1"
 
+// Rooms which the user had joined by the given position, but which have no
+// events at or before it any more.
+const selectRoomsWithPurgedEventsSQL = "" +
+	"SELECT m.room_id FROM syncapi_memberships m" +
+	" WHERE m.room_id = ANY($1) AND m.user_id = $2 AND m.membership = 'join' AND m.stream_pos <= $3" +
+	" AND NOT EXISTS (SELECT 1 FROM syncapi_output_room_events e WHERE e.room_id = m.room_id AND e.id <= $3)"
+
 const purgeMembershipsSQL = "" +
 	"DELETE FROM syncapi_memberships WHERE room_id = $1"
 
 const selectMembersSQL = `
-	SELECT event_id FROM (
+	SELECT user_id, event_id FROM (
 		SELECT DISTINCT ON (room_id, user_id) room_id, user_id, event_id, membership FROM syncapi_memberships WHERE room_id = $1 AND topological_pos <= $2 ORDER BY room_id, user_id, stream_pos DESC  
 	) t 
 	WHERE ($3::text IS NULL OR t.membership = $3)
 		AND ($4::text IS NULL OR t.membership <> $4)
+		AND t.user_id > $5
+	ORDER BY t.user_id
+	LIMIT $6
 `
 
 type membershipsStatements struct {
 	upsertMembershipStmt        *sql.Stmt
 	selectMembershipCountStmt   *sql.Stmt
 	selectMembershipForUserStmt *sql.Stmt
+	selectRoomsWithPurgedStmt   *sql.Stmt
 	purgeMembershipsStmt        *sql.Stmt
 	selectMembersStmt           *sql.Stmt
 }
@@ -94,6 +107,7 @@ func NewPostgresMembershipsTable(db *sql.DB) (tables.Memberships, error) {
 		{&s.upsertMembershipStmt, upsertMembershipSQL},
 		{&s.selectMembershipCountStmt, selectMembershipCountSQL},
 		{&s.selectMembershipForUserStmt, selectMembershipBeforeSQL},
+		{&s.selectRoomsWithPurgedStmt, selectRoomsWithPurgedEventsSQL},
 		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
 		{&s.selectMembersStmt, selectMembersSQL},
 	}.Prepare(db)
@@ -144,6 +158,25 @@ func (s *membershipsStatements) SelectMembershipForUser(
 	return membership, topologyPos, nil
 }
 
+func (s *membershipsStatements) SelectRoomsWithPurgedEvents(
+	ctx context.Context, txn *sql.Tx, userID string, roomIDs []string, pos types.StreamPosition,
+) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRoomsWithPurgedStmt).QueryContext(ctx, pq.StringArray(roomIDs), userID, pos)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomsWithPurgedEvents: rows.close() failed")
+	var result []string
+	var roomID string
+	for rows.Next() {
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		result = append(result, roomID)
+	}
+	return result, rows.Err()
+}
+
 func (s *membershipsStatements) PurgeMemberships(
 	ctx context.Context, txn *sql.Tx, roomID string,
 ) error {
@@ -155,20 +188,25 @@ func (s *membershipsStatements) SelectMemberships(
 	ctx context.Context, txn *sql.Tx,
 	roomID string, pos types.TopologyToken,
 	membership, notMembership *string,
-) (eventIDs []string, err error) {
+	fromUserID string, limit int,
+) (userIDs, eventIDs []string, err error) {
+	// A NULL limit means no limit at all.
+	var maxRows *int
+	if limit > 0 {
+		maxRows = &limit
+	}
 	stmt := sqlutil.TxStmt(txn, s.selectMembersStmt)
-	rows, err := stmt.QueryContext(ctx, roomID, pos.Depth, membership, notMembership)
+	rows, err := stmt.QueryContext(ctx, roomID, pos.Depth, membership, notMembership, fromUserID, maxRows)
 	if err != nil {
 		return
 	}
-	var (
-		eventID string
-	)
+	var userID, eventID string
 	for rows.Next() {
-		if err = rows.Scan(&eventID); err != nil {
+		if err = rows.Scan(&userID, &eventID); err != nil {
 			return
 		}
+		userIDs = append(userIDs, userID)
 		eventIDs = append(eventIDs, eventID)
 	}
-	return eventIDs, rows.Err()
+	return userIDs, eventIDs, rows.Err()
 }
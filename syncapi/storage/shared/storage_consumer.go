@@ -56,6 +56,10 @@ type Database struct {
 	Relations           tables.Relations
 }
 
+// NewDatabaseSnapshot starts a read-only transaction. If the context is marked
+// with sqlutil.WithReadReplica then this may be served by the read replica, so
+// it mustn't be used where the reads depend on recent writes, e.g. /sync, which
+// must see everything up to the stream positions given by the notifier.
 func (d *Database) NewDatabaseSnapshot(ctx context.Context) (*DatabaseTransaction, error) {
 	txn, err := d.DB.BeginTx(ctx, &sql.TxOptions{
 		// Set the isolation level so that we see a snapshot of the database.
@@ -340,6 +344,18 @@ func (d *Database) PutFilter(
 	return filterID, err
 }
 
+func (d *Database) FilterSize(
+	ctx context.Context, localpart string, filter *gomatrixserverlib.Filter,
+) (total, added int64, err error) {
+	return d.Filter.SelectFilterSize(ctx, nil, filter, localpart)
+}
+
+func (d *Database) FilterSizes(
+	ctx context.Context, afterLocalpart string, limit int,
+) (map[string]int64, error) {
+	return d.Filter.SelectFilterSizes(ctx, nil, afterLocalpart, limit)
+}
+
 func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error {
 	redactedEvents, err := d.Events(ctx, []string{redactedEventID})
 	if err != nil {
@@ -600,6 +616,7 @@ func (d *Database) SelectMemberships(
 	ctx context.Context,
 	roomID string, pos types.TopologyToken,
 	membership, notMembership *string,
-) (eventIDs []string, err error) {
-	return d.Memberships.SelectMemberships(ctx, nil, roomID, pos, membership, notMembership)
+	fromUserID string, limit int,
+) (userIDs, eventIDs []string, err error) {
+	return d.Memberships.SelectMemberships(ctx, nil, roomID, pos, membership, notMembership, fromUserID, limit)
 }
@@ -42,6 +42,21 @@ func (d *DatabaseTransaction) MaxStreamPositionForPDUs(ctx context.Context) (typ
 	return types.StreamPosition(id), nil
 }
 
+// RoomsWithPurgedEvents returns the rooms which the user is joined to, and
+// had joined by the given position, but whose events up to that position
+// have all been purged.
+func (d *DatabaseTransaction) RoomsWithPurgedEvents(ctx context.Context, userID string, pos types.StreamPosition) ([]string, error) {
+	roomIDs, err := d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, d.txn, userID, gomatrixserverlib.Join)
+	if err != nil {
+		return nil, fmt.Errorf("d.CurrentRoomState.SelectRoomIDsWithMembership: %w", err)
+	}
+	roomIDs, err = d.Memberships.SelectRoomsWithPurgedEvents(ctx, d.txn, userID, roomIDs, pos)
+	if err != nil {
+		return nil, fmt.Errorf("d.Memberships.SelectRoomsWithPurgedEvents: %w", err)
+	}
+	return roomIDs, nil
+}
+
 func (d *DatabaseTransaction) MaxStreamPositionForReceipts(ctx context.Context) (types.StreamPosition, error) {
 	id, err := d.Receipts.SelectMaxReceiptID(ctx, d.txn)
 	if err != nil {
@@ -296,8 +311,9 @@ func (d *DatabaseTransaction) StreamToTopologicalPosition(
 	}
 }
 
-// GetBackwardTopologyPos retrieves the backward topology position, i.e. the position of the
-// oldest event in the room's topology.
+// GetBackwardTopologyPos retrieves the backward topology position, i.e. the position
+// just before the oldest of the given events in the room's topology, so that
+// paginating backwards from it continues exactly where the events end.
 func (d *DatabaseTransaction) GetBackwardTopologyPos(
 	ctx context.Context,
 	events []*gomatrixserverlib.HeaderedEvent,
@@ -306,11 +322,30 @@ func (d *DatabaseTransaction) GetBackwardTopologyPos(
 	if len(events) == 0 {
 		return zeroToken, nil
 	}
-	pos, spos, err := d.Topology.SelectPositionInTopology(ctx, d.txn, events[0].EventID())
-	if err != nil {
-		return zeroToken, err
+	// The events aren't necessarily ordered by their position in the topology,
+	// e.g. if several of them have the same depth, so look at all of the ones
+	// with the lowest depth.
+	minDepth := events[0].Depth()
+	for _, ev := range events[1:] {
+		if ev.Depth() < minDepth {
+			minDepth = ev.Depth()
+		}
+	}
+	var tok types.TopologyToken
+	found := false
+	for _, ev := range events {
+		if ev.Depth() != minDepth {
+			continue
+		}
+		pos, spos, err := d.Topology.SelectPositionInTopology(ctx, d.txn, ev.EventID())
+		if err != nil {
+			return zeroToken, err
+		}
+		if !found || pos < tok.Depth || (pos == tok.Depth && spos < tok.PDUPosition) {
+			tok = types.TopologyToken{Depth: pos, PDUPosition: spos}
+			found = true
+		}
 	}
-	tok := types.TopologyToken{Depth: pos, PDUPosition: spos}
 	tok.Decrement()
 	return tok, nil
 }
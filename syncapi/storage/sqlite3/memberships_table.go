@@ -18,9 +18,11 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 
 	"github.com/matrix-org/gomatrixserverlib"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -66,12 +68,22 @@ const selectMembershipBeforeSQL = "" +
 	"SELECT membership, topological_pos FROM syncapi_memberships WHERE room_id = $1 and user_id = $2 AND topological_pos <= $3 ORDER BY topological_pos DESC LIMIT 1"
 
 const selectMembersSQL = `
-SELECT event_id FROM
- ( SELECT event_id, membership FROM syncapi_memberships WHERE room_id = $1 AND topological_pos <= $2 GROUP BY user_id HAVING(max(stream_pos))) t
+SELECT user_id, event_id FROM
+ ( SELECT user_id, event_id, membership FROM syncapi_memberships WHERE room_id = $1 AND topological_pos <= $2 GROUP BY user_id HAVING(max(stream_pos))) t
     WHERE ($3 IS NULL OR t.membership = $3)
 		 	AND ($4 IS NULL OR t.membership <> $4)
+			AND t.user_id > $5
+	ORDER BY t.user_id
+	LIMIT $6
 `
 
+// Rooms which the user had joined by the given position, but which have no
+// events at or before it any more.
+const selectRoomsWithPurgedEventsSQL = "" +
+	"SELECT m.room_id FROM syncapi_memberships m" +
+	" WHERE m.user_id = $1 AND m.membership = 'join' AND m.stream_pos <= $2 AND m.room_id IN ($3)" +
+	" AND NOT EXISTS (SELECT 1 FROM syncapi_output_room_events e WHERE e.room_id = m.room_id AND e.id <= $2)"
+
 const purgeMembershipsSQL = "" +
 	"DELETE FROM syncapi_memberships WHERE room_id = $1"
 
@@ -147,6 +159,39 @@ func (s *membershipsStatements) SelectMembershipForUser(
 	return membership, topologyPos, nil
 }
 
+func (s *membershipsStatements) SelectRoomsWithPurgedEvents(
+	ctx context.Context, txn *sql.Tx, userID string, roomIDs []string, pos types.StreamPosition,
+) ([]string, error) {
+	if len(roomIDs) == 0 {
+		return nil, nil
+	}
+	query := strings.Replace(selectRoomsWithPurgedEventsSQL, "($3)", sqlutil.QueryVariadicOffset(len(roomIDs), 2), 1)
+	params := make([]interface{}, 0, len(roomIDs)+2)
+	params = append(params, userID, pos)
+	for _, roomID := range roomIDs {
+		params = append(params, roomID)
+	}
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, fmt.Errorf("SelectRoomsWithPurgedEvents s.db.Prepare: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "SelectRoomsWithPurgedEvents: stmt.close() failed")
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRoomsWithPurgedEvents: rows.close() failed")
+	var result []string
+	var roomID string
+	for rows.Next() {
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		result = append(result, roomID)
+	}
+	return result, rows.Err()
+}
+
 func (s *membershipsStatements) PurgeMemberships(
 	ctx context.Context, txn *sql.Tx, roomID string,
 ) error {
@@ -158,18 +203,24 @@ func (s *membershipsStatements) SelectMemberships(
 	ctx context.Context, txn *sql.Tx,
 	roomID string, pos types.TopologyToken,
 	membership, notMembership *string,
-) (eventIDs []string, err error) {
+	fromUserID string, limit int,
+) (userIDs, eventIDs []string, err error) {
+	// A negative limit means no limit at all.
+	if limit <= 0 {
+		limit = -1
+	}
 	stmt := sqlutil.TxStmt(txn, s.selectMembersStmt)
-	rows, err := stmt.QueryContext(ctx, roomID, pos.Depth, membership, notMembership)
+	rows, err := stmt.QueryContext(ctx, roomID, pos.Depth, membership, notMembership, fromUserID, limit)
 	if err != nil {
 		return
 	}
-	var eventID string
+	var userID, eventID string
 	for rows.Next() {
-		if err = rows.Scan(&eventID); err != nil {
+		if err = rows.Scan(&userID, &eventID); err != nil {
 			return
 		}
+		userIDs = append(userIDs, userID)
 		eventIDs = append(eventIDs, eventID)
 	}
-	return eventIDs, rows.Err()
+	return userIDs, eventIDs, rows.Err()
 }
@@ -181,6 +181,12 @@ type SendToDevice interface {
 type Filter interface {
 	SelectFilter(ctx context.Context, txn *sql.Tx, target *gomatrixserverlib.Filter, localpart string, filterID string) error
 	InsertFilter(ctx context.Context, txn *sql.Tx, filter *gomatrixserverlib.Filter, localpart string) (filterID string, err error)
+	// SelectFilterSize returns the total size in bytes of a user's filters, and
+	// how many bytes storing the given filter would add to that.
+	SelectFilterSize(ctx context.Context, txn *sql.Tx, filter *gomatrixserverlib.Filter, localpart string) (total, added int64, err error)
+	// SelectFilterSizes returns the total size in bytes of the filters of up
+	// to limit users, ordered by localpart, starting after the given one.
+	SelectFilterSizes(ctx context.Context, txn *sql.Tx, afterLocalpart string, limit int) (map[string]int64, error)
 }
 
 type Receipts interface {
@@ -195,11 +201,15 @@ type Memberships interface {
 	SelectMembershipCount(ctx context.Context, txn *sql.Tx, roomID, membership string, pos types.StreamPosition) (count int, err error)
 	SelectMembershipForUser(ctx context.Context, txn *sql.Tx, roomID, userID string, pos int64) (membership string, topologicalPos int, err error)
 	PurgeMemberships(ctx context.Context, txn *sql.Tx, roomID string) error
+	// SelectRoomsWithPurgedEvents returns the rooms, out of the given ones, which the user had joined at or before
+	// the position, but which have no events at or before the position any more.
+	SelectRoomsWithPurgedEvents(ctx context.Context, txn *sql.Tx, userID string, roomIDs []string, pos types.StreamPosition) ([]string, error)
 	SelectMemberships(
 		ctx context.Context, txn *sql.Tx,
 		roomID string, pos types.TopologyToken,
 		membership, notMembership *string,
-	) (eventIDs []string, err error)
+		fromUserID string, limit int,
+	) (userIDs, eventIDs []string, err error)
 }
 
 type NotificationData interface {
@@ -3,6 +3,9 @@ package tables_test
 import (
 	"context"
 	"database/sql"
+	"math"
+	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -86,6 +89,38 @@ func TestMembershipsTable(t *testing.T) {
 
 		testUpsert(t, ctx, table, userEvents[0], alice, room)
 		testMembershipCount(t, ctx, table, room)
+		testSelectMemberships(t, ctx, table, room, users)
+	})
+}
+
+func testSelectMemberships(t *testing.T, ctx context.Context, table tables.Memberships, room *test.Room, users []string) {
+	t.Run("memberships are paginated by user ID", func(t *testing.T) {
+		wantUserIDs := append([]string{}, users...)
+		sort.Strings(wantUserIDs)
+		pos := types.TopologyToken{Depth: math.MaxInt64, PDUPosition: math.MaxInt64}
+
+		var gotUserIDs []string
+		from := ""
+		for {
+			userIDs, eventIDs, err := table.SelectMemberships(ctx, nil, room.ID, pos, nil, nil, from, 4)
+			if err != nil {
+				t.Fatalf("failed to select memberships: %s", err)
+			}
+			if len(userIDs) != len(eventIDs) {
+				t.Fatalf("expected as many user IDs as event IDs, got %d and %d", len(userIDs), len(eventIDs))
+			}
+			if len(userIDs) == 0 {
+				break
+			}
+			if len(userIDs) > 4 {
+				t.Fatalf("expected at most 4 memberships, got %d", len(userIDs))
+			}
+			gotUserIDs = append(gotUserIDs, userIDs...)
+			from = userIDs[len(userIDs)-1]
+		}
+		if !reflect.DeepEqual(gotUserIDs, wantUserIDs) {
+			t.Fatalf("expected user IDs %v, got %v", wantUserIDs, gotUserIDs)
+		}
 	})
 }
 
@@ -0,0 +1,76 @@
+package streams
+
+import (
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// roomFilterAllowsRoom returns whether the room is included by both the
+// top-level room filter and the filter of the given section.
+func roomFilterAllowsRoom(roomFilter *gomatrixserverlib.RoomFilter, filter *gomatrixserverlib.RoomEventFilter, roomID string) bool {
+	return filterAllowsRoom(roomFilter.Rooms, roomFilter.NotRooms, roomID) &&
+		filterAllowsRoom(filter.Rooms, filter.NotRooms, roomID)
+}
+
+// filterAllowsRoom returns whether the room is in rooms, if set, and not in
+// notRooms.
+func filterAllowsRoom(rooms, notRooms *[]string, roomID string) bool {
+	if notRooms != nil {
+		for _, r := range *notRooms {
+			if r == roomID {
+				return false
+			}
+		}
+	}
+	if rooms == nil {
+		return true
+	}
+	for _, r := range *rooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// filterAllowsType returns whether the event type matches types, if set, and
+// doesn't match notTypes. A "*" in a filter type matches any sequence of
+// characters.
+func filterAllowsType(types, notTypes *[]string, eventType string) bool {
+	if notTypes != nil {
+		for _, t := range *notTypes {
+			if filterTypeMatches(t, eventType) {
+				return false
+			}
+		}
+	}
+	if types == nil {
+		return true
+	}
+	for _, t := range *types {
+		if filterTypeMatches(t, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+func filterTypeMatches(pattern, eventType string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == eventType
+	}
+	if !strings.HasPrefix(eventType, parts[0]) {
+		return false
+	}
+	eventType = eventType[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(eventType, part)
+		if i < 0 {
+			return false
+		}
+		eventType = eventType[i+len(part):]
+	}
+	return strings.HasSuffix(eventType, parts[len(parts)-1])
+}
@@ -0,0 +1,27 @@
+package streams
+
+import "testing"
+
+func TestFilterAllowsType(t *testing.T) {
+	testCases := []struct {
+		types, notTypes *[]string
+		eventType       string
+		want            bool
+	}{
+		{eventType: "m.typing", want: true},
+		{types: &[]string{"m.typing"}, eventType: "m.typing", want: true},
+		{types: &[]string{"m.receipt"}, eventType: "m.typing", want: false},
+		{types: &[]string{}, eventType: "m.typing", want: false},
+		{types: &[]string{"m.*"}, eventType: "m.typing", want: true},
+		{types: &[]string{"*.typing"}, eventType: "m.typing", want: true},
+		{types: &[]string{"m.*.x"}, eventType: "m.typing", want: false},
+		{notTypes: &[]string{"m.typing"}, eventType: "m.typing", want: false},
+		{types: &[]string{"*"}, notTypes: &[]string{"m.typ*"}, eventType: "m.typing", want: false},
+		{notTypes: &[]string{"m.typ*"}, eventType: "m.receipt", want: true},
+	}
+	for _, tc := range testCases {
+		if got := filterAllowsType(tc.types, tc.notTypes, tc.eventType); got != tc.want {
+			t.Errorf("filterAllowsType(%v, %v, %q): got %v, want %v", tc.types, tc.notTypes, tc.eventType, got, tc.want)
+		}
+	}
+}
@@ -49,8 +49,10 @@ func (p *AccountDataStreamProvider) IncrementalSync(
 		To:   to,
 	}
 
+	// Global and room account data have separate type filters, so only the
+	// limit is applied by the database and the types are filtered below.
 	dataTypes, pos, err := snapshot.GetAccountDataInRange(
-		ctx, req.Device.UserID, r, &req.Filter.AccountData,
+		ctx, req.Device.UserID, r, &gomatrixserverlib.EventFilter{Limit: req.Filter.AccountData.Limit},
 	)
 	if err != nil {
 		req.Log.WithError(err).Error("p.DB.GetAccountDataInRange failed")
@@ -64,9 +66,18 @@ func (p *AccountDataStreamProvider) IncrementalSync(
 		if from == 0 && roomID != "" && !req.IsRoomPresent(roomID) {
 			continue
 		}
+		if roomID != "" && !roomFilterAllowsRoom(&req.Filter.Room, &req.Filter.Room.AccountData, roomID) {
+			continue
+		}
 
 		// Request the missing data from the database
 		for _, dataType := range dataTypes {
+			if roomID == "" && !filterAllowsType(req.Filter.AccountData.Types, req.Filter.AccountData.NotTypes, dataType) {
+				continue
+			}
+			if roomID != "" && !filterAllowsType(req.Filter.Room.AccountData.Types, req.Filter.Room.AccountData.NotTypes, dataType) {
+				continue
+			}
 			dataReq := userapi.QueryAccountDataRequest{
 				UserID:   req.Device.UserID,
 				RoomID:   roomID,
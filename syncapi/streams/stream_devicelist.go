@@ -21,6 +21,9 @@ func (p *DeviceListStreamProvider) CompleteSync(
 	snapshot storage.DatabaseTransaction,
 	req *types.SyncRequest,
 ) types.StreamPosition {
+	if err := internal.DeviceOTKCounts(req.Context, p.keyAPI, req.Device.UserID, req.Device.ID, req.Response); err != nil {
+		req.Log.WithError(err).Error("internal.DeviceOTKCounts failed")
+	}
 	return p.LatestPosition(ctx)
 }
 
@@ -38,7 +41,7 @@ func (p *DeviceListStreamProvider) IncrementalSync(
 	}
 	err = internal.DeviceOTKCounts(req.Context, p.keyAPI, req.Device.UserID, req.Device.ID, req.Response)
 	if err != nil {
-		req.Log.WithError(err).Error("internal.DeviceListCatchup failed")
+		req.Log.WithError(err).Error("internal.DeviceOTKCounts failed")
 		return from
 	}
 
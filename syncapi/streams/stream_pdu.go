@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/matrix-org/dendrite/internal/caching"
@@ -34,6 +35,8 @@ type PDUStreamProvider struct {
 	lazyLoadCache caching.LazyLoadCache
 	rsAPI         roomserverAPI.SyncRoomserverAPI
 	notifier      *notifier.Notifier
+	// The maximum number of joined rooms in a complete sync, or 0
+	maxRooms int
 }
 
 func (p *PDUStreamProvider) Setup(
@@ -58,6 +61,9 @@ func (p *PDUStreamProvider) CompleteSync(
 ) types.StreamPosition {
 	from := types.StreamPosition(0)
 	to := p.LatestPosition(ctx)
+	if req.RoomsContinuation != nil && req.RoomsContinuation.PDUPosition < to {
+		to = req.RoomsContinuation.PDUPosition
+	}
 
 	// Get the current sync position which we will base the sync response on.
 	// For complete syncs, we want to start at the most recent events and work
@@ -74,6 +80,7 @@ func (p *PDUStreamProvider) CompleteSync(
 		req.Log.WithError(err).Error("p.DB.RoomIDsWithMembership failed")
 		return from
 	}
+	joinedRoomIDs = p.limitRoomsForCompleteSync(req, joinedRoomIDs, to)
 
 	stateFilter := req.Filter.Room.State
 	eventFilter := req.Filter.Room.Timeline
@@ -107,7 +114,10 @@ func (p *PDUStreamProvider) CompleteSync(
 		req.Rooms[roomID] = gomatrixserverlib.Join
 	}
 
-	// Add peeked rooms.
+	// Add peeked rooms. These were already returned if this is a continuation.
+	if req.RoomsContinuation != nil {
+		return to
+	}
 	peeks, err := snapshot.PeeksInRange(ctx, req.Device.UserID, req.Device.ID, r)
 	if err != nil {
 		req.Log.WithError(err).Error("p.DB.PeeksInRange failed")
@@ -133,6 +143,33 @@ func (p *PDUStreamProvider) CompleteSync(
 	return to
 }
 
+// limitRoomsForCompleteSync returns the joined rooms to include in a complete
+// sync. If there is a maximum number of rooms, they are returned in order of
+// room ID, starting after those returned by any previous responses, and a
+// continuation is added to the response if there are more rooms left.
+func (p *PDUStreamProvider) limitRoomsForCompleteSync(
+	req *types.SyncRequest, roomIDs []string, to types.StreamPosition,
+) []string {
+	if p.maxRooms <= 0 && req.RoomsContinuation == nil {
+		return roomIDs
+	}
+	sort.Strings(roomIDs)
+	if req.RoomsContinuation != nil {
+		after := req.RoomsContinuation.AfterRoomID
+		roomIDs = roomIDs[sort.Search(len(roomIDs), func(i int) bool {
+			return roomIDs[i] > after
+		}):]
+	}
+	if p.maxRooms > 0 && len(roomIDs) > p.maxRooms {
+		roomIDs = roomIDs[:p.maxRooms]
+		req.Response.RoomsContinuation = &types.RoomsContinuation{
+			PDUPosition: to,
+			AfterRoomID: roomIDs[len(roomIDs)-1],
+		}
+	}
+	return roomIDs
+}
+
 func (p *PDUStreamProvider) IncrementalSync(
 	ctx context.Context,
 	snapshot storage.DatabaseTransaction,
@@ -504,26 +541,17 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 		}
 	}
 
-	// Retrieve the backward topology position, i.e. the position of the
-	// oldest event in the room's topology.
+	// Retrieve the backward topology position, i.e. the position just before
+	// the oldest event in the room's topology. If the timeline starts with the
+	// room creation, paginating backwards from it simply returns no events.
 	var prevBatch *types.TopologyToken
 	if len(events) > 0 {
-		var backwardTopologyPos, backwardStreamPos types.StreamPosition
-		event := events[0]
-		// If this is the beginning of the room, we can't go back further. We're going to return
-		// the TopologyToken from the last event instead. (Synapse returns the /sync next_Batch)
-		if event.Type() == gomatrixserverlib.MRoomCreate && event.StateKeyEquals("") {
-			event = events[len(events)-1]
-		}
-		backwardTopologyPos, backwardStreamPos, err = snapshot.PositionInTopology(ctx, event.EventID())
+		var backwardTopologyPos types.TopologyToken
+		backwardTopologyPos, err = snapshot.GetBackwardTopologyPos(ctx, events)
 		if err != nil {
 			return
 		}
-		prevBatch = &types.TopologyToken{
-			Depth:       backwardTopologyPos,
-			PDUPosition: backwardStreamPos,
-		}
-		prevBatch.Decrement()
+		prevBatch = &backwardTopologyPos
 	}
 
 	jr.Timeline.PrevBatch = prevBatch
@@ -71,7 +71,7 @@ func (p *PresenceStreamProvider) IncrementalSync(
 		return from
 	}
 
-	getPresenceForUsers, err := p.getNeededUsersFromRequest(ctx, req, presences)
+	getPresenceForUsers, newlyShared, err := p.getNeededUsersFromRequest(ctx, req, presences)
 	if err != nil {
 		req.Log.WithError(err).Error("getNeededUsersFromRequest failed")
 		return from
@@ -109,7 +109,10 @@ func (p *PresenceStreamProvider) IncrementalSync(
 			currentlyActive := prevPresence.CurrentlyActive()
 			skip := prevPresence.Equals(presence) && currentlyActive && req.Device.UserID != presence.UserID
 			_, membershipChange := req.MembershipChanges[presence.UserID]
-			if skip && !membershipChange {
+			// Always send the presence of users in newly joined rooms, as
+			// we may have missed changes since we last shared a room.
+			_, shared := newlyShared[presence.UserID]
+			if skip && !membershipChange && !shared {
 				req.Log.Tracef("Skipping presence, no change (%s)", presence.UserID)
 				continue
 			}
@@ -151,8 +154,11 @@ func (p *PresenceStreamProvider) IncrementalSync(
 	return lastPos
 }
 
-func (p *PresenceStreamProvider) getNeededUsersFromRequest(ctx context.Context, req *types.SyncRequest, presences map[string]*types.PresenceInternal) ([]string, error) {
+// getNeededUsersFromRequest returns the users whose presence needs to be
+// fetched from the database, along with the set of users in newly joined rooms.
+func (p *PresenceStreamProvider) getNeededUsersFromRequest(ctx context.Context, req *types.SyncRequest, presences map[string]*types.PresenceInternal) ([]string, map[string]struct{}, error) {
 	getPresenceForUsers := []string{}
+	newlyShared := map[string]struct{}{}
 	// Add presence for users which newly joined a room
 	for userID := range req.MembershipChanges {
 		if _, ok := presences[userID]; ok {
@@ -164,16 +170,17 @@ func (p *PresenceStreamProvider) getNeededUsersFromRequest(ctx context.Context,
 	// add newly joined rooms user presences
 	newlyJoined := joinedRooms(req.Response, req.Device.UserID)
 	if len(newlyJoined) == 0 {
-		return getPresenceForUsers, nil
+		return getPresenceForUsers, newlyShared, nil
 	}
 
 	// TODO: Check if this is working better than before.
 	if err := p.notifier.LoadRooms(ctx, p.DB, newlyJoined); err != nil {
-		return getPresenceForUsers, fmt.Errorf("unable to refresh notifier lists: %w", err)
+		return getPresenceForUsers, newlyShared, fmt.Errorf("unable to refresh notifier lists: %w", err)
 	}
 	for _, roomID := range newlyJoined {
 		roomUsers := p.notifier.JoinedUsers(roomID)
 		for i := range roomUsers {
+			newlyShared[roomUsers[i]] = struct{}{}
 			// we already got a presence from this user
 			if _, ok := presences[roomUsers[i]]; ok {
 				continue
@@ -181,7 +188,7 @@ func (p *PresenceStreamProvider) getNeededUsersFromRequest(ctx context.Context,
 			getPresenceForUsers = append(getPresenceForUsers, roomUsers[i])
 		}
 	}
-	return getPresenceForUsers, nil
+	return getPresenceForUsers, newlyShared, nil
 }
 
 func joinedRooms(res *types.Response, userID string) []string {
@@ -2,16 +2,19 @@ package streams
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 
 	"github.com/matrix-org/gomatrixserverlib"
 
+	"github.com/matrix-org/dendrite/syncapi/notifier"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 )
 
 type ReceiptStreamProvider struct {
 	DefaultStreamProvider
+	notifier *notifier.Notifier
 }
 
 func (p *ReceiptStreamProvider) Setup(
@@ -43,12 +46,19 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 	req *types.SyncRequest,
 	from, to types.StreamPosition,
 ) types.StreamPosition {
+	ephemeralFilter := &req.Filter.Room.Ephemeral
+	if !filterAllowsType(ephemeralFilter.Types, ephemeralFilter.NotTypes, gomatrixserverlib.MReceipt) {
+		return to
+	}
 	var joinedRooms []string
 	for roomID, membership := range req.Rooms {
-		if membership == gomatrixserverlib.Join {
+		if membership == gomatrixserverlib.Join && roomFilterAllowsRoom(&req.Filter.Room, ephemeralFilter, roomID) {
 			joinedRooms = append(joinedRooms, roomID)
 		}
 	}
+	if len(joinedRooms) == 0 {
+		return to
+	}
 
 	lastPos, receipts, err := snapshot.RoomReceiptsAfter(ctx, joinedRooms, from)
 	if err != nil {
@@ -74,6 +84,20 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 		receiptsByRoom[receipt.RoomID] = append(receiptsByRoom[receipt.RoomID], receipt)
 	}
 
+	// In an incremental sync, hold back the receipts if any of them refer to
+	// events which the client won't have until its next sync, and send them
+	// then instead.
+	if from > 0 && req.PDUPosition > 0 {
+		later, err := p.refersToLaterEvents(ctx, snapshot, req, receiptsByRoom)
+		if err != nil {
+			req.Log.WithError(err).Error("p.refersToLaterEvents failed")
+			return from
+		}
+		if later {
+			return from
+		}
+	}
+
 	for roomID, receipts := range receiptsByRoom {
 		// For a complete sync, make sure we're only including this room if
 		// that room was present in the joined rooms.
@@ -113,6 +137,42 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 	return lastPos
 }
 
+// refersToLaterEvents returns true if any of the receipts refer to events which
+// come after the position that the PDU stream reached for this sync. Receipts
+// for events which we don't have at all aren't held back, as the events might
+// never arrive.
+func (p *ReceiptStreamProvider) refersToLaterEvents(
+	ctx context.Context,
+	snapshot storage.DatabaseTransaction,
+	req *types.SyncRequest,
+	receiptsByRoom map[string][]types.OutputReceiptEvent,
+) (bool, error) {
+	// If no events have arrived since the PDU stream ran then there's
+	// nothing to check.
+	if p.notifier.CurrentPosition().PDUPosition <= req.PDUPosition {
+		return false, nil
+	}
+	checked := make(map[string]struct{})
+	for _, receipts := range receiptsByRoom {
+		for _, receipt := range receipts {
+			if _, ok := checked[receipt.EventID]; ok {
+				continue
+			}
+			checked[receipt.EventID] = struct{}{}
+			_, pos, err := snapshot.PositionInTopology(ctx, receipt.EventID)
+			switch {
+			case err == sql.ErrNoRows:
+				continue
+			case err != nil:
+				return false, err
+			case pos > req.PDUPosition:
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
 type ReceiptMRead struct {
 	User map[string]ReceiptTS `json:"m.read"`
 }
@@ -0,0 +1,110 @@
+package streams
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/test"
+	"github.com/matrix-org/dendrite/test/testrig"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestReceiptStreamHoldsBackLaterEvents(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	ctx := context.Background()
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, closeDB := test.PrepareDBConnectionString(t, dbType)
+		defer closeDB()
+		base, closeBase := testrig.CreateBaseDendrite(t, dbType)
+		defer closeBase()
+		db, err := storage.NewSyncServerDatasource(base, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		})
+		if err != nil {
+			t.Fatalf("failed to create database: %s", err)
+		}
+
+		writeEvent := func(ev *gomatrixserverlib.HeaderedEvent) types.StreamPosition {
+			var addStateEvents []*gomatrixserverlib.HeaderedEvent
+			var addStateEventIDs []string
+			if ev.StateKey() != nil {
+				addStateEvents = append(addStateEvents, ev)
+				addStateEventIDs = append(addStateEventIDs, ev.EventID())
+			}
+			pos, err := db.WriteEvent(ctx, ev, addStateEvents, addStateEventIDs, nil, nil, false, gomatrixserverlib.HistoryVisibilityShared)
+			if err != nil {
+				t.Fatalf("failed to write event: %s", err)
+			}
+			return pos
+		}
+
+		room := test.NewRoom(t, alice)
+		var pduPos types.StreamPosition
+		for _, ev := range room.Events() {
+			pduPos = writeEvent(ev)
+		}
+		since, err := db.StoreReceipt(ctx, room.ID, "m.read", alice.ID, room.Events()[len(room.Events())-1].EventID(), gomatrixserverlib.AsTimestamp(time.Now()))
+		if err != nil {
+			t.Fatalf("failed to store receipt: %s", err)
+		}
+
+		// A new message arrives and Bob reads it straight away, in between the
+		// PDU stream and the receipt stream running for Alice's sync.
+		msg := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+		msgPos := writeEvent(msg)
+		latest, err := db.StoreReceipt(ctx, room.ID, "m.read", bob.ID, msg.EventID(), gomatrixserverlib.AsTimestamp(time.Now()))
+		if err != nil {
+			t.Fatalf("failed to store receipt: %s", err)
+		}
+
+		n := notifier.NewNotifier()
+		n.SetCurrentPosition(types.StreamingToken{PDUPosition: msgPos})
+		provider := &ReceiptStreamProvider{DefaultStreamProvider{DB: db}, n}
+		sync := func(pduPos types.StreamPosition) (*types.SyncRequest, types.StreamPosition) {
+			snapshot, err := db.NewDatabaseSnapshot(ctx)
+			if err != nil {
+				t.Fatalf("failed to create snapshot: %s", err)
+			}
+			defer snapshot.Rollback() // nolint: errcheck
+			req := &types.SyncRequest{
+				Log:         logrus.WithField("test", t.Name()),
+				Device:      &userapi.Device{UserID: alice.ID},
+				Response:    types.NewResponse(),
+				Filter:      gomatrixserverlib.DefaultFilter(),
+				Rooms:       map[string]string{room.ID: gomatrixserverlib.Join},
+				PDUPosition: pduPos,
+			}
+			return req, provider.IncrementalSync(ctx, snapshot, req, since, latest)
+		}
+
+		// The receipt refers to an event which isn't in the timeline yet, so
+		// it's held back and the receipt position doesn't advance.
+		req, pos := sync(pduPos)
+		if pos != since {
+			t.Fatalf("expected receipt position %d, got %d", since, pos)
+		}
+		if _, ok := req.Response.Rooms.Join[room.ID]; ok {
+			t.Fatalf("expected no receipts, got %+v", req.Response.Rooms.Join[room.ID].Ephemeral)
+		}
+
+		// Once the event is in the timeline, the receipt is sent.
+		req, pos = sync(msgPos)
+		if pos != latest {
+			t.Fatalf("expected receipt position %d, got %d", latest, pos)
+		}
+		jr, ok := req.Response.Rooms.Join[room.ID]
+		if !ok || len(jr.Ephemeral.Events) != 1 {
+			t.Fatalf("expected a receipt for the room, got %+v", req.Response.Rooms.Join)
+		}
+	})
+}
@@ -31,10 +31,17 @@ func (p *TypingStreamProvider) IncrementalSync(
 	from, to types.StreamPosition,
 ) types.StreamPosition {
 	var err error
+	ephemeralFilter := &req.Filter.Room.Ephemeral
+	if !filterAllowsType(ephemeralFilter.Types, ephemeralFilter.NotTypes, gomatrixserverlib.MTyping) {
+		return to
+	}
 	for roomID, membership := range req.Rooms {
 		if membership != gomatrixserverlib.Join {
 			continue
 		}
+		if !roomFilterAllowsRoom(&req.Filter.Room, ephemeralFilter, roomID) {
+			continue
+		}
 
 		jr, ok := req.Response.Rooms.Join[roomID]
 		if !ok {
@@ -0,0 +1,92 @@
+package streams
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestTypingStreamFiltering(t *testing.T) {
+	roomA, roomB := "!a:test", "!b:test"
+	cache := caching.NewTypingCache()
+	cache.AddTypingUser("@bob:test", roomA, nil)
+	latest := types.StreamPosition(cache.AddTypingUser("@bob:test", roomB, nil))
+	provider := &TypingStreamProvider{EDUCache: cache}
+
+	testCases := []struct {
+		name      string
+		filter    func(f *gomatrixserverlib.Filter)
+		wantRooms []string
+	}{
+		{
+			name:      "no filter",
+			filter:    func(f *gomatrixserverlib.Filter) {},
+			wantRooms: []string{roomA, roomB},
+		},
+		{
+			name: "m.typing not in types",
+			filter: func(f *gomatrixserverlib.Filter) {
+				f.Room.Ephemeral.Types = &[]string{gomatrixserverlib.MReceipt}
+			},
+		},
+		{
+			name: "m.typing in not_types",
+			filter: func(f *gomatrixserverlib.Filter) {
+				f.Room.Ephemeral.NotTypes = &[]string{"m.typ*"}
+			},
+		},
+		{
+			name: "ephemeral not_rooms",
+			filter: func(f *gomatrixserverlib.Filter) {
+				f.Room.Ephemeral.NotRooms = &[]string{roomA}
+			},
+			wantRooms: []string{roomB},
+		},
+		{
+			name: "top-level rooms",
+			filter: func(f *gomatrixserverlib.Filter) {
+				f.Room.Rooms = &[]string{roomA}
+			},
+			wantRooms: []string{roomA},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &types.SyncRequest{
+				Log:      logrus.WithField("test", tc.name),
+				Device:   &userapi.Device{UserID: "@alice:test"},
+				Response: types.NewResponse(),
+				Filter:   gomatrixserverlib.DefaultFilter(),
+				Rooms: map[string]string{
+					roomA: gomatrixserverlib.Join,
+					roomB: gomatrixserverlib.Join,
+				},
+			}
+			tc.filter(&req.Filter)
+
+			provider.IncrementalSync(context.Background(), nil, req, 0, latest)
+
+			for _, roomID := range []string{roomA, roomB} {
+				want := false
+				for _, r := range tc.wantRooms {
+					want = want || r == roomID
+				}
+				jr, ok := req.Response.Rooms.Join[roomID]
+				got := ok && len(jr.Ephemeral.Events) > 0
+				if got != want {
+					t.Fatalf("room %s: expected typing events %v, got %v", roomID, want, got)
+				}
+				if got && jr.Ephemeral.Events[0].Type != gomatrixserverlib.MTyping {
+					t.Fatalf("room %s: unexpected ephemeral event %s", roomID, jr.Ephemeral.Events[0].Type)
+				}
+			}
+		})
+	}
+}
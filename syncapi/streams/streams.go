@@ -7,6 +7,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/syncapi/notifier"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -26,7 +27,7 @@ type Streams struct {
 }
 
 func NewSyncStreamProviders(
-	d storage.Database, userAPI userapi.SyncUserAPI,
+	d storage.Database, cfg *config.SyncAPI, userAPI userapi.SyncUserAPI,
 	rsAPI rsapi.SyncRoomserverAPI, keyAPI keyapi.SyncKeyAPI,
 	eduCache *caching.EDUCache, lazyLoadCache caching.LazyLoadCache, notifier *notifier.Notifier,
 ) *Streams {
@@ -36,6 +37,7 @@ func NewSyncStreamProviders(
 			lazyLoadCache:         lazyLoadCache,
 			rsAPI:                 rsAPI,
 			notifier:              notifier,
+			maxRooms:              cfg.MaxRoomsPerInitialSync,
 		},
 		TypingStreamProvider: &TypingStreamProvider{
 			DefaultStreamProvider: DefaultStreamProvider{DB: d},
@@ -43,6 +45,7 @@ func NewSyncStreamProviders(
 		},
 		ReceiptStreamProvider: &ReceiptStreamProvider{
 			DefaultStreamProvider: DefaultStreamProvider{DB: d},
+			notifier:              notifier,
 		},
 		InviteStreamProvider: &InviteStreamProvider{
 			DefaultStreamProvider: DefaultStreamProvider{DB: d},
@@ -0,0 +1,130 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var reapedSyncRequests = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "syncapi",
+		Name:      "reaped_sync_requests",
+		Help:      "The number of sync requests that were cancelled after outliving their timeout",
+	},
+)
+
+// syncConnection is a single in-flight /sync request.
+type syncConnection struct {
+	deadline time.Time
+	cancel   context.CancelFunc
+}
+
+// connectionTracker keeps track of the /sync requests which are currently
+// open. It limits how many requests a single device may hold open at once
+// and cancels requests which are still open long after their timeout, e.g.
+// because the client went away without the connection being closed.
+type connectionTracker struct {
+	sync.Mutex
+	maxPerDevice int
+	gracePeriod  time.Duration
+	devices      map[string]map[*syncConnection]struct{}
+}
+
+func newConnectionTracker(maxPerDevice int, gracePeriod time.Duration) *connectionTracker {
+	return &connectionTracker{
+		maxPerDevice: maxPerDevice,
+		gracePeriod:  gracePeriod,
+		devices:      make(map[string]map[*syncConnection]struct{}),
+	}
+}
+
+// acquire registers a new /sync request for the given device. It returns
+// false if the device already has the maximum number of requests open.
+// Otherwise it returns a context which will be cancelled if the request is
+// reaped, along with a function which must be called once the request is done.
+func (t *connectionTracker) acquire(
+	ctx context.Context, userID, deviceID string, timeout time.Duration,
+) (context.Context, func(), bool) {
+	key := userID + "|" + deviceID
+	t.Lock()
+	defer t.Unlock()
+	conns := t.devices[key]
+	if t.maxPerDevice > 0 && len(conns) >= t.maxPerDevice {
+		return nil, nil, false
+	}
+	if conns == nil {
+		conns = make(map[*syncConnection]struct{})
+		t.devices[key] = conns
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	conn := &syncConnection{
+		deadline: time.Now().Add(timeout + t.gracePeriod),
+		cancel:   cancel,
+	}
+	conns[conn] = struct{}{}
+	release := func() {
+		cancel()
+		t.Lock()
+		defer t.Unlock()
+		delete(conns, conn)
+		if len(t.devices[key]) == 0 {
+			delete(t.devices, key)
+		}
+	}
+	return ctx, release, true
+}
+
+// reap cancels all requests which have passed their deadline and returns how
+// many were cancelled. Cancelled requests still need to be released by their
+// owning goroutine.
+func (t *connectionTracker) reap(now time.Time) int {
+	t.Lock()
+	defer t.Unlock()
+	reaped := 0
+	for key, conns := range t.devices {
+		for conn := range conns {
+			if now.After(conn.deadline) {
+				conn.cancel()
+				delete(conns, conn)
+				reaped++
+			}
+		}
+		if len(conns) == 0 {
+			delete(t.devices, key)
+		}
+	}
+	reapedSyncRequests.Add(float64(reaped))
+	return reaped
+}
+
+// count returns the number of requests currently open for the given device.
+func (t *connectionTracker) count(userID, deviceID string) int {
+	t.Lock()
+	defer t.Unlock()
+	return len(t.devices[userID+"|"+deviceID])
+}
+
+func (t *connectionTracker) reapStale() {
+	for {
+		time.Sleep(t.gracePeriod)
+		t.reap(time.Now())
+	}
+}
@@ -0,0 +1,92 @@
+package sync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestConnectionTracker_PerDeviceCap(t *testing.T) {
+	tracker := newConnectionTracker(2, time.Minute)
+	ctx := context.Background()
+
+	_, release1, ok := tracker.acquire(ctx, "@alice:test", "DEVICE", time.Second)
+	if !ok {
+		t.Fatalf("expected first sync to be accepted")
+	}
+	_, release2, ok := tracker.acquire(ctx, "@alice:test", "DEVICE", time.Second)
+	if !ok {
+		t.Fatalf("expected second sync to be accepted")
+	}
+	if _, _, ok = tracker.acquire(ctx, "@alice:test", "DEVICE", time.Second); ok {
+		t.Fatalf("expected third sync to be rejected")
+	}
+	// Other devices of the same user are not affected by the cap.
+	_, release3, ok := tracker.acquire(ctx, "@alice:test", "OTHERDEVICE", time.Second)
+	if !ok {
+		t.Fatalf("expected sync from another device to be accepted")
+	}
+	defer release3()
+
+	release1()
+	_, release4, ok := tracker.acquire(ctx, "@alice:test", "DEVICE", time.Second)
+	if !ok {
+		t.Fatalf("expected sync to be accepted after another was released")
+	}
+	release2()
+	release4()
+	if count := tracker.count("@alice:test", "DEVICE"); count != 0 {
+		t.Fatalf("expected no open syncs, got %d", count)
+	}
+}
+
+func TestConnectionTracker_Reap(t *testing.T) {
+	tracker := newConnectionTracker(0, time.Second)
+	ctx, release, ok := tracker.acquire(context.Background(), "@alice:test", "DEVICE", time.Second)
+	if !ok {
+		t.Fatalf("expected sync to be accepted")
+	}
+	defer release()
+
+	if reaped := tracker.reap(time.Now()); reaped != 0 {
+		t.Fatalf("expected nothing to be reaped yet, reaped %d", reaped)
+	}
+	if reaped := tracker.reap(time.Now().Add(3 * time.Second)); reaped != 1 {
+		t.Fatalf("expected one stale sync to be reaped, reaped %d", reaped)
+	}
+	select {
+	case <-ctx.Done():
+	default:
+		t.Fatalf("expected the reaped sync context to be cancelled")
+	}
+	if count := tracker.count("@alice:test", "DEVICE"); count != 0 {
+		t.Fatalf("expected reaped sync to no longer count against the cap, got %d", count)
+	}
+	if len(tracker.devices) != 0 {
+		t.Fatalf("expected devices without syncs to be forgotten, got %d", len(tracker.devices))
+	}
+}
+
+func TestRequestPool_SyncLimitExceeded(t *testing.T) {
+	rp := &RequestPool{
+		cfg:   &config.SyncAPI{},
+		conns: newConnectionTracker(1, time.Minute),
+	}
+	device := &userapi.Device{UserID: "@alice:test", ID: "DEVICE"}
+	_, release, ok := rp.conns.acquire(context.Background(), device.UserID, device.ID, time.Minute)
+	if !ok {
+		t.Fatalf("expected first sync to be accepted")
+	}
+	defer release()
+
+	req := httptest.NewRequest(http.MethodGet, "/_matrix/client/v3/sync?timeout=30000", nil)
+	res := rp.OnIncomingSyncRequest(req, device)
+	if res.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected HTTP %d, got %d", http.StatusTooManyRequests, res.Code)
+	}
+}
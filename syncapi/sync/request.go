@@ -47,6 +47,18 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 			return nil, err
 		}
 	}
+	var roomsContinuation *types.RoomsContinuation
+	if continuationStr := req.URL.Query().Get("org.matrix.dendrite.rooms_continuation"); continuationStr != "" {
+		// Only complete syncs can be continued.
+		if !since.IsEmpty() {
+			return nil, types.ErrMalformedSyncToken
+		}
+		continuation, err := types.NewRoomsContinuationFromString(continuationStr)
+		if err != nil {
+			return nil, err
+		}
+		roomsContinuation = &continuation
+	}
 
 	// Create a default filter and apply a stored filter on top of it (if specified)
 	filter := gomatrixserverlib.DefaultFilter()
@@ -74,11 +86,7 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 	// A loaded filter might have overwritten these values,
 	// so set them after loading the filter.
 	if since.IsEmpty() {
-		// Send as much account data down for complete syncs as possible
-		// by default, otherwise clients do weird things while waiting
-		// for the rest of the data to trickle down.
-		filter.AccountData.Limit = math.MaxInt32
-		filter.Room.AccountData.Limit = math.MaxInt32
+		setCompleteSyncLimits(&filter)
 	}
 
 	logger := util.GetLogger(req.Context()).WithFields(logrus.Fields{
@@ -96,6 +104,7 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 		Response:          types.NewResponse(),       // Populated by all streams
 		Filter:            filter,                    //
 		Since:             since,                     //
+		RoomsContinuation: roomsContinuation,         //
 		Timeout:           timeout,                   //
 		Rooms:             make(map[string]string),   // Populated by the PDU stream
 		WantFullState:     wantFullState,             //
@@ -103,6 +112,23 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 	}, nil
 }
 
+// setCompleteSyncLimits sends as much account data down for complete
+// syncs as possible by default, otherwise clients do weird things while
+// waiting for the rest of the data to trickle down.
+func setCompleteSyncLimits(filter *gomatrixserverlib.Filter) {
+	filter.AccountData.Limit = math.MaxInt32
+	filter.Room.AccountData.Limit = math.MaxInt32
+}
+
+// resetToCompleteSync turns an incremental sync into a complete sync with
+// the full state of every room.
+func resetToCompleteSync(syncReq *types.SyncRequest) {
+	syncReq.Since = types.StreamingToken{}
+	syncReq.WantFullState = true
+	setCompleteSyncLimits(&syncReq.Filter)
+	syncReq.Log = syncReq.Log.WithField("since", syncReq.Since)
+}
+
 func getTimeout(timeoutMS string) time.Duration {
 	if timeoutMS == "" {
 		return defaultSyncTimeout
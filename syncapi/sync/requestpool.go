@@ -19,6 +19,7 @@ package sync
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"net"
 	"net/http"
 	"strings"
@@ -56,6 +57,7 @@ type RequestPool struct {
 	Notifier *notifier.Notifier
 	producer PresencePublisher
 	consumer PresenceConsumer
+	conns    *connectionTracker
 }
 
 type PresencePublisher interface {
@@ -76,7 +78,7 @@ func NewRequestPool(
 ) *RequestPool {
 	if enableMetrics {
 		prometheus.MustRegister(
-			activeSyncRequests, waitingSyncRequests,
+			activeSyncRequests, waitingSyncRequests, reapedSyncRequests,
 		)
 	}
 	rp := &RequestPool{
@@ -91,8 +93,12 @@ func NewRequestPool(
 		Notifier: notifier,
 		producer: producer,
 		consumer: consumer,
+		conns:    newConnectionTracker(cfg.MaxConcurrentSyncsPerDevice, cfg.StaleSyncGracePeriod),
 	}
 	go rp.cleanLastSeen()
+	if cfg.StaleSyncGracePeriod > 0 {
+		go rp.conns.reapStale()
+	}
 	go rp.cleanPresence(db, time.Minute*5)
 	return rp
 }
@@ -225,6 +231,37 @@ var waitingSyncRequests = prometheus.NewGauge(
 	},
 )
 
+// invalidSinceToken returns why the since token of an incremental sync is
+// outside of the stored stream positions, or an empty string if it isn't.
+// Only the PDU position is checked, as the other streams can't be trusted
+// to only move forwards, e.g. send-to-device messages are deleted once they
+// have been delivered.
+func (rp *RequestPool) invalidSinceToken(syncReq *types.SyncRequest) (reason string, err error) {
+	since, latest := syncReq.Since, rp.streams.Latest(syncReq.Context)
+	if since.PDUPosition > latest.PDUPosition {
+		return fmt.Sprintf("ahead of the current position %d", latest.PDUPosition), nil
+	}
+
+	snapshot, err := rp.db.NewDatabaseSnapshot(syncReq.Context)
+	if err != nil {
+		return "", fmt.Errorf("rp.db.NewDatabaseSnapshot: %w", err)
+	}
+	var succeeded bool
+	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
+	// If the user had joined a room by the since token but the room has no
+	// events up to it any more, then events which the client has seen have
+	// been purged.
+	roomIDs, err := snapshot.RoomsWithPurgedEvents(syncReq.Context, syncReq.Device.UserID, since.PDUPosition)
+	if err != nil {
+		return "", fmt.Errorf("snapshot.RoomsWithPurgedEvents: %w", err)
+	}
+	succeeded = true
+	if len(roomIDs) > 0 {
+		return fmt.Sprintf("events before it have been purged from %s", strings.Join(roomIDs, ", ")), nil
+	}
+	return "", nil
+}
+
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
 // called in a dedicated goroutine for this request. This function will block the goroutine
 // until a response is ready, or it times out.
@@ -244,12 +281,31 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 		}
 	}
 
+	ctx, release, ok := rp.conns.acquire(syncReq.Context, device.UserID, device.ID, syncReq.Timeout)
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("Too many concurrent sync requests for this device", 0),
+		}
+	}
+	defer release()
+	syncReq.Context = ctx
+
 	activeSyncRequests.Inc()
 	defer activeSyncRequests.Dec()
 
 	rp.updateLastSeen(req, device)
 	rp.updatePresence(rp.db, req.FormValue("set_presence"), device.UserID)
 
+	if rp.cfg.ResetInvalidSinceTokens && !syncReq.Since.IsEmpty() {
+		if reason, err := rp.invalidSinceToken(syncReq); err != nil {
+			syncReq.Log.WithError(err).Error("Failed to validate since token")
+		} else if reason != "" {
+			syncReq.Log.WithField("reason", reason).Warn("Resetting sync with an invalid since token to a complete sync")
+			resetToCompleteSync(syncReq)
+		}
+	}
+
 	waitingSyncRequests.Inc()
 	defer waitingSyncRequests.Dec()
 
@@ -308,7 +364,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 
 		withTransaction := func(from types.StreamPosition, f func(snapshot storage.DatabaseTransaction) types.StreamPosition) types.StreamPosition {
 			var succeeded bool
-			snapshot, err := rp.db.NewDatabaseSnapshot(req.Context())
+			snapshot, err := rp.db.NewDatabaseSnapshot(syncReq.Context)
 			if err != nil {
 				logrus.WithError(err).Error("Failed to acquire database snapshot for sync request")
 				return from
@@ -400,23 +456,27 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 				),
 			}
 		} else {
-			// Incremental sync
+			// Incremental sync. All of the streams sync up to the same current
+			// position, and the PDU stream goes first, so that the other streams
+			// can hold back anything which refers to events that aren't in the
+			// response yet.
+			syncReq.PDUPosition = withTransaction(
+				syncReq.Since.PDUPosition,
+				func(txn storage.DatabaseTransaction) types.StreamPosition {
+					return rp.streams.PDUStreamProvider.IncrementalSync(
+						syncReq.Context, txn, syncReq,
+						syncReq.Since.PDUPosition, currentPos.PDUPosition,
+					)
+				},
+			)
 			syncReq.Response.NextBatch = types.StreamingToken{
-				PDUPosition: withTransaction(
-					syncReq.Since.PDUPosition,
-					func(txn storage.DatabaseTransaction) types.StreamPosition {
-						return rp.streams.PDUStreamProvider.IncrementalSync(
-							syncReq.Context, txn, syncReq,
-							syncReq.Since.PDUPosition, rp.Notifier.CurrentPosition().PDUPosition,
-						)
-					},
-				),
+				PDUPosition: syncReq.PDUPosition,
 				TypingPosition: withTransaction(
 					syncReq.Since.TypingPosition,
 					func(txn storage.DatabaseTransaction) types.StreamPosition {
 						return rp.streams.TypingStreamProvider.IncrementalSync(
 							syncReq.Context, txn, syncReq,
-							syncReq.Since.TypingPosition, rp.Notifier.CurrentPosition().TypingPosition,
+							syncReq.Since.TypingPosition, currentPos.TypingPosition,
 						)
 					},
 				),
@@ -425,7 +485,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 					func(txn storage.DatabaseTransaction) types.StreamPosition {
 						return rp.streams.ReceiptStreamProvider.IncrementalSync(
 							syncReq.Context, txn, syncReq,
-							syncReq.Since.ReceiptPosition, rp.Notifier.CurrentPosition().ReceiptPosition,
+							syncReq.Since.ReceiptPosition, currentPos.ReceiptPosition,
 						)
 					},
 				),
@@ -434,7 +494,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 					func(txn storage.DatabaseTransaction) types.StreamPosition {
 						return rp.streams.InviteStreamProvider.IncrementalSync(
 							syncReq.Context, txn, syncReq,
-							syncReq.Since.InvitePosition, rp.Notifier.CurrentPosition().InvitePosition,
+							syncReq.Since.InvitePosition, currentPos.InvitePosition,
 						)
 					},
 				),
@@ -443,7 +503,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 					func(txn storage.DatabaseTransaction) types.StreamPosition {
 						return rp.streams.SendToDeviceStreamProvider.IncrementalSync(
 							syncReq.Context, txn, syncReq,
-							syncReq.Since.SendToDevicePosition, rp.Notifier.CurrentPosition().SendToDevicePosition,
+							syncReq.Since.SendToDevicePosition, currentPos.SendToDevicePosition,
 						)
 					},
 				),
@@ -452,7 +512,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 					func(txn storage.DatabaseTransaction) types.StreamPosition {
 						return rp.streams.AccountDataStreamProvider.IncrementalSync(
 							syncReq.Context, txn, syncReq,
-							syncReq.Since.AccountDataPosition, rp.Notifier.CurrentPosition().AccountDataPosition,
+							syncReq.Since.AccountDataPosition, currentPos.AccountDataPosition,
 						)
 					},
 				),
@@ -461,7 +521,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 					func(txn storage.DatabaseTransaction) types.StreamPosition {
 						return rp.streams.NotificationDataStreamProvider.IncrementalSync(
 							syncReq.Context, txn, syncReq,
-							syncReq.Since.NotificationDataPosition, rp.Notifier.CurrentPosition().NotificationDataPosition,
+							syncReq.Since.NotificationDataPosition, currentPos.NotificationDataPosition,
 						)
 					},
 				),
@@ -470,7 +530,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 					func(txn storage.DatabaseTransaction) types.StreamPosition {
 						return rp.streams.DeviceListStreamProvider.IncrementalSync(
 							syncReq.Context, txn, syncReq,
-							syncReq.Since.DeviceListPosition, rp.Notifier.CurrentPosition().DeviceListPosition,
+							syncReq.Since.DeviceListPosition, currentPos.DeviceListPosition,
 						)
 					},
 				),
@@ -479,7 +539,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 					func(txn storage.DatabaseTransaction) types.StreamPosition {
 						return rp.streams.PresenceStreamProvider.IncrementalSync(
 							syncReq.Context, txn, syncReq,
-							syncReq.Since.PresencePosition, rp.Notifier.CurrentPosition().PresencePosition,
+							syncReq.Since.PresencePosition, currentPos.PresencePosition,
 						)
 					},
 				),
@@ -496,6 +556,8 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 			//   they weren't always doing, resulting in flakey tests.
 			if !syncReq.Response.HasUpdates() {
 				syncReq.Since = currentPos
+				// Receipts which were held back still need to be sent.
+				syncReq.Since.ReceiptPosition = syncReq.Response.NextBatch.ReceiptPosition
 				// do not loop again if the ?timeout= is 0 as that means "return immediately"
 				if syncReq.Timeout > 0 {
 					syncReq.Timeout = syncReq.Timeout - time.Since(startTime)
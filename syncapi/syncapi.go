@@ -19,6 +19,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
 	"github.com/matrix-org/dendrite/internal/caching"
 
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
@@ -43,6 +44,7 @@ func AddPublicRoutes(
 	userAPI userapi.SyncUserAPI,
 	rsAPI api.SyncRoomserverAPI,
 	keyAPI keyapi.SyncKeyAPI,
+	fsAPI federationAPI.SyncFederationAPI,
 ) {
 	cfg := &base.Cfg.SyncAPI
 
@@ -55,7 +57,7 @@ func AddPublicRoutes(
 
 	eduCache := caching.NewTypingCache()
 	notifier := notifier.NewNotifier()
-	streams := streams.NewSyncStreamProviders(syncDB, userAPI, rsAPI, keyAPI, eduCache, base.Caches, notifier)
+	streams := streams.NewSyncStreamProviders(syncDB, cfg, userAPI, rsAPI, keyAPI, eduCache, base.Caches, notifier)
 	notifier.SetCurrentPosition(streams.Latest(context.Background()))
 	if err = notifier.Load(context.Background(), syncDB); err != nil {
 		logrus.WithError(err).Panicf("failed to load notifier ")
@@ -130,8 +132,15 @@ func AddPublicRoutes(
 		logrus.WithError(err).Panicf("failed to start receipts consumer")
 	}
 
+	if base.Cfg.UserAPI.StorageQuotaPerUser > 0 {
+		if err = base.BackgroundUpdates.Register(filterUsageUpdate(syncDB, userAPI, cfg.Matrix.ServerName)); err != nil {
+			logrus.WithError(err).Error("Failed to register filter usage update")
+		}
+	}
+
 	routing.Setup(
 		base.PublicClientAPIMux, requestPool, syncDB, userAPI,
-		rsAPI, cfg, base.Caches, base.Fulltext,
+		rsAPI, fsAPI, cfg, base.Caches, base.Fulltext,
+		&base.Cfg.ClientAPI.RateLimiting, base.Cfg.Derived.ApplicationServices,
 	)
 }
@@ -2,25 +2,32 @@ package syncapi
 
 import (
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/nats-io/nats.go"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/tidwall/gjson"
 
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	federationAPI "github.com/matrix-org/dendrite/federationapi/api"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	rsapi "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/base"
 	"github.com/matrix-org/dendrite/setup/jetstream"
+	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/dendrite/test/testrig"
@@ -68,7 +75,9 @@ func (s *syncRoomserverAPI) QueryMembershipAtEvent(ctx context.Context, req *rsa
 
 type syncUserAPI struct {
 	userapi.SyncUserAPI
-	accounts []userapi.Device
+	accounts    []userapi.Device
+	filterQuota int64
+	filterUsage int64
 }
 
 func (s *syncUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAccessTokenRequest, res *userapi.QueryAccessTokenResponse) error {
@@ -82,10 +91,25 @@ func (s *syncUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAc
 	return nil
 }
 
+func (s *syncUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
+	res.RoomAccountData = map[string]map[string]json.RawMessage{
+		req.RoomID: {"m.tag": json.RawMessage(`{"tags":{"u.test":{}}}`)},
+	}
+	return nil
+}
+
 func (s *syncUserAPI) PerformLastSeenUpdate(ctx context.Context, req *userapi.PerformLastSeenUpdateRequest, res *userapi.PerformLastSeenUpdateResponse) error {
 	return nil
 }
 
+func (s *syncUserAPI) PerformFilterUsageUpdate(ctx context.Context, req *userapi.PerformFilterUsageUpdateRequest, res *userapi.PerformFilterUsageUpdateResponse) error {
+	if s.filterQuota > 0 && req.Added > 0 && req.Size+req.Added > s.filterQuota {
+		return &userapi.ErrorStorageQuotaExceeded{Message: "too many filters"}
+	}
+	s.filterUsage = req.Size + req.Added
+	return nil
+}
+
 type syncKeyAPI struct {
 	keyapi.SyncKeyAPI
 }
@@ -120,7 +144,7 @@ func testSyncAccessTokens(t *testing.T, dbType test.DBType) {
 	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
 	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
 	msgs := toNATSMsgs(t, base, room.Events()...)
-	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{})
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{}, nil)
 	testrig.MustPublishMsgs(t, jsctx, msgs...)
 
 	testCases := []struct {
@@ -219,7 +243,7 @@ func testSyncAPICreateRoomSyncEarly(t *testing.T, dbType test.DBType) {
 	// m.room.history_visibility
 	msgs := toNATSMsgs(t, base, room.Events()...)
 	sinceTokens := make([]string, len(msgs))
-	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{})
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, &syncKeyAPI{}, nil)
 	for i, msg := range msgs {
 		testrig.MustPublishMsgs(t, jsctx, msg)
 		time.Sleep(100 * time.Millisecond)
@@ -303,7 +327,7 @@ func testSyncAPIUpdatePresenceImmediately(t *testing.T, dbType test.DBType) {
 
 	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
 	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
-	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{}, &syncKeyAPI{})
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{}, &syncKeyAPI{}, nil)
 	w := httptest.NewRecorder()
 	base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
 		"access_token": alice.AccessToken,
@@ -332,6 +356,128 @@ func testSyncAPIUpdatePresenceImmediately(t *testing.T, dbType test.DBType) {
 
 }
 
+// Joining a room should return the presence of the existing members on the
+// next sync, rather than waiting for them to change their presence.
+func TestSyncPresenceOnJoin(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+	bob := test.NewUser(t)
+	bobDev := userapi.Device{
+		ID:          "BOBID",
+		UserID:      bob.ID,
+		AccessToken: "BOB_BEARER_TOKEN",
+		DisplayName: "Bob",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		base.Cfg.Global.Presence.EnableOutbound = true
+		base.Cfg.Global.Presence.EnableInbound = true
+		defer close()
+
+		jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, &syncKeyAPI{}, nil)
+
+		sync := func(t *testing.T, accessToken, since, setPresence string) gjson.Result {
+			t.Helper()
+			params := map[string]string{
+				"access_token": accessToken,
+				"timeout":      "0",
+			}
+			if since != "" {
+				params["since"] = since
+			}
+			if setPresence != "" {
+				params["set_presence"] = setPresence
+			}
+			w := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(params)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			return gjson.ParseBytes(w.Body.Bytes())
+		}
+		alicePresence := func(body gjson.Result) gjson.Result {
+			return body.Get(fmt.Sprintf(`presence.events.#(sender=="%s")`, alice.ID))
+		}
+
+		// Send enough messages that Alice's join isn't in the timeline when
+		// Bob joins, so her presence isn't returned because of her join.
+		room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat))
+		for i := 0; i < 100; i++ {
+			room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": fmt.Sprintf("Message %d", i)})
+		}
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		// Alice comes online before Bob shares a room with her.
+		sync(t, aliceDev.AccessToken, "", "online")
+		since := sync(t, bobDev.AccessToken, "", "").Get("next_batch").Str
+		if body := sync(t, bobDev.AccessToken, since, ""); alicePresence(body).Exists() {
+			t.Fatalf("expected no presence for Alice before sharing a room, got %s", body.Get("presence").Raw)
+		}
+
+		joinEv := room.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(bob.ID))
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{joinEv}, "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+
+		// The sync which returns the join also returns Alice's presence.
+		waitForPresence := func(t *testing.T, since string) string {
+			t.Helper()
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				body := sync(t, bobDev.AccessToken, since, "")
+				if body.Get("rooms.join." + room.ID).Exists() {
+					presence := alicePresence(body)
+					if !presence.Exists() {
+						t.Fatalf("expected presence for Alice after joining, got %s", body.Get("presence").Raw)
+					}
+					if got := presence.Get("content.presence").Str; got != "online" {
+						t.Fatalf("expected Alice to be online, got %q", got)
+					}
+					return body.Get("next_batch").Str
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("timed out waiting for the join")
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+		since = waitForPresence(t, since)
+
+		// Rejoining the room returns Alice's presence again, even though it
+		// hasn't changed since Bob last saw it.
+		leaveEv := room.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "leave"}, test.WithStateKey(bob.ID))
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{leaveEv}, "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		syncUntil(t, base, bobDev.AccessToken, false, func(syncBody string) bool {
+			since = gjson.Get(syncBody, "next_batch").Str
+			return since != "" && !gjson.Get(syncBody, "rooms.join."+room.ID).Exists()
+		})
+		joinEv = room.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(bob.ID))
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{joinEv}, "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		waitForPresence(t, since)
+	})
+}
+
 // This is mainly what Sytest is doing in "test_history_visibility"
 func TestMessageHistoryVisibility(t *testing.T) {
 	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
@@ -421,7 +567,7 @@ func testHistoryVisibility(t *testing.T, dbType test.DBType) {
 		rsAPI := roomserver.NewInternalAPI(base)
 		rsAPI.SetFederationAPI(nil, nil)
 
-		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, &syncKeyAPI{})
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, &syncKeyAPI{}, nil)
 
 		for _, tc := range testCases {
 			testname := fmt.Sprintf("%s - %s", tc.historyVisibility, userType)
@@ -503,6 +649,80 @@ func testHistoryVisibility(t *testing.T, dbType test.DBType) {
 	}
 }
 
+// Changing the history visibility only affects events sent after the change.
+func TestMessageHistoryVisibilityChange(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "ALICE",
+	}
+	bob := test.NewUser(t)
+	bobDev := userapi.Device{
+		ID:          "BOBID",
+		UserID:      bob.ID,
+		AccessToken: "BOB_BEARER_TOKEN",
+		DisplayName: "BOB",
+	}
+
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+
+		jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, &syncKeyAPI{}, nil)
+
+		// The room starts out as shared, then becomes joined, before Bob joins.
+		room := test.NewRoom(t, alice, test.RoomPreset(test.PresetPublicChat), test.RoomHistoryVisibility(gomatrixserverlib.HistoryVisibilityShared))
+		beforeChangeEv := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "Before the change"})
+		room.CreateAndInsert(t, alice, gomatrixserverlib.MRoomHistoryVisibility, map[string]interface{}{
+			"history_visibility": gomatrixserverlib.HistoryVisibilityJoined,
+		}, test.WithStateKey(""))
+		afterChangeEv := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "After the change"})
+		room.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(bob.ID))
+		afterJoinEv := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "After the join"})
+
+		if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		syncUntil(t, base, aliceDev.AccessToken, false,
+			func(syncBody string) bool {
+				path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, room.ID, afterJoinEv.EventID())
+				return gjson.Get(syncBody, path).Exists()
+			},
+		)
+
+		w := httptest.NewRecorder()
+		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", fmt.Sprintf("/_matrix/client/v3/rooms/%s/messages", room.ID), test.WithQueryParams(map[string]string{
+			"access_token": bobDev.AccessToken,
+			"dir":          "b",
+		})))
+		if w.Code != 200 {
+			t.Logf("%s", w.Body.String())
+			t.Fatalf("got HTTP %d want %d", w.Code, 200)
+		}
+		var res struct {
+			Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("failed to decode response body: %s", err)
+		}
+
+		// Bob can see history from while the room was shared, but not from
+		// while it was joined and he wasn't in the room.
+		verifyEventVisible(t, true, beforeChangeEv, res.Chunk)
+		verifyEventVisible(t, false, afterChangeEv, res.Chunk)
+		verifyEventVisible(t, true, afterJoinEv, res.Chunk)
+	})
+}
+
 func verifyEventVisible(t *testing.T, wantVisible bool, wantVisibleEvent *gomatrixserverlib.HeaderedEvent, chunk []gomatrixserverlib.ClientEvent) {
 	t.Helper()
 	if wantVisible {
@@ -720,7 +940,7 @@ func TestGetMembership(t *testing.T) {
 		rsAPI := roomserver.NewInternalAPI(base)
 		rsAPI.SetFederationAPI(nil, nil)
 
-		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, &syncKeyAPI{})
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, &syncKeyAPI{}, nil)
 
 		for _, tc := range testCases {
 			t.Run(tc.name, func(t *testing.T) {
@@ -767,149 +987,977 @@ func TestGetMembership(t *testing.T) {
 	})
 }
 
-func TestSendToDevice(t *testing.T) {
-	test.WithAllDatabases(t, testSendToDevice)
-}
-
-func testSendToDevice(t *testing.T, dbType test.DBType) {
-	user := test.NewUser(t)
-	alice := userapi.Device{
+func TestGetMembershipPaginated(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceDev := userapi.Device{
 		ID:          "ALICEID",
-		UserID:      user.ID,
+		UserID:      alice.ID,
 		AccessToken: "ALICE_BEARER_TOKEN",
 		DisplayName: "Alice",
 		AccountType: userapi.AccountTypeUser,
 	}
 
-	base, baseClose := testrig.CreateBaseDendrite(t, dbType)
-	defer baseClose()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
 
-	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
-	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+		jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
 
-	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{}, &syncKeyAPI{})
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
 
-	producer := producers.SyncAPIProducer{
-		TopicSendToDeviceEvent: base.Cfg.Global.JetStream.Prefixed(jetstream.OutputSendToDeviceEvent),
-		JetStream:              jsctx,
-	}
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev}}, rsAPI, &syncKeyAPI{}, nil)
+
+		// Create a large room, with lots of users joining it.
+		room := test.NewRoom(t, alice)
+		wantMembers := map[string]struct{}{alice.ID: {}}
+		for i := 0; i < 24; i++ {
+			user := test.NewUser(t)
+			room.CreateAndInsert(t, user, gomatrixserverlib.MRoomMember, map[string]interface{}{
+				"membership": "join",
+			}, test.WithStateKey(user.ID))
+			wantMembers[user.ID] = struct{}{}
+		}
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		syncUntil(t, base, aliceDev.AccessToken, false, func(syncBody string) bool {
+			path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, room.ID, room.Events()[len(room.Events())-1].EventID())
+			return gjson.Get(syncBody, path).Exists()
+		})
 
-	msgCounter := 0
+		getMembers := func(params map[string]string) gjson.Result {
+			params["access_token"] = aliceDev.AccessToken
+			w := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", fmt.Sprintf("/_matrix/client/v3/rooms/%s/members", room.ID), test.WithQueryParams(params)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			return gjson.ParseBytes(w.Body.Bytes())
+		}
 
-	testCases := []struct {
-		name              string
-		since             string
-		want              []string
-		sendMessagesCount int
-	}{
-		{
-			name: "initial sync, no messages",
-			want: []string{},
-		},
-		{
-			name:              "initial sync, one new message",
-			sendMessagesCount: 1,
-			want: []string{
-				"message 1",
-			},
-		},
-		{
-			name:              "initial sync, two new messages", // we didn't advance the since token, so we'll receive two messages
-			sendMessagesCount: 1,
-			want: []string{
-				"message 1",
-				"message 2",
-			},
-		},
-		{
-			name:  "incremental sync, one message", // this deletes message 1, as we advanced the since token
-			since: types.StreamingToken{SendToDevicePosition: 1}.String(),
-			want: []string{
-				"message 2",
-			},
-		},
-		{
-			name:  "failed incremental sync, one message", // didn't advance since, so still the same message
-			since: types.StreamingToken{SendToDevicePosition: 1}.String(),
-			want: []string{
-				"message 2",
-			},
-		},
-		{
-			name:  "incremental sync, no message",                         // this should delete message 2
-			since: types.StreamingToken{SendToDevicePosition: 2}.String(), // next_batch from previous sync
-			want:  []string{},
-		},
-		{
-			name:              "incremental sync, three new messages",
-			since:             types.StreamingToken{SendToDevicePosition: 2}.String(),
-			sendMessagesCount: 3,
-			want: []string{
-				"message 3", // message 2 was deleted in the previous test
-				"message 4",
-				"message 5",
-			},
-		},
-		{
-			name: "initial sync, three messages", // we expect three messages, as we didn't go beyond "2"
-			want: []string{
-				"message 3",
-				"message 4",
-				"message 5",
-			},
-		},
-		{
-			name:  "incremental sync, no messages", // advance the sync token, no new messages
-			since: types.StreamingToken{SendToDevicePosition: 5}.String(),
-			want:  []string{},
-		},
-	}
+		// Without a limit, all members are returned at once.
+		res := getMembers(map[string]string{})
+		if got := len(res.Get("chunk").Array()); got != len(wantMembers) {
+			t.Fatalf("expected %d members, got %d", len(wantMembers), got)
+		}
+		if res.Get("next_batch").Exists() {
+			t.Fatalf("expected no next_batch without a limit, got %q", res.Get("next_batch").Str)
+		}
 
-	ctx := context.Background()
-	for _, tc := range testCases {
-		// Send to-device messages of type "m.dendrite.test" with content `{"dummy":"message $counter"}`
-		for i := 0; i < tc.sendMessagesCount; i++ {
-			msgCounter++
-			msg := json.RawMessage(fmt.Sprintf(`{"dummy":"message %d"}`, msgCounter))
-			if err := producer.SendToDevice(ctx, user.ID, user.ID, alice.ID, "m.dendrite.test", msg); err != nil {
-				t.Fatalf("unable to send to device message: %v", err)
+		// With a limit, the members are returned in batches.
+		gotMembers := map[string]struct{}{}
+		batch := ""
+		batches := 0
+		for {
+			params := map[string]string{"limit": "10"}
+			if batch != "" {
+				params["batch"] = batch
+			}
+			res = getMembers(params)
+			batches++
+			chunk := res.Get("chunk").Array()
+			if len(chunk) > 10 {
+				t.Fatalf("expected at most 10 members, got %d", len(chunk))
+			}
+			for _, ev := range chunk {
+				userID := ev.Get("state_key").Str
+				if _, ok := gotMembers[userID]; ok {
+					t.Fatalf("member %s returned more than once", userID)
+				}
+				gotMembers[userID] = struct{}{}
+			}
+			batch = res.Get("next_batch").Str
+			if batch == "" {
+				break
+			}
+			if batches > len(wantMembers) {
+				t.Fatalf("too many batches returned")
 			}
 		}
+		if batches != 3 {
+			t.Fatalf("expected 3 batches, got %d", batches)
+		}
+		if !reflect.DeepEqual(gotMembers, wantMembers) {
+			t.Fatalf("expected members %v, got %v", wantMembers, gotMembers)
+		}
 
-		syncUntil(t, base, alice.AccessToken,
-			len(tc.want) == 0,
-			func(body string) bool {
-				return gjson.Get(body, fmt.Sprintf(`to_device.events.#(content.dummy=="message %d")`, msgCounter)).Exists()
-			},
-		)
-
-		// Execute a /sync request, recording the response
 		w := httptest.NewRecorder()
-		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
-			"access_token": alice.AccessToken,
-			"since":        tc.since,
+		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", fmt.Sprintf("/_matrix/client/v3/rooms/%s/members", room.ID), test.WithQueryParams(map[string]string{
+			"access_token": aliceDev.AccessToken,
+			"limit":        "-1",
 		})))
-
-		// Extract the to_device.events, # gets all values of an array, in this case a string slice with "message $counter" entries
-		events := gjson.Get(w.Body.String(), "to_device.events.#.content.dummy").Array()
-		got := make([]string, len(events))
-		for i := range events {
-			got[i] = events[i].String()
-		}
-
-		// Ensure the messages we received are as we expect them to be
-		if !reflect.DeepEqual(got, tc.want) {
-			t.Logf("[%s|since=%s]: Sync: %s", tc.name, tc.since, w.Body.String())
-			t.Fatalf("[%s|since=%s]: got: %+v, want: %+v", tc.name, tc.since, got, tc.want)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("got HTTP %d want %d for a negative limit", w.Code, http.StatusBadRequest)
 		}
-	}
+	})
 }
 
-func syncUntil(t *testing.T,
-	base *base.BaseDendrite, accessToken string,
-	skip bool,
-	checkFunc func(syncBody string) bool,
-) {
+func TestRoomInitialSync(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+	bob := test.NewUser(t)
+	bobDev := userapi.Device{
+		ID:          "BOBID",
+		UserID:      bob.ID,
+		AccessToken: "notjoinedtoanyrooms",
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+
+		jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, &syncKeyAPI{}, nil)
+
+		room := test.NewRoom(t, alice)
+		for i := 0; i < 5; i++ {
+			room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": fmt.Sprintf("message %d", i)})
+		}
+		room.CreateAndInsert(t, alice, "m.room.topic", map[string]interface{}{"topic": "testing"}, test.WithStateKey(""))
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		syncUntil(t, base, aliceDev.AccessToken, false, func(syncBody string) bool {
+			path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, room.ID, room.Events()[len(room.Events())-1].EventID())
+			return gjson.Get(syncBody, path).Exists()
+		})
+
+		t.Run("joined user sees recent messages and current state", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", fmt.Sprintf("/_matrix/client/v3/rooms/%s/initialSync", room.ID), test.WithQueryParams(map[string]string{
+				"access_token": aliceDev.AccessToken,
+				"limit":        "3",
+			})))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			body := w.Body.Bytes()
+			if got := gjson.GetBytes(body, "room_id").Str; got != room.ID {
+				t.Fatalf("expected room_id %s, got %s", room.ID, got)
+			}
+			if got := gjson.GetBytes(body, "membership").Str; got != gomatrixserverlib.Join {
+				t.Fatalf("expected membership %q, got %q", gomatrixserverlib.Join, got)
+			}
+			if got := gjson.GetBytes(body, "visibility").Str; got != "private" {
+				t.Fatalf("expected visibility %q, got %q", "private", got)
+			}
+
+			// The timeline should be the most recent events in chronological order.
+			events := room.Events()
+			wantTimeline := events[len(events)-3:]
+			gotTimeline := gjson.GetBytes(body, "messages.chunk").Array()
+			if len(gotTimeline) != len(wantTimeline) {
+				t.Fatalf("expected %d timeline events, got %d", len(wantTimeline), len(gotTimeline))
+			}
+			for i, ev := range wantTimeline {
+				if got := gotTimeline[i].Get("event_id").Str; got != ev.EventID() {
+					t.Fatalf("timeline event %d: expected %s, got %s", i, ev.EventID(), got)
+				}
+			}
+			if gjson.GetBytes(body, "messages.start").Str == "" || gjson.GetBytes(body, "messages.end").Str == "" {
+				t.Fatalf("expected pagination tokens, got %s", gjson.GetBytes(body, "messages").Raw)
+			}
+
+			// The state should match the current state of the room.
+			wantState := make(map[string]struct{})
+			for _, ev := range room.CurrentState() {
+				wantState[ev.EventID()] = struct{}{}
+			}
+			gotState := gjson.GetBytes(body, "state").Array()
+			if len(gotState) != len(wantState) {
+				t.Fatalf("expected %d state events, got %d", len(wantState), len(gotState))
+			}
+			for _, ev := range gotState {
+				if _, ok := wantState[ev.Get("event_id").Str]; !ok {
+					t.Fatalf("unexpected state event %s", ev.Get("event_id").Str)
+				}
+			}
+
+			if got := gjson.GetBytes(body, `account_data.#(type=="m.tag").content.tags`).Raw; got != `{"u.test":{}}` {
+				t.Fatalf("expected room account data, got %s", gjson.GetBytes(body, "account_data").Raw)
+			}
+		})
+
+		t.Run("user who was never in the room is forbidden", func(t *testing.T) {
+			w := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", fmt.Sprintf("/_matrix/client/v3/rooms/%s/initialSync", room.ID), test.WithQueryParams(map[string]string{
+				"access_token": bobDev.AccessToken,
+			})))
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusForbidden, w.Body.String())
+			}
+		})
+	})
+}
+
+func TestSyncLimitedTimelinePrevBatch(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+
+		jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev}}, rsAPI, &syncKeyAPI{}, nil)
+
+		room := test.NewRoom(t, alice)
+		sendMessages := func(t *testing.T, count int) {
+			t.Helper()
+			events := make([]*gomatrixserverlib.HeaderedEvent, 0, count)
+			for i := 0; i < count; i++ {
+				events = append(events, room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": fmt.Sprintf("message %d", i)}))
+			}
+			if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, events, "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		sendMessages(t, 10)
+
+		// limitedSync syncs until the last event of the room is in the timeline,
+		// which must be limited, and returns the timeline, prev_batch and next_batch.
+		limitedSync := func(t *testing.T, since string) (timeline []string, prevBatch, nextBatch string) {
+			t.Helper()
+			lastEventID := room.Events()[len(room.Events())-1].EventID()
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) {
+				w := httptest.NewRecorder()
+				base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+					"access_token": aliceDev.AccessToken,
+					"timeout":      "100",
+					"since":        since,
+					"filter":       `{"room":{"timeline":{"limit":5}}}`,
+				})))
+				joinedRoom := gjson.GetBytes(w.Body.Bytes(), "rooms.join."+room.ID)
+				events := joinedRoom.Get("timeline.events.#.event_id").Array()
+				if len(events) == 0 || events[len(events)-1].Str != lastEventID {
+					continue
+				}
+				if !joinedRoom.Get("timeline.limited").Bool() {
+					t.Fatalf("expected the timeline to be limited: %s", joinedRoom.Raw)
+				}
+				for _, ev := range events {
+					timeline = append(timeline, ev.Str)
+				}
+				return timeline, joinedRoom.Get("timeline.prev_batch").Str, gjson.GetBytes(w.Body.Bytes(), "next_batch").Str
+			}
+			t.Fatalf("timed out waiting for %s to be synced", lastEventID)
+			return
+		}
+
+		// paginateBackwards returns the event IDs of all events before the given
+		// token, in chronological order.
+		paginateBackwards := func(t *testing.T, from string) []string {
+			t.Helper()
+			var eventIDs []string
+			for from != "" {
+				w := httptest.NewRecorder()
+				base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", fmt.Sprintf("/_matrix/client/v3/rooms/%s/messages", room.ID), test.WithQueryParams(map[string]string{
+					"access_token": aliceDev.AccessToken,
+					"dir":          "b",
+					"from":         from,
+					"limit":        "3",
+				})))
+				if w.Code != http.StatusOK {
+					t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+				}
+				chunk := gjson.GetBytes(w.Body.Bytes(), "chunk.#.event_id").Array()
+				if len(chunk) == 0 {
+					break
+				}
+				for _, ev := range chunk {
+					eventIDs = append([]string{ev.Str}, eventIDs...)
+				}
+				from = gjson.GetBytes(w.Body.Bytes(), "end").Str
+			}
+			return eventIDs
+		}
+
+		assertContiguous := func(t *testing.T, before, timeline []string, wantEvents []*gomatrixserverlib.HeaderedEvent) {
+			t.Helper()
+			got := append(before, timeline...)
+			if len(got) != len(wantEvents) {
+				t.Fatalf("expected %d events, got %d: %v", len(wantEvents), len(got), got)
+			}
+			for i, ev := range wantEvents {
+				if got[i] != ev.EventID() {
+					t.Fatalf("event %d: expected %s, got %s", i, ev.EventID(), got[i])
+				}
+			}
+		}
+
+		var since string
+		t.Run("initial sync", func(t *testing.T) {
+			timeline, prevBatch, nextBatch := limitedSync(t, "")
+			since = nextBatch
+			assertContiguous(t, paginateBackwards(t, prevBatch), timeline, room.Events())
+		})
+
+		t.Run("incremental sync", func(t *testing.T) {
+			sendMessages(t, 10)
+			timeline, prevBatch, _ := limitedSync(t, since)
+			assertContiguous(t, paginateBackwards(t, prevBatch), timeline, room.Events())
+		})
+	})
+}
+
+func TestSyncMaxRoomsPerInitialSync(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+		base.Cfg.SyncAPI.MaxRoomsPerInitialSync = 2
+
+		jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev}}, rsAPI, &syncKeyAPI{}, nil)
+
+		rooms := map[string]*test.Room{}
+		for i := 0; i < 5; i++ {
+			room := test.NewRoom(t, alice)
+			if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+			rooms[room.ID] = room
+		}
+
+		sync := func(t *testing.T, params map[string]string) gjson.Result {
+			t.Helper()
+			params["access_token"] = aliceDev.AccessToken
+			params["timeout"] = "0"
+			w := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(params)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected HTTP %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+			}
+			return gjson.ParseBytes(w.Body.Bytes())
+		}
+
+		// initialSync pages through a complete sync, returning the rooms of
+		// each response and the next_batch of the last one.
+		initialSync := func(t *testing.T) (pages [][]string, nextBatch string) {
+			t.Helper()
+			continuation := ""
+			for {
+				params := map[string]string{}
+				if continuation != "" {
+					params["org.matrix.dendrite.rooms_continuation"] = continuation
+				}
+				res := sync(t, params)
+				var page []string
+				res.Get("rooms.join").ForEach(func(roomID, _ gjson.Result) bool {
+					page = append(page, roomID.Str)
+					return true
+				})
+				pages = append(pages, page)
+				continuation = res.Get("org\\.matrix\\.dendrite\\.rooms_continuation").Str
+				if continuation == "" {
+					return pages, res.Get("next_batch").Str
+				}
+				if len(pages) > len(rooms) {
+					t.Fatalf("expected the rooms to be paged through, got %v", pages)
+				}
+			}
+		}
+
+		// Wait for all of the rooms to be synced.
+		var pages [][]string
+		var nextBatch string
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			pages, nextBatch = initialSync(t)
+			count := 0
+			for _, page := range pages {
+				count += len(page)
+			}
+			if count == len(rooms) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d rooms to be synced, got %v", len(rooms), pages)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if len(pages) != 3 {
+			t.Fatalf("expected 3 responses for 5 rooms, got %v", pages)
+		}
+		seen := map[string]bool{}
+		for i, page := range pages {
+			want := 2
+			if i == len(pages)-1 {
+				want = 1
+			}
+			if len(page) != want {
+				t.Fatalf("expected %d rooms in response %d, got %v", want, i, page)
+			}
+			for _, roomID := range page {
+				if _, ok := rooms[roomID]; !ok || seen[roomID] {
+					t.Fatalf("unexpected or duplicate room %s in %v", roomID, pages)
+				}
+				seen[roomID] = true
+			}
+		}
+
+		// A message sent while paging must not be missed by the incremental sync
+		// which follows. Continuing from the first response returns the rooms as
+		// of its position, so the message arrives with the incremental sync.
+		first := sync(t, map[string]string{})
+		continuation := first.Get("org\\.matrix\\.dendrite\\.rooms_continuation").Str
+		firstRoom := rooms[pages[0][0]]
+		msg := firstRoom.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{msg}, "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		for deadline = time.Now().Add(5 * time.Second); ; time.Sleep(100 * time.Millisecond) {
+			// Wait for the message to reach the sync API.
+			res := sync(t, map[string]string{"since": nextBatch})
+			if res.Get("rooms.join." + strings.ReplaceAll(firstRoom.ID, ".", "\\.")).Exists() {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the message to be synced")
+			}
+		}
+		for continuation != "" {
+			res := sync(t, map[string]string{"org.matrix.dendrite.rooms_continuation": continuation})
+			continuation = res.Get("org\\.matrix\\.dendrite\\.rooms_continuation").Str
+			nextBatch = res.Get("next_batch").Str
+		}
+		res := sync(t, map[string]string{"since": nextBatch})
+		events := res.Get("rooms.join." + strings.ReplaceAll(firstRoom.ID, ".", "\\.") + ".timeline.events.#.event_id").Array()
+		if len(events) != 1 || events[0].Str != msg.EventID() {
+			t.Fatalf("expected the incremental sync to return %s, got %v", msg.EventID(), events)
+		}
+
+		// Continuations are only valid for complete syncs.
+		w := httptest.NewRecorder()
+		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+			"access_token":                           aliceDev.AccessToken,
+			"since":                                  nextBatch,
+			"org.matrix.dendrite.rooms_continuation": first.Get("org\\.matrix\\.dendrite\\.rooms_continuation").Str,
+		})))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected HTTP %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+}
+
+func TestEventsWorldReadablePeek(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+	bob := test.NewUser(t)
+	bobDev := userapi.Device{
+		ID:          "BOBID",
+		UserID:      bob.ID,
+		AccessToken: "notjoinedtoanyrooms",
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+
+		jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, &syncKeyAPI{}, nil)
+
+		worldReadableRoom := test.NewRoom(t, alice, test.RoomHistoryVisibility(gomatrixserverlib.HistoryVisibilityWorldReadable))
+		sharedRoom := test.NewRoom(t, alice, test.RoomHistoryVisibility(gomatrixserverlib.HistoryVisibilityShared))
+		for _, room := range []*test.Room{worldReadableRoom, sharedRoom} {
+			if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+		syncUntil(t, base, aliceDev.AccessToken, false, func(syncBody string) bool {
+			path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, sharedRoom.ID, sharedRoom.Events()[len(sharedRoom.Events())-1].EventID())
+			return gjson.Get(syncBody, path).Exists()
+		})
+
+		events := func(roomID, from, timeout string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/events", test.WithQueryParams(map[string]string{
+				"access_token": bobDev.AccessToken,
+				"room_id":      roomID,
+				"from":         from,
+				"timeout":      timeout,
+			})))
+			return w
+		}
+
+		t.Run("non-member receives new events of a world readable room", func(t *testing.T) {
+			w := events(worldReadableRoom.ID, "", "0")
+			if w.Code != http.StatusOK {
+				t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			from := gjson.GetBytes(w.Body.Bytes(), "end").Str
+			if from == "" {
+				t.Fatalf("expected an end token, got %s", w.Body.String())
+			}
+
+			msg := worldReadableRoom.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+			if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{msg}, "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+
+			w = events(worldReadableRoom.ID, from, "5000")
+			if w.Code != http.StatusOK {
+				t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			chunk := gjson.GetBytes(w.Body.Bytes(), "chunk").Array()
+			if len(chunk) != 1 || chunk[0].Get("event_id").Str != msg.EventID() {
+				t.Fatalf("expected event %s, got %s", msg.EventID(), w.Body.String())
+			}
+		})
+
+		t.Run("non-member can't stream a room which isn't world readable", func(t *testing.T) {
+			w := events(sharedRoom.ID, "", "0")
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusForbidden, w.Body.String())
+			}
+		})
+	})
+}
+
+func TestSyncFullState(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+	bob := test.NewUser(t)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+
+		jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev}}, rsAPI, &syncKeyAPI{}, nil)
+
+		room := test.NewRoom(t, alice)
+		room.CreateAndInsert(t, bob, gomatrixserverlib.MRoomMember, map[string]interface{}{
+			"membership": "join",
+		}, test.WithStateKey(bob.ID))
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		var since string
+		syncUntil(t, base, aliceDev.AccessToken, false, func(syncBody string) bool {
+			path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, room.ID, room.Events()[len(room.Events())-1].EventID())
+			since = gjson.Get(syncBody, "next_batch").Str
+			return gjson.Get(syncBody, path).Exists()
+		})
+
+		msg := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "hello"})
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, []*gomatrixserverlib.HeaderedEvent{msg}, "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		syncUntil(t, base, aliceDev.AccessToken, false, func(syncBody string) bool {
+			path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, room.ID, msg.EventID())
+			return gjson.Get(syncBody, path).Exists()
+		})
+
+		wantState := make(map[string]struct{})
+		for _, ev := range room.CurrentState() {
+			wantState[ev.EventID()] = struct{}{}
+		}
+
+		testCases := []struct {
+			name      string
+			fullState string
+			wantState map[string]struct{}
+		}{
+			{name: "incremental sync only returns state changes", fullState: "false", wantState: map[string]struct{}{}},
+			{name: "full_state returns the complete room state", fullState: "true", wantState: wantState},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				w := httptest.NewRecorder()
+				base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+					"access_token": aliceDev.AccessToken,
+					"timeout":      "0",
+					"since":        since,
+					"full_state":   tc.fullState,
+				})))
+				if w.Code != http.StatusOK {
+					t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+				}
+				joinedRoom := gjson.GetBytes(w.Body.Bytes(), "rooms.join."+room.ID)
+
+				// The timeline should still be limited by the since token.
+				gotTimeline := joinedRoom.Get("timeline.events").Array()
+				if len(gotTimeline) != 1 || gotTimeline[0].Get("event_id").Str != msg.EventID() {
+					t.Fatalf("expected only %s in the timeline, got %s", msg.EventID(), joinedRoom.Get("timeline.events").Raw)
+				}
+
+				gotState := joinedRoom.Get("state.events").Array()
+				if len(gotState) != len(tc.wantState) {
+					t.Fatalf("expected %d state events, got %d: %s", len(tc.wantState), len(gotState), joinedRoom.Get("state.events").Raw)
+				}
+				for _, ev := range gotState {
+					if _, ok := tc.wantState[ev.Get("event_id").Str]; !ok {
+						t.Fatalf("unexpected state event %s", ev.Get("event_id").Str)
+					}
+				}
+				if tc.fullState == "true" {
+					for _, userID := range []string{alice.ID, bob.ID} {
+						found := false
+						for _, key := range joinedRoom.Get(`state.events.#(type=="m.room.member")#.state_key`).Array() {
+							found = found || key.Str == userID
+						}
+						if !found {
+							t.Fatalf("expected membership for %s in the state", userID)
+						}
+					}
+				}
+			})
+		}
+	})
+}
+
+func TestSyncInvalidSinceToken(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+
+		jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev}}, rsAPI, &syncKeyAPI{}, nil)
+
+		room := test.NewRoom(t, alice)
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		var since types.StreamingToken
+		syncUntil(t, base, aliceDev.AccessToken, false, func(syncBody string) bool {
+			path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, room.ID, room.Events()[len(room.Events())-1].EventID())
+			var err error
+			since, err = types.NewStreamTokenFromString(gjson.Get(syncBody, "next_batch").Str)
+			return err == nil && gjson.Get(syncBody, path).Exists()
+		})
+
+		hook := logrustest.NewGlobal()
+		defer hook.Reset()
+		syncWithSince := func(t *testing.T, since types.StreamingToken) gjson.Result {
+			t.Helper()
+			w := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+				"access_token": aliceDev.AccessToken,
+				"timeout":      "0",
+				"since":        since.String(),
+			})))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			return gjson.ParseBytes(w.Body.Bytes())
+		}
+		wasReset := func() bool {
+			for _, entry := range hook.AllEntries() {
+				if strings.HasPrefix(entry.Message, "Resetting sync with an invalid since token") {
+					return true
+				}
+			}
+			return false
+		}
+		assertFullState := func(t *testing.T, body gjson.Result) {
+			t.Helper()
+			gotState := map[string]struct{}{}
+			for _, ev := range body.Get("rooms.join." + room.ID + ".state.events").Array() {
+				gotState[ev.Get("event_id").Str] = struct{}{}
+			}
+			for _, ev := range body.Get("rooms.join." + room.ID + ".timeline.events").Array() {
+				gotState[ev.Get("event_id").Str] = struct{}{}
+			}
+			for _, ev := range room.CurrentState() {
+				if _, ok := gotState[ev.EventID()]; !ok {
+					t.Fatalf("expected state event %s in the response, got %s", ev.EventID(), body.Get("rooms.join."+room.ID).Raw)
+				}
+			}
+		}
+
+		t.Run("valid token returns no changes", func(t *testing.T) {
+			hook.Reset()
+			body := syncWithSince(t, since)
+			if body.Get("rooms.join." + room.ID).Exists() {
+				t.Fatalf("expected no changes, got %s", body.Get("rooms").Raw)
+			}
+			if wasReset() {
+				t.Fatalf("expected a valid token not to be reset")
+			}
+		})
+
+		t.Run("token ahead of the current position returns full state", func(t *testing.T) {
+			hook.Reset()
+			ahead := since
+			ahead.PDUPosition += 1000
+			body := syncWithSince(t, ahead)
+			if !wasReset() {
+				t.Fatalf("expected the token to be reset")
+			}
+			assertFullState(t, body)
+			nextBatch, err := types.NewStreamTokenFromString(body.Get("next_batch").Str)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if nextBatch.PDUPosition != since.PDUPosition {
+				t.Fatalf("expected next_batch at the current position %d, got %d", since.PDUPosition, nextBatch.PDUPosition)
+			}
+		})
+
+		t.Run("token ahead in other streams is kept", func(t *testing.T) {
+			// Only the PDU position is checked, as other streams may go backwards.
+			hook.Reset()
+			ahead := since
+			ahead.SendToDevicePosition += 1000
+			syncWithSince(t, ahead)
+			if wasReset() {
+				t.Fatalf("expected the token not to be reset")
+			}
+		})
+
+		t.Run("token from before purged events returns full state", func(t *testing.T) {
+			// Purge the room's history up to the since token.
+			db, _, err := base.DatabaseConnection(&base.Cfg.SyncAPI.Database, sqlutil.NewExclusiveWriter())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = db.Exec("DELETE FROM syncapi_output_room_events WHERE room_id = $1 AND id <= $2", room.ID, since.PDUPosition); err != nil {
+				t.Fatalf("failed to purge events: %v", err)
+			}
+			hook.Reset()
+			body := syncWithSince(t, since)
+			if !wasReset() {
+				t.Fatalf("expected the token to be reset")
+			}
+			assertFullState(t, body)
+		})
+
+		t.Run("disabled", func(t *testing.T) {
+			base.Cfg.SyncAPI.ResetInvalidSinceTokens = false
+			defer func() { base.Cfg.SyncAPI.ResetInvalidSinceTokens = true }()
+			hook.Reset()
+			ahead := since
+			ahead.PDUPosition += 1000
+			syncWithSince(t, ahead)
+			if wasReset() {
+				t.Fatalf("expected the token not to be reset when disabled")
+			}
+		})
+	})
+}
+
+func TestSendToDevice(t *testing.T) {
+	test.WithAllDatabases(t, testSendToDevice)
+}
+
+func testSendToDevice(t *testing.T, dbType test.DBType) {
+	user := test.NewUser(t)
+	alice := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      user.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+	defer baseClose()
+
+	jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+	defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+	AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{}, &syncKeyAPI{}, nil)
+
+	producer := producers.SyncAPIProducer{
+		TopicSendToDeviceEvent: base.Cfg.Global.JetStream.Prefixed(jetstream.OutputSendToDeviceEvent),
+		JetStream:              jsctx,
+	}
+
+	msgCounter := 0
+
+	testCases := []struct {
+		name              string
+		since             string
+		want              []string
+		sendMessagesCount int
+	}{
+		{
+			name: "initial sync, no messages",
+			want: []string{},
+		},
+		{
+			name:              "initial sync, one new message",
+			sendMessagesCount: 1,
+			want: []string{
+				"message 1",
+			},
+		},
+		{
+			name:              "initial sync, two new messages", // we didn't advance the since token, so we'll receive two messages
+			sendMessagesCount: 1,
+			want: []string{
+				"message 1",
+				"message 2",
+			},
+		},
+		{
+			name:  "incremental sync, one message", // this deletes message 1, as we advanced the since token
+			since: types.StreamingToken{SendToDevicePosition: 1}.String(),
+			want: []string{
+				"message 2",
+			},
+		},
+		{
+			name:  "failed incremental sync, one message", // didn't advance since, so still the same message
+			since: types.StreamingToken{SendToDevicePosition: 1}.String(),
+			want: []string{
+				"message 2",
+			},
+		},
+		{
+			name:  "incremental sync, no message",                         // this should delete message 2
+			since: types.StreamingToken{SendToDevicePosition: 2}.String(), // next_batch from previous sync
+			want:  []string{},
+		},
+		{
+			name:              "incremental sync, three new messages",
+			since:             types.StreamingToken{SendToDevicePosition: 2}.String(),
+			sendMessagesCount: 3,
+			want: []string{
+				"message 3", // message 2 was deleted in the previous test
+				"message 4",
+				"message 5",
+			},
+		},
+		{
+			name: "initial sync, three messages", // we expect three messages, as we didn't go beyond "2"
+			want: []string{
+				"message 3",
+				"message 4",
+				"message 5",
+			},
+		},
+		{
+			name:  "incremental sync, no messages", // advance the sync token, no new messages
+			since: types.StreamingToken{SendToDevicePosition: 5}.String(),
+			want:  []string{},
+		},
+	}
+
+	ctx := context.Background()
+	for _, tc := range testCases {
+		// Send to-device messages of type "m.dendrite.test" with content `{"dummy":"message $counter"}`
+		for i := 0; i < tc.sendMessagesCount; i++ {
+			msgCounter++
+			msg := json.RawMessage(fmt.Sprintf(`{"dummy":"message %d"}`, msgCounter))
+			if err := producer.SendToDevice(ctx, user.ID, user.ID, alice.ID, "m.dendrite.test", msg); err != nil {
+				t.Fatalf("unable to send to device message: %v", err)
+			}
+		}
+
+		syncUntil(t, base, alice.AccessToken,
+			len(tc.want) == 0,
+			func(body string) bool {
+				return gjson.Get(body, fmt.Sprintf(`to_device.events.#(content.dummy=="message %d")`, msgCounter)).Exists()
+			},
+		)
+
+		// Execute a /sync request, recording the response
+		w := httptest.NewRecorder()
+		base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+			"access_token": alice.AccessToken,
+			"since":        tc.since,
+		})))
+
+		// Extract the to_device.events, # gets all values of an array, in this case a string slice with "message $counter" entries
+		events := gjson.Get(w.Body.String(), "to_device.events.#.content.dummy").Array()
+		got := make([]string, len(events))
+		for i := range events {
+			got[i] = events[i].String()
+		}
+
+		// Ensure the messages we received are as we expect them to be
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Logf("[%s|since=%s]: Sync: %s", tc.name, tc.since, w.Body.String())
+			t.Fatalf("[%s|since=%s]: got: %+v, want: %+v", tc.name, tc.since, got, tc.want)
+		}
+	}
+}
+
+func syncUntil(t *testing.T,
+	base *base.BaseDendrite, accessToken string,
+	skip bool,
+	checkFunc func(syncBody string) bool,
+) {
 	if checkFunc == nil {
 		t.Fatalf("No checkFunc defined")
 	}
@@ -959,3 +2007,305 @@ func toNATSMsgs(t *testing.T, base *base.BaseDendrite, input ...*gomatrixserverl
 	}
 	return result
 }
+
+func TestSyncOneTimeKeyCounts(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+
+		jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev}}, rsAPI, keyAPI, nil)
+
+		var since string
+		wantCount := func(want int) {
+			t.Helper()
+			params := map[string]string{
+				"access_token": aliceDev.AccessToken,
+				"timeout":      "0",
+			}
+			if since != "" {
+				params["since"] = since
+			}
+			w := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(params)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			since = gjson.GetBytes(w.Body.Bytes(), "next_batch").Str
+			count := gjson.GetBytes(w.Body.Bytes(), "device_one_time_keys_count.signed_curve25519")
+			if !count.Exists() || int(count.Int()) != want {
+				t.Fatalf("expected %d one-time keys, got %s", want, w.Body.String())
+			}
+		}
+
+		// The count is reported even before any keys have been uploaded.
+		wantCount(0)
+
+		uploadRes := &keyapi.PerformUploadKeysResponse{}
+		if err := keyAPI.PerformUploadKeys(context.Background(), &keyapi.PerformUploadKeysRequest{
+			UserID:   alice.ID,
+			DeviceID: aliceDev.ID,
+			OneTimeKeys: []keyapi.OneTimeKeys{{
+				UserID:   alice.ID,
+				DeviceID: aliceDev.ID,
+				KeyJSON: map[string]json.RawMessage{
+					"signed_curve25519:AAAAAQ": json.RawMessage(`{"key":"a"}`),
+					"signed_curve25519:AAAAAg": json.RawMessage(`{"key":"b"}`),
+				},
+			}},
+		}, uploadRes); err != nil || uploadRes.Error != nil {
+			t.Fatalf("failed to upload keys: %v %v", err, uploadRes.Error)
+		}
+		wantCount(2)
+
+		claimRes := &keyapi.PerformClaimKeysResponse{}
+		if err := keyAPI.PerformClaimKeys(context.Background(), &keyapi.PerformClaimKeysRequest{
+			OneTimeKeys: map[string]map[string]string{
+				alice.ID: {aliceDev.ID: "signed_curve25519"},
+			},
+		}, claimRes); err != nil || claimRes.Error != nil {
+			t.Fatalf("failed to claim keys: %v %v", err, claimRes.Error)
+		}
+		wantCount(1)
+	})
+}
+
+type syncFederationAPI struct {
+	events  map[string]*gomatrixserverlib.HeaderedEvent
+	keyRing *gomatrixserverlib.KeyRing
+}
+
+func (f *syncFederationAPI) KeyRing() *gomatrixserverlib.KeyRing {
+	return f.keyRing
+}
+
+func (f *syncFederationAPI) QueryJoinedHostServerNamesInRoom(ctx context.Context, req *federationAPI.QueryJoinedHostServerNamesInRoomRequest, res *federationAPI.QueryJoinedHostServerNamesInRoomResponse) error {
+	res.ServerNames = []gomatrixserverlib.ServerName{"remote"}
+	return nil
+}
+
+func (f *syncFederationAPI) GetEvent(ctx context.Context, origin, s gomatrixserverlib.ServerName, eventID string) (gomatrixserverlib.Transaction, error) {
+	ev, ok := f.events[eventID]
+	if !ok {
+		return gomatrixserverlib.Transaction{}, fmt.Errorf("unknown event %s", eventID)
+	}
+	return gomatrixserverlib.Transaction{PDUs: []json.RawMessage{ev.JSON()}}, nil
+}
+
+// syncKeyDatabase knows the signing key of the "remote" server only.
+type syncKeyDatabase struct{}
+
+func (d syncKeyDatabase) FetcherName() string {
+	return "syncKeyDatabase"
+}
+
+func (d syncKeyDatabase) FetchKeys(ctx context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	for req := range requests {
+		if req.ServerName != "remote" || req.KeyID != "ed25519:remote" {
+			continue
+		}
+		results[req] = gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: gomatrixserverlib.Base64Bytes(test.PrivateKeyA.Public().(ed25519.PublicKey)),
+			},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Hour)),
+		}
+	}
+	return results, nil
+}
+
+func (d syncKeyDatabase) StoreKeys(ctx context.Context, results map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult) error {
+	return nil
+}
+
+func TestGetEventOverFederation(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+	charlie := test.NewUser(t)
+	charlieDev := userapi.Device{
+		ID:          "CHARLIEID",
+		UserID:      charlie.ID,
+		AccessToken: "notjoinedtoanyrooms",
+	}
+	bob := test.NewUser(t, test.WithSigningServer("remote", "ed25519:remote", test.PrivateKeyA))
+	// eve's server's key isn't known, so her events can't be verified.
+	eve := test.NewUser(t, test.WithSigningServer("evil", "ed25519:evil", test.PrivateKeyB))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+
+		jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		fsAPI := &syncFederationAPI{
+			events:  map[string]*gomatrixserverlib.HeaderedEvent{},
+			keyRing: &gomatrixserverlib.KeyRing{KeyDatabase: syncKeyDatabase{}},
+		}
+		base.Cfg.ClientAPI.RateLimiting.Enabled = false
+		AddPublicRoutes(base, &syncUserAPI{accounts: []userapi.Device{aliceDev, charlieDev}}, rsAPI, &syncKeyAPI{}, fsAPI)
+
+		room := test.NewRoom(t, alice)
+		for _, user := range []*test.User{bob, eve} {
+			room.CreateAndInsert(t, user, gomatrixserverlib.MRoomMember, map[string]interface{}{
+				"membership": "join",
+			}, test.WithStateKey(user.ID))
+		}
+
+		// These events are only known to the remote server, but follow
+		// events which we have.
+		missing := room.CreateEvent(t, bob, "m.room.message", map[string]interface{}{"body": "hello"})
+		unverifiable := room.CreateEvent(t, eve, "m.room.message", map[string]interface{}{"body": "hello"})
+		otherRoom := test.NewRoom(t, bob)
+		wrongRoom := otherRoom.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "hello"})
+		// The history visibility is taken from the state before the event
+		// rather than the current state.
+		room.CreateAndInsert(t, alice, gomatrixserverlib.MRoomHistoryVisibility, map[string]interface{}{
+			"history_visibility": gomatrixserverlib.HistoryVisibilityJoined,
+		}, test.WithStateKey(""))
+		hidden := room.CreateEvent(t, bob, "m.room.message", map[string]interface{}{"body": "hello"})
+		room.CreateAndInsert(t, alice, gomatrixserverlib.MRoomHistoryVisibility, map[string]interface{}{
+			"history_visibility": gomatrixserverlib.HistoryVisibilityShared,
+		}, test.WithStateKey(""))
+		if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+			t.Fatalf("failed to send events: %v", err)
+		}
+		syncUntil(t, base, aliceDev.AccessToken, false, func(syncBody string) bool {
+			path := fmt.Sprintf(`rooms.join.%s.timeline.events.#(event_id=="%s")`, room.ID, room.Events()[len(room.Events())-1].EventID())
+			return gjson.Get(syncBody, path).Exists()
+		})
+
+		// The state before this event is unknown, as we don't have the event
+		// before it either.
+		room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "hello"})
+		afterGap := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "hello"})
+		for _, ev := range []*gomatrixserverlib.HeaderedEvent{missing, unverifiable, wrongRoom, hidden, afterGap} {
+			fsAPI.events[ev.EventID()] = ev
+		}
+
+		testCases := []struct {
+			name        string
+			fetchRemote bool
+			accessToken string
+			eventID     string
+			wantCode    int
+		}{
+			{name: "missing event isn't fetched if disabled", accessToken: aliceDev.AccessToken, eventID: missing.EventID(), wantCode: http.StatusNotFound},
+			{name: "missing event is fetched over federation", fetchRemote: true, accessToken: aliceDev.AccessToken, eventID: missing.EventID(), wantCode: http.StatusOK},
+			{name: "missing event isn't fetched for non-members", fetchRemote: true, accessToken: charlieDev.AccessToken, eventID: missing.EventID(), wantCode: http.StatusNotFound},
+			{name: "event with unverifiable signatures is refused", fetchRemote: true, accessToken: aliceDev.AccessToken, eventID: unverifiable.EventID(), wantCode: http.StatusNotFound},
+			{name: "event from another room is refused", fetchRemote: true, accessToken: aliceDev.AccessToken, eventID: wrongRoom.EventID(), wantCode: http.StatusNotFound},
+			{name: "event which wasn't visible when it was sent is refused", fetchRemote: true, accessToken: aliceDev.AccessToken, eventID: hidden.EventID(), wantCode: http.StatusNotFound},
+			{name: "event after unknown events is refused", fetchRemote: true, accessToken: aliceDev.AccessToken, eventID: afterGap.EventID(), wantCode: http.StatusNotFound},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				base.Cfg.SyncAPI.FetchMissingEventsOverFederation = tc.fetchRemote
+				w := httptest.NewRecorder()
+				base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", fmt.Sprintf("/_matrix/client/v3/rooms/%s/event/%s", room.ID, tc.eventID), test.WithQueryParams(map[string]string{
+					"access_token": tc.accessToken,
+				})))
+				if w.Code != tc.wantCode {
+					t.Fatalf("got HTTP %d want %d: %s", w.Code, tc.wantCode, w.Body.String())
+				}
+				if tc.wantCode == http.StatusOK && gjson.GetBytes(w.Body.Bytes(), "event_id").Str != tc.eventID {
+					t.Fatalf("expected event %s, got %s", tc.eventID, w.Body.String())
+				}
+			})
+		}
+	})
+}
+
+func TestPutFilterStorageQuota(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceDev := userapi.Device{
+		ID:          "ALICEID",
+		UserID:      alice.ID,
+		AccessToken: "ALICE_BEARER_TOKEN",
+		DisplayName: "Alice",
+		AccountType: userapi.AccountTypeUser,
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, close := testrig.CreateBaseDendrite(t, dbType)
+		defer close()
+
+		jsctx, _ := base.NATS.Prepare(base.ProcessContext, &base.Cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &base.Cfg.Global.JetStream)
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+		userAPI := &syncUserAPI{accounts: []userapi.Device{aliceDev}}
+		AddPublicRoutes(base, userAPI, rsAPI, &syncKeyAPI{}, nil)
+
+		putFilter := func(t *testing.T, limit int) *httptest.ResponseRecorder {
+			t.Helper()
+			w := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "POST", "/_matrix/client/v3/user/"+alice.ID+"/filter",
+				test.WithQueryParams(map[string]string{"access_token": aliceDev.AccessToken}),
+				test.WithJSONBody(t, map[string]interface{}{"room": map[string]interface{}{"timeline": map[string]interface{}{"limit": limit}}}),
+			))
+			return w
+		}
+
+		// The size of new filters is reported to the user API before they are
+		// stored, so that it can enforce the user's storage quota.
+		if w := putFilter(t, 10); w.Code != http.StatusOK {
+			t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		if userAPI.filterUsage <= 0 {
+			t.Fatalf("expected the filter usage to be reported, got %d", userAPI.filterUsage)
+		}
+		userAPI.filterQuota = userAPI.filterUsage
+
+		// Identical filters aren't stored twice, so they are still allowed.
+		if w := putFilter(t, 10); w.Code != http.StatusOK {
+			t.Fatalf("got HTTP %d want %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		w := putFilter(t, 20)
+		if w.Code != http.StatusRequestEntityTooLarge || gjson.Get(w.Body.String(), "errcode").Str != "M_TOO_LARGE" {
+			t.Fatalf("expected the filter to be rejected with M_TOO_LARGE, got HTTP %d: %s", w.Code, w.Body.String())
+		}
+
+		// Filters which were stored before the quota was enabled are reported
+		// by a background update.
+		syncDB, err := storage.NewSyncServerDatasource(base, &base.Cfg.SyncAPI.Database)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantUsage := userAPI.filterUsage
+		userAPI.filterUsage = 0
+		if _, done, err := filterUsageUpdate(syncDB, userAPI, base.Cfg.Global.ServerName).Batch(context.Background()); err != nil || !done {
+			t.Fatalf("expected the update to be done, got done %v error %v", done, err)
+		}
+		if userAPI.filterUsage != wantUsage {
+			t.Fatalf("expected the filter usage %d to be reported, got %d", wantUsage, userAPI.filterUsage)
+		}
+	})
+}
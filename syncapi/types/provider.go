@@ -19,6 +19,9 @@ type SyncRequest struct {
 	Since         StreamingToken
 	Timeout       time.Duration
 	WantFullState bool
+	// Set if this complete sync continues one which was split over several
+	// responses.
+	RoomsContinuation *RoomsContinuation
 
 	// Updated by the PDU stream.
 	Rooms map[string]string
@@ -26,6 +29,9 @@ type SyncRequest struct {
 	MembershipChanges map[string]struct{}
 	// Updated by the PDU stream.
 	IgnoredUsers IgnoredUsers
+	// The position which the PDU stream reached in an incremental sync. Set
+	// after the PDU stream has run.
+	PDUPosition StreamPosition
 }
 
 func (r *SyncRequest) IsRoomPresent(roomID string) bool {
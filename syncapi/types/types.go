@@ -102,6 +102,9 @@ const (
 	SyncTokenTypeStream SyncTokenType = "s"
 	// SyncTokenTypeTopology represents a position in a room's topology.
 	SyncTokenTypeTopology SyncTokenType = "t"
+	// SyncTokenTypeRoomsContinuation represents the rooms returned so far by
+	// a complete sync which was split over several responses.
+	SyncTokenTypeRoomsContinuation SyncTokenType = "r"
 )
 
 type StreamingToken struct {
@@ -240,26 +243,16 @@ func (t TopologyToken) String() string {
 	return fmt.Sprintf("t%d_%d", t.Depth, t.PDUPosition)
 }
 
-// Decrement the topology token to one event earlier.
+// Decrement moves the topology token from the position of an event to the
+// position just before it. Paginating backwards returns the events with a
+// lower depth, or with the same depth and a stream position no higher than
+// the token's, so this keeps the depth and only steps back the stream
+// position: every earlier event, including any others at the same depth, is
+// still returned, but not the event itself.
 func (t *TopologyToken) Decrement() {
-	depth := t.Depth
-	pduPos := t.PDUPosition
-	if depth-1 <= 0 {
-		// nothing can be lower than this
-		depth = 1
-	} else {
-		// this assumes that we will never have 1000 events all with the same
-		// depth. TODO: work out what the right PDU position is to use, probably needs a db hit.
-		depth--
-		pduPos += 1000
-	}
-	// The lowest token value is 1, therefore we need to manually set it to that
-	// value if we're below it.
-	if depth < 1 {
-		depth = 1
-	}
-	t.Depth = depth
-	t.PDUPosition = pduPos
+	if t.PDUPosition > 0 {
+		t.PDUPosition--
+	}
 }
 
 func NewTopologyTokenFromString(tok string) (token TopologyToken, err error) {
@@ -331,6 +324,44 @@ func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 	return token, nil
 }
 
+// RoomsContinuation is returned by a complete sync which was capped to a
+// maximum number of joined rooms. Passing it back to /sync, again without a
+// since token, returns the next rooms as of the same PDU stream position, so
+// that an incremental sync from the last response doesn't miss any events in
+// the rooms returned by the earlier ones. Rooms are returned in order of ID.
+type RoomsContinuation struct {
+	PDUPosition StreamPosition
+	// The ID of the last room returned so far.
+	AfterRoomID string
+}
+
+// This will be used as a fallback by json.Marshal.
+func (c RoomsContinuation) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c RoomsContinuation) String() string {
+	return fmt.Sprintf("%s%d_%s", SyncTokenTypeRoomsContinuation, c.PDUPosition, c.AfterRoomID)
+}
+
+func NewRoomsContinuationFromString(tok string) (RoomsContinuation, error) {
+	if len(tok) < 1 || tok[0] != SyncTokenTypeRoomsContinuation[0] {
+		return RoomsContinuation{}, ErrMalformedSyncToken
+	}
+	parts := strings.SplitN(tok[1:], "_", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return RoomsContinuation{}, ErrMalformedSyncToken
+	}
+	pos, err := strconv.Atoi(parts[0])
+	if err != nil || pos < 0 {
+		return RoomsContinuation{}, ErrMalformedSyncToken
+	}
+	return RoomsContinuation{
+		PDUPosition: StreamPosition(pos),
+		AfterRoomID: parts[1],
+	}, nil
+}
+
 // PrevEventRef represents a reference to a previous event in a state event upgrade
 type PrevEventRef struct {
 	PrevContent   json.RawMessage `json:"prev_content"`
@@ -363,6 +394,8 @@ type Response struct {
 	ToDevice            *ToDeviceResponse `json:"to_device,omitempty"`
 	DeviceLists         *DeviceLists      `json:"device_lists,omitempty"`
 	DeviceListsOTKCount map[string]int    `json:"device_one_time_keys_count,omitempty"`
+	// Set if a complete sync has more joined rooms than were returned.
+	RoomsContinuation *RoomsContinuation `json:"org.matrix.dendrite.rooms_continuation,omitempty"`
 }
 
 func (r Response) MarshalJSON() ([]byte, error) {
@@ -43,6 +43,16 @@ func TestSyncTokens(t *testing.T) {
 			t.Errorf("NewTopologyTokenFromString %q should have failed", f)
 		}
 	}
+
+	for _, f := range append(shouldFail, "r1_", "r-1_!room:test", "s1_!room:test") {
+		if _, err := NewRoomsContinuationFromString(f); err == nil {
+			t.Errorf("NewRoomsContinuationFromString %q should have failed", f)
+		}
+	}
+	continuation := RoomsContinuation{PDUPosition: 3, AfterRoomID: "!room_1:test"}
+	if got, err := NewRoomsContinuationFromString(continuation.String()); err != nil || got != continuation {
+		t.Errorf("expected %+v to round-trip, got %+v (%v)", continuation, got, err)
+	}
 }
 
 func TestNewInviteResponse(t *testing.T) {
@@ -70,6 +70,10 @@ type SyncUserAPI interface {
 	QueryAccountData(ctx context.Context, req *QueryAccountDataRequest, res *QueryAccountDataResponse) error
 	PerformLastSeenUpdate(ctx context.Context, req *PerformLastSeenUpdateRequest, res *PerformLastSeenUpdateResponse) error
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
+	// PerformFilterUsageUpdate records the size of a user's sync filters, e.g.
+	// before a new one is stored, returning an ErrorStorageQuotaExceeded if the
+	// new filter would take the user over their storage quota.
+	PerformFilterUsageUpdate(ctx context.Context, req *PerformFilterUsageUpdateRequest, res *PerformFilterUsageUpdateResponse) error
 	QueryDevices(ctx context.Context, req *QueryDevicesRequest, res *QueryDevicesResponse) error
 	QueryDeviceInfos(ctx context.Context, req *QueryDeviceInfosRequest, res *QueryDeviceInfosResponse) error
 }
@@ -108,6 +112,11 @@ type ClientUserAPI interface {
 	QueryLocalpartForThreePID(ctx context.Context, req *QueryLocalpartForThreePIDRequest, res *QueryLocalpartForThreePIDResponse) error
 	PerformForgetThreePID(ctx context.Context, req *PerformForgetThreePIDRequest, res *struct{}) error
 	PerformSaveThreePIDAssociation(ctx context.Context, req *PerformSaveThreePIDAssociationRequest, res *struct{}) error
+
+	QueryAcceptedTerms(ctx context.Context, req *QueryAcceptedTermsRequest, res *QueryAcceptedTermsResponse) error
+	PerformTermsAcceptance(ctx context.Context, req *PerformTermsAcceptanceRequest, res *struct{}) error
+
+	QueryLocalparts(ctx context.Context, req *QueryLocalpartsRequest, res *QueryLocalpartsResponse) error
 }
 
 // custom api functions required by pinecone / p2p demos
@@ -235,6 +244,8 @@ type PerformDeviceDeletionRequest struct {
 }
 
 type PerformDeviceDeletionResponse struct {
+	// The devices which were deleted. Only set when DeviceIDs is empty.
+	Devices []Device
 }
 
 // QueryDeviceInfosRequest is the request to QueryDeviceInfos
@@ -361,6 +372,19 @@ type PerformLastSeenUpdateRequest struct {
 type PerformLastSeenUpdateResponse struct {
 }
 
+// PerformFilterUsageUpdateRequest is the request for PerformFilterUsageUpdate.
+type PerformFilterUsageUpdateRequest struct {
+	UserID string
+	// The total size in bytes of the user's stored sync filters.
+	Size int64
+	// The size in bytes of a new filter which is about to be stored, or 0.
+	Added int64
+}
+
+// PerformFilterUsageUpdateResponse is the response for PerformFilterUsageUpdate.
+type PerformFilterUsageUpdateResponse struct {
+}
+
 // PerformDeviceCreationRequest is the request for PerformDeviceCreation
 type PerformDeviceCreationRequest struct {
 	Localpart   string
@@ -379,6 +403,11 @@ type PerformDeviceCreationRequest struct {
 	// update for this account. Generally the only reason to do this is if the account
 	// is an appservice account.
 	NoDeviceListUpdate bool
+	// SSOProvider is the ID of the SSO identity provider the device logged
+	// in with, or empty if it didn't log in with SSO.
+	SSOProvider string
+	// SSOIDToken is the ID token issued by the SSO identity provider, if any.
+	SSOIDToken string
 }
 
 // PerformDeviceCreationResponse is the response for PerformDeviceCreation
@@ -438,6 +467,11 @@ type Device struct {
 	// this is the appservice ID.
 	AppserviceID string
 	AccountType  AccountType
+	// If the device logged in with SSO, this is the ID of the identity
+	// provider and the ID token it issued. Only set when looked up by
+	// access token or when listing all of a user's devices.
+	SSOProvider string
+	SSOIDToken  string
 }
 
 func (d *Device) UserDomain() gomatrixserverlib.ServerName {
@@ -498,6 +532,16 @@ func (e *ErrorConflict) Error() string {
 	return "Conflict: " + e.Message
 }
 
+// ErrorStorageQuotaExceeded is an error indicating that a write was rejected
+// because it would take the user over their storage quota.
+type ErrorStorageQuotaExceeded struct {
+	Message string
+}
+
+func (e *ErrorStorageQuotaExceeded) Error() string {
+	return "Storage quota exceeded: " + e.Message
+}
+
 // Conflict is an enum representing what to do when encountering conflicting when creating profiles/devices
 type Conflict int
 
@@ -667,11 +711,41 @@ type QueryThreePIDsForLocalpartResponse struct {
 
 type PerformForgetThreePIDRequest QueryLocalpartForThreePIDRequest
 
+type QueryAcceptedTermsRequest struct {
+	Localpart  string
+	ServerName gomatrixserverlib.ServerName
+}
+
+type QueryAcceptedTermsResponse struct {
+	// The accepted version of each policy, keyed by policy ID
+	Policies map[string]string
+}
+
+// QueryLocalpartsRequest is a request to list the active accounts of users on
+// a server name, excluding guests and application services.
+type QueryLocalpartsRequest struct {
+	ServerName gomatrixserverlib.ServerName
+}
+
+type QueryLocalpartsResponse struct {
+	Localparts []string
+}
+
+type PerformTermsAcceptanceRequest struct {
+	Localpart  string
+	ServerName gomatrixserverlib.ServerName
+	// The accepted version of each policy, keyed by policy ID
+	Policies map[string]string
+}
+
 type PerformSaveThreePIDAssociationRequest struct {
 	ThreePID   string
 	Localpart  string
 	ServerName gomatrixserverlib.ServerName
 	Medium     string
+	// When the identity server validated the 3PID, in milliseconds since
+	// the epoch. If 0, the time the association is saved is used instead.
+	ValidatedAt int64
 }
 
 type QueryAccountByLocalpartRequest struct {
@@ -44,6 +44,12 @@ type LoginTokenInternalAPI interface {
 type LoginTokenData struct {
 	// UserID is the full mxid of the user.
 	UserID string
+	// SSOProvider is the ID of the SSO identity provider the user logged
+	// in with, if the token was created by an SSO login.
+	SSOProvider string
+	// SSOIDToken is the OpenID Connect ID token issued by the identity
+	// provider, used to end the session there when the user logs out.
+	SSOIDToken string
 }
 
 // LoginTokenMetadata contains metadata created and maintained by the User API.
@@ -59,6 +59,11 @@ func (t *UserInternalAPITrace) PerformLastSeenUpdate(ctx context.Context, req *P
 	util.GetLogger(ctx).Infof("PerformLastSeenUpdate req=%+v res=%+v", js(req), js(res))
 	return err
 }
+func (t *UserInternalAPITrace) PerformFilterUsageUpdate(ctx context.Context, req *PerformFilterUsageUpdateRequest, res *PerformFilterUsageUpdateResponse) error {
+	err := t.Impl.PerformFilterUsageUpdate(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformFilterUsageUpdate req=%+v res=%+v", js(req), js(res))
+	return err
+}
 func (t *UserInternalAPITrace) PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error {
 	err := t.Impl.PerformDeviceUpdate(ctx, req, res)
 	util.GetLogger(ctx).Infof("PerformDeviceUpdate req=%+v res=%+v", js(req), js(res))
@@ -204,6 +209,24 @@ func (t *UserInternalAPITrace) PerformSaveThreePIDAssociation(ctx context.Contex
 	return err
 }
 
+func (t *UserInternalAPITrace) QueryAcceptedTerms(ctx context.Context, req *QueryAcceptedTermsRequest, res *QueryAcceptedTermsResponse) error {
+	err := t.Impl.QueryAcceptedTerms(ctx, req, res)
+	util.GetLogger(ctx).Infof("QueryAcceptedTerms req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) PerformTermsAcceptance(ctx context.Context, req *PerformTermsAcceptanceRequest, res *struct{}) error {
+	err := t.Impl.PerformTermsAcceptance(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformTermsAcceptance req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *UserInternalAPITrace) QueryLocalparts(ctx context.Context, req *QueryLocalpartsRequest, res *QueryLocalpartsResponse) error {
+	err := t.Impl.QueryLocalparts(ctx, req, res)
+	util.GetLogger(ctx).Infof("QueryLocalparts req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *UserInternalAPITrace) QueryAccountByLocalpart(ctx context.Context, req *QueryAccountByLocalpartRequest, res *QueryAccountByLocalpartResponse) error {
 	err := t.Impl.QueryAccountByLocalpart(ctx, req, res)
 	util.GetLogger(ctx).Infof("QueryAccountByLocalpart req=%+v res=%+v", js(req), js(res))
@@ -683,6 +683,7 @@ func (rse *ruleSetEvalContext) HasPowerLevel(userID, levelKey string) (bool, err
 	req := &rsapi.QueryLatestEventsAndStateRequest{
 		RoomID: rse.roomID,
 		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomCreate},
 			{EventType: gomatrixserverlib.MRoomPowerLevels},
 		},
 	}
@@ -690,18 +691,20 @@ func (rse *ruleSetEvalContext) HasPowerLevel(userID, levelKey string) (bool, err
 	if err := rse.rsAPI.QueryLatestEventsAndState(rse.ctx, req, &res); err != nil {
 		return false, err
 	}
+	var create, powerLevels *gomatrixserverlib.Event
 	for _, ev := range res.StateEvents {
-		if ev.Type() != gomatrixserverlib.MRoomPowerLevels {
-			continue
-		}
-
-		plc, err := gomatrixserverlib.NewPowerLevelContentFromEvent(ev.Event)
-		if err != nil {
-			return false, err
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomCreate:
+			create = ev.Event
+		case gomatrixserverlib.MRoomPowerLevels:
+			powerLevels = ev.Event
 		}
-		return plc.UserLevel(userID) >= plc.NotificationLevel(levelKey), nil
 	}
-	return true, nil
+	plc, err := eventutil.PowerLevelsFromState(create, powerLevels)
+	if err != nil {
+		return false, err
+	}
+	return plc.UserLevel(userID) >= plc.NotificationLevel(levelKey), nil
 }
 
 // localPushDevices pushes to the configured devices of a local
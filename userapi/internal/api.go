@@ -20,7 +20,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/gomatrixserverlib"
@@ -55,6 +57,24 @@ type UserInternalAPI struct {
 	RSAPI       rsapi.UserRoomserverAPI
 	PgClient    pushgateway.Client
 	Cfg         *config.UserAPI
+	// LastSeen, if set, throttles device last-seen updates.
+	LastSeen *LastSeenUpdater
+	// accountDataMutexes serialise the account data updates of a user, so
+	// that they are sent to the sync API in the order in which they were
+	// saved, and so that storage quota checks of the user don't race with
+	// each other. Users are spread over a fixed number of mutexes, so that
+	// memory use doesn't grow with the number of users.
+	accountDataMutexes [accountDataMutexCount]sync.Mutex
+}
+
+const accountDataMutexCount = 256
+
+// accountDataMutex returns the mutex which serialises the account data
+// updates of the given user.
+func (a *UserInternalAPI) accountDataMutex(userID string) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(userID))
+	return &a.accountDataMutexes[h.Sum32()%accountDataMutexCount]
 }
 
 func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse) error {
@@ -68,6 +88,30 @@ func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAc
 	if req.DataType == "" {
 		return fmt.Errorf("data type must not be empty")
 	}
+	// Otherwise concurrent updates of the same type could reach the sync API
+	// in a different order than they were saved in, and e.g. leave it with a
+	// stale ignored users list.
+	mu := a.accountDataMutex(req.UserID)
+	mu.Lock()
+	defer mu.Unlock()
+	if quota := a.Config.StorageQuotaPerUser; quota > 0 {
+		existing, err := a.DB.GetAccountDataByType(ctx, local, domain, req.RoomID, req.DataType)
+		if err != nil {
+			return fmt.Errorf("a.DB.GetAccountDataByType: %w", err)
+		}
+		accountDataSize, filterSize, err := a.DB.GetStorageUsage(ctx, local, domain)
+		if err != nil {
+			return fmt.Errorf("a.DB.GetStorageUsage: %w", err)
+		}
+		// Writes which don't grow the account data are always allowed, so
+		// that users over their quota can still make room.
+		growth := int64(len(req.AccountData) - len(existing))
+		if growth > 0 && accountDataSize+filterSize+growth > quota {
+			return &api.ErrorStorageQuotaExceeded{
+				Message: fmt.Sprintf("account data and filters must not be larger than %d bytes in total", quota),
+			}
+		}
+	}
 	if err := a.DB.SaveAccountData(ctx, local, domain, req.RoomID, req.DataType, req.AccountData); err != nil {
 		util.GetLogger(ctx).WithError(err).Error("a.DB.SaveAccountData failed")
 		return fmt.Errorf("failed to save account data: %w", err)
@@ -134,15 +178,32 @@ func (a *UserInternalAPI) setFullyRead(ctx context.Context, req *api.InputAccoun
 func postRegisterJoinRooms(cfg *config.UserAPI, acc *api.Account, rsAPI rsapi.UserRoomserverAPI) {
 	// POST register behaviour: check if the user is a normal user.
 	// If the user is a normal user, add user to room specified in the configuration "auto_join_rooms".
+	// Local aliases which don't exist yet are created first if "auto_create_auto_join_rooms" is set,
+	// in which case the user creating the room is already joined to it.
 	if acc.AccountType != api.AccountTypeAppService && acc.AppServiceID == "" {
-		for room := range cfg.AutoJoinRooms {
-			userID := userutil.MakeUserID(acc.Localpart, cfg.Matrix.ServerName)
-			err := addUserToRoom(context.Background(), rsAPI, cfg.AutoJoinRooms[room], acc.Localpart, userID)
+		ctx := context.Background()
+		userID := userutil.MakeUserID(acc.Localpart, cfg.Matrix.ServerName)
+		for _, room := range cfg.AutoJoinRooms {
+			logger := logrus.WithFields(logrus.Fields{
+				"user_id": userID,
+				"room":    room,
+			})
+			create, err := autoJoinRoomToCreate(ctx, cfg, rsAPI, room)
 			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"user_id": userID,
-					"room":    cfg.AutoJoinRooms[room],
-				}).WithError(err).Errorf("user failed to auto-join room")
+				logger.WithError(err).Errorf("failed to check whether auto-join room exists")
+			}
+			if create {
+				created, err := createAutoJoinRoom(ctx, cfg, rsAPI, room, userID, acc.Localpart)
+				if err != nil {
+					logger.WithError(err).Errorf("failed to create auto-join room")
+					continue
+				}
+				if created {
+					continue
+				}
+			}
+			if err = addUserToRoom(ctx, rsAPI, room, acc.Localpart, userID); err != nil {
+				logger.WithError(err).Errorf("user failed to auto-join room")
 			}
 		}
 	}
@@ -257,7 +318,7 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 		"device_id":    req.DeviceID,
 		"display_name": req.DeviceDisplayName,
 	}).Info("PerformDeviceCreation")
-	dev, err := a.DB.CreateDevice(ctx, req.Localpart, serverName, req.DeviceID, req.AccessToken, req.DeviceDisplayName, req.IPAddr, req.UserAgent)
+	dev, err := a.DB.CreateDevice(ctx, req.Localpart, serverName, req.DeviceID, req.AccessToken, req.DeviceDisplayName, req.IPAddr, req.UserAgent, req.SSOProvider, req.SSOIDToken)
 	if err != nil {
 		return err
 	}
@@ -286,6 +347,7 @@ func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.Pe
 		for _, d := range devices {
 			deletedDeviceIDs = append(deletedDeviceIDs, d.ID)
 		}
+		res.Devices = devices
 	} else {
 		err = a.DB.RemoveDevices(ctx, local, domain, req.DeviceIDs)
 	}
@@ -296,7 +358,7 @@ func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.Pe
 	deleteReq := &keyapi.PerformDeleteKeysRequest{
 		UserID: req.UserID,
 	}
-	for _, keyID := range req.DeviceIDs {
+	for _, keyID := range deletedDeviceIDs {
 		deleteReq.KeyIDs = append(deleteReq.KeyIDs, gomatrixserverlib.KeyID(keyID))
 	}
 	deleteRes := &keyapi.PerformDeleteKeysResponse{}
@@ -306,8 +368,8 @@ func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.Pe
 	if err := deleteRes.Error; err != nil {
 		return fmt.Errorf("a.KeyAPI.PerformDeleteKeys: %w", err)
 	}
-	// create empty device keys and upload them to delete what was once there and trigger device list changes
-	return a.deviceListUpdate(req.UserID, deletedDeviceIDs)
+	// the keyserver sends the device list changes for the deleted devices
+	return nil
 }
 
 func (a *UserInternalAPI) deviceListUpdate(userID string, deviceIDs []string) error {
@@ -348,12 +410,49 @@ func (a *UserInternalAPI) PerformLastSeenUpdate(
 	if !a.Config.Matrix.IsLocalServerName(domain) {
 		return fmt.Errorf("server name %s is not local", domain)
 	}
-	if err := a.DB.UpdateDeviceLastSeen(ctx, localpart, domain, req.DeviceID, req.RemoteAddr, req.UserAgent); err != nil {
+	if a.LastSeen != nil {
+		return a.LastSeen.Update(ctx, localpart, domain, req.DeviceID, req.RemoteAddr, req.UserAgent)
+	}
+	if err := a.DB.UpdateDeviceLastSeen(ctx, localpart, domain, req.DeviceID, req.RemoteAddr, req.UserAgent, time.Now().UnixNano()/1000000); err != nil {
 		return fmt.Errorf("a.DeviceDB.UpdateDeviceLastSeen: %w", err)
 	}
 	return nil
 }
 
+func (a *UserInternalAPI) PerformFilterUsageUpdate(
+	ctx context.Context,
+	req *api.PerformFilterUsageUpdateRequest,
+	res *api.PerformFilterUsageUpdateResponse,
+) error {
+	localpart, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib.SplitID: %w", err)
+	}
+	if !a.Config.Matrix.IsLocalServerName(domain) {
+		return fmt.Errorf("server name %s is not local", domain)
+	}
+	mu := a.accountDataMutex(req.UserID)
+	mu.Lock()
+	defer mu.Unlock()
+	// Only new filters are checked against the quota, so that the sync API
+	// can always report the size of the filters which it has stored already.
+	if quota := a.Config.StorageQuotaPerUser; quota > 0 && req.Added > 0 {
+		accountDataSize, _, err := a.DB.GetStorageUsage(ctx, localpart, domain)
+		if err != nil {
+			return fmt.Errorf("a.DB.GetStorageUsage: %w", err)
+		}
+		if accountDataSize+req.Size+req.Added > quota {
+			return &api.ErrorStorageQuotaExceeded{
+				Message: fmt.Sprintf("account data and filters must not be larger than %d bytes in total", quota),
+			}
+		}
+	}
+	if err := a.DB.SetFilterUsage(ctx, localpart, domain, req.Size+req.Added); err != nil {
+		return fmt.Errorf("a.DB.SetFilterUsage: %w", err)
+	}
+	return nil
+}
+
 func (a *UserInternalAPI) PerformDeviceUpdate(ctx context.Context, req *api.PerformDeviceUpdateRequest, res *api.PerformDeviceUpdateResponse) error {
 	localpart, domain, err := gomatrixserverlib.SplitID('@', req.RequestingUserID)
 	if err != nil {
@@ -962,7 +1061,29 @@ func (a *UserInternalAPI) PerformForgetThreePID(ctx context.Context, req *api.Pe
 }
 
 func (a *UserInternalAPI) PerformSaveThreePIDAssociation(ctx context.Context, req *api.PerformSaveThreePIDAssociationRequest, res *struct{}) error {
-	return a.DB.SaveThreePIDAssociation(ctx, req.ThreePID, req.Localpart, req.ServerName, req.Medium)
+	return a.DB.SaveThreePIDAssociation(ctx, req.ThreePID, req.Localpart, req.ServerName, req.Medium, req.ValidatedAt)
+}
+
+func (a *UserInternalAPI) QueryAcceptedTerms(ctx context.Context, req *api.QueryAcceptedTermsRequest, res *api.QueryAcceptedTermsResponse) error {
+	policies, err := a.DB.GetAcceptedTerms(ctx, req.Localpart, req.ServerName)
+	if err != nil {
+		return err
+	}
+	res.Policies = policies
+	return nil
+}
+
+func (a *UserInternalAPI) QueryLocalparts(ctx context.Context, req *api.QueryLocalpartsRequest, res *api.QueryLocalpartsResponse) error {
+	localparts, err := a.DB.GetLocalparts(ctx, req.ServerName)
+	if err != nil {
+		return err
+	}
+	res.Localparts = localparts
+	return nil
+}
+
+func (a *UserInternalAPI) PerformTermsAcceptance(ctx context.Context, req *api.PerformTermsAcceptanceRequest, res *struct{}) error {
+	return a.DB.SaveTermsAcceptance(ctx, req.Localpart, req.ServerName, req.Policies)
 }
 
 const pushRulesAccountDataType = "m.push_rules"
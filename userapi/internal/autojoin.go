@@ -0,0 +1,166 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// autoJoinRoomToCreate returns whether the given auto-join room is a local
+// alias that doesn't exist yet and should therefore be created.
+func autoJoinRoomToCreate(
+	ctx context.Context, cfg *config.UserAPI, rsAPI rsapi.UserRoomserverAPI, room string,
+) (bool, error) {
+	if !cfg.AutoCreateAutoJoinRooms || len(room) == 0 || room[0] != '#' {
+		return false, nil
+	}
+	_, domain, err := gomatrixserverlib.SplitID('#', room)
+	if err != nil {
+		return false, err
+	}
+	if !cfg.Matrix.IsLocalServerName(domain) {
+		return false, nil
+	}
+	aliasRes := &rsapi.GetRoomIDForAliasResponse{}
+	if err = rsAPI.GetRoomIDForAlias(ctx, &rsapi.GetRoomIDForAliasRequest{
+		Alias:              room,
+		IncludeAppservices: true,
+	}, aliasRes); err != nil {
+		return false, err
+	}
+	return aliasRes.RoomID == "", nil
+}
+
+// createAutoJoinRoom creates a public room with the given local alias,
+// with the given user as its creator and only member. It returns false if
+// the alias was claimed by another room in the meantime, in which case the
+// user should join that room instead.
+func createAutoJoinRoom(
+	ctx context.Context, cfg *config.UserAPI, rsAPI rsapi.UserRoomserverAPI,
+	alias, userID, displayName string,
+) (bool, error) {
+	_, domain, err := gomatrixserverlib.SplitID('#', alias)
+	if err != nil {
+		return false, err
+	}
+	identity, err := cfg.Matrix.SigningIdentityFor(domain)
+	if err != nil {
+		return false, err
+	}
+	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), domain)
+	roomVersion := version.DefaultRoomVersion()
+
+	// The same events, in the same order, as a room created with the
+	// "public_chat" preset and a room alias.
+	eventsToMake := []struct {
+		eventType string
+		stateKey  string
+		content   interface{}
+	}{
+		{gomatrixserverlib.MRoomCreate, "", map[string]interface{}{
+			"creator":      userID,
+			"room_version": roomVersion,
+		}},
+		{gomatrixserverlib.MRoomMember, userID, gomatrixserverlib.MemberContent{
+			Membership:  gomatrixserverlib.Join,
+			DisplayName: displayName,
+		}},
+		{gomatrixserverlib.MRoomPowerLevels, "", eventutil.InitialPowerLevelsContent(userID)},
+		{gomatrixserverlib.MRoomJoinRules, "", gomatrixserverlib.JoinRuleContent{
+			JoinRule: gomatrixserverlib.Public,
+		}},
+		{gomatrixserverlib.MRoomHistoryVisibility, "", gomatrixserverlib.HistoryVisibilityContent{
+			HistoryVisibility: gomatrixserverlib.HistoryVisibilityShared,
+		}},
+		{gomatrixserverlib.MRoomCanonicalAlias, "", eventutil.CanonicalAlias{
+			Alias: alias,
+		}},
+	}
+
+	evTime := time.Now()
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	inputs := make([]rsapi.InputRoomEvent, 0, len(eventsToMake))
+	var prevEvent *gomatrixserverlib.Event
+	for i, e := range eventsToMake {
+		stateKey := e.stateKey
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   userID,
+			RoomID:   roomID,
+			Type:     e.eventType,
+			StateKey: &stateKey,
+			Depth:    int64(i + 1),
+		}
+		if err = builder.SetContent(e.content); err != nil {
+			return false, fmt.Errorf("builder.SetContent: %w", err)
+		}
+		if prevEvent != nil {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{prevEvent.EventReference()}
+		}
+		eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+		if err != nil {
+			return false, fmt.Errorf("gomatrixserverlib.StateNeededForEventBuilder: %w", err)
+		}
+		if builder.AuthEvents, err = eventsNeeded.AuthEventReferences(&authEvents); err != nil {
+			return false, fmt.Errorf("eventsNeeded.AuthEventReferences: %w", err)
+		}
+		ev, err := builder.Build(evTime, identity.ServerName, identity.KeyID, identity.PrivateKey, roomVersion)
+		if err != nil {
+			return false, fmt.Errorf("builder.Build: %w", err)
+		}
+		if err = gomatrixserverlib.Allowed(ev, &authEvents); err != nil {
+			return false, fmt.Errorf("gomatrixserverlib.Allowed: %w", err)
+		}
+		if err = authEvents.AddEvent(ev); err != nil {
+			return false, fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+		inputs = append(inputs, rsapi.InputRoomEvent{
+			Kind:         rsapi.KindNew,
+			Event:        ev.Headered(roomVersion),
+			Origin:       identity.ServerName,
+			SendAsServer: rsapi.DoNotSendToOtherServers,
+		})
+		prevEvent = ev
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"user_id": userID,
+		"room_id": roomID,
+		"alias":   alias,
+	}).Info("Creating auto-join room")
+	if err = rsapi.SendInputRoomEvents(ctx, rsAPI, identity.ServerName, inputs, false); err != nil {
+		return false, fmt.Errorf("rsapi.SendInputRoomEvents: %w", err)
+	}
+
+	aliasRes := &rsapi.SetRoomAliasResponse{}
+	if err = rsAPI.SetRoomAlias(ctx, &rsapi.SetRoomAliasRequest{
+		Alias:  alias,
+		RoomID: roomID,
+		UserID: userID,
+	}, aliasRes); err != nil {
+		return false, fmt.Errorf("rsAPI.SetRoomAlias: %w", err)
+	}
+	return !aliasRes.AliasExists, nil
+}
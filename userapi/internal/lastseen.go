@@ -0,0 +1,122 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matrix-org/dendrite/setup/process"
+)
+
+// LastSeenDatabase is the part of the user API database used to record when
+// devices were last seen.
+type LastSeenDatabase interface {
+	UpdateDeviceLastSeen(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, deviceID, ipAddr, userAgent string, lastSeenTs int64) error
+}
+
+type lastSeenDevice struct {
+	localpart  string
+	serverName gomatrixserverlib.ServerName
+	deviceID   string
+}
+
+type lastSeenUpdate struct {
+	ipAddr     string
+	userAgent  string
+	lastSeenTs int64
+}
+
+// LastSeenUpdater coalesces device last-seen updates and writes them to the
+// database in batches, so that each device is written at most once per
+// interval. Only the most recent IP address, user agent and time that a device
+// was seen are kept between writes.
+type LastSeenUpdater struct {
+	db       LastSeenDatabase
+	interval time.Duration
+	mu       sync.Mutex
+	pending  map[lastSeenDevice]lastSeenUpdate
+}
+
+// NewLastSeenUpdater creates a LastSeenUpdater. If the interval is 0, updates
+// are written to the database straight away.
+func NewLastSeenUpdater(db LastSeenDatabase, interval time.Duration) *LastSeenUpdater {
+	return &LastSeenUpdater{
+		db:       db,
+		interval: interval,
+		pending:  make(map[lastSeenDevice]lastSeenUpdate),
+	}
+}
+
+// Start flushes pending updates every interval until the process shuts down,
+// at which point any remaining updates are flushed.
+func (u *LastSeenUpdater) Start(process *process.ProcessContext) {
+	if u.interval == 0 {
+		return
+	}
+	process.ComponentStarted()
+	go func() {
+		defer process.ComponentFinished()
+		ticker := time.NewTicker(u.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				u.flush(process.Context())
+			case <-process.WaitForShutdown():
+				u.flush(context.Background())
+				return
+			}
+		}
+	}()
+}
+
+// Update records that a device has been seen.
+func (u *LastSeenUpdater) Update(
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
+	deviceID, ipAddr, userAgent string,
+) error {
+	lastSeenTs := time.Now().UnixNano() / 1000000
+	if u.interval == 0 {
+		return u.db.UpdateDeviceLastSeen(ctx, localpart, serverName, deviceID, ipAddr, userAgent, lastSeenTs)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.pending[lastSeenDevice{localpart, serverName, deviceID}] = lastSeenUpdate{ipAddr, userAgent, lastSeenTs}
+	return nil
+}
+
+// flush writes all pending updates to the database and returns how many
+// were written.
+func (u *LastSeenUpdater) flush(ctx context.Context) int {
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = make(map[lastSeenDevice]lastSeenUpdate, len(pending))
+	u.mu.Unlock()
+
+	written := 0
+	for device, update := range pending {
+		if err := u.db.UpdateDeviceLastSeen(ctx, device.localpart, device.serverName, device.deviceID, update.ipAddr, update.userAgent, update.lastSeenTs); err != nil {
+			logrus.WithError(err).WithField("device_id", device.deviceID).Error("Failed to update device last seen")
+			continue
+		}
+		written++
+	}
+	return written
+}
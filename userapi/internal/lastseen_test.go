@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type lastSeenWrite struct {
+	deviceID, ipAddr, userAgent string
+	lastSeenTs                  int64
+}
+
+type countingLastSeenDB struct {
+	mu     sync.Mutex
+	writes []lastSeenWrite
+}
+
+func (d *countingLastSeenDB) UpdateDeviceLastSeen(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, deviceID, ipAddr, userAgent string, lastSeenTs int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.writes = append(d.writes, lastSeenWrite{deviceID, ipAddr, userAgent, lastSeenTs})
+	return nil
+}
+
+func TestLastSeenUpdaterCoalesces(t *testing.T) {
+	ctx := context.Background()
+	db := &countingLastSeenDB{}
+	updater := NewLastSeenUpdater(db, time.Minute)
+
+	ips := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	for i := 0; i < 100; i++ {
+		if err := updater.Update(ctx, "alice", "test", "DEVICE", ips[i%len(ips)], "agent"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := updater.Update(ctx, "alice", "test", "OTHER", "10.0.0.9", "agent"); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.writes) != 0 {
+		t.Fatalf("expected no writes before the interval elapsed, got %d", len(db.writes))
+	}
+
+	// The time that the device was seen is written, not the time of the write.
+	seenBefore := time.Now().UnixNano() / 1000000
+	time.Sleep(5 * time.Millisecond)
+	if written := updater.flush(ctx); written != 2 {
+		t.Fatalf("expected 2 writes, got %d", written)
+	}
+	for _, w := range db.writes {
+		if w.deviceID == "DEVICE" && w.ipAddr != ips[99%len(ips)] {
+			t.Fatalf("expected the latest IP address to be written, got %q", w.ipAddr)
+		}
+		if w.lastSeenTs > seenBefore {
+			t.Fatalf("expected the time the device was seen to be written, got %d which is after %d", w.lastSeenTs, seenBefore)
+		}
+	}
+
+	if written := updater.flush(ctx); written != 0 {
+		t.Fatalf("expected nothing to be written without new updates, got %d", written)
+	}
+}
+
+func TestLastSeenUpdaterWithoutInterval(t *testing.T) {
+	db := &countingLastSeenDB{}
+	updater := NewLastSeenUpdater(db, 0)
+	for i := 0; i < 3; i++ {
+		if err := updater.Update(context.Background(), "alice", "test", "DEVICE", "10.0.0.1", "agent"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(db.writes) != 3 {
+		t.Fatalf("expected every update to be written, got %d", len(db.writes))
+	}
+}
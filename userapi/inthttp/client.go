@@ -33,6 +33,7 @@ const (
 	PerformDeviceDeletionPath          = "/userapi/performDeviceDeletion"
 	PerformLastSeenUpdatePath          = "/userapi/performLastSeenUpdate"
 	PerformDeviceUpdatePath            = "/userapi/performDeviceUpdate"
+	PerformFilterUsageUpdatePath       = "/userapi/performFilterUsageUpdate"
 	PerformAccountDeactivationPath     = "/userapi/performAccountDeactivation"
 	PerformOpenIDTokenCreationPath     = "/userapi/performOpenIDTokenCreation"
 	PerformKeyBackupPath               = "/userapi/performKeyBackup"
@@ -43,6 +44,7 @@ const (
 	PerformSetDisplayNamePath          = "/userapi/performSetDisplayName"
 	PerformForgetThreePIDPath          = "/userapi/performForgetThreePID"
 	PerformSaveThreePIDAssociationPath = "/userapi/performSaveThreePIDAssociation"
+	PerformTermsAcceptancePath         = "/userapi/performTermsAcceptance"
 
 	QueryKeyBackupPath             = "/userapi/queryKeyBackup"
 	QueryProfilePath               = "/userapi/queryProfile"
@@ -61,6 +63,8 @@ const (
 	QueryLocalpartForThreePIDPath  = "/userapi/queryLocalpartForThreePID"
 	QueryThreePIDsForLocalpartPath = "/userapi/queryThreePIDsForLocalpart"
 	QueryAccountByLocalpartPath    = "/userapi/queryAccountType"
+	QueryAcceptedTermsPath         = "/userapi/queryAcceptedTerms"
+	QueryLocalpartsPath            = "/userapi/queryLocalparts"
 )
 
 // NewUserAPIClient creates a UserInternalAPI implemented by talking to a HTTP POST API.
@@ -145,6 +149,17 @@ func (h *httpUserInternalAPI) PerformLastSeenUpdate(
 	)
 }
 
+func (h *httpUserInternalAPI) PerformFilterUsageUpdate(
+	ctx context.Context,
+	request *api.PerformFilterUsageUpdateRequest,
+	response *api.PerformFilterUsageUpdateResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformFilterUsageUpdate", h.apiURL+PerformFilterUsageUpdatePath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
 func (h *httpUserInternalAPI) PerformDeviceUpdate(
 	ctx context.Context,
 	request *api.PerformDeviceUpdateRequest,
@@ -442,6 +457,39 @@ func (h *httpUserInternalAPI) PerformSaveThreePIDAssociation(
 	)
 }
 
+func (h *httpUserInternalAPI) QueryAcceptedTerms(
+	ctx context.Context,
+	request *api.QueryAcceptedTermsRequest,
+	response *api.QueryAcceptedTermsResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"QueryAcceptedTerms", h.apiURL+QueryAcceptedTermsPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpUserInternalAPI) PerformTermsAcceptance(
+	ctx context.Context,
+	request *api.PerformTermsAcceptanceRequest,
+	response *struct{},
+) error {
+	return httputil.CallInternalRPCAPI(
+		"PerformTermsAcceptance", h.apiURL+PerformTermsAcceptancePath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
+func (h *httpUserInternalAPI) QueryLocalparts(
+	ctx context.Context,
+	request *api.QueryLocalpartsRequest,
+	response *api.QueryLocalpartsResponse,
+) error {
+	return httputil.CallInternalRPCAPI(
+		"QueryLocalparts", h.apiURL+QueryLocalpartsPath,
+		h.httpClient, ctx, request, response,
+	)
+}
+
 func (h *httpUserInternalAPI) QueryAccountByLocalpart(
 	ctx context.Context,
 	req *api.QueryAccountByLocalpartRequest,
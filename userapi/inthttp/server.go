@@ -46,6 +46,11 @@ func AddRoutes(internalAPIMux *mux.Router, s api.UserInternalAPI, enableMetrics
 		httputil.MakeInternalRPCAPI("UserAPIPerformLastSeenUpdate", enableMetrics, s.PerformLastSeenUpdate),
 	)
 
+	internalAPIMux.Handle(
+		PerformFilterUsageUpdatePath,
+		httputil.MakeInternalRPCAPI("UserAPIPerformFilterUsageUpdate", enableMetrics, s.PerformFilterUsageUpdate),
+	)
+
 	internalAPIMux.Handle(
 		PerformDeviceUpdatePath,
 		httputil.MakeInternalRPCAPI("UserAPIPerformDeviceUpdate", enableMetrics, s.PerformDeviceUpdate),
@@ -191,6 +196,21 @@ func AddRoutes(internalAPIMux *mux.Router, s api.UserInternalAPI, enableMetrics
 		httputil.MakeInternalRPCAPI("UserAPIPerformSaveThreePIDAssociation", enableMetrics, s.PerformSaveThreePIDAssociation),
 	)
 
+	internalAPIMux.Handle(
+		QueryAcceptedTermsPath,
+		httputil.MakeInternalRPCAPI("UserAPIQueryAcceptedTerms", enableMetrics, s.QueryAcceptedTerms),
+	)
+
+	internalAPIMux.Handle(
+		PerformTermsAcceptancePath,
+		httputil.MakeInternalRPCAPI("UserAPIPerformTermsAcceptance", enableMetrics, s.PerformTermsAcceptance),
+	)
+
+	internalAPIMux.Handle(
+		QueryLocalpartsPath,
+		httputil.MakeInternalRPCAPI("UserAPIQueryLocalparts", enableMetrics, s.QueryLocalparts),
+	)
+
 	internalAPIMux.Handle(
 		QueryAccountByLocalpartPath,
 		httputil.MakeInternalRPCAPI("AccountByLocalpart", enableMetrics, s.QueryAccountByLocalpart),
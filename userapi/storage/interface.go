@@ -44,6 +44,9 @@ type Account interface {
 	GetNewNumericLocalpart(ctx context.Context, serverName gomatrixserverlib.ServerName) (int64, error)
 	CheckAccountAvailability(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (bool, error)
 	GetAccountByLocalpart(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (*api.Account, error)
+	// GetLocalparts returns the localparts of the active accounts of users on
+	// the given server name, excluding guests and application services.
+	GetLocalparts(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]string, error)
 	DeactivateAccount(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (err error)
 	SetPassword(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, plaintextPassword string) error
 }
@@ -56,6 +59,12 @@ type AccountData interface {
 	// If no account data could be found, returns nil
 	// Returns an error if there was an issue with the retrieval
 	GetAccountDataByType(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, roomID, dataType string) (data json.RawMessage, err error)
+	// GetStorageUsage returns the total size in bytes of a user's account data
+	// and of their sync filters, which count towards their storage quota.
+	GetStorageUsage(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (accountDataSize, filterSize int64, err error)
+	// SetFilterUsage records the total size in bytes of a user's sync filters,
+	// which are stored by the sync API.
+	SetFilterUsage(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, size int64) error
 	QueryPushRules(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (*pushrules.AccountRuleSets, error)
 }
 
@@ -68,11 +77,12 @@ type Device interface {
 	// If there is already a device with the same device ID for this user, that access token will be revoked
 	// and replaced with the given accessToken. If the given accessToken is already in use for another device,
 	// an error will be returned.
-	// If no device ID is given one is generated.
+	// If no device ID is given one is generated. ssoProvider is the ID of the SSO identity provider
+	// the device logged in with, or empty if it didn't log in with SSO, and ssoIDToken is the ID token it issued.
 	// Returns the device on success.
-	CreateDevice(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, deviceID *string, accessToken string, displayName *string, ipAddr, userAgent string) (dev *api.Device, returnErr error)
+	CreateDevice(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, deviceID *string, accessToken string, displayName *string, ipAddr, userAgent, ssoProvider, ssoIDToken string) (dev *api.Device, returnErr error)
 	UpdateDevice(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, deviceID string, displayName *string) error
-	UpdateDeviceLastSeen(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, deviceID, ipAddr, userAgent string) error
+	UpdateDeviceLastSeen(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, deviceID, ipAddr, userAgent string, lastSeenTs int64) error
 	RemoveDevices(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, devices []string) error
 	// RemoveAllDevices deleted all devices for this user. Returns the devices deleted.
 	RemoveAllDevices(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, exceptDeviceID string) (devices []api.Device, err error)
@@ -119,8 +129,17 @@ type SSO interface {
 	GetLocalpartForSSO(ctx context.Context, namespace, iss, sub string) (string, error)
 }
 
+type Terms interface {
+	// SaveTermsAcceptance records that the user accepted the given versions of
+	// the given policies, as a map of policy ID to version.
+	SaveTermsAcceptance(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, policies map[string]string) error
+	// GetAcceptedTerms returns the versions of the policies the user has
+	// accepted, as a map of policy ID to version.
+	GetAcceptedTerms(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (map[string]string, error)
+}
+
 type ThreePID interface {
-	SaveThreePIDAssociation(ctx context.Context, threepid, localpart string, serverName gomatrixserverlib.ServerName, medium string) (err error)
+	SaveThreePIDAssociation(ctx context.Context, threepid, localpart string, serverName gomatrixserverlib.ServerName, medium string, validatedAt int64) (err error)
 	RemoveThreePIDAssociation(ctx context.Context, threepid string, medium string) (err error)
 	GetLocalpartForThreePID(ctx context.Context, threepid string, medium string) (localpart string, serverName gomatrixserverlib.ServerName, err error)
 	GetThreePIDsForLocalpart(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (threepids []authtypes.ThreePID, err error)
@@ -148,6 +167,7 @@ type Database interface {
 	Pusher
 	SSO
 	Statistics
+	Terms
 	ThreePID
 }
 
@@ -53,10 +53,14 @@ const selectAccountDataSQL = "" +
 const selectAccountDataByTypeSQL = "" +
 	"SELECT content FROM userapi_account_datas WHERE localpart = $1 AND server_name = $2 AND room_id = $3 AND type = $4"
 
+const selectAccountDataSizeSQL = "" +
+	"SELECT COALESCE(SUM(OCTET_LENGTH(content)), 0) FROM userapi_account_datas WHERE localpart = $1 AND server_name = $2"
+
 type accountDataStatements struct {
 	insertAccountDataStmt       *sql.Stmt
 	selectAccountDataStmt       *sql.Stmt
 	selectAccountDataByTypeStmt *sql.Stmt
+	selectAccountDataSizeStmt   *sql.Stmt
 }
 
 func NewPostgresAccountDataTable(db *sql.DB) (tables.AccountDataTable, error) {
@@ -69,6 +73,7 @@ func NewPostgresAccountDataTable(db *sql.DB) (tables.AccountDataTable, error) {
 		{&s.insertAccountDataStmt, insertAccountDataSQL},
 		{&s.selectAccountDataStmt, selectAccountDataSQL},
 		{&s.selectAccountDataByTypeStmt, selectAccountDataByTypeSQL},
+		{&s.selectAccountDataSizeStmt, selectAccountDataSizeSQL},
 	}.Prepare(db)
 }
 
@@ -137,3 +142,11 @@ func (s *accountDataStatements) SelectAccountDataByType(
 	data = json.RawMessage(bytes)
 	return
 }
+
+func (s *accountDataStatements) SelectAccountDataSize(
+	ctx context.Context,
+	localpart string, serverName gomatrixserverlib.ServerName,
+) (size int64, err error) {
+	err = s.selectAccountDataSizeStmt.QueryRowContext(ctx, localpart, serverName).Scan(&size)
+	return
+}
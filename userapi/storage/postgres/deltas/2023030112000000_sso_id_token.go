@@ -0,0 +1,39 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpDeviceSSOIDToken(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `ALTER TABLE userapi_devices ADD COLUMN IF NOT EXISTS sso_id_token TEXT NOT NULL DEFAULT '';`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownDeviceSSOIDToken(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `ALTER TABLE userapi_devices DROP COLUMN sso_id_token;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
+
+func UpLoginTokenSSOIDToken(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `ALTER TABLE userapi_login_tokens ADD COLUMN IF NOT EXISTS sso_id_token TEXT NOT NULL DEFAULT '';`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownLoginTokenSSOIDToken(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `ALTER TABLE userapi_login_tokens DROP COLUMN sso_id_token;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
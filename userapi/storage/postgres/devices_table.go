@@ -61,7 +61,11 @@ CREATE TABLE IF NOT EXISTS userapi_devices (
 	-- The last seen IP address of this device
 	ip TEXT,
 	-- User agent of this device
-	user_agent TEXT
+	user_agent TEXT,
+	-- The ID of the SSO identity provider the device logged in with, if any
+	sso_provider TEXT NOT NULL DEFAULT '',
+	-- The ID token the SSO identity provider issued, used to end the session there
+	sso_id_token TEXT NOT NULL DEFAULT ''
                                           
     -- TODO: device keys, device display names, token restrictions (if 3rd-party OAuth app)
 );
@@ -71,17 +75,17 @@ CREATE UNIQUE INDEX IF NOT EXISTS userapi_device_localpart_id_idx ON userapi_dev
 `
 
 const insertDeviceSQL = "" +
-	"INSERT INTO userapi_devices(device_id, localpart, server_name, access_token, created_ts, display_name, last_seen_ts, ip, user_agent) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)" +
+	"INSERT INTO userapi_devices(device_id, localpart, server_name, access_token, created_ts, display_name, last_seen_ts, ip, user_agent, sso_provider, sso_id_token) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)" +
 	" RETURNING session_id"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart, server_name FROM userapi_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, server_name, sso_provider, sso_id_token FROM userapi_devices WHERE access_token = $1"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name, last_seen_ts, ip FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id = $3"
 
 const selectDevicesByLocalpartSQL = "" +
-	"SELECT device_id, display_name, last_seen_ts, ip, user_agent FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id != $3 ORDER BY last_seen_ts DESC"
+	"SELECT device_id, display_name, last_seen_ts, ip, user_agent, sso_provider, sso_id_token FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id != $3 ORDER BY last_seen_ts DESC"
 
 const updateDeviceNameSQL = "" +
 	"UPDATE userapi_devices SET display_name = $1 WHERE localpart = $2 AND server_name = $3 AND device_id = $4"
@@ -128,6 +132,16 @@ func NewPostgresDevicesTable(db *sql.DB, serverName gomatrixserverlib.ServerName
 		Version: "userapi: add last_seen_ts",
 		Up:      deltas.UpLastSeenTSIP,
 	})
+	m.AddMigrations(sqlutil.Migration{
+		Version: "userapi: add device sso_provider",
+		Up:      deltas.UpDeviceSSOProvider,
+		Down:    deltas.DownDeviceSSOProvider,
+	})
+	m.AddMigrations(sqlutil.Migration{
+		Version: "userapi: add device sso_id_token",
+		Up:      deltas.UpDeviceSSOIDToken,
+		Down:    deltas.DownDeviceSSOIDToken,
+	})
 	err = m.Up(context.Background())
 	if err != nil {
 		return nil, err
@@ -152,12 +166,12 @@ func NewPostgresDevicesTable(db *sql.DB, serverName gomatrixserverlib.ServerName
 func (s *devicesStatements) InsertDevice(
 	ctx context.Context, txn *sql.Tx, id string,
 	localpart string, serverName gomatrixserverlib.ServerName,
-	accessToken string, displayName *string, ipAddr, userAgent string,
+	accessToken string, displayName *string, ipAddr, userAgent, ssoProvider, ssoIDToken string,
 ) (*api.Device, error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
 	var sessionID int64
 	stmt := sqlutil.TxStmt(txn, s.insertDeviceStmt)
-	if err := stmt.QueryRowContext(ctx, id, localpart, serverName, accessToken, createdTimeMS, displayName, createdTimeMS, ipAddr, userAgent).Scan(&sessionID); err != nil {
+	if err := stmt.QueryRowContext(ctx, id, localpart, serverName, accessToken, createdTimeMS, displayName, createdTimeMS, ipAddr, userAgent, ssoProvider, ssoIDToken).Scan(&sessionID); err != nil {
 		return nil, fmt.Errorf("insertDeviceStmt: %w", err)
 	}
 	return &api.Device{
@@ -168,6 +182,8 @@ func (s *devicesStatements) InsertDevice(
 		LastSeenTS:  createdTimeMS,
 		LastSeenIP:  ipAddr,
 		UserAgent:   userAgent,
+		SSOProvider: ssoProvider,
+		SSOIDToken:  ssoIDToken,
 	}, nil
 }
 
@@ -222,7 +238,7 @@ func (s *devicesStatements) SelectDeviceByToken(
 	var localpart string
 	var serverName gomatrixserverlib.ServerName
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &serverName)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &serverName, &dev.SSOProvider, &dev.SSOIDToken)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, serverName)
 		dev.AccessToken = accessToken
@@ -303,7 +319,7 @@ func (s *devicesStatements) SelectDevicesByLocalpart(
 	var lastseents sql.NullInt64
 	var id, displayname, ip, useragent sql.NullString
 	for rows.Next() {
-		err = rows.Scan(&id, &displayname, &lastseents, &ip, &useragent)
+		err = rows.Scan(&id, &displayname, &lastseents, &ip, &useragent, &dev.SSOProvider, &dev.SSOIDToken)
 		if err != nil {
 			return devices, err
 		}
@@ -330,8 +346,7 @@ func (s *devicesStatements) SelectDevicesByLocalpart(
 	return devices, rows.Err()
 }
 
-func (s *devicesStatements) UpdateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, deviceID, ipAddr, userAgent string) error {
-	lastSeenTs := time.Now().UnixNano() / 1000000
+func (s *devicesStatements) UpdateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, deviceID, ipAddr, userAgent string, lastSeenTs int64) error {
 	stmt := sqlutil.TxStmt(txn, s.updateDeviceLastSeenStmt)
 	_, err := stmt.ExecContext(ctx, lastSeenTs, ipAddr, userAgent, localpart, serverName, deviceID)
 	return err
@@ -21,6 +21,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/postgres/deltas"
 	"github.com/matrix-org/dendrite/userapi/storage/tables"
 	"github.com/matrix-org/util"
 )
@@ -33,7 +34,13 @@ CREATE TABLE IF NOT EXISTS userapi_login_tokens (
 	token_expires_at TIMESTAMP NOT NULL,
 
     -- The mxid for this account
-	user_id TEXT NOT NULL
+	user_id TEXT NOT NULL,
+
+	-- The ID of the SSO identity provider the user logged in with, if any
+	sso_provider TEXT NOT NULL DEFAULT '',
+
+	-- The ID token the SSO identity provider issued, if any
+	sso_id_token TEXT NOT NULL DEFAULT ''
 );
 
 -- This index allows efficient garbage collection of expired tokens.
@@ -41,13 +48,13 @@ CREATE INDEX IF NOT EXISTS userapi_login_tokens_expiration_idx ON userapi_login_
 `
 
 const insertLoginTokenSQL = "" +
-	"INSERT INTO userapi_login_tokens(token, token_expires_at, user_id) VALUES ($1, $2, $3)"
+	"INSERT INTO userapi_login_tokens(token, token_expires_at, user_id, sso_provider, sso_id_token) VALUES ($1, $2, $3, $4, $5)"
 
 const deleteLoginTokenSQL = "" +
 	"DELETE FROM userapi_login_tokens WHERE token = $1 OR token_expires_at <= $2"
 
 const selectLoginTokenSQL = "" +
-	"SELECT user_id FROM userapi_login_tokens WHERE token = $1 AND token_expires_at > $2"
+	"SELECT user_id, sso_provider, sso_id_token FROM userapi_login_tokens WHERE token = $1 AND token_expires_at > $2"
 
 type loginTokenStatements struct {
 	insertStmt *sql.Stmt
@@ -61,6 +68,20 @@ func NewPostgresLoginTokenTable(db *sql.DB) (tables.LoginTokenTable, error) {
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "userapi: add login token sso_provider",
+		Up:      deltas.UpLoginTokenSSOProvider,
+		Down:    deltas.DownLoginTokenSSOProvider,
+	})
+	m.AddMigrations(sqlutil.Migration{
+		Version: "userapi: add login token sso_id_token",
+		Up:      deltas.UpLoginTokenSSOIDToken,
+		Down:    deltas.DownLoginTokenSSOIDToken,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	return s, sqlutil.StatementList{
 		{&s.insertStmt, insertLoginTokenSQL},
 		{&s.deleteStmt, deleteLoginTokenSQL},
@@ -71,7 +92,7 @@ func NewPostgresLoginTokenTable(db *sql.DB) (tables.LoginTokenTable, error) {
 // insert adds an already generated token to the database.
 func (s *loginTokenStatements) InsertLoginToken(ctx context.Context, txn *sql.Tx, metadata *api.LoginTokenMetadata, data *api.LoginTokenData) error {
 	stmt := sqlutil.TxStmt(txn, s.insertStmt)
-	_, err := stmt.ExecContext(ctx, metadata.Token, metadata.Expiration.UTC(), data.UserID)
+	_, err := stmt.ExecContext(ctx, metadata.Token, metadata.Expiration.UTC(), data.UserID, data.SSOProvider, data.SSOIDToken)
 	return err
 }
 
@@ -94,7 +115,7 @@ func (s *loginTokenStatements) DeleteLoginToken(ctx context.Context, txn *sql.Tx
 // selectByToken returns the data associated with the given token. May return sql.ErrNoRows.
 func (s *loginTokenStatements) SelectLoginToken(ctx context.Context, token string) (*api.LoginTokenData, error) {
 	var data api.LoginTokenData
-	err := s.selectStmt.QueryRowContext(ctx, token, time.Now().UTC()).Scan(&data.UserID)
+	err := s.selectStmt.QueryRowContext(ctx, token, time.Now().UTC()).Scan(&data.UserID, &data.SSOProvider, &data.SSOIDToken)
 	if err != nil {
 		return nil, err
 	}
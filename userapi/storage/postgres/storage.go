@@ -107,6 +107,14 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions,
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresStatsTable: %w", err)
 	}
+	termsAcceptanceTable, err := NewPostgresTermsAcceptanceTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresTermsAcceptanceTable: %w", err)
+	}
+	storageUsageTable, err := NewPostgresStorageUsageTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresStorageUsageTable: %w", err)
+	}
 
 	m = sqlutil.NewMigrator(db)
 	m.AddMigrations(sqlutil.Migration{
@@ -133,6 +141,8 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions,
 		Notifications:         notificationsTable,
 		SSOs:                  ssoTable,
 		Stats:                 statsTable,
+		TermsAcceptance:       termsAcceptanceTable,
+		StorageUsage:          storageUsageTable,
 		ServerName:            serverName,
 		DB:                    db,
 		Writer:                writer,
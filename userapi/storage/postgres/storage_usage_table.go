@@ -0,0 +1,109 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+)
+
+const storageUsageSchema = `
+-- Stores how much space the account data and sync filters of each user take
+-- up, so that it can be checked against their storage quota without adding
+-- it all up again on every write
+CREATE TABLE IF NOT EXISTS userapi_storage_usage (
+	-- The localpart of the Matrix user ID
+	localpart TEXT NOT NULL,
+	server_name TEXT NOT NULL,
+	-- The total size of the user's account data in bytes
+	account_data_size BIGINT NOT NULL,
+	-- The total size of the user's sync filters in bytes, as reported by
+	-- the sync API, which stores them
+	filter_size BIGINT NOT NULL DEFAULT 0,
+
+	PRIMARY KEY(localpart, server_name)
+);
+`
+
+const insertStorageUsageSQL = "" +
+	"INSERT INTO userapi_storage_usage (localpart, server_name, account_data_size) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (localpart, server_name) DO NOTHING"
+
+const selectStorageUsageSQL = "" +
+	"SELECT account_data_size, filter_size FROM userapi_storage_usage WHERE localpart = $1 AND server_name = $2"
+
+const updateAccountDataUsageSQL = "" +
+	"UPDATE userapi_storage_usage SET account_data_size = account_data_size + $3 WHERE localpart = $1 AND server_name = $2"
+
+const updateFilterUsageSQL = "" +
+	"UPDATE userapi_storage_usage SET filter_size = $3 WHERE localpart = $1 AND server_name = $2"
+
+type storageUsageStatements struct {
+	insertStorageUsageStmt     *sql.Stmt
+	selectStorageUsageStmt     *sql.Stmt
+	updateAccountDataUsageStmt *sql.Stmt
+	updateFilterUsageStmt      *sql.Stmt
+}
+
+func NewPostgresStorageUsageTable(db *sql.DB) (tables.StorageUsageTable, error) {
+	s := &storageUsageStatements{}
+	_, err := db.Exec(storageUsageSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertStorageUsageStmt, insertStorageUsageSQL},
+		{&s.selectStorageUsageStmt, selectStorageUsageSQL},
+		{&s.updateAccountDataUsageStmt, updateAccountDataUsageSQL},
+		{&s.updateFilterUsageStmt, updateFilterUsageSQL},
+	}.Prepare(db)
+}
+
+func (s *storageUsageStatements) InsertStorageUsage(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, accountDataSize int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertStorageUsageStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName, accountDataSize)
+	return err
+}
+
+func (s *storageUsageStatements) SelectStorageUsage(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName,
+) (accountDataSize, filterSize int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectStorageUsageStmt)
+	err = stmt.QueryRowContext(ctx, localpart, serverName).Scan(&accountDataSize, &filterSize)
+	return
+}
+
+func (s *storageUsageStatements) UpdateAccountDataUsage(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, delta int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateAccountDataUsageStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName, delta)
+	return err
+}
+
+func (s *storageUsageStatements) UpdateFilterUsage(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, size int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateFilterUsageStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName, size)
+	return err
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/gomatrixserverlib"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/storage/tables"
+)
+
+const termsAcceptanceSchema = `
+-- Stores which version of each policy a user has accepted
+CREATE TABLE IF NOT EXISTS userapi_terms_acceptance (
+	-- The localpart of the Matrix user ID who accepted the policy
+	localpart TEXT NOT NULL,
+	server_name TEXT NOT NULL,
+	-- The ID of the policy, e.g. privacy_policy
+	policy_id TEXT NOT NULL,
+	-- The version of the policy which was accepted
+	version TEXT NOT NULL,
+	-- When the policy was accepted, in milliseconds
+	accepted_ts BIGINT NOT NULL,
+
+	PRIMARY KEY(localpart, server_name, policy_id)
+);
+`
+
+const upsertTermsAcceptanceSQL = "" +
+	"INSERT INTO userapi_terms_acceptance (localpart, server_name, policy_id, version, accepted_ts) VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (localpart, server_name, policy_id) DO UPDATE SET version = $4, accepted_ts = $5"
+
+const selectAcceptedTermsSQL = "" +
+	"SELECT policy_id, version FROM userapi_terms_acceptance WHERE localpart = $1 AND server_name = $2"
+
+type termsAcceptanceStatements struct {
+	upsertTermsAcceptanceStmt *sql.Stmt
+	selectAcceptedTermsStmt   *sql.Stmt
+}
+
+func NewPostgresTermsAcceptanceTable(db *sql.DB) (tables.TermsAcceptanceTable, error) {
+	s := &termsAcceptanceStatements{}
+	_, err := db.Exec(termsAcceptanceSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.upsertTermsAcceptanceStmt, upsertTermsAcceptanceSQL},
+		{&s.selectAcceptedTermsStmt, selectAcceptedTermsSQL},
+	}.Prepare(db)
+}
+
+func (s *termsAcceptanceStatements) UpsertTermsAcceptance(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName,
+	policyID, version string, acceptedTS gomatrixserverlib.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertTermsAcceptanceStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName, policyID, version, acceptedTS)
+	return err
+}
+
+func (s *termsAcceptanceStatements) SelectAcceptedTerms(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName,
+) (map[string]string, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAcceptedTermsStmt)
+	rows, err := stmt.QueryContext(ctx, localpart, serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectAcceptedTerms: rows.close() failed")
+
+	accepted := map[string]string{}
+	var policyID, version string
+	for rows.Next() {
+		if err = rows.Scan(&policyID, &version); err != nil {
+			return nil, err
+		}
+		accepted[policyID] = version
+	}
+	return accepted, rows.Err()
+}
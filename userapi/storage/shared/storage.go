@@ -54,6 +54,8 @@ type Database struct {
 	Pushers               tables.PusherTable
 	SSOs                  tables.SSOTable
 	Stats                 tables.StatsTable
+	TermsAcceptance       tables.TermsAcceptanceTable
+	StorageUsage          tables.StorageUsageTable
 	LoginTokenLifetime    time.Duration
 	ServerName            gomatrixserverlib.ServerName
 	BcryptCost            int
@@ -147,9 +149,9 @@ func (d *Database) CreateAccount(
 		// For guest accounts, we create a new numeric local part
 		if accountType == api.AccountTypeGuest {
 			var numLocalpart int64
-			numLocalpart, err = d.Accounts.SelectNewNumericLocalpart(ctx, txn, serverName)
+			numLocalpart, err = d.Accounts.AllocateNumericLocalpart(ctx, txn, serverName)
 			if err != nil {
-				return fmt.Errorf("d.Accounts.SelectNewNumericLocalpart: %w", err)
+				return fmt.Errorf("d.Accounts.AllocateNumericLocalpart: %w", err)
 			}
 			localpart = strconv.FormatInt(numLocalpart, 10)
 			plaintextPassword = ""
@@ -216,7 +218,7 @@ func (d *Database) QueryPushRules(
 			if dbErr := d.AccountDatas.InsertAccountData(ctx, txn, localpart, serverName, "", "m.push_rules", prbs); dbErr != nil {
 				return fmt.Errorf("failed to save default push rules: %w", dbErr)
 			}
-			return nil
+			return d.StorageUsage.UpdateAccountDataUsage(ctx, txn, localpart, serverName, int64(len(prbs)))
 		})
 
 		return pushRuleSets, err
@@ -239,8 +241,16 @@ func (d *Database) SaveAccountData(
 	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
 	roomID, dataType string, content json.RawMessage,
 ) error {
+	existing, err := d.AccountDatas.SelectAccountDataByType(ctx, localpart, serverName, roomID, dataType)
+	if err != nil {
+		return err
+	}
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.AccountDatas.InsertAccountData(ctx, txn, localpart, serverName, roomID, dataType, content)
+		if err := d.AccountDatas.InsertAccountData(ctx, txn, localpart, serverName, roomID, dataType, content); err != nil {
+			return err
+		}
+		// Keep the running total of the user's storage usage up to date.
+		return d.StorageUsage.UpdateAccountDataUsage(ctx, txn, localpart, serverName, int64(len(content)-len(existing)))
 	})
 }
 
@@ -268,11 +278,17 @@ func (d *Database) GetAccountDataByType(
 	)
 }
 
-// GetNewNumericLocalpart generates and returns a new unused numeric localpart
+// GetNewNumericLocalpart generates and returns a new unused numeric localpart.
+// The localpart is allocated, so it won't be returned again, even if it is
+// never used to create an account.
 func (d *Database) GetNewNumericLocalpart(
 	ctx context.Context, serverName gomatrixserverlib.ServerName,
-) (int64, error) {
-	return d.Accounts.SelectNewNumericLocalpart(ctx, nil, serverName)
+) (id int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		id, err = d.Accounts.AllocateNumericLocalpart(ctx, txn, serverName)
+		return err
+	})
+	return
 }
 
 func (d *Database) hashPassword(plaintext string) (hash string, err error) {
@@ -309,19 +325,90 @@ func (d *Database) GetLocalpartForSSO(ctx context.Context, namespace, iss, sub s
 	return d.SSOs.SelectLocalpartForSSO(ctx, nil, namespace, iss, sub)
 }
 
+// SaveTermsAcceptance records that the user accepted the given versions of
+// the given policies, as a map of policy ID to version.
+func (d *Database) SaveTermsAcceptance(
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, policies map[string]string,
+) error {
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for policyID, version := range policies {
+			if err := d.TermsAcceptance.UpsertTermsAcceptance(ctx, txn, localpart, serverName, policyID, version, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetAcceptedTerms returns the versions of the policies the user has accepted,
+// as a map of policy ID to version.
+func (d *Database) GetAcceptedTerms(
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
+) (map[string]string, error) {
+	return d.TermsAcceptance.SelectAcceptedTerms(ctx, nil, localpart, serverName)
+}
+
+// GetStorageUsage returns the total size in bytes of a user's account data
+// and of their sync filters. The usage of a user is tracked from the first
+// time it is needed, starting from the size of their existing account data.
+func (d *Database) GetStorageUsage(
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
+) (accountDataSize, filterSize int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		accountDataSize, filterSize, err = d.trackStorageUsage(ctx, txn, localpart, serverName)
+		return err
+	})
+	return
+}
+
+// SetFilterUsage records the total size in bytes of a user's sync filters.
+func (d *Database) SetFilterUsage(
+	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, size int64,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if _, _, err := d.trackStorageUsage(ctx, txn, localpart, serverName); err != nil {
+			return err
+		}
+		return d.StorageUsage.UpdateFilterUsage(ctx, txn, localpart, serverName, size)
+	})
+}
+
+func (d *Database) trackStorageUsage(
+	ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName,
+) (accountDataSize, filterSize int64, err error) {
+	accountDataSize, filterSize, err = d.StorageUsage.SelectStorageUsage(ctx, txn, localpart, serverName)
+	if err != sql.ErrNoRows {
+		return
+	}
+	if accountDataSize, err = d.AccountDatas.SelectAccountDataSize(ctx, localpart, serverName); err != nil {
+		return 0, 0, fmt.Errorf("d.AccountDatas.SelectAccountDataSize: %w", err)
+	}
+	if err = d.StorageUsage.InsertStorageUsage(ctx, txn, localpart, serverName, accountDataSize); err != nil {
+		return 0, 0, fmt.Errorf("d.StorageUsage.InsertStorageUsage: %w", err)
+	}
+	return accountDataSize, 0, nil
+}
+
 // Err3PIDInUse is the error returned when trying to save an association involving
 // a third-party identifier which is already associated to a local user.
 var Err3PIDInUse = errors.New("this third-party identifier is already in use")
 
 // SaveThreePIDAssociation saves the association between a third party identifier
 // and a local Matrix user (identified by the user's ID's local part).
+// The association is recorded as added now, and as validated at validatedAt
+// (in milliseconds since the epoch), or now if validatedAt is 0.
 // If the third-party identifier is already part of an association, returns Err3PIDInUse.
 // Returns an error if there was a problem talking to the database.
 func (d *Database) SaveThreePIDAssociation(
 	ctx context.Context, threepid string,
 	localpart string, serverName gomatrixserverlib.ServerName,
-	medium string,
+	medium string, validatedAt int64,
 ) (err error) {
+	addedAt := int64(gomatrixserverlib.AsTimestamp(time.Now()))
+	if validatedAt == 0 {
+		validatedAt = addedAt
+	}
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		user, _, err := d.ThreePIDs.SelectLocalpartForThreePID(
 			ctx, txn, threepid, medium,
@@ -334,7 +421,7 @@ func (d *Database) SaveThreePIDAssociation(
 			return Err3PIDInUse
 		}
 
-		return d.ThreePIDs.InsertThreePID(ctx, txn, threepid, medium, localpart, serverName)
+		return d.ThreePIDs.InsertThreePID(ctx, txn, threepid, medium, localpart, serverName, addedAt, validatedAt)
 	})
 }
 
@@ -396,6 +483,12 @@ func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
 	return acc, err
 }
 
+// GetLocalparts returns the localparts of the active accounts of users on the
+// given server name, excluding guests and application services.
+func (d *Database) GetLocalparts(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]string, error) {
+	return d.Accounts.SelectLocalparts(ctx, serverName)
+}
+
 // SearchProfiles returns all profiles where the provided localpart or display name
 // match any part of the profiles in the database.
 func (d *Database) SearchProfiles(ctx context.Context, searchString string, limit int,
@@ -611,13 +704,25 @@ func (d *Database) GetDevicesByID(ctx context.Context, deviceIDs []string) ([]ap
 // If there is already a device with the same device ID for this user, that access token will be revoked
 // and replaced with the given accessToken. If the given accessToken is already in use for another device,
 // an error will be returned.
-// If no device ID is given one is generated.
+// If no device ID is given one is generated. ssoProvider is the ID of the SSO identity provider
+// the device logged in with, or empty if it didn't log in with SSO, and ssoIDToken is the ID token it issued.
 // Returns the device on success.
 func (d *Database) CreateDevice(
 	ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName,
-	deviceID *string, accessToken string, displayName *string, ipAddr, userAgent string,
+	deviceID *string, accessToken string, displayName *string, ipAddr, userAgent, ssoProvider, ssoIDToken string,
 ) (dev *api.Device, returnErr error) {
 	if deviceID != nil {
+		if displayName == nil {
+			// Keep the display name of the device that we're replacing, if
+			// the client didn't give us a new one.
+			existing, err := d.Devices.SelectDeviceByID(ctx, localpart, serverName, *deviceID)
+			switch {
+			case err == nil && existing.DisplayName != "":
+				displayName = &existing.DisplayName
+			case err != nil && !errors.Is(err, sql.ErrNoRows):
+				return nil, err
+			}
+		}
 		returnErr = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 			var err error
 			// Revoke existing tokens for this device
@@ -625,7 +730,7 @@ func (d *Database) CreateDevice(
 				return err
 			}
 
-			dev, err = d.Devices.InsertDevice(ctx, txn, *deviceID, localpart, serverName, accessToken, displayName, ipAddr, userAgent)
+			dev, err = d.Devices.InsertDevice(ctx, txn, *deviceID, localpart, serverName, accessToken, displayName, ipAddr, userAgent, ssoProvider, ssoIDToken)
 			return err
 		})
 	} else {
@@ -640,7 +745,7 @@ func (d *Database) CreateDevice(
 
 			returnErr = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 				var err error
-				dev, err = d.Devices.InsertDevice(ctx, txn, newDeviceID, localpart, serverName, accessToken, displayName, ipAddr, userAgent)
+				dev, err = d.Devices.InsertDevice(ctx, txn, newDeviceID, localpart, serverName, accessToken, displayName, ipAddr, userAgent, ssoProvider, ssoIDToken)
 				return err
 			})
 			if returnErr == nil {
@@ -713,10 +818,10 @@ func (d *Database) RemoveAllDevices(
 	return
 }
 
-// UpdateDeviceLastSeen updates a last seen timestamp and the ip address.
-func (d *Database) UpdateDeviceLastSeen(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, deviceID, ipAddr, userAgent string) error {
+// UpdateDeviceLastSeen updates a last seen timestamp, in milliseconds, and the ip address.
+func (d *Database) UpdateDeviceLastSeen(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, deviceID, ipAddr, userAgent string, lastSeenTs int64) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.Devices.UpdateDeviceLastSeen(ctx, txn, localpart, serverName, deviceID, ipAddr, userAgent)
+		return d.Devices.UpdateDeviceLastSeen(ctx, txn, localpart, serverName, deviceID, ipAddr, userAgent, lastSeenTs)
 	})
 }
 
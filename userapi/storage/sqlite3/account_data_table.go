@@ -52,11 +52,15 @@ const selectAccountDataSQL = "" +
 const selectAccountDataByTypeSQL = "" +
 	"SELECT content FROM userapi_account_datas WHERE localpart = $1 AND server_name = $2 AND room_id = $3 AND type = $4"
 
+const selectAccountDataSizeSQL = "" +
+	"SELECT COALESCE(SUM(LENGTH(CAST(content AS BLOB))), 0) FROM userapi_account_datas WHERE localpart = $1 AND server_name = $2"
+
 type accountDataStatements struct {
 	db                          *sql.DB
 	insertAccountDataStmt       *sql.Stmt
 	selectAccountDataStmt       *sql.Stmt
 	selectAccountDataByTypeStmt *sql.Stmt
+	selectAccountDataSizeStmt   *sql.Stmt
 }
 
 func NewSQLiteAccountDataTable(db *sql.DB) (tables.AccountDataTable, error) {
@@ -71,6 +75,7 @@ func NewSQLiteAccountDataTable(db *sql.DB) (tables.AccountDataTable, error) {
 		{&s.insertAccountDataStmt, insertAccountDataSQL},
 		{&s.selectAccountDataStmt, selectAccountDataSQL},
 		{&s.selectAccountDataByTypeStmt, selectAccountDataByTypeSQL},
+		{&s.selectAccountDataSizeStmt, selectAccountDataSizeSQL},
 	}.Prepare(db)
 }
 
@@ -137,3 +142,11 @@ func (s *accountDataStatements) SelectAccountDataByType(
 	data = json.RawMessage(bytes)
 	return
 }
+
+func (s *accountDataStatements) SelectAccountDataSize(
+	ctx context.Context,
+	localpart string, serverName gomatrixserverlib.ServerName,
+) (size int64, err error) {
+	err = s.selectAccountDataSizeStmt.QueryRowContext(ctx, localpart, serverName).Scan(&size)
+	return
+}
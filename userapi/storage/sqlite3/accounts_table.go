@@ -22,6 +22,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/sqlite3/deltas"
@@ -51,6 +52,13 @@ CREATE TABLE IF NOT EXISTS userapi_accounts (
 );
 
 CREATE UNIQUE INDEX IF NOT EXISTS userapi_accounts_idx ON userapi_accounts(localpart, server_name);
+
+-- Stores the last numeric localpart allocated for each server name, so that
+-- concurrent guest and auto-generated registrations never get the same one.
+CREATE TABLE IF NOT EXISTS userapi_numeric_localparts (
+    server_name TEXT NOT NULL PRIMARY KEY,
+    last_localpart BIGINT NOT NULL
+);
 `
 
 const insertAccountSQL = "" +
@@ -68,18 +76,25 @@ const selectAccountByLocalpartSQL = "" +
 const selectPasswordHashSQL = "" +
 	"SELECT password_hash FROM userapi_accounts WHERE localpart = $1 AND server_name = $2 AND is_deactivated = 0"
 
-const selectNewNumericLocalpartSQL = "" +
-	"SELECT COALESCE(MAX(CAST(localpart AS INT)), 0) FROM userapi_accounts WHERE CAST(localpart AS INT) <> 0 AND server_name = $1"
+const selectLocalpartsSQL = "" +
+	"SELECT localpart FROM userapi_accounts WHERE server_name = $1 AND is_deactivated = 0 AND account_type <> $2 AND account_type <> $3 ORDER BY localpart"
+
+const allocateNumericLocalpartSQL = "" +
+	"INSERT INTO userapi_numeric_localparts (server_name, last_localpart)" +
+	" SELECT $1, COALESCE(MAX(CAST(localpart AS INT)), 0) + 1 FROM userapi_accounts WHERE CAST(localpart AS INT) <> 0 AND server_name = $1" +
+	" ON CONFLICT (server_name) DO UPDATE SET last_localpart = MAX(userapi_numeric_localparts.last_localpart + 1, excluded.last_localpart)" +
+	" RETURNING last_localpart"
 
 type accountsStatements struct {
-	db                            *sql.DB
-	insertAccountStmt             *sql.Stmt
-	updatePasswordStmt            *sql.Stmt
-	deactivateAccountStmt         *sql.Stmt
-	selectAccountByLocalpartStmt  *sql.Stmt
-	selectPasswordHashStmt        *sql.Stmt
-	selectNewNumericLocalpartStmt *sql.Stmt
-	serverName                    gomatrixserverlib.ServerName
+	db                           *sql.DB
+	insertAccountStmt            *sql.Stmt
+	updatePasswordStmt           *sql.Stmt
+	deactivateAccountStmt        *sql.Stmt
+	selectAccountByLocalpartStmt *sql.Stmt
+	selectPasswordHashStmt       *sql.Stmt
+	selectLocalpartsStmt         *sql.Stmt
+	allocateNumericLocalpartStmt *sql.Stmt
+	serverName                   gomatrixserverlib.ServerName
 }
 
 func NewSQLiteAccountsTable(db *sql.DB, serverName gomatrixserverlib.ServerName) (tables.AccountsTable, error) {
@@ -114,7 +129,8 @@ func NewSQLiteAccountsTable(db *sql.DB, serverName gomatrixserverlib.ServerName)
 		{&s.deactivateAccountStmt, deactivateAccountSQL},
 		{&s.selectAccountByLocalpartStmt, selectAccountByLocalpartSQL},
 		{&s.selectPasswordHashStmt, selectPasswordHashSQL},
-		{&s.selectNewNumericLocalpartStmt, selectNewNumericLocalpartSQL},
+		{&s.selectLocalpartsStmt, selectLocalpartsSQL},
+		{&s.allocateNumericLocalpartStmt, allocateNumericLocalpartSQL},
 	}.Prepare(db)
 }
 
@@ -191,16 +207,34 @@ func (s *accountsStatements) SelectAccountByLocalpart(
 	return &acc, nil
 }
 
-func (s *accountsStatements) SelectNewNumericLocalpart(
+// SelectLocalparts returns the localparts of the active accounts of users on
+// the given server name, excluding guests and application services.
+func (s *accountsStatements) SelectLocalparts(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]string, error) {
+	rows, err := s.selectLocalpartsStmt.QueryContext(ctx, serverName, api.AccountTypeGuest, api.AccountTypeAppService)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectLocalparts: rows.close() failed")
+	var localparts []string
+	for rows.Next() {
+		var localpart string
+		if err = rows.Scan(&localpart); err != nil {
+			return nil, err
+		}
+		localparts = append(localparts, localpart)
+	}
+	return localparts, rows.Err()
+}
+
+// AllocateNumericLocalpart allocates a numeric localpart which is higher than
+// any existing numeric localpart and hasn't been allocated before. This must be
+// called through the writer, which serialises concurrent allocations.
+func (s *accountsStatements) AllocateNumericLocalpart(
 	ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName,
 ) (id int64, err error) {
-	stmt := s.selectNewNumericLocalpartStmt
-	if txn != nil {
-		stmt = sqlutil.TxStmt(txn, stmt)
-	}
+	stmt := sqlutil.TxStmt(txn, s.allocateNumericLocalpartStmt)
 	err = stmt.QueryRowContext(ctx, serverName).Scan(&id)
-	if err == sql.ErrNoRows {
-		return 1, nil
-	}
-	return id + 1, err
+	return
 }
@@ -0,0 +1,40 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+func UpThreePIDTimestamps(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if not exists", so check if the columns exist already,
+	// which is the case if the table was only just created.
+	if _, err := tx.ExecContext(ctx, "SELECT added_ts, validated_ts FROM userapi_threepids LIMIT 1"); err == nil {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE userapi_threepids ADD COLUMN added_ts BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE userapi_threepids ADD COLUMN validated_ts BIGINT NOT NULL DEFAULT 0;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	// We don't know when existing 3PIDs were added, so say they were added
+	// and validated now rather than in 1970.
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	_, err = tx.ExecContext(ctx, "UPDATE userapi_threepids SET added_ts = $1, validated_ts = $1 WHERE added_ts = 0", now)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownThreePIDTimestamps(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+ALTER TABLE userapi_threepids DROP COLUMN added_ts;
+ALTER TABLE userapi_threepids DROP COLUMN validated_ts;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+func UpDeviceSSOIDToken(ctx context.Context, tx *sql.Tx) error {
+	// SQLite doesn't have "if not exists", so check if the column exists already,
+	// which is the case if the table was only just created.
+	if _, err := tx.ExecContext(ctx, "SELECT sso_id_token FROM userapi_devices LIMIT 1"); err == nil {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `ALTER TABLE userapi_devices ADD COLUMN sso_id_token TEXT NOT NULL DEFAULT '';`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownDeviceSSOIDToken(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `ALTER TABLE userapi_devices DROP COLUMN sso_id_token;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
+
+func UpLoginTokenSSOIDToken(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, "SELECT sso_id_token FROM userapi_login_tokens LIMIT 1"); err == nil {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `ALTER TABLE userapi_login_tokens ADD COLUMN sso_id_token TEXT NOT NULL DEFAULT '';`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+func DownLoginTokenSSOIDToken(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `ALTER TABLE userapi_login_tokens DROP COLUMN sso_id_token;`)
+	if err != nil {
+		return fmt.Errorf("failed to execute downgrade: %w", err)
+	}
+	return nil
+}
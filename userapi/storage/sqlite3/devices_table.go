@@ -46,26 +46,28 @@ CREATE TABLE IF NOT EXISTS userapi_devices (
     last_seen_ts BIGINT,
     ip TEXT,
     user_agent TEXT,
+    sso_provider TEXT NOT NULL DEFAULT '',
+    sso_id_token TEXT NOT NULL DEFAULT '',
 
 	UNIQUE (localpart, server_name, device_id)
 );
 `
 
 const insertDeviceSQL = "" +
-	"INSERT INTO userapi_devices (device_id, localpart, server_name, access_token, created_ts, display_name, session_id, last_seen_ts, ip, user_agent)" +
-	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)"
+	"INSERT INTO userapi_devices (device_id, localpart, server_name, access_token, created_ts, display_name, session_id, last_seen_ts, ip, user_agent, sso_provider, sso_id_token)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)"
 
 const selectDevicesCountSQL = "" +
 	"SELECT COUNT(access_token) FROM userapi_devices"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart, server_name FROM userapi_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, server_name, sso_provider, sso_id_token FROM userapi_devices WHERE access_token = $1"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name, last_seen_ts, ip FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id = $3"
 
 const selectDevicesByLocalpartSQL = "" +
-	"SELECT device_id, display_name, last_seen_ts, ip, user_agent FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id != $3 ORDER BY last_seen_ts DESC"
+	"SELECT device_id, display_name, last_seen_ts, ip, user_agent, sso_provider, sso_id_token FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id != $3 ORDER BY last_seen_ts DESC"
 
 const updateDeviceNameSQL = "" +
 	"UPDATE userapi_devices SET display_name = $1 WHERE localpart = $2 AND server_name = $3 AND device_id = $4"
@@ -114,6 +116,16 @@ func NewSQLiteDevicesTable(db *sql.DB, serverName gomatrixserverlib.ServerName)
 		Version: "userapi: add last_seen_ts",
 		Up:      deltas.UpLastSeenTSIP,
 	})
+	m.AddMigrations(sqlutil.Migration{
+		Version: "userapi: add device sso_provider",
+		Up:      deltas.UpDeviceSSOProvider,
+		Down:    deltas.DownDeviceSSOProvider,
+	})
+	m.AddMigrations(sqlutil.Migration{
+		Version: "userapi: add device sso_id_token",
+		Up:      deltas.UpDeviceSSOIDToken,
+		Down:    deltas.DownDeviceSSOIDToken,
+	})
 	if err = m.Up(context.Background()); err != nil {
 		return nil, err
 	}
@@ -138,7 +150,7 @@ func NewSQLiteDevicesTable(db *sql.DB, serverName gomatrixserverlib.ServerName)
 func (s *devicesStatements) InsertDevice(
 	ctx context.Context, txn *sql.Tx, id string,
 	localpart string, serverName gomatrixserverlib.ServerName,
-	accessToken string, displayName *string, ipAddr, userAgent string,
+	accessToken string, displayName *string, ipAddr, userAgent, ssoProvider, ssoIDToken string,
 ) (*api.Device, error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
 	var sessionID int64
@@ -148,7 +160,7 @@ func (s *devicesStatements) InsertDevice(
 		return nil, err
 	}
 	sessionID++
-	if _, err := insertStmt.ExecContext(ctx, id, localpart, serverName, accessToken, createdTimeMS, displayName, sessionID, createdTimeMS, ipAddr, userAgent); err != nil {
+	if _, err := insertStmt.ExecContext(ctx, id, localpart, serverName, accessToken, createdTimeMS, displayName, sessionID, createdTimeMS, ipAddr, userAgent, ssoProvider, ssoIDToken); err != nil {
 		return nil, err
 	}
 	return &api.Device{
@@ -159,6 +171,8 @@ func (s *devicesStatements) InsertDevice(
 		LastSeenTS:  createdTimeMS,
 		LastSeenIP:  ipAddr,
 		UserAgent:   userAgent,
+		SSOProvider: ssoProvider,
+		SSOIDToken:  ssoIDToken,
 	}, nil
 }
 
@@ -219,7 +233,7 @@ func (s *devicesStatements) SelectDeviceByToken(
 	var localpart string
 	var serverName gomatrixserverlib.ServerName
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &serverName)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &serverName, &dev.SSOProvider, &dev.SSOIDToken)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, serverName)
 		dev.AccessToken = accessToken
@@ -271,7 +285,7 @@ func (s *devicesStatements) SelectDevicesByLocalpart(
 	var lastseents sql.NullInt64
 	var id, displayname, ip, useragent sql.NullString
 	for rows.Next() {
-		err = rows.Scan(&id, &displayname, &lastseents, &ip, &useragent)
+		err = rows.Scan(&id, &displayname, &lastseents, &ip, &useragent, &dev.SSOProvider, &dev.SSOIDToken)
 		if err != nil {
 			return devices, err
 		}
@@ -332,8 +346,7 @@ func (s *devicesStatements) SelectDevicesByID(ctx context.Context, deviceIDs []s
 	return devices, rows.Err()
 }
 
-func (s *devicesStatements) UpdateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, deviceID, ipAddr, userAgent string) error {
-	lastSeenTs := time.Now().UnixNano() / 1000000
+func (s *devicesStatements) UpdateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, deviceID, ipAddr, userAgent string, lastSeenTs int64) error {
 	stmt := sqlutil.TxStmt(txn, s.updateDeviceLastSeenStmt)
 	_, err := stmt.ExecContext(ctx, lastSeenTs, ipAddr, userAgent, localpart, serverName, deviceID)
 	return err
@@ -105,6 +105,14 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions,
 	if err != nil {
 		return nil, fmt.Errorf("NewSQLiteStatsTable: %w", err)
 	}
+	termsAcceptanceTable, err := NewSQLiteTermsAcceptanceTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLiteTermsAcceptanceTable: %w", err)
+	}
+	storageUsageTable, err := NewSQLiteStorageUsageTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewSQLiteStorageUsageTable: %w", err)
+	}
 
 	m = sqlutil.NewMigrator(db)
 	m.AddMigrations(sqlutil.Migration{
@@ -131,6 +139,8 @@ func NewDatabase(base *base.BaseDendrite, dbProperties *config.DatabaseOptions,
 		Notifications:         notificationsTable,
 		SSOs:                  ssoTable,
 		Stats:                 statsTable,
+		TermsAcceptance:       termsAcceptanceTable,
+		StorageUsage:          storageUsageTable,
 		ServerName:            serverName,
 		DB:                    db,
 		Writer:                writer,
@@ -20,6 +20,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/storage/sqlite3/deltas"
 	"github.com/matrix-org/dendrite/userapi/storage/tables"
 	"github.com/matrix-org/gomatrixserverlib"
 
@@ -36,6 +37,10 @@ CREATE TABLE IF NOT EXISTS userapi_threepids (
 	-- The localpart of the Matrix user ID associated to this 3PID
 	localpart TEXT NOT NULL,
 	server_name TEXT NOT NULL,
+	-- When the 3PID was added to the account, in milliseconds since the epoch
+	added_ts BIGINT NOT NULL DEFAULT 0,
+	-- When the 3PID was validated by the identity server, in milliseconds since the epoch
+	validated_ts BIGINT NOT NULL DEFAULT 0,
 
 	PRIMARY KEY(threepid, medium)
 );
@@ -47,10 +52,10 @@ const selectLocalpartForThreePIDSQL = "" +
 	"SELECT localpart, server_name FROM userapi_threepids WHERE threepid = $1 AND medium = $2"
 
 const selectThreePIDsForLocalpartSQL = "" +
-	"SELECT threepid, medium FROM userapi_threepids WHERE localpart = $1 AND server_name = $2"
+	"SELECT threepid, medium, added_ts, validated_ts FROM userapi_threepids WHERE localpart = $1 AND server_name = $2"
 
 const insertThreePIDSQL = "" +
-	"INSERT INTO userapi_threepids (threepid, medium, localpart, server_name) VALUES ($1, $2, $3, $4)"
+	"INSERT INTO userapi_threepids (threepid, medium, localpart, server_name, added_ts, validated_ts) VALUES ($1, $2, $3, $4, $5, $6)"
 
 const deleteThreePIDSQL = "" +
 	"DELETE FROM userapi_threepids WHERE threepid = $1 AND medium = $2"
@@ -71,6 +76,15 @@ func NewSQLiteThreePIDTable(db *sql.DB) (tables.ThreePIDTable, error) {
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(sqlutil.Migration{
+		Version: "userapi: add threepid timestamps",
+		Up:      deltas.UpThreePIDTimestamps,
+		Down:    deltas.DownThreePIDTimestamps,
+	})
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	return s, sqlutil.StatementList{
 		{&s.selectLocalpartForThreePIDStmt, selectLocalpartForThreePIDSQL},
 		{&s.selectThreePIDsForLocalpartStmt, selectThreePIDsForLocalpartSQL},
@@ -104,12 +118,15 @@ func (s *threepidStatements) SelectThreePIDsForLocalpart(
 	for rows.Next() {
 		var threepid string
 		var medium string
-		if err = rows.Scan(&threepid, &medium); err != nil {
+		var addedAt, validatedAt int64
+		if err = rows.Scan(&threepid, &medium, &addedAt, &validatedAt); err != nil {
 			return
 		}
 		threepids = append(threepids, authtypes.ThreePID{
-			Address: threepid,
-			Medium:  medium,
+			Address:     threepid,
+			Medium:      medium,
+			AddedAt:     addedAt,
+			ValidatedAt: validatedAt,
 		})
 	}
 	return threepids, rows.Err()
@@ -118,9 +135,10 @@ func (s *threepidStatements) SelectThreePIDsForLocalpart(
 func (s *threepidStatements) InsertThreePID(
 	ctx context.Context, txn *sql.Tx, threepid, medium,
 	localpart string, serverName gomatrixserverlib.ServerName,
+	addedAt, validatedAt int64,
 ) (err error) {
 	stmt := sqlutil.TxStmt(txn, s.insertThreePIDStmt)
-	_, err = stmt.ExecContext(ctx, threepid, medium, localpart, serverName)
+	_, err = stmt.ExecContext(ctx, threepid, medium, localpart, serverName, addedAt, validatedAt)
 	return err
 }
 
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
@@ -150,6 +152,73 @@ func Test_Accounts(t *testing.T) {
 	})
 }
 
+func Test_NumericLocalpartsConcurrent(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, closeDB := mustCreateDatabase(t, dbType)
+		defer closeDB()
+
+		// Mix allocations for auto-generated usernames with guest accounts,
+		// which allocate their localparts while creating the account.
+		const workers = 20
+		localparts := make(chan string, workers*2)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				id, err := db.GetNewNumericLocalpart(ctx, "localhost")
+				assert.NoError(t, err, "failed to get new numeric localpart")
+				localparts <- strconv.FormatInt(id, 10)
+			}()
+			go func() {
+				defer wg.Done()
+				acc, err := db.CreateAccount(ctx, "", "localhost", "", "", api.AccountTypeGuest)
+				if !assert.NoError(t, err, "failed to create guest account") {
+					return
+				}
+				localparts <- acc.Localpart
+			}()
+		}
+		wg.Wait()
+		close(localparts)
+
+		seen := map[string]struct{}{}
+		for localpart := range localparts {
+			if _, ok := seen[localpart]; ok {
+				t.Fatalf("localpart %q was allocated more than once", localpart)
+			}
+			seen[localpart] = struct{}{}
+		}
+		assert.Len(t, seen, workers*2)
+	})
+}
+
+func Test_Localparts(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, closeDB := mustCreateDatabase(t, dbType)
+		defer closeDB()
+
+		for localpart, accountType := range map[string]api.AccountType{
+			"bob":         api.AccountTypeUser,
+			"alice":       api.AccountTypeAdmin,
+			"deactivated": api.AccountTypeUser,
+			"bridge":      api.AccountTypeAppService,
+		} {
+			_, err := db.CreateAccount(ctx, localpart, "localhost", "", "", accountType)
+			assert.NoError(t, err, "failed to create account")
+		}
+		_, err := db.CreateAccount(ctx, "", "localhost", "", "", api.AccountTypeGuest)
+		assert.NoError(t, err, "failed to create guest account")
+		_, err = db.CreateAccount(ctx, "charlie", "other", "", "", api.AccountTypeUser)
+		assert.NoError(t, err, "failed to create account")
+		assert.NoError(t, db.DeactivateAccount(ctx, "deactivated", "localhost"))
+
+		localparts, err := db.GetLocalparts(ctx, "localhost")
+		assert.NoError(t, err, "failed to get localparts")
+		assert.Equal(t, []string{"alice", "bob"}, localparts)
+	})
+}
+
 func Test_Devices(t *testing.T) {
 	alice := test.NewUser(t)
 	localpart, domain, err := gomatrixserverlib.SplitID('@', alice.ID)
@@ -161,7 +230,7 @@ func Test_Devices(t *testing.T) {
 		db, close := mustCreateDatabase(t, dbType)
 		defer close()
 
-		deviceWithID, err := db.CreateDevice(ctx, localpart, domain, &deviceID, accessToken, nil, "", "")
+		deviceWithID, err := db.CreateDevice(ctx, localpart, domain, &deviceID, accessToken, nil, "", "", "", "")
 		assert.NoError(t, err, "unable to create deviceWithoutID")
 
 		gotDevice, err := db.GetDeviceByID(ctx, localpart, domain, deviceID)
@@ -174,7 +243,7 @@ func Test_Devices(t *testing.T) {
 
 		// create a device without existing device ID
 		accessToken = util.RandomString(16)
-		deviceWithoutID, err := db.CreateDevice(ctx, localpart, domain, nil, accessToken, nil, "", "")
+		deviceWithoutID, err := db.CreateDevice(ctx, localpart, domain, nil, accessToken, nil, "", "", "", "")
 		assert.NoError(t, err, "unable to create deviceWithoutID")
 		gotDeviceWithoutID, err := db.GetDeviceByID(ctx, localpart, domain, deviceWithoutID.ID)
 		assert.NoError(t, err, "unable to get device by id")
@@ -198,7 +267,7 @@ func Test_Devices(t *testing.T) {
 		err = db.UpdateDevice(ctx, localpart, domain, deviceWithID.ID, &newName)
 		assert.NoError(t, err, "unable to update device displayname")
 		updatedAfterTimestamp := time.Now().Unix()
-		err = db.UpdateDeviceLastSeen(ctx, localpart, domain, deviceWithID.ID, "127.0.0.1", "Element Web")
+		err = db.UpdateDeviceLastSeen(ctx, localpart, domain, deviceWithID.ID, "127.0.0.1", "Element Web", time.Now().UnixNano()/1000000)
 		assert.NoError(t, err, "unable to update device last seen")
 
 		deviceWithID.DisplayName = newName
@@ -213,7 +282,7 @@ func Test_Devices(t *testing.T) {
 		// create one more device and remove the devices step by step
 		newDeviceID := util.RandomString(16)
 		accessToken = util.RandomString(16)
-		_, err = db.CreateDevice(ctx, localpart, domain, &newDeviceID, accessToken, nil, "", "")
+		_, err = db.CreateDevice(ctx, localpart, domain, &newDeviceID, accessToken, nil, "", "", "", "")
 		assert.NoError(t, err, "unable to create new device")
 
 		devices, err = db.GetDevicesByLocalpart(ctx, localpart, domain)
@@ -508,8 +577,11 @@ func Test_ThreePID(t *testing.T) {
 		defer close()
 		threePID := util.RandomString(8)
 		medium := util.RandomString(8)
-		err = db.SaveThreePIDAssociation(ctx, threePID, aliceLocalpart, aliceDomain, medium)
+		validatedAt := int64(gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Minute)))
+		before := int64(gomatrixserverlib.AsTimestamp(time.Now()))
+		err = db.SaveThreePIDAssociation(ctx, threePID, aliceLocalpart, aliceDomain, medium, validatedAt)
 		assert.NoError(t, err, "unable to save threepid association")
+		after := int64(gomatrixserverlib.AsTimestamp(time.Now()))
 
 		// get the stored threepid
 		gotLocalpart, gotDomain, err := db.GetLocalpartForThreePID(ctx, threePID, medium)
@@ -520,11 +592,31 @@ func Test_ThreePID(t *testing.T) {
 		threepids, err := db.GetThreePIDsForLocalpart(ctx, aliceLocalpart, aliceDomain)
 		assert.NoError(t, err, "unable to get threepids for localpart")
 		assert.Equal(t, 1, len(threepids))
+		addedAt := threepids[0].AddedAt
+		assert.True(t, addedAt >= before && addedAt <= after, "unexpected added_at %d", addedAt)
 		assert.Equal(t, authtypes.ThreePID{
-			Address: threePID,
-			Medium:  medium,
+			Address:     threePID,
+			Medium:      medium,
+			AddedAt:     addedAt,
+			ValidatedAt: validatedAt,
 		}, threepids[0])
 
+		// without a validation time, the 3PID is treated as validated when added
+		otherThreePID := util.RandomString(8)
+		err = db.SaveThreePIDAssociation(ctx, otherThreePID, aliceLocalpart, aliceDomain, medium, 0)
+		assert.NoError(t, err, "unable to save threepid association")
+		threepids, err = db.GetThreePIDsForLocalpart(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err, "unable to get threepids for localpart")
+		assert.Equal(t, 2, len(threepids))
+		for _, tp := range threepids {
+			if tp.Address == otherThreePID {
+				assert.NotZero(t, tp.AddedAt)
+				assert.Equal(t, tp.AddedAt, tp.ValidatedAt)
+			}
+		}
+		err = db.RemoveThreePIDAssociation(ctx, otherThreePID, medium)
+		assert.NoError(t, err, "unexpected error")
+
 		// remove threepid association
 		err = db.RemoveThreePIDAssociation(ctx, threePID, medium)
 		assert.NoError(t, err, "unexpected error")
@@ -536,6 +628,40 @@ func Test_ThreePID(t *testing.T) {
 	})
 }
 
+func Test_TermsAcceptance(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceLocalpart, aliceDomain, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+
+		accepted, err := db.GetAcceptedTerms(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err, "unable to get accepted terms")
+		assert.Equal(t, map[string]string{}, accepted)
+
+		err = db.SaveTermsAcceptance(ctx, aliceLocalpart, aliceDomain, map[string]string{
+			"privacy_policy":   "1.0",
+			"terms_of_service": "1.0",
+		})
+		assert.NoError(t, err, "unable to save terms acceptance")
+
+		// accepting a newer version replaces the old one
+		err = db.SaveTermsAcceptance(ctx, aliceLocalpart, aliceDomain, map[string]string{
+			"privacy_policy": "2.0",
+		})
+		assert.NoError(t, err, "unable to save terms acceptance")
+
+		accepted, err = db.GetAcceptedTerms(ctx, aliceLocalpart, aliceDomain)
+		assert.NoError(t, err, "unable to get accepted terms")
+		assert.Equal(t, map[string]string{
+			"privacy_policy":   "2.0",
+			"terms_of_service": "1.0",
+		}, accepted)
+	})
+}
+
 func Test_Notification(t *testing.T) {
 	alice := test.NewUser(t)
 	aliceLocalpart, aliceDomain, err := gomatrixserverlib.SplitID('@', alice.ID)
@@ -31,6 +31,9 @@ type AccountDataTable interface {
 	InsertAccountData(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, roomID, dataType string, content json.RawMessage) error
 	SelectAccountData(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (map[string]json.RawMessage, map[string]map[string]json.RawMessage, error)
 	SelectAccountDataByType(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, roomID, dataType string) (data json.RawMessage, err error)
+	// SelectAccountDataSize returns the total size in bytes of the content of
+	// all of a user's account data.
+	SelectAccountDataSize(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (size int64, err error)
 }
 
 type AccountsTable interface {
@@ -39,11 +42,12 @@ type AccountsTable interface {
 	DeactivateAccount(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (err error)
 	SelectPasswordHash(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (hash string, err error)
 	SelectAccountByLocalpart(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (*api.Account, error)
-	SelectNewNumericLocalpart(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) (id int64, err error)
+	SelectLocalparts(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]string, error)
+	AllocateNumericLocalpart(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) (id int64, err error)
 }
 
 type DevicesTable interface {
-	InsertDevice(ctx context.Context, txn *sql.Tx, id, localpart string, serverName gomatrixserverlib.ServerName, accessToken string, displayName *string, ipAddr, userAgent string) (*api.Device, error)
+	InsertDevice(ctx context.Context, txn *sql.Tx, id, localpart string, serverName gomatrixserverlib.ServerName, accessToken string, displayName *string, ipAddr, userAgent, ssoProvider, ssoIDToken string) (*api.Device, error)
 	DeleteDevice(ctx context.Context, txn *sql.Tx, id, localpart string, serverName gomatrixserverlib.ServerName) error
 	DeleteDevices(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, devices []string) error
 	DeleteDevicesByLocalpart(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, exceptDeviceID string) error
@@ -52,7 +56,7 @@ type DevicesTable interface {
 	SelectDeviceByID(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName, deviceID string) (*api.Device, error)
 	SelectDevicesByLocalpart(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, exceptDeviceID string) ([]api.Device, error)
 	SelectDevicesByID(ctx context.Context, deviceIDs []string) ([]api.Device, error)
-	UpdateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, deviceID, ipAddr, userAgent string) error
+	UpdateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, deviceID, ipAddr, userAgent string, lastSeenTs int64) error
 }
 
 type KeyBackupTable interface {
@@ -94,7 +98,7 @@ type ProfileTable interface {
 type ThreePIDTable interface {
 	SelectLocalpartForThreePID(ctx context.Context, txn *sql.Tx, threepid string, medium string) (localpart string, serverName gomatrixserverlib.ServerName, err error)
 	SelectThreePIDsForLocalpart(ctx context.Context, localpart string, serverName gomatrixserverlib.ServerName) (threepids []authtypes.ThreePID, err error)
-	InsertThreePID(ctx context.Context, txn *sql.Tx, threepid, medium, localpart string, serverName gomatrixserverlib.ServerName) (err error)
+	InsertThreePID(ctx context.Context, txn *sql.Tx, threepid, medium, localpart string, serverName gomatrixserverlib.ServerName, addedAt, validatedAt int64) (err error)
 	DeleteThreePID(ctx context.Context, txn *sql.Tx, threepid string, medium string) (err error)
 }
 
@@ -121,6 +125,21 @@ type SSOTable interface {
 	DeleteSSO(ctx context.Context, txn *sql.Tx, namespace, iss, sub string) error
 }
 
+type TermsAcceptanceTable interface {
+	UpsertTermsAcceptance(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, policyID, version string, acceptedTS gomatrixserverlib.Timestamp) error
+	SelectAcceptedTerms(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName) (map[string]string, error)
+}
+
+type StorageUsageTable interface {
+	InsertStorageUsage(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, accountDataSize int64) error
+	// SelectStorageUsage returns sql.ErrNoRows if the usage of the user isn't tracked yet.
+	SelectStorageUsage(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName) (accountDataSize, filterSize int64, err error)
+	// UpdateAccountDataUsage adds delta to the account data size of the user, if it is tracked.
+	UpdateAccountDataUsage(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, delta int64) error
+	// UpdateFilterUsage sets the filter size of the user, if it is tracked.
+	UpdateFilterUsage(ctx context.Context, txn *sql.Tx, localpart string, serverName gomatrixserverlib.ServerName, size int64) error
+}
+
 type StatsTable interface {
 	UserStatistics(ctx context.Context, txn *sql.Tx) (*types.UserStatistics, *types.DatabaseEngine, error)
 	DailyRoomsMessages(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) (msgStats types.MessageStats, activeRooms, activeE2EERooms int64, err error)
@@ -83,7 +83,9 @@ func NewInternalAPI(
 		DisableTLSValidation: cfg.PushGatewayDisableTLSValidation,
 		PgClient:             pgClient,
 		Cfg:                  cfg,
+		LastSeen:             internal.NewLastSeenUpdater(db, cfg.LastSeenUpdateInterval),
 	}
+	userAPI.LastSeen.Start(base.ProcessContext)
 
 	receiptConsumer := consumers.NewOutputReceiptEventConsumer(
 		base.ProcessContext, cfg, js, db, syncProducer, pgClient,
@@ -16,18 +16,26 @@ package userapi_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/keyserver"
+	"github.com/matrix-org/dendrite/roomserver"
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi"
 	"github.com/matrix-org/dendrite/test"
 	"github.com/matrix-org/dendrite/test/testrig"
 	"github.com/matrix-org/dendrite/userapi"
@@ -67,12 +75,12 @@ func MustMakeInternalAPI(t *testing.T, opts apiTestOpts, dbType test.DBType) (ap
 	}
 
 	return &internal.UserInternalAPI{
-			DB:     accountDB,
-			Config: cfg,
-		}, accountDB, func() {
-			close()
-			baseclose()
-		}
+		DB:     accountDB,
+		Config: cfg,
+	}, accountDB, func() {
+		close()
+		baseclose()
+	}
 }
 
 func TestQueryProfile(t *testing.T) {
@@ -368,3 +376,251 @@ func TestQueryAccountByLocalpart(t *testing.T) {
 		})
 	})
 }
+
+func TestAutoJoinRooms(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+
+		welcome := fmt.Sprintf("#welcome:%s", base.Cfg.Global.ServerName)
+		notCreated := fmt.Sprintf("#not-created:%s", base.Cfg.Global.ServerName)
+		base.Cfg.UserAPI.AutoJoinRooms = []string{welcome}
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		keyAPI.SetUserAPI(userAPI)
+
+		createAccount := func(localpart string) string {
+			res := &api.PerformAccountCreationResponse{}
+			if err := userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+				AccountType: api.AccountTypeUser,
+				Localpart:   localpart,
+				Password:    "someRandomPassword",
+			}, res); err != nil {
+				t.Fatalf("failed to create account: %s", err)
+			}
+			return res.Account.UserID
+		}
+		roomIDForAlias := func(alias string) string {
+			res := &rsapi.GetRoomIDForAliasResponse{}
+			if err := rsAPI.GetRoomIDForAlias(ctx, &rsapi.GetRoomIDForAliasRequest{Alias: alias}, res); err != nil {
+				t.Fatal(err)
+			}
+			return res.RoomID
+		}
+		assertJoined := func(roomID, userID string) {
+			t.Helper()
+			res := &rsapi.QueryMembershipForUserResponse{}
+			if err := rsAPI.QueryMembershipForUser(ctx, &rsapi.QueryMembershipForUserRequest{
+				RoomID: roomID, UserID: userID,
+			}, res); err != nil {
+				t.Fatal(err)
+			}
+			if !res.IsInRoom {
+				t.Fatalf("expected %s to be joined to %s, got membership %q", userID, roomID, res.Membership)
+			}
+		}
+
+		// The first user creates the room.
+		first := createAccount("first")
+		roomID := roomIDForAlias(welcome)
+		if roomID == "" {
+			t.Fatalf("expected %s to be created", welcome)
+		}
+		assertJoined(roomID, first)
+
+		// Later users join the existing room.
+		second := createAccount("second")
+		if got := roomIDForAlias(welcome); got != roomID {
+			t.Fatalf("expected %s to still point to %s, got %s", welcome, roomID, got)
+		}
+		assertJoined(roomID, second)
+
+		// Missing rooms are not created when auto-creation is disabled, and
+		// failing to join them doesn't fail the registration.
+		base.Cfg.UserAPI.AutoCreateAutoJoinRooms = false
+		base.Cfg.UserAPI.AutoJoinRooms = []string{notCreated, welcome}
+		third := createAccount("third")
+		if got := roomIDForAlias(notCreated); got != "" {
+			t.Fatalf("expected %s not to be created, got %s", notCreated, got)
+		}
+		assertJoined(roomID, third)
+	})
+}
+
+func TestAccountDataSyncOrdering(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		keyAPI.SetUserAPI(userAPI)
+		syncapi.AddPublicRoutes(base, userAPI, rsAPI, keyAPI, nil)
+
+		accRes := &api.PerformAccountCreationResponse{}
+		if err := userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+			AccountType: api.AccountTypeUser,
+			Localpart:   "alice",
+			Password:    "someRandomPassword",
+		}, accRes); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+		devRes := &api.PerformDeviceCreationResponse{}
+		if err := userAPI.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+			Localpart:   "alice",
+			AccessToken: "alice_token",
+		}, devRes); err != nil {
+			t.Fatalf("failed to create device: %s", err)
+		}
+
+		sync := func(since string) gjson.Result {
+			t.Helper()
+			w := httptest.NewRecorder()
+			base.PublicClientAPIMux.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+				"access_token": "alice_token",
+				"since":        since,
+				"timeout":      "100",
+			})))
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected sync to succeed, got HTTP %d: %s", w.Code, w.Body.String())
+			}
+			return gjson.ParseBytes(w.Body.Bytes())
+		}
+		since := sync("").Get("next_batch").Str
+
+		// Write the same type many times in quick succession.
+		const writes = 20
+		for i := 0; i < writes; i++ {
+			if err := userAPI.InputAccountData(ctx, &api.InputAccountDataRequest{
+				UserID:      accRes.Account.UserID,
+				DataType:    "m.test",
+				AccountData: []byte(fmt.Sprintf(`{"n":%d}`, i)),
+			}, &api.InputAccountDataResponse{}); err != nil {
+				t.Fatalf("failed to input account data: %s", err)
+			}
+		}
+
+		// Incremental syncs must only ever move forward and must eventually
+		// return the last value written, once per response.
+		last := int64(-1)
+		deadline := time.Now().Add(5 * time.Second)
+		for last != writes-1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for the last write, got %d", last)
+			}
+			res := sync(since)
+			events := res.Get(`account_data.events.#(type=="m.test")#`).Array()
+			if len(events) > 1 {
+				t.Fatalf("expected m.test at most once per sync, got %d times", len(events))
+			}
+			if len(events) == 1 {
+				n := events[0].Get("content.n").Int()
+				if n < last {
+					t.Fatalf("expected writes in order, got %d after %d", n, last)
+				}
+				last = n
+			}
+			since = res.Get("next_batch").Str
+		}
+	})
+}
+
+func TestStorageQuota(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		base, baseClose := testrig.CreateBaseDendrite(t, dbType)
+		defer baseClose()
+
+		rsAPI := roomserver.NewInternalAPI(base)
+		rsAPI.SetFederationAPI(nil, nil)
+		keyAPI := keyserver.NewInternalAPI(base, &base.Cfg.KeyServer, nil, rsAPI)
+		userAPI := userapi.NewInternalAPI(base, &base.Cfg.UserAPI, nil, keyAPI, rsAPI, nil)
+		keyAPI.SetUserAPI(userAPI)
+
+		accRes := &api.PerformAccountCreationResponse{}
+		if err := userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+			AccountType: api.AccountTypeUser,
+			Localpart:   "alice",
+			Password:    "someRandomPassword",
+		}, accRes); err != nil {
+			t.Fatalf("failed to create account: %s", err)
+		}
+		userID := accRes.Account.UserID
+		queryAccountData := func() *api.QueryAccountDataResponse {
+			t.Helper()
+			dataRes := &api.QueryAccountDataResponse{}
+			if err := userAPI.QueryAccountData(ctx, &api.QueryAccountDataRequest{UserID: userID}, dataRes); err != nil {
+				t.Fatalf("failed to query account data: %s", err)
+			}
+			return dataRes
+		}
+
+		// The default push rules are stored as account data when the account
+		// is created, so they count towards the quota too.
+		var initialSize int64
+		for _, data := range queryAccountData().GlobalAccountData {
+			initialSize += int64(len(data))
+		}
+		base.Cfg.UserAPI.StorageQuotaPerUser = initialSize + 100
+
+		blob := func(size int) []byte {
+			// {"a":"..."} is 8 bytes longer than the padding
+			return []byte(`{"a":"` + strings.Repeat("x", size-8) + `"}`)
+		}
+		wantQuotaExceeded := func(t *testing.T, err error, want bool) {
+			t.Helper()
+			var quotaErr *api.ErrorStorageQuotaExceeded
+			if got := errors.As(err, &quotaErr); got != want {
+				t.Fatalf("expected quota exceeded %v, got error %v", want, err)
+			}
+			if !want && err != nil {
+				t.Fatalf("expected no error, got %s", err)
+			}
+		}
+		inputAccountData := func(roomID, dataType string, content []byte) error {
+			return userAPI.InputAccountData(ctx, &api.InputAccountDataRequest{
+				UserID:      userID,
+				RoomID:      roomID,
+				DataType:    dataType,
+				AccountData: content,
+			}, &api.InputAccountDataResponse{})
+		}
+		updateFilterUsage := func(size, added int64) error {
+			return userAPI.PerformFilterUsageUpdate(ctx, &api.PerformFilterUsageUpdateRequest{
+				UserID: userID,
+				Size:   size,
+				Added:  added,
+			}, &api.PerformFilterUsageUpdateResponse{})
+		}
+
+		wantQuotaExceeded(t, inputAccountData("", "org.example.a", blob(60)), false)
+		wantQuotaExceeded(t, inputAccountData("!room:test", "org.example.b", blob(50)), true)
+		// Replacing account data doesn't count it twice.
+		wantQuotaExceeded(t, inputAccountData("", "org.example.a", blob(80)), false)
+		// Filters count towards the same quota as account data.
+		wantQuotaExceeded(t, updateFilterUsage(0, 30), true)
+		wantQuotaExceeded(t, updateFilterUsage(0, 20), false)
+		// The size of filters which are stored already is always recorded.
+		wantQuotaExceeded(t, updateFilterUsage(1000, 0), false)
+		wantQuotaExceeded(t, inputAccountData("", "org.example.c", blob(10)), true)
+		wantQuotaExceeded(t, updateFilterUsage(20, 0), false)
+		wantQuotaExceeded(t, inputAccountData("", "org.example.a", blob(81)), true)
+
+		// Once the quota is exceeded, existing data can still be read, and
+		// shrunk to make room.
+		base.Cfg.UserAPI.StorageQuotaPerUser = initialSize + 50
+		wantQuotaExceeded(t, inputAccountData("!room:test", "org.example.b", blob(10)), true)
+		if got := string(queryAccountData().GlobalAccountData["org.example.a"]); got != string(blob(80)) {
+			t.Fatalf("expected existing account data to be readable, got %q", got)
+		}
+		wantQuotaExceeded(t, inputAccountData("", "org.example.a", blob(20)), false)
+		wantQuotaExceeded(t, inputAccountData("!room:test", "org.example.b", blob(10)), false)
+	})
+}
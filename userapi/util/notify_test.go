@@ -106,7 +106,7 @@ func TestNotifyUserCountsAsync(t *testing.T) {
 		}
 
 		// Notify the user about a new notification
-		if err := userUtil.NotifyUserCountsAsync(ctx, pushgateway.NewHTTPClient(true), aliceLocalpart, serverName, db); err != nil {
+		if err := userUtil.NotifyUserCountsAsync(ctx, pushgateway.NewHTTPClient(true, &config.RetryAfterOptions{}), aliceLocalpart, serverName, db); err != nil {
 			t.Error(err)
 		}
 		select {